@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// AccessLogQueueSize is how many access log entries may wait to be written.
+// If more are waiting, we drop new ones rather than block the event loop.
+const AccessLogQueueSize = 1024
+
+// AccessLog writes an entry to a file each time a user connects or
+// disconnects. Each entry is a line of JSON.
+//
+// A goroutine does the writing. The event loop hands it entries through a
+// channel.
+type AccessLog struct {
+	path string
+
+	// Entries to write. We close this to stop the goroutine.
+	entries chan AccessLogEntry
+
+	// Tell the goroutine to reopen the file. e.g., after rotating it.
+	reopen chan struct{}
+
+	// Where we report problems writing.
+	logger Logger
+}
+
+// AccessLogEntry is a line in the access log.
+type AccessLogEntry struct {
+	Time           string `json:"time"`
+	Event          string `json:"event"`
+	IP             string `json:"ip"`
+	Nick           string `json:"nick"`
+	User           string `json:"user"`
+	Host           string `json:"host"`
+	Country        string `json:"country,omitempty"`
+	TLSVersion     string `json:"tls_version,omitempty"`
+	TLSCipherSuite string `json:"tls_cipher_suite,omitempty"`
+	Reason         string `json:"reason,omitempty"`
+}
+
+// startAccessLog opens the access log and starts the goroutine writing to it.
+func (cb *Catbox) startAccessLog() error {
+	f, err := openAccessLog(cb.Config.AccessLog)
+	if err != nil {
+		return err
+	}
+
+	accessLog := &AccessLog{
+		path:    cb.Config.AccessLog,
+		entries: make(chan AccessLogEntry, AccessLogQueueSize),
+		reopen:  make(chan struct{}, 1),
+		logger:  cb.Logger,
+	}
+	cb.AccessLog = accessLog
+
+	cb.WG.Add(1)
+	go func() {
+		defer cb.WG.Done()
+		accessLog.run(f)
+	}()
+
+	return nil
+}
+
+// stopAccessLog stops the access log goroutine once it writes what is
+// waiting.
+func (cb *Catbox) stopAccessLog() {
+	close(cb.AccessLog.entries)
+	cb.AccessLog = nil
+}
+
+// openAccessLog opens the file to append to. Only we may read it as it holds
+// users' IPs.
+func openAccessLog(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open access log: %s", err)
+	}
+	return f, nil
+}
+
+// run writes entries to the file until the entries channel closes.
+func (a *AccessLog) run(f *os.File) {
+	defer func() {
+		if err := f.Close(); err != nil {
+			a.logger.Error("Error closing access log: %s", err)
+		}
+		a.logger.Debug("Access log shutting down.")
+	}()
+
+	for {
+		select {
+		case entry, ok := <-a.entries:
+			if !ok {
+				return
+			}
+
+			buf, err := json.Marshal(entry)
+			if err != nil {
+				a.logger.Error("Unable to encode access log entry: %s", err)
+				continue
+			}
+
+			if _, err := f.Write(append(buf, '\n')); err != nil {
+				a.logger.Error("Unable to write to access log: %s", err)
+			}
+		case <-a.reopen:
+			newF, err := openAccessLog(a.path)
+			if err != nil {
+				a.logger.Error("%s", err)
+				continue
+			}
+
+			if err := f.Close(); err != nil {
+				a.logger.Error("Error closing access log: %s", err)
+			}
+			f = newF
+		}
+	}
+}
+
+// logAccess adds an entry to the access log, if we have one. We never block.
+// If too many entries are waiting, we drop this one.
+func (cb *Catbox) logAccess(entry AccessLogEntry) {
+	if cb.AccessLog == nil {
+		return
+	}
+
+	entry.Time = time.Now().UTC().Format(time.RFC3339)
+	entry.Event = sanitizeLogValue(entry.Event)
+	entry.IP = sanitizeLogValue(entry.IP)
+	entry.Nick = sanitizeLogValue(entry.Nick)
+	entry.User = sanitizeLogValue(entry.User)
+	entry.Host = sanitizeLogValue(entry.Host)
+	entry.Reason = sanitizeLogValue(entry.Reason)
+
+	select {
+	case cb.AccessLog.entries <- entry:
+	default:
+		cb.Logger.Warn("Access log queue is full. Dropping entry.")
+	}
+}
+
+// reopenAccessLog tells the access log goroutine to reopen the file. We do this
+// when we rehash so the file can be rotated.
+func (cb *Catbox) reopenAccessLog() {
+	if cb.AccessLog == nil {
+		return
+	}
+
+	select {
+	case cb.AccessLog.reopen <- struct{}{}:
+	default:
+		// It's going to reopen already.
+	}
+}
+
+// sanitizeLogValue replaces control characters so that a value can't mess up
+// the log or a terminal showing it.
+func sanitizeLogValue(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return '?'
+		}
+		return r
+	}, s)
+}
+
+// accessLogEntry makes an access log entry about a local user.
+func (u *LocalUser) accessLogEntry(event string) AccessLogEntry {
+	host := u.Hostname
+	if host == "" {
+		host = u.User.Hostname
+	}
+
+	return AccessLogEntry{
+		Event:   event,
+		IP:      u.Conn.IP.String(),
+		Nick:    u.User.DisplayNick,
+		User:    u.User.Username,
+		Host:    host,
+		Country: u.Country,
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAccessLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catbox-access-log-")
+	if err != nil {
+		t.Fatalf("unable to make temporary directory: %s", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	cb := newSnapshotCatbox()
+	cb.Config.AccessLog = filepath.Join(dir, "access.log")
+	if err := cb.startAccessLog(); err != nil {
+		t.Fatalf("unable to start access log: %s", err)
+	}
+
+	alice := addCallerIDTestUser(cb, 0, "alice")
+	alice.Conn.IP = net.ParseIP("192.168.1.5")
+
+	entry := alice.accessLogEntry("connect")
+	entry.TLSVersion = "TLS 1.3"
+	entry.TLSCipherSuite = "TLS_AES_128_GCM_SHA256"
+	cb.logAccess(entry)
+
+	alice.quit("Bye\x01\x1b[31m", true)
+
+	cb.stopAccessLog()
+	cb.WG.Wait()
+
+	if cb.AccessLog != nil {
+		t.Errorf("access log is still set after stopping")
+	}
+
+	// We don't log after stopping.
+	cb.logAccess(entry)
+
+	buf, err := ioutil.ReadFile(cb.Config.AccessLog)
+	if err != nil {
+		t.Fatalf("unable to read access log: %s", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(buf)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("access log has %d lines, wanted 2: %q", len(lines), lines)
+	}
+
+	wanted := []map[string]string{
+		{
+			"event":            "connect",
+			"ip":               "192.168.1.5",
+			"nick":             "alice",
+			"user":             "user",
+			"host":             "host.example.com",
+			"tls_version":      "TLS 1.3",
+			"tls_cipher_suite": "TLS_AES_128_GCM_SHA256",
+		},
+		{
+			"event":  "disconnect",
+			"ip":     "192.168.1.5",
+			"nick":   "alice",
+			"user":   "user",
+			"host":   "host.example.com",
+			"reason": "Bye??[31m",
+		},
+	}
+
+	for i, line := range lines {
+		var got map[string]string
+		if err := json.Unmarshal([]byte(line), &got); err != nil {
+			t.Errorf("line %d is not JSON: %s: %s", i, line, err)
+			continue
+		}
+
+		if got["time"] == "" {
+			t.Errorf("line %d has no time: %s", i, line)
+		}
+		delete(got, "time")
+
+		if len(got) != len(wanted[i]) {
+			t.Errorf("line %d = %v, wanted %v", i, got, wanted[i])
+			continue
+		}
+		for k, v := range wanted[i] {
+			if got[k] != v {
+				t.Errorf("line %d %s = %q, wanted %q", i, k, got[k], v)
+			}
+		}
+	}
+}
+
+func TestSanitizeLogValue(t *testing.T) {
+	tests := []struct {
+		input  string
+		output string
+	}{
+		{"hello", "hello"},
+		{"a\r\nb", "a??b"},
+		{"\x00\x7f", "??"},
+		{"héllo", "héllo"},
+	}
+
+	for _, test := range tests {
+		if got := sanitizeLogValue(test.input); got != test.output {
+			t.Errorf("sanitizeLogValue(%q) = %q, wanted %q", test.input, got,
+				test.output)
+		}
+	}
+}
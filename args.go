@@ -11,12 +11,18 @@ import (
 type Args struct {
 	ConfigFile string
 	ListenFD   int
+
+	// Whether to write the config as JSON to stdout and exit.
+	DumpConfig bool
 }
 
 func getArgs() *Args {
-	configFile := flag.String("conf", "", "Configuration file.")
+	configFile := flag.String("conf", "",
+		"Configuration file. If its name ends in .json, it is JSON.")
 	fd := flag.Int("listen-fd", -1,
 		"File descriptor with listening port to use (optional).")
+	dumpConfig := flag.Bool("dump-config", false,
+		"Write the configuration as JSON to stdout and exit.")
 
 	flag.Parse()
 
@@ -35,6 +41,7 @@ func getArgs() *Args {
 	return &Args{
 		ConfigFile: configPath,
 		ListenFD:   *fd,
+		DumpConfig: *dumpConfig,
 	}
 }
 
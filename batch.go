@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/horgh/irc"
+)
+
+// openBatch starts an IRCv3 batch of the given type. We tag the messages we
+// send the client until closeBatch with the batch's reference. params are any
+// parameters of the batch type, such as a channel name.
+//
+// It returns the reference. If the client does not have the batch capability,
+// we don't start a batch and return a blank reference.
+func (u *LocalUser) openBatch(batchType string, params []string) string {
+	if !u.hasCap("batch") {
+		return ""
+	}
+
+	u.NextBatchID++
+	ref := fmt.Sprintf("%d", u.NextBatchID)
+
+	u.maybeQueueMessage(irc.Message{
+		Prefix:  u.Catbox.Config.ServerName,
+		Command: "BATCH",
+		Params:  append([]string{"+" + ref, batchType}, params...),
+	})
+
+	u.BatchRef = ref
+	return ref
+}
+
+// closeBatch ends a batch openBatch started.
+func (u *LocalUser) closeBatch(ref string) {
+	if ref == "" {
+		return
+	}
+
+	u.BatchRef = ""
+
+	u.maybeQueueMessage(irc.Message{
+		Prefix:  u.Catbox.Config.ServerName,
+		Command: "BATCH",
+		Params:  []string{"-" + ref},
+	})
+}
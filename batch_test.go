@@ -0,0 +1,101 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/horgh/irc"
+)
+
+func TestBatch(t *testing.T) {
+	tests := []struct {
+		caps   []string
+		output []string
+		// The batch tag we expect on the message inside the batch.
+		batchTag string
+	}{
+		{
+			[]string{"batch"},
+			[]string{
+				"BATCH +1 chathistory #test",
+				"PRIVMSG #test hi",
+				"BATCH -1",
+				"PRIVMSG #test bye",
+			},
+			"1",
+		},
+		{
+			nil,
+			[]string{
+				"PRIVMSG #test hi",
+				"PRIVMSG #test bye",
+			},
+			"",
+		},
+	}
+
+	for _, test := range tests {
+		u := &LocalUser{
+			LocalClient: &LocalClient{
+				Catbox:    &Catbox{Config: &Config{ServerName: "irc.example.com"}},
+				WriteChan: make(chan TaggedMessage, 10),
+				Caps:      map[string]struct{}{},
+			},
+			User: &User{DisplayNick: "nick"},
+		}
+		for _, cap := range test.caps {
+			u.Caps[cap] = struct{}{}
+		}
+
+		ref := u.openBatch("chathistory", []string{"#test"})
+		u.maybeQueueMessage(irc.Message{Command: "PRIVMSG",
+			Params: []string{"#test", "hi"}})
+		u.closeBatch(ref)
+		u.maybeQueueMessage(irc.Message{Command: "PRIVMSG",
+			Params: []string{"#test", "bye"}})
+
+		if len(u.WriteChan) != len(test.output) {
+			t.Errorf("caps %q: sent %d messages, wanted %d", test.caps,
+				len(u.WriteChan), len(test.output))
+			continue
+		}
+
+		for _, want := range test.output {
+			m := <-u.WriteChan
+			got := m.Command + " " + strings.Join(m.Params, " ")
+			if got != want {
+				t.Errorf("caps %q: sent %s, wanted %s", test.caps, got, want)
+			}
+
+			wantTag := ""
+			if m.Command == "PRIVMSG" && m.Params[1] == "hi" {
+				wantTag = test.batchTag
+			}
+			if m.Tags["batch"] != wantTag {
+				t.Errorf("caps %q: %s has batch tag %q, wanted %q", test.caps, got,
+					m.Tags["batch"], wantTag)
+			}
+		}
+	}
+}
+
+func TestBatchReferencesDiffer(t *testing.T) {
+	u := &LocalUser{
+		LocalClient: &LocalClient{
+			Catbox:    &Catbox{Config: &Config{ServerName: "irc.example.com"}},
+			WriteChan: make(chan TaggedMessage, 10),
+			Caps:      map[string]struct{}{"batch": {}},
+		},
+		User: &User{DisplayNick: "nick"},
+	}
+
+	ref1 := u.openBatch("chathistory", []string{"#test"})
+	u.closeBatch(ref1)
+	ref2 := u.openBatch("chathistory", []string{"#test"})
+	u.closeBatch(ref2)
+
+	if ref1 == "" || ref1 == ref2 {
+		t.Errorf("batch references are %q and %q, wanted two different ones",
+			ref1, ref2)
+	}
+}
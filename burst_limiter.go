@@ -0,0 +1,78 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// BurstLimiter limits how fast we read messages from a server while it is
+// bursting. Without it, a server with a large burst can send thousands of
+// messages at once and keep the event loop from doing anything else.
+//
+// It is a token bucket holding up to one second's worth of messages.
+//
+// Only the client's read goroutine touches the bucket. The event loop turns the
+// limiter on and off, so that flag is atomic.
+type BurstLimiter struct {
+	// Messages per second.
+	rate float64
+
+	tokens float64
+
+	// When we last took a token. Zero if we have not yet.
+	last time.Time
+
+	// 1 if we are limiting.
+	active int32
+}
+
+// NewBurstLimiter creates a BurstLimiter allowing rate messages per second. It
+// starts off inactive.
+func NewBurstLimiter(rate int) *BurstLimiter {
+	return &BurstLimiter{rate: float64(rate)}
+}
+
+// start turns on limiting. We do this when a server's burst begins.
+func (b *BurstLimiter) start() {
+	if b == nil {
+		return
+	}
+	atomic.StoreInt32(&b.active, 1)
+}
+
+// stop turns off limiting. We do this when a server's burst completes.
+func (b *BurstLimiter) stop() {
+	if b == nil {
+		return
+	}
+	atomic.StoreInt32(&b.active, 0)
+}
+
+func (b *BurstLimiter) isActive() bool {
+	return b != nil && atomic.LoadInt32(&b.active) == 1
+}
+
+// delay takes a token for a message read at the given time. It returns how
+// long to wait before reading the next message, or 0 if we need not wait.
+func (b *BurstLimiter) delay(now time.Time) time.Duration {
+	if !b.isActive() {
+		return 0
+	}
+
+	if b.last.IsZero() {
+		b.tokens = b.rate
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.rate {
+			b.tokens = b.rate
+		}
+	}
+	b.last = now
+
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBurstLimiterDelay(t *testing.T) {
+	start := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	b := NewBurstLimiter(2)
+
+	// Inactive. No limit.
+	for i := 0; i < 5; i++ {
+		if d := b.delay(start); d != 0 {
+			t.Errorf("inactive delay() = %s, wanted 0", d)
+		}
+	}
+
+	b.start()
+
+	tests := []struct {
+		now    time.Time
+		output time.Duration
+	}{
+		// Start with a full bucket: 2 tokens.
+		{start, 0},
+		{start, 0},
+		// Empty. We need half a second for another token.
+		{start, 500 * time.Millisecond},
+		// We waited. We're back to empty.
+		{start.Add(500 * time.Millisecond), 500 * time.Millisecond},
+		// A long wait only refills to 2 tokens.
+		{start.Add(10 * time.Second), 0},
+		{start.Add(10 * time.Second), 0},
+		{start.Add(10 * time.Second), 500 * time.Millisecond},
+	}
+
+	for i, test := range tests {
+		if d := b.delay(test.now); d != test.output {
+			t.Errorf("delay() #%d = %s, wanted %s", i, d, test.output)
+		}
+	}
+
+	b.stop()
+
+	if d := b.delay(start.Add(10 * time.Second)); d != 0 {
+		t.Errorf("stopped delay() = %s, wanted 0", d)
+	}
+}
+
+func TestBurstLimiterNil(t *testing.T) {
+	var b *BurstLimiter
+
+	b.start()
+	if d := b.delay(time.Now()); d != 0 {
+		t.Errorf("nil delay() = %s, wanted 0", d)
+	}
+	b.stop()
+}
+
+// BenchmarkReadLoop measures how many messages per second a client's
+// readLoop passes to the event loop.
+func BenchmarkReadLoop(b *testing.B) {
+	b.Run("unlimited", func(b *testing.B) {
+		benchmarkReadLoop(b, 0)
+	})
+	b.Run("limited", func(b *testing.B) {
+		benchmarkReadLoop(b, 10000)
+	})
+}
+
+func benchmarkReadLoop(b *testing.B, rate int) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("unable to listen: %s", err)
+	}
+	defer func() {
+		_ = ln.Close()
+	}()
+
+	// Write b.N messages as a bursting peer would.
+	var writerWG sync.WaitGroup
+	writerWG.Add(1)
+	go func() {
+		defer writerWG.Done()
+
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			b.Errorf("unable to dial: %s", err)
+			return
+		}
+		defer func() {
+			_ = conn.Close()
+		}()
+
+		for i := 0; i < b.N; i++ {
+			if _, err := fmt.Fprintf(conn, ":000 PING :%d\r\n", i); err != nil {
+				b.Errorf("unable to write: %s", err)
+				return
+			}
+		}
+	}()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		b.Fatalf("unable to accept: %s", err)
+	}
+
+	cb := &Catbox{
+		Config:       &Config{DeadTime: time.Minute, BurstRateLimit: rate},
+		ShutdownChan: make(chan struct{}),
+		ToServerChan: make(chan Event),
+		Logger:       newTestLogger(),
+	}
+
+	c := NewLocalClient(cb, 1, conn)
+	c.BurstLimiter.start()
+
+	b.ResetTimer()
+
+	cb.WG.Add(1)
+	go c.readLoop()
+
+	// Act as the event loop.
+	for i := 0; i < b.N; i++ {
+		if evt := <-cb.ToServerChan; evt.Type != MessageFromClientEvent {
+			b.Fatalf("unexpected event: %d", evt.Type)
+		}
+	}
+
+	b.StopTimer()
+
+	writerWG.Wait()
+	close(cb.ShutdownChan)
+	_ = conn.Close()
+	cb.WG.Wait()
+}
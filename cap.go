@@ -0,0 +1,131 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/horgh/irc"
+)
+
+// SupportedCaps are the IRCv3 capabilities clients may request with CAP REQ.
+var SupportedCaps = map[string]struct{}{
+	"batch":             {},
+	"chghost":           {},
+	"draft/chathistory": {},
+	"invite-notify":     {},
+	"message-tags":      {},
+	"metadata":          {},
+	"server-time":       {},
+}
+
+// capCommand handles CAP. This is how clients negotiate IRCv3 capabilities.
+//
+// nick is who to address replies to. This is * if the client has not yet
+// registered and not told us a nick.
+//
+// If the client has not yet registered and it starts negotiating, we hold off
+// on registration until it sends CAP END.
+func (c *LocalClient) capCommand(m irc.Message, nick string,
+	registered bool) {
+	if len(m.Params) == 0 {
+		// 461 ERR_NEEDMOREPARAMS
+		c.maybeQueueMessage(irc.Message{
+			Prefix:  c.Catbox.Config.ServerName,
+			Command: "461",
+			Params:  []string{nick, "CAP", "Not enough parameters"},
+		})
+		return
+	}
+
+	subCommand := strings.ToUpper(m.Params[0])
+
+	switch subCommand {
+	case "LS":
+		if !registered {
+			c.CapNegotiating = true
+		}
+		c.capReply(nick, "LS", capsString(SupportedCaps))
+	case "LIST":
+		c.capReply(nick, "LIST", capsString(c.Caps))
+	case "REQ":
+		if !registered {
+			c.CapNegotiating = true
+		}
+
+		requested := ""
+		if len(m.Params) > 1 {
+			requested = m.Params[1]
+		}
+
+		// We acknowledge all of them or none of them.
+		add := map[string]struct{}{}
+		remove := map[string]struct{}{}
+		for _, cap := range strings.Fields(requested) {
+			if cap[0] == '-' {
+				if _, ok := SupportedCaps[cap[1:]]; !ok {
+					c.capReply(nick, "NAK", requested)
+					return
+				}
+				remove[cap[1:]] = struct{}{}
+				continue
+			}
+
+			if _, ok := SupportedCaps[cap]; !ok {
+				c.capReply(nick, "NAK", requested)
+				return
+			}
+			add[cap] = struct{}{}
+		}
+
+		for cap := range add {
+			c.Caps[cap] = struct{}{}
+		}
+		for cap := range remove {
+			delete(c.Caps, cap)
+		}
+
+		c.capReply(nick, "ACK", requested)
+	case "END":
+		if registered || !c.CapNegotiating {
+			return
+		}
+		c.CapNegotiating = false
+
+		// They may have sent NICK and USER while we negotiated.
+		if len(c.PreRegDisplayNick) > 0 && len(c.PreRegUser) > 0 {
+			c.registerUser()
+		}
+	default:
+		// 410 ERR_INVALIDCAPCMD
+		c.maybeQueueMessage(irc.Message{
+			Prefix:  c.Catbox.Config.ServerName,
+			Command: "410",
+			Params:  []string{nick, m.Params[0], "Invalid CAP command"},
+		})
+	}
+}
+
+func (c *LocalClient) capReply(nick, subCommand, caps string) {
+	c.maybeQueueMessage(irc.Message{
+		Prefix:  c.Catbox.Config.ServerName,
+		Command: "CAP",
+		Params:  []string{nick, subCommand, caps},
+	})
+}
+
+// hasCap checks whether the client negotiated the given capability.
+func (c *LocalClient) hasCap(cap string) bool {
+	_, exists := c.Caps[cap]
+	return exists
+}
+
+// Turn a set of capabilities into a space separated string. We sort them so
+// the string is the same each time.
+func capsString(caps map[string]struct{}) string {
+	names := make([]string, 0, len(caps))
+	for cap := range caps {
+		names = append(names, cap)
+	}
+	sort.Strings(names)
+	return strings.Join(names, " ")
+}
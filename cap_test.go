@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/horgh/irc"
+)
+
+func TestCapCommand(t *testing.T) {
+	tests := []struct {
+		params []string
+		// The reply we expect. Blank if none.
+		reply       string
+		caps        string
+		negotiating bool
+	}{
+		{[]string{"LS", "302"},
+			"CAP * LS batch chghost draft/chathistory invite-notify message-tags metadata server-time", "", true},
+		{[]string{"REQ", "draft/chathistory"}, "CAP * ACK draft/chathistory",
+			"draft/chathistory", true},
+		{[]string{"REQ", "draft/chathistory unknown"},
+			"CAP * NAK draft/chathistory unknown", "", true},
+		{[]string{"REQ", "-draft/chathistory"}, "CAP * ACK -draft/chathistory", "",
+			true},
+		{[]string{"LIST"}, "CAP * LIST ", "", false},
+		{[]string{"BLAH"}, "410 * BLAH Invalid CAP command", "", false},
+	}
+
+	for _, test := range tests {
+		c := &LocalClient{
+			Catbox:    &Catbox{Config: &Config{ServerName: "irc.example.com"}},
+			WriteChan: make(chan TaggedMessage, 10),
+			Caps:      map[string]struct{}{},
+		}
+
+		// Removing a cap needs one to remove.
+		if test.params[0] == "REQ" && test.params[1][0] == '-' {
+			c.Caps["draft/chathistory"] = struct{}{}
+		}
+
+		c.capCommand(irc.Message{Command: "CAP", Params: test.params}, "*", false)
+
+		reply := ""
+		if len(c.WriteChan) > 0 {
+			m := <-c.WriteChan
+			reply = m.Command + " " + strings.Join(m.Params, " ")
+		}
+		if reply != test.reply {
+			t.Errorf("capCommand(%v) replied %q, wanted %q", test.params, reply,
+				test.reply)
+		}
+
+		if capsString(c.Caps) != test.caps {
+			t.Errorf("capCommand(%v) left caps %q, wanted %q", test.params,
+				capsString(c.Caps), test.caps)
+		}
+
+		if c.CapNegotiating != test.negotiating {
+			t.Errorf("capCommand(%v) left negotiating %v, wanted %v", test.params,
+				c.CapNegotiating, test.negotiating)
+		}
+	}
+}
+
+func TestCapCommandEnd(t *testing.T) {
+	c := &LocalClient{
+		Catbox:         &Catbox{Config: &Config{ServerName: "irc.example.com"}},
+		WriteChan:      make(chan TaggedMessage, 10),
+		Caps:           map[string]struct{}{},
+		CapNegotiating: true,
+	}
+
+	c.capCommand(irc.Message{Command: "CAP", Params: []string{"END"}}, "*", false)
+
+	if c.CapNegotiating {
+		t.Errorf("capCommand(END) left us negotiating")
+	}
+}
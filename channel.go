@@ -1,6 +1,13 @@
 package main
 
-import "github.com/horgh/irc"
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/horgh/irc"
+)
 
 // Channel holds everything to do with a channel.
 type Channel struct {
@@ -14,6 +21,38 @@ type Channel struct {
 	// Ops tracks users who have ops in the channel.
 	Ops map[TS6UID]*User
 
+	// Voices tracks users who have voice in the channel.
+	Voices map[TS6UID]*User
+
+	// HalfOps tracks users who are half-operators (+h). They may kick, ban, and
+	// voice users without ops.
+	HalfOps map[TS6UID]*User
+
+	// Owners tracks users who are channel owners (+q). Owners may do anything
+	// ops may, whether or not they are +o.
+	Owners map[TS6UID]*User
+
+	// Bans set on the channel (+b).
+	Bans []BanEntry
+
+	// Ban exceptions set on the channel (+e). Users matching one are not
+	// affected by bans.
+	BanExceptions []BanEntry
+
+	// Quiets set on the channel (+Q). Users matching one may join but not
+	// speak. Ban exceptions override them.
+	Quiets []BanEntry
+
+	// Channel key (+k). Blank if there is none.
+	Key string
+
+	// Maximum number of members (+l). 0 if there is no limit.
+	Limit int
+
+	// Users invited to the channel and when. They may join even if it is +i.
+	// Invites expire after inviteExpiry.
+	Invites map[TS6UID]time.Time
+
 	// Current topic. May be blank.
 	Topic string
 
@@ -29,11 +68,77 @@ type Channel struct {
 	// Channel TS. Changes on channel creation (or if another server tells us
 	// a different TS).
 	TS int64
+
+	// Recent messages sent to the channel. Oldest first.
+	History []*HistoryEntry
+
+	// Metadata set on the channel (METADATA). Key to value.
+	Metadata map[string]string
 }
 
-// Check if a user has operator status in the channel.
+// BanEntry is a mask set on a channel, such as a ban.
+type BanEntry struct {
+	// nick!user@host. May contain wildcards.
+	Mask string
+
+	// Who set it. Nick or server name.
+	Setter string
+
+	// When it was set.
+	TS int64
+}
+
+// modesString returns the channel's modes as a string, such as +ns. We sort
+// them so the string is the same each time.
+func (c *Channel) modesString() string {
+	modes := make([]string, 0, len(c.Modes))
+	for m := range c.Modes {
+		modes = append(modes, string(m))
+	}
+	sort.Strings(modes)
+	return "+" + strings.Join(modes, "")
+}
+
+// modesWithParams returns the channel's modes including those with
+// parameters: The mode string followed by the parameters. e.g., +nskl key 10
+func (c *Channel) modesWithParams() []string {
+	modeStr := c.modesString()
+	params := []string{}
+
+	if c.Key != "" {
+		modeStr += "k"
+		params = append(params, c.Key)
+	}
+
+	if c.Limit > 0 {
+		modeStr += "l"
+		params = append(params, strconv.Itoa(c.Limit))
+	}
+
+	return append([]string{modeStr}, params...)
+}
+
+// Check if a user has operator status in the channel. Owners count.
 func (c *Channel) userHasOps(u *User) bool {
 	_, exists := c.Ops[u.UID]
+	return exists || c.userIsOwner(u)
+}
+
+// Check if a user is a half-operator in the channel.
+func (c *Channel) userIsHalfOp(u *User) bool {
+	_, exists := c.HalfOps[u.UID]
+	return exists
+}
+
+// Check if a user is a channel owner.
+func (c *Channel) userIsOwner(u *User) bool {
+	_, exists := c.Owners[u.UID]
+	return exists
+}
+
+// Check if a user has voice in the channel.
+func (c *Channel) userHasVoice(u *User) bool {
+	_, exists := c.Voices[u.UID]
 	return exists
 }
 
@@ -49,6 +154,21 @@ func (c *Channel) removeUser(u *User) {
 		delete(c.Ops, u.UID)
 	}
 
+	_, exists = c.Voices[u.UID]
+	if exists {
+		delete(c.Voices, u.UID)
+	}
+
+	_, exists = c.HalfOps[u.UID]
+	if exists {
+		delete(c.HalfOps, u.UID)
+	}
+
+	_, exists = c.Owners[u.UID]
+	if exists {
+		delete(c.Owners, u.UID)
+	}
+
 	_, exists = u.Channels[c.Name]
 	if exists {
 		delete(u.Channels, c.Name)
@@ -68,6 +188,194 @@ func (c *Channel) removeOps(u *User) {
 	}
 }
 
+// Grant a user voice.
+func (c *Channel) grantVoice(u *User) {
+	if c.Voices == nil {
+		c.Voices = make(map[TS6UID]*User)
+	}
+	c.Voices[u.UID] = u
+}
+
+// Remove voice from a user.
+func (c *Channel) removeVoice(u *User) {
+	_, exists := c.Voices[u.UID]
+	if exists {
+		delete(c.Voices, u.UID)
+	}
+}
+
+// Make a user a half-operator.
+func (c *Channel) grantHalfOp(u *User) {
+	if c.HalfOps == nil {
+		c.HalfOps = make(map[TS6UID]*User)
+	}
+	c.HalfOps[u.UID] = u
+}
+
+// Remove half-operator status from a user.
+func (c *Channel) removeHalfOp(u *User) {
+	_, exists := c.HalfOps[u.UID]
+	if exists {
+		delete(c.HalfOps, u.UID)
+	}
+}
+
+// Make a user a channel owner.
+func (c *Channel) grantOwner(u *User) {
+	if c.Owners == nil {
+		c.Owners = make(map[TS6UID]*User)
+	}
+	c.Owners[u.UID] = u
+}
+
+// Remove owner status from a user.
+func (c *Channel) removeOwner(u *User) {
+	_, exists := c.Owners[u.UID]
+	if exists {
+		delete(c.Owners, u.UID)
+	}
+}
+
+// membershipPrefix is the prefix we show before a member's nick, such as in
+// NAMES. We show only the highest: ~ for owners, @ for ops, % for half-ops,
+// + for voice.
+func (c *Channel) membershipPrefix(u *User) string {
+	if c.userIsOwner(u) {
+		return "~"
+	}
+	if c.userHasOps(u) {
+		return "@"
+	}
+	if c.userIsHalfOp(u) {
+		return "%"
+	}
+	if c.userHasVoice(u) {
+		return "+"
+	}
+	return ""
+}
+
+// Find the index of a mask in a list such as the channel's bans. Masks
+// compare case insensitively. -1 if we don't have it.
+func banIndex(list []BanEntry, mask string) int {
+	for i, ban := range list {
+		if strings.EqualFold(ban.Mask, mask) {
+			return i
+		}
+	}
+	return -1
+}
+
+// addInvite records that a user was invited to the channel.
+func (c *Channel) addInvite(u *User) {
+	if c.Invites == nil {
+		c.Invites = make(map[TS6UID]time.Time)
+	}
+	c.Invites[u.UID] = time.Now()
+}
+
+// isInvited checks whether the user has an invite to the channel.
+func (c *Channel) isInvited(u *User) bool {
+	_, exists := c.Invites[u.UID]
+	return exists
+}
+
+// removeInvite forgets a user's invite to the channel. We do this once they
+// join.
+func (c *Channel) removeInvite(u *User) {
+	delete(c.Invites, u.UID)
+}
+
+// expireInvites forgets invites sent longer than inviteExpiry ago.
+func (c *Channel) expireInvites(now time.Time) {
+	for uid, invited := range c.Invites {
+		if now.Sub(invited) >= inviteExpiry {
+			delete(c.Invites, uid)
+		}
+	}
+}
+
+// isInviteOnly checks whether the channel is +i.
+func (c *Channel) isInviteOnly() bool {
+	_, exists := c.Modes['i']
+	return exists
+}
+
+// isPrivate checks whether the channel is +p.
+func (c *Channel) isPrivate() bool {
+	_, exists := c.Modes['p']
+	return exists
+}
+
+// isSecret checks whether the channel is +s.
+func (c *Channel) isSecret() bool {
+	_, exists := c.Modes['s']
+	return exists
+}
+
+// namesFlag is the channel flag for 353 RPL_NAMREPLY: @ if the channel is
+// secret, * if it is private, and = otherwise. +s takes priority.
+func (c *Channel) namesFlag() string {
+	if c.isSecret() {
+		return "@"
+	}
+	if c.isPrivate() {
+		return "*"
+	}
+	return "="
+}
+
+// stripsColors checks whether the channel is +c. We strip colors and other
+// formatting from messages to it.
+func (c *Channel) stripsColors() bool {
+	_, exists := c.Modes['c']
+	return exists
+}
+
+// Check if a user matches any ban on the channel.
+//
+// A user matching a ban exception is never banned.
+func (c *Channel) isBanned(u *User) bool {
+	for _, ban := range c.Bans {
+		if u.matchesBanMask(ban.Mask) {
+			return !c.isBanExempt(u)
+		}
+	}
+	return false
+}
+
+// Check if a user matches any quiet on the channel.
+//
+// A user matching a ban exception is never quieted.
+func (c *Channel) isQuieted(u *User) bool {
+	for _, quiet := range c.Quiets {
+		if u.matchesBanMask(quiet.Mask) {
+			return !c.isBanExempt(u)
+		}
+	}
+	return false
+}
+
+// Check if a user matches any ban exception on the channel.
+func (c *Channel) isBanExempt(u *User) bool {
+	for _, exception := range c.BanExceptions {
+		if u.matchesBanMask(exception.Mask) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if a user may speak in the channel.
+//
+// Banned and quieted users may not unless they have ops, half-ops, or voice.
+func (c *Channel) canSpeak(u *User) bool {
+	if c.userHasOps(u) || c.userIsHalfOp(u) || c.userHasVoice(u) {
+		return true
+	}
+	return !c.isBanned(u) && !c.isQuieted(u)
+}
+
 // Remove all modes from the channel, and all ops/voices.
 //
 // This informs local users about the mode changes, but no one else.
@@ -82,6 +390,10 @@ func (c *Channel) clearModes(cb *Catbox) {
 		delete(c.Modes, k)
 		modeStr += string(k)
 	}
+	if c.Limit > 0 {
+		c.Limit = 0
+		modeStr += "l"
+	}
 	if len(modeStr) > 0 {
 		msgs = append(msgs, irc.Message{
 			Prefix:  cb.Config.ServerName,
@@ -90,45 +402,74 @@ func (c *Channel) clearModes(cb *Catbox) {
 		})
 	}
 
-	// Clear ops.
+	// Clear modes with parameters: Key, bans, ban exceptions, quiets, ops, and
+	// voices.
 
-	var ops []string
-	for _, op := range c.Ops {
-		ops = append(ops, op.DisplayNick)
+	var changes []ModeChange
 
-		if len(ops) == ChanModesPerCommand {
-			modeStr := "-"
-			for i := 0; i < ChanModesPerCommand; i++ {
-				modeStr += "o"
-			}
+	if c.Key != "" {
+		changes = append(changes, ModeChange{Action: '-', Mode: 'k', Param: c.Key})
+		c.Key = ""
+	}
 
-			params := []string{c.Name, modeStr}
-			params = append(params, ops...)
+	for _, ban := range c.Bans {
+		changes = append(changes, ModeChange{Action: '-', Mode: 'b',
+			Param: ban.Mask})
+	}
+	c.Bans = nil
 
-			msgs = append(msgs, irc.Message{
-				Prefix:  cb.Config.ServerName,
-				Command: "MODE",
-				Params:  params,
-			})
+	for _, exception := range c.BanExceptions {
+		changes = append(changes, ModeChange{Action: '-', Mode: 'e',
+			Param: exception.Mask})
+	}
+	c.BanExceptions = nil
 
-			ops = nil
-		}
+	for _, quiet := range c.Quiets {
+		changes = append(changes, ModeChange{Action: '-', Mode: 'Q',
+			Param: quiet.Mask})
+	}
+	c.Quiets = nil
+
+	for _, op := range c.Ops {
+		changes = append(changes, ModeChange{Action: '-', Mode: 'o',
+			Param: op.DisplayNick})
+	}
+	c.Ops = make(map[TS6UID]*User)
+
+	for _, voice := range c.Voices {
+		changes = append(changes, ModeChange{Action: '-', Mode: 'v',
+			Param: voice.DisplayNick})
+	}
+	c.Voices = make(map[TS6UID]*User)
+
+	for _, halfOp := range c.HalfOps {
+		changes = append(changes, ModeChange{Action: '-', Mode: 'h',
+			Param: halfOp.DisplayNick})
 	}
+	c.HalfOps = make(map[TS6UID]*User)
 
-	if len(ops) > 0 {
-		modeStr := "-"
-		for range ops {
-			modeStr += "o"
+	for _, owner := range c.Owners {
+		changes = append(changes, ModeChange{Action: '-', Mode: 'q',
+			Param: owner.DisplayNick})
+	}
+	c.Owners = make(map[TS6UID]*User)
+
+	for len(changes) > 0 {
+		n := ChanModesPerCommand
+		if len(changes) < n {
+			n = len(changes)
 		}
 
-		params := []string{c.Name, modeStr}
-		params = append(params, ops...)
+		params := []string{c.Name}
+		params = append(params, modeChangesToParams(changes[:n], false)...)
 
 		msgs = append(msgs, irc.Message{
 			Prefix:  cb.Config.ServerName,
 			Command: "MODE",
 			Params:  params,
 		})
+
+		changes = changes[n:]
 	}
 
 	// Fire off the messages.
@@ -136,3 +477,386 @@ func (c *Channel) clearModes(cb *Catbox) {
 		cb.messageLocalUsersOnChannel(c, msg)
 	}
 }
+
+// ModeChange is a single change to a channel's modes.
+type ModeChange struct {
+	// + or -
+	Action byte
+
+	// Mode letter. e.g., o
+	Mode byte
+
+	// The mode's parameter as we show it to users. For +o/+v this is a nick.
+	// Blank if the mode has no parameter.
+	Param string
+
+	// The mode's parameter as we send it to servers. For +o/+v this is a UID.
+	// If blank we send Param.
+	ServerParam string
+}
+
+// applyModes parses a channel mode string along with its parameters and
+// applies each change we support to the channel.
+//
+// Currently I support:
+// - +b/-b (ban)
+// - +c/-c (strip colors)
+// - +e/-e (ban exception)
+// - +i/-i (invite only)
+// - +k/-k (key)
+// - +l/-l (limit)
+// - +o/-o (operator)
+// - +v/-v (voice)
+// - +Q/-Q (quiet)
+//
+// lookupUser resolves the parameter of +o/+v to a user. From users the
+// parameter is a nick. From servers it is a UID. It returns nil if there is no
+// such user.
+//
+// setter is who we record as setting bans and ban exceptions.
+//
+// We apply at most max changes. If max is 0 there is no limit.
+//
+// We return the changes we applied. We skip changes that would not change
+// anything, such as opping someone who already has ops.
+//
+// This does not tell anyone about the changes.
+func (c *Channel) applyModes(modes string, params []string,
+	lookupUser func(string) *User, setter string, max int) []ModeChange {
+	var applied []ModeChange
+
+	action := byte('+')
+
+	// Track what parameter we're on (of those presented).
+	// i.e., if we had "+oo u1 u2", then we start out at index 0 pointing
+	// to u1, then index 1 indicating u2.
+	paramIndex := 0
+
+	for i := 0; i < len(modes); i++ {
+		if max > 0 && len(applied) >= max {
+			break
+		}
+
+		char := modes[i]
+
+		if char == '+' || char == '-' {
+			action = char
+			continue
+		}
+
+		switch char {
+		case 'o', 'v', 'q', 'h':
+			// Must have a parameter.
+			if paramIndex >= len(params) {
+				return applied
+			}
+			param := params[paramIndex]
+			paramIndex++
+
+			targetUser := lookupUser(param)
+			if targetUser == nil || !targetUser.onChannel(c) {
+				continue
+			}
+
+			if char == 'o' {
+				// Owners have ops without +o, so look at +o alone.
+				_, opped := c.Ops[targetUser.UID]
+				if action == '+' {
+					if opped {
+						continue
+					}
+					c.grantOps(targetUser)
+				} else {
+					if !opped {
+						continue
+					}
+					c.removeOps(targetUser)
+				}
+			} else if char == 'h' {
+				if action == '+' {
+					if c.userIsHalfOp(targetUser) {
+						continue
+					}
+					c.grantHalfOp(targetUser)
+				} else {
+					if !c.userIsHalfOp(targetUser) {
+						continue
+					}
+					c.removeHalfOp(targetUser)
+				}
+			} else if char == 'q' {
+				if action == '+' {
+					if c.userIsOwner(targetUser) {
+						continue
+					}
+					c.grantOwner(targetUser)
+				} else {
+					if !c.userIsOwner(targetUser) {
+						continue
+					}
+					c.removeOwner(targetUser)
+				}
+			} else {
+				if action == '+' {
+					if c.userHasVoice(targetUser) {
+						continue
+					}
+					c.grantVoice(targetUser)
+				} else {
+					if !c.userHasVoice(targetUser) {
+						continue
+					}
+					c.removeVoice(targetUser)
+				}
+			}
+
+			applied = append(applied, ModeChange{
+				Action:      action,
+				Mode:        char,
+				Param:       targetUser.DisplayNick,
+				ServerParam: string(targetUser.UID),
+			})
+
+		case 'b', 'e', 'Q':
+			if paramIndex >= len(params) {
+				return applied
+			}
+			mask := normalizeBanMask(params[paramIndex])
+			paramIndex++
+
+			if strings.HasPrefix(mask, "$") && !isValidExtendedBan(mask) {
+				continue
+			}
+
+			list := &c.Bans
+			if char == 'e' {
+				list = &c.BanExceptions
+			}
+			if char == 'Q' {
+				list = &c.Quiets
+			}
+
+			idx := banIndex(*list, mask)
+
+			if action == '+' {
+				if idx != -1 {
+					continue
+				}
+				*list = append(*list, BanEntry{
+					Mask:   mask,
+					Setter: setter,
+					TS:     time.Now().Unix(),
+				})
+			} else {
+				if idx == -1 {
+					continue
+				}
+				mask = (*list)[idx].Mask
+				*list = append((*list)[:idx], (*list)[idx+1:]...)
+			}
+
+			applied = append(applied, ModeChange{Action: action, Mode: char,
+				Param: mask})
+
+		case 'k':
+			if action == '+' {
+				if paramIndex >= len(params) {
+					return applied
+				}
+				key := params[paramIndex]
+				paramIndex++
+
+				if !isValidChannelKey(key) || key == c.Key {
+					continue
+				}
+				c.Key = key
+
+				applied = append(applied, ModeChange{Action: action, Mode: char,
+					Param: key})
+				continue
+			}
+
+			// -k takes a parameter, but it need not match. Accept it missing.
+			if paramIndex < len(params) {
+				paramIndex++
+			}
+
+			if c.Key == "" {
+				continue
+			}
+			key := c.Key
+			c.Key = ""
+
+			applied = append(applied, ModeChange{Action: action, Mode: char,
+				Param: key})
+
+		case 'i':
+			if action == '+' {
+				if c.isInviteOnly() {
+					continue
+				}
+				c.Modes['i'] = struct{}{}
+			} else {
+				if !c.isInviteOnly() {
+					continue
+				}
+				delete(c.Modes, 'i')
+			}
+
+			applied = append(applied, ModeChange{Action: action, Mode: char})
+
+		case 'p':
+			if action == '+' {
+				if c.isPrivate() {
+					continue
+				}
+				c.Modes['p'] = struct{}{}
+			} else {
+				if !c.isPrivate() {
+					continue
+				}
+				delete(c.Modes, 'p')
+			}
+
+			applied = append(applied, ModeChange{Action: action, Mode: char})
+
+		case 's':
+			if action == '+' {
+				if c.isSecret() {
+					continue
+				}
+				c.Modes['s'] = struct{}{}
+			} else {
+				if !c.isSecret() {
+					continue
+				}
+				delete(c.Modes, 's')
+			}
+
+			applied = append(applied, ModeChange{Action: action, Mode: char})
+
+		case 'c':
+			if action == '+' {
+				if c.stripsColors() {
+					continue
+				}
+				c.Modes['c'] = struct{}{}
+			} else {
+				if !c.stripsColors() {
+					continue
+				}
+				delete(c.Modes, 'c')
+			}
+
+			applied = append(applied, ModeChange{Action: action, Mode: char})
+
+		case 'l':
+			if action == '+' {
+				if paramIndex >= len(params) {
+					return applied
+				}
+				limit, err := strconv.Atoi(params[paramIndex])
+				paramIndex++
+
+				if err != nil || limit <= 0 || limit == c.Limit {
+					continue
+				}
+				c.Limit = limit
+
+				applied = append(applied, ModeChange{Action: action, Mode: char,
+					Param: strconv.Itoa(limit)})
+				continue
+			}
+
+			if c.Limit == 0 {
+				continue
+			}
+			c.Limit = 0
+
+			applied = append(applied, ModeChange{Action: action, Mode: char})
+		}
+	}
+
+	return applied
+}
+
+// removesMode checks whether a mode string such as +o-v removes the mode.
+func removesMode(modes string, mode byte) bool {
+	action := byte('+')
+	for i := 0; i < len(modes); i++ {
+		if modes[i] == '+' || modes[i] == '-' {
+			action = modes[i]
+			continue
+		}
+		if modes[i] == mode && action == '-' {
+			return true
+		}
+	}
+	return false
+}
+
+// onlyModes checks whether a mode string such as +b-v changes only the
+// given modes.
+func onlyModes(modes, allowed string) bool {
+	for i := 0; i < len(modes); i++ {
+		if modes[i] == '+' || modes[i] == '-' {
+			continue
+		}
+		if strings.IndexByte(allowed, modes[i]) == -1 {
+			return false
+		}
+	}
+	return true
+}
+
+// modeChangesToParams turns mode changes into MODE/TMODE parameters: The mode
+// string followed by any mode parameters. e.g., +o-v nick1 nick2
+//
+// If forServer is set, we use the parameters meant for servers.
+func modeChangesToParams(changes []ModeChange, forServer bool) []string {
+	modeStr := ""
+	params := []string{}
+
+	action := byte(' ')
+	for _, change := range changes {
+		if change.Action != action {
+			action = change.Action
+			modeStr += string(action)
+		}
+		modeStr += string(change.Mode)
+
+		param := change.Param
+		if forServer && change.ServerParam != "" {
+			param = change.ServerParam
+		}
+		if param != "" {
+			params = append(params, param)
+		}
+	}
+
+	return append([]string{modeStr}, params...)
+}
+
+// Turn a ban mask into the form nick!user@host.
+//
+// For example: nick becomes nick!*@*, and user@host becomes *!user@host.
+//
+// We leave extended bans ($...) alone.
+func normalizeBanMask(mask string) string {
+	if strings.HasPrefix(mask, "$") {
+		return mask
+	}
+
+	if strings.Contains(mask, "!") {
+		if strings.Contains(mask, "@") {
+			return mask
+		}
+		return mask + "@*"
+	}
+
+	if strings.Contains(mask, "@") {
+		return "*!" + mask
+	}
+
+	return mask + "!*@*"
+}
@@ -0,0 +1,681 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChannelApplyModes(t *testing.T) {
+	// Each test starts with a channel with two members. nick1 has ops. nick2
+	// has voice. The channel has a ban on *!*@bad.example.com, key "secret",
+	// and limit 10.
+	tests := []struct {
+		modes  string
+		params []string
+		max    int
+		// What we expect to apply. In the user form.
+		applied string
+		// Resulting state.
+		nick1Ops   bool
+		nick2Ops   bool
+		nick2Voice bool
+		bans       int
+		key        string
+		limit      int
+	}{
+		// o
+		{"+o", []string{"nick2"}, 0, "+o nick2", true, true, true, 1, "secret", 10},
+		{"-o", []string{"nick1"}, 0, "-o nick1", false, false, true, 1, "secret", 10},
+		{"+o", []string{"nick1"}, 0, "", true, false, true, 1, "secret", 10},
+		{"+o", []string{"nobody"}, 0, "", true, false, true, 1, "secret", 10},
+		{"+o", []string{}, 0, "", true, false, true, 1, "secret", 10},
+
+		// v
+		{"-v", []string{"nick2"}, 0, "-v nick2", true, false, false, 1, "secret",
+			10},
+		{"+v", []string{"nick2"}, 0, "", true, false, true, 1, "secret", 10},
+		{"+v", []string{"nick1"}, 0, "+v nick1", true, false, true, 1, "secret",
+			10},
+
+		// b
+		{"+b", []string{"*!*@evil.example.com"}, 0, "+b *!*@evil.example.com",
+			true, false, true, 2, "secret", 10},
+		{"+b", []string{"someone"}, 0, "+b someone!*@*", true, false, true, 2,
+			"secret", 10},
+		{"+b", []string{"*!*@BAD.example.com"}, 0, "", true, false, true, 1,
+			"secret", 10},
+		{"-b", []string{"*!*@bad.example.com"}, 0, "-b *!*@bad.example.com", true,
+			false, true, 0, "secret", 10},
+		{"-b", []string{"*!*@other.example.com"}, 0, "", true, false, true, 1,
+			"secret", 10},
+
+		// k
+		{"+k", []string{"newkey"}, 0, "+k newkey", true, false, true, 1, "newkey",
+			10},
+		{"+k", []string{"bad,key"}, 0, "", true, false, true, 1, "secret", 10},
+		{"-k", []string{"whatever"}, 0, "-k secret", true, false, true, 1, "", 10},
+		{"-k", []string{}, 0, "-k secret", true, false, true, 1, "", 10},
+
+		// l
+		{"+l", []string{"20"}, 0, "+l 20", true, false, true, 1, "secret", 20},
+		{"+l", []string{"abc"}, 0, "", true, false, true, 1, "secret", 10},
+		{"+l", []string{"0"}, 0, "", true, false, true, 1, "secret", 10},
+		{"-l", []string{}, 0, "-l", true, false, true, 1, "secret", 0},
+
+		// Combinations. Parameters get consumed in order.
+		{"+ov-l+k", []string{"nick2", "nick1", "key2"}, 0, "+ov-l+k nick2 nick1 key2",
+			true, true, true, 1, "key2", 0},
+		{"-v+b", []string{"nick2", "x!y@z"}, 0, "-v+b nick2 x!y@z", true, false,
+			false, 2, "secret", 10},
+
+		// c
+		{"+c", []string{}, 0, "+c", true, false, true, 1, "secret", 10},
+		{"-c", []string{}, 0, "", true, false, true, 1, "secret", 10},
+
+		// Unknown modes are ignored.
+		{"+zo", []string{"nick2"}, 0, "+o nick2", true, true, true, 1, "secret",
+			10},
+
+		// Limit on changes.
+		{"+ov-kl", []string{"nick2", "nick1", "secret"}, 2, "+ov nick2 nick1", true,
+			true, true, 1, "secret", 10},
+	}
+
+	for _, test := range tests {
+		nick1 := &User{DisplayNick: "nick1", Username: "u1", Hostname: "h1",
+			UID: TS6UID("000AAAAAA"), Channels: map[string]*Channel{}}
+		nick2 := &User{DisplayNick: "nick2", Username: "u2", Hostname: "h2",
+			UID: TS6UID("000AAAAAB"), Channels: map[string]*Channel{}}
+
+		channel := &Channel{
+			Name:    "#test",
+			Members: map[TS6UID]struct{}{nick1.UID: {}, nick2.UID: {}},
+			Ops:     map[TS6UID]*User{nick1.UID: nick1},
+			Voices:  map[TS6UID]*User{nick2.UID: nick2},
+			Modes:   map[byte]struct{}{},
+			Bans:    []BanEntry{{Mask: "*!*@bad.example.com"}},
+			Key:     "secret",
+			Limit:   10,
+		}
+		nick1.Channels[channel.Name] = channel
+		nick2.Channels[channel.Name] = channel
+
+		users := map[string]*User{"nick1": nick1, "nick2": nick2}
+		lookupUser := func(nick string) *User { return users[nick] }
+
+		changes := channel.applyModes(test.modes, test.params, lookupUser, "nick1",
+			test.max)
+
+		applied := ""
+		if len(changes) > 0 {
+			applied = strings.Join(modeChangesToParams(changes, false), " ")
+		}
+
+		if applied != test.applied {
+			t.Errorf("applyModes(%s, %v) applied %q, wanted %q", test.modes,
+				test.params, applied, test.applied)
+		}
+
+		if channel.userHasOps(nick1) != test.nick1Ops ||
+			channel.userHasOps(nick2) != test.nick2Ops ||
+			channel.userHasVoice(nick2) != test.nick2Voice {
+			t.Errorf("applyModes(%s, %v) left ops/voices %v/%v", test.modes,
+				test.params, channel.Ops, channel.Voices)
+		}
+
+		if len(channel.Bans) != test.bans {
+			t.Errorf("applyModes(%s, %v) left bans %v, wanted %d", test.modes,
+				test.params, channel.Bans, test.bans)
+		}
+
+		if channel.Key != test.key {
+			t.Errorf("applyModes(%s, %v) left key %s, wanted %s", test.modes,
+				test.params, channel.Key, test.key)
+		}
+
+		if channel.Limit != test.limit {
+			t.Errorf("applyModes(%s, %v) left limit %d, wanted %d", test.modes,
+				test.params, channel.Limit, test.limit)
+		}
+	}
+}
+
+func TestModeChangesToParams(t *testing.T) {
+	changes := []ModeChange{
+		{Action: '+', Mode: 'o', Param: "nick1", ServerParam: "000AAAAAA"},
+		{Action: '+', Mode: 'b', Param: "*!*@host"},
+		{Action: '-', Mode: 'l'},
+		{Action: '-', Mode: 'v', Param: "nick2", ServerParam: "000AAAAAB"},
+	}
+
+	user := strings.Join(modeChangesToParams(changes, false), " ")
+	if user != "+ob-lv nick1 *!*@host nick2" {
+		t.Errorf("modeChangesToParams(user) = %s", user)
+	}
+
+	server := strings.Join(modeChangesToParams(changes, true), " ")
+	if server != "+ob-lv 000AAAAAA *!*@host 000AAAAAB" {
+		t.Errorf("modeChangesToParams(server) = %s", server)
+	}
+}
+
+func TestNormalizeBanMask(t *testing.T) {
+	tests := []struct {
+		input  string
+		output string
+	}{
+		{"nick", "nick!*@*"},
+		{"user@host", "*!user@host"},
+		{"nick!user", "nick!user@*"},
+		{"nick!user@host", "nick!user@host"},
+		{"*!*@*", "*!*@*"},
+		{"$a:account", "$a:account"},
+		{"$~r:*bot*", "$~r:*bot*"},
+	}
+
+	for _, test := range tests {
+		out := normalizeBanMask(test.input)
+		if out != test.output {
+			t.Errorf("normalizeBanMask(%s) = %s, wanted %s", test.input, out,
+				test.output)
+		}
+	}
+}
+
+func TestMatchesBanMask(t *testing.T) {
+	u := &User{DisplayNick: "Nick", Username: "user", Hostname: "host.example.com"}
+
+	tests := []struct {
+		mask   string
+		output bool
+	}{
+		{"nick!user@host.example.com", true},
+		{"*!*@*.example.com", true},
+		{"*!*@HOST.EXAMPLE.COM", true},
+		{"n?ck!*@*", true},
+		{"nick!*@host", false},
+		{"ick!*@*", false},
+		{"other!*@*", false},
+	}
+
+	for _, test := range tests {
+		out := u.matchesBanMask(test.mask)
+		if out != test.output {
+			t.Errorf("matchesBanMask(%s) = %v, wanted %v", test.mask, out,
+				test.output)
+		}
+	}
+}
+
+func TestExtendedBanMatch(t *testing.T) {
+	u := &User{DisplayNick: "Nick", Username: "user", Hostname: "host.example.com",
+		RealName: "Some Bot", Account: "Acct",
+		Server: &Server{Name: "irc2.example.com"}}
+	anon := &User{DisplayNick: "anon", Username: "user", Hostname: "host",
+		RealName: "Anonymous", Server: &Server{Name: "irc3.example.com"}}
+
+	tests := []struct {
+		user   *User
+		mask   string
+		output bool
+	}{
+		{u, "$a", true},
+		{anon, "$a", false},
+		{u, "$a:acct", true},
+		{u, "$a:other", false},
+		{anon, "$a:acct", false},
+		{u, "$~a", false},
+		{anon, "$~a", true},
+		{u, "$r:*bot", true},
+		{u, "$r:*human*", false},
+		{anon, "$~r:*bot", true},
+		{u, "$s:irc2.*", true},
+		{anon, "$s:irc2.*", false},
+		{anon, "$~s:irc2.*", true},
+		{u, "$x:nick!*@*.example.com#some*", true},
+		{u, "$x:nick!*@*#anon*", false},
+		{u, "$~x:nick!*@*#anon*", true},
+		{u, "$r", false},
+		{u, "$q:x", false},
+		{u, "$", false},
+		{u, "$~", false},
+		{u, "$a:", false},
+	}
+
+	for _, test := range tests {
+		out := extendedBanMatch(test.user, test.mask)
+		if out != test.output {
+			t.Errorf("extendedBanMatch(%s, %s) = %v, wanted %v",
+				test.user.DisplayNick, test.mask, out, test.output)
+		}
+
+		out = test.user.matchesBanMask(test.mask)
+		if out != test.output {
+			t.Errorf("matchesBanMask(%s, %s) = %v, wanted %v",
+				test.user.DisplayNick, test.mask, out, test.output)
+		}
+	}
+}
+
+func TestChannelExtendedBans(t *testing.T) {
+	u := &User{DisplayNick: "nick", Username: "user", Hostname: "host",
+		RealName: "Spam Bot", Server: &Server{Name: "irc2.example.com"}}
+	channel := &Channel{Name: "#test", Modes: map[byte]struct{}{}}
+
+	changes := channel.applyModes("+bb", []string{"$r:*bot", "$q:invalid"}, nil,
+		"nick", 0)
+	if got := strings.Join(modeChangesToParams(changes, false), " "); got !=
+		"+b $r:*bot" {
+		t.Errorf("applyModes(+bb) applied %s, wanted +b $r:*bot", got)
+	}
+
+	if !channel.isBanned(u) {
+		t.Errorf("isBanned() is false with extended ban")
+	}
+
+	u.RealName = "Human"
+	if channel.isBanned(u) {
+		t.Errorf("isBanned() is true with non-matching extended ban")
+	}
+}
+
+func TestChannelModesString(t *testing.T) {
+	tests := []struct {
+		modes  string
+		key    string
+		limit  int
+		output string
+		params []string
+	}{
+		{"", "", 0, "+", []string{"+"}},
+		{"n", "", 0, "+n", []string{"+n"}},
+		{"tsnmi", "", 0, "+imnst", []string{"+imnst"}},
+		{"tn", "secret", 5, "+nt", []string{"+ntkl", "secret", "5"}},
+	}
+
+	for _, test := range tests {
+		channel := &Channel{Name: "#test", Modes: map[byte]struct{}{},
+			Key: test.key, Limit: test.limit}
+		for i := range test.modes {
+			channel.Modes[test.modes[i]] = struct{}{}
+		}
+
+		// Map iteration order varies, so make sure we get the same each time.
+		for i := 0; i < 10; i++ {
+			if got := channel.modesString(); got != test.output {
+				t.Errorf("modesString() with %s = %s, wanted %s", test.modes, got,
+					test.output)
+				break
+			}
+
+			got := channel.modesWithParams()
+			if strings.Join(got, " ") != strings.Join(test.params, " ") {
+				t.Errorf("modesWithParams() with %s = %v, wanted %v", test.modes, got,
+					test.params)
+				break
+			}
+		}
+	}
+}
+
+func TestChannelPrivate(t *testing.T) {
+	channel := &Channel{Name: "#test", Modes: map[byte]struct{}{}}
+
+	changes := channel.applyModes("+pp", nil, nil, "nick", 0)
+	if got := strings.Join(modeChangesToParams(changes, false), " "); got != "+p" ||
+		!channel.isPrivate() {
+		t.Errorf("applyModes(+pp) applied %s, private %v", got,
+			channel.isPrivate())
+	}
+
+	if got := channel.modesString(); got != "+p" {
+		t.Errorf("modesString() = %s, wanted +p", got)
+	}
+
+	changes = channel.applyModes("-p", nil, nil, "nick", 0)
+	if got := strings.Join(modeChangesToParams(changes, false), " "); got != "-p" ||
+		channel.isPrivate() {
+		t.Errorf("applyModes(-p) applied %s, private %v", got,
+			channel.isPrivate())
+	}
+}
+
+func TestChannelSecret(t *testing.T) {
+	channel := &Channel{Name: "#test", Modes: map[byte]struct{}{'s': {}}}
+
+	if got := channel.namesFlag(); got != "@" {
+		t.Errorf("namesFlag() for +s = %s, wanted @", got)
+	}
+
+	// +s takes priority.
+	channel.applyModes("+p", nil, nil, "nick", 0)
+	if got := channel.namesFlag(); got != "@" {
+		t.Errorf("namesFlag() for +ps = %s, wanted @", got)
+	}
+
+	changes := channel.applyModes("-ss", nil, nil, "nick", 0)
+	if got := strings.Join(modeChangesToParams(changes, false), " "); got != "-s" ||
+		channel.isSecret() {
+		t.Errorf("applyModes(-ss) applied %s, secret %v", got, channel.isSecret())
+	}
+	if got := channel.namesFlag(); got != "*" {
+		t.Errorf("namesFlag() for +p = %s, wanted *", got)
+	}
+
+	channel.applyModes("-p", nil, nil, "nick", 0)
+	if got := channel.namesFlag(); got != "=" {
+		t.Errorf("namesFlag() for a public channel = %s, wanted =", got)
+	}
+
+	changes = channel.applyModes("+s", nil, nil, "nick", 0)
+	if got := strings.Join(modeChangesToParams(changes, false), " "); got != "+s" ||
+		!channel.isSecret() {
+		t.Errorf("applyModes(+s) applied %s, secret %v", got, channel.isSecret())
+	}
+}
+
+func TestChannelOwners(t *testing.T) {
+	owner := &User{DisplayNick: "owner", UID: TS6UID("000AAAAAA")}
+	op := &User{DisplayNick: "op", UID: TS6UID("000AAAAAB")}
+	voice := &User{DisplayNick: "voice", UID: TS6UID("000AAAAAC")}
+	users := map[string]*User{"owner": owner, "op": op, "voice": voice}
+	lookupUser := func(nick string) *User { return users[nick] }
+
+	channel := &Channel{Name: "#test", Modes: map[byte]struct{}{},
+		Members: map[TS6UID]struct{}{}, Ops: map[TS6UID]*User{},
+		Voices: map[TS6UID]*User{}}
+	for _, u := range users {
+		channel.Members[u.UID] = struct{}{}
+		u.Channels = map[string]*Channel{channel.Name: channel}
+	}
+
+	changes := channel.applyModes("+qov", []string{"owner", "op", "voice"},
+		lookupUser, "op", 0)
+	if got := strings.Join(modeChangesToParams(changes, false), " "); got !=
+		"+qov owner op voice" {
+		t.Errorf("applyModes(+qov) applied %s", got)
+	}
+
+	// Owners have ops without +o.
+	if !channel.userIsOwner(owner) || !channel.userHasOps(owner) {
+		t.Errorf("owner is not owner or has no ops")
+	}
+	if channel.userIsOwner(op) {
+		t.Errorf("op is owner")
+	}
+
+	prefixes := map[*User]string{owner: "~", op: "@", voice: "+"}
+	for u, want := range prefixes {
+		if got := channel.membershipPrefix(u); got != want {
+			t.Errorf("membershipPrefix(%s) = %s, wanted %s", u.DisplayNick, got,
+				want)
+		}
+	}
+
+	// The owner doesn't have +o, so there is nothing to remove.
+	changes = channel.applyModes("-o", []string{"owner"}, lookupUser, "op", 0)
+	if len(changes) != 0 || !channel.userHasOps(owner) {
+		t.Errorf("applyModes(-o) on owner applied %v", changes)
+	}
+
+	changes = channel.applyModes("-q", []string{"owner"}, lookupUser, "op", 0)
+	if len(changes) != 1 || channel.userIsOwner(owner) ||
+		channel.userHasOps(owner) {
+		t.Errorf("applyModes(-q) applied %v, owner %v", changes,
+			channel.userIsOwner(owner))
+	}
+
+	// Parting forgets owner status.
+	channel.grantOwner(owner)
+	channel.removeUser(owner)
+	if channel.userIsOwner(owner) {
+		t.Errorf("user is owner after leaving")
+	}
+}
+
+func TestChannelHalfOps(t *testing.T) {
+	op := &User{DisplayNick: "op", UID: TS6UID("000AAAAAA")}
+	halfOp := &User{DisplayNick: "halfop", UID: TS6UID("000AAAAAB")}
+	users := map[string]*User{"op": op, "halfop": halfOp}
+	lookupUser := func(nick string) *User { return users[nick] }
+
+	channel := &Channel{Name: "#test", Modes: map[byte]struct{}{},
+		Members: map[TS6UID]struct{}{}, Ops: map[TS6UID]*User{},
+		Voices: map[TS6UID]*User{}}
+	for _, u := range users {
+		channel.Members[u.UID] = struct{}{}
+		u.Channels = map[string]*Channel{channel.Name: channel}
+	}
+
+	changes := channel.applyModes("+oh", []string{"op", "halfop"}, lookupUser,
+		"op", 0)
+	if got := strings.Join(modeChangesToParams(changes, false), " "); got !=
+		"+oh op halfop" {
+		t.Errorf("applyModes(+oh) applied %s", got)
+	}
+
+	// Half-ops don't have ops.
+	if !channel.userIsHalfOp(halfOp) || channel.userHasOps(halfOp) {
+		t.Errorf("halfop is not a half-op or has ops")
+	}
+	if got := channel.membershipPrefix(halfOp); got != "%" {
+		t.Errorf("membershipPrefix(halfop) = %s, wanted %%", got)
+	}
+
+	// Banned half-ops may still speak.
+	channel.applyModes("+b", []string{"*!*@*"}, lookupUser, "op", 0)
+	if !channel.canSpeak(halfOp) {
+		t.Errorf("banned half-op may not speak")
+	}
+
+	changes = channel.applyModes("-h", []string{"halfop"}, lookupUser, "op", 0)
+	if len(changes) != 1 || channel.userIsHalfOp(halfOp) {
+		t.Errorf("applyModes(-h) applied %v", changes)
+	}
+
+	// Parting forgets half-op status.
+	channel.grantHalfOp(halfOp)
+	channel.removeUser(halfOp)
+	if channel.userIsHalfOp(halfOp) {
+		t.Errorf("user is half-op after leaving")
+	}
+}
+
+func TestOnlyModes(t *testing.T) {
+	tests := []struct {
+		modes  string
+		output bool
+	}{
+		{"+b", true},
+		{"-v+b", true},
+		{"+bo", false},
+		{"+h", false},
+		{"-k", false},
+		{"", true},
+	}
+
+	for _, test := range tests {
+		if got := onlyModes(test.modes, "bv"); got != test.output {
+			t.Errorf("onlyModes(%s, bv) = %v, wanted %v", test.modes, got,
+				test.output)
+		}
+	}
+}
+
+func TestRemovesMode(t *testing.T) {
+	tests := []struct {
+		modes  string
+		output bool
+	}{
+		{"-q", true},
+		{"+q", false},
+		{"+o-q", true},
+		{"-o+q", false},
+		{"q", false},
+		{"-ov", false},
+	}
+
+	for _, test := range tests {
+		if got := removesMode(test.modes, 'q'); got != test.output {
+			t.Errorf("removesMode(%s, q) = %v, wanted %v", test.modes, got,
+				test.output)
+		}
+	}
+}
+
+func TestChannelInvites(t *testing.T) {
+	u := &User{DisplayNick: "nick", UID: TS6UID("000AAAAAA")}
+	channel := &Channel{Name: "#test", Modes: map[byte]struct{}{}}
+
+	changes := channel.applyModes("+i", nil, nil, "nick", 0)
+	if len(changes) != 1 || !channel.isInviteOnly() {
+		t.Errorf("applyModes(+i) = %v, invite only %v", changes,
+			channel.isInviteOnly())
+	}
+
+	if channel.isInvited(u) {
+		t.Errorf("isInvited() is true before invite")
+	}
+
+	channel.addInvite(u)
+	if !channel.isInvited(u) {
+		t.Errorf("isInvited() is false after invite")
+	}
+
+	channel.removeInvite(u)
+	if channel.isInvited(u) {
+		t.Errorf("isInvited() is true after removing invite")
+	}
+
+	// Invites expire.
+	channel.addInvite(u)
+	channel.expireInvites(time.Now().Add(inviteExpiry - time.Second))
+	if !channel.isInvited(u) {
+		t.Errorf("invite expired early")
+	}
+	channel.expireInvites(time.Now().Add(inviteExpiry))
+	if channel.isInvited(u) {
+		t.Errorf("invite did not expire")
+	}
+
+	changes = channel.applyModes("-i", nil, nil, "nick", 0)
+	if len(changes) != 1 || channel.isInviteOnly() {
+		t.Errorf("applyModes(-i) = %v, invite only %v", changes,
+			channel.isInviteOnly())
+	}
+}
+
+func TestChannelBanExceptions(t *testing.T) {
+	u := &User{DisplayNick: "nick", Username: "user",
+		Hostname: "host.example.com", UID: TS6UID("000AAAAAA")}
+	other := &User{DisplayNick: "other", Username: "user",
+		Hostname: "other.example.com", UID: TS6UID("000AAAAAB")}
+
+	channel := &Channel{Name: "#test", Modes: map[byte]struct{}{},
+		Ops: map[TS6UID]*User{}, Voices: map[TS6UID]*User{}}
+
+	channel.applyModes("+b", []string{"*!*@*.example.com"}, nil, "op", 0)
+	if !channel.isBanned(u) || channel.canSpeak(u) {
+		t.Errorf("user matching a ban is not banned")
+	}
+
+	changes := channel.applyModes("+e", []string{"nick"}, nil, "op", 0)
+	if got := strings.Join(modeChangesToParams(changes, false), " "); got !=
+		"+e nick!*@*" {
+		t.Errorf("applyModes(+e) applied %s, wanted +e nick!*@*", got)
+	}
+	if len(channel.BanExceptions) != 1 ||
+		channel.BanExceptions[0].Setter != "op" {
+		t.Errorf("ban exceptions = %v", channel.BanExceptions)
+	}
+
+	// The exception overrides the ban.
+	if channel.isBanned(u) || !channel.canSpeak(u) {
+		t.Errorf("user matching a ban exception is banned")
+	}
+
+	// Others are still banned.
+	if !channel.isBanned(other) || channel.canSpeak(other) {
+		t.Errorf("user not matching a ban exception is not banned")
+	}
+
+	// Adding it again does nothing.
+	if changes := channel.applyModes("+e", []string{"NICK!*@*"}, nil, "op",
+		0); len(changes) != 0 || len(channel.BanExceptions) != 1 {
+		t.Errorf("applyModes(+e) added a duplicate: %v", channel.BanExceptions)
+	}
+
+	// An exception alone does nothing.
+	channel.applyModes("-b", []string{"*!*@*.example.com"}, nil, "op", 0)
+	if channel.isBanned(other) {
+		t.Errorf("user is banned with no bans")
+	}
+
+	changes = channel.applyModes("-e", []string{"nick!*@*"}, nil, "op", 0)
+	if len(changes) != 1 || len(channel.BanExceptions) != 0 {
+		t.Errorf("applyModes(-e) = %v, exceptions %v", changes,
+			channel.BanExceptions)
+	}
+
+	if changes := channel.applyModes("-e", []string{"nick!*@*"}, nil, "op",
+		0); len(changes) != 0 {
+		t.Errorf("applyModes(-e) removed a missing exception: %v", changes)
+	}
+}
+
+func TestChannelQuiets(t *testing.T) {
+	u := &User{DisplayNick: "nick", Username: "user",
+		Hostname: "host.example.com", UID: TS6UID("000AAAAAA")}
+	other := &User{DisplayNick: "other", Username: "user",
+		Hostname: "other.example.com", UID: TS6UID("000AAAAAB")}
+
+	channel := &Channel{Name: "#test", Modes: map[byte]struct{}{},
+		Ops: map[TS6UID]*User{}, Voices: map[TS6UID]*User{}}
+
+	changes := channel.applyModes("+Q", []string{"*!*@*.example.com"}, nil,
+		"op", 0)
+	if got := strings.Join(modeChangesToParams(changes, false), " "); got !=
+		"+Q *!*@*.example.com" {
+		t.Errorf("applyModes(+Q) applied %s", got)
+	}
+	if len(channel.Quiets) != 1 || channel.Quiets[0].Setter != "op" {
+		t.Errorf("quiets = %v", channel.Quiets)
+	}
+
+	// Quieted users may not speak but are not banned.
+	if !channel.isQuieted(u) || channel.canSpeak(u) || channel.isBanned(u) {
+		t.Errorf("user matching a quiet may speak or is banned")
+	}
+
+	// Voice lets them speak.
+	channel.grantVoice(u)
+	if !channel.canSpeak(u) {
+		t.Errorf("voiced user matching a quiet may not speak")
+	}
+	channel.removeVoice(u)
+
+	// A ban exception overrides the quiet.
+	channel.applyModes("+e", []string{"nick"}, nil, "op", 0)
+	if channel.isQuieted(u) || !channel.canSpeak(u) {
+		t.Errorf("user matching a ban exception is quieted")
+	}
+	if !channel.isQuieted(other) || channel.canSpeak(other) {
+		t.Errorf("user not matching a ban exception is not quieted")
+	}
+
+	// Adding it again does nothing.
+	if changes := channel.applyModes("+Q", []string{"*!*@*.EXAMPLE.COM"}, nil,
+		"op", 0); len(changes) != 0 || len(channel.Quiets) != 1 {
+		t.Errorf("applyModes(+Q) added a duplicate: %v", channel.Quiets)
+	}
+
+	changes = channel.applyModes("-Q", []string{"*!*@*.example.com"}, nil,
+		"op", 0)
+	if len(changes) != 1 || len(channel.Quiets) != 0 {
+		t.Errorf("applyModes(-Q) = %v, quiets %v", changes, channel.Quiets)
+	}
+	if channel.isQuieted(other) || !channel.canSpeak(other) {
+		t.Errorf("user is quieted with no quiets")
+	}
+}
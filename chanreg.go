@@ -0,0 +1,476 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// ChanReg holds a channel registration.
+//
+// Registrations are local to this server. We don't tell other servers about
+// them.
+type ChanReg struct {
+	// Canonicalized channel name.
+	Name string `json:"name"`
+
+	// Nick of the operator who registered the channel.
+	Founder string `json:"founder"`
+
+	// Unix time the channel was registered.
+	RegisteredAt int64 `json:"registered_at"`
+
+	// Flags set on the registration. See chanRegFlags.
+	Flags map[string]bool `json:"flags"`
+
+	// The channel's last topic. We restore it when the channel is created if
+	// KEEPTOPIC is set.
+	Topic       string `json:"topic"`
+	TopicSetter string `json:"topic_setter"`
+	TopicTS     int64  `json:"topic_ts"`
+}
+
+// chanRegFlags are the flags that may be set on a registration.
+//
+// KEEPTOPIC: Restore the channel's topic when it is created.
+//
+// GUARD: Keep the channel in existence even when no one is in it. ChanServ
+// sits in it.
+var chanRegFlags = []string{"GUARD", "KEEPTOPIC"}
+
+// ChanServNick is the nick of the service that holds guarded channels.
+const ChanServNick = "ChanServ"
+
+// chanregCommand manages channel registrations.
+//
+// Parameters: REGISTER <#channel>, DROP <#channel>, or
+// SET <#channel> <flag> <ON|OFF>
+func (u *LocalUser) chanregCommand(m irc.Message) {
+	if len(m.Params) < 2 {
+		// 461 ERR_NEEDMOREPARAMS
+		u.messageFromServer("461", []string{"CHANREG", "Not enough parameters"})
+		return
+	}
+
+	if !u.User.isOperator() {
+		// 481 ERR_NOPRIVILEGES
+		u.messageFromServer("481", []string{"Permission Denied- You're not an IRC operator"})
+		return
+	}
+
+	channelName := canonicalizeChannel(m.Params[1])
+	if !isValidChannel(channelName) {
+		// 403 ERR_NOSUCHCHANNEL
+		u.messageFromServer("403", []string{m.Params[1], "Invalid channel name"})
+		return
+	}
+
+	subCommand := strings.ToUpper(m.Params[0])
+
+	if subCommand == "REGISTER" {
+		if _, exists := u.Catbox.ChanRegs[channelName]; exists {
+			u.serverNotice(fmt.Sprintf("%s is already registered", channelName))
+			return
+		}
+
+		reg := &ChanReg{
+			Name:         channelName,
+			Founder:      u.User.DisplayNick,
+			RegisteredAt: time.Now().Unix(),
+			Flags:        make(map[string]bool),
+		}
+		u.Catbox.ChanRegs[channelName] = reg
+
+		// Start with the topic it has now, if any.
+		if channel, exists := u.Catbox.Channels[channelName]; exists {
+			u.Catbox.rememberTopic(channel)
+		}
+
+		u.Catbox.saveChanRegs()
+		u.Catbox.noticeOpers(fmt.Sprintf("%s registered channel %s",
+			u.User.DisplayNick, channelName))
+		return
+	}
+
+	reg, exists := u.Catbox.ChanRegs[channelName]
+	if !exists {
+		u.serverNotice(fmt.Sprintf("%s is not registered", channelName))
+		return
+	}
+
+	if subCommand == "DROP" {
+		if reg.Flags["GUARD"] {
+			u.Catbox.unguardChannel(channelName)
+		}
+		delete(u.Catbox.ChanRegs, channelName)
+
+		u.Catbox.saveChanRegs()
+		u.Catbox.noticeOpers(fmt.Sprintf("%s dropped channel %s",
+			u.User.DisplayNick, channelName))
+		return
+	}
+
+	if subCommand != "SET" {
+		u.serverNotice(fmt.Sprintf("Unknown CHANREG command: %s", m.Params[0]))
+		return
+	}
+
+	if len(m.Params) < 4 {
+		// 461 ERR_NEEDMOREPARAMS
+		u.messageFromServer("461", []string{"CHANREG", "Not enough parameters"})
+		return
+	}
+
+	flag := strings.ToUpper(m.Params[2])
+	if !isChanRegFlag(flag) {
+		u.serverNotice(fmt.Sprintf("Unknown flag: %s. Flags are: %s", m.Params[2],
+			strings.Join(chanRegFlags, ", ")))
+		return
+	}
+
+	setting := strings.ToUpper(m.Params[3])
+	if setting != "ON" && setting != "OFF" {
+		u.serverNotice("Flags must be set ON or OFF")
+		return
+	}
+	on := setting == "ON"
+
+	if flag == "GUARD" && on != reg.Flags["GUARD"] {
+		if on {
+			if err := u.Catbox.guardChannel(reg); err != nil {
+				u.serverNotice(fmt.Sprintf("Unable to guard %s: %s", channelName, err))
+				return
+			}
+		} else {
+			u.Catbox.unguardChannel(channelName)
+		}
+	}
+
+	if on {
+		reg.Flags[flag] = true
+	} else {
+		delete(reg.Flags, flag)
+	}
+
+	u.Catbox.saveChanRegs()
+	u.Catbox.noticeOpers(fmt.Sprintf("%s set %s %s on channel %s",
+		u.User.DisplayNick, flag, setting, channelName))
+}
+
+// isChanRegFlag checks whether the flag is one we know.
+func isChanRegFlag(flag string) bool {
+	for _, f := range chanRegFlags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// statsChanRegs lists the registered channels for STATS R.
+func (u *LocalUser) statsChanRegs() {
+	names := make([]string, 0, len(u.Catbox.ChanRegs))
+	for name := range u.Catbox.ChanRegs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		reg := u.Catbox.ChanRegs[name]
+
+		var flags []string
+		for _, flag := range chanRegFlags {
+			if reg.Flags[flag] {
+				flags = append(flags, flag)
+			}
+		}
+		if len(flags) == 0 {
+			flags = append(flags, "-")
+		}
+
+		// 249 RPL_STATSDEBUG
+		u.messageFromServer("249", []string{
+			"R",
+			reg.Name,
+			reg.Founder,
+			fmt.Sprintf("%d", reg.RegisteredAt),
+			strings.Join(flags, ","),
+		})
+	}
+
+	// 219 RPL_ENDOFSTATS
+	u.messageFromServer("219", []string{"R", "End of /STATS report"})
+}
+
+// rememberTopic records the channel's topic in its registration, if it has
+// one. Call this whenever the topic changes.
+func (cb *Catbox) rememberTopic(channel *Channel) {
+	reg, exists := cb.ChanRegs[channel.Name]
+	if !exists {
+		return
+	}
+
+	reg.Topic = channel.Topic
+	reg.TopicSetter = channel.TopicSetter
+	reg.TopicTS = channel.TopicTS
+	cb.saveChanRegs()
+}
+
+// restoreTopic sets a channel's topic from its registration if it has
+// KEEPTOPIC set. Call this when creating a channel.
+func (cb *Catbox) restoreTopic(channel *Channel) {
+	reg, exists := cb.ChanRegs[channel.Name]
+	if !exists || !reg.Flags["KEEPTOPIC"] {
+		return
+	}
+
+	channel.Topic = reg.Topic
+	channel.TopicSetter = reg.TopicSetter
+	channel.TopicTS = reg.TopicTS
+}
+
+// chanServ finds the ChanServ service, creating it if necessary.
+func (cb *Catbox) chanServ() (*User, error) {
+	if uid, exists := cb.Nicks[canonicalizeNick(ChanServNick)]; exists {
+		user := cb.Users[uid]
+		if !user.IsService {
+			return nil, fmt.Errorf("nick is in use: %s", ChanServNick)
+		}
+		return user, nil
+	}
+
+	return NewServiceUser(cb, ChanServNick, ChanServNick, cb.Config.ServerName,
+		"Channel Services")
+}
+
+// guardChannels puts ChanServ in every channel with GUARD set. We do this at
+// startup.
+func (cb *Catbox) guardChannels() error {
+	for _, reg := range cb.ChanRegs {
+		if !reg.Flags["GUARD"] {
+			continue
+		}
+		if err := cb.guardChannel(reg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// guardChannel puts ChanServ in the channel so that it stays around when
+// everyone leaves. We create the channel if it does not exist.
+func (cb *Catbox) guardChannel(reg *ChanReg) error {
+	chanServ, err := cb.chanServ()
+	if err != nil {
+		return err
+	}
+
+	channel, channelExists := cb.Channels[reg.Name]
+	if channelExists {
+		if _, exists := channel.Members[chanServ.UID]; exists {
+			return nil
+		}
+	} else if persisted, exists := cb.PersistedChannels[reg.Name]; exists {
+		// Like joining, bring back the channel's saved state.
+		channel = persisted
+		delete(cb.PersistedChannels, reg.Name)
+		cb.Channels[channel.Name] = channel
+	} else {
+		channel = &Channel{
+			Name:    reg.Name,
+			Members: make(map[TS6UID]struct{}),
+			Ops:     make(map[TS6UID]*User),
+			Modes:   make(map[byte]struct{}),
+			TS:      time.Now().Unix(),
+		}
+		channel.Modes['n'] = struct{}{}
+		channel.Modes['s'] = struct{}{}
+		cb.restoreTopic(channel)
+		cb.Channels[channel.Name] = channel
+	}
+
+	channel.Members[chanServ.UID] = struct{}{}
+	chanServ.Channels[channel.Name] = channel
+
+	for memberUID := range channel.Members {
+		member := cb.Users[memberUID]
+		if !member.isLocal() {
+			continue
+		}
+		member.LocalUser.maybeQueueMessage(irc.Message{
+			Prefix:  chanServ.nickUhost(),
+			Command: "JOIN",
+			Params:  []string{channel.Name},
+		})
+	}
+
+	for _, server := range cb.LocalServers {
+		if channelExists {
+			server.maybeQueueMessage(irc.Message{
+				Prefix:  string(chanServ.UID),
+				Command: "JOIN",
+				Params:  []string{fmt.Sprintf("%d", channel.TS), channel.Name, "+"},
+			})
+			continue
+		}
+
+		server.maybeQueueMessage(irc.Message{
+			Prefix:  string(cb.Config.TS6SID),
+			Command: "SJOIN",
+			Params: []string{
+				fmt.Sprintf("%d", channel.TS),
+				channel.Name,
+				channel.modesString(),
+				string(chanServ.UID),
+			},
+		})
+		cb.sendTopicBurst(server, channel)
+	}
+
+	return nil
+}
+
+// unguardChannel takes ChanServ out of the channel. If it was the last member
+// the channel goes away.
+func (cb *Catbox) unguardChannel(channelName string) {
+	uid, exists := cb.Nicks[canonicalizeNick(ChanServNick)]
+	if !exists {
+		return
+	}
+	chanServ := cb.Users[uid]
+
+	channel, exists := cb.Channels[channelName]
+	if !exists || !chanServ.onChannel(channel) {
+		return
+	}
+
+	for memberUID := range channel.Members {
+		member := cb.Users[memberUID]
+		if !member.isLocal() {
+			continue
+		}
+		member.LocalUser.maybeQueueMessage(irc.Message{
+			Prefix:  chanServ.nickUhost(),
+			Command: "PART",
+			Params:  []string{channel.Name},
+		})
+	}
+
+	for _, server := range cb.LocalServers {
+		server.maybeQueueMessage(irc.Message{
+			Prefix:  string(chanServ.UID),
+			Command: "PART",
+			Params:  []string{channel.Name},
+		})
+	}
+
+	channel.removeUser(chanServ)
+	if len(channel.Members) == 0 {
+		delete(cb.Channels, channel.Name)
+	}
+}
+
+// sendTopicBurst tells a server a channel's topic with TB, if it supports it
+// and the channel has one.
+func (cb *Catbox) sendTopicBurst(server *LocalServer, channel *Channel) {
+	if !server.Server.hasCapability("TB") || len(channel.Topic) == 0 {
+		return
+	}
+
+	server.maybeQueueMessage(irc.Message{
+		Prefix:  string(cb.Config.TS6SID),
+		Command: "TB",
+		Params: []string{
+			channel.Name,
+			fmt.Sprintf("%d", channel.TopicTS),
+			channel.TopicSetter,
+			channel.Topic,
+		},
+	})
+}
+
+// saveChanRegs writes our registrations to the registration file, if we have
+// one.
+func (cb *Catbox) saveChanRegs() {
+	if cb.Config.ChanRegFile == "" {
+		return
+	}
+
+	if err := saveChanRegFile(cb.Config.ChanRegFile, cb.ChanRegs); err != nil {
+		cb.Logger.Error("Unable to save channel registrations: %s", err)
+		cb.noticeOpers(fmt.Sprintf("Unable to save channel registrations: %s",
+			err))
+	}
+}
+
+// saveChanRegFile writes registrations to the file as JSON.
+//
+// Like the state file, we write to a temporary file and then rename.
+func saveChanRegFile(file string, regs map[string]*ChanReg) error {
+	list := make([]*ChanReg, 0, len(regs))
+	for _, reg := range regs {
+		list = append(list, reg)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	buf, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding channel registrations: %s", err)
+	}
+
+	tmpFile := file + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, buf, 0600); err != nil {
+		return fmt.Errorf("error writing channel registration file: %s", err)
+	}
+
+	if err := os.Rename(tmpFile, file); err != nil {
+		return fmt.Errorf("error renaming channel registration file: %s", err)
+	}
+
+	return nil
+}
+
+// loadChanRegs reads registrations from the file.
+//
+// It is not an error for the file to be blank or to not exist. In that case
+// there are no registrations.
+func loadChanRegs(file string) (map[string]*ChanReg, error) {
+	regs := make(map[string]*ChanReg)
+	if file == "" {
+		return regs, nil
+	}
+
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return regs, nil
+		}
+		return nil, fmt.Errorf("error reading channel registration file: %s", err)
+	}
+
+	var list []*ChanReg
+	if err := json.Unmarshal(buf, &list); err != nil {
+		return nil, fmt.Errorf("error decoding channel registration file: %s", err)
+	}
+
+	for _, reg := range list {
+		name := canonicalizeChannel(reg.Name)
+		if !isValidChannel(name) {
+			return nil, fmt.Errorf("invalid channel in registration file: %s",
+				reg.Name)
+		}
+		reg.Name = name
+		if reg.Flags == nil {
+			reg.Flags = make(map[string]bool)
+		}
+		regs[name] = reg
+	}
+
+	return regs, nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/horgh/irc"
+)
+
+func TestChanRegCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catbox-chanreg-")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	cb := newSnapshotCatbox()
+	cb.Config.ChanRegFile = filepath.Join(dir, "chanregs.json")
+	oper := addCallerIDTestUser(cb, 1, "oper")
+	oper.User.Modes['o'] = struct{}{}
+	alice := addCallerIDTestUser(cb, 2, "alice")
+
+	alice.chanregCommand(irc.Message{Command: "CHANREG",
+		Params: []string{"REGISTER", "#test"}})
+	if got := drainCommands(alice); len(got) != 1 || !strings.HasPrefix(got[0], "481 ") {
+		t.Errorf("non-operator got %q", got)
+	}
+
+	alice.join("#test", "", false)
+	alice.topicCommand(irc.Message{Command: "TOPIC",
+		Params: []string{"#test", "Hello"}})
+
+	oper.chanregCommand(irc.Message{Command: "CHANREG",
+		Params: []string{"REGISTER", "#Test"}})
+	oper.chanregCommand(irc.Message{Command: "CHANREG",
+		Params: []string{"SET", "#test", "keeptopic", "on"}})
+	_ = drainCommands(oper)
+
+	oper.chanregCommand(irc.Message{Command: "CHANREG",
+		Params: []string{"SET", "#test", "NOSUCHFLAG", "ON"}})
+	if got := drainCommands(oper); len(got) != 1 ||
+		!strings.Contains(got[0], "Unknown flag: NOSUCHFLAG") {
+		t.Errorf("unknown flag got %q", got)
+	}
+
+	reg, exists := cb.ChanRegs["#test"]
+	if !exists {
+		t.Fatalf("channel was not registered")
+	}
+	if reg.Founder != "oper" || !reg.Flags["KEEPTOPIC"] || reg.Topic != "Hello" {
+		t.Errorf("registered %+v", reg)
+	}
+
+	// Topic changes are remembered.
+	alice.topicCommand(irc.Message{Command: "TOPIC",
+		Params: []string{"#test", "Goodbye"}})
+	if reg.Topic != "Goodbye" {
+		t.Errorf("remembered topic %q, wanted Goodbye", reg.Topic)
+	}
+
+	// It survives a reload.
+	regs, err := loadChanRegs(cb.Config.ChanRegFile)
+	if err != nil {
+		t.Fatalf("error loading registrations: %s", err)
+	}
+	if loaded := regs["#test"]; loaded == nil || loaded.Founder != "oper" ||
+		!loaded.Flags["KEEPTOPIC"] || loaded.Topic != "Goodbye" {
+		t.Errorf("loaded %+v", loaded)
+	}
+
+	oper.statsCommand(irc.Message{Command: "STATS", Params: []string{"R"}})
+	got := drainCommands(oper)
+	if len(got) != 2 ||
+		!strings.HasPrefix(got[0], "249 oper R #test oper ") ||
+		!strings.HasSuffix(got[0], " KEEPTOPIC") ||
+		got[1] != "219 oper R End of /STATS report" {
+		t.Errorf("STATS R got %q", got)
+	}
+
+	oper.chanregCommand(irc.Message{Command: "CHANREG",
+		Params: []string{"DROP", "#test"}})
+	if _, exists := cb.ChanRegs["#test"]; exists {
+		t.Errorf("channel is still registered")
+	}
+	regs, err = loadChanRegs(cb.Config.ChanRegFile)
+	if err != nil {
+		t.Fatalf("error loading registrations: %s", err)
+	}
+	if len(regs) != 0 {
+		t.Errorf("saved %v after dropping", regs)
+	}
+}
+
+func TestChanRegKeepTopic(t *testing.T) {
+	cb := newSnapshotCatbox()
+	cb.ChanRegs["#test"] = &ChanReg{Name: "#test",
+		Flags: map[string]bool{"KEEPTOPIC": true}, Topic: "Hello",
+		TopicSetter: "oper!user@host.example.com", TopicTS: 100}
+	cb.ChanRegs["#other"] = &ChanReg{Name: "#other", Flags: map[string]bool{},
+		Topic: "Hi"}
+	alice := addCallerIDTestUser(cb, 1, "alice")
+
+	alice.join("#test", "", false)
+	if channel := cb.Channels["#test"]; channel.Topic != "Hello" ||
+		channel.TopicTS != 100 {
+		t.Errorf("channel has topic %q at %d, wanted Hello", channel.Topic,
+			channel.TopicTS)
+	}
+	found := false
+	for _, line := range drainCommands(alice) {
+		if line == "332 alice #test Hello" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("joining did not show the topic")
+	}
+
+	// Without KEEPTOPIC there is no topic.
+	alice.join("#other", "", false)
+	if topic := cb.Channels["#other"].Topic; topic != "" {
+		t.Errorf("channel without KEEPTOPIC has topic %q", topic)
+	}
+}
+
+func TestChanRegGuard(t *testing.T) {
+	cb := newSnapshotCatbox()
+	cb.Config.MaxNickLength = 9
+	link := addTraceTestLink(cb, 10, "irc2.example.com", "001")
+	oper := addCallerIDTestUser(cb, 1, "oper")
+	oper.User.Modes['o'] = struct{}{}
+	alice := addCallerIDTestUser(cb, 2, "alice")
+
+	oper.chanregCommand(irc.Message{Command: "CHANREG",
+		Params: []string{"REGISTER", "#test"}})
+	oper.chanregCommand(irc.Message{Command: "CHANREG",
+		Params: []string{"SET", "#test", "GUARD", "ON"}})
+
+	uid, exists := cb.Nicks["chanserv"]
+	if !exists || !cb.Users[uid].IsService {
+		t.Fatalf("ChanServ was not created")
+	}
+	channel, exists := cb.Channels["#test"]
+	if !exists {
+		t.Fatalf("guarded channel does not exist")
+	}
+	if _, exists := channel.Members[uid]; !exists {
+		t.Errorf("ChanServ is not in the channel")
+	}
+
+	// The other server hears about ChanServ and the channel.
+	var commands []string
+	for len(link.WriteChan) > 0 {
+		commands = append(commands, (<-link.WriteChan).Message.Command)
+	}
+	if strings.Join(commands, " ") != "UID SJOIN" {
+		t.Errorf("sent %q to server, wanted UID SJOIN", commands)
+	}
+
+	// The channel stays when everyone leaves.
+	alice.join("#test", "", false)
+	alice.part("#test", "")
+	if _, exists := cb.Channels["#test"]; !exists {
+		t.Errorf("guarded channel went away")
+	}
+
+	// Messages to the channel don't go anywhere for ChanServ.
+	alice.join("#test", "", false)
+	alice.privmsgCommand(irc.Message{Command: "PRIVMSG",
+		Params: []string{"#test", "hi"}})
+
+	oper.chanregCommand(irc.Message{Command: "CHANREG",
+		Params: []string{"SET", "#test", "GUARD", "OFF"}})
+	if _, exists := channel.Members[uid]; exists {
+		t.Errorf("ChanServ is still in the channel")
+	}
+	alice.part("#test", "")
+	if _, exists := cb.Channels["#test"]; exists {
+		t.Errorf("channel remained after guard was removed")
+	}
+
+	// Guarding at startup.
+	cb.ChanRegs["#test"].Flags["GUARD"] = true
+	if err := cb.guardChannels(); err != nil {
+		t.Fatalf("error guarding channels: %s", err)
+	}
+	if _, exists := cb.Channels["#test"]; !exists {
+		t.Errorf("channel was not guarded at startup")
+	}
+}
@@ -1,7 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -23,6 +30,14 @@ type Config struct {
 
 	MOTD string
 
+	// If an IP received the MOTD within this long, we leave the MOTD out when
+	// it connects or asks again. 0 to always send it.
+	MOTDThrottle time.Duration
+
+	// How long we hold the nick of a user who quits. Only opers may take it
+	// during this time. 0 to not hold nicks.
+	NickDelay time.Duration
+
 	MaxNickLength int
 
 	// Period of time a client can be idle before we send it a PING.
@@ -42,11 +57,186 @@ type Config struct {
 	// Oper name to password.
 	Opers map[string]string
 
+	// The most users a user may have on their accept list (for +g).
+	MaxAcceptList int
+
+	// The most nicks a user may WATCH.
+	MaxWatchSize int
+
+	// The most metadata keys a user or channel may have.
+	MaxMetadataKeys int
+
+	// The longest a KICK reason may be. We truncate longer ones.
+	MaxKickLength int
+
+	// The longest a QUIT message may be. We truncate longer ones.
+	MaxQuitLength int
+
+	// The longest a PART message may be. We truncate longer ones.
+	MaxPartLength int
+
+	// How many users may finish registering each second. We hold back further
+	// registrations until the next second. 0 for no limit.
+	MaxRegistrationsPerSecond int
+
+	// Whether SERVLIST lists our services. If not, it lists none.
+	AllowSERVLIST bool
+
+	// How many hops from us MAP shows. We summarize servers further away.
+	MapMaxDepth int
+
+	// Whether only opers may use STATS. Otherwise anyone may see uptime.
+	HideStats bool
+
+	// How many WHOIS queries a user may make each minute. Opers are exempt. 0
+	// for no limit.
+	MaxWhoisPerMinute int
+
+	// Oper name to TLS client certificate fingerprint. An oper who connects
+	// with the certificate does not need a password.
+	OperCerts map[string]string
+
+	// Oper name to the path to their PEM encoded RSA public key. These opers
+	// may become opers with CHALLENGE.
+	OperRSAKeys map[string]string
+
 	// Server name to its link information.
 	Servers map[string]*ServerDefinition
 
 	// User configuration info.
 	UserConfigs []UserConfig
+
+	// Connection classes. Users get one through their user config. Users with
+	// no class are in the default class.
+	ConnClasses []ConnClass
+
+	// Filters we check local users' channel messages against.
+	SpamFilters []SpamFilter
+
+	// File to save channel state to at shutdown and restore it from at
+	// startup. If blank, we don't persist channels.
+	StateFile string
+
+	// File to save X-Lines to. If blank, we don't persist X-Lines.
+	XLineFile string
+
+	// File to save D-Lines to. If blank, we don't persist D-Lines.
+	DLineFile string
+
+	// File to save channel registrations to. If blank, registrations last
+	// until we restart.
+	ChanRegFile string
+
+	// Password users must send with PASS to connect. If blank, we don't
+	// require one.
+	UserPassword string
+
+	// Whether clients connect through a proxy that sends the PROXY protocol
+	// header. If so, every connection we accept must start with one.
+	ProxyProtocol bool
+
+	// Address to serve HTTP health checks on. If blank, we don't.
+	HealthAddr string
+
+	// File to log users connecting and disconnecting to. If blank, we don't.
+	AccessLog string
+
+	// Minimum level of log messages to write.
+	LogLevel LogLevel
+
+	// Format of log messages: text or json.
+	LogFormat string
+
+	// Whether an oper's REHASH tells all servers on the network to rehash too.
+	PropagateRehash bool
+
+	// Whether to hide part of the IP of users without a hostname. The last octet
+	// for IPv4 and the last 64 bits for IPv6.
+	CloakIPv4 bool
+	CloakIPv6 bool
+
+	// How many messages to keep per channel for CHATHISTORY. 0 to keep none.
+	HistorySize int
+
+	// File containing the server's rules. Users see them with RULES.
+	RulesFile string
+
+	// Whether to show the rules to users when they connect.
+	RulesOnConnect bool
+
+	// NOTICEs to send users when they register. They may contain {nick},
+	// {server}, {users}, and {channels}.
+	WelcomeLines []string
+
+	// File containing welcome NOTICEs, one per line. If set, we use it instead
+	// of WelcomeLines.
+	WelcomeFile string
+
+	// Directory holding help topics, one .txt file per topic. If blank, there
+	// is no help other than our built in help.
+	HelpDir string
+
+	// Whether HELP serves our built in help on each command. It comes before
+	// topics from HelpDir.
+	EnableHelp bool
+
+	// Whether to show opers the nick!user@host of users who become opers.
+	ShowOperOnConnect bool
+
+	// How many messages per second we read from a server while it is bursting.
+	// 0 for no limit.
+	BurstRateLimit int
+
+	// Whether to write messages waiting to go to a client in one write rather
+	// than one write per message.
+	BatchWrites bool
+
+	// A regex nicks must match instead of our usual rules. If blank, we use
+	// our usual rules, or UnicodeNickRegex if NickAllowUnicode is set.
+	NickValidRegex string
+
+	// Whether to permit letters in any script in nicks.
+	NickAllowUnicode bool
+
+	// Whether a client's hostname must resolve back to their IP. If not, we
+	// use the name from reverse DNS as is.
+	RequireForwardDNS bool
+
+	// A MaxMind DB (MMDB) country database such as GeoLite2 Country. We note
+	// the country clients connect from. If blank, we don't look it up.
+	GeoIPDB string
+
+	// File to save a snapshot to when we restart. With one, users stay
+	// connected across restarts. If blank, everyone disconnects.
+	SnapshotFile string
+
+	// Whether to K-Line an IP automatically if it floods more than
+	// AutoKLineCount times within AutoKLineWindow.
+	AutoKLineOnFlood bool
+	AutoKLineCount   int
+	AutoKLineWindow  time.Duration
+
+	// How long automatic K-Lines last, in minutes.
+	AutoKLineDuration int
+
+	// Host masks of users exempt from flood control. They may be globs or
+	// CIDRs, as in K-Lines.
+	FloodExempt []string
+
+	// Whether to create NickServ. It's an example service that only answers
+	// HELP.
+	NickServStub bool
+
+	// Whether to tell local opers about netsplits and netjoins.
+	NetsplitNotifyOpers bool
+
+	// Whether to tell local users about netsplits and netjoins when they share
+	// a channel with users on the other side.
+	NetsplitNotifyUsers bool
+
+	// A glob matching channels whose members we tell about oper actions such
+	// as K-Lines and OPME, e.g. #opers. If blank, we tell no channels.
+	ChannelNoticePattern string
 }
 
 // ServerDefinition defines how to link to a server.
@@ -56,6 +246,14 @@ type ServerDefinition struct {
 	Port     int
 	Pass     string
 	TLS      bool
+
+	// Whether to offer to compress the link. We compress it if the server
+	// offers too.
+	ZIP bool
+
+	// Whether to prove we know the password with CHALLENGE rather than sending
+	// it. The server must be configured the same way.
+	UseChallenge bool
 }
 
 // UserConfig defines settings about users. Matched by usermask and hostmask.
@@ -70,8 +268,64 @@ type UserConfig struct {
 
 	// If non-blank, a spoof to set instead of their host.
 	Spoof string
+
+	// If non-blank, the connection class to put the user in.
+	Class string
+
+	// How many channels the user may be in at once. 0 for no limit.
+	MaxChannels int
 }
 
+// ConnClass defines limits for a group of users.
+type ConnClass struct {
+	Name string
+
+	// How many local users may be in the class at once. 0 for no limit.
+	MaxUsers int
+
+	// Period of time a user can be idle before we send it a PING.
+	PingTime time.Duration
+
+	// Period of time a user can be idle before we consider it dead.
+	DeadTime time.Duration
+
+	// How many messages we may have waiting to send to a user before we cut it
+	// off. 0 for no limit beyond the size of its write channel.
+	MaxSendQ int
+
+	// How many messages a user may have queued by flood control before we cut
+	// it off for excess flood.
+	MaxRecvQ int
+
+	// How many messages a user may send at once before flood control kicks in.
+	FloodThreshold int
+}
+
+// SpamFilter defines what to do about channel messages matching a pattern.
+type SpamFilter struct {
+	Name string
+
+	// A regular expression. It matches anywhere in the message.
+	Pattern string
+
+	// One of warn, drop, kick, or kline.
+	Action string
+
+	Reason string
+}
+
+// SpamFilterActions are the actions a spam filter may take.
+var SpamFilterActions = map[string]struct{}{
+	"warn":  {},
+	"drop":  {},
+	"kick":  {},
+	"kline": {},
+}
+
+// DefaultConnClass is the name of the class users are in if they have no
+// other.
+const DefaultConnClass = "default"
+
 // checkAndParseConfig checks configuration keys are present and in an
 // acceptable format.
 //
@@ -79,11 +333,92 @@ type UserConfig struct {
 //
 // This function populates both the server.Config and server.Opers fields.
 func checkAndParseConfig(file string) (*Config, error) {
-	m, err := config.ReadStringMap(file)
+	m, err := readConfigMap(file)
 	if err != nil {
 		return nil, err
 	}
 
+	return parseConfigMap(m)
+}
+
+// readConfigMap reads a config file into a map of keys to values. If the file
+// name ends in .json, the file is a JSON object. Otherwise it has a key = value
+// on each line.
+func readConfigMap(file string) (map[string]string, error) {
+	if strings.EqualFold(filepath.Ext(file), ".json") {
+		return readJSONConfig(file)
+	}
+	return config.ReadStringMap(file)
+}
+
+// readJSONConfig reads a JSON config file. It is an object with the same keys
+// as the key = value format. Values may be strings, numbers, or booleans. A
+// boolean becomes 1 or 0.
+func readJSONConfig(file string) (map[string]string, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read config: %s", err)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(buf))
+	decoder.UseNumber()
+
+	var raw map[string]interface{}
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("unable to parse JSON config: %s: %s", file, err)
+	}
+	if raw == nil {
+		return nil, fmt.Errorf("JSON config is not an object: %s", file)
+	}
+
+	m := make(map[string]string, len(raw))
+	for key, value := range raw {
+		switch v := value.(type) {
+		case string:
+			m[key] = v
+		case json.Number:
+			m[key] = v.String()
+		case bool:
+			m[key] = "0"
+			if v {
+				m[key] = "1"
+			}
+		default:
+			return nil, fmt.Errorf(
+				"config value for %s must be a string, number, or boolean", key)
+		}
+	}
+
+	return m, nil
+}
+
+// dumpConfig reads and checks a config file and writes its keys and values to
+// w as JSON. This is a way to convert a config to JSON.
+func dumpConfig(file string, w io.Writer) error {
+	m, err := readConfigMap(file)
+	if err != nil {
+		return err
+	}
+
+	if _, err := parseConfigMap(m); err != nil {
+		return err
+	}
+
+	buf, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode config: %s", err)
+	}
+
+	if _, err := w.Write(append(buf, '\n')); err != nil {
+		return fmt.Errorf("unable to write config: %s", err)
+	}
+	return nil
+}
+
+// parseConfigMap checks and parses the keys and values of a config file.
+func parseConfigMap(m map[string]string) (*Config, error) {
+	var err error
+
 	c := &Config{}
 
 	c.ListenHost = "0.0.0.0"
@@ -124,6 +459,21 @@ func checkAndParseConfig(file string) (*Config, error) {
 		c.MOTD = m["motd"]
 	}
 
+	if m["motd-throttle"] != "" {
+		c.MOTDThrottle, err = time.ParseDuration(m["motd-throttle"])
+		if err != nil || c.MOTDThrottle < 0 {
+			return nil, fmt.Errorf("MOTD throttle is not valid: %s",
+				m["motd-throttle"])
+		}
+	}
+
+	if m["nick-delay"] != "" {
+		c.NickDelay, err = time.ParseDuration(m["nick-delay"])
+		if err != nil || c.NickDelay < 0 {
+			return nil, fmt.Errorf("nick delay is not valid: %s", m["nick-delay"])
+		}
+	}
+
 	c.MaxNickLength = 9
 	if m["max-nick-length"] != "" {
 		nickLen64, err := strconv.ParseInt(m["max-nick-length"], 10, 8)
@@ -161,7 +511,7 @@ func checkAndParseConfig(file string) (*Config, error) {
 	// opers.conf.
 
 	if m["opers-config"] != "" {
-		opers, err := config.ReadStringMap(m["opers-config"])
+		opers, err := readConfigMap(m["opers-config"])
 		if err != nil {
 			return nil, fmt.Errorf("unable to load opers config: %s", err)
 		}
@@ -170,12 +520,32 @@ func checkAndParseConfig(file string) (*Config, error) {
 		c.Opers = map[string]string{}
 	}
 
+	c.OperCerts = map[string]string{}
+	if m["oper-certs-config"] != "" {
+		operCerts, err := readConfigMap(m["oper-certs-config"])
+		if err != nil {
+			return nil, fmt.Errorf("unable to load oper certs config: %s", err)
+		}
+		for name, certFP := range operCerts {
+			c.OperCerts[name] = normalizeCertFP(certFP)
+		}
+	}
+
+	c.OperRSAKeys = map[string]string{}
+	if m["oper-rsa-keys-config"] != "" {
+		operRSAKeys, err := readConfigMap(m["oper-rsa-keys-config"])
+		if err != nil {
+			return nil, fmt.Errorf("unable to load oper RSA keys config: %s", err)
+		}
+		c.OperRSAKeys = operRSAKeys
+	}
+
 	// servers.conf.
 
 	c.Servers = make(map[string]*ServerDefinition)
 
 	if m["servers-config"] != "" {
-		servers, err := config.ReadStringMap(m["servers-config"])
+		servers, err := readConfigMap(m["servers-config"])
 		if err != nil {
 			return nil, fmt.Errorf("unable to load servers config: %s", err)
 		}
@@ -193,7 +563,7 @@ func checkAndParseConfig(file string) (*Config, error) {
 	// users.conf.
 
 	if m["users-config"] != "" {
-		usersConfig, err := config.ReadStringMap(m["users-config"])
+		usersConfig, err := readConfigMap(m["users-config"])
 		if err != nil {
 			return nil, fmt.Errorf("unable to load users config: %s", err)
 		}
@@ -208,6 +578,62 @@ func checkAndParseConfig(file string) (*Config, error) {
 		}
 	}
 
+	// classes.conf.
+
+	if m["classes-config"] != "" {
+		classesConfig, err := readConfigMap(m["classes-config"])
+		if err != nil {
+			return nil, fmt.Errorf("unable to load classes config: %s", err)
+		}
+
+		for name, value := range classesConfig {
+			class, err := parseConnClass(name, value)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse class %s: %s: %s", name, value,
+					err)
+			}
+			c.ConnClasses = append(c.ConnClasses, class)
+		}
+
+		// Map order is random. Keep them in a stable order.
+		sort.Slice(c.ConnClasses, func(i, j int) bool {
+			return c.ConnClasses[i].Name < c.ConnClasses[j].Name
+		})
+	}
+
+	// spam-filters.conf.
+
+	if m["spam-filters-config"] != "" {
+		spamFiltersConfig, err := readConfigMap(m["spam-filters-config"])
+		if err != nil {
+			return nil, fmt.Errorf("unable to load spam filters config: %s", err)
+		}
+
+		for name, value := range spamFiltersConfig {
+			filter, err := parseSpamFilter(name, value)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse spam filter %s: %s: %s", name,
+					value, err)
+			}
+			c.SpamFilters = append(c.SpamFilters, filter)
+		}
+
+		// Map order is random. Keep them in a stable order.
+		sort.Slice(c.SpamFilters, func(i, j int) bool {
+			return c.SpamFilters[i].Name < c.SpamFilters[j].Name
+		})
+	}
+
+	for _, userConfig := range c.UserConfigs {
+		if userConfig.Class == "" || userConfig.Class == DefaultConnClass {
+			continue
+		}
+		if _, ok := c.findConnClass(userConfig.Class); !ok {
+			return nil, fmt.Errorf("user config refers to unknown class: %s",
+				userConfig.Class)
+		}
+	}
+
 	c.TS6SID = TS6SID("000")
 
 	if m["ts6-sid"] != "" {
@@ -219,15 +645,258 @@ func checkAndParseConfig(file string) (*Config, error) {
 
 	c.AdminEmail = m["admin-email"]
 
+	c.StateFile = m["state-file"]
+
+	c.XLineFile = m["xline-file"]
+
+	c.DLineFile = m["dline-file"]
+
+	c.ChanRegFile = m["chanreg-file"]
+
+	c.ProxyProtocol = m["proxy-protocol"] == "1"
+
+	c.UserPassword = m["user-password"]
+
+	c.HealthAddr = m["health-addr"]
+
+	c.AccessLog = m["access-log"]
+
+	c.SnapshotFile = m["snapshot-file"]
+
+	c.LogLevel = LogLevelInfo
+	if m["log-level"] != "" {
+		c.LogLevel, err = parseLogLevel(m["log-level"])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	c.LogFormat = "text"
+	if m["log-format"] != "" {
+		if m["log-format"] != "text" && m["log-format"] != "json" {
+			return nil, fmt.Errorf("log format must be text or json")
+		}
+		c.LogFormat = m["log-format"]
+	}
+
+	c.PropagateRehash = m["propagate-rehash"] == "1"
+
+	c.CloakIPv4 = m["cloak-ipv4"] == "1"
+	c.CloakIPv6 = m["cloak-ipv6"] == "1"
+
+	c.RulesFile = m["rules-file"]
+	c.RulesOnConnect = m["rules-on-connect"] == "1"
+
+	if m["welcome-lines"] != "" {
+		for _, line := range strings.Split(m["welcome-lines"], "|") {
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+			c.WelcomeLines = append(c.WelcomeLines, line)
+		}
+	}
+	c.WelcomeFile = m["welcome-file"]
+
+	c.HelpDir = m["help-dir"]
+
+	c.EnableHelp = true
+	if m["enable-help"] != "" {
+		c.EnableHelp = m["enable-help"] == "1"
+	}
+
+	c.HistorySize = 100
+	if m["history-size"] != "" {
+		historySize, err := strconv.Atoi(m["history-size"])
+		if err != nil || historySize < 0 {
+			return nil, fmt.Errorf("history size is not valid: %s",
+				m["history-size"])
+		}
+		c.HistorySize = historySize
+	}
+
+	if m["burst-rate-limit"] != "" {
+		burstRateLimit, err := strconv.Atoi(m["burst-rate-limit"])
+		if err != nil || burstRateLimit < 0 {
+			return nil, fmt.Errorf("burst rate limit is not valid: %s",
+				m["burst-rate-limit"])
+		}
+		c.BurstRateLimit = burstRateLimit
+	}
+
+	c.AutoKLineOnFlood = m["auto-kline-on-flood"] == "1"
+
+	c.AutoKLineCount = 3
+	if m["auto-kline-count"] != "" {
+		count, err := strconv.Atoi(m["auto-kline-count"])
+		if err != nil || count < 0 {
+			return nil, fmt.Errorf("auto K-Line count is not valid: %s",
+				m["auto-kline-count"])
+		}
+		c.AutoKLineCount = count
+	}
+
+	c.AutoKLineWindow = 5 * time.Minute
+	if m["auto-kline-window"] != "" {
+		c.AutoKLineWindow, err = time.ParseDuration(m["auto-kline-window"])
+		if err != nil {
+			return nil, fmt.Errorf("auto K-Line window is in invalid format: %s",
+				err)
+		}
+	}
+
+	c.AutoKLineDuration = 10
+	if m["auto-kline-duration"] != "" {
+		duration, err := strconv.Atoi(m["auto-kline-duration"])
+		if err != nil || duration <= 0 {
+			return nil, fmt.Errorf("auto K-Line duration is not valid: %s",
+				m["auto-kline-duration"])
+		}
+		c.AutoKLineDuration = duration
+	}
+
+	if m["flood-exempt"] != "" {
+		for _, mask := range strings.Split(m["flood-exempt"], ",") {
+			mask = strings.TrimSpace(mask)
+			if !isValidHostMask(mask) {
+				return nil, fmt.Errorf("flood exempt mask is not valid: %s", mask)
+			}
+			c.FloodExempt = append(c.FloodExempt, mask)
+		}
+	}
+
+	c.NickServStub = m["nickserv-stub"] == "1"
+
+	c.NetsplitNotifyOpers = m["netsplit-notify-opers"] == "1"
+	c.NetsplitNotifyUsers = m["netsplit-notify-users"] == "1"
+
+	c.ChannelNoticePattern = m["channel-notice-pattern"]
+
+	c.ShowOperOnConnect = m["show-oper-on-connect"] == "1"
+
+	c.MaxAcceptList = 20
+	if m["max-accept-list"] != "" {
+		maxAcceptList, err := strconv.Atoi(m["max-accept-list"])
+		if err != nil || maxAcceptList < 0 {
+			return nil, fmt.Errorf("max accept list is not valid: %s",
+				m["max-accept-list"])
+		}
+		c.MaxAcceptList = maxAcceptList
+	}
+
+	c.MaxWatchSize = 128
+	if m["max-watch-size"] != "" {
+		maxWatchSize, err := strconv.Atoi(m["max-watch-size"])
+		if err != nil || maxWatchSize < 0 {
+			return nil, fmt.Errorf("max watch size is not valid: %s",
+				m["max-watch-size"])
+		}
+		c.MaxWatchSize = maxWatchSize
+	}
+
+	c.MaxMetadataKeys = 20
+	if m["max-metadata-keys"] != "" {
+		maxMetadataKeys, err := strconv.Atoi(m["max-metadata-keys"])
+		if err != nil || maxMetadataKeys < 0 {
+			return nil, fmt.Errorf("max metadata keys is not valid: %s",
+				m["max-metadata-keys"])
+		}
+		c.MaxMetadataKeys = maxMetadataKeys
+	}
+
+	c.MaxKickLength = 255
+	if m["max-kick-length"] != "" {
+		maxKickLength, err := strconv.Atoi(m["max-kick-length"])
+		if err != nil || maxKickLength < 1 {
+			return nil, fmt.Errorf("max kick length is not valid: %s",
+				m["max-kick-length"])
+		}
+		c.MaxKickLength = maxKickLength
+	}
+
+	c.MaxQuitLength = 255
+	if m["max-quit-length"] != "" {
+		maxQuitLength, err := strconv.Atoi(m["max-quit-length"])
+		if err != nil || maxQuitLength < 1 {
+			return nil, fmt.Errorf("max quit length is not valid: %s",
+				m["max-quit-length"])
+		}
+		c.MaxQuitLength = maxQuitLength
+	}
+
+	c.MaxPartLength = 255
+	if m["max-part-length"] != "" {
+		maxPartLength, err := strconv.Atoi(m["max-part-length"])
+		if err != nil || maxPartLength < 1 {
+			return nil, fmt.Errorf("max part length is not valid: %s",
+				m["max-part-length"])
+		}
+		c.MaxPartLength = maxPartLength
+	}
+
+	if m["max-registrations-per-second"] != "" {
+		maxRegistrations, err := strconv.Atoi(m["max-registrations-per-second"])
+		if err != nil || maxRegistrations < 0 {
+			return nil, fmt.Errorf("max registrations per second is not valid: %s",
+				m["max-registrations-per-second"])
+		}
+		c.MaxRegistrationsPerSecond = maxRegistrations
+	}
+
+	c.AllowSERVLIST = true
+	if m["allow-servlist"] != "" {
+		c.AllowSERVLIST = m["allow-servlist"] == "1"
+	}
+
+	c.MapMaxDepth = 5
+	if m["map-max-depth"] != "" {
+		mapMaxDepth, err := strconv.Atoi(m["map-max-depth"])
+		if err != nil || mapMaxDepth < 1 {
+			return nil, fmt.Errorf("map max depth is not valid: %s",
+				m["map-max-depth"])
+		}
+		c.MapMaxDepth = mapMaxDepth
+	}
+
+	c.HideStats = m["hide-stats"] == "1"
+
+	c.MaxWhoisPerMinute = 30
+	if m["max-whois-per-minute"] != "" {
+		maxWhois, err := strconv.Atoi(m["max-whois-per-minute"])
+		if err != nil || maxWhois < 0 {
+			return nil, fmt.Errorf("max whois per minute is not valid: %s",
+				m["max-whois-per-minute"])
+		}
+		c.MaxWhoisPerMinute = maxWhois
+	}
+
+	c.BatchWrites = true
+	if m["batch-writes"] != "" {
+		c.BatchWrites = m["batch-writes"] == "1"
+	}
+
+	c.NickValidRegex = m["nick-valid-regex"]
+	c.NickAllowUnicode = m["nick-allow-unicode"] == "1"
+	if _, err := newNickValidator(c); err != nil {
+		return nil, err
+	}
+
+	c.RequireForwardDNS = true
+	if m["require-forward-dns"] != "" {
+		c.RequireForwardDNS = m["require-forward-dns"] == "1"
+	}
+
+	c.GeoIPDB = m["geoip-db"]
+
 	return c, nil
 }
 
 // Parse the value side of a server definition from the servers config.
 // Format:
-// <hostname>,<port>,<password>,<tls: 1 or 0>
+// <hostname>,<port>,<password>,<tls: 1 or 0>[,<zip: 1 or 0>[,<challenge: 1 or 0>]]
 func parseLink(name, s string) (*ServerDefinition, error) {
 	pieces := strings.Split(s, ",")
-	if len(pieces) != 4 {
+	if len(pieces) < 4 || len(pieces) > 6 {
 		return nil, fmt.Errorf("unexpected number of fields")
 	}
 
@@ -253,13 +922,16 @@ func parseLink(name, s string) (*ServerDefinition, error) {
 		Port:     int(port),
 		Pass:     pass,
 		TLS:      pieces[3] == "1",
+		ZIP:      len(pieces) >= 5 && strings.TrimSpace(pieces[4]) == "1",
+		UseChallenge: len(pieces) == 6 &&
+			strings.TrimSpace(pieces[5]) == "1",
 	}, nil
 }
 
 // Parse the value part of a user config line.
 // This is a comma separated value.
 // A line looks like so:
-// <name> = <user mask>,<host mask>,<flood exempt = 1|0>,<spoof>
+// <name> = <user mask>,<host mask>,<flood exempt = 1|0>,<spoof>[,<class>[,<max channels>]]
 //
 // This function takes the portion after the equals sign and parses it.
 //
@@ -267,12 +939,18 @@ func parseLink(name, s string) (*ServerDefinition, error) {
 // that.
 //
 // <user mask> and <host mask> define how to match the user's raw user and
-// host. If they both match, the user falls under this config.
+// host. If they both match, the user falls under this config. The host mask
+// may be a CIDR. If so it matches the user's IP.
 //
 // Spoof may be empty.
+//
+// Class is optional. If it's absent or blank, the user is in the default
+// class.
+//
+// Max channels is optional. If it's absent or 0, there is no limit.
 func parseUserConfig(s string) (UserConfig, error) {
 	piecesUntrimmed := strings.Split(s, ",")
-	if len(piecesUntrimmed) != 4 {
+	if len(piecesUntrimmed) < 4 || len(piecesUntrimmed) > 6 {
 		return UserConfig{}, fmt.Errorf("unexpected number of fields")
 	}
 
@@ -303,10 +981,158 @@ func parseUserConfig(s string) (UserConfig, error) {
 		}
 	}
 
+	class := ""
+	if len(pieces) >= 5 {
+		class = pieces[4]
+	}
+
+	maxChannels := 0
+	if len(pieces) == 6 && pieces[5] != "" {
+		n, err := strconv.Atoi(pieces[5])
+		if err != nil || n < 0 {
+			return UserConfig{}, fmt.Errorf("invalid max channels: %s", pieces[5])
+		}
+		maxChannels = n
+	}
+
 	return UserConfig{
 		UserMask:    userMask,
 		HostMask:    hostMask,
 		FloodExempt: floodExempt,
 		Spoof:       spoof,
+		Class:       class,
+		MaxChannels: maxChannels,
+	}, nil
+}
+
+// Parse the value part of a class config line.
+// A line looks like so:
+// <name> = <max users>,<ping time>,<dead time>,<max sendq>,<max recvq>,<flood threshold>
+//
+// Max users and max sendq may be 0 for no limit.
+func parseConnClass(name, s string) (ConnClass, error) {
+	pieces := strings.Split(s, ",")
+	if len(pieces) != 6 {
+		return ConnClass{}, fmt.Errorf("unexpected number of fields")
+	}
+
+	for i := range pieces {
+		pieces[i] = strings.TrimSpace(pieces[i])
+	}
+
+	maxUsers, err := strconv.Atoi(pieces[0])
+	if err != nil || maxUsers < 0 {
+		return ConnClass{}, fmt.Errorf("invalid max users: %s", pieces[0])
+	}
+
+	pingTime, err := time.ParseDuration(pieces[1])
+	if err != nil || pingTime <= 0 {
+		return ConnClass{}, fmt.Errorf("invalid ping time: %s", pieces[1])
+	}
+
+	deadTime, err := time.ParseDuration(pieces[2])
+	if err != nil || deadTime <= 0 {
+		return ConnClass{}, fmt.Errorf("invalid dead time: %s", pieces[2])
+	}
+
+	maxSendQ, err := strconv.Atoi(pieces[3])
+	if err != nil || maxSendQ < 0 {
+		return ConnClass{}, fmt.Errorf("invalid max sendq: %s", pieces[3])
+	}
+
+	maxRecvQ, err := strconv.Atoi(pieces[4])
+	if err != nil || maxRecvQ <= 0 {
+		return ConnClass{}, fmt.Errorf("invalid max recvq: %s", pieces[4])
+	}
+
+	floodThreshold, err := strconv.Atoi(pieces[5])
+	if err != nil || floodThreshold <= 0 {
+		return ConnClass{}, fmt.Errorf("invalid flood threshold: %s", pieces[5])
+	}
+
+	return ConnClass{
+		Name:           name,
+		MaxUsers:       maxUsers,
+		PingTime:       pingTime,
+		DeadTime:       deadTime,
+		MaxSendQ:       maxSendQ,
+		MaxRecvQ:       maxRecvQ,
+		FloodThreshold: floodThreshold,
+	}, nil
+}
+
+// Parse the value part of a spam filter config line.
+// A line looks like so:
+// <name> = <action>,<reason>,<pattern>
+//
+// The pattern comes last so it may contain commas.
+func parseSpamFilter(name, s string) (SpamFilter, error) {
+	pieces := strings.SplitN(s, ",", 3)
+	if len(pieces) != 3 {
+		return SpamFilter{}, fmt.Errorf("unexpected number of fields")
+	}
+
+	action := strings.ToLower(strings.TrimSpace(pieces[0]))
+	if _, ok := SpamFilterActions[action]; !ok {
+		return SpamFilter{}, fmt.Errorf("invalid action: %s", pieces[0])
+	}
+
+	reason := strings.TrimSpace(pieces[1])
+	if reason == "" {
+		return SpamFilter{}, fmt.Errorf("reason is blank")
+	}
+
+	pattern := strings.TrimSpace(pieces[2])
+	if pattern == "" {
+		return SpamFilter{}, fmt.Errorf("pattern is blank")
+	}
+	if _, err := regexp.Compile(pattern); err != nil {
+		return SpamFilter{}, fmt.Errorf("invalid pattern: %s", err)
+	}
+
+	return SpamFilter{
+		Name:    name,
+		Pattern: pattern,
+		Action:  action,
+		Reason:  reason,
 	}, nil
 }
+
+// findConnClass looks up a configured class by name.
+func (c *Config) findConnClass(name string) (ConnClass, bool) {
+	for _, class := range c.ConnClasses {
+		if class.Name == name {
+			return class, true
+		}
+	}
+	return ConnClass{}, false
+}
+
+// connClass returns the class with the given name. If there is no such
+// class, we fall back to the default class.
+//
+// The default class uses the global ping and dead times and flood limits
+// unless the classes config defines one named default.
+func (c *Config) connClass(name string) ConnClass {
+	if class, ok := c.findConnClass(name); ok {
+		return class
+	}
+
+	if class, ok := c.findConnClass(DefaultConnClass); ok {
+		return class
+	}
+
+	return ConnClass{
+		Name:           DefaultConnClass,
+		PingTime:       c.PingTime,
+		DeadTime:       c.DeadTime,
+		MaxRecvQ:       ExcessFloodThreshold,
+		FloodThreshold: UserMessageLimit,
+	}
+}
+
+// normalizeCertFP puts a fingerprint in the form certFingerprint makes. This
+// lets people write fingerprints in uppercase or with colons.
+func normalizeCertFP(certFP string) string {
+	return strings.ToLower(strings.Replace(certFP, ":", "", -1))
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseConnClass(t *testing.T) {
+	tests := []struct {
+		input   string
+		success bool
+		class   ConnClass
+	}{
+		{
+			"10, 1m, 5m, 1000, 100, 20",
+			true,
+			ConnClass{Name: "test", MaxUsers: 10, PingTime: time.Minute,
+				DeadTime: 5 * time.Minute, MaxSendQ: 1000, MaxRecvQ: 100,
+				FloodThreshold: 20},
+		},
+		{"0,30s,4m,0,50,10", true,
+			ConnClass{Name: "test", PingTime: 30 * time.Second,
+				DeadTime: 4 * time.Minute, MaxRecvQ: 50, FloodThreshold: 10}},
+		{"10,1m,5m,1000,100", false, ConnClass{}},
+		{"-1,1m,5m,1000,100,20", false, ConnClass{}},
+		{"10,1,5m,1000,100,20", false, ConnClass{}},
+		{"10,1m,5m,1000,0,20", false, ConnClass{}},
+		{"10,1m,5m,1000,100,0", false, ConnClass{}},
+	}
+
+	for _, test := range tests {
+		class, err := parseConnClass("test", test.input)
+		if err != nil {
+			if test.success {
+				t.Errorf("parseConnClass(%s) = error %s, wanted success", test.input,
+					err)
+			}
+			continue
+		}
+
+		if !test.success {
+			t.Errorf("parseConnClass(%s) = success, wanted error", test.input)
+			continue
+		}
+
+		if class != test.class {
+			t.Errorf("parseConnClass(%s) = %+v, wanted %+v", test.input, class,
+				test.class)
+		}
+	}
+}
+
+func TestParseSpamFilter(t *testing.T) {
+	tests := []struct {
+		input   string
+		success bool
+		filter  SpamFilter
+	}{
+		{"warn, Links, https?://", true,
+			SpamFilter{Name: "test", Pattern: "https?://", Action: "warn",
+				Reason: "Links"}},
+		{"KLINE,Spam,a{1,3}b", true,
+			SpamFilter{Name: "test", Pattern: "a{1,3}b", Action: "kline",
+				Reason: "Spam"}},
+		{"warn,Links", false, SpamFilter{}},
+		{"ban,Links,https?://", false, SpamFilter{}},
+		{"drop,,https?://", false, SpamFilter{}},
+		{"drop,Links,", false, SpamFilter{}},
+		{"drop,Links,(", false, SpamFilter{}},
+	}
+
+	for _, test := range tests {
+		filter, err := parseSpamFilter("test", test.input)
+		if err != nil {
+			if test.success {
+				t.Errorf("parseSpamFilter(%s) = error %s, wanted success", test.input,
+					err)
+			}
+			continue
+		}
+
+		if !test.success {
+			t.Errorf("parseSpamFilter(%s) = success, wanted error", test.input)
+			continue
+		}
+
+		if filter != test.filter {
+			t.Errorf("parseSpamFilter(%s) = %+v, wanted %+v", test.input, filter,
+				test.filter)
+		}
+	}
+}
+
+func TestParseUserConfigClass(t *testing.T) {
+	tests := []struct {
+		input   string
+		success bool
+		class   string
+	}{
+		{"*,*.example.com,0,", true, ""},
+		{"*,*.example.com,0,,trusted", true, "trusted"},
+		{"*,*.example.com,0,,trusted,5,extra", false, ""},
+	}
+
+	for _, test := range tests {
+		userConfig, err := parseUserConfig(test.input)
+		if err != nil {
+			if test.success {
+				t.Errorf("parseUserConfig(%s) = error %s, wanted success", test.input,
+					err)
+			}
+			continue
+		}
+
+		if !test.success {
+			t.Errorf("parseUserConfig(%s) = success, wanted error", test.input)
+			continue
+		}
+
+		if userConfig.Class != test.class {
+			t.Errorf("parseUserConfig(%s) class = %s, wanted %s", test.input,
+				userConfig.Class, test.class)
+		}
+	}
+}
+
+func TestParseUserConfigMaxChannels(t *testing.T) {
+	tests := []struct {
+		input       string
+		success     bool
+		hostMask    string
+		maxChannels int
+	}{
+		{"*,*.example.com,0,", true, "*.example.com", 0},
+		{"*,10.0.0.0/8,0,,trusted,5", true, "10.0.0.0/8", 5},
+		{"*,*.example.com,0,,,5", true, "*.example.com", 5},
+		{"*,*.example.com,0,,trusted,", true, "*.example.com", 0},
+		{"*,*.example.com,0,,trusted,-1", false, "", 0},
+		{"*,*.example.com,0,,trusted,many", false, "", 0},
+		{"*,10.0.0.0/40,0,", false, "", 0},
+	}
+
+	for _, test := range tests {
+		userConfig, err := parseUserConfig(test.input)
+		if err != nil {
+			if test.success {
+				t.Errorf("parseUserConfig(%s) = error %s, wanted success", test.input,
+					err)
+			}
+			continue
+		}
+
+		if !test.success {
+			t.Errorf("parseUserConfig(%s) = success, wanted error", test.input)
+			continue
+		}
+
+		if userConfig.HostMask != test.hostMask {
+			t.Errorf("parseUserConfig(%s) host mask = %s, wanted %s", test.input,
+				userConfig.HostMask, test.hostMask)
+		}
+		if userConfig.MaxChannels != test.maxChannels {
+			t.Errorf("parseUserConfig(%s) max channels = %d, wanted %d", test.input,
+				userConfig.MaxChannels, test.maxChannels)
+		}
+	}
+}
+
+func TestConfigConnClass(t *testing.T) {
+	trusted := ConnClass{Name: "trusted", PingTime: time.Minute,
+		DeadTime: 5 * time.Minute, MaxRecvQ: 100, FloodThreshold: 20}
+	configuredDefault := ConnClass{Name: DefaultConnClass, PingTime: time.Minute,
+		DeadTime: 2 * time.Minute, MaxRecvQ: 10, FloodThreshold: 5}
+	builtinDefault := ConnClass{Name: DefaultConnClass,
+		PingTime: 30 * time.Second, DeadTime: 240 * time.Second,
+		MaxRecvQ: ExcessFloodThreshold, FloodThreshold: UserMessageLimit}
+
+	tests := []struct {
+		classes []ConnClass
+		name    string
+		output  ConnClass
+	}{
+		{[]ConnClass{trusted}, "trusted", trusted},
+		{[]ConnClass{trusted}, "", builtinDefault},
+		{[]ConnClass{trusted}, "missing", builtinDefault},
+		{[]ConnClass{trusted, configuredDefault}, "", configuredDefault},
+	}
+
+	for _, test := range tests {
+		c := &Config{PingTime: 30 * time.Second, DeadTime: 240 * time.Second,
+			ConnClasses: test.classes}
+
+		class := c.connClass(test.name)
+		if class != test.output {
+			t.Errorf("connClass(%s) = %+v, wanted %+v", test.name, class,
+				test.output)
+		}
+	}
+}
+
+func TestParseLink(t *testing.T) {
+	tests := []struct {
+		input     string
+		success   bool
+		tls       bool
+		zip       bool
+		challenge bool
+	}{
+		{"127.0.0.1,6667,pass,1", true, true, false, false},
+		{"127.0.0.1,6667,pass,0,1", true, false, true, false},
+		{"127.0.0.1,6667,pass,1, 0", true, true, false, false},
+		{"127.0.0.1,6667,pass,0,0,1", true, false, false, true},
+		{"127.0.0.1,6667,pass", false, false, false, false},
+		{"127.0.0.1,6667,pass,1,1,1,1", false, false, false, false},
+	}
+
+	for _, test := range tests {
+		link, err := parseLink("irc.example.com", test.input)
+		if err != nil {
+			if test.success {
+				t.Errorf("parseLink(%q) failed: %s", test.input, err)
+			}
+			continue
+		}
+
+		if !test.success {
+			t.Errorf("parseLink(%q) succeeded, wanted failure", test.input)
+			continue
+		}
+
+		if link.TLS != test.tls || link.ZIP != test.zip ||
+			link.UseChallenge != test.challenge {
+			t.Errorf("parseLink(%q) = TLS %v ZIP %v challenge %v, wanted TLS %v "+
+				"ZIP %v challenge %v", test.input, link.TLS, link.ZIP,
+				link.UseChallenge, test.tls, test.zip, test.challenge)
+		}
+	}
+}
+
+func TestReadJSONConfig(t *testing.T) {
+	tests := []struct {
+		input   string
+		success bool
+		output  map[string]string
+	}{
+		{
+			`{"server-name": "irc.example.com", "max-nick-length": 12,
+				"batch-writes": false, "nickserv-stub": true}`,
+			true,
+			map[string]string{"server-name": "irc.example.com",
+				"max-nick-length": "12", "batch-writes": "0", "nickserv-stub": "1"},
+		},
+		{`{}`, true, map[string]string{}},
+		{`{"server-name": ["irc.example.com"]}`, false, nil},
+		{`{"server-name": null}`, false, nil},
+		{`{"server-name": {"a": "b"}}`, false, nil},
+		{`["server-name"]`, false, nil},
+		{`null`, false, nil},
+		{`{"server-name": `, false, nil},
+	}
+
+	dir, err := ioutil.TempDir("", "catbox-config-")
+	if err != nil {
+		t.Fatalf("error making temporary directory: %s", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	file := filepath.Join(dir, "catbox.json")
+
+	for _, test := range tests {
+		if err := ioutil.WriteFile(file, []byte(test.input), 0600); err != nil {
+			t.Fatalf("error writing config: %s", err)
+		}
+
+		output, err := readJSONConfig(file)
+		if !test.success {
+			if err == nil {
+				t.Errorf("readJSONConfig(%s) succeeded, wanted error", test.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("readJSONConfig(%s) = error %s", test.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(output, test.output) {
+			t.Errorf("readJSONConfig(%s) = %v, wanted %v", test.input, output,
+				test.output)
+		}
+	}
+}
+
+// Dumping a config as JSON and reading it back gives the same config.
+func TestDumpConfigRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catbox-config-")
+	if err != nil {
+		t.Fatalf("error making temporary directory: %s", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	// Other config files may be JSON too.
+	usersFile := filepath.Join(dir, "users.json")
+	if err := ioutil.WriteFile(usersFile,
+		[]byte(`{"trusted": "*,*.example.com,1,"}`), 0600); err != nil {
+		t.Fatalf("error writing users config: %s", err)
+	}
+
+	confFile := filepath.Join(dir, "catbox.conf")
+	conf := "server-name = irc.example.org\n" +
+		"ts6-sid = 1AB\n" +
+		"max-nick-length = 12\n" +
+		"ping-time = 2m\n" +
+		"batch-writes = 0\n" +
+		"users-config = " + usersFile + "\n"
+	if err := ioutil.WriteFile(confFile, []byte(conf), 0600); err != nil {
+		t.Fatalf("error writing config: %s", err)
+	}
+
+	var buf bytes.Buffer
+	if err := dumpConfig(confFile, &buf); err != nil {
+		t.Fatalf("dumpConfig() = error %s", err)
+	}
+
+	jsonFile := filepath.Join(dir, "catbox.json")
+	if err := ioutil.WriteFile(jsonFile, buf.Bytes(), 0600); err != nil {
+		t.Fatalf("error writing JSON config: %s", err)
+	}
+
+	fromConf, err := checkAndParseConfig(confFile)
+	if err != nil {
+		t.Fatalf("checkAndParseConfig(conf) = error %s", err)
+	}
+	fromJSON, err := checkAndParseConfig(jsonFile)
+	if err != nil {
+		t.Fatalf("checkAndParseConfig(JSON) = error %s", err)
+	}
+
+	if !reflect.DeepEqual(fromConf, fromJSON) {
+		t.Errorf("JSON config is %+v, wanted %+v", fromJSON, fromConf)
+	}
+	if fromJSON.ServerName != "irc.example.org" || fromJSON.MaxNickLength != 12 ||
+		fromJSON.PingTime != 2*time.Minute || fromJSON.BatchWrites ||
+		len(fromJSON.UserConfigs) != 1 || !fromJSON.UserConfigs[0].FloodExempt {
+		t.Errorf("JSON config is %+v", fromJSON)
+	}
+}
+
+// JSON configs go through the same checks as other configs.
+func TestCheckAndParseConfigJSONInvalid(t *testing.T) {
+	tests := []string{
+		`{"max-nick-length": "abc"}`,
+		`{"ts6-sid": "toolong"}`,
+		`{"ping-time": 5}`,
+		`{"log-format": "xml"}`,
+		`{"nick-valid-regex": "("}`,
+	}
+
+	dir, err := ioutil.TempDir("", "catbox-config-")
+	if err != nil {
+		t.Fatalf("error making temporary directory: %s", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	file := filepath.Join(dir, "catbox.json")
+
+	for _, test := range tests {
+		if err := ioutil.WriteFile(file, []byte(test), 0600); err != nil {
+			t.Fatalf("error writing config: %s", err)
+		}
+
+		if _, err := checkAndParseConfig(file); err == nil {
+			t.Errorf("checkAndParseConfig(%s) succeeded, wanted error", test)
+		}
+
+		var buf bytes.Buffer
+		if err := dumpConfig(file, &buf); err == nil {
+			t.Errorf("dumpConfig(%s) succeeded, wanted error", test)
+		}
+	}
+}
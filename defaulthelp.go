@@ -0,0 +1,334 @@
+package main
+
+// defaultHelp is the help we serve when enable-help is set. It covers every
+// command users may send us. Uppercased topic to its lines. The first line is
+// the topic's usage.
+var defaultHelp = map[string][]string{
+	"ACCEPT": {
+		"ACCEPT <nick>[,<nick>...] | ACCEPT -<nick>[,-<nick>...] | ACCEPT *",
+		"While you have user mode +g, only users on your accept list may send you",
+		"private messages. Add nicks, remove them with -, or list them with *.",
+	},
+	"AWAY": {
+		"AWAY [<message>]",
+		"Marks you as away. Users who message you see the message. Without a",
+		"message you are no longer away.",
+	},
+	"CAP": {
+		"CAP <LS | LIST | REQ | END> [<capabilities>]",
+		"Negotiates IRCv3 capabilities. LS shows what we support, REQ asks for",
+		"capabilities, LIST shows what you have, and END finishes negotiation.",
+	},
+	"CHALLENGE": {
+		"CHALLENGE <name> | CHALLENGE +<answer>",
+		"Becomes an operator using a key pair. We send a nonce encrypted with the",
+		"oper's public key. Answer with the base64 encoded SHA-256 hash of the",
+		"decrypted nonce.",
+	},
+	"CHANREG": {
+		"CHANREG <REGISTER | DROP> <#channel> | CHANREG SET <#channel> <flag> <ON | OFF>",
+		"Registers a channel so it keeps its topic and modes when it empties.",
+		"Registrations are local to the server.",
+	},
+	"CHATHISTORY": {
+		"CHATHISTORY <LATEST | BEFORE | AFTER> <#channel> <reference> <count>",
+		"Replays recent messages sent to a channel. The reference is * or",
+		"timestamp=<time>. * is only valid with LATEST. You must have the",
+		"draft/chathistory capability.",
+	},
+	"CONNECT": {
+		"CONNECT <server> [<port> [<remote server>]]",
+		"Links to a server in our configuration. With a remote server, that",
+		"server makes the link instead. Only operators may use it.",
+	},
+	"DIE": {
+		"DIE",
+		"Shuts down the server. Only operators may use it.",
+		"Every user on the server is disconnected.",
+	},
+	"DLINE": {
+		"DLINE [<minutes>] <IP or CIDR> <reason>",
+		"Bans an IP address or range from the network. Without a duration the",
+		"D-Line is permanent. Only operators may use it. See also UNDLINE.",
+	},
+	"FINGERPRINT": {
+		"FINGERPRINT",
+		"Shows the fingerprint of the TLS certificate you connected with.",
+		"Operators may use it to log in with OPER without a password.",
+	},
+	"GLINE": {
+		"GLINE [<minutes>] <user@host> <reason>",
+		"Bans user@host from the network. Without a duration the G-Line is",
+		"permanent. Only operators may use it. See also UNGLINE.",
+	},
+	"GNOTICE": {
+		"GNOTICE <text>",
+		"Sends a notice to every user on the network. Only operators may use it,",
+		"and only once in a while.",
+	},
+	"HELP": {
+		"HELP [<topic>]",
+		"Shows help on a topic, usually a command. Without a topic it lists the",
+		"topics. HELPOP is the same.",
+	},
+	"INVITE": {
+		"INVITE <nick> <#channel>",
+		"Invites a user to a channel, letting them past +i. On an invite only",
+		"channel you must be a channel operator. Invites expire after a while.",
+	},
+	"INVITELIST": {
+		"INVITELIST [<#channel>]",
+		"Lists pending channel invites. Without a channel it lists them for every",
+		"channel. Only operators may use it.",
+	},
+	"JOIN": {
+		"JOIN <#channel>[,<#channel>...] [<key>[,<key>...]]",
+		"Joins channels, creating them if they don't exist. A channel with +k",
+		"needs its key. JOIN 0 parts every channel you're on.",
+	},
+	"KICK": {
+		"KICK <#channel> <nick> [<reason>]",
+		"Removes a user from a channel. You must be a channel operator.",
+		"They may join again unless something stops them, such as a ban.",
+	},
+	"KILL": {
+		"KILL <nick> [<reason>]",
+		"Disconnects a user from the network. Only operators may use it.",
+		"The reason is shown in their quit message.",
+	},
+	"KLINE": {
+		"KLINE [<minutes>] <user@host> <reason>",
+		"Bans user@host from the network and disconnects matching users. Only",
+		"operators may use it. See also UNKLINE.",
+	},
+	"LINKS": {
+		"LINKS",
+		"Lists the servers on the network and their descriptions.",
+		"We ignore any parameters.",
+	},
+	"LIST": {
+		"LIST [<#channel>[,<#channel>...]]",
+		"Lists channels with how many users are on them and their topics. Secret",
+		"channels you're not on don't show. Private channels you're not on show",
+		"as * with no topic.",
+	},
+	"LUSERS": {
+		"LUSERS",
+		"Shows how many users, operators, channels, and servers there are, here",
+		"and on the whole network.",
+	},
+	"MAP": {
+		"MAP",
+		"Shows the servers on the network as a tree with their user counts.",
+		"Servers far from us are summarized.",
+	},
+	"METADATA": {
+		"METADATA <target> <GET | LIST | SET | CLEAR> [<key> [<value>]]",
+		"Shows and changes metadata on yourself (*), users, and channels. You may",
+		"change your own metadata, and channel operators their channel's. You",
+		"must have the metadata capability.",
+	},
+	"MODE": {
+		"MODE <nick | #channel> [<modes> [<parameters>]]",
+		"Shows or changes user modes (+giowC) or channel modes. Without modes it",
+		"shows the current ones. Changing channel modes needs channel operator",
+		"status.",
+	},
+	"MOTD": {
+		"MOTD",
+		"Shows the server's message of the day.",
+		"We show it when you connect too.",
+	},
+	"NAMES": {
+		"NAMES <#channel>[,<#channel>...]",
+		"Lists the users on channels with their status prefixes (~, @, %, +).",
+		"You only see who is on a secret channel if you're on it too.",
+	},
+	"NICK": {
+		"NICK <nick>",
+		"Changes your nick. It must be valid and not in use. Users who share a",
+		"channel with you see the change.",
+	},
+	"NOTICE": {
+		"NOTICE <target> <text>",
+		"Sends a notice to a user or channel. It is like PRIVMSG but nobody",
+		"should reply to it automatically.",
+	},
+	"OJOIN": {
+		"OJOIN <#channel>",
+		"Joins a channel with channel operator status whatever its modes. Only",
+		"operators may use it. We tell the other operators.",
+	},
+	"OPER": {
+		"OPER <name> [<password>]",
+		"Makes you an operator. The password is optional if you connected with",
+		"the operator's certificate.",
+	},
+	"OPERS": {
+		"OPERS",
+		"Lists the operators on the network.",
+		"Only operators may use it.",
+	},
+	"OPME": {
+		"OPME <#channel>",
+		"Gives you channel operator status in a channel, joining it if need be.",
+		"Only operators may use it. We tell the other operators.",
+	},
+	"PART": {
+		"PART <#channel>[,<#channel>...] [<message>]",
+		"Leaves channels. The message is shown to the channel.",
+		"Long messages are cut short.",
+	},
+	"PING": {
+		"PING <token>",
+		"Asks the server to reply with PONG and the token.",
+		"Clients use it to check the connection is alive.",
+	},
+	"PONG": {
+		"PONG <token>",
+		"Replies to a PING from the server.",
+		"If you don't reply in time we disconnect you.",
+	},
+	"PRIVMSG": {
+		"PRIVMSG <target> <text>",
+		"Sends a message to a user or channel. Operators may send to every user",
+		"on matching servers with $<server mask>.",
+	},
+	"QUIT": {
+		"QUIT [<message>]",
+		"Disconnects you from the server. The message is shown to users who",
+		"share a channel with you. Long messages are cut short.",
+	},
+	"REHASH": {
+		"REHASH [<server or mask>] [motd | opers | servers | all]",
+		"Reloads the configuration. Naming a server or mask reloads those servers",
+		"instead. Only operators may use it.",
+	},
+	"RESTART": {
+		"RESTART",
+		"Restarts the server. Only operators may use it.",
+		"Every user on the server is disconnected.",
+	},
+	"RULES": {
+		"RULES",
+		"Shows the server's rules.",
+		"If there are none, we say so.",
+	},
+	"SERVICE": {
+		"SERVICE <nick> <reserved> <distribution> <type> <reserved> <info>",
+		"Registers a service. We only have services we create ourselves, so we",
+		"always refuse it.",
+	},
+	"SERVLIST": {
+		"SERVLIST [<mask> [<type>]]",
+		"Lists the services on the network. The mask matches their nicks.",
+		"Our services have type 0.",
+	},
+	"SQUERY": {
+		"SQUERY <service> <text>",
+		"Sends a message to a service. Our services take PRIVMSG instead.",
+		"We always refuse it.",
+	},
+	"SQUIT": {
+		"SQUIT <server> [<reason>]",
+		"Delinks a server from the network. Only operators may use it.",
+		"Users on the other side of the link are lost.",
+	},
+	"STATS": {
+		"STATS <query>",
+		"Shows server statistics. Queries are c, d, g, k, p, R, u, x, and ?.",
+		"Only operators may use them, except u which shows our uptime.",
+	},
+	"SUMMON": {
+		"SUMMON <user>",
+		"Asks a user logged in to the server's host to join IRC.",
+		"We don't support it.",
+	},
+	"TAGMSG": {
+		"TAGMSG <target>",
+		"Sends a message with only tags to a user or channel. You must have the",
+		"message-tags capability. Only users with it hear it.",
+	},
+	"TIME": {
+		"TIME",
+		"Shows the server's local time.",
+		"We don't support asking other servers.",
+	},
+	"TOPIC": {
+		"TOPIC <#channel> [<topic>]",
+		"Shows or changes a channel's topic. On a channel with +t you must be",
+		"a channel operator to change it. Long topics are cut short.",
+	},
+	"TRACE": {
+		"TRACE [<server>]",
+		"Shows the route to a server and the server's connections. Without a",
+		"server we describe our own. Only operators may use it.",
+	},
+	"UNDLINE": {
+		"UNDLINE <IP or CIDR>",
+		"Removes a D-Line from the network.",
+		"Only operators may use it. See also DLINE.",
+	},
+	"UNGLINE": {
+		"UNGLINE <user@host>",
+		"Removes a G-Line from the network.",
+		"Only operators may use it. See also GLINE.",
+	},
+	"UNKLINE": {
+		"UNKLINE <user@host>",
+		"Removes a K-Line from the network.",
+		"Only operators may use it. See also KLINE.",
+	},
+	"UNXLINE": {
+		"UNXLINE <regex>",
+		"Removes an X-Line from the network.",
+		"Only operators may use it. See also XLINE.",
+	},
+	"USER": {
+		"USER <username> <mode> <unused> <real name>",
+		"Gives your username and real name when you connect.",
+		"You may only send it once.",
+	},
+	"USERS": {
+		"USERS",
+		"Lists the users logged in to the server's host.",
+		"We don't support it.",
+	},
+	"VERSION": {
+		"VERSION",
+		"Shows the server's version and what it supports.",
+		"We don't support asking other servers.",
+	},
+	"WALLOPS": {
+		"WALLOPS <text>",
+		"Sends a message to every operator on the network.",
+		"Only operators may use it.",
+	},
+	"WATCH": {
+		"WATCH [+<nick>] [-<nick>] [C] [L] [S]",
+		"Tells you when nicks come online and go offline. + adds a nick, -",
+		"removes one, C clears the list, L lists it, and S shows each nick's",
+		"status. Without parameters it is the same as L.",
+	},
+	"WHO": {
+		"WHO <#channel> [<flags>]",
+		"Lists the users on a channel. We only support channels, and only users",
+		"on the channel see who is on it.",
+	},
+	"WHOIS": {
+		"WHOIS <nick>",
+		"Shows information about a user, such as their host, server, and the",
+		"channels you share with them. You may only make so many queries each",
+		"minute.",
+	},
+	"WHOWAS": {
+		"WHOWAS <nick>",
+		"Shows information about a user who used a nick before.",
+		"We don't remember, so we always say there was no such nick.",
+	},
+	"XLINE": {
+		"XLINE <regex> <reason>",
+		"Bans users whose real name matches the regex from the network. Only",
+		"operators may use it. See also UNXLINE.",
+	},
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// DLine holds a D-Line. This bans connections by IP. We check them as soon as
+// we accept a connection.
+type DLine struct {
+	// An IP, an IP glob such as 192.0.2.*, or a CIDR such as 192.0.2.0/24.
+	Mask string `json:"mask"`
+
+	Reason string `json:"reason"`
+
+	// When the D-Line expires as a Unix time. Zero if it is permanent.
+	ExpiresAt int64 `json:"expires_at"`
+}
+
+// dlineCommand adds a D-Line.
+//
+// Parameters: [duration] <mask> <reason>
+//
+// The duration is in minutes. Without one the D-Line is permanent.
+func (u *LocalUser) dlineCommand(m irc.Message) {
+	if len(m.Params) < 2 {
+		// 461 ERR_NEEDMOREPARAMS
+		u.messageFromServer("461", []string{"DLINE", "Not enough parameters"})
+		return
+	}
+
+	if !u.User.isOperator() {
+		// 481 ERR_NOPRIVILEGES
+		u.messageFromServer("481", []string{"Permission Denied- You're not an IRC operator"})
+		return
+	}
+
+	params := m.Params
+	minutes := 0
+	if n, err := strconv.Atoi(params[0]); err == nil && n >= 0 {
+		if len(params) < 3 {
+			// 461 ERR_NEEDMOREPARAMS
+			u.messageFromServer("461", []string{"DLINE", "Not enough parameters"})
+			return
+		}
+		minutes = n
+		params = params[1:]
+	}
+
+	if !isValidDLineMask(params[0]) {
+		// 415 ERR_BADMASK
+		u.messageFromServer("415", []string{params[0], "Bad Server/host mask"})
+		return
+	}
+
+	dline := DLine{
+		Mask:   params[0],
+		Reason: params[1],
+	}
+	if minutes > 0 {
+		dline.ExpiresAt = time.Now().Add(time.Duration(minutes) * time.Minute).Unix()
+	}
+
+	// Propagate. Like KLINE this must be in ENCAP. The duration is in seconds.
+	for _, server := range u.Catbox.LocalServers {
+		server.maybeQueueMessage(irc.Message{
+			Prefix:  string(u.User.UID),
+			Command: "ENCAP",
+			Params: []string{"*", "DLINE", strconv.Itoa(minutes * 60), dline.Mask,
+				dline.Reason},
+		})
+	}
+
+	u.Catbox.addAndApplyDLine(dline, u.User.DisplayNick)
+}
+
+// undlineCommand removes a D-Line.
+//
+// Parameters: <mask>
+func (u *LocalUser) undlineCommand(m irc.Message) {
+	if len(m.Params) < 1 {
+		// 461 ERR_NEEDMOREPARAMS
+		u.messageFromServer("461", []string{"UNDLINE", "Not enough parameters"})
+		return
+	}
+
+	if !u.User.isOperator() {
+		// 481 ERR_NOPRIVILEGES
+		u.messageFromServer("481", []string{"Permission Denied- You're not an IRC operator"})
+		return
+	}
+
+	u.Catbox.removeDLine(m.Params[0], u.User.DisplayNick)
+
+	// Propagate.
+	for _, server := range u.Catbox.LocalServers {
+		server.maybeQueueMessage(irc.Message{
+			Prefix:  string(u.User.UID),
+			Command: "ENCAP",
+			Params:  []string{"*", "UNDLINE", m.Params[0]},
+		})
+	}
+}
+
+// statsDLines lists the D-Lines for STATS d.
+func (u *LocalUser) statsDLines() {
+	u.Catbox.DLineLock.Lock()
+	dlines := append([]DLine{}, u.Catbox.DLines...)
+	u.Catbox.DLineLock.Unlock()
+
+	for _, dline := range dlines {
+		// 225 RPL_STATSDLINE
+		u.messageFromServer("225", []string{"D", dline.Mask, dline.Reason})
+	}
+
+	// 219 RPL_ENDOFSTATS
+	u.messageFromServer("219", []string{"D", "End of /STATS report"})
+}
+
+// DLINE <duration> <mask> <reason>
+//
+// The duration is in seconds. 0 means permanent.
+//
+// This comes only inside ENCAP, so we don't need to propagate it.
+func (s *LocalServer) dlineCommand(m irc.Message) {
+	if len(m.Params) < 2 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"DLINE", "Not enough parameters"})
+		return
+	}
+
+	source := s.Catbox.sourceName(m.Prefix)
+	if source == "" {
+		s.Catbox.Logger.Warn("Unknown source for DLINE command")
+		return
+	}
+
+	seconds, err := strconv.Atoi(m.Params[0])
+	if err != nil || seconds < 0 {
+		s.Catbox.Logger.Warn("Invalid DLINE duration: %s", m.Params[0])
+		return
+	}
+
+	if !isValidDLineMask(m.Params[1]) {
+		s.Catbox.noticeOpers(fmt.Sprintf("Ignoring invalid D-Line for [%s] from %s",
+			m.Params[1], source))
+		return
+	}
+
+	dline := DLine{
+		Mask:   m.Params[1],
+		Reason: "<No reason given>",
+	}
+	if len(m.Params) > 2 {
+		dline.Reason = m.Params[2]
+	}
+	if seconds > 0 {
+		dline.ExpiresAt = time.Now().Add(time.Duration(seconds) * time.Second).Unix()
+	}
+
+	s.Catbox.addAndApplyDLine(dline, source)
+}
+
+// UNDLINE <mask>
+//
+// This comes only inside ENCAP, so we don't need to propagate it.
+func (s *LocalServer) undlineCommand(m irc.Message) {
+	if len(m.Params) < 1 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"UNDLINE", "Not enough parameters"})
+		return
+	}
+
+	source := s.Catbox.sourceName(m.Prefix)
+	if source == "" {
+		s.Catbox.Logger.Warn("Unknown source for UNDLINE command")
+		return
+	}
+
+	s.Catbox.removeDLine(m.Params[0], source)
+}
+
+// isValidDLineMask checks a D-Line mask is an IP, an IP glob, or a CIDR.
+func isValidDLineMask(mask string) bool {
+	if _, _, err := net.ParseCIDR(mask); err == nil {
+		return true
+	}
+
+	matched, err := regexp.MatchString("^[0-9a-fA-F.:*?]+$", mask)
+	if err != nil {
+		return false
+	}
+	return matched
+}
+
+// dlineMatchesIP checks whether a D-Line mask matches the IP.
+func dlineMatchesIP(mask string, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	if _, ipNet, err := net.ParseCIDR(mask); err == nil {
+		return ipNet.Contains(ip)
+	}
+
+	return globMatch(mask, ip.String())
+}
+
+// addAndApplyDLine adds a D-Line, saves it, and cuts off matching local users
+// and unregistered clients.
+func (cb *Catbox) addAndApplyDLine(dline DLine, source string) {
+	cb.DLineLock.Lock()
+	for _, d := range cb.DLines {
+		if d.Mask == dline.Mask {
+			cb.DLineLock.Unlock()
+			cb.noticeOpers(fmt.Sprintf("Ignoring duplicate D-Line for [%s] from %s",
+				dline.Mask, source))
+			return
+		}
+	}
+	cb.DLines = append(cb.DLines, dline)
+	cb.DLineLock.Unlock()
+
+	cb.saveDLines()
+
+	cb.noticeOpers(fmt.Sprintf("%s added D-Line for [%s] [%s]", source,
+		dline.Mask, dline.Reason))
+
+	quitReason := fmt.Sprintf("Connection closed: %s", dline.Reason)
+
+	for _, client := range cb.LocalClients {
+		if !dlineMatchesIP(dline.Mask, client.Conn.IP) {
+			continue
+		}
+		client.quit(quitReason)
+	}
+
+	for _, user := range cb.LocalUsers {
+		if !dlineMatchesIP(dline.Mask, net.ParseIP(user.User.IP)) {
+			continue
+		}
+
+		user.quit(quitReason, true)
+
+		cb.noticeOpers(fmt.Sprintf("User disconnected due to D-Line: %s",
+			user.User.DisplayNick))
+	}
+}
+
+// removeDLine removes the D-Line with the mask. It returns false if there was
+// no such D-Line.
+func (cb *Catbox) removeDLine(mask, source string) bool {
+	cb.DLineLock.Lock()
+	idx := -1
+	for i, dline := range cb.DLines {
+		if dline.Mask == mask {
+			idx = i
+			break
+		}
+	}
+	if idx != -1 {
+		cb.DLines = append(cb.DLines[:idx], cb.DLines[idx+1:]...)
+	}
+	cb.DLineLock.Unlock()
+
+	if idx == -1 {
+		cb.noticeOpers(fmt.Sprintf("Not removing D-Line for [%s] (not found)",
+			mask))
+		return false
+	}
+
+	cb.saveDLines()
+
+	cb.noticeOpers(fmt.Sprintf("%s removed D-Line for [%s]", source, mask))
+
+	return true
+}
+
+// matchDLine finds a D-Line matching the IP.
+//
+// We call this from the goroutines accepting connections.
+func (cb *Catbox) matchDLine(ip net.IP) (DLine, bool) {
+	cb.DLineLock.Lock()
+	defer cb.DLineLock.Unlock()
+
+	for _, dline := range cb.DLines {
+		if dlineMatchesIP(dline.Mask, ip) {
+			return dline, true
+		}
+	}
+	return DLine{}, false
+}
+
+// expireDLines removes temporary D-Lines that have expired.
+func (cb *Catbox) expireDLines(now time.Time) {
+	cb.DLineLock.Lock()
+	dlines := []DLine{}
+	var expired []DLine
+	for _, dline := range cb.DLines {
+		if dline.ExpiresAt == 0 || now.Unix() < dline.ExpiresAt {
+			dlines = append(dlines, dline)
+			continue
+		}
+		expired = append(expired, dline)
+	}
+	cb.DLines = dlines
+	cb.DLineLock.Unlock()
+
+	if len(expired) == 0 {
+		return
+	}
+
+	cb.saveDLines()
+
+	for _, dline := range expired {
+		cb.noticeOpers(fmt.Sprintf("Temporary D-Line for [%s] expired",
+			dline.Mask))
+	}
+}
+
+// reloadDLines takes the D-Line file from the new config, puts it in next, and
+// loads the D-Lines from it. This lets admins edit the file by hand.
+func (cb *Catbox) reloadDLines(next, cfg *Config) {
+	// Without a file there is nothing to load. Keep the D-Lines we have.
+	if cfg.DLineFile == "" {
+		next.DLineFile = ""
+		return
+	}
+
+	dlines, err := loadDLines(cfg.DLineFile)
+	if err != nil {
+		cb.noticeOpers(fmt.Sprintf("Rehash: Unable to load D-Lines: %s", err))
+		return
+	}
+
+	cb.DLineLock.Lock()
+	cb.DLines = dlines
+	cb.DLineLock.Unlock()
+
+	next.DLineFile = cfg.DLineFile
+}
+
+// saveDLines writes our D-Lines to the D-Line file, if we have one.
+func (cb *Catbox) saveDLines() {
+	if cb.Config.DLineFile == "" {
+		return
+	}
+
+	cb.DLineLock.Lock()
+	dlines := append([]DLine{}, cb.DLines...)
+	cb.DLineLock.Unlock()
+
+	if err := saveDLineFile(cb.Config.DLineFile, dlines); err != nil {
+		cb.Logger.Error("Unable to save D-Lines: %s", err)
+		cb.noticeOpers(fmt.Sprintf("Unable to save D-Lines: %s", err))
+	}
+}
+
+// saveDLineFile writes D-Lines to the file as JSON.
+//
+// Like the state file, we write to a temporary file and then rename.
+func saveDLineFile(file string, dlines []DLine) error {
+	buf, err := json.MarshalIndent(dlines, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding D-Lines: %s", err)
+	}
+
+	tmpFile := file + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, buf, 0600); err != nil {
+		return fmt.Errorf("error writing D-Line file: %s", err)
+	}
+
+	if err := os.Rename(tmpFile, file); err != nil {
+		return fmt.Errorf("error renaming D-Line file: %s", err)
+	}
+
+	return nil
+}
+
+// loadDLines reads D-Lines from the file.
+//
+// It is not an error for the file to be blank or to not exist. In that case
+// there are no D-Lines.
+func loadDLines(file string) ([]DLine, error) {
+	if file == "" {
+		return []DLine{}, nil
+	}
+
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []DLine{}, nil
+		}
+		return nil, fmt.Errorf("error reading D-Line file: %s", err)
+	}
+
+	dlines := []DLine{}
+	if err := json.Unmarshal(buf, &dlines); err != nil {
+		return nil, fmt.Errorf("error decoding D-Line file: %s", err)
+	}
+
+	return dlines, nil
+}
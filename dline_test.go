@@ -0,0 +1,232 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+func TestDLineMatchesIP(t *testing.T) {
+	tests := []struct {
+		mask  string
+		ip    string
+		match bool
+	}{
+		{"192.0.2.1", "192.0.2.1", true},
+		{"192.0.2.1", "192.0.2.10", false},
+		{"192.0.2.*", "192.0.2.10", true},
+		{"192.0.2.*", "192.0.3.10", false},
+		{"192.0.2.0/24", "192.0.2.200", true},
+		{"192.0.2.0/24", "192.0.3.1", false},
+		{"2001:db8::/32", "2001:db8::1", true},
+		{"2001:db8::/32", "192.0.2.1", false},
+	}
+
+	for _, test := range tests {
+		if got := dlineMatchesIP(test.mask, net.ParseIP(test.ip)); got !=
+			test.match {
+			t.Errorf("dlineMatchesIP(%s, %s) = %v, wanted %v", test.mask, test.ip,
+				got, test.match)
+		}
+	}
+
+	if dlineMatchesIP("*", nil) {
+		t.Errorf("matched a nil IP")
+	}
+
+	for _, mask := range []string{"192.0.2.*", "10.0.0.0/8", "2001:db8::1"} {
+		if !isValidDLineMask(mask) {
+			t.Errorf("mask %s is invalid", mask)
+		}
+	}
+	for _, mask := range []string{"*@192.0.2.1", "host.example.com", ""} {
+		if isValidDLineMask(mask) {
+			t.Errorf("mask %s is valid", mask)
+		}
+	}
+}
+
+func TestDLineCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catbox-dline-")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	cb := newSnapshotCatbox()
+	cb.Config.DLineFile = filepath.Join(dir, "dlines.json")
+	link := addTraceTestLink(cb, 10, "irc2.example.com", "001")
+	oper := addCallerIDTestUser(cb, 1, "oper")
+	oper.User.Modes['o'] = struct{}{}
+	oper.User.IP = "198.51.100.1"
+	alice := addCallerIDTestUser(cb, 2, "alice")
+	alice.User.IP = "192.0.2.5"
+
+	oper.dlineCommand(irc.Message{Command: "DLINE",
+		Params: []string{"host.example.com", "Bad"}})
+	if got := drainCommands(oper); len(got) != 1 ||
+		got[0] != "415 oper host.example.com Bad Server/host mask" {
+		t.Errorf("invalid mask got %q", got)
+	}
+
+	oper.dlineCommand(irc.Message{Command: "DLINE",
+		Params: []string{"10", "192.0.2.0/24", "Go away"}})
+
+	// The D-Line goes out first and then the matching user's QUIT.
+	if len(link.WriteChan) != 2 {
+		t.Fatalf("sent %d messages to server, wanted 2", len(link.WriteChan))
+	}
+	m := (<-link.WriteChan).Message
+	if m.Prefix != string(oper.User.UID) || m.Command != "ENCAP" ||
+		strings.Join(m.Params, " ") != "* DLINE 600 192.0.2.0/24 Go away" {
+		t.Errorf("propagated %v", m)
+	}
+	if m := (<-link.WriteChan).Message; m.Prefix != string(alice.User.UID) ||
+		m.Command != "QUIT" {
+		t.Errorf("sent %v, wanted the QUIT", m)
+	}
+	if _, exists := cb.LocalUsers[alice.ID]; exists {
+		t.Errorf("matching user is still connected")
+	}
+
+	dlines, err := loadDLines(cb.Config.DLineFile)
+	if err != nil {
+		t.Fatalf("error loading D-Lines: %s", err)
+	}
+	if len(dlines) != 1 || dlines[0].Mask != "192.0.2.0/24" ||
+		dlines[0].Reason != "Go away" {
+		t.Fatalf("saved %v", dlines)
+	}
+	if d := time.Until(time.Unix(dlines[0].ExpiresAt, 0)); d < 9*time.Minute ||
+		d > 10*time.Minute {
+		t.Errorf("D-Line expires in %s, wanted 10 minutes", d)
+	}
+
+	_ = drainCommands(oper)
+	oper.statsCommand(irc.Message{Command: "STATS", Params: []string{"d"}})
+	wanted := []string{
+		"225 oper D 192.0.2.0/24 Go away",
+		"219 oper D End of /STATS report",
+	}
+	if got := drainCommands(oper); strings.Join(got, "\n") !=
+		strings.Join(wanted, "\n") {
+		t.Errorf("STATS d got %q, wanted %q", got, wanted)
+	}
+
+	oper.undlineCommand(irc.Message{Command: "UNDLINE",
+		Params: []string{"192.0.2.0/24"}})
+	m = (<-link.WriteChan).Message
+	if strings.Join(m.Params, " ") != "* UNDLINE 192.0.2.0/24" {
+		t.Errorf("propagated %v", m)
+	}
+	if len(cb.DLines) != 0 {
+		t.Errorf("D-Line was not removed")
+	}
+	dlines, err = loadDLines(cb.Config.DLineFile)
+	if err != nil {
+		t.Fatalf("error loading D-Lines: %s", err)
+	}
+	if len(dlines) != 0 {
+		t.Errorf("saved %v after removing", dlines)
+	}
+}
+
+func TestEncapDLine(t *testing.T) {
+	cb := newTraceTestCatbox("irc2.example.com", "001")
+	cb.Opers = map[TS6UID]*User{}
+	link21 := addTraceTestLink(cb, 1, "irc1.example.com", "000")
+	link23 := addTraceTestLink(cb, 2, "irc3.example.com", "002")
+	cb.Users["000AAAAAA"] = &User{DisplayNick: "oper", UID: "000AAAAAA",
+		Modes: map[byte]struct{}{'o': {}}, ClosestServer: link21}
+	alice := addCallerIDTestUser(cb, 1, "alice")
+	alice.User.IP = "192.0.2.5"
+
+	link21.encapCommand(irc.Message{Prefix: "000AAAAAA", Command: "ENCAP",
+		Params: []string{"*", "DLINE", "0", "192.0.2.*", "Go away"}})
+
+	dline, matched := cb.matchDLine(net.ParseIP("192.0.2.9"))
+	if !matched || dline.Reason != "Go away" || dline.ExpiresAt != 0 {
+		t.Errorf("D-Line was not added: %v", dline)
+	}
+	if _, exists := cb.LocalUsers[alice.ID]; exists {
+		t.Errorf("matching user is still connected")
+	}
+	if len(link23.WriteChan) == 0 {
+		t.Errorf("did not propagate the D-Line")
+	}
+
+	link21.encapCommand(irc.Message{Prefix: "000AAAAAA", Command: "ENCAP",
+		Params: []string{"*", "UNDLINE", "192.0.2.*"}})
+	if _, matched := cb.matchDLine(net.ParseIP("192.0.2.9")); matched {
+		t.Errorf("D-Line was not removed")
+	}
+}
+
+func TestExpireDLines(t *testing.T) {
+	cb := newSnapshotCatbox()
+	now := time.Now()
+	cb.DLines = []DLine{
+		{Mask: "192.0.2.1", ExpiresAt: now.Add(-time.Second).Unix()},
+		{Mask: "192.0.2.2", ExpiresAt: now.Add(time.Minute).Unix()},
+		{Mask: "192.0.2.3"},
+	}
+
+	cb.expireDLines(now)
+
+	if len(cb.DLines) != 2 || cb.DLines[0].Mask != "192.0.2.2" ||
+		cb.DLines[1].Mask != "192.0.2.3" {
+		t.Errorf("D-Lines after expiry: %v", cb.DLines)
+	}
+}
+
+func TestDLineRejectsConnection(t *testing.T) {
+	cb := newSnapshotCatbox()
+	cb.ToServerChan = make(chan Event, 10)
+	cb.ShutdownChan = make(chan struct{})
+	cb.DLines = []DLine{{Mask: "127.0.0.0/8", Reason: "Go away"}}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %s", err)
+	}
+	defer func() {
+		_ = listener.Close()
+	}()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("error dialing: %s", err)
+	}
+	defer func() {
+		_ = client.Close()
+	}()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("error accepting: %s", err)
+	}
+
+	cb.introduceClient(conn, nil)
+	cb.WG.Wait()
+
+	// We close the connection without telling the server loop or sending
+	// anything.
+	if err := client.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("error setting deadline: %s", err)
+	}
+	buf, err := ioutil.ReadAll(client)
+	if err != nil || len(buf) != 0 {
+		t.Errorf("read %q, %v, wanted EOF", buf, err)
+	}
+	if len(cb.ToServerChan) != 0 {
+		t.Errorf("told the server about the client")
+	}
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+)
+
+// countryDB looks up the country an IP is in.
+type countryDB interface {
+	// lookupCountry returns the ISO country code, such as CA. It is blank if
+	// the database does not know the IP.
+	lookupCountry(ip net.IP) (string, error)
+}
+
+// mmdbMetadataMarker comes before the metadata at the end of an MMDB file.
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// Data types in the MMDB data section.
+const (
+	mmdbExtended = 0
+	mmdbPointer  = 1
+	mmdbString   = 2
+	mmdbDouble   = 3
+	mmdbBytes    = 4
+	mmdbUint16   = 5
+	mmdbUint32   = 6
+	mmdbMap      = 7
+	mmdbInt32    = 8
+	mmdbUint64   = 9
+	mmdbUint128  = 10
+	mmdbArray    = 11
+	mmdbBool     = 14
+	mmdbFloat    = 15
+)
+
+// mmdbMaxDepth limits how deeply we follow nested values. A valid file stays
+// far below it.
+const mmdbMaxDepth = 32
+
+// mmdbReader reads a MaxMind DB (MMDB) file such as GeoLite2 Country.
+//
+// This is a minimal reader. It supports what we need to find country codes.
+// See https://maxmind.github.io/MaxMind-DB/ for the format.
+type mmdbReader struct {
+	// The search tree.
+	tree []byte
+
+	// The data section.
+	data []byte
+
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+
+	// The node where IPv4 addresses start in an IPv6 tree.
+	ipv4Start uint
+}
+
+// loadGeoIPDB loads the database at the path. Without a path there is no
+// database.
+func loadGeoIPDB(path string) (countryDB, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading GeoIP database: %s", err)
+	}
+
+	db, err := newMMDBReader(buf)
+	if err != nil {
+		return nil, fmt.Errorf("error loading GeoIP database: %s: %s", path, err)
+	}
+	return db, nil
+}
+
+// reloadGeoIP loads the country database on rehash. If it fails to load we
+// keep the one we have.
+func (cb *Catbox) reloadGeoIP(next, cfg *Config) {
+	geoIP, err := loadGeoIPDB(cfg.GeoIPDB)
+	if err != nil {
+		cb.noticeOpers(fmt.Sprintf("Rehash: Unable to load GeoIP database: %s",
+			err))
+		return
+	}
+
+	cb.GeoIPLock.Lock()
+	cb.GeoIP = geoIP
+	cb.GeoIPLock.Unlock()
+
+	next.GeoIPDB = cfg.GeoIPDB
+}
+
+// lookupCountry finds the country code of the IP. It is blank if we have no
+// database or the IP is not in it.
+func (cb *Catbox) lookupCountry(ip net.IP) string {
+	cb.GeoIPLock.Lock()
+	geoIP := cb.GeoIP
+	cb.GeoIPLock.Unlock()
+
+	if geoIP == nil || ip == nil {
+		return ""
+	}
+
+	country, err := geoIP.lookupCountry(ip)
+	if err != nil {
+		cb.Logger.Warn("Unable to look up country of %s: %s", ip, err)
+		return ""
+	}
+	return country
+}
+
+func newMMDBReader(buf []byte) (*mmdbReader, error) {
+	idx := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if idx == -1 {
+		return nil, fmt.Errorf("metadata not found")
+	}
+
+	metadata, _, err := mmdbDecoder{buf: buf[idx+len(mmdbMetadataMarker):]}.
+		decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding metadata: %s", err)
+	}
+	fields, ok := metadata.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("metadata is not a map")
+	}
+
+	r := &mmdbReader{}
+	for key, value := range map[string]*uint{
+		"node_count":  &r.nodeCount,
+		"record_size": &r.recordSize,
+		"ip_version":  &r.ipVersion,
+	} {
+		n, ok := fields[key].(uint64)
+		if !ok {
+			return nil, fmt.Errorf("metadata is missing %s", key)
+		}
+		*value = uint(n)
+	}
+
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size: %d", r.recordSize)
+	}
+	if r.ipVersion != 4 && r.ipVersion != 6 {
+		return nil, fmt.Errorf("unsupported IP version: %d", r.ipVersion)
+	}
+
+	// The tree, then 16 zero bytes, then the data section.
+	treeSize := r.nodeCount * r.recordSize / 4
+	if treeSize+16 > uint(idx) {
+		return nil, fmt.Errorf("search tree is larger than the file")
+	}
+	r.tree = buf[:treeSize]
+	r.data = buf[treeSize+16 : idx]
+
+	// IPv4 addresses are in an IPv6 tree as ::a.b.c.d.
+	if r.ipVersion == 6 {
+		for i := 0; i < 96 && r.ipv4Start < r.nodeCount; i++ {
+			r.ipv4Start = r.record(r.ipv4Start, 0)
+		}
+	}
+
+	return r, nil
+}
+
+func (r *mmdbReader) lookupCountry(ip net.IP) (string, error) {
+	offset, found, err := r.find(ip)
+	if err != nil || !found {
+		return "", err
+	}
+
+	record, _, err := mmdbDecoder{buf: r.data}.decode(offset, 0)
+	if err != nil {
+		return "", fmt.Errorf("error decoding record: %s", err)
+	}
+
+	// Where they are, or otherwise where their network is registered.
+	for _, key := range []string{"country", "registered_country"} {
+		if code := mmdbPath(record, key, "iso_code"); code != "" {
+			return code, nil
+		}
+	}
+	return "", nil
+}
+
+// find walks the search tree. It returns the offset of the IP's record in the
+// data section.
+func (r *mmdbReader) find(ip net.IP) (uint, bool, error) {
+	node := uint(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		if r.ipVersion == 6 {
+			node = r.ipv4Start
+		}
+	} else if r.ipVersion == 4 {
+		return 0, false, nil
+	}
+
+	for i := 0; i < len(ip)*8 && node < r.nodeCount; i++ {
+		bit := uint(ip[i/8]>>(7-uint(i%8))) & 1
+		node = r.record(node, bit)
+	}
+
+	if node == r.nodeCount {
+		return 0, false, nil
+	}
+	if node < r.nodeCount {
+		return 0, false, fmt.Errorf("invalid search tree")
+	}
+
+	// Record values past the tree point into the data section, after the 16
+	// byte separator.
+	offset := node - r.nodeCount - 16
+	if offset >= uint(len(r.data)) {
+		return 0, false, fmt.Errorf("invalid record pointer")
+	}
+	return offset, true, nil
+}
+
+// record reads the left (0) or right (1) record of a node.
+func (r *mmdbReader) record(node, bit uint) uint {
+	b := r.tree[node*r.recordSize/4:]
+
+	switch r.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		// The middle byte holds the high bits of both records.
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 |
+				uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// mmdbPath finds a string in nested maps.
+func mmdbPath(value interface{}, keys ...string) string {
+	for _, key := range keys {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		value = m[key]
+	}
+
+	s, _ := value.(string)
+	return s
+}
+
+// mmdbDecoder decodes values in an MMDB data (or metadata) section.
+type mmdbDecoder struct {
+	buf []byte
+}
+
+// decode decodes the value at the offset. It returns the value and the offset
+// after it.
+func (d mmdbDecoder) decode(offset uint, depth int) (interface{}, uint, error) {
+	if depth > mmdbMaxDepth {
+		return nil, 0, fmt.Errorf("values are nested too deeply")
+	}
+
+	ctrl, offset, err := d.next(offset, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	typ := uint(ctrl[0] >> 5)
+
+	if typ == mmdbPointer {
+		pointer, next, err := d.pointer(ctrl[0], offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		value, _, err := d.decode(pointer, depth+1)
+		return value, next, err
+	}
+
+	if typ == mmdbExtended {
+		extended, next, err := d.next(offset, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		typ = 7 + uint(extended[0])
+		offset = next
+	}
+
+	size, offset, err := d.size(ctrl[0], offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch typ {
+	case mmdbMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			key, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			k, ok := key.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("map key is not a string")
+			}
+
+			value, next, err := d.decode(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[k] = value
+			offset = next
+		}
+		return m, offset, nil
+	case mmdbArray:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			value, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+			offset = next
+		}
+		return a, offset, nil
+	case mmdbBool:
+		return size != 0, offset, nil
+	}
+
+	b, next, err := d.next(offset, size)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch typ {
+	case mmdbString:
+		return string(b), next, nil
+	case mmdbBytes, mmdbUint128:
+		return b, next, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("invalid double size: %d", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), next, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("invalid float size: %d", size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), next,
+			nil
+	case mmdbUint16, mmdbUint32, mmdbUint64:
+		if size > 8 {
+			return nil, 0, fmt.Errorf("invalid integer size: %d", size)
+		}
+		n := uint64(0)
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n, next, nil
+	case mmdbInt32:
+		if size > 4 {
+			return nil, 0, fmt.Errorf("invalid integer size: %d", size)
+		}
+		n := uint32(0)
+		for _, c := range b {
+			n = n<<8 | uint32(c)
+		}
+		// Smaller sizes are padded with zeros, so sign extend only at 4 bytes.
+		return int64(int32(n)), next, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported data type: %d", typ)
+	}
+}
+
+// next returns the next n bytes.
+func (d mmdbDecoder) next(offset, n uint) ([]byte, uint, error) {
+	if offset+n > uint(len(d.buf)) {
+		return nil, 0, fmt.Errorf("value runs past the end of the data")
+	}
+	return d.buf[offset : offset+n], offset + n, nil
+}
+
+// size reads the size of a value from its control byte and any bytes after.
+func (d mmdbDecoder) size(ctrl byte, offset uint) (uint, uint, error) {
+	size := uint(ctrl & 0x1f)
+	if size < 29 {
+		return size, offset, nil
+	}
+
+	n := size - 28
+	b, next, err := d.next(offset, n)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	extra := uint(0)
+	for _, c := range b {
+		extra = extra<<8 | uint(c)
+	}
+
+	switch size {
+	case 29:
+		return 29 + extra, next, nil
+	case 30:
+		return 285 + extra, next, nil
+	default:
+		return 65821 + extra, next, nil
+	}
+}
+
+// pointer reads a pointer. It returns where it points and the offset after it.
+func (d mmdbDecoder) pointer(ctrl byte, offset uint) (uint, uint, error) {
+	n := uint(ctrl>>3&0x3) + 1
+	b, next, err := d.next(offset, n)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	pointer := uint(0)
+	if n < 4 {
+		pointer = uint(ctrl & 0x7)
+	}
+	for _, c := range b {
+		pointer = pointer<<8 | uint(c)
+	}
+
+	switch n {
+	case 2:
+		pointer += 2048
+	case 3:
+		pointer += 526336
+	}
+	return pointer, next, nil
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeCountryDB knows the countries of some IPs.
+type fakeCountryDB map[string]string
+
+func (f fakeCountryDB) lookupCountry(ip net.IP) (string, error) {
+	return f[ip.String()], nil
+}
+
+// testMMDBNetwork is a network and its encoded data section record.
+type testMMDBNetwork struct {
+	cidr   string
+	record []byte
+}
+
+// buildTestMMDB writes an MMDB file with the networks.
+func buildTestMMDB(t *testing.T, recordSize, ipVersion int,
+	networks []testMMDBNetwork) []byte {
+	// Nodes' records are 0 if empty, a node index if positive, and -(n+1) if
+	// they point to the nth network's record. No record points to the root.
+	nodes := [][2]int{{0, 0}}
+
+	for i, network := range networks {
+		_, ipNet, err := net.ParseCIDR(network.cidr)
+		if err != nil {
+			t.Fatalf("invalid CIDR: %s", network.cidr)
+		}
+		ones, _ := ipNet.Mask.Size()
+		ip := ipNet.IP
+		if ipVersion == 6 && len(ip) == net.IPv4len {
+			ip = append(make(net.IP, 12), ip...)
+			ones += 96
+		}
+
+		node := 0
+		for bit := 0; bit < ones; bit++ {
+			b := int(ip[bit/8]>>(7-uint(bit%8))) & 1
+			if bit == ones-1 {
+				nodes[node][b] = -(i + 1)
+				break
+			}
+			if nodes[node][b] <= 0 {
+				nodes = append(nodes, [2]int{0, 0})
+				nodes[node][b] = len(nodes) - 1
+			}
+			node = nodes[node][b]
+		}
+	}
+
+	var data []byte
+	offsets := make([]int, len(networks))
+	for i, network := range networks {
+		offsets[i] = len(data)
+		data = append(data, network.record...)
+	}
+
+	nodeCount := len(nodes)
+	value := func(record int) uint32 {
+		if record == 0 {
+			return uint32(nodeCount)
+		}
+		if record > 0 {
+			return uint32(record)
+		}
+		return uint32(nodeCount + 16 + offsets[-record-1])
+	}
+
+	var buf []byte
+	for _, node := range nodes {
+		left, right := value(node[0]), value(node[1])
+		switch recordSize {
+		case 24:
+			buf = append(buf, byte(left>>16), byte(left>>8), byte(left),
+				byte(right>>16), byte(right>>8), byte(right))
+		case 28:
+			buf = append(buf, byte(left>>16), byte(left>>8), byte(left),
+				byte(left>>24)<<4|byte(right>>24), byte(right>>16), byte(right>>8),
+				byte(right))
+		default:
+			b := make([]byte, 8)
+			binary.BigEndian.PutUint32(b, left)
+			binary.BigEndian.PutUint32(b[4:], right)
+			buf = append(buf, b...)
+		}
+	}
+
+	buf = append(buf, make([]byte, 16)...)
+	buf = append(buf, data...)
+	buf = append(buf, mmdbMetadataMarker...)
+	buf = append(buf, 0xe3)
+	buf = append(buf, mmdbTestString("node_count")...)
+	buf = append(buf, 0xc4, byte(nodeCount>>24), byte(nodeCount>>16),
+		byte(nodeCount>>8), byte(nodeCount))
+	buf = append(buf, mmdbTestString("record_size")...)
+	buf = append(buf, 0xa2, 0, byte(recordSize))
+	buf = append(buf, mmdbTestString("ip_version")...)
+	buf = append(buf, 0xa1, byte(ipVersion))
+	return buf
+}
+
+// mmdbTestString encodes a short string.
+func mmdbTestString(s string) []byte {
+	return append([]byte{0x40 | byte(len(s))}, s...)
+}
+
+// mmdbTestCountry encodes {"<key>": {"iso_code": "<code>"}}.
+func mmdbTestCountry(key, code string) []byte {
+	b := []byte{0xe1}
+	b = append(b, mmdbTestString(key)...)
+	b = append(b, 0xe1)
+	b = append(b, mmdbTestString("iso_code")...)
+	return append(b, mmdbTestString(code)...)
+}
+
+func TestMMDBReader(t *testing.T) {
+	// The first record's inner map starts after the outer map's control byte
+	// and "country".
+	pointer := 1 + len(mmdbTestString("country"))
+
+	networks := []testMMDBNetwork{
+		{"192.0.2.0/24", mmdbTestCountry("country", "CA")},
+		// Only a registered country, pointing at the first record's.
+		{"198.51.100.0/24", append(append([]byte{0xe1},
+			mmdbTestString("registered_country")...), 0x20, byte(pointer))},
+		{"203.0.113.0/24", mmdbTestCountry("continent", "NA")},
+	}
+	networks6 := append(networks, testMMDBNetwork{"2001:db8::/32",
+		mmdbTestCountry("country", "DE")})
+
+	lookups := []struct {
+		ip    string
+		code4 string
+		code6 string
+	}{
+		{"192.0.2.7", "CA", "CA"},
+		{"198.51.100.1", "CA", "CA"},
+		{"203.0.113.1", "", ""},
+		{"192.0.3.1", "", ""},
+		{"2001:db8::1", "", "DE"},
+		{"2001:db9::1", "", ""},
+	}
+
+	for _, recordSize := range []int{24, 28, 32} {
+		for _, ipVersion := range []int{4, 6} {
+			nets := networks
+			if ipVersion == 6 {
+				nets = networks6
+			}
+
+			r, err := newMMDBReader(buildTestMMDB(t, recordSize, ipVersion, nets))
+			if err != nil {
+				t.Errorf("record size %d IPv%d: newMMDBReader() = error %s",
+					recordSize, ipVersion, err)
+				continue
+			}
+
+			for _, lookup := range lookups {
+				wanted := lookup.code4
+				if ipVersion == 6 {
+					wanted = lookup.code6
+				}
+
+				got, err := r.lookupCountry(net.ParseIP(lookup.ip))
+				if err != nil || got != wanted {
+					t.Errorf("record size %d IPv%d: lookupCountry(%s) = %q, %v, wanted %q",
+						recordSize, ipVersion, lookup.ip, got, err, wanted)
+				}
+			}
+		}
+	}
+}
+
+func TestMMDBReaderInvalid(t *testing.T) {
+	valid := buildTestMMDB(t, 24, 4, []testMMDBNetwork{
+		{"192.0.2.0/24", mmdbTestCountry("country", "CA")},
+	})
+
+	tests := []struct {
+		name string
+		buf  []byte
+	}{
+		{"no metadata", []byte("not a database")},
+		{"truncated metadata", valid[:len(valid)-1]},
+		{"truncated tree", valid[len(valid)-len(mmdbMetadataMarker)-40:]},
+	}
+
+	for _, test := range tests {
+		if _, err := newMMDBReader(test.buf); err == nil {
+			t.Errorf("%s: newMMDBReader() succeeded", test.name)
+		}
+	}
+}
+
+func TestLoadGeoIPDB(t *testing.T) {
+	db, err := loadGeoIPDB("")
+	if db != nil || err != nil {
+		t.Errorf("loadGeoIPDB(\"\") = %v, %v, wanted no database", db, err)
+	}
+
+	dir, err := ioutil.TempDir("", "catbox-geoip-")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	path := filepath.Join(dir, "country.mmdb")
+	if _, err := loadGeoIPDB(path); err == nil {
+		t.Errorf("loaded a missing database")
+	}
+
+	if err := ioutil.WriteFile(path, buildTestMMDB(t, 28, 6, []testMMDBNetwork{
+		{"192.0.2.0/24", mmdbTestCountry("country", "CA")},
+	}), 0600); err != nil {
+		t.Fatalf("error writing database: %s", err)
+	}
+
+	cb := newSnapshotCatbox()
+	cb.Config.GeoIPDB = path
+	next := *cb.Config
+	cb.reloadGeoIP(&next, cb.Config)
+	if next.GeoIPDB != path {
+		t.Errorf("GeoIPDB = %s after reloading, wanted %s", next.GeoIPDB, path)
+	}
+	if got := cb.lookupCountry(net.ParseIP("192.0.2.1")); got != "CA" {
+		t.Errorf("lookupCountry() = %s, wanted CA", got)
+	}
+
+	// If the database is bad when we rehash, we keep the one we have.
+	if err := ioutil.WriteFile(path, []byte("junk"), 0600); err != nil {
+		t.Fatalf("error writing database: %s", err)
+	}
+	cb.reloadGeoIP(&next, cb.Config)
+	if got := cb.lookupCountry(net.ParseIP("192.0.2.1")); got != "CA" {
+		t.Errorf("lookupCountry() = %s after a bad rehash, wanted CA", got)
+	}
+}
+
+func TestRegisterUserCountry(t *testing.T) {
+	cb := &Catbox{
+		Config: &Config{
+			ServerName: "irc.example.com",
+			TS6SID:     TS6SID("000"),
+			PingTime:   30 * time.Second,
+			DeadTime:   240 * time.Second,
+		},
+		LocalClients: map[uint64]*LocalClient{},
+		LocalUsers:   map[uint64]*LocalUser{},
+		Opers:        map[TS6UID]*User{},
+		Nicks:        map[string]TS6UID{},
+		Users:        map[TS6UID]*User{},
+		Servers:      map[TS6SID]*Server{},
+		Logger:       newTestLogger(),
+		GeoIP:        fakeCountryDB{"192.0.2.1": "CA"},
+	}
+	oper := addCallerIDTestUser(cb, 5, "oper")
+	oper.User.Modes['o'] = struct{}{}
+	oper.User.Modes['C'] = struct{}{}
+	cb.Opers[oper.User.UID] = oper.User
+
+	c := &LocalClient{
+		ID:                1,
+		Catbox:            cb,
+		Conn:              Conn{IP: net.ParseIP("192.0.2.1")},
+		WriteChan:         make(chan TaggedMessage, 100),
+		Country:           cb.lookupCountry(net.ParseIP("192.0.2.1")),
+		PreRegDisplayNick: "alice",
+		PreRegUser:        "user",
+		PreRegRealName:    "real name",
+	}
+	cb.LocalClients[c.ID] = c
+
+	c.registerUser()
+
+	lu, registered := cb.LocalUsers[c.ID]
+	if !registered {
+		t.Fatalf("user did not register")
+	}
+
+	wanted := "NOTICE oper *** Notice --- CLICONN alice user 192.0.2.1 192.0.2.1 real name (irc.example.com) (CA)"
+	if got := drainCommands(oper); len(got) != 1 || got[0] != wanted {
+		t.Errorf("oper got %q, wanted %s", got, wanted)
+	}
+
+	if entry := lu.accessLogEntry("connect"); entry.Country != "CA" {
+		t.Errorf("access log country = %s, wanted CA", entry.Country)
+	}
+
+	if got := cb.lookupCountry(net.ParseIP("198.51.100.1")); got != "" {
+		t.Errorf("lookupCountry() = %s for an unknown IP", got)
+	}
+	cb.GeoIP = nil
+	if got := cb.lookupCountry(net.ParseIP("192.0.2.1")); got != "" {
+		t.Errorf("lookupCountry() = %s without a database", got)
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// GLine holds a G-Line. This is a K-Line for the whole network.
+type GLine struct {
+	// Together we have <usermask>@<hostmask>
+	UserMask string
+	HostMask string
+
+	Reason string
+
+	// When the G-Line was set as a Unix time.
+	SetAt int64
+
+	// When the G-Line expires as a Unix time. Zero if it is permanent.
+	ExpiresAt int64
+}
+
+// glineCommand adds a G-Line.
+//
+// Parameters: [duration] <user@host> <reason>
+//
+// The duration is in minutes. Without one the G-Line is permanent.
+func (u *LocalUser) glineCommand(m irc.Message) {
+	if len(m.Params) < 2 {
+		// 461 ERR_NEEDMOREPARAMS
+		u.messageFromServer("461", []string{"GLINE", "Not enough parameters"})
+		return
+	}
+
+	if !u.User.isOperator() {
+		// 481 ERR_NOPRIVILEGES
+		u.messageFromServer("481", []string{"Permission Denied- You're not an IRC operator"})
+		return
+	}
+
+	params := m.Params
+	minutes := 0
+	if n, err := strconv.Atoi(params[0]); err == nil && n >= 0 {
+		if len(params) < 3 {
+			// 461 ERR_NEEDMOREPARAMS
+			u.messageFromServer("461", []string{"GLINE", "Not enough parameters"})
+			return
+		}
+		minutes = n
+		params = params[1:]
+	}
+
+	userMask, hostMask, ok := parseGLineMask(params[0])
+	if !ok {
+		// 415 ERR_BADMASK
+		u.messageFromServer("415", []string{params[0], "Bad Server/host mask"})
+		return
+	}
+
+	now := time.Now()
+	gline := GLine{
+		UserMask: userMask,
+		HostMask: hostMask,
+		Reason:   params[1],
+		SetAt:    now.Unix(),
+	}
+	if minutes > 0 {
+		gline.ExpiresAt = now.Add(time.Duration(minutes) * time.Minute).Unix()
+	}
+
+	// Propagate. Like KLINE this must be in ENCAP. The duration is in seconds.
+	// Do this before applying it locally in case the oper G-Lines themself.
+	for _, server := range u.Catbox.LocalServers {
+		server.maybeQueueMessage(irc.Message{
+			Prefix:  string(u.User.UID),
+			Command: "ENCAP",
+			Params: []string{"*", "GLINE", strconv.Itoa(minutes * 60),
+				userMask + "@" + hostMask, gline.Reason},
+		})
+	}
+
+	u.Catbox.addAndApplyGLine(gline, u.User.DisplayNick)
+}
+
+// unglineCommand removes a G-Line.
+//
+// Parameters: <user@host>
+func (u *LocalUser) unglineCommand(m irc.Message) {
+	if len(m.Params) < 1 {
+		// 461 ERR_NEEDMOREPARAMS
+		u.messageFromServer("461", []string{"UNGLINE", "Not enough parameters"})
+		return
+	}
+
+	if !u.User.isOperator() {
+		// 481 ERR_NOPRIVILEGES
+		u.messageFromServer("481", []string{"Permission Denied- You're not an IRC operator"})
+		return
+	}
+
+	userMask, hostMask, ok := parseGLineMask(m.Params[0])
+	if !ok {
+		// 415 ERR_BADMASK
+		u.messageFromServer("415", []string{m.Params[0], "Bad Server/host mask"})
+		return
+	}
+
+	u.Catbox.removeGLine(userMask, hostMask, u.User.DisplayNick)
+
+	// Propagate.
+	for _, server := range u.Catbox.LocalServers {
+		server.maybeQueueMessage(irc.Message{
+			Prefix:  string(u.User.UID),
+			Command: "ENCAP",
+			Params:  []string{"*", "UNGLINE", userMask + "@" + hostMask},
+		})
+	}
+}
+
+// statsGLines lists the G-Lines for STATS g.
+func (u *LocalUser) statsGLines() {
+	for _, gline := range u.Catbox.GLines {
+		// 247 RPL_STATSGLINE
+		// This is the same as we use for K-Lines.
+		u.messageFromServer("247", []string{
+			"G",
+			gline.HostMask,
+			"*",
+			gline.UserMask,
+			gline.Reason,
+		})
+	}
+
+	// 219 RPL_ENDOFSTATS
+	u.messageFromServer("219", []string{"G", "End of /STATS report"})
+}
+
+// GLINE <duration> <user@host> <reason>
+//
+// The duration is in seconds. 0 means permanent.
+//
+// This comes only inside ENCAP, so we don't need to propagate it.
+func (s *LocalServer) glineCommand(m irc.Message) {
+	if len(m.Params) < 2 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"GLINE", "Not enough parameters"})
+		return
+	}
+
+	source := s.Catbox.sourceName(m.Prefix)
+	if source == "" {
+		s.Catbox.Logger.Warn("Unknown source for GLINE command")
+		return
+	}
+
+	seconds, err := strconv.Atoi(m.Params[0])
+	if err != nil || seconds < 0 {
+		s.Catbox.Logger.Warn("Invalid GLINE duration: %s", m.Params[0])
+		return
+	}
+
+	userMask, hostMask, ok := parseGLineMask(m.Params[1])
+	if !ok {
+		s.Catbox.noticeOpers(fmt.Sprintf("Ignoring invalid G-Line for [%s] from %s",
+			m.Params[1], source))
+		return
+	}
+
+	now := time.Now()
+	gline := GLine{
+		UserMask: userMask,
+		HostMask: hostMask,
+		Reason:   "<No reason given>",
+		SetAt:    now.Unix(),
+	}
+	if len(m.Params) > 2 {
+		gline.Reason = m.Params[2]
+	}
+	if seconds > 0 {
+		gline.ExpiresAt = now.Add(time.Duration(seconds) * time.Second).Unix()
+	}
+
+	s.Catbox.addAndApplyGLine(gline, source)
+}
+
+// UNGLINE <user@host>
+//
+// This comes only inside ENCAP, so we don't need to propagate it.
+func (s *LocalServer) unglineCommand(m irc.Message) {
+	if len(m.Params) < 1 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"UNGLINE", "Not enough parameters"})
+		return
+	}
+
+	source := s.Catbox.sourceName(m.Prefix)
+	if source == "" {
+		s.Catbox.Logger.Warn("Unknown source for UNGLINE command")
+		return
+	}
+
+	userMask, hostMask, ok := parseGLineMask(m.Params[0])
+	if !ok {
+		s.Catbox.Logger.Warn("Invalid UNGLINE mask: %s", m.Params[0])
+		return
+	}
+
+	s.Catbox.removeGLine(userMask, hostMask, source)
+}
+
+// parseGLineMask splits user@host into its user and host masks.
+func parseGLineMask(uhost string) (string, string, bool) {
+	pieces := strings.Split(uhost, "@")
+	if len(pieces) != 2 {
+		return "", "", false
+	}
+
+	if !isValidUserMask(pieces[0]) || !isValidHostMask(pieces[1]) {
+		return "", "", false
+	}
+
+	return pieces[0], pieces[1], true
+}
+
+// addAndApplyGLine adds a G-Line and cuts off matching local users.
+//
+// This function does not propagate to any other servers.
+func (cb *Catbox) addAndApplyGLine(gline GLine, source string) {
+	for _, g := range cb.GLines {
+		if g.UserMask == gline.UserMask && g.HostMask == gline.HostMask {
+			cb.noticeOpers(fmt.Sprintf("Ignoring duplicate G-Line for [%s@%s] from %s",
+				g.UserMask, g.HostMask, source))
+			return
+		}
+	}
+
+	cb.GLines = append(cb.GLines, gline)
+
+	cb.noticeOpers(fmt.Sprintf("%s added G-Line for [%s@%s] [%s]", source,
+		gline.UserMask, gline.HostMask, gline.Reason))
+
+	quitReason := fmt.Sprintf("G-Lined: %s", gline.Reason)
+
+	for _, user := range cb.LocalUsers {
+		matches, err := user.User.matchesMask(gline.UserMask, gline.HostMask)
+		if err != nil {
+			cb.Logger.Warn("G-Line: %s", err)
+		}
+		if !matches {
+			continue
+		}
+
+		user.quit(quitReason, true)
+
+		cb.noticeOpers(fmt.Sprintf("User disconnected due to G-Line: %s",
+			user.User.DisplayNick))
+	}
+}
+
+// removeGLine removes a G-Line. It returns whether there was one.
+func (cb *Catbox) removeGLine(userMask, hostMask, source string) bool {
+	for i, gline := range cb.GLines {
+		if gline.UserMask != userMask || gline.HostMask != hostMask {
+			continue
+		}
+
+		cb.GLines = append(cb.GLines[:i], cb.GLines[i+1:]...)
+
+		cb.noticeOpers(fmt.Sprintf("%s removed G-Line for [%s@%s]", source,
+			userMask, hostMask))
+		return true
+	}
+
+	cb.noticeOpers(fmt.Sprintf("Not removing G-Line for [%s@%s] (not found)",
+		userMask, hostMask))
+	return false
+}
+
+// matchGLine finds the first G-Line matching the user.
+func (cb *Catbox) matchGLine(u *User) (GLine, bool) {
+	for _, gline := range cb.GLines {
+		matches, err := u.matchesMask(gline.UserMask, gline.HostMask)
+		if err != nil {
+			cb.Logger.Warn("G-Line: %s", err)
+		}
+		if matches {
+			return gline, true
+		}
+	}
+	return GLine{}, false
+}
+
+// expireGLines removes temporary G-Lines that have expired.
+func (cb *Catbox) expireGLines(now time.Time) {
+	glines := []GLine{}
+	for _, gline := range cb.GLines {
+		if gline.ExpiresAt == 0 || now.Unix() < gline.ExpiresAt {
+			glines = append(glines, gline)
+			continue
+		}
+
+		cb.noticeOpers(fmt.Sprintf("Temporary G-Line for [%s@%s] expired",
+			gline.UserMask, gline.HostMask))
+	}
+	cb.GLines = glines
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+func TestGLineCommand(t *testing.T) {
+	cb := newSnapshotCatbox()
+	link := addTraceTestLink(cb, 10, "irc2.example.com", "001")
+	oper := addCallerIDTestUser(cb, 1, "oper")
+	oper.User.Modes['o'] = struct{}{}
+	oper.User.IP = "198.51.100.1"
+	alice := addCallerIDTestUser(cb, 2, "alice")
+	alice.User.IP = "192.0.2.5"
+
+	oper.glineCommand(irc.Message{Command: "GLINE",
+		Params: []string{"192.0.2.5", "Bad"}})
+	if got := drainCommands(oper); len(got) != 1 ||
+		got[0] != "415 oper 192.0.2.5 Bad Server/host mask" {
+		t.Errorf("invalid mask got %q", got)
+	}
+
+	oper.glineCommand(irc.Message{Command: "GLINE",
+		Params: []string{"10", "*@192.0.2.*", "Go away"}})
+
+	// The G-Line goes out first and then the matching user's QUIT.
+	if len(link.WriteChan) != 2 {
+		t.Fatalf("sent %d messages to server, wanted 2", len(link.WriteChan))
+	}
+	m := (<-link.WriteChan).Message
+	if m.Prefix != string(oper.User.UID) || m.Command != "ENCAP" ||
+		strings.Join(m.Params, " ") != "* GLINE 600 *@192.0.2.* Go away" {
+		t.Errorf("propagated %v", m)
+	}
+	if m := (<-link.WriteChan).Message; m.Prefix != string(alice.User.UID) ||
+		m.Command != "QUIT" || m.Params[0] != "G-Lined: Go away" {
+		t.Errorf("sent %v, wanted the QUIT", m)
+	}
+	if _, exists := cb.LocalUsers[alice.ID]; exists {
+		t.Errorf("matching user is still connected")
+	}
+
+	if len(cb.GLines) != 1 {
+		t.Fatalf("have %d G-Lines, wanted 1", len(cb.GLines))
+	}
+	gline := cb.GLines[0]
+	if gline.UserMask != "*" || gline.HostMask != "192.0.2.*" ||
+		gline.Reason != "Go away" || gline.SetAt == 0 {
+		t.Errorf("added %+v", gline)
+	}
+	if d := time.Until(time.Unix(gline.ExpiresAt, 0)); d < 9*time.Minute ||
+		d > 10*time.Minute {
+		t.Errorf("G-Line expires in %s, wanted 10 minutes", d)
+	}
+
+	_ = drainCommands(oper)
+	oper.statsCommand(irc.Message{Command: "STATS", Params: []string{"g"}})
+	wanted := []string{
+		"247 oper G 192.0.2.* * * Go away",
+		"219 oper G End of /STATS report",
+	}
+	if got := drainCommands(oper); strings.Join(got, "\n") !=
+		strings.Join(wanted, "\n") {
+		t.Errorf("STATS g got %q, wanted %q", got, wanted)
+	}
+
+	oper.unglineCommand(irc.Message{Command: "UNGLINE",
+		Params: []string{"*@192.0.2.*"}})
+	m = (<-link.WriteChan).Message
+	if strings.Join(m.Params, " ") != "* UNGLINE *@192.0.2.*" {
+		t.Errorf("propagated %v", m)
+	}
+	if len(cb.GLines) != 0 {
+		t.Errorf("G-Line was not removed")
+	}
+}
+
+func TestEncapGLine(t *testing.T) {
+	cb := newTraceTestCatbox("irc2.example.com", "001")
+	cb.Opers = map[TS6UID]*User{}
+	link21 := addTraceTestLink(cb, 1, "irc1.example.com", "000")
+	link23 := addTraceTestLink(cb, 2, "irc3.example.com", "002")
+	cb.Users["000AAAAAA"] = &User{DisplayNick: "oper", UID: "000AAAAAA",
+		Modes: map[byte]struct{}{'o': {}}, ClosestServer: link21}
+	alice := addCallerIDTestUser(cb, 1, "alice")
+	bob := addCallerIDTestUser(cb, 2, "bob")
+	bob.User.Username = "bob"
+
+	link21.encapCommand(irc.Message{Prefix: "000AAAAAA", Command: "ENCAP",
+		Params: []string{"*", "GLINE", "0", "user@*.example.com", "Go away"}})
+
+	gline, matched := cb.matchGLine(&User{Username: "user",
+		Hostname: "other.example.com"})
+	if !matched || gline.Reason != "Go away" || gline.ExpiresAt != 0 {
+		t.Errorf("G-Line was not added: %+v", gline)
+	}
+	if _, exists := cb.LocalUsers[alice.ID]; exists {
+		t.Errorf("matching user is still connected")
+	}
+	if _, exists := cb.LocalUsers[bob.ID]; !exists {
+		t.Errorf("user who does not match was disconnected")
+	}
+	if len(link23.WriteChan) == 0 {
+		t.Errorf("did not propagate the G-Line")
+	}
+
+	link21.encapCommand(irc.Message{Prefix: "000AAAAAA", Command: "ENCAP",
+		Params: []string{"*", "UNGLINE", "user@*.example.com"}})
+	if _, matched := cb.matchGLine(&User{Username: "user",
+		Hostname: "other.example.com"}); matched {
+		t.Errorf("G-Line was not removed")
+	}
+}
+
+func TestExpireGLines(t *testing.T) {
+	cb := newSnapshotCatbox()
+	now := time.Now()
+	cb.GLines = []GLine{
+		{HostMask: "expired", ExpiresAt: now.Add(-time.Second).Unix()},
+		{HostMask: "active", ExpiresAt: now.Add(time.Minute).Unix()},
+		{HostMask: "permanent"},
+	}
+
+	cb.expireGLines(now)
+
+	if len(cb.GLines) != 2 || cb.GLines[0].HostMask != "active" ||
+		cb.GLines[1].HostMask != "permanent" {
+		t.Errorf("G-Lines after expiry: %+v", cb.GLines)
+	}
+}
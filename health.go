@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// HealthStatus is the body we return from the health check endpoints.
+type HealthStatus struct {
+	Status  string `json:"status"`
+	Users   *int   `json:"users,omitempty"`
+	Servers *int   `json:"servers,omitempty"`
+}
+
+// startHealthServer starts an HTTP server that load balancers can use to check
+// on us.
+//
+// The handlers run in their own goroutines. They must not touch the server's
+// state directly. Instead they look at a snapshot that the event loop
+// updates.
+func (cb *Catbox) startHealthServer() error {
+	ln, err := net.Listen("tcp", cb.Config.HealthAddr)
+	if err != nil {
+		return fmt.Errorf("unable to listen (health): %s", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", cb.healthHandler)
+	mux.HandleFunc("/ready", cb.readyHandler)
+
+	cb.HealthServer = &http.Server{
+		Handler:      mux,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+
+	cb.WG.Add(1)
+	go func() {
+		defer cb.WG.Done()
+		if err := cb.HealthServer.Serve(ln); err != nil &&
+			err != http.ErrServerClosed {
+			cb.Logger.Error("Health server error: %s", err)
+		}
+		cb.Logger.Info("Health server shutting down.")
+	}()
+
+	return nil
+}
+
+// stopHealthServer shuts down the health HTTP server. We give in flight
+// requests a few seconds to complete.
+func (cb *Catbox) stopHealthServer() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := cb.HealthServer.Shutdown(ctx); err != nil {
+		cb.Logger.Error("Error shutting down health server: %s", err)
+	}
+}
+
+// updateHealthSnapshot records counts for the health check to report.
+//
+// Only the event loop goroutine should call this.
+func (cb *Catbox) updateHealthSnapshot() {
+	cb.HealthLock.Lock()
+	defer cb.HealthLock.Unlock()
+
+	cb.HealthUserCount = cb.userCount()
+	cb.HealthServerCount = len(cb.Servers)
+}
+
+// setFirstUser records that a user registered. After this we're ready.
+func (cb *Catbox) setFirstUser() {
+	cb.HealthLock.Lock()
+	defer cb.HealthLock.Unlock()
+
+	cb.FirstUser = true
+}
+
+func (cb *Catbox) healthHandler(w http.ResponseWriter, r *http.Request) {
+	if cb.isShuttingDown() {
+		cb.writeHealthStatus(w, http.StatusServiceUnavailable,
+			HealthStatus{Status: "shutting_down"})
+		return
+	}
+
+	cb.HealthLock.Lock()
+	users := cb.HealthUserCount
+	servers := cb.HealthServerCount
+	cb.HealthLock.Unlock()
+
+	cb.writeHealthStatus(w, http.StatusOK, HealthStatus{
+		Status:  "ok",
+		Users:   &users,
+		Servers: &servers,
+	})
+}
+
+// readyHandler tells whether we're ready for traffic. We consider ourselves
+// ready once a user registers.
+func (cb *Catbox) readyHandler(w http.ResponseWriter, r *http.Request) {
+	if cb.isShuttingDown() {
+		cb.writeHealthStatus(w, http.StatusServiceUnavailable,
+			HealthStatus{Status: "shutting_down"})
+		return
+	}
+
+	cb.HealthLock.Lock()
+	firstUser := cb.FirstUser
+	cb.HealthLock.Unlock()
+
+	if !firstUser {
+		cb.writeHealthStatus(w, http.StatusServiceUnavailable,
+			HealthStatus{Status: "not_ready"})
+		return
+	}
+
+	cb.writeHealthStatus(w, http.StatusOK, HealthStatus{Status: "ok"})
+}
+
+func (cb *Catbox) writeHealthStatus(w http.ResponseWriter, code int, status HealthStatus) {
+	buf, err := json.Marshal(status)
+	if err != nil {
+		cb.Logger.Error("Unable to encode health status: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if _, err := w.Write(buf); err != nil {
+		cb.Logger.Warn("Unable to write health status: %s", err)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealthHandler(t *testing.T) {
+	tests := []struct {
+		shuttingDown bool
+		users        int
+		servers      int
+		code         int
+		status       string
+	}{
+		{false, 0, 0, http.StatusOK, "ok"},
+		{false, 5, 2, http.StatusOK, "ok"},
+		{true, 5, 2, http.StatusServiceUnavailable, "shutting_down"},
+	}
+
+	for _, test := range tests {
+		cb := &Catbox{ShutdownChan: make(chan struct{})}
+		if test.shuttingDown {
+			close(cb.ShutdownChan)
+		}
+		cb.HealthUserCount = test.users
+		cb.HealthServerCount = test.servers
+
+		w := httptest.NewRecorder()
+		cb.healthHandler(w, httptest.NewRequest("GET", "/health", nil))
+
+		if w.Code != test.code {
+			t.Errorf("/health code = %d, wanted %d", w.Code, test.code)
+			continue
+		}
+
+		var status HealthStatus
+		if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+			t.Errorf("/health body is not valid JSON: %s: %s", w.Body.String(), err)
+			continue
+		}
+
+		if status.Status != test.status {
+			t.Errorf("/health status = %s, wanted %s", status.Status, test.status)
+		}
+
+		if test.shuttingDown {
+			if status.Users != nil || status.Servers != nil {
+				t.Errorf("/health included counts while shutting down: %s",
+					w.Body.String())
+			}
+			continue
+		}
+
+		if status.Users == nil || *status.Users != test.users {
+			t.Errorf("/health users = %v, wanted %d", status.Users, test.users)
+		}
+		if status.Servers == nil || *status.Servers != test.servers {
+			t.Errorf("/health servers = %v, wanted %d", status.Servers, test.servers)
+		}
+	}
+}
+
+func TestReadyHandler(t *testing.T) {
+	tests := []struct {
+		shuttingDown bool
+		firstUser    bool
+		code         int
+	}{
+		{false, false, http.StatusServiceUnavailable},
+		{false, true, http.StatusOK},
+		{true, true, http.StatusServiceUnavailable},
+	}
+
+	for _, test := range tests {
+		cb := &Catbox{ShutdownChan: make(chan struct{})}
+		if test.shuttingDown {
+			close(cb.ShutdownChan)
+		}
+		if test.firstUser {
+			cb.setFirstUser()
+		}
+
+		w := httptest.NewRecorder()
+		cb.readyHandler(w, httptest.NewRequest("GET", "/ready", nil))
+
+		if w.Code != test.code {
+			t.Errorf("/ready (shutting down: %v, first user: %v) code = %d, wanted %d",
+				test.shuttingDown, test.firstUser, w.Code, test.code)
+		}
+	}
+}
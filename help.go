@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/horgh/irc"
+)
+
+// helpTopicsPerLine is how many topics we list in each NOTICE when HELP has
+// no topic.
+const helpTopicsPerLine = 10
+
+// helpCommand shows help on a topic. Without a topic we list the topics.
+//
+// We serve topics from our built in help if enable-help is set, and otherwise
+// from the help cache. We never read files named by users.
+func (u *LocalUser) helpCommand(m irc.Message) {
+	if len(m.Params) == 0 || m.Params[0] == "" {
+		u.helpTopics()
+		return
+	}
+
+	topic := strings.ToUpper(m.Params[0])
+
+	lines, exists := u.Catbox.helpTopic(topic)
+	if !isValidHelpTopic(topic) || !exists {
+		// 524 ERR_HELPNOTFOUND
+		u.messageFromServer("524", []string{m.Params[0], "Help not found"})
+		return
+	}
+
+	first := ""
+	if len(lines) > 0 {
+		first = lines[0]
+	}
+
+	// 704 RPL_HELPSTART
+	u.messageFromServer("704", []string{topic, first})
+
+	// 705 RPL_HELPTXT
+	for i := 1; i < len(lines); i++ {
+		u.messageFromServer("705", []string{topic, lines[i]})
+	}
+
+	// 706 RPL_ENDOFHELP
+	u.messageFromServer("706", []string{topic, "End of /HELP"})
+}
+
+// helpTopic finds the lines of a topic. Our built in help comes first, then
+// the help directory.
+func (cb *Catbox) helpTopic(topic string) ([]string, bool) {
+	if cb.Config.EnableHelp {
+		if lines, exists := defaultHelp[topic]; exists {
+			return lines, true
+		}
+	}
+
+	lines, exists := cb.HelpCache[topic]
+	return lines, exists
+}
+
+// helpTopics lists the help topics.
+func (u *LocalUser) helpTopics() {
+	seen := make(map[string]struct{})
+	for topic := range u.Catbox.HelpCache {
+		seen[topic] = struct{}{}
+	}
+	if u.Catbox.Config.EnableHelp {
+		for topic := range defaultHelp {
+			seen[topic] = struct{}{}
+		}
+	}
+
+	if len(seen) == 0 {
+		u.messageFromServer("NOTICE", []string{u.User.DisplayNick,
+			"There is no help available"})
+		return
+	}
+
+	topics := make([]string, 0, len(seen))
+	for topic := range seen {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+
+	u.messageFromServer("NOTICE", []string{u.User.DisplayNick,
+		"Help topics (HELP <topic>):"})
+
+	for i := 0; i < len(topics); i += helpTopicsPerLine {
+		end := i + helpTopicsPerLine
+		if end > len(topics) {
+			end = len(topics)
+		}
+		u.messageFromServer("NOTICE", []string{u.User.DisplayNick,
+			strings.Join(topics[i:end], " ")})
+	}
+}
+
+// isValidHelpTopic checks a topic is only letters, digits, and underscores.
+// This keeps topics from naming files outside the help directory.
+func isValidHelpTopic(topic string) bool {
+	if topic == "" {
+		return false
+	}
+
+	for _, c := range topic {
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+			(c >= '0' && c <= '9') || c == '_' {
+			continue
+		}
+		return false
+	}
+
+	return true
+}
+
+// reloadHelp takes the help settings from the new config, puts them in next,
+// and loads the help cache from the help directory.
+func (cb *Catbox) reloadHelp(next, cfg *Config) {
+	next.EnableHelp = cfg.EnableHelp
+
+	help, err := loadHelp(cfg.HelpDir)
+	if err != nil {
+		cb.noticeOpers(fmt.Sprintf("Rehash: Unable to load help: %s", err))
+		return
+	}
+
+	next.HelpDir = cfg.HelpDir
+	cb.HelpCache = help
+}
+
+// loadHelp reads the help topics from the directory. Each topic is a file
+// named after it with a .txt extension, e.g. PRIVMSG.txt. We key topics by
+// their uppercased name.
+//
+// We skip files whose names are not valid topics.
+//
+// If there is no directory configured or it does not exist, there is no help.
+func loadHelp(dir string) (map[string][]string, error) {
+	help := make(map[string][]string)
+	if dir == "" {
+		return help, nil
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return help, nil
+		}
+		return nil, fmt.Errorf("unable to read help directory: %s", err)
+	}
+
+	for _, file := range files {
+		if !file.Mode().IsRegular() || filepath.Ext(file.Name()) != ".txt" {
+			continue
+		}
+
+		topic := strings.TrimSuffix(file.Name(), ".txt")
+		if !isValidHelpTopic(topic) {
+			continue
+		}
+
+		buf, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("unable to read help file: %s", err)
+		}
+
+		var lines []string
+		for _, line := range strings.Split(string(buf), "\n") {
+			lines = append(lines, strings.TrimRight(line, "\r"))
+		}
+
+		// Drop the blank line a trailing newline leaves.
+		for len(lines) > 0 && lines[len(lines)-1] == "" {
+			lines = lines[:len(lines)-1]
+		}
+
+		help[strings.ToUpper(topic)] = lines
+	}
+
+	return help, nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/horgh/irc"
+)
+
+func TestHelpCommand(t *testing.T) {
+	cb := newSnapshotCatbox()
+	cb.HelpCache = map[string][]string{
+		"PRIVMSG": {"PRIVMSG <target> <text>", "", "Sends a message."},
+		"MODE":    {"MODE <target> <modes>"},
+	}
+	alice := addCallerIDTestUser(cb, 1, "alice")
+
+	tests := []struct {
+		name   string
+		params []string
+		output []string
+	}{
+		{
+			"topic",
+			[]string{"privmsg"},
+			[]string{
+				"704 alice PRIVMSG PRIVMSG <target> <text>",
+				"705 alice PRIVMSG ",
+				"705 alice PRIVMSG Sends a message.",
+				"706 alice PRIVMSG End of /HELP",
+			},
+		},
+		{
+			"one line topic",
+			[]string{"MODE"},
+			[]string{
+				"704 alice MODE MODE <target> <modes>",
+				"706 alice MODE End of /HELP",
+			},
+		},
+		{
+			"unknown topic",
+			[]string{"KICK"},
+			[]string{"524 alice KICK Help not found"},
+		},
+		{
+			"invalid topic",
+			[]string{"../PRIVMSG"},
+			[]string{"524 alice ../PRIVMSG Help not found"},
+		},
+		{
+			"list topics",
+			nil,
+			[]string{
+				"NOTICE alice Help topics (HELP <topic>):",
+				"NOTICE alice MODE PRIVMSG",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		alice.helpCommand(irc.Message{Command: "HELP", Params: test.params})
+		if got := drainCommands(alice); strings.Join(got, "\n") !=
+			strings.Join(test.output, "\n") {
+			t.Errorf("%s: got %q, wanted %q", test.name, got, test.output)
+		}
+	}
+}
+
+func TestDefaultHelp(t *testing.T) {
+	cb := newSnapshotCatbox()
+	cb.Config.EnableHelp = true
+	cb.HelpCache = map[string][]string{
+		"PRIVMSG": {"From the help directory"},
+		"NEWBIES": {"Welcome!", "Ask in #help."},
+	}
+	alice := addCallerIDTestUser(cb, 1, "alice")
+
+	help := func(topic string) []string {
+		alice.helpCommand(irc.Message{Command: "HELP", Params: []string{topic}})
+		return drainCommands(alice)
+	}
+
+	// Our built in help comes first.
+	wanted := []string{
+		"704 alice PRIVMSG PRIVMSG <target> <text>",
+		"705 alice PRIVMSG Sends a message to a user or channel. Operators may send to every user",
+		"705 alice PRIVMSG on matching servers with $<server mask>.",
+		"706 alice PRIVMSG End of /HELP",
+	}
+	if got := help("privmsg"); strings.Join(got, "\n") !=
+		strings.Join(wanted, "\n") {
+		t.Errorf("HELP PRIVMSG got %q, wanted %q", got, wanted)
+	}
+
+	// Then the help directory.
+	wanted = []string{
+		"704 alice NEWBIES Welcome!",
+		"705 alice NEWBIES Ask in #help.",
+		"706 alice NEWBIES End of /HELP",
+	}
+	if got := help("NEWBIES"); strings.Join(got, "\n") !=
+		strings.Join(wanted, "\n") {
+		t.Errorf("HELP NEWBIES got %q, wanted %q", got, wanted)
+	}
+
+	if got := help("NOPE"); len(got) != 1 ||
+		got[0] != "524 alice NOPE Help not found" {
+		t.Errorf("HELP NOPE got %q", got)
+	}
+
+	// Without it we only have the help directory.
+	cb.Config.EnableHelp = false
+	if got := help("PRIVMSG"); len(got) != 2 ||
+		got[0] != "704 alice PRIVMSG From the help directory" {
+		t.Errorf("HELP PRIVMSG without built in help got %q", got)
+	}
+	if got := help("KICK"); len(got) != 1 || !strings.HasPrefix(got[0], "524 ") {
+		t.Errorf("HELP KICK without built in help got %q", got)
+	}
+}
+
+// Each built in topic starts with its usage and has a few lines.
+func TestDefaultHelpTopics(t *testing.T) {
+	for topic, lines := range defaultHelp {
+		if !isValidHelpTopic(topic) || strings.ToUpper(topic) != topic {
+			t.Errorf("topic %s is not valid", topic)
+		}
+		if len(lines) < 3 || len(lines) > 5 {
+			t.Errorf("topic %s has %d lines", topic, len(lines))
+		}
+		if len(lines) > 0 && !strings.HasPrefix(lines[0], topic) {
+			t.Errorf("topic %s starts with %s", topic, lines[0])
+		}
+	}
+}
+
+func TestIsValidHelpTopic(t *testing.T) {
+	tests := []struct {
+		topic string
+		valid bool
+	}{
+		{"PRIVMSG", true},
+		{"user_modes", true},
+		{"Mode2", true},
+		{"", false},
+		{"..", false},
+		{"../etc/passwd", false},
+		{"a/b", false},
+		{"a.txt", false},
+		{"a b", false},
+	}
+
+	for _, test := range tests {
+		if got := isValidHelpTopic(test.topic); got != test.valid {
+			t.Errorf("isValidHelpTopic(%q) = %v, wanted %v", test.topic, got,
+				test.valid)
+		}
+	}
+}
+
+func TestReloadHelp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catbox-help-")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	files := map[string]string{
+		"privmsg.txt":   "PRIVMSG <target> <text>\r\nSends a message.\n",
+		"not-valid.txt": "Skipped\n",
+		"README":        "Skipped\n",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content),
+			0600); err != nil {
+			t.Fatalf("error writing help file: %s", err)
+		}
+	}
+
+	cb := newSnapshotCatbox()
+	cb.reloadHelp(cb.Config, &Config{HelpDir: dir})
+	if len(cb.HelpCache) != 1 ||
+		strings.Join(cb.HelpCache["PRIVMSG"], "|") !=
+			"PRIVMSG <target> <text>|Sends a message." {
+		t.Errorf("loaded %q", cb.HelpCache)
+	}
+
+	// Rehashing picks up changes.
+	if err := ioutil.WriteFile(filepath.Join(dir, "MODE.txt"),
+		[]byte("MODE <target> <modes>\n"), 0600); err != nil {
+		t.Fatalf("error writing help file: %s", err)
+	}
+	cb.reloadHelp(cb.Config, &Config{HelpDir: dir})
+	if len(cb.HelpCache) != 2 || len(cb.HelpCache["MODE"]) != 1 {
+		t.Errorf("after changing the directory loaded %q", cb.HelpCache)
+	}
+
+	// A directory that does not exist has no help.
+	cb.reloadHelp(cb.Config, &Config{HelpDir: filepath.Join(dir, "missing")})
+	if len(cb.HelpCache) != 0 {
+		t.Errorf("loaded %q from a missing directory", cb.HelpCache)
+	}
+}
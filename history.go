@@ -0,0 +1,171 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// HistoryEntry is a message sent to a channel. We keep recent ones so clients
+// can ask for them with CHATHISTORY.
+type HistoryEntry struct {
+	Time    time.Time
+	Prefix  string
+	Command string
+	Params  []string
+}
+
+// addHistory records a message sent to the channel. We keep at most max
+// entries, dropping the oldest.
+func (c *Channel) addHistory(entry *HistoryEntry, max int) {
+	if max <= 0 {
+		return
+	}
+
+	c.History = append(c.History, entry)
+	if len(c.History) > max {
+		c.History = c.History[len(c.History)-max:]
+	}
+}
+
+// historyBefore returns up to count of the most recent entries sent before the
+// given time. Oldest first.
+func (c *Channel) historyBefore(t time.Time, count int) []*HistoryEntry {
+	end := len(c.History)
+	for end > 0 && !c.History[end-1].Time.Before(t) {
+		end--
+	}
+
+	start := end - count
+	if start < 0 {
+		start = 0
+	}
+	return c.History[start:end]
+}
+
+// historyAfter returns up to count of the oldest entries sent after the given
+// time. Oldest first.
+func (c *Channel) historyAfter(t time.Time, count int) []*HistoryEntry {
+	start := 0
+	for start < len(c.History) && !c.History[start].Time.After(t) {
+		start++
+	}
+
+	end := start + count
+	if end > len(c.History) {
+		end = len(c.History)
+	}
+	return c.History[start:end]
+}
+
+// historyLatest returns up to count of the most recent entries. If since is
+// not zero, we return only entries sent after it. Oldest first.
+func (c *Channel) historyLatest(since time.Time, count int) []*HistoryEntry {
+	start := len(c.History) - count
+	if start < 0 {
+		start = 0
+	}
+
+	for start < len(c.History) && !since.IsZero() &&
+		!c.History[start].Time.After(since) {
+		start++
+	}
+	return c.History[start:]
+}
+
+// Parse a CHATHISTORY message reference. We support * (no reference) and
+// timestamp=<RFC 3339 time>.
+func parseHistoryReference(s string) (time.Time, bool) {
+	if s == "*" {
+		return time.Time{}, true
+	}
+
+	if !strings.HasPrefix(s, "timestamp=") {
+		return time.Time{}, false
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, strings.TrimPrefix(s, "timestamp="))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// chathistoryCommand replays messages sent to a channel. The client must have
+// negotiated the draft/chathistory capability.
+//
+// Parameters: <LATEST | BEFORE | AFTER> <channel> <reference> <count>
+//
+// The reference is * or timestamp=<time>. * is only valid with LATEST.
+func (u *LocalUser) chathistoryCommand(m irc.Message) {
+	if !u.hasCap("draft/chathistory") {
+		// 421 ERR_UNKNOWNCOMMAND
+		u.messageFromServer("421", []string{m.Command, "Unknown command"})
+		return
+	}
+
+	if len(m.Params) < 4 {
+		// 461 ERR_NEEDMOREPARAMS
+		u.messageFromServer("461", []string{m.Command, "Not enough parameters"})
+		return
+	}
+
+	subCommand := strings.ToUpper(m.Params[0])
+	if subCommand != "LATEST" && subCommand != "BEFORE" && subCommand != "AFTER" {
+		u.messageFromServer("FAIL", []string{"CHATHISTORY", "INVALID_PARAMS",
+			m.Params[0], "Unknown subcommand"})
+		return
+	}
+
+	channelName := canonicalizeChannel(m.Params[1])
+	channel, exists := u.Catbox.Channels[channelName]
+	if !exists {
+		// 403 ERR_NOSUCHCHANNEL
+		u.messageFromServer("403", []string{m.Params[1], "No such channel"})
+		return
+	}
+
+	if !u.User.onChannel(channel) {
+		// 442 ERR_NOTONCHANNEL
+		u.messageFromServer("442", []string{channel.Name,
+			"You're not on that channel"})
+		return
+	}
+
+	t, ok := parseHistoryReference(m.Params[2])
+	if !ok || (subCommand != "LATEST" && t.IsZero()) {
+		u.messageFromServer("FAIL", []string{"CHATHISTORY", "INVALID_PARAMS",
+			m.Params[2], "Invalid message reference"})
+		return
+	}
+
+	count, err := strconv.Atoi(m.Params[3])
+	if err != nil || count <= 0 {
+		u.messageFromServer("FAIL", []string{"CHATHISTORY", "INVALID_PARAMS",
+			m.Params[3], "Invalid count"})
+		return
+	}
+
+	var entries []*HistoryEntry
+	switch subCommand {
+	case "LATEST":
+		entries = channel.historyLatest(t, count)
+	case "BEFORE":
+		entries = channel.historyBefore(t, count)
+	case "AFTER":
+		entries = channel.historyAfter(t, count)
+	}
+
+	// Clients that know about the time tag see when each was sent.
+	ref := u.openBatch("chathistory", []string{channel.Name})
+	for _, entry := range entries {
+		u.maybeQueueTaggedMessage(irc.Message{
+			Prefix:  entry.Prefix,
+			Command: entry.Command,
+			Params:  entry.Params,
+		}, map[string]string{"time": serverTime(entry.Time)})
+	}
+	u.closeBatch(ref)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+func TestChannelAddHistory(t *testing.T) {
+	channel := &Channel{Name: "#test"}
+
+	start := time.Unix(1000, 0)
+	for i := 0; i < 5; i++ {
+		channel.addHistory(&HistoryEntry{Time: start.Add(time.Duration(i) *
+			time.Second)}, 3)
+	}
+
+	if len(channel.History) != 3 {
+		t.Fatalf("addHistory() kept %d entries, wanted 3", len(channel.History))
+	}
+
+	// We drop the oldest.
+	for i, entry := range channel.History {
+		want := start.Add(time.Duration(i+2) * time.Second)
+		if !entry.Time.Equal(want) {
+			t.Errorf("History[%d] is from %s, wanted %s", i, entry.Time, want)
+		}
+	}
+
+	channel.addHistory(&HistoryEntry{Time: start}, 0)
+	if len(channel.History) != 3 {
+		t.Errorf("addHistory() with max 0 kept the entry")
+	}
+}
+
+func TestChannelHistoryQueries(t *testing.T) {
+	// Entries at 1000, 1001, ... 1009.
+	channel := &Channel{Name: "#test"}
+	for i := 0; i < 10; i++ {
+		channel.addHistory(&HistoryEntry{Time: time.Unix(int64(1000+i), 0)}, 100)
+	}
+
+	tests := []struct {
+		query string
+		t     int64
+		count int
+		// Times of the entries we expect. Oldest first.
+		output []int64
+	}{
+		{"latest", 0, 3, []int64{1007, 1008, 1009}},
+		{"latest", 0, 20, []int64{1000, 1001, 1002, 1003, 1004, 1005, 1006, 1007,
+			1008, 1009}},
+		{"latest", 1007, 5, []int64{1008, 1009}},
+		{"before", 1005, 2, []int64{1003, 1004}},
+		{"before", 1002, 5, []int64{1000, 1001}},
+		{"before", 1000, 5, []int64{}},
+		{"after", 1005, 2, []int64{1006, 1007}},
+		{"after", 1008, 5, []int64{1009}},
+		{"after", 1009, 5, []int64{}},
+	}
+
+	for _, test := range tests {
+		var since time.Time
+		if test.t != 0 {
+			since = time.Unix(test.t, 0)
+		}
+
+		var entries []*HistoryEntry
+		switch test.query {
+		case "latest":
+			entries = channel.historyLatest(since, test.count)
+		case "before":
+			entries = channel.historyBefore(since, test.count)
+		case "after":
+			entries = channel.historyAfter(since, test.count)
+		}
+
+		if len(entries) != len(test.output) {
+			t.Errorf("%s(%d, %d) = %d entries, wanted %d", test.query, test.t,
+				test.count, len(entries), len(test.output))
+			continue
+		}
+
+		for i, entry := range entries {
+			if entry.Time.Unix() != test.output[i] {
+				t.Errorf("%s(%d, %d)[%d] = %d, wanted %d", test.query, test.t,
+					test.count, i, entry.Time.Unix(), test.output[i])
+			}
+		}
+	}
+}
+
+func TestChathistoryCommand(t *testing.T) {
+	cb := &Catbox{
+		Config:   &Config{ServerName: "irc.example.com"},
+		Channels: map[string]*Channel{},
+	}
+
+	user := &User{DisplayNick: "nick", UID: TS6UID("000AAAAAA"),
+		Channels: map[string]*Channel{}}
+	u := &LocalUser{
+		LocalClient: &LocalClient{Catbox: cb,
+			WriteChan: make(chan TaggedMessage, 10), Caps: map[string]struct{}{}},
+		User: user,
+	}
+
+	channel := &Channel{Name: "#test",
+		Members: map[TS6UID]struct{}{user.UID: {}}}
+	cb.Channels[channel.Name] = channel
+	user.Channels[channel.Name] = channel
+
+	for i := 0; i < 5; i++ {
+		channel.addHistory(&HistoryEntry{
+			Time:    time.Unix(int64(1000+i), 0),
+			Prefix:  "other!user@host",
+			Command: "PRIVMSG",
+			Params:  []string{"#test", "hi"},
+		}, 100)
+	}
+
+	m := irc.Message{Command: "CHATHISTORY",
+		Params: []string{"LATEST", "#test", "*", "2"}}
+
+	// Without the capability it's unknown.
+	u.chathistoryCommand(m)
+	if len(u.WriteChan) != 1 {
+		t.Fatalf("chathistoryCommand() without cap sent %d messages, wanted 1",
+			len(u.WriteChan))
+	}
+	if reply := <-u.WriteChan; reply.Command != "421" {
+		t.Errorf("chathistoryCommand() without cap sent %s, wanted 421",
+			reply.Command)
+	}
+
+	u.Caps["draft/chathistory"] = struct{}{}
+	u.chathistoryCommand(m)
+	if len(u.WriteChan) != 2 {
+		t.Fatalf("chathistoryCommand() sent %d messages, wanted 2",
+			len(u.WriteChan))
+	}
+	for i := 0; i < 2; i++ {
+		reply := <-u.WriteChan
+		if reply.Prefix != "other!user@host" || reply.Command != "PRIVMSG" {
+			t.Errorf("chathistoryCommand() sent %s %s", reply.Prefix, reply.Command)
+		}
+	}
+
+	m.Params = []string{"BEFORE", "#test", "timestamp=1970-01-01T00:16:43Z", "10"}
+	u.chathistoryCommand(m)
+	if len(u.WriteChan) != 3 {
+		t.Errorf("chathistoryCommand(BEFORE) sent %d messages, wanted 3",
+			len(u.WriteChan))
+	}
+	for len(u.WriteChan) > 0 {
+		<-u.WriteChan
+	}
+
+	// With batch the messages are in a chathistory batch.
+	u.Caps["batch"] = struct{}{}
+	m.Params = []string{"LATEST", "#test", "*", "2"}
+	u.chathistoryCommand(m)
+	if len(u.WriteChan) != 4 {
+		t.Fatalf("chathistoryCommand() with batch sent %d messages, wanted 4",
+			len(u.WriteChan))
+	}
+	if reply := <-u.WriteChan; reply.Command != "BATCH" ||
+		strings.Join(reply.Params, " ") != "+1 chathistory #test" {
+		t.Errorf("chathistoryCommand() started with %v", reply)
+	}
+	for i := 0; i < 2; i++ {
+		if reply := <-u.WriteChan; reply.Tags["batch"] != "1" {
+			t.Errorf("chathistoryCommand() sent %v outside the batch", reply)
+		}
+	}
+	if reply := <-u.WriteChan; reply.Command != "BATCH" ||
+		strings.Join(reply.Params, " ") != "-1" {
+		t.Errorf("chathistoryCommand() ended with %v", reply)
+	}
+}
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// These tests run a catbox in this process and talk to it over TCP.
+
+// testServerOper is the oper in the test server's opers config.
+const testServerOper = "oper"
+
+// testServerOperPass is that oper's password.
+const testServerOperPass = "secret"
+
+// testServerTimeout is how long we wait for the server to reply or stop before
+// we give up on it. Tests wait for specific replies rather than for time to
+// pass, so this only matters if the server hangs. Keep it long: under -race
+// things are slow.
+const testServerTimeout = 30 * time.Second
+
+// testServer is a catbox we started for a test.
+type testServer struct {
+	t        *testing.T
+	catbox   *Catbox
+	dir      string
+	addr     string
+	done     chan error
+	resolver hostResolver
+}
+
+// TestClient is a client connected to a testServer.
+type TestClient struct {
+	t      *testing.T
+	nick   string
+	conn   net.Conn
+	reader *bufio.Reader
+
+	// Whether we saw the server welcome us.
+	registered bool
+}
+
+// newTestServer starts a catbox listening on a random port. extra is appended
+// to its config.
+//
+// The caller must call stop() to shut it down.
+func newTestServer(t *testing.T, extra string) *testServer {
+	dir, err := ioutil.TempDir("", "catbox-test-")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+
+	opersConf := filepath.Join(dir, "opers.conf")
+	if err := ioutil.WriteFile(opersConf, []byte(fmt.Sprintf("%s = %s\n",
+		testServerOper, testServerOperPass)), 0644); err != nil {
+		_ = os.RemoveAll(dir)
+		t.Fatalf("error writing opers config: %s", err)
+	}
+
+	// We pass in the listener's descriptor, so no port.
+	catboxConf := filepath.Join(dir, "catbox.conf")
+	if err := ioutil.WriteFile(catboxConf, []byte(fmt.Sprintf(`
+listen-port = -1
+server-name = irc.example.com
+ts6-sid = 000
+opers-config = %s
+%s
+`, opersConf, extra)), 0644); err != nil {
+		_ = os.RemoveAll(dir)
+		t.Fatalf("error writing config: %s", err)
+	}
+
+	ln, err := net.Listen("tcp4", "127.0.0.1:")
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		t.Fatalf("error listening: %s", err)
+	}
+
+	// The catbox gets a copy of the descriptor.
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		_ = ln.Close()
+		_ = os.RemoveAll(dir)
+		t.Fatalf("error retrieving listener file: %s", err)
+	}
+
+	cb, err := newCatbox(catboxConf)
+	if err != nil {
+		_ = f.Close()
+		_ = ln.Close()
+		_ = os.RemoveAll(dir)
+		t.Fatalf("error creating catbox: %s", err)
+	}
+	cb.Logger = newTestLogger()
+
+	s := &testServer{
+		t:        t,
+		catbox:   cb,
+		dir:      dir,
+		addr:     ln.Addr().String(),
+		done:     make(chan error, 1),
+		resolver: resolver,
+	}
+
+	// Answer hostname lookups right away. Registration waits on them, and a
+	// slow resolver would stall every test.
+	resolver = fakeResolver{
+		names: map[string][]string{"127.0.0.1": {"localhost."}},
+		ips:   map[string][]string{"localhost.": {"127.0.0.1"}},
+	}
+
+	if err := ln.Close(); err != nil {
+		t.Fatalf("error closing listener: %s", err)
+	}
+
+	go func() {
+		s.done <- cb.start(int(f.Fd()))
+	}()
+
+	return s
+}
+
+// stop shuts down the server by having an oper issue DIE. We wait for it to
+// finish shutting down.
+func (s *testServer) stop() {
+	defer func() {
+		resolver = s.resolver
+		_ = os.RemoveAll(s.dir)
+	}()
+
+	c := s.connect("killer")
+	c.Send("OPER", testServerOper, testServerOperPass)
+	c.ReadUntil("381")
+	c.Send("DIE")
+	_ = c.conn.Close()
+
+	select {
+	case err := <-s.done:
+		if err != nil {
+			s.t.Fatalf("catbox exited with error: %s", err)
+		}
+	case <-time.After(testServerTimeout):
+		s.t.Fatalf("timed out waiting for catbox to shut down")
+	}
+}
+
+// dial opens a connection to the server. The client has not registered.
+func (s *testServer) dial(nick string) *TestClient {
+	conn, err := net.DialTimeout("tcp", s.addr, testServerTimeout)
+	if err != nil {
+		s.t.Fatalf("error connecting: %s", err)
+	}
+
+	return &TestClient{
+		t:      s.t,
+		nick:   nick,
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+}
+
+// connect opens a connection to the server and registers.
+func (s *testServer) connect(nick string) *TestClient {
+	c := s.dial(nick)
+	c.Send("NICK", nick)
+	c.Send("USER", nick, "0", "*", nick+"'s real name")
+	c.ReadUntil("001")
+	return c
+}
+
+// Send sends a message to the server.
+func (c *TestClient) Send(command string, params ...string) {
+	buf, err := irc.Message{Command: command, Params: params}.Encode()
+	if err != nil {
+		c.t.Fatalf("%s: error encoding %s: %s", c.nick, command, err)
+	}
+
+	if err := c.conn.SetWriteDeadline(time.Now().Add(
+		testServerTimeout)); err != nil {
+		c.t.Fatalf("%s: error setting write deadline: %s", c.nick, err)
+	}
+
+	if _, err := c.conn.Write([]byte(buf)); err != nil {
+		c.t.Fatalf("%s: error writing %s: %s", c.nick, command, err)
+	}
+}
+
+// ReadUntil reads messages until one has the given command or numeric. It
+// returns every message read, including that one. If it does not arrive, the
+// test fails.
+func (c *TestClient) ReadUntil(command string) []irc.Message {
+	var messages []irc.Message
+	deadline := time.Now().Add(testServerTimeout)
+
+	for {
+		if err := c.conn.SetReadDeadline(deadline); err != nil {
+			c.t.Fatalf("%s: error setting read deadline: %s", c.nick, err)
+		}
+
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("%s: error reading while waiting for %s: %s (read %v)",
+				c.nick, command, err, messages)
+		}
+
+		m, err := irc.ParseMessage(line)
+		if err != nil {
+			c.t.Fatalf("%s: error parsing message: %s: %s", c.nick, line, err)
+		}
+
+		messages = append(messages, m)
+
+		if m.Command == "001" {
+			c.registered = true
+		}
+
+		if m.Command == command {
+			return messages
+		}
+	}
+}
+
+// Close quits and closes the connection.
+//
+// If we registered, we wait for the server to close the connection first. If
+// we close it while the server is writing to it, the server's writer waits a
+// while before giving up, which slows shutdown.
+func (c *TestClient) Close() {
+	if !c.registered {
+		_ = c.conn.Close()
+		return
+	}
+
+	buf, err := irc.Message{Command: "QUIT"}.Encode()
+	if err == nil {
+		_ = c.conn.SetWriteDeadline(time.Now().Add(testServerTimeout))
+		_, _ = c.conn.Write([]byte(buf))
+	}
+
+	_ = c.conn.SetReadDeadline(time.Now().Add(testServerTimeout))
+	_, _ = ioutil.ReadAll(c.reader)
+
+	_ = c.conn.Close()
+}
+
+// lastParam returns the message's last parameter.
+func lastParam(m irc.Message) string {
+	if len(m.Params) == 0 {
+		return ""
+	}
+	return m.Params[len(m.Params)-1]
+}
+
+func TestIntegrationRegistration(t *testing.T) {
+	s := newTestServer(t, "")
+	defer s.stop()
+
+	c := s.dial("alice")
+	defer c.Close()
+
+	c.Send("NICK", "alice")
+	c.Send("USER", "alice", "0", "*", "Alice")
+
+	messages := c.ReadUntil("001")
+	welcome := messages[len(messages)-1]
+	if welcome.Prefix != "irc.example.com" || len(welcome.Params) != 2 ||
+		welcome.Params[0] != "alice" {
+		t.Errorf("001 = %s", welcome)
+	}
+
+	for _, numeric := range []string{"002", "003", "004", "005", "376"} {
+		c.ReadUntil(numeric)
+	}
+
+	// We're registered, so we can use commands such as PING.
+	c.Send("PING", "token")
+	messages = c.ReadUntil("PONG")
+	if got := lastParam(messages[len(messages)-1]); got != "token" {
+		t.Errorf("PONG = %s, wanted token", got)
+	}
+}
+
+func TestIntegrationNickCollision(t *testing.T) {
+	s := newTestServer(t, "")
+	defer s.stop()
+
+	alice := s.connect("alice")
+	defer alice.Close()
+
+	// Registering with a nick in use fails.
+	c := s.dial("alice")
+	defer c.Close()
+	c.Send("NICK", "ALICE")
+	c.ReadUntil("433")
+
+	// As does changing to one.
+	bob := s.connect("bob")
+	defer bob.Close()
+	bob.Send("NICK", "Alice")
+	messages := bob.ReadUntil("433")
+	if got := messages[len(messages)-1].Params[1]; got != "Alice" {
+		t.Errorf("433 nick = %s, wanted Alice", got)
+	}
+}
+
+func TestIntegrationChannels(t *testing.T) {
+	s := newTestServer(t, "")
+	defer s.stop()
+
+	alice := s.connect("alice")
+	defer alice.Close()
+	bob := s.connect("bob")
+	defer bob.Close()
+
+	// The first to join gets ops.
+	alice.Send("JOIN", "#test")
+	messages := alice.ReadUntil("366")
+	if names := messages[len(messages)-2]; lastParam(names) != "@alice" {
+		t.Errorf("NAMES = %s, wanted @alice", names)
+	}
+
+	bob.Send("JOIN", "#test")
+	bob.ReadUntil("366")
+	messages = alice.ReadUntil("JOIN")
+	if got := messages[len(messages)-1].Prefix; !strings.HasPrefix(got,
+		"bob!") {
+		t.Errorf("JOIN from %s, wanted bob", got)
+	}
+
+	alice.Send("TOPIC", "#test", "a topic")
+	messages = bob.ReadUntil("TOPIC")
+	if got := lastParam(messages[len(messages)-1]); got != "a topic" {
+		t.Errorf("TOPIC = %s, wanted a topic", got)
+	}
+
+	// Only ops may change modes.
+	bob.Send("MODE", "#test", "+m")
+	bob.ReadUntil("482")
+
+	alice.Send("MODE", "#test", "+o", "bob")
+	messages = bob.ReadUntil("MODE")
+	if got := strings.Join(messages[len(messages)-1].Params, " "); got !=
+		"#test +o bob" {
+		t.Errorf("MODE = %s, wanted #test +o bob", got)
+	}
+
+	bob.Send("PART", "#test", "bye")
+	messages = alice.ReadUntil("PART")
+	if got := lastParam(messages[len(messages)-1]); got != "bye" {
+		t.Errorf("PART reason = %s, wanted bye", got)
+	}
+}
+
+func TestIntegrationKick(t *testing.T) {
+	s := newTestServer(t, "")
+	defer s.stop()
+
+	alice := s.connect("alice")
+	defer alice.Close()
+	bob := s.connect("bob")
+	defer bob.Close()
+
+	alice.Send("JOIN", "#test")
+	alice.ReadUntil("366")
+	bob.Send("JOIN", "#test")
+	bob.ReadUntil("366")
+
+	// Only ops may kick.
+	bob.Send("KICK", "#test", "alice")
+	bob.ReadUntil("482")
+
+	alice.Send("KICK", "#test", "bob", "go away")
+	messages := bob.ReadUntil("KICK")
+	if got := strings.Join(messages[len(messages)-1].Params, " "); got !=
+		"#test bob go away" {
+		t.Errorf("KICK = %s, wanted #test bob go away", got)
+	}
+
+	// They're no longer on the channel.
+	bob.Send("PRIVMSG", "#test", "hi")
+	bob.ReadUntil("404")
+}
+
+func TestIntegrationWHOIS(t *testing.T) {
+	s := newTestServer(t, "")
+	defer s.stop()
+
+	alice := s.connect("alice")
+	defer alice.Close()
+	bob := s.connect("bob")
+	defer bob.Close()
+
+	alice.Send("WHOIS", "bob")
+	messages := alice.ReadUntil("318")
+
+	found := false
+	for _, m := range messages {
+		if m.Command != "311" {
+			continue
+		}
+		found = true
+		if len(m.Params) != 6 || m.Params[1] != "bob" || m.Params[2] != "~bob" ||
+			m.Params[5] != "bob's real name" {
+			t.Errorf("311 = %s", m)
+		}
+	}
+	if !found {
+		t.Errorf("no 311 in WHOIS reply")
+	}
+
+	alice.Send("WHOIS", "nobody")
+	alice.ReadUntil("401")
+}
+
+func TestIntegrationQuit(t *testing.T) {
+	s := newTestServer(t, "")
+	defer s.stop()
+
+	alice := s.connect("alice")
+	defer alice.Close()
+	bob := s.connect("bob")
+	defer bob.Close()
+
+	alice.Send("JOIN", "#test")
+	alice.ReadUntil("366")
+	bob.Send("JOIN", "#test")
+	bob.ReadUntil("366")
+
+	bob.Send("QUIT", "see you")
+	bob.ReadUntil("ERROR")
+
+	messages := alice.ReadUntil("QUIT")
+	quit := messages[len(messages)-1]
+	if !strings.HasPrefix(quit.Prefix, "bob!") ||
+		lastParam(quit) != "Quit: see you" {
+		t.Errorf("QUIT = %s", quit)
+	}
+}
+
+func TestIntegrationFloodControl(t *testing.T) {
+	s := newTestServer(t, "")
+	defer s.stop()
+
+	alice := s.connect("alice")
+	defer alice.Close()
+
+	// We may send some messages at once. After that, flood control queues them.
+	// Once too many are queued, we're cut off.
+	for i := 0; i < UserMessageLimit+ExcessFloodThreshold+1; i++ {
+		alice.Send("PRIVMSG", "alice", "flood")
+	}
+
+	messages := alice.ReadUntil("ERROR")
+	if got := lastParam(messages[len(messages)-1]); !strings.Contains(got,
+		"Excess flood") {
+		t.Errorf("ERROR = %s, wanted excess flood", got)
+	}
+}
+
+func TestIntegrationKLine(t *testing.T) {
+	s := newTestServer(t, "")
+	defer s.stop()
+
+	oper := s.connect("oper")
+	defer oper.Close()
+	victim := s.connect("victim")
+	defer victim.Close()
+
+	oper.Send("OPER", testServerOper, testServerOperPass)
+	oper.ReadUntil("381")
+
+	// Users matching a new K-Line are cut off.
+	oper.Send("KLINE", "~victim@*", "go away")
+	messages := victim.ReadUntil("ERROR")
+	if got := lastParam(messages[len(messages)-1]); !strings.Contains(got,
+		"go away") {
+		t.Errorf("ERROR = %s, wanted K-Line reason", got)
+	}
+
+	// And may not connect.
+	c := s.dial("victim")
+	defer c.Close()
+	c.Send("NICK", "victim")
+	c.Send("USER", "victim", "0", "*", "Victim")
+	c.ReadUntil("465")
+
+	// Others may.
+	other := s.connect("other")
+	defer other.Close()
+}
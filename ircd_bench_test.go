@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// benchWriteChanSize is the size of each benchmark user's write channel. We
+// empty the channels before they fill.
+const benchWriteChanSize = 64
+
+// newBenchChannel makes a catbox with a channel with the given number of
+// local users in it. There are no connections. Messages to the users queue on
+// their write channels.
+func newBenchChannel(members int) (*Catbox, *Channel, []*LocalUser) {
+	cb := newTraceTestCatbox("irc.example.com", "000")
+	cb.Config.MaxNickLength = 20
+	cb.Channels = map[string]*Channel{}
+
+	channel := &Channel{
+		Name:    "#test",
+		Members: map[TS6UID]struct{}{},
+		Ops:     map[TS6UID]*User{},
+		Voices:  map[TS6UID]*User{},
+		Modes:   map[byte]struct{}{'n': {}},
+	}
+	cb.Channels[channel.Name] = channel
+
+	users := make([]*LocalUser, 0, members)
+	for i := 0; i < members; i++ {
+		lu := &LocalUser{
+			LocalClient: &LocalClient{
+				Catbox:    cb,
+				ID:        uint64(i),
+				WriteChan: make(chan TaggedMessage, benchWriteChanSize),
+			},
+		}
+		lu.User = &User{
+			DisplayNick: fmt.Sprintf("user%d", i),
+			Username:    "user",
+			Hostname:    "host.example.com",
+			UID:         TS6UID(fmt.Sprintf("000%06d", i)),
+			Modes:       map[byte]struct{}{},
+			Channels:    map[string]*Channel{channel.Name: channel},
+			LocalUser:   lu,
+		}
+		cb.LocalUsers[lu.ID] = lu
+		cb.Users[lu.User.UID] = lu.User
+		cb.Nicks[canonicalizeNick(lu.User.DisplayNick)] = lu.User.UID
+		channel.Members[lu.User.UID] = struct{}{}
+		users = append(users, lu)
+	}
+
+	return cb, channel, users
+}
+
+// drainBenchUsers empties the users' write channels.
+func drainBenchUsers(users []*LocalUser) {
+	for _, lu := range users {
+		for len(lu.WriteChan) > 0 {
+			<-lu.WriteChan
+		}
+	}
+}
+
+// benchmarkPrivmsgToChannel measures one user sending PRIVMSG to a channel
+// with the given number of local members. Each message goes to every member
+// but the sender.
+func benchmarkPrivmsgToChannel(b *testing.B, members int) {
+	_, _, users := newBenchChannel(members)
+	sender := users[0]
+
+	m := irc.Message{Command: "PRIVMSG", Params: []string{"#test", "hello there"}}
+
+	// How long routing took, excluding emptying the write channels.
+	var routing time.Duration
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		start := time.Now()
+		sender.privmsgCommand(m)
+		routing += time.Since(start)
+
+		if (i+1)%benchWriteChanSize == 0 {
+			b.StopTimer()
+			drainBenchUsers(users)
+			b.StartTimer()
+		}
+	}
+
+	b.StopTimer()
+
+	if users[members-1].SendQueueExceeded {
+		b.Fatalf("member's send queue filled")
+	}
+
+	b.ReportMetric(float64(b.N)*float64(members-1)/routing.Seconds(), "routed/s")
+}
+
+func BenchmarkPrivmsgToChannel100(b *testing.B) {
+	benchmarkPrivmsgToChannel(b, 100)
+}
+
+func BenchmarkPrivmsgToChannel1000(b *testing.B) {
+	benchmarkPrivmsgToChannel(b, 1000)
+}
+
+func BenchmarkPrivmsgToChannel10000(b *testing.B) {
+	benchmarkPrivmsgToChannel(b, 10000)
+}
+
+// BenchmarkNickChange1000ChannelMembers measures a user changing nick while
+// sharing a channel with 1,000 local users. Each change goes to every member.
+func BenchmarkNickChange1000ChannelMembers(b *testing.B) {
+	_, _, users := newBenchChannel(1000)
+	lu := users[0]
+
+	nicks := []string{"alice", "bob"}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		lu.nickCommand(irc.Message{Command: "NICK",
+			Params: []string{nicks[i%len(nicks)]}})
+
+		if (i+1)%benchWriteChanSize == 0 {
+			b.StopTimer()
+			drainBenchUsers(users)
+			b.StartTimer()
+		}
+	}
+
+	b.StopTimer()
+
+	if users[len(users)-1].SendQueueExceeded {
+		b.Fatalf("member's send queue filled")
+	}
+}
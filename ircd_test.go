@@ -1,8 +1,13 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestCanonicalizeNick(t *testing.T) {
@@ -104,6 +109,42 @@ func TestMakeTS6ID(t *testing.T) {
 //	}
 //}
 
+func TestStripColors(t *testing.T) {
+	tests := []struct {
+		input  string
+		output string
+	}{
+		{"hi there", "hi there"},
+		{"\x02bold\x02 \x1funderline\x1f \x16reverse\x16\x0f", "bold underline reverse"},
+		{"\x034red", "red"},
+		{"\x0304red", "red"},
+		{"\x03123", "3"},
+		{"\x034,12red on blue", "red on blue"},
+		{"\x0304,02red on blue", "red on blue"},
+		{"\x034,123", "3"},
+		// Nested codes.
+		{"\x02\x034,5\x1fall\x0f\x03", "all"},
+		{"\x034a\x035b\x03c", "abc"},
+		// Partial codes.
+		{"\x03", ""},
+		{"\x03,5x", ",5x"},
+		{"\x034,", ","},
+		{"\x034,x", ",x"},
+		{"1,2\x03", "1,2"},
+		{"hi\x03\x03", "hi"},
+		// Other control characters stay.
+		{"\x01ACTION waves\x01", "\x01ACTION waves\x01"},
+	}
+
+	for _, test := range tests {
+		output := stripColors(test.input)
+		if output != test.output {
+			t.Errorf("stripColors(%q) = %q, wanted %q", test.input, output,
+				test.output)
+		}
+	}
+}
+
 func TestUserMatchesMask(t *testing.T) {
 	tests := []struct {
 		inputUser     User
@@ -160,10 +201,61 @@ func TestUserMatchesMask(t *testing.T) {
 			inputHostMask: "127.0.0.1",
 			output:        false,
 		},
+
+		// A cloaked hostname. We match the real IP.
+		{
+			inputUser: User{Username: "test", Hostname: "192.168.1.x",
+				IP: "192.168.1.5"},
+			inputUserMask: "test",
+			inputHostMask: "192.168.1.5",
+			output:        true,
+		},
+		{
+			inputUser: User{Username: "test", Hostname: "192.168.1.x",
+				IP: "192.168.1.5"},
+			inputUserMask: "test",
+			inputHostMask: "192.168.1.6",
+			output:        false,
+		},
+
+		// CIDR host masks match the IP.
+		{
+			inputUser: User{Username: "test", Hostname: "192.168.1.x",
+				IP: "192.168.1.5"},
+			inputUserMask: "test",
+			inputHostMask: "192.168.0.0/16",
+			output:        true,
+		},
+		{
+			inputUser: User{Username: "test", Hostname: "192.168.1.x",
+				IP: "192.168.1.5"},
+			inputUserMask: "test",
+			inputHostMask: "10.0.0.0/8",
+			output:        false,
+		},
+		{
+			inputUser: User{Username: "test", Hostname: "2001:db8::x",
+				IP: "2001:db8::5"},
+			inputUserMask: "test",
+			inputHostMask: "2001:db8::/32",
+			output:        true,
+		},
+		{
+			inputUser:     User{Username: "test", Hostname: "example.com"},
+			inputUserMask: "test",
+			inputHostMask: "192.168.0.0/16",
+			output:        false,
+		},
 	}
 
 	for _, test := range tests {
-		output := test.inputUser.matchesMask(test.inputUserMask, test.inputHostMask)
+		output, err := test.inputUser.matchesMask(test.inputUserMask,
+			test.inputHostMask)
+		if err != nil {
+			t.Errorf("matchesMask(%s, %s) = error %s", test.inputUserMask,
+				test.inputHostMask, err)
+			continue
+		}
 		if output != test.output {
 			t.Errorf("matchesMask(%s, %s) = %v, wanted %v", test.inputUserMask,
 				test.inputHostMask, output, test.output)
@@ -171,6 +263,142 @@ func TestUserMatchesMask(t *testing.T) {
 	}
 }
 
+func TestUserIsFloodExempt(t *testing.T) {
+	masks := []string{"*.trusted.example.com", "10.0.0.0/8"}
+
+	tests := []struct {
+		name   string
+		user   *User
+		masks  []string
+		output bool
+	}{
+		{"oper", &User{Modes: map[byte]struct{}{'o': {}}, Hostname: "a.com",
+			IP: "192.168.0.1"}, masks, true},
+		{"flagged", &User{FloodExempt: true, Hostname: "a.com",
+			IP: "192.168.0.1"}, masks, true},
+		{"service", &User{IsService: true, Hostname: "services.example.com",
+			IP: "0"}, masks, true},
+		{"hostname", &User{Hostname: "bot.trusted.example.com",
+			IP: "192.168.0.1"}, masks, true},
+		{"IP in CIDR", &User{Hostname: "a.com", IP: "10.1.2.3"}, masks, true},
+		{"no match", &User{Hostname: "a.com", IP: "192.168.0.1"}, masks, false},
+		{"no masks", &User{Hostname: "bot.trusted.example.com",
+			IP: "10.1.2.3"}, nil, false},
+	}
+
+	for _, test := range tests {
+		if test.user.Modes == nil {
+			test.user.Modes = map[byte]struct{}{}
+		}
+		if output := test.user.isFloodExempt(test.masks); output != test.output {
+			t.Errorf("%s: isFloodExempt() = %v, wanted %v", test.name, output,
+				test.output)
+		}
+	}
+}
+
+func TestCloakIP(t *testing.T) {
+	tests := []struct {
+		ip        string
+		cloakIPv4 bool
+		cloakIPv6 bool
+		output    string
+		cloaked   bool
+	}{
+		{"192.168.1.5", true, false, "192.168.1.x", true},
+		{"192.168.1.5", false, true, "", false},
+		{"2001:db8:1:2:3:4:5:6", false, true, "2001:db8:1:2:xxxx:xxxx:xxxx:xxxx",
+			true},
+		{"2001:db8::1", false, true, "2001:db8:0:0:xxxx:xxxx:xxxx:xxxx", true},
+		{"::1", false, true, "0:0:0:0:xxxx:xxxx:xxxx:xxxx", true},
+		{"2001:db8::1", true, false, "", false},
+	}
+
+	for _, test := range tests {
+		output, cloaked := cloakIP(net.ParseIP(test.ip), test.cloakIPv4,
+			test.cloakIPv6)
+		if output != test.output || cloaked != test.cloaked {
+			t.Errorf("cloakIP(%s, %v, %v) = %s, %v, wanted %s, %v", test.ip,
+				test.cloakIPv4, test.cloakIPv6, output, cloaked, test.output,
+				test.cloaked)
+		}
+	}
+}
+
+// fakeResolver answers DNS lookups from maps.
+type fakeResolver struct {
+	names map[string][]string
+	ips   map[string][]string
+}
+
+func (r fakeResolver) LookupAddr(ctx context.Context,
+	addr string) ([]string, error) {
+	names, ok := r.names[addr]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	return names, nil
+}
+
+func (r fakeResolver) LookupIPAddr(ctx context.Context,
+	host string) ([]net.IPAddr, error) {
+	ips, ok := r.ips[host]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	var addrs []net.IPAddr
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return addrs, nil
+}
+
+func TestLookupHostname(t *testing.T) {
+	oldResolver := resolver
+	defer func() {
+		resolver = oldResolver
+	}()
+
+	resolver = fakeResolver{
+		names: map[string][]string{
+			"192.0.2.1": {"good.example.com."},
+			"192.0.2.2": {"spoof.example.com."},
+			"192.0.2.3": {"gone.example.com."},
+			"192.0.2.4": {"spoof.example.com.", "good4.example.com."},
+		},
+		ips: map[string][]string{
+			"good.example.com.":  {"192.0.2.1"},
+			"spoof.example.com.": {"198.51.100.1"},
+			"good4.example.com.": {"198.51.100.4", "192.0.2.4"},
+		},
+	}
+
+	tests := []struct {
+		ip             string
+		requireForward bool
+		hostname       string
+		mismatch       bool
+	}{
+		{"192.0.2.1", true, "good.example.com", false},
+		{"192.0.2.2", true, "", true},
+		{"192.0.2.3", true, "", true},
+		{"192.0.2.4", true, "good4.example.com", false},
+		{"192.0.2.5", true, "", false},
+		{"192.0.2.2", false, "spoof.example.com", false},
+		{"192.0.2.5", false, "", false},
+	}
+
+	for _, test := range tests {
+		hostname, mismatch := lookupHostname(context.Background(),
+			net.ParseIP(test.ip), test.requireForward)
+		if hostname != test.hostname || mismatch != test.mismatch {
+			t.Errorf("lookupHostname(%s, %v) = %s, %v, wanted %s, %v", test.ip,
+				test.requireForward, hostname, mismatch, test.hostname,
+				test.mismatch)
+		}
+	}
+}
+
 func TestParseAndResolveUmodeChanges(t *testing.T) {
 	tests := []struct {
 		inputModes         string
@@ -196,6 +424,38 @@ func TestParseAndResolveUmodeChanges(t *testing.T) {
 			outputUnknownModes: map[byte]struct{}{},
 			success:            true,
 		},
+		{
+			inputCurrentModes:  map[byte]struct{}{},
+			inputModes:         "+g",
+			outputSetModes:     map[byte]struct{}{'g': {}},
+			outputUnsetModes:   map[byte]struct{}{},
+			outputUnknownModes: map[byte]struct{}{},
+			success:            true,
+		},
+		{
+			inputCurrentModes:  map[byte]struct{}{'g': {}},
+			inputModes:         "-g",
+			outputSetModes:     map[byte]struct{}{},
+			outputUnsetModes:   map[byte]struct{}{'g': {}},
+			outputUnknownModes: map[byte]struct{}{},
+			success:            true,
+		},
+		{
+			inputCurrentModes:  map[byte]struct{}{},
+			inputModes:         "+w",
+			outputSetModes:     map[byte]struct{}{'w': {}},
+			outputUnsetModes:   map[byte]struct{}{},
+			outputUnknownModes: map[byte]struct{}{},
+			success:            true,
+		},
+		{
+			inputCurrentModes:  map[byte]struct{}{'w': {}},
+			inputModes:         "-w",
+			outputSetModes:     map[byte]struct{}{},
+			outputUnsetModes:   map[byte]struct{}{'w': {}},
+			outputUnknownModes: map[byte]struct{}{},
+			success:            true,
+		},
 		{
 			inputCurrentModes:  map[byte]struct{}{'o': {}},
 			inputModes:         "+C-C",
@@ -370,35 +630,176 @@ func TestIsValidUser(t *testing.T) {
 	}
 }
 
-func TestIsValidNick(t *testing.T) {
+func TestIsKLineTooBroad(t *testing.T) {
 	tests := []struct {
-		Input string
-		Valid bool
+		userMask string
+		hostMask string
+		tooBroad bool
 	}{
-		{"hi", true},
+		{"*", "*", true},
+		{"*", "*.*", true},
+		{"?*", "*", true},
+		{"*", "10.*", true},
+		{"*", "*.*.*.*", true},
+		{"*", "1?.*", true},
+		{"*", "0.0.0.0/0", true},
+		{"*", "10.0.0.0/8", true},
+		{"*", "::/0", true},
+		{"*", "192.168.*", false},
+		{"*", "192.168.0.0/16", false},
+		{"*", "2001:db8::/32", false},
+		{"*", "*.example.com", false},
+		{"*", "host.example.com", false},
+		{"*", "192.0.2.1", false},
+		{"~victim", "*", false},
+		{"user*", "10.*", false},
+	}
 
-		// - can't be in first position.
-		{"-hi", false},
+	for _, test := range tests {
+		if got := isKLineTooBroad(test.userMask, test.hostMask); got !=
+			test.tooBroad {
+			t.Errorf("isKLineTooBroad(%s, %s) = %v, wanted %v", test.userMask,
+				test.hostMask, got, test.tooBroad)
+		}
+	}
+}
 
-		// Digits can't be in first position.
-		{"0hi", false},
-		{"9hi", false},
+func TestTruncateText(t *testing.T) {
+	tests := []struct {
+		text   string
+		maxLen int
+		output string
+	}{
+		{"hello", 5, "hello"},
+		{"hello", 6, "hello"},
+		{"hello", 4, "hell"},
+		{"", 4, ""},
+		// é is two bytes. We don't cut it in half.
+		{"caf\u00e9", 5, "caf\u00e9"},
+		{"caf\u00e9", 4, "caf"},
+		{"caf\u00e9s", 5, "caf\u00e9"},
+	}
 
-		{"hi_there", true},
-		{"hi_there19", true},
+	for _, test := range tests {
+		if got := truncateText(test.text, test.maxLen); got != test.output {
+			t.Errorf("truncateText(%q, %d) = %q, wanted %q", test.text,
+				test.maxLen, got, test.output)
+		}
+	}
+}
 
-		{"[HiThere]", true},
-		{"hi`", true},
+func TestFormatUptime(t *testing.T) {
+	tests := []struct {
+		uptime time.Duration
+		output string
+	}{
+		{0, "Server Up 0 days 00:00:00"},
+		{59 * time.Second, "Server Up 0 days 00:00:59"},
+		{time.Minute, "Server Up 0 days 00:01:00"},
+		{59*time.Minute + 59*time.Second, "Server Up 0 days 00:59:59"},
+		{time.Hour, "Server Up 0 days 01:00:00"},
+		{23*time.Hour + 59*time.Minute + 59*time.Second + 999*time.Millisecond,
+			"Server Up 0 days 23:59:59"},
+		{24 * time.Hour, "Server Up 1 days 00:00:00"},
+		{50*time.Hour + 3*time.Minute + 4*time.Second,
+			"Server Up 2 days 02:03:04"},
+		{400 * 24 * time.Hour, "Server Up 400 days 00:00:00"},
+		{-time.Second, "Server Up 0 days 00:00:00"},
 	}
 
 	for _, test := range tests {
-		if !isValidNick(25, test.Input) {
-			if !test.Valid {
-				continue
-			}
+		if got := formatUptime(test.uptime); got != test.output {
+			t.Errorf("formatUptime(%s) = %q, wanted %q", test.uptime, got,
+				test.output)
+		}
+	}
+}
 
-			t.Errorf("isValidNick(%s) invalid, wanted valid", test.Input)
-			continue
+func TestServerToMapLine(t *testing.T) {
+	tests := []struct {
+		name        string
+		localUsers  int
+		globalUsers int
+		hopCount    int
+		output      string
+	}{
+		{"irc.example.com", 1, 4, 0,
+			"irc.example.com[000] ----------------------------- | Users: 1 ( 25.0%)"},
+		{"irc2.example.com", 3, 4, 1,
+			"  irc2.example.com[000] -------------------------- | Users: 3 ( 75.0%)"},
+		{"irc.example.com", 2, 10, 0,
+			"irc.example.com[000] ----------------------------- | Users:  2 ( 20.0%)"},
+		// No users anywhere.
+		{"irc.example.com", 0, 0, 0,
+			"irc.example.com[000] ----------------------------- | Users: 0 (  0.0%)"},
+		// A long name still gets a dash.
+		{strings.Repeat("a", 50), 1, 1, 0,
+			strings.Repeat("a", 50) + "[000] - | Users: 1 (100.0%)"},
+	}
+
+	for _, test := range tests {
+		if got := serverToMapLine(test.name, "000", test.localUsers,
+			test.globalUsers, test.hopCount); got != test.output {
+			t.Errorf("serverToMapLine(%s, %d, %d, %d) = %q, wanted %q", test.name,
+				test.localUsers, test.globalUsers, test.hopCount, got, test.output)
+		}
+	}
+}
+
+func TestIsValidNick(t *testing.T) {
+	unicode, err := newNickValidator(&Config{NickAllowUnicode: true})
+	if err != nil {
+		t.Fatalf("error making Unicode validator: %s", err)
+	}
+
+	// Custom regexes take precedence.
+	custom, err := newNickValidator(&Config{NickValidRegex: "^[a-z0-9-]+$",
+		NickAllowUnicode: true})
+	if err != nil {
+		t.Fatalf("error making custom validator: %s", err)
+	}
+
+	tests := []struct {
+		Input   string
+		Valid   bool
+		Unicode bool
+		Custom  bool
+	}{
+		{"hi", true, true, true},
+
+		// - can't be in first position.
+		{"-hi", false, false, false},
+
+		// Digits can't be in first position.
+		{"0hi", false, false, false},
+		{"9hi", false, false, false},
+
+		{"hi_there", true, true, false},
+		{"hi_there19", true, true, false},
+		{"hi-there", true, true, true},
+
+		{"[HiThere]", true, true, false},
+		{"hi`", true, true, false},
+
+		{"héllo", false, true, false},
+		{"日本", false, true, false},
+		{"hi there", false, false, false},
+		{"hi@there", false, false, false},
+		{"", false, false, false},
+		{"waytoolongnickname", false, false, false},
+	}
+
+	for _, test := range tests {
+		if got := isValidNick(15, nil, test.Input); got != test.Valid {
+			t.Errorf("isValidNick(%s) = %v, wanted %v", test.Input, got, test.Valid)
+		}
+		if got := isValidNick(15, unicode, test.Input); got != test.Unicode {
+			t.Errorf("isValidNick(%s) with Unicode = %v, wanted %v", test.Input, got,
+				test.Unicode)
+		}
+		if got := isValidNick(15, custom, test.Input); got != test.Custom {
+			t.Errorf("isValidNick(%s) with custom regex = %v, wanted %v", test.Input,
+				got, test.Custom)
 		}
 	}
 }
@@ -474,6 +875,7 @@ func TestIssueKillToServer(t *testing.T) {
 				ServerName: "irc.example.com",
 				TS6SID:     "000",
 			},
+			Logger: newTestLogger(),
 		}
 
 		ls := &LocalServer{
@@ -698,6 +1100,7 @@ func TestIssueKillToAllServers(t *testing.T) {
 				ServerName: "irc.example.com",
 				TS6SID:     "000",
 			},
+			Logger:       newTestLogger(),
 			LocalServers: test.Servers,
 		}
 
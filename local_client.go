@@ -1,9 +1,13 @@
 package main
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
 	"fmt"
-	"log"
 	"net"
 	"strconv"
 	"strings"
@@ -22,11 +26,18 @@ type LocalClient struct { // nolint: maligned
 	// Their hostname. May be blank if we can't look it up.
 	Hostname string
 
+	// The country code of their IP. Blank if we don't know it.
+	Country string
+
 	// Locally unique identifier.
 	ID uint64
 
 	// WriteChan is the channel to send to to write to the client.
-	WriteChan chan irc.Message
+	WriteChan chan TaggedMessage
+
+	// BatchRef is the reference of the IRCv3 batch we're sending the client, if
+	// any. See openBatch.
+	BatchRef string
 
 	// The time they connected.
 	ConnectionStartTime time.Time
@@ -37,6 +48,18 @@ type LocalClient struct { // nolint: maligned
 	// Track if we overflow our send queue. If we do, we'll kill the client.
 	SendQueueExceeded bool
 
+	// How many messages may wait in the send queue. 0 means as many as fit in
+	// WriteChan. Users get this from their connection class.
+	MaxSendQ int
+
+	// Limits how fast we read from the client if it becomes a server and
+	// bursts. nil if we don't limit.
+	BurstLimiter *BurstLimiter
+
+	// Whether they are ready to register but must wait because too many users
+	// registered this second (MaxRegistrationsPerSecond).
+	RegistrationDeferred bool
+
 	// Track how many messages we receive in a pre-registered state.
 	// If we hit a defined threshold, kill the connection.
 	PreRegisterMessageCount int
@@ -55,7 +78,8 @@ type LocalClient struct { // nolint: maligned
 
 	// Server info
 
-	// PASS arguments.
+	// PASS arguments. Users may send PASS too. We check their password against
+	// UserPassword.
 	PreRegPass   string
 	PreRegTS6SID string
 
@@ -75,26 +99,67 @@ type LocalClient struct { // nolint: maligned
 
 	SentSERVER bool
 	SentSVINFO bool
+
+	// CHALLENGE state. We use it instead of checking the password if the link
+	// is configured to. See challengeCommand.
+
+	// The nonce we sent the server. Hex encoded.
+	ChallengeNonce string
+
+	// The nonce the server sent us. Hex encoded.
+	PreRegChallenge string
+
+	// Whether the server's link uses CHALLENGE.
+	PreRegUseChallenge bool
+
+	// Whether the server answered our nonce correctly.
+	ChallengeVerified bool
+
+	// Whether we're waiting for the server to answer our nonce before we send
+	// SVINFO.
+	SVINFOPending bool
+
+	// IRCv3 capabilities the client negotiated with CAP.
+	Caps map[string]struct{}
+
+	// Whether the client is negotiating capabilities. While it is we don't
+	// complete registration.
+	CapNegotiating bool
 }
 
+// ChallengeNonceLength is how many random bytes are in a CHALLENGE nonce.
+const ChallengeNonceLength = 32
+
 // MaxAllowedPreRegisterMessageCount defines how many messages a client may send
 // us before registration before we consider them abusive and cut them off.
 const MaxAllowedPreRegisterMessageCount = 10
 
 // NewLocalClient creates a LocalClient
 func NewLocalClient(cb *Catbox, id uint64, conn net.Conn) *LocalClient {
+	// We create clients outside of the main goroutine.
+	cfg := cb.config()
+
+	// We don't know yet whether this is a server. Set up the limiter now anyway
+	// as the read goroutine uses it. It does nothing until a burst starts.
+	var burstLimiter *BurstLimiter
+	if cfg.BurstRateLimit > 0 {
+		burstLimiter = NewBurstLimiter(cfg.BurstRateLimit)
+	}
+
 	return &LocalClient{
-		Conn: NewConn(conn, cb.Config.DeadTime),
+		Conn: NewConn(conn, cfg.DeadTime, cb.Logger),
 		ID:   id,
 
 		// Buffered channel. We don't want to block sending to the client from the
 		// server. The client may be stuck. Make the buffer large enough that it
 		// should only max out in case of connection issues.
-		WriteChan: make(chan irc.Message, 32768),
+		WriteChan: make(chan TaggedMessage, 32768),
 
 		ConnectionStartTime: time.Now(),
 		Catbox:              cb,
 		PreRegCapabs:        make(map[string]struct{}),
+		Caps:                make(map[string]struct{}),
+		BurstLimiter:        burstLimiter,
 	}
 }
 
@@ -133,6 +198,39 @@ func (c *LocalClient) getTLSState() (string, string, error) {
 		cipherSuiteToString(state.CipherSuite), nil
 }
 
+// getCertFP gets the fingerprint of the client's TLS certificate. It is empty
+// if the client did not present one.
+//
+// We run the client/server handshake if it has not been run yet.
+func (c *LocalClient) getCertFP() (string, error) {
+	tlsConn, ok := c.Conn.conn.(*tls.Conn)
+	if !ok {
+		return "", fmt.Errorf("client is not connected with TLS")
+	}
+
+	if err := c.Conn.conn.SetDeadline(time.Now().Add(c.Conn.ioWait)); err != nil {
+		return "", fmt.Errorf("error setting deadline: %s", err)
+	}
+
+	if err := tlsConn.Handshake(); err != nil {
+		return "", fmt.Errorf("TLS handshake failed: %s", err)
+	}
+
+	state := tlsConn.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return "", nil
+	}
+
+	return certFingerprint(state.PeerCertificates[0].Raw), nil
+}
+
+// certFingerprint makes a fingerprint from a DER encoded certificate. It is
+// the SHA-256 hash in lowercase hex.
+func certFingerprint(der []byte) string {
+	hash := sha256.Sum256(der)
+	return hex.EncodeToString(hash[:])
+}
+
 // Send a message to the client. We send it to its write channel, which in turn
 // leads to writing it to its TCP socket.
 //
@@ -142,12 +240,46 @@ func (c *LocalClient) getTLSState() (string, string, error) {
 // Not blocking is important because the server sends the client messages this
 // way, and if we block on a problem client, everything would grind to a halt.
 func (c *LocalClient) maybeQueueMessage(m irc.Message) {
+	c.maybeQueueTaggedMessage(m, nil)
+}
+
+// maybeQueueTaggedMessage sends a message with tags to the client. It is like
+// maybeQueueMessage.
+//
+// Clients only see tags if they have the message-tags capability. Clients with
+// it or with server-time also get the time tag. If tags does not include it,
+// we say the message is from now.
+//
+// If we're sending a batch, we tag the message with it.
+func (c *LocalClient) maybeQueueTaggedMessage(m irc.Message,
+	tags map[string]string) {
 	if c.SendQueueExceeded {
 		return
 	}
 
+	tm := TaggedMessage{Message: m}
+	if c.hasCap("message-tags") || c.hasCap("server-time") {
+		tm.Tags = map[string]string{"time": serverTime(time.Now())}
+		for name, value := range tags {
+			if name == "time" || c.hasCap("message-tags") {
+				tm.Tags[name] = value
+			}
+		}
+	}
+	if c.BatchRef != "" {
+		if tm.Tags == nil {
+			tm.Tags = make(map[string]string)
+		}
+		tm.Tags["batch"] = c.BatchRef
+	}
+
+	if c.MaxSendQ > 0 && len(c.WriteChan) >= c.MaxSendQ {
+		c.SendQueueExceeded = true
+		return
+	}
+
 	select {
-	case c.WriteChan <- m:
+	case c.WriteChan <- tm:
 	default:
 		c.SendQueueExceeded = true
 	}
@@ -166,7 +298,7 @@ func (c *LocalClient) readLoop() {
 
 		buf, err := c.Conn.Read()
 		if err != nil {
-			log.Printf("Client %s: Read problem: %s", c, err)
+			c.Catbox.Logger.Info("Client %s: Read problem: %s", c, err)
 			// Debug concerns with missing quit messages.
 			if buf != "" {
 				c.Catbox.noticeOpers(fmt.Sprintf("Read error but have [%s]",
@@ -176,6 +308,8 @@ func (c *LocalClient) readLoop() {
 			break
 		}
 
+		tags, buf := parseTags(buf)
+
 		message, err := irc.ParseMessage(buf)
 		if err != nil {
 			c.Catbox.noticeOpers(fmt.Sprintf("Invalid message from client %s: %s", c,
@@ -188,19 +322,35 @@ func (c *LocalClient) readLoop() {
 			}
 		}
 
+		// Everything after ZIPSTART is compressed. We have to switch before we
+		// read again. The server decides whether the link is allowed to do this.
+		if message.Command == "ZIPSTART" && c.Conn.zipOffered() {
+			c.Conn.startDecompressing()
+		}
+
 		c.Catbox.newEvent(Event{
 			Type:    MessageFromClientEvent,
 			Client:  c,
 			Message: message,
+			Tags:    tags,
 		})
+
+		// If it's a server that is bursting, don't let it take over the event
+		// loop.
+		if wait := c.BurstLimiter.delay(time.Now()); wait > 0 {
+			time.Sleep(wait)
+		}
 	}
 
-	log.Printf("Client %s: Reader shutting down.", c)
+	c.Catbox.Logger.Debug("Client %s: Reader shutting down.", c)
 }
 
 // writeLoop endlessly reads from the client's channel, encodes each message,
 // and writes it to the client's TCP connection.
 //
+// If we batch writes, we encode any other messages waiting on the channel too
+// and write them all at once.
+//
 // When the channel is closed, or if we have a write error, close the TCP
 // connection. I have this here so that we try to deliver messages to the
 // client before closing its socket and giving up.
@@ -222,6 +372,8 @@ func (c *LocalClient) writeLoop() {
 	// messages on the write channel (and so inform the client about shutdown)
 	// when we are shutting down. But it is an improvement on leaking the
 	// goroutine.
+	buf := &bytes.Buffer{}
+
 Loop:
 	for {
 		select {
@@ -230,21 +382,33 @@ Loop:
 				break Loop
 			}
 
-			buf, err := message.Encode()
-			if err != nil {
-				c.Catbox.noticeOpers(fmt.Sprintf(
-					"Trying to send invalid message to client %s: %s", c, err))
-				if err != irc.ErrTruncated {
-					continue
+			buf.Reset()
+			open, zipStart := c.encodeWriteBatch(buf, message)
+
+			if buf.Len() > 0 {
+				if err := c.Conn.Write(buf.String()); err != nil {
+					c.Catbox.Logger.Info("Client %s: Write problem: %s: %s", c,
+						buf.String(), err)
+					// Don't kill the client immediately. Give a chance for us to read
+					// anything from it.
+					time.Sleep(5 * time.Second)
+					c.Catbox.newEvent(Event{Type: DeadClientEvent, Client: c,
+						Error: err})
+					break Loop
+				}
+			}
+
+			// We compress everything after ZIPSTART.
+			if zipStart {
+				if err := c.Conn.startCompressing(); err != nil {
+					c.Catbox.Logger.Info("Client %s: %s", c, err)
+					c.Catbox.newEvent(Event{Type: DeadClientEvent, Client: c,
+						Error: err})
+					break Loop
 				}
 			}
 
-			if err := c.Conn.Write(buf); err != nil {
-				log.Printf("Client %s: Write problem: %s: %s", c, buf, err)
-				// Don't kill the client immediately. Give a chance for us to read
-				// anything from it.
-				time.Sleep(5 * time.Second)
-				c.Catbox.newEvent(Event{Type: DeadClientEvent, Client: c, Error: err})
+			if !open {
 				break Loop
 			}
 		case <-c.Catbox.ShutdownChan:
@@ -253,10 +417,59 @@ Loop:
 	}
 
 	if err := c.Conn.Close(); err != nil {
-		log.Printf("Client %s: Problem closing connection: %s", c, err)
+		c.Catbox.Logger.Warn("Client %s: Problem closing connection: %s", c, err)
 	}
 
-	log.Printf("Client %s: Writer shutting down.", c)
+	c.Catbox.Logger.Debug("Client %s: Writer shutting down.", c)
+}
+
+// encodeWriteBatch encodes the message into buf.
+//
+// If we batch writes, we then encode any more messages waiting on the write
+// channel. We stop when there are no more waiting, when we have
+// WriteBatchMessages messages, or when another message might not fit in
+// WriteBatchBytes. We never block. We also stop after ZIPSTART since we must
+// compress what follows it.
+//
+// It returns false if the write channel closed. It returns true as its second
+// value if the batch ends with ZIPSTART.
+func (c *LocalClient) encodeWriteBatch(buf *bytes.Buffer,
+	message TaggedMessage) (bool, bool) {
+	// We're on the writer goroutine.
+	batchWrites := c.Catbox.config().BatchWrites
+
+	count := 0
+	for {
+		s, err := message.Encode()
+		if err != nil {
+			c.Catbox.noticeOpers(fmt.Sprintf(
+				"Trying to send invalid message to client %s: %s", c, err))
+		}
+		if err == nil || err == irc.ErrTruncated {
+			_, _ = buf.WriteString(s)
+			count++
+		}
+
+		if message.Command == "ZIPSTART" {
+			return true, true
+		}
+
+		if !batchWrites ||
+			count >= WriteBatchMessages ||
+			buf.Len()+irc.MaxLineLength > WriteBatchBytes {
+			return true, false
+		}
+
+		select {
+		case m, ok := <-c.WriteChan:
+			if !ok {
+				return false, false
+			}
+			message = m
+		default:
+			return true, false
+		}
+	}
 }
 
 // quit means the client is quitting. Tell it why and clean up.
@@ -278,16 +491,38 @@ func (c *LocalClient) quit(msg string) {
 func (c *LocalClient) registerUser() {
 	// RFC 2813 specifies messages to send upon registration.
 
+	// If we require a password, they must have sent it with PASS.
+	if c.Catbox.Config.UserPassword != "" &&
+		c.PreRegPass != c.Catbox.Config.UserPassword {
+		// 464 ERR_PASSWDMISMATCH
+		c.messageFromServer("464", []string{"Password incorrect"})
+		c.quit("Bad password")
+		return
+	}
+
 	// Check NICK is still available. I'm no longer reserving it in the Nicks map
 	// until registration completes, so check now.
+	//
+	// If we deferred them, someone may have taken it since. They're no longer
+	// deferred. They register once they send another NICK.
 	_, exists := c.Catbox.Nicks[canonicalizeNick(c.PreRegDisplayNick)]
 	if exists {
+		c.RegistrationDeferred = false
 		// 433 ERR_NICKNAMEINUSE
 		c.messageFromServer("433", []string{c.PreRegDisplayNick,
 			"Nickname is already in use"})
 		return
 	}
 
+	// If too many users registered this second, we finish registering them
+	// when we wake up (checkAndPingClients()).
+	if c.Catbox.registrationThrottled(time.Now()) {
+		c.RegistrationDeferred = true
+		return
+	}
+	c.RegistrationDeferred = false
+	c.Catbox.RegistrationCount++
+
 	lu := NewLocalUser(c)
 
 	// This IP field is not always actually an IP. It can be "0" in the case of a
@@ -304,6 +539,10 @@ func (c *LocalClient) registerUser() {
 	hostname := ip
 	if len(c.Hostname) > 0 {
 		hostname = c.Hostname
+	} else if cloakedIP, ok := cloakIP(c.Conn.IP, c.Catbox.Config.CloakIPv4,
+		c.Catbox.Config.CloakIPv6); ok {
+		// We show the hostname to other users. Keep the real IP in the IP field.
+		hostname = cloakedIP
 	}
 
 	u := &User{
@@ -325,7 +564,11 @@ func (c *LocalClient) registerUser() {
 	// This may flag the user flood exempt.
 	// This may give the user a spoof.
 	for _, userConfig := range c.Catbox.Config.UserConfigs {
-		if !u.matchesMask(userConfig.UserMask, userConfig.HostMask) {
+		matches, err := u.matchesMask(userConfig.UserMask, userConfig.HostMask)
+		if err != nil {
+			c.Catbox.Logger.Warn("User config: %s", err)
+		}
+		if !matches {
 			continue
 		}
 
@@ -339,13 +582,22 @@ func (c *LocalClient) registerUser() {
 			lu.serverNotice(fmt.Sprintf("Spoofing your hostname as %s", u.Hostname))
 		}
 
+		u.Class = userConfig.Class
+
+		matched := userConfig
+		lu.Config = &matched
+
 		// Match the first only.
 		break
 	}
 
 	// Check if they're klined. Don't accept further if so.
 	for _, kline := range c.Catbox.KLines {
-		if !u.matchesMask(kline.UserMask, kline.HostMask) {
+		matches, err := u.matchesMask(kline.UserMask, kline.HostMask)
+		if err != nil {
+			c.Catbox.Logger.Warn("K-Line: %s", err)
+		}
+		if !matches {
 			continue
 		}
 		// 465 ERR_YOUREBANNEDCREEP
@@ -359,9 +611,58 @@ func (c *LocalClient) registerUser() {
 		return
 	}
 
+	// Check if they're G-Lined.
+	if gline, matched := c.Catbox.matchGLine(u); matched {
+		// 465 ERR_YOUREBANNEDCREEP
+		lu.messageFromServer("465", []string{"You are banned from this network"})
+
+		c.quit(fmt.Sprintf("Connection closed: G-Lined: %s", gline.Reason))
+
+		c.Catbox.noticeLocalOpers(fmt.Sprintf(
+			"Rejecting user registration for %s!%s@%s. GLined: %s",
+			u.DisplayNick, u.Username, u.Hostname, gline.Reason))
+		return
+	}
+
+	// Check if they're X-Lined.
+	if xline, matched := c.Catbox.matchXLine(u.RealName); matched {
+		// 465 ERR_YOUREBANNEDCREEP
+		lu.messageFromServer("465", []string{"You are banned from this server"})
+
+		c.quit(fmt.Sprintf("Connection closed: %s", xline.Reason))
+
+		c.Catbox.noticeLocalOpers(fmt.Sprintf(
+			"Rejecting user registration for %s!%s@%s. XLined: %s",
+			u.DisplayNick, u.Username, u.Hostname, xline.Reason))
+		return
+	}
+
+	class := c.Catbox.Config.connClass(u.Class)
+	if class.MaxUsers > 0 &&
+		c.Catbox.countClassUsers(class.Name) >= class.MaxUsers {
+		c.quit("Connection closed: Too many connections in your class")
+
+		c.Catbox.noticeLocalOpers(fmt.Sprintf(
+			"Rejecting user registration for %s!%s@%s. Class %s is full.",
+			u.DisplayNick, u.Username, u.Hostname, class.Name))
+		return
+	}
+	if c.isTLS() {
+		certFP, err := c.getCertFP()
+		if err != nil {
+			c.Catbox.Logger.Warn("Client %s: Unable to get certificate fingerprint: %s",
+				c, err)
+		}
+		lu.CertFP = certFP
+	}
+
+	u.Class = class.Name
+	lu.MaxSendQ = class.MaxSendQ
+	lu.MessageCounter = class.FloodThreshold
+
 	uid, err := lu.makeTS6UID(lu.ID)
 	if err != nil {
-		log.Fatal(err)
+		c.Catbox.fatal("%s", err)
 	}
 	u.UID = uid
 
@@ -394,22 +695,57 @@ func (c *LocalClient) registerUser() {
 		// It seems ambiguous if these are to be separate parameters.
 		lu.Catbox.Config.ServerName,
 		lu.Catbox.version(),
-		// User modes we support.
-		"ioC",
-		// Channel modes we support.
-		"nos",
+		lu.Catbox.supportedUserModes(),
+		lu.Catbox.supportedChannelModes(),
 	})
 
+	maxChannels := 0
+	if lu.Config != nil {
+		maxChannels = lu.Config.MaxChannels
+	}
+	tokens := lu.Catbox.isupportTokens(maxChannels)
+	for len(tokens) > 0 {
+		n := ISupportTokensPerLine
+		if len(tokens) < n {
+			n = len(tokens)
+		}
+
+		// 005 RPL_ISUPPORT
+		lu.messageFromServer("005", append(tokens[:n:n],
+			"are supported by this server"))
+
+		tokens = tokens[n:]
+	}
+
 	c.Catbox.updateCounters()
 	c.Catbox.ConnectionCount++
+	c.Catbox.setFirstUser()
+
+	entry := lu.accessLogEntry("connect")
+	if c.isTLS() {
+		tlsVersion, tlsCipherSuite, err := c.getTLSState()
+		if err == nil {
+			entry.TLSVersion = tlsVersion
+			entry.TLSCipherSuite = tlsCipherSuite
+		}
+	}
+	c.Catbox.logAccess(entry)
 
+	lu.sendWelcome()
+
+	// LUSERS, MOTD, and, if we're configured to show them at connect, RULES.
 	lu.lusersCommand()
 	lu.motdCommand()
+	if lu.Catbox.Config.RulesOnConnect && len(lu.Catbox.Rules) > 0 {
+		lu.rulesCommand()
+	}
 
 	// Set user mode +i automatically.
 	lu.messageUser(u, "MODE", []string{u.DisplayNick, "+i"})
 	u.Modes['i'] = struct{}{}
 
+	c.Catbox.notifyWatchers(u, true)
+
 	// Tell linked servers about this new client.
 	for _, server := range c.Catbox.LocalServers {
 		server.maybeQueueMessage(irc.Message{
@@ -455,9 +791,12 @@ func (c *LocalClient) registerUser() {
 		if !exists {
 			continue
 		}
-		oper.LocalUser.serverNotice(fmt.Sprintf("CLICONN %s %s %s %s %s (%s)",
-			u.DisplayNick, u.Username, u.Hostname, u.IP, u.RealName,
-			c.Catbox.Config.ServerName))
+		notice := fmt.Sprintf("CLICONN %s %s %s %s %s (%s)", u.DisplayNick,
+			u.Username, u.Hostname, u.IP, u.RealName, c.Catbox.Config.ServerName)
+		if c.Country != "" {
+			notice += fmt.Sprintf(" (%s)", c.Country)
+		}
+		oper.LocalUser.serverNotice(notice)
 	}
 }
 
@@ -499,6 +838,19 @@ func (c *LocalClient) sendSVINFO() {
 	c.SentSVINFO = true
 }
 
+// zipNegotiated tells whether we and the server both advertised ZIP. If so we
+// compress the link.
+func (c *LocalClient) zipNegotiated() bool {
+	_, exists := c.PreRegCapabs["ZIP"]
+	return exists && c.Conn.zipOffered()
+}
+
+// sendZIPSTART tells the server that we compress everything we send from now
+// on. The writer switches after it writes this.
+func (c *LocalClient) sendZIPSTART() {
+	c.maybeQueueMessage(irc.Message{Command: "ZIPSTART"})
+}
+
 // Upgrade a LocalClient to a LocalServer.
 func (c *LocalClient) registerServer() {
 	newLS := NewLocalServer(c)
@@ -514,6 +866,9 @@ func (c *LocalClient) registerServer() {
 
 	newLS.Server = newServer
 
+	// It bursts to us now.
+	newLS.BurstLimiter.start()
+
 	delete(c.Catbox.LocalClients, c.ID)
 	c.Catbox.LocalServers[newLS.ID] = newLS
 	c.Catbox.Servers[newServer.SID] = newServer
@@ -575,7 +930,13 @@ func (c *LocalClient) registerServer() {
 	}
 }
 
-func (c *LocalClient) sendServerIntro(pass string) {
+func (c *LocalClient) sendServerIntro(linkInfo *ServerDefinition) {
+	// With CHALLENGE we don't send the password. PASS still tells our SID.
+	pass := linkInfo.Pass
+	if linkInfo.UseChallenge {
+		pass = "*"
+	}
+
 	// PASS <password>, TS, <ts version>, <SID>
 	c.maybeQueueMessage(irc.Message{
 		Command: "PASS",
@@ -583,6 +944,14 @@ func (c *LocalClient) sendServerIntro(pass string) {
 			pass, "TS", "6", string(c.Catbox.Config.TS6SID)},
 	})
 
+	capabs := fmt.Sprintf("QS ENCAP EX TB QUIET NICKLEN=%d",
+		c.Catbox.Config.MaxNickLength)
+	if linkInfo.ZIP {
+		// Record it before the server can see CAPAB and reply with ZIPSTART.
+		c.Conn.offerZIP()
+		capabs += " ZIP"
+	}
+
 	// CAPAB <space separated list>
 	c.maybeQueueMessage(irc.Message{
 		Command: "CAPAB",
@@ -593,9 +962,18 @@ func (c *LocalClient) sendServerIntro(pass string) {
 		// http://www.leeh.co.uk/ircd/encap.txt
 		// TB means support for topic burst. We send/receive TB commands during
 		// burst which tells the topics in channels.
-		Params: []string{"QS ENCAP TB"},
+		// EX means support for ban exceptions (channel mode +e).
+		// QUIET means support for quiets (channel mode +Q).
+		// NICKLEN tells the longest nick we accept. Nicks from the server that
+		// are longer than it are invalid to us.
+		// ZIP means we compress the link after SVINFO if we both support it.
+		Params: []string{capabs},
 	})
 
+	if linkInfo.UseChallenge {
+		c.sendCHALLENGE()
+	}
+
 	// SERVER <name> <hopcount> <description>
 	c.maybeQueueMessage(irc.Message{
 		Command: "SERVER",
@@ -624,9 +1002,12 @@ func (c *LocalClient) handleMessage(m irc.Message) {
 		return
 	}
 
-	// Non-RFC command that appears to be widely supported. Just ignore it for
-	// now.
 	if m.Command == "CAP" {
+		nick := "*"
+		if len(c.PreRegDisplayNick) > 0 {
+			nick = c.PreRegDisplayNick
+		}
+		c.capCommand(m, nick, false)
 		return
 	}
 
@@ -699,6 +1080,11 @@ func (c *LocalClient) handleMessage(m irc.Message) {
 		return
 	}
 
+	if m.Command == "CHALLENGE" {
+		c.challengeCommand(m)
+		return
+	}
+
 	if m.Command == "SERVER" {
 		c.serverCommand(m)
 		return
@@ -734,7 +1120,8 @@ func (c *LocalClient) nickCommand(m irc.Message) {
 		nick = nick[0:c.Catbox.Config.MaxNickLength]
 	}
 
-	if !isValidNick(c.Catbox.Config.MaxNickLength, nick) {
+	if !isValidNick(c.Catbox.Config.MaxNickLength, c.Catbox.NickValidator,
+		nick) {
 		// 432 ERR_ERRONEUSNICKNAME
 		c.messageFromServer("432", []string{nick, "Erroneous nickname"})
 		return
@@ -750,6 +1137,14 @@ func (c *LocalClient) nickCommand(m irc.Message) {
 		return
 	}
 
+	// We hold the nicks of users who quit recently.
+	if c.Catbox.isNickHeld(nickCanon, time.Now()) {
+		// 433 ERR_NICKNAMEINUSE
+		c.messageFromServer("433", []string{nick,
+			"Nickname is temporarily unavailable"})
+		return
+	}
+
 	// NOTE: I no longer flag the nick as taken until registration completes.
 	//   Simpler.
 
@@ -758,8 +1153,9 @@ func (c *LocalClient) nickCommand(m irc.Message) {
 	// We don't reply during registration (we don't have enough info, no uhost
 	// anyway).
 
-	// If we have USER done already, then we're done registration.
-	if len(c.PreRegUser) > 0 {
+	// If we have USER done already, then we're done registration. Unless we're
+	// negotiating capabilities.
+	if len(c.PreRegUser) > 0 && !c.CapNegotiating {
 		c.registerUser()
 	}
 }
@@ -805,17 +1201,33 @@ func (c *LocalClient) userCommand(m irc.Message) {
 	}
 	c.PreRegRealName = realName
 
-	// If we have a nick, then we're done registration.
-	if len(c.PreRegDisplayNick) > 0 {
+	// If we have a nick, then we're done registration. Unless we're negotiating
+	// capabilities.
+	if len(c.PreRegDisplayNick) > 0 && !c.CapNegotiating {
 		c.registerUser()
 	}
 }
 
 func (c *LocalClient) passCommand(m irc.Message) {
+	if len(m.Params) == 0 {
+		// 461 ERR_NEEDMOREPARAMS
+		c.messageFromServer("461", []string{"PASS", "Not enough parameters"})
+		return
+	}
+
+	// For user registration:
+	// PASS <password>
+	//
+	// Servers always send the longer form below, and before CAPAB and SERVER.
+	if len(m.Params) < 4 && !c.GotCAPAB && !c.GotSERVER {
+		// We check it when they register.
+		c.PreRegPass = m.Params[0]
+		return
+	}
+
 	// For server registration:
 	// PASS <password>, TS, <ts version>, <SID>
 	if len(m.Params) < 4 {
-		// For now I only recognise this form of PASS.
 		// 461 ERR_NEEDMOREPARAMS
 		c.messageFromServer("461", []string{"PASS", "Not enough parameters"})
 		return
@@ -936,7 +1348,14 @@ func (c *LocalClient) serverCommand(m irc.Message) {
 	}
 
 	// At this point we should have a password from the PASS command. Check it.
-	if linkInfo.Pass != c.PreRegPass {
+	// If the link uses CHALLENGE we instead should have their nonce. We check
+	// their answer to ours later.
+	if linkInfo.UseChallenge {
+		if c.PreRegChallenge == "" {
+			c.quit("Missing CHALLENGE")
+			return
+		}
+	} else if linkInfo.Pass != c.PreRegPass {
 		c.quit("Bad password")
 		return
 	}
@@ -955,6 +1374,7 @@ func (c *LocalClient) serverCommand(m irc.Message) {
 
 	c.PreRegServerName = serverName
 	c.PreRegServerDesc = m.Params[2]
+	c.PreRegUseChallenge = linkInfo.UseChallenge
 
 	c.GotSERVER = true
 
@@ -965,14 +1385,157 @@ func (c *LocalClient) serverCommand(m irc.Message) {
 	// instead.
 
 	if !c.SentSERVER {
-		c.sendServerIntro(linkInfo.Pass)
+		c.sendServerIntro(linkInfo)
+
+		if c.PreRegUseChallenge {
+			c.answerChallenge(linkInfo.Pass)
+		}
+		return
+	}
 
+	// With CHALLENGE, we wait until they answer our nonce to send SVINFO.
+	if c.PreRegUseChallenge {
+		c.answerChallenge(linkInfo.Pass)
+		c.SVINFOPending = true
 		return
 	}
 
 	c.sendSVINFO()
 }
 
+// sendCHALLENGE sends the server a random nonce. It must answer with the
+// HMAC-SHA256 of the nonce keyed by the link password. This way the password
+// is never sent, and an answer can't be used again.
+func (c *LocalClient) sendCHALLENGE() {
+	nonce := make([]byte, ChallengeNonceLength)
+	if _, err := rand.Read(nonce); err != nil {
+		// The server will give up on us since we send no CHALLENGE.
+		c.Catbox.Logger.Error("Client %s: Unable to make CHALLENGE nonce: %s", c,
+			err)
+		return
+	}
+
+	c.ChallengeNonce = hex.EncodeToString(nonce)
+
+	// CHALLENGE <nonce>
+	c.maybeQueueMessage(irc.Message{
+		Command: "CHALLENGE",
+		Params:  []string{c.ChallengeNonce},
+	})
+}
+
+// answerChallenge answers the nonce the server sent us.
+func (c *LocalClient) answerChallenge(pass string) {
+	// CHALLENGE <nonce> <answer>
+	c.maybeQueueMessage(irc.Message{
+		Command: "CHALLENGE",
+		Params: []string{
+			c.PreRegChallenge,
+			challengeAnswer(c.PreRegChallenge, pass, c.Catbox.Config.ServerName,
+				c.PreRegServerName),
+		},
+	})
+}
+
+// challengeAnswer computes the answer to a CHALLENGE nonce: The HMAC-SHA256
+// keyed by the password of the name of the server answering, the name of the
+// server that sent the nonce, and the nonce. Hex encoded.
+//
+// Including the names means an answer is only good for one direction of one
+// link. We can't be tricked into answering our own nonce for the server
+// claiming to be our peer.
+func challengeAnswer(nonce, pass, from, to string) string {
+	rawNonce, err := hex.DecodeString(nonce)
+	if err != nil {
+		return ""
+	}
+
+	mac := hmac.New(sha256.New, []byte(pass))
+	_, _ = mac.Write([]byte("CHALLENGE\x00" + from + "\x00" + to + "\x00"))
+	_, _ = mac.Write(rawNonce)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// challengeCommand handles both parts of CHALLENGE authentication during a
+// server link.
+//
+// CHALLENGE <nonce> is the server's nonce. It comes before SERVER. We answer
+// it once we know which server it is.
+//
+// CHALLENGE <nonce> <answer> is the server's answer to our nonce. It comes
+// after SERVER. If it's right, we continue linking.
+func (c *LocalClient) challengeCommand(m irc.Message) {
+	if len(m.Params) == 0 {
+		// 461 ERR_NEEDMOREPARAMS
+		c.messageFromServer("461", []string{"CHALLENGE", "Not enough parameters"})
+		return
+	}
+
+	if !c.GotCAPAB {
+		c.quit("CAPAB first")
+		return
+	}
+
+	if len(m.Params) == 1 {
+		if c.GotSERVER {
+			c.quit("CHALLENGE must come before SERVER")
+			return
+		}
+
+		if c.PreRegChallenge != "" {
+			c.quit("Double CHALLENGE")
+			return
+		}
+
+		nonce, err := hex.DecodeString(m.Params[0])
+		if err != nil || len(nonce) != ChallengeNonceLength {
+			c.quit("Malformed CHALLENGE")
+			return
+		}
+
+		// Someone sending us one of our own nonces wants us to answer it for
+		// them.
+		if c.Catbox.issuedChallengeNonce(m.Params[0]) {
+			c.quit("Reflected CHALLENGE")
+			return
+		}
+
+		c.PreRegChallenge = m.Params[0]
+		return
+	}
+
+	if !c.GotSERVER || !c.PreRegUseChallenge || c.ChallengeNonce == "" {
+		c.quit("Unexpected CHALLENGE answer")
+		return
+	}
+
+	if c.ChallengeVerified {
+		c.quit("Double CHALLENGE answer")
+		return
+	}
+
+	linkInfo, exists := c.Catbox.Config.Servers[c.PreRegServerName]
+	if !exists {
+		c.quit("I don't know you")
+		return
+	}
+
+	want := challengeAnswer(c.ChallengeNonce, linkInfo.Pass, c.PreRegServerName,
+		c.Catbox.Config.ServerName)
+	if m.Params[0] != c.ChallengeNonce ||
+		!hmac.Equal([]byte(m.Params[1]), []byte(want)) {
+		c.quit("Bad CHALLENGE answer")
+		return
+	}
+
+	c.ChallengeVerified = true
+
+	if c.SVINFOPending {
+		c.SVINFOPending = false
+		c.sendSVINFO()
+	}
+}
+
 func (c *LocalClient) svinfoCommand(m irc.Message) {
 	// SVINFO <TS version> <min TS version> 0 <current time>
 	if len(m.Params) < 4 {
@@ -986,6 +1549,11 @@ func (c *LocalClient) svinfoCommand(m irc.Message) {
 		return
 	}
 
+	if c.PreRegUseChallenge && !c.ChallengeVerified {
+		c.quit("CHALLENGE first")
+		return
+	}
+
 	// Once we have SVINFO, we'll upgrade to LocalServer, so we will never see
 	// double SVINFO.
 
@@ -1029,6 +1597,12 @@ func (c *LocalClient) svinfoCommand(m irc.Message) {
 		c.sendSVINFO()
 	}
 
+	// We've each seen the other's SVINFO. Compress from here on if we agreed.
+	// The burst follows.
+	if c.zipNegotiated() {
+		c.sendZIPSTART()
+	}
+
 	// Let's choose here to decide we're linked. The burst is still to come.
 	c.registerServer()
 }
@@ -0,0 +1,974 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+func TestRegisterUserConnClass(t *testing.T) {
+	classes := []ConnClass{
+		{Name: "full", MaxUsers: 1, PingTime: time.Minute,
+			DeadTime: 5 * time.Minute, MaxRecvQ: 20, FloodThreshold: 5},
+		{Name: "trusted", MaxUsers: 10, PingTime: time.Minute,
+			DeadTime: 5 * time.Minute, MaxSendQ: 1000, MaxRecvQ: 100,
+			FloodThreshold: 20},
+	}
+
+	tests := []struct {
+		name           string
+		hostname       string
+		registered     bool
+		class          string
+		maxSendQ       int
+		messageCounter int
+	}{
+		{"trusted user gets their class", "trusted.example.com", true, "trusted",
+			1000, 20},
+		{"unmatched user gets the default class", "other.example.com", true,
+			DefaultConnClass, 0, UserMessageLimit},
+		{"full class rejects the user", "full.example.com", false, "", 0, 0},
+	}
+
+	for _, test := range tests {
+		cb := &Catbox{
+			Config: &Config{
+				ServerName: "irc.example.com",
+				TS6SID:     TS6SID("000"),
+				PingTime:   30 * time.Second,
+				DeadTime:   240 * time.Second,
+				UserConfigs: []UserConfig{
+					{UserMask: "*", HostMask: "trusted.example.com", Class: "trusted"},
+					{UserMask: "*", HostMask: "full.example.com", Class: "full"},
+				},
+				ConnClasses: classes,
+			},
+			LocalClients: map[uint64]*LocalClient{},
+			LocalUsers: map[uint64]*LocalUser{
+				// Someone already in the full class.
+				100: {User: &User{Class: "full"}},
+			},
+			Nicks:   map[string]TS6UID{},
+			Users:   map[TS6UID]*User{},
+			Servers: map[TS6SID]*Server{},
+			Logger:  newTestLogger(),
+		}
+
+		c := &LocalClient{
+			ID:                1,
+			Catbox:            cb,
+			Conn:              Conn{IP: net.ParseIP("192.168.0.1")},
+			WriteChan:         make(chan TaggedMessage, 100),
+			Hostname:          test.hostname,
+			PreRegDisplayNick: "nick",
+			PreRegUser:        "user",
+			PreRegRealName:    "real name",
+		}
+		cb.LocalClients[c.ID] = c
+
+		c.registerUser()
+
+		u, registered := cb.LocalUsers[c.ID]
+		if registered != test.registered {
+			t.Errorf("%s: registered = %v, wanted %v", test.name, registered,
+				test.registered)
+			continue
+		}
+		if !registered {
+			continue
+		}
+
+		if u.User.Class != test.class {
+			t.Errorf("%s: class = %s, wanted %s", test.name, u.User.Class,
+				test.class)
+		}
+		if u.MaxSendQ != test.maxSendQ {
+			t.Errorf("%s: max sendq = %d, wanted %d", test.name, u.MaxSendQ,
+				test.maxSendQ)
+		}
+		if u.MessageCounter != test.messageCounter {
+			t.Errorf("%s: message counter = %d, wanted %d", test.name,
+				u.MessageCounter, test.messageCounter)
+		}
+	}
+}
+
+func TestRegisterUserConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		ip          string
+		matched     bool
+		floodExempt bool
+		maxChannels int
+	}{
+		{"IP in the CIDR", "10.1.2.3", true, true, 3},
+		{"IP outside the CIDR", "192.168.0.1", false, false, 0},
+	}
+
+	for _, test := range tests {
+		cb := newSnapshotCatbox()
+		cb.Config.UserConfigs = []UserConfig{
+			{UserMask: "*", HostMask: "10.0.0.0/8", FloodExempt: true,
+				MaxChannels: 3},
+		}
+
+		c := &LocalClient{
+			ID:                1,
+			Catbox:            cb,
+			Conn:              Conn{IP: net.ParseIP(test.ip)},
+			WriteChan:         make(chan TaggedMessage, 100),
+			PreRegDisplayNick: "nick",
+			PreRegUser:        "user",
+			PreRegRealName:    "real name",
+		}
+		cb.LocalClients[c.ID] = c
+
+		c.registerUser()
+
+		u, registered := cb.LocalUsers[c.ID]
+		if !registered {
+			t.Errorf("%s: user did not register", test.name)
+			continue
+		}
+
+		if (u.Config != nil) != test.matched {
+			t.Errorf("%s: matched config = %v, wanted %v", test.name,
+				u.Config != nil, test.matched)
+			continue
+		}
+
+		if u.User.isFloodExempt(nil) != test.floodExempt {
+			t.Errorf("%s: flood exempt = %v, wanted %v", test.name,
+				u.User.isFloodExempt(nil), test.floodExempt)
+		}
+
+		if u.Config != nil && u.Config.MaxChannels != test.maxChannels {
+			t.Errorf("%s: max channels = %d, wanted %d", test.name,
+				u.Config.MaxChannels, test.maxChannels)
+		}
+	}
+}
+
+func TestRegisterUserPassword(t *testing.T) {
+	tests := []struct {
+		name         string
+		userPassword string
+		pass         []string
+		registered   bool
+	}{
+		{"correct password", "secret", []string{"secret"}, true},
+		{"wrong password", "secret", []string{"wrong"}, false},
+		{"no password", "secret", nil, false},
+		{"last PASS counts", "secret", []string{"wrong", "secret"}, true},
+		{"no password required", "", nil, true},
+		{"password sent when not required", "", []string{"whatever"}, true},
+	}
+
+	for _, test := range tests {
+		cb := newSnapshotCatbox()
+		cb.Config.UserPassword = test.userPassword
+
+		c := &LocalClient{
+			ID:                1,
+			Catbox:            cb,
+			Conn:              Conn{IP: net.ParseIP("192.168.0.1")},
+			WriteChan:         make(chan TaggedMessage, 100),
+			PreRegDisplayNick: "nick",
+			PreRegUser:        "user",
+			PreRegRealName:    "real name",
+		}
+		cb.LocalClients[c.ID] = c
+
+		for _, pass := range test.pass {
+			c.passCommand(irc.Message{Command: "PASS", Params: []string{pass}})
+		}
+		if c.GotPASS {
+			t.Errorf("%s: took user PASS as server PASS", test.name)
+		}
+
+		c.registerUser()
+
+		if _, registered := cb.LocalUsers[c.ID]; registered != test.registered {
+			t.Errorf("%s: registered = %v, wanted %v", test.name, registered,
+				test.registered)
+			continue
+		}
+		if test.registered {
+			continue
+		}
+
+		var got []string
+		for len(c.WriteChan) > 0 {
+			m := (<-c.WriteChan).Message
+			got = append(got, m.Command+" "+strings.Join(m.Params, " "))
+		}
+		wanted := []string{"464 nick Password incorrect", "ERROR Bad password"}
+		if strings.Join(got, "\n") != strings.Join(wanted, "\n") {
+			t.Errorf("%s: got %q, wanted %q", test.name, got, wanted)
+		}
+	}
+}
+
+// newChallengeTestClient makes a Catbox that links to the other server with
+// CHALLENGE, and a client in it for the link.
+func newChallengeTestClient(name, sid, otherName, pass string) *LocalClient {
+	cb := newSnapshotCatbox()
+	cb.Config.ServerName = name
+	cb.Config.TS6SID = TS6SID(sid)
+	cb.Config.Servers = map[string]*ServerDefinition{
+		otherName: {Name: otherName, Pass: pass, UseChallenge: true},
+	}
+
+	c := &LocalClient{
+		ID:           1,
+		Catbox:       cb,
+		WriteChan:    make(chan TaggedMessage, 100),
+		PreRegCapabs: map[string]struct{}{},
+	}
+	cb.LocalClients[c.ID] = c
+	return c
+}
+
+// linked tells whether the client is still around, either linking or linked.
+func linked(c *LocalClient) bool {
+	if _, ok := c.Catbox.LocalClients[c.ID]; ok {
+		return true
+	}
+	_, ok := c.Catbox.LocalServers[c.ID]
+	return ok
+}
+
+// runChallengeLink links server 1 to server 2. It passes messages between
+// them until neither has anything to say. It returns what each sent.
+func runChallengeLink(c1, c2 *LocalClient) ([]string, []string) {
+	c1.sendServerIntro(c1.Catbox.Config.Servers[c2.Catbox.Config.ServerName])
+
+	var sent1, sent2 []string
+	for {
+		progress := false
+		for _, pair := range []struct {
+			from, to *LocalClient
+			sent     *[]string
+		}{{c1, c2, &sent1}, {c2, c1, &sent2}} {
+			for len(pair.from.WriteChan) > 0 {
+				m, ok := <-pair.from.WriteChan
+				if !ok {
+					break
+				}
+				progress = true
+
+				*pair.sent = append(*pair.sent,
+					m.Command+" "+strings.Join(m.Params, " "))
+
+				if !linked(pair.to) || !linked(pair.from) {
+					continue
+				}
+
+				if _, ok := pair.to.Catbox.LocalServers[pair.to.ID]; ok {
+					// Once linked, we don't need the rest.
+					continue
+				}
+				pair.to.handleMessage(m.Message)
+			}
+		}
+		if !progress {
+			return sent1, sent2
+		}
+	}
+}
+
+func TestRegistrationThrottle(t *testing.T) {
+	cb := newSnapshotCatbox()
+	cb.Config.MaxRegistrationsPerSecond = 2
+
+	var clients []*LocalClient
+	for i, nick := range []string{"alice", "bob", "carol", "dave"} {
+		c := &LocalClient{
+			ID:                uint64(i + 1),
+			Catbox:            cb,
+			Conn:              Conn{IP: net.ParseIP("192.168.0.1")},
+			WriteChan:         make(chan TaggedMessage, 100),
+			PreRegDisplayNick: nick,
+			PreRegUser:        "user",
+			PreRegRealName:    "real name",
+		}
+		cb.LocalClients[c.ID] = c
+		clients = append(clients, c)
+		c.registerUser()
+	}
+
+	registered := func() []bool {
+		var got []bool
+		for _, c := range clients {
+			_, exists := cb.LocalUsers[c.ID]
+			got = append(got, exists)
+		}
+		return got
+	}
+
+	if got := registered(); !got[0] || !got[1] || got[2] || got[3] {
+		t.Fatalf("registered = %v, wanted only the first two", got)
+	}
+	if !clients[2].RegistrationDeferred || !clients[3].RegistrationDeferred {
+		t.Errorf("did not defer the registrations")
+	}
+	if _, exists := cb.LocalClients[clients[2].ID]; !exists {
+		t.Errorf("deferred client is not a client any more")
+	}
+
+	// Still the same second. Nothing changes.
+	cb.completeDeferredRegistrations(cb.RegistrationWindowStart)
+	if got := registered(); got[2] || got[3] {
+		t.Errorf("registered = %v in the same second", got)
+	}
+
+	// The next second we register the deferred clients, up to the limit.
+	cb.Config.MaxRegistrationsPerSecond = 1
+	next := cb.RegistrationWindowStart.Add(time.Second)
+	cb.completeDeferredRegistrations(next)
+	if got := registered(); !got[2] || got[3] {
+		t.Errorf("registered = %v, wanted carol but not dave", got)
+	}
+	if clients[2].RegistrationDeferred {
+		t.Errorf("carol is still deferred")
+	}
+	if cb.RegistrationCount != 1 || !cb.RegistrationWindowStart.Equal(next) {
+		t.Errorf("window has count %d starting %s, wanted 1 starting %s",
+			cb.RegistrationCount, cb.RegistrationWindowStart, next)
+	}
+
+	cb.completeDeferredRegistrations(next.Add(time.Second))
+	if got := registered(); !got[3] {
+		t.Errorf("registered = %v, wanted dave", got)
+	}
+
+	// Without a limit we never defer.
+	cb.Config.MaxRegistrationsPerSecond = 0
+	if cb.registrationThrottled(cb.RegistrationWindowStart) {
+		t.Errorf("throttled without a limit")
+	}
+}
+
+// If someone takes a deferred client's nick, we tell the client once and stop
+// trying to register them.
+func TestDeferredRegistrationNickTaken(t *testing.T) {
+	cb := newSnapshotCatbox()
+	cb.Config.MaxRegistrationsPerSecond = 1
+	cb.RegistrationWindowStart = time.Now()
+	cb.RegistrationCount = 1
+
+	c := &LocalClient{
+		ID:                1,
+		Catbox:            cb,
+		Conn:              Conn{IP: net.ParseIP("192.168.0.1")},
+		WriteChan:         make(chan TaggedMessage, 100),
+		PreRegDisplayNick: "alice",
+		PreRegUser:        "user",
+		PreRegRealName:    "real name",
+	}
+	cb.LocalClients[c.ID] = c
+	c.registerUser()
+	if !c.RegistrationDeferred {
+		t.Fatalf("did not defer the registration")
+	}
+
+	cb.Nicks["alice"] = TS6UID("001AAAAAA")
+
+	next := cb.RegistrationWindowStart
+	for i := 0; i < 3; i++ {
+		next = next.Add(time.Second)
+		cb.completeDeferredRegistrations(next)
+	}
+
+	if _, exists := cb.LocalUsers[c.ID]; exists || c.RegistrationDeferred {
+		t.Fatalf("registered %v, deferred %v, wanted neither", exists,
+			c.RegistrationDeferred)
+	}
+
+	var got []string
+	for len(c.WriteChan) > 0 {
+		m := <-c.WriteChan
+		got = append(got, m.Command)
+	}
+	if len(got) != 1 || got[0] != "433" {
+		t.Errorf("client got %v, wanted one 433", got)
+	}
+}
+
+func TestChallengeLink(t *testing.T) {
+	tests := []struct {
+		name   string
+		pass1  string
+		pass2  string
+		linked bool
+	}{
+		{"same password", "secret", "secret", true},
+		{"different password", "secret", "guess", false},
+	}
+
+	for _, test := range tests {
+		c1 := newChallengeTestClient("irc1.example.com", "001", "irc2.example.com",
+			test.pass1)
+		c2 := newChallengeTestClient("irc2.example.com", "002", "irc1.example.com",
+			test.pass2)
+
+		sent1, sent2 := runChallengeLink(c1, c2)
+
+		for _, line := range append(sent1, sent2...) {
+			if strings.Contains(line, test.pass1) ||
+				strings.Contains(line, test.pass2) {
+				t.Errorf("%s: sent the password: %s", test.name, line)
+			}
+		}
+
+		_, linked1 := c1.Catbox.LocalServers[c1.ID]
+		_, linked2 := c2.Catbox.LocalServers[c2.ID]
+		if linked1 != test.linked || linked2 != test.linked {
+			t.Errorf("%s: linked = %v and %v, wanted %v", test.name, linked1,
+				linked2, test.linked)
+		}
+
+		if !test.linked {
+			last := sent1[len(sent1)-1]
+			if last != "ERROR Bad CHALLENGE answer" {
+				t.Errorf("%s: server 1 said %s, wanted a bad answer ERROR", test.name,
+					last)
+			}
+		}
+	}
+}
+
+// Someone pretending to be server 2 can't get server 1 to answer its own
+// nonce by sending it back on a second connection.
+func TestChallengeReflection(t *testing.T) {
+	c1 := newChallengeTestClient("irc1.example.com", "001", "irc2.example.com",
+		"secret")
+	cb := c1.Catbox
+
+	c2 := &LocalClient{
+		ID:           2,
+		Catbox:       cb,
+		WriteChan:    make(chan TaggedMessage, 100),
+		PreRegCapabs: map[string]struct{}{},
+	}
+	cb.LocalClients[c2.ID] = c2
+
+	// The attacker doesn't know the password, but anything will do to start.
+	attacker := newChallengeTestClient("irc2.example.com", "002",
+		"irc1.example.com", "guess")
+	attacker.sendServerIntro(attacker.Catbox.Config.Servers["irc1.example.com"])
+	var intro []irc.Message
+	for len(attacker.WriteChan) > 0 {
+		m := <-attacker.WriteChan
+		intro = append(intro, m.Message)
+	}
+
+	for _, m := range intro {
+		c1.handleMessage(m)
+	}
+
+	var nonce string
+	for len(c1.WriteChan) > 0 {
+		m := <-c1.WriteChan
+		if m.Command == "CHALLENGE" && len(m.Params) == 1 {
+			nonce = m.Params[0]
+		}
+	}
+	if nonce == "" {
+		t.Fatalf("server 1 did not send a nonce")
+	}
+
+	// Start over on the second connection, sending server 1's nonce.
+	for _, m := range intro {
+		if m.Command == "CHALLENGE" {
+			m.Params = []string{nonce}
+			c2.handleMessage(m)
+			break
+		}
+		c2.handleMessage(m)
+	}
+
+	if _, ok := cb.LocalClients[c2.ID]; ok {
+		t.Fatalf("second connection is still here")
+	}
+
+	var sent []string
+	for len(c2.WriteChan) > 0 {
+		m := <-c2.WriteChan
+		sent = append(sent, m.Command+" "+strings.Join(m.Params, " "))
+	}
+	if len(sent) == 0 || sent[len(sent)-1] != "ERROR Reflected CHALLENGE" {
+		t.Errorf("second connection got %v, wanted a reflected ERROR", sent)
+	}
+	for _, line := range sent {
+		if strings.HasPrefix(line, "CHALLENGE "+nonce+" ") {
+			t.Errorf("server 1 answered its own nonce: %s", line)
+		}
+	}
+}
+
+func TestChallengeCommand(t *testing.T) {
+	nonce := strings.Repeat("ab", ChallengeNonceLength)
+
+	tests := []struct {
+		name   string
+		setup  func(c *LocalClient)
+		params []string
+		quit   string
+	}{
+		{
+			"nonce before CAPAB",
+			func(c *LocalClient) {},
+			[]string{nonce},
+			"CAPAB first",
+		},
+		{
+			"malformed nonce",
+			func(c *LocalClient) { c.GotCAPAB = true },
+			[]string{"abcd"},
+			"Malformed CHALLENGE",
+		},
+		{
+			"double nonce",
+			func(c *LocalClient) { c.GotCAPAB = true; c.PreRegChallenge = nonce },
+			[]string{nonce},
+			"Double CHALLENGE",
+		},
+		{
+			"answer we didn't ask for",
+			func(c *LocalClient) { c.GotCAPAB = true; c.GotSERVER = true },
+			[]string{nonce, "abcd"},
+			"Unexpected CHALLENGE answer",
+		},
+		{
+			"answer to another nonce",
+			func(c *LocalClient) {
+				c.GotCAPAB = true
+				c.GotSERVER = true
+				c.PreRegServerName = "irc2.example.com"
+				c.PreRegUseChallenge = true
+				c.ChallengeNonce = strings.Repeat("cd", ChallengeNonceLength)
+			},
+			[]string{nonce, challengeAnswer(nonce, "secret", "irc2.example.com",
+				"irc1.example.com")},
+			"Bad CHALLENGE answer",
+		},
+		{
+			"our own answer reflected back",
+			func(c *LocalClient) {
+				c.GotCAPAB = true
+				c.GotSERVER = true
+				c.PreRegServerName = "irc2.example.com"
+				c.PreRegUseChallenge = true
+				c.ChallengeNonce = nonce
+			},
+			[]string{nonce, challengeAnswer(nonce, "secret", "irc1.example.com",
+				"irc2.example.com")},
+			"Bad CHALLENGE answer",
+		},
+		{
+			"our own nonce reflected back",
+			func(c *LocalClient) { c.GotCAPAB = true; c.ChallengeNonce = nonce },
+			[]string{nonce},
+			"Reflected CHALLENGE",
+		},
+		{
+			"nonce we sent on another link",
+			func(c *LocalClient) {
+				c.GotCAPAB = true
+				c.Catbox.LocalClients[2] = &LocalClient{ID: 2, ChallengeNonce: nonce}
+			},
+			[]string{nonce},
+			"Reflected CHALLENGE",
+		},
+		{
+			"good answer",
+			func(c *LocalClient) {
+				c.GotCAPAB = true
+				c.GotSERVER = true
+				c.PreRegServerName = "irc2.example.com"
+				c.PreRegUseChallenge = true
+				c.ChallengeNonce = nonce
+			},
+			[]string{nonce, challengeAnswer(nonce, "secret", "irc2.example.com",
+				"irc1.example.com")},
+			"",
+		},
+	}
+
+	for _, test := range tests {
+		c := newChallengeTestClient("irc1.example.com", "001", "irc2.example.com",
+			"secret")
+		test.setup(c)
+
+		c.challengeCommand(irc.Message{Command: "CHALLENGE", Params: test.params})
+
+		_, stillHere := c.Catbox.LocalClients[c.ID]
+		if test.quit == "" {
+			if !stillHere || !c.ChallengeVerified {
+				t.Errorf("%s: client quit or is not verified", test.name)
+			}
+			continue
+		}
+
+		if stillHere {
+			t.Errorf("%s: client did not quit", test.name)
+			continue
+		}
+
+		m := <-c.WriteChan
+		if m.Command != "ERROR" || m.Params[0] != test.quit {
+			t.Errorf("%s: sent %s %v, wanted ERROR %s", test.name, m.Command,
+				m.Params, test.quit)
+		}
+	}
+}
+
+func TestMaybeQueueMessageMaxSendQ(t *testing.T) {
+	c := &LocalClient{WriteChan: make(chan TaggedMessage, 10), MaxSendQ: 2}
+
+	c.maybeQueueMessage(irc.Message{Command: "PING"})
+	c.maybeQueueMessage(irc.Message{Command: "PING"})
+	if c.SendQueueExceeded {
+		t.Errorf("send queue exceeded before reaching max sendq")
+	}
+
+	c.maybeQueueMessage(irc.Message{Command: "PING"})
+	if !c.SendQueueExceeded {
+		t.Errorf("send queue not exceeded after passing max sendq")
+	}
+	if len(c.WriteChan) != 2 {
+		t.Errorf("queued %d messages, wanted 2", len(c.WriteChan))
+	}
+}
+
+// With no max sendq, the send queue is as big as WriteChan.
+func TestMaybeQueueMessageNoMaxSendQ(t *testing.T) {
+	c := &LocalClient{WriteChan: make(chan TaggedMessage, 2)}
+
+	c.maybeQueueMessage(irc.Message{Command: "PING"})
+	c.maybeQueueMessage(irc.Message{Command: "PING"})
+	if c.SendQueueExceeded {
+		t.Errorf("send queue exceeded before WriteChan filled")
+	}
+
+	c.maybeQueueMessage(irc.Message{Command: "PING"})
+	if !c.SendQueueExceeded {
+		t.Errorf("send queue not exceeded after WriteChan filled")
+	}
+}
+
+func TestEncodeWriteBatch(t *testing.T) {
+	longParam := strings.Repeat("a", 400)
+
+	// With long messages we stop when another might not fit.
+	longLength := len(":irc.example.com PRIVMSG #test :0 " + longParam + "\r\n")
+	longMessages := (WriteBatchBytes-irc.MaxLineLength)/longLength + 1
+
+	tests := []struct {
+		name        string
+		batchWrites bool
+		queued      int
+		param       string
+		closeChan   bool
+		messages    int
+		open        bool
+	}{
+		{"one message", true, 0, "hi", false, 1, true},
+		{"takes what is waiting", true, 9, "hi", false, 10, true},
+		{"message cap", true, 100, "hi", false, WriteBatchMessages, true},
+		{"byte cap", true, 100, longParam, false, longMessages, true},
+		{"disabled", false, 9, "hi", false, 1, true},
+		{"closed channel", true, 3, "hi", true, 4, false},
+	}
+
+	for _, test := range tests {
+		c := &LocalClient{
+			Catbox: &Catbox{
+				Config: &Config{BatchWrites: test.batchWrites},
+				Logger: newTestLogger(),
+			},
+			WriteChan: make(chan TaggedMessage, 200),
+		}
+
+		makeMessage := func(i int) TaggedMessage {
+			return TaggedMessage{Message: irc.Message{
+				Prefix:  "irc.example.com",
+				Command: "PRIVMSG",
+				Params:  []string{"#test", fmt.Sprintf("%d %s", i, test.param)},
+			}}
+		}
+
+		for i := 1; i <= test.queued; i++ {
+			c.WriteChan <- makeMessage(i)
+		}
+		if test.closeChan {
+			close(c.WriteChan)
+		}
+
+		buf := &bytes.Buffer{}
+		open, _ := c.encodeWriteBatch(buf, makeMessage(0))
+
+		if open != test.open {
+			t.Errorf("%s: encodeWriteBatch() = %v, wanted %v", test.name, open,
+				test.open)
+		}
+
+		if buf.Len() > WriteBatchBytes {
+			t.Errorf("%s: batch is %d bytes, more than %d", test.name, buf.Len(),
+				WriteBatchBytes)
+		}
+
+		lines := strings.SplitAfter(buf.String(), "\r\n")
+		lines = lines[:len(lines)-1]
+		if len(lines) != test.messages {
+			t.Errorf("%s: batch has %d messages, wanted %d", test.name, len(lines),
+				test.messages)
+			continue
+		}
+
+		// They must be in the order we queued them.
+		for i, line := range lines {
+			want, err := makeMessage(i).Encode()
+			if err != nil {
+				t.Fatalf("%s: unable to encode: %s", test.name, err)
+			}
+			if line != want {
+				t.Errorf("%s: message %d is %q, wanted %q", test.name, i, line, want)
+			}
+		}
+	}
+}
+
+func TestEncodeWriteBatchZIPSTART(t *testing.T) {
+	c := &LocalClient{
+		Catbox: &Catbox{
+			Config: &Config{BatchWrites: true},
+			Logger: newTestLogger(),
+		},
+		WriteChan: make(chan TaggedMessage, 10),
+	}
+
+	// What follows ZIPSTART must wait for the next batch, compressed.
+	c.WriteChan <- TaggedMessage{Message: irc.Message{Command: "ZIPSTART"}}
+	c.WriteChan <- TaggedMessage{Message: irc.Message{Command: "PING",
+		Params: []string{"000"}}}
+
+	buf := &bytes.Buffer{}
+	open, zipStart := c.encodeWriteBatch(buf,
+		TaggedMessage{Message: irc.Message{Command: "SVINFO",
+			Params: []string{"6", "6", "0", "1"}}})
+	if !open || !zipStart {
+		t.Errorf("encodeWriteBatch() = %v, %v, wanted true, true", open, zipStart)
+	}
+
+	if buf.String() != "SVINFO 6 6 0 1\r\nZIPSTART\r\n" {
+		t.Errorf("batch is %q, wanted SVINFO and ZIPSTART", buf.String())
+	}
+
+	if len(c.WriteChan) != 1 {
+		t.Errorf("%d messages left queued, wanted 1", len(c.WriteChan))
+	}
+}
+
+// countingConn counts calls to Write.
+type countingConn struct {
+	net.Conn
+	writes int64
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	atomic.AddInt64(&c.writes, 1)
+	return c.Conn.Write(b)
+}
+
+// BenchmarkWriteLoop measures writing 10,000 messages to a client. It reports
+// how many writes (system calls) that takes.
+func BenchmarkWriteLoop(b *testing.B) {
+	b.Run("batched", func(b *testing.B) {
+		benchmarkWriteLoop(b, true)
+	})
+	b.Run("unbatched", func(b *testing.B) {
+		benchmarkWriteLoop(b, false)
+	})
+}
+
+func benchmarkWriteLoop(b *testing.B, batchWrites bool) {
+	const messages = 10000
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("unable to listen: %s", err)
+	}
+	defer func() {
+		_ = ln.Close()
+	}()
+
+	message := TaggedMessage{Message: irc.Message{
+		Prefix:  "nick!user@example.com",
+		Command: "PRIVMSG",
+		Params:  []string{"#test", "hello there"},
+	}}
+	encoded, err := message.Encode()
+	if err != nil {
+		b.Fatalf("unable to encode: %s", err)
+	}
+
+	// The synthetic client reads everything we send.
+	read := make(chan struct{})
+	go func() {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			b.Errorf("unable to dial: %s", err)
+			return
+		}
+		defer func() {
+			_ = conn.Close()
+		}()
+
+		buf := make([]byte, 64*1024)
+		total := 0
+		for {
+			n, err := conn.Read(buf)
+			total += n
+			for total >= messages*len(encoded) {
+				read <- struct{}{}
+				total -= messages * len(encoded)
+			}
+			if err != nil {
+				close(read)
+				return
+			}
+		}
+	}()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		b.Fatalf("unable to accept: %s", err)
+	}
+	counter := &countingConn{Conn: conn}
+
+	cb := &Catbox{
+		Config:       &Config{DeadTime: time.Minute, BatchWrites: batchWrites},
+		ShutdownChan: make(chan struct{}),
+		Logger:       newTestLogger(),
+	}
+
+	c := NewLocalClient(cb, 1, counter)
+
+	cb.WG.Add(1)
+	go c.writeLoop()
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < messages; j++ {
+			c.WriteChan <- message
+		}
+		<-read
+	}
+
+	b.StopTimer()
+
+	b.ReportMetric(float64(atomic.LoadInt64(&counter.writes))/float64(b.N),
+		"writes/op")
+
+	close(c.WriteChan)
+	cb.WG.Wait()
+}
+
+// makeTestCertificate makes a self-signed certificate.
+func makeTestCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template,
+		&key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unable to create certificate: %s", err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestGetCertFP(t *testing.T) {
+	serverCert := makeTestCertificate(t)
+	clientCert := makeTestCertificate(t)
+
+	tests := []struct {
+		clientCerts []tls.Certificate
+		output      string
+	}{
+		{[]tls.Certificate{clientCert}, certFingerprint(clientCert.Certificate[0])},
+		{nil, ""},
+	}
+
+	for _, test := range tests {
+		server, client := tcpPair(t)
+
+		tlsServer := tls.Server(server, &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientAuth:   tls.RequestClientCert,
+		})
+		tlsClient := tls.Client(client, &tls.Config{
+			Certificates:       test.clientCerts,
+			InsecureSkipVerify: true,
+		})
+
+		done := make(chan struct{})
+		go func() {
+			_ = tlsClient.Handshake()
+			close(done)
+		}()
+
+		c := &LocalClient{Conn: NewConn(tlsServer, 5*time.Second,
+			newTestLogger())}
+
+		certFP, err := c.getCertFP()
+		<-done
+		_ = tlsServer.Close()
+		_ = tlsClient.Close()
+
+		if err != nil {
+			t.Errorf("getCertFP() = %s", err)
+			continue
+		}
+		if certFP != test.output {
+			t.Errorf("getCertFP() = %s, wanted %s", certFP, test.output)
+		}
+	}
+}
+
+func TestCertFingerprint(t *testing.T) {
+	// SHA-256 of "abc".
+	want := "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
+	if got := certFingerprint([]byte("abc")); got != want {
+		t.Errorf("certFingerprint() = %s, wanted %s", got, want)
+	}
+
+	if got := normalizeCertFP("BA:78:16:BF"); got != "ba7816bf" {
+		t.Errorf("normalizeCertFP() = %s, wanted ba7816bf", got)
+	}
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"strconv"
 	"strings"
 	"time"
@@ -26,6 +25,11 @@ type LocalServer struct {
 	GotPING  bool
 	GotPONG  bool
 	Bursting bool
+
+	// Users introduced during the burst whose hostname differs from their IP.
+	// We tell local users in their channels about the host once the burst
+	// completes. By then we know what channels they are in.
+	BurstHostChanges []TS6UID
 }
 
 // NewLocalServer upgrades a LocalClient to a LocalServer.
@@ -117,7 +121,16 @@ func (s *LocalServer) serverSplitCleanUp(lostServer *Server) {
 	// Include the one we're losing with its links.
 	lostServers = append(lostServers, lostServer)
 
+	// Quit message format is important. It tells that there was a netsplit,
+	// and between which two servers.
+	nearServerName := s.Catbox.Config.ServerName
+	if !lostServer.isLocal() {
+		nearServerName = lostServer.LinkedTo.Name
+	}
+	quitMessage := fmt.Sprintf("%s %s", nearServerName, lostServer.Name)
+
 	// Look for users we are losing.
+	lostUsers := []*User{}
 	for _, user := range s.Catbox.Users {
 		if user.isLocal() {
 			continue
@@ -125,42 +138,31 @@ func (s *LocalServer) serverSplitCleanUp(lostServer *Server) {
 
 		// Are we losing this user?
 		// We are if it is on a server we are losing.
-		keepingUser := true
 		for _, server := range lostServers {
 			if user.Server == server {
-				keepingUser = false
+				lostUsers = append(lostUsers, user)
 				break
 			}
 		}
+	}
 
-		if keepingUser {
-			continue
-		}
+	// Tell about the netsplit while we still know the users' channels.
+	s.Catbox.notifyNetsplit("Netsplit", nearServerName, lostServer.Name,
+		lostUsers)
 
-		log.Printf("Losing user %s", user)
+	for _, user := range lostUsers {
+		s.Catbox.Logger.Info("Losing user %s", user)
 
 		// This user is gone.
 
 		// Tell local users about them quitting.
 		// Remote users will be told by their own servers.
-
-		// Quit message format is important. It tells that there was a netsplit,
-		// and between which two servers.
-		var quitMessage string
-		if lostServer.isLocal() {
-			quitMessage = fmt.Sprintf("%s %s", s.Catbox.Config.ServerName,
-				lostServer.Name)
-		} else {
-			quitMessage = fmt.Sprintf("%s %s", lostServer.LinkedTo.Name,
-				lostServer.Name)
-		}
-
 		s.Catbox.quitRemoteUser(user, quitMessage)
 	}
 
 	// Forget all lost servers.
 	for _, server := range lostServers {
-		log.Printf("Losing server %s", server)
+		s.Catbox.Logger.Info("Losing server %s", server)
 		if server.isLocal() {
 			delete(s.Catbox.LocalServers, server.LocalServer.ID)
 		}
@@ -233,7 +235,7 @@ func (s *LocalServer) sendBurst() {
 	// :8ZZ UID will 1 1475024621 +i will blashyrkh. 0 8ZZAAAAAB :will
 	for _, user := range s.Catbox.Users {
 		var onServer TS6SID
-		if user.isLocal() {
+		if user.isLocal() || user.IsService {
 			onServer = s.Catbox.Config.TS6SID
 		} else {
 			onServer = user.Server.SID
@@ -255,6 +257,16 @@ func (s *LocalServer) sendBurst() {
 			},
 		})
 
+		s.sendMetadataBurst(string(onServer), string(user.UID), user.Metadata)
+
+		if user.Account != "" {
+			s.maybeQueueMessage(irc.Message{
+				Prefix:  string(s.Catbox.Config.TS6SID),
+				Command: "ENCAP",
+				Params:  []string{"*", "SU", string(user.UID), user.Account},
+			})
+		}
+
 		// Send AWAY if they are away.
 		if len(user.AwayMessage) == 0 {
 			continue
@@ -267,91 +279,172 @@ func (s *LocalServer) sendBurst() {
 	}
 
 	// Send channels and the users in them with SJOIN commands.
-	// Parameters: <channel TS> <channel name> <modes> [mode params] :<UIDs>
-	// e.g., :8ZZ SJOIN 1475187553 #test2 +sn :@8ZZAAAAAB
-	// Each UID may be prefixed with @ and/or + if voiced/opped.
-
 	for _, channel := range s.Catbox.Channels {
-		// We want to combine as many UIDs into a single SJOIN message as possible.
-
-		// First make a message with what is common to all messages so that we can
-		// determine the base length.
-		sjoinMessage := irc.Message{
-			Prefix:  string(s.Catbox.Config.TS6SID),
-			Command: "SJOIN",
-			Params: []string{
-				fmt.Sprintf("%d", channel.TS),
-				channel.Name,
-				// Currently we only support +ns.
-				"+ns",
-				// UIDs go in the last parameter. As it is blank, encoding will turn it
-				// into " :" for us. This is acceptable.
-				"",
-			},
-		}
-
-		// If encoding the prefix truncates then we have a big problem. We won't be
-		// able to include any UIDs. Killing the connection is perhaps extreme but
-		// we cannot fully synchronize in this case.
-		sjoinEncoded, err := sjoinMessage.Encode()
+		// If we can't build the SJOIN then we have a big problem. Killing the
+		// connection is perhaps extreme but we cannot fully synchronize in this
+		// case.
+		sjoinMessages, err := makeSJOINMessages(s.Catbox.Config.TS6SID, channel)
 		if err != nil {
 			s.quit(fmt.Sprintf("Unable to create SJOIN message: %s", err))
 			return
 		}
 
-		baseSize := len(sjoinEncoded)
-
-		uids := ""
-		for uid := range channel.Members {
-			member := s.Catbox.Users[uid]
-
-			uidStr := string(uid)
+		for _, sjoinMessage := range sjoinMessages {
+			s.maybeQueueMessage(sjoinMessage)
+		}
 
-			// Send with ops and/or voice prefix.
-			if channel.userHasOps(member) {
-				uidStr = "@" + uidStr
+		// SJOIN does not carry bans, ban exceptions, or quiets. Send them with
+		// TMODE. Only servers with EX know about ban exceptions, and only servers
+		// with QUIET know about quiets.
+		var masks []ModeChange
+		for _, ban := range channel.Bans {
+			masks = append(masks, ModeChange{Action: '+', Mode: 'b',
+				Param: ban.Mask})
+		}
+		if s.Server.hasCapability("EX") {
+			for _, exception := range channel.BanExceptions {
+				masks = append(masks, ModeChange{Action: '+', Mode: 'e',
+					Param: exception.Mask})
 			}
-
-			// Assume the first may fit.
-			if len(uids) == 0 {
-				uids += uidStr
-				continue
+		}
+		if s.Server.hasCapability("QUIET") {
+			for _, quiet := range channel.Quiets {
+				masks = append(masks, ModeChange{Action: '+', Mode: 'Q',
+					Param: quiet.Mask})
 			}
+		}
 
-			// If we'll exceed the max protocol message length, fire the message and
-			// start a new list.
-			// +1 to account for a space.
-			if baseSize+len(uids)+1+len(uidStr) > irc.MaxLineLength {
-				sjoinMessage.Params[3] = uids
-				s.maybeQueueMessage(sjoinMessage)
-				uids = "" + uidStr
-				continue
+		for i := 0; i < len(masks); i += ChanModesPerCommand {
+			end := i + ChanModesPerCommand
+			if end > len(masks) {
+				end = len(masks)
 			}
+			changes := masks[i:end]
 
-			// Add it to the list.
-			uids += " " + uidStr
-		}
+			params := []string{fmt.Sprintf("%d", channel.TS), channel.Name}
+			params = append(params, modeChangesToParams(changes, true)...)
 
-		if len(uids) > 0 {
-			sjoinMessage.Params[3] = uids
-			s.maybeQueueMessage(sjoinMessage)
+			s.maybeQueueMessage(irc.Message{
+				Prefix:  string(s.Catbox.Config.TS6SID),
+				Command: "TMODE",
+				Params:  params,
+			})
 		}
 
-		// If they support the TB capab then send them TB commands. This tells them
-		// the topic for each channel.
-		if s.Server.hasCapability("TB") && len(channel.Topic) > 0 {
+		// Tell them about pending invites so the invited users can join if the
+		// channel is +i.
+		for uid := range channel.Invites {
 			s.maybeQueueMessage(irc.Message{
 				Prefix:  string(s.Catbox.Config.TS6SID),
-				Command: "TB",
+				Command: "ENCAP",
 				Params: []string{
+					"*",
+					"INVITE",
+					string(uid),
 					channel.Name,
-					fmt.Sprintf("%d", channel.TopicTS),
-					channel.TopicSetter,
-					channel.Topic,
+					fmt.Sprintf("%d", channel.TS),
 				},
 			})
 		}
+
+		// If they support the TB capab then send them TB commands. This tells them
+		// the topic for each channel.
+		s.Catbox.sendTopicBurst(s, channel)
+
+		s.sendMetadataBurst(string(s.Catbox.Config.TS6SID), channel.Name,
+			channel.Metadata)
+	}
+}
+
+// makeSJOINMessages builds the SJOIN messages that tell a server about a
+// channel and its members.
+//
+// Parameters: <channel TS> <channel name> <modes> [mode params] :<UIDs>
+// e.g., :8ZZ SJOIN 1475187553 #test2 +snk key :@8ZZAAAAAB
+// Each UID may be prefixed with @ and/or + if voiced/opped, and ~ if they
+// are a channel owner.
+//
+// We want to combine as many UIDs into a single SJOIN message as possible.
+// When adding another would take us over the maximum line length, we start a
+// new message.
+func makeSJOINMessages(sid TS6SID, channel *Channel) ([]irc.Message,
+	error) {
+	// First make a message with what is common to all messages so that we can
+	// determine the base length.
+	baseParams := append([]string{
+		fmt.Sprintf("%d", channel.TS),
+		channel.Name,
+	}, channel.modesWithParams()...)
+
+	// UIDs go in the last parameter. As it is blank, encoding will turn it into
+	// " :" for us. This is acceptable.
+	sjoinEncoded, err := irc.Message{
+		Prefix:  string(sid),
+		Command: "SJOIN",
+		Params:  append(append([]string{}, baseParams...), ""),
+	}.Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	baseSize := len(sjoinEncoded)
+
+	var msgs []irc.Message
+
+	// Each message needs its own parameters. If we shared them then changing
+	// the UIDs of one would change those of the others.
+	addMessage := func(uids string) {
+		params := append([]string{}, baseParams...)
+		params = append(params, uids)
+		msgs = append(msgs, irc.Message{
+			Prefix:  string(sid),
+			Command: "SJOIN",
+			Params:  params,
+		})
+	}
+
+	uids := ""
+	for uid := range channel.Members {
+		uidStr := string(uid)
+
+		// Send with owner, ops, half-ops, and/or voice prefix.
+		if _, ok := channel.Voices[uid]; ok {
+			uidStr = "+" + uidStr
+		}
+		if _, ok := channel.HalfOps[uid]; ok {
+			uidStr = "%" + uidStr
+		}
+		if _, ok := channel.Ops[uid]; ok {
+			uidStr = "@" + uidStr
+		}
+		if _, ok := channel.Owners[uid]; ok {
+			uidStr = "~" + uidStr
+		}
+
+		// Assume the first may fit.
+		if len(uids) == 0 {
+			uids += uidStr
+			continue
+		}
+
+		// If we'll exceed the max protocol message length, finish the message and
+		// start a new list.
+		// +1 to account for a space.
+		if baseSize+len(uids)+1+len(uidStr) > irc.MaxLineLength {
+			addMessage(uids)
+			uids = uidStr
+			continue
+		}
+
+		// Add it to the list.
+		uids += " " + uidStr
+	}
+
+	if len(uids) > 0 {
+		addMessage(uids)
 	}
+
+	return msgs, nil
 }
 
 // Part a user from a channel.
@@ -409,6 +502,11 @@ func (s *LocalServer) handleMessage(m irc.Message) {
 		return
 	}
 
+	if m.Command == "ZIPSTART" {
+		s.zipstartCommand(m)
+		return
+	}
+
 	if m.Command == "UID" {
 		s.uidCommand(m)
 		return
@@ -449,6 +547,11 @@ func (s *LocalServer) handleMessage(m irc.Message) {
 		return
 	}
 
+	if m.Command == "KICK" {
+		s.kickCommand(m)
+		return
+	}
+
 	// ircd-ratbox sends OPERWALL between servers, like WALLOPS
 	if m.Command == "WALLOPS" || m.Command == "OPERWALL" {
 		s.wallopsCommand(m)
@@ -490,6 +593,11 @@ func (s *LocalServer) handleMessage(m irc.Message) {
 		return
 	}
 
+	if m.Command == "TRACE" {
+		s.traceCommand(m)
+		return
+	}
+
 	if isNumericCommand(m.Command) {
 		s.numericCommand(m)
 		return
@@ -572,8 +680,7 @@ func (s *LocalServer) pingCommand(m irc.Message) {
 		if s.Bursting && sourceSID == s.Server.SID {
 			s.GotPING = true
 			if s.GotPONG {
-				s.Bursting = false
-				s.Catbox.noticeOpers(fmt.Sprintf("Burst with %s over.", s.Server.Name))
+				s.endBurst()
 			}
 		}
 		return
@@ -628,8 +735,7 @@ func (s *LocalServer) pongCommand(m irc.Message) {
 		s.GotPONG = true
 
 		if s.Bursting && s.GotPING {
-			s.Catbox.noticeOpers(fmt.Sprintf("Burst with %s over.", s.Server.Name))
-			s.Bursting = false
+			s.endBurst()
 		}
 		return
 	}
@@ -649,6 +755,59 @@ func (s *LocalServer) pongCommand(m irc.Message) {
 	destinationServer.ClosestServer.maybeQueueMessage(m)
 }
 
+// endBurst marks the burst as over. This is when we have both received a
+// PING from the server and a PONG to ours.
+//
+// We now tell local users about the hosts of users introduced during the
+// burst.
+func (s *LocalServer) endBurst() {
+	s.Bursting = false
+	s.BurstLimiter.stop()
+	s.Catbox.noticeOpers(fmt.Sprintf("Burst with %s over.", s.Server.Name))
+
+	// Everyone on the other side of the link is here now.
+	servers := append(s.Server.getLinkedServers(s.Catbox.Servers), s.Server)
+	users := []*User{}
+	for _, user := range s.Catbox.Users {
+		for _, server := range servers {
+			if user.Server == server {
+				users = append(users, user)
+				break
+			}
+		}
+	}
+	s.Catbox.notifyNetsplit("Netjoin", s.Catbox.Config.ServerName,
+		s.Server.Name, users)
+
+	for _, uid := range s.BurstHostChanges {
+		// They may have quit or been killed since.
+		user, exists := s.Catbox.Users[uid]
+		if !exists {
+			continue
+		}
+		sendMessages(s.Catbox.chghostMessages(user, user.Username, user.IP))
+	}
+	s.BurstHostChanges = nil
+}
+
+// zipstartCommand means the server compresses everything it sends after this.
+// Our reader already switched to decompressing if we offered ZIP.
+//
+// ZIPSTART
+func (s *LocalServer) zipstartCommand(m irc.Message) {
+	if !s.zipNegotiated() {
+		s.quit("ZIPSTART without ZIP")
+		return
+	}
+}
+
+// compressionRatio tells how well we compress what we send the server. It's
+// the bytes before compressing divided by the bytes after. It's 0 if we don't
+// compress the link.
+func (s *LocalServer) compressionRatio() float64 {
+	return s.Conn.compressionRatio()
+}
+
 func (s *LocalServer) errorCommand(m irc.Message) {
 	if len(m.Params) != 1 {
 		s.quit(fmt.Sprintf("ERROR from %s with invalid number of parameters: %d",
@@ -700,8 +859,9 @@ func (s *LocalServer) uidCommand(m irc.Message) {
 		return
 	}
 
-	if !isValidNick(s.Catbox.Config.MaxNickLength, m.Params[0]) {
-		log.Printf("Invalid nick (%s)", m.Params[0])
+	if !isValidNick(s.Catbox.Config.MaxNickLength, s.Catbox.NickValidator,
+		m.Params[0]) {
+		s.Catbox.Logger.Warn("Invalid nick (%s)", m.Params[0])
 		s.quit(fmt.Sprintf("Invalid NICK! (%s)", m.Params[0]))
 		return
 	}
@@ -741,7 +901,8 @@ func (s *LocalServer) uidCommand(m irc.Message) {
 			continue
 		}
 
-		if umode == 'i' || umode == 'o' || umode == 'C' {
+		if umode == 'i' || umode == 'o' || umode == 'w' || umode == 'C' ||
+			umode == 'g' {
 			umodes[byte(umode)] = struct{}{}
 			continue
 		}
@@ -781,6 +942,12 @@ func (s *LocalServer) uidCommand(m irc.Message) {
 	s.Catbox.Nicks[canonicalizeNick(displayNick)] = u.UID
 	s.Catbox.Users[u.UID] = u
 
+	s.Catbox.notifyWatchers(u, true)
+
+	if s.Bursting && u.Hostname != u.IP {
+		s.BurstHostChanges = append(s.BurstHostChanges, u.UID)
+	}
+
 	// No reply needed I think.
 
 	// Tell our other servers.
@@ -852,15 +1019,36 @@ func (s *LocalServer) privmsgCommand(m irc.Message) {
 		s.quit(fmt.Sprintf("Unknown source (%s)", m.Command))
 	}
 
+	// A server mask. The sending server checked that the source may use one.
+	if len(m.Params[0]) > 0 && m.Params[0][0] == '$' {
+		if !s.Catbox.serverMaskMessage(source, m, s) {
+			s.Catbox.Logger.Warn("%s to server mask %s matches no server", m.Command,
+				m.Params[0])
+		}
+		return
+	}
+
 	// Is target a user?
 	if isValidUID(m.Params[0]) {
 		targetUID := TS6UID(m.Params[0])
 
 		targetUser, exists := s.Catbox.Users[targetUID]
 		if exists {
-			// We either deliver it to a local user, and done, or we need to propagate
-			// it to another server.
-			if targetUser.isLocal() {
+			// We either deliver it to a local user or one of our services, and done,
+			// or we need to propagate it to another server.
+			if targetUser.IsService {
+				if sourceUser, exists := s.Catbox.Users[TS6UID(m.Prefix)]; exists {
+					s.Catbox.serviceCommand(sourceUser, m)
+				}
+			} else if targetUser.isLocal() {
+				sourceUser, exists := s.Catbox.Users[TS6UID(m.Prefix)]
+				if exists && !targetUser.acceptsMessagesFrom(sourceUser) {
+					if m.Command == "PRIVMSG" {
+						s.Catbox.callerIDReject(sourceUser, targetUser)
+					}
+					return
+				}
+
 				// Source and target were UIDs. Translate to uhost and nick
 				// respectively.
 				m.Params[0] = targetUser.DisplayNick
@@ -884,10 +1072,17 @@ func (s *LocalServer) privmsgCommand(m irc.Message) {
 
 	channel, exists := s.Catbox.Channels[canonicalizeChannel(m.Params[0])]
 	if !exists {
-		log.Printf("PRIVMSG to unknown target %s", m.Params[0])
+		s.Catbox.Logger.Warn("PRIVMSG to unknown target %s", m.Params[0])
 		return
 	}
 
+	// We pass on the message as we got it. Each server strips colors for its
+	// own users.
+	text := m.Params[1]
+	if channel.stripsColors() {
+		text = stripColors(text)
+	}
+
 	// Inform all members of the channel.
 	// Message local users directly.
 	// If a user is remote, then we record the server to send the message towards.
@@ -899,11 +1094,16 @@ func (s *LocalServer) privmsgCommand(m irc.Message) {
 			member.LocalUser.maybeQueueMessage(irc.Message{
 				Prefix:  source,
 				Command: m.Command,
-				Params:  m.Params,
+				Params:  []string{m.Params[0], text},
 			})
 			continue
 		}
 
+		// Services have no server to propagate to.
+		if member.IsService {
+			continue
+		}
+
 		// Remote user. We need to propagate it towards them.
 		if member.ClosestServer != s {
 			toServers[member.ClosestServer] = struct{}{}
@@ -914,6 +1114,13 @@ func (s *LocalServer) privmsgCommand(m irc.Message) {
 	for server := range toServers {
 		server.maybeQueueMessage(m)
 	}
+
+	channel.addHistory(&HistoryEntry{
+		Time:    time.Now(),
+		Prefix:  source,
+		Command: m.Command,
+		Params:  []string{channel.Name, text},
+	}, s.Catbox.Config.HistorySize)
 }
 
 // SID tells us about a new server.
@@ -1031,9 +1238,6 @@ func (s *LocalServer) sjoinCommand(m irc.Message) {
 		return
 	}
 
-	// Currently I ignore modes. All channels have the same mode, or we pretend so
-	// anyway.
-
 	channel, channelExists := s.Catbox.Channels[canonicalizeChannel(chanName)]
 	if !channelExists {
 		channel = &Channel{
@@ -1078,29 +1282,16 @@ func (s *LocalServer) sjoinCommand(m irc.Message) {
 		channel.clearModes(s.Catbox)
 	}
 
-	modes := m.Params[2]
-
-	// Apply the simple (+ntski type) modes now.
 	if acceptModes {
-		modeStr := ""
-		for _, mode := range modes {
-			if mode != 'n' && mode != 's' {
-				continue
-			}
-
-			if _, ok := channel.Modes[byte(mode)]; ok {
-				continue
-			}
+		changes := s.applySJOINModes(channel, m.Params[2],
+			m.Params[3:len(m.Params)-1], sourceServer.Name, !clearModes)
 
-			channel.Modes[byte(mode)] = struct{}{}
-			modeStr += string(mode)
-		}
-
-		if len(modeStr) > 0 {
+		if len(changes) > 0 {
 			s.Catbox.messageLocalUsersOnChannel(channel, irc.Message{
 				Prefix:  sourceServer.Name,
 				Command: "MODE",
-				Params:  []string{channel.Name, "+" + modeStr},
+				Params: append([]string{channel.Name},
+					modeChangesToParams(changes, false)...),
 			})
 		}
 	}
@@ -1112,30 +1303,28 @@ func (s *LocalServer) sjoinCommand(m irc.Message) {
 	// Look at each of the members we were told about.
 	uidsRaw := strings.Split(userList, " ")
 	for _, uidRaw := range uidsRaw {
-		// May have op/voice prefix.
+		// May have owner/op/half-op/voice prefix.
+		owner := false
 		opped := false
-		//voiced := false
+		halfOpped := false
+		voiced := false
 
+		prefix := uidRaw[:len(uidRaw)-len(strings.TrimLeft(uidRaw, "~@%+"))]
 		if acceptModes {
-			if uidRaw[0] == '@' {
-				opped = true
-				//if uidRaw[1] == '+' {
-				//	voiced = true
-				//}
-			}
-			//if uidRaw[0] == '+' {
-			//	voiced = true
-			//}
+			owner = strings.Contains(prefix, "~")
+			opped = strings.Contains(prefix, "@")
+			halfOpped = strings.Contains(prefix, "%")
+			voiced = strings.Contains(prefix, "+")
 		}
 
 		// Done with prefix.
-		uidRaw = strings.TrimLeft(uidRaw, "@+")
+		uidRaw = strings.TrimLeft(uidRaw, "~@%+")
 
 		user, exists := s.Catbox.Users[TS6UID(uidRaw)]
 		if !exists {
 			// We may not know the user in case of nick collision where we killed.
 			// them and forgot them. Allow this.
-			log.Printf("SJOIN for unknown user %s, ignoring", uidRaw)
+			s.Catbox.Logger.Warn("SJOIN for unknown user %s, ignoring", uidRaw)
 			if !channelExists {
 				delete(s.Catbox.Channels, channel.Name)
 			}
@@ -1144,13 +1333,23 @@ func (s *LocalServer) sjoinCommand(m irc.Message) {
 
 		// We could check if we already have them flagged as in the channel.
 
-		// Flag them as being in the channel.
+		// Flag them as being in the channel. They no longer need an invite.
 		channel.Members[user.UID] = struct{}{}
 		user.Channels[channel.Name] = channel
+		channel.removeInvite(user)
 
 		if opped {
 			channel.grantOps(user)
 		}
+		if halfOpped {
+			channel.grantHalfOp(user)
+		}
+		if voiced {
+			channel.grantVoice(user)
+		}
+		if owner {
+			channel.grantOwner(user)
+		}
 
 		// Tell our local users who are in the channel.
 		for memberUID := range channel.Members {
@@ -1172,6 +1371,27 @@ func (s *LocalServer) sjoinCommand(m irc.Message) {
 					Params:  []string{channel.Name, "+o", user.DisplayNick},
 				})
 			}
+			if halfOpped {
+				member.LocalUser.maybeQueueMessage(irc.Message{
+					Prefix:  sourceServer.Name,
+					Command: "MODE",
+					Params:  []string{channel.Name, "+h", user.DisplayNick},
+				})
+			}
+			if voiced {
+				member.LocalUser.maybeQueueMessage(irc.Message{
+					Prefix:  sourceServer.Name,
+					Command: "MODE",
+					Params:  []string{channel.Name, "+v", user.DisplayNick},
+				})
+			}
+			if owner {
+				member.LocalUser.maybeQueueMessage(irc.Message{
+					Prefix:  sourceServer.Name,
+					Command: "MODE",
+					Params:  []string{channel.Name, "+q", user.DisplayNick},
+				})
+			}
 		}
 	}
 
@@ -1186,6 +1406,63 @@ func (s *LocalServer) sjoinCommand(m irc.Message) {
 	}
 }
 
+// applySJOINModes applies the modes from an SJOIN to the channel and returns
+// the changes.
+//
+// Parameters for +k and +l come after the modes, in the same order.
+//
+// If merge is true, both sides have the same TS and we keep modes we have
+// that they don't. In that case, as in TS6, the greater key and the higher
+// limit win.
+func (s *LocalServer) applySJOINModes(channel *Channel, modes string,
+	params []string, setter string, merge bool) []ModeChange {
+	var changes []ModeChange
+
+	// Modes applyModes handles and their parameters.
+	applyStr := "+"
+	var applyParams []string
+
+	paramIndex := 0
+	for i := 0; i < len(modes); i++ {
+		mode := modes[i]
+
+		switch mode {
+		case 'n', 's':
+			if _, ok := channel.Modes[mode]; ok {
+				continue
+			}
+			channel.Modes[mode] = struct{}{}
+			changes = append(changes, ModeChange{Action: '+', Mode: mode})
+		case 'c', 'i', 'p':
+			applyStr += string(mode)
+		case 'k', 'l':
+			if paramIndex >= len(params) {
+				s.Catbox.Logger.Warn("SJOIN for %s is missing a parameter for %c",
+					channel.Name, mode)
+				continue
+			}
+			param := params[paramIndex]
+			paramIndex++
+
+			if merge && mode == 'k' && channel.Key != "" && param <= channel.Key {
+				continue
+			}
+			if merge && mode == 'l' && channel.Limit > 0 {
+				if limit, err := strconv.Atoi(param); err != nil ||
+					limit <= channel.Limit {
+					continue
+				}
+			}
+
+			applyStr += string(mode)
+			applyParams = append(applyParams, param)
+		}
+	}
+
+	return append(changes, channel.applyModes(applyStr, applyParams, nil,
+		setter, 0)...)
+}
+
 // We receive TB commands during burst if the other side supports the TB
 // capability. They tell us about the topic of a channel.
 //
@@ -1235,9 +1512,7 @@ func (s *LocalServer) tbCommand(m irc.Message) {
 	} else {
 		topic = m.Params[2]
 	}
-	if len(topic) > maxTopicLength {
-		topic = topic[:maxTopicLength]
-	}
+	topic = truncateText(topic, maxTopicLength)
 
 	// If the topic matches what we have, nothing to do.
 	if topic == channel.Topic {
@@ -1268,6 +1543,7 @@ func (s *LocalServer) tbCommand(m irc.Message) {
 	channel.Topic = topic
 	channel.TopicSetter = setter
 	channel.TopicTS = topicTS
+	s.Catbox.rememberTopic(channel)
 
 	// Tell our local clients about the topic change.
 	for memberUID := range channel.Members {
@@ -1376,9 +1652,10 @@ func (s *LocalServer) joinCommand(m irc.Message) {
 		channel.TS = channelTS
 	}
 
-	// Put the user in it.
+	// Put the user in it. They no longer need an invite.
 	channel.Members[user.UID] = struct{}{}
 	user.Channels[channel.Name] = channel
+	channel.removeInvite(user)
 
 	// Tell our local users who are in the channel about the new member.
 	msg := irc.Message{
@@ -1423,7 +1700,8 @@ func (s *LocalServer) nickCommand(m irc.Message) {
 		return
 	}
 
-	if !isValidNick(s.Catbox.Config.MaxNickLength, nick) {
+	if !isValidNick(s.Catbox.Config.MaxNickLength, s.Catbox.NickValidator,
+		nick) {
 		s.quit("Invalid nick (NICK)")
 		return
 	}
@@ -1468,13 +1746,28 @@ func (s *LocalServer) nickCommand(m irc.Message) {
 	}
 
 	// Update our records, their nick, and their nick TS.
+	//
+	// Only remove the old nick if it still refers to this user. Otherwise we'd
+	// drop another user's nick.
 
-	delete(s.Catbox.Nicks, canonicalizeNick(user.DisplayNick))
+	oldNickCanon := canonicalizeNick(user.DisplayNick)
+	if uid, exists := s.Catbox.Nicks[oldNickCanon]; exists && uid == user.UID {
+		delete(s.Catbox.Nicks, oldNickCanon)
+	}
 	s.Catbox.Nicks[canonicalizeNick(nick)] = user.UID
 
+	nickChanged := oldNickCanon != canonicalizeNick(nick)
+	if nickChanged {
+		s.Catbox.notifyWatchers(user, false)
+	}
+
 	user.DisplayNick = nick
 	user.NickTS = nickTS
 
+	if nickChanged {
+		s.Catbox.notifyWatchers(user, true)
+	}
+
 	// Propagate to other servers.
 	for _, server := range s.Catbox.LocalServers {
 		if server == s {
@@ -1529,6 +1822,77 @@ func (s *LocalServer) partCommand(m irc.Message) {
 	}
 }
 
+// kickCommand handles a KICK from a server. A user (or a server, such as
+// services) removed users from a channel.
+//
+// TS6 servers send one UID per KICK, but we accept several separated by
+// commas. We send each on as its own KICK.
+func (s *LocalServer) kickCommand(m irc.Message) {
+	// Params: <channel> <UID>[,<UID>...] [reason]
+	if len(m.Params) < 2 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"KICK", "Not enough parameters"})
+		return
+	}
+
+	// The source may be a user or a server.
+	source := ""
+	if user, exists := s.Catbox.Users[TS6UID(m.Prefix)]; exists {
+		source = user.nickUhost()
+	} else if server, exists := s.Catbox.Servers[TS6SID(m.Prefix)]; exists {
+		source = server.Name
+	} else {
+		s.quit("Unknown source (KICK)")
+		return
+	}
+
+	channel, exists := s.Catbox.Channels[canonicalizeChannel(m.Params[0])]
+	if !exists {
+		s.Catbox.Logger.Warn("KICK for unknown channel %s", m.Params[0])
+		return
+	}
+
+	reason := ""
+	if len(m.Params) > 2 {
+		reason = m.Params[2]
+	}
+
+	for _, uid := range strings.Split(m.Params[1], ",") {
+		if uid == "" {
+			continue
+		}
+
+		target, exists := s.Catbox.Users[TS6UID(uid)]
+		if !exists {
+			s.Catbox.Logger.Warn("KICK for unknown user %s", uid)
+			continue
+		}
+
+		// They may have left already, e.g. if they parted at the same time.
+		if !target.onChannel(channel) {
+			continue
+		}
+
+		s.Catbox.kickUser(source, channel, target, reason)
+
+		// Propagate to all other servers.
+		params := []string{m.Params[0], uid}
+		if len(m.Params) > 2 {
+			params = append(params, reason)
+		}
+		for _, server := range s.Catbox.LocalServers {
+			if server == s {
+				continue
+			}
+			server.maybeQueueMessage(irc.Message{
+				Prefix:  m.Prefix,
+				Command: "KICK",
+				Params:  params,
+			})
+		}
+	}
+}
+
 func (s *LocalServer) wallopsCommand(m irc.Message) {
 	// Params: <text to send>
 	if len(m.Params) < 1 {
@@ -1564,17 +1928,8 @@ func (s *LocalServer) wallopsCommand(m irc.Message) {
 		return
 	}
 
-	// Send WALLOPS to all our local opers.
-	for _, oper := range s.Catbox.Opers {
-		if !oper.isLocal() {
-			continue
-		}
-		oper.LocalUser.maybeQueueMessage(irc.Message{
-			Prefix:  origin,
-			Command: "WALLOPS",
-			Params:  []string{text},
-		})
-	}
+	// Send WALLOPS to our local users who want it.
+	sendMessages(s.Catbox.wallopsMessages(origin, text))
 
 	// Propagate to other servers.
 	for _, ls := range s.Catbox.LocalServers {
@@ -1648,7 +2003,7 @@ func (s *LocalServer) modeCommand(m irc.Message) {
 			continue
 		}
 
-		if c == 'i' || c == 'o' || c == 'C' {
+		if c == 'i' || c == 'o' || c == 'w' || c == 'C' || c == 'g' {
 			if motion == '+' {
 				user.Modes[byte(c)] = struct{}{}
 				if c == 'o' {
@@ -1708,9 +2063,7 @@ func (s *LocalServer) topicCommand(m irc.Message) {
 	if len(m.Params) >= 2 {
 		topic = m.Params[1]
 	}
-	if len(topic) > maxTopicLength {
-		topic = topic[:maxTopicLength]
-	}
+	topic = truncateText(topic, maxTopicLength)
 
 	// We could check the source user has ops.
 
@@ -1721,6 +2074,7 @@ func (s *LocalServer) topicCommand(m irc.Message) {
 	channel.Topic = topic
 	channel.TopicTS = time.Now().Unix()
 	channel.TopicSetter = sourceUser.nickUhost()
+	s.Catbox.rememberTopic(channel)
 
 	// Tell local clients who are in the channel about the topic change.
 
@@ -1850,11 +2204,13 @@ func (s *LocalServer) killCommand(m irc.Message) {
 	// record its name.
 
 	source := ""
+	sourcePrefix := ""
 
 	// Is the prefix a user?
 	sourceUser, exists := s.Catbox.Users[TS6UID(m.Prefix)]
 	if exists {
 		source = sourceUser.DisplayNick
+		sourcePrefix = sourceUser.nickUhost()
 	}
 
 	// If not, is it a server?
@@ -1862,6 +2218,7 @@ func (s *LocalServer) killCommand(m irc.Message) {
 		sourceServer, exists := s.Catbox.Servers[TS6SID(m.Prefix)]
 		if exists {
 			source = sourceServer.Name
+			sourcePrefix = sourceServer.Name
 		}
 	}
 
@@ -1913,7 +2270,7 @@ func (s *LocalServer) killCommand(m irc.Message) {
 	if targetUser.isLocal() {
 		s.Catbox.noticeOpers(fmt.Sprintf("Killing local user %s",
 			targetUser.DisplayNick))
-		targetUser.LocalUser.quit(quitReason, false)
+		targetUser.LocalUser.killed(sourcePrefix, source, reason)
 	}
 
 	// If it's remote, we need to forget about this user.
@@ -1948,11 +2305,11 @@ func (s *LocalServer) killCommand(m irc.Message) {
 // [params for the subcommand]
 //
 // Destination can be a mask. For servers it may be a wildcard. For clients
-// apparently not.
+// apparently not. It may also be a SID.
 //
-// Currently I will assume destination mask is always *.
-//
-// If the encapsulated command is one I know about, operate on it locally.
+// If the destination includes us and the encapsulated command is one I know
+// about, operate on it locally. We pass it on only toward servers the
+// destination matches.
 func (s *LocalServer) encapCommand(m irc.Message) {
 	if len(m.Params) < 2 {
 		// 461 ERR_NEEDMOREPARAMS
@@ -1960,8 +2317,6 @@ func (s *LocalServer) encapCommand(m irc.Message) {
 		return
 	}
 
-	// I don't look at destination right now. Assume it's for this server too.
-
 	// Extract the sub command and its parameters.
 	subCommand := strings.ToUpper(m.Params[1])
 	subParams := []string{}
@@ -1969,49 +2324,109 @@ func (s *LocalServer) encapCommand(m irc.Message) {
 		subParams = append(subParams, m.Params[2:]...)
 	}
 
-	// Do we want to do something with the encapsulated command?
-	if subCommand == "KLINE" {
-		s.klineCommand(irc.Message{
-			Prefix:  m.Prefix,
-			Command: subCommand,
-			Params:  subParams,
-		})
-	}
-	if subCommand == "UNKLINE" {
-		s.unklineCommand(irc.Message{
-			Prefix:  m.Prefix,
-			Command: subCommand,
-			Params:  subParams,
-		})
+	// A SID destination must be a server we know. Tell whoever sent it.
+	dest := m.Params[0]
+	if isValidSID(dest) && TS6SID(dest) != s.Catbox.Config.TS6SID {
+		if _, exists := s.Catbox.Servers[TS6SID(dest)]; !exists {
+			if m.Prefix == "" {
+				s.Catbox.Logger.Warn("ENCAP to unknown server %s with no source", dest)
+				return
+			}
+			// 402 ERR_NOSUCHSERVER
+			s.maybeQueueMessage(irc.Message{
+				Prefix:  string(s.Catbox.Config.TS6SID),
+				Command: "402",
+				Params:  []string{m.Prefix, dest, "No such server"},
+			})
+			return
+		}
 	}
-	if subCommand == "GCAP" {
-		s.gcapCommand(irc.Message{
+
+	// Act on it only if we're one of the servers it is for.
+	if s.Catbox.encapForUs(dest) {
+		s.encapSubCommand(irc.Message{
 			Prefix:  m.Prefix,
 			Command: subCommand,
 			Params:  subParams,
 		})
 	}
 
-	// Propagate everywhere.
-	for _, server := range s.Catbox.LocalServers {
-		if server == s {
-			continue
-		}
+	// Pass it on toward the other servers it is for.
+	for _, server := range s.Catbox.encapRoutes(dest, s) {
 		server.maybeQueueMessage(m)
 	}
 }
 
-// The KLINE command comes only in ENCAP messages.
-//
-// Apply a ban on user@host.
-//
-// Currently this is persistent only for the runtime.
-//
-// Parameters: <duration> <user mask> <host mask> [<reason>]
-// Example (with ENCAP portion dropped):
-// :1SNAAAAAF KLINE 0 * 127.5.5.5 :bye bye
-//
-// At this time we treat all KLINEs as "permanent" for the duration of our run.
+// encapSubCommand runs an encapsulated command we know about. The ENCAP
+// portion is already dropped.
+func (s *LocalServer) encapSubCommand(m irc.Message) {
+	if m.Command == "KLINE" {
+		s.klineCommand(m)
+	}
+	if m.Command == "UNKLINE" {
+		s.unklineCommand(m)
+	}
+	if m.Command == "XLINE" {
+		s.xlineCommand(m)
+	}
+	if m.Command == "UNXLINE" {
+		s.unxlineCommand(m)
+	}
+	if m.Command == "DLINE" {
+		s.dlineCommand(m)
+	}
+	if m.Command == "UNDLINE" {
+		s.undlineCommand(m)
+	}
+	if m.Command == "GLINE" {
+		s.glineCommand(m)
+	}
+	if m.Command == "UNGLINE" {
+		s.unglineCommand(m)
+	}
+	if m.Command == "GCAP" {
+		s.gcapCommand(m)
+	}
+	if m.Command == "INVITE" {
+		s.encapInviteCommand(m)
+	}
+	if m.Command == "GNOTICE" {
+		s.gnoticeCommand(m)
+	}
+	if m.Command == "SVSNICK" {
+		s.svsnickCommand(m)
+	}
+	if m.Command == "SVSJOIN" {
+		s.svsjoinCommand(m)
+	}
+	if m.Command == "SVSPART" {
+		s.svspartCommand(m)
+	}
+	if m.Command == "METADATA" {
+		s.metadataCommand(m)
+	}
+	if m.Command == "SU" {
+		s.suCommand(m)
+	}
+	if m.Command == "CONNECT" {
+		s.connectCommand(m)
+	}
+	if m.Command == "REHASH" {
+		s.rehashCommand(m)
+	}
+}
+
+// The KLINE command comes only in ENCAP messages.
+//
+// Apply a ban on user@host.
+//
+// Currently this is persistent only for the runtime.
+//
+// Parameters: <duration> <user mask> <host mask> [<reason>]
+// Example (with ENCAP portion dropped):
+// :1SNAAAAAF KLINE 0 * 127.5.5.5 :bye bye
+//
+// At this time we treat all KLINEs as "permanent" for the duration of our run.
 // i.e., we ignore duration.
 func (s *LocalServer) klineCommand(m irc.Message) {
 	if len(m.Params) < 3 {
@@ -2033,7 +2448,7 @@ func (s *LocalServer) klineCommand(m irc.Message) {
 		}
 	}
 	if source == "" {
-		log.Printf("Unknown source for KLINE command")
+		s.Catbox.Logger.Warn("Unknown source for KLINE command")
 		return
 	}
 
@@ -2050,6 +2465,13 @@ func (s *LocalServer) klineCommand(m irc.Message) {
 		Reason:   reason,
 	}
 
+	// Other servers may not check this. Refuse to cut off everyone here anyway.
+	if isKLineTooBroad(kline.UserMask, kline.HostMask) {
+		s.Catbox.noticeOpers(fmt.Sprintf("Ignoring too broad K-Line for [%s@%s] from %s",
+			kline.UserMask, kline.HostMask, source))
+		return
+	}
+
 	s.Catbox.addAndApplyKLine(kline, source, reason)
 
 	// We don't need to propagate. Since KLINE comes in through an ENCAP command,
@@ -2077,7 +2499,7 @@ func (s *LocalServer) unklineCommand(m irc.Message) {
 		}
 	}
 	if source == "" {
-		log.Printf("Unknown source for UNKLINE command")
+		s.Catbox.Logger.Warn("Unknown source for UNKLINE command")
 		return
 	}
 
@@ -2090,6 +2512,284 @@ func (s *LocalServer) unklineCommand(m irc.Message) {
 	// We don't need to propagate as UNKLINE comes inside ENCAP.
 }
 
+// The REHASH command comes only in ENCAP messages. An oper on another server
+// asked for us to rehash.
+//
+// Parameters: [motd | opers | servers | all]
+// Example (with ENCAP portion dropped):
+// :1SNAAAAAF REHASH motd
+func (s *LocalServer) rehashCommand(m irc.Message) {
+	user, exists := s.Catbox.Users[TS6UID(m.Prefix)]
+	if !exists {
+		s.Catbox.Logger.Warn("Unknown source for REHASH command")
+		return
+	}
+
+	if !user.isOperator() {
+		s.Catbox.noticeOpers(fmt.Sprintf(
+			"Ignoring REHASH from %s who is not an operator", user.DisplayNick))
+		return
+	}
+
+	what := RehashAll
+	if len(m.Params) > 0 {
+		what = strings.ToLower(m.Params[0])
+		if _, ok := RehashTargets[what]; !ok {
+			s.Catbox.noticeOpers(fmt.Sprintf("Unknown REHASH option from %s: %s",
+				user.DisplayNick, m.Params[0]))
+			return
+		}
+	}
+
+	s.Catbox.rehash(user, what)
+
+	// We don't need to propagate as REHASH comes inside ENCAP.
+}
+
+// CONNECT comes only in ENCAP messages. An oper on another server asked us to
+// link to a server.
+//
+// Parameters: <server name> [<port>]
+//
+// A port of 0 means the port from our config.
+func (s *LocalServer) connectCommand(m irc.Message) {
+	if len(m.Params) < 1 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"CONNECT", "Not enough parameters"})
+		return
+	}
+
+	user, exists := s.Catbox.Users[TS6UID(m.Prefix)]
+	if !exists {
+		s.Catbox.Logger.Warn("Unknown source for CONNECT command")
+		return
+	}
+
+	if !user.isOperator() {
+		s.Catbox.noticeOpers(fmt.Sprintf(
+			"Ignoring CONNECT from %s who is not an operator", user.DisplayNick))
+		return
+	}
+
+	serverName := m.Params[0]
+
+	port := 0
+	if len(m.Params) > 1 {
+		p, err := strconv.Atoi(m.Params[1])
+		if err != nil || p < 0 || p > 65535 {
+			s.Catbox.noticeOpers(fmt.Sprintf("Invalid CONNECT port from %s: %s",
+				user.DisplayNick, m.Params[1]))
+			return
+		}
+		port = p
+	}
+
+	s.Catbox.noticeLocalOpers(fmt.Sprintf("Remote CONNECT %s %d from %s",
+		serverName, port, user.DisplayNick))
+
+	linkInfo, exists := s.Catbox.Config.Servers[serverName]
+	if !exists {
+		s.Catbox.noticeOpers(fmt.Sprintf(
+			"Ignoring CONNECT from %s: No such server: %s", user.DisplayNick,
+			serverName))
+		return
+	}
+
+	if s.Catbox.isLinkedToServer(serverName) {
+		s.Catbox.noticeOpers(fmt.Sprintf(
+			"Ignoring CONNECT from %s: Already linked to %s", user.DisplayNick,
+			serverName))
+		return
+	}
+
+	s.Catbox.connectToServer(linkInfoWithPort(linkInfo, port))
+
+	// We don't need to propagate as CONNECT comes inside ENCAP.
+}
+
+// GNOTICE comes only in ENCAP messages. An operator is sending a notice to
+// every user on the network. We tell our local users.
+//
+// Parameters: <text>
+func (s *LocalServer) gnoticeCommand(m irc.Message) {
+	if len(m.Params) == 0 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"GNOTICE", "Not enough parameters"})
+		return
+	}
+
+	sourceUser, exists := s.Catbox.Users[TS6UID(m.Prefix)]
+	if !exists {
+		s.Catbox.Logger.Warn("GNOTICE from unknown user %s", m.Prefix)
+		return
+	}
+
+	sendMessages(s.Catbox.globalNoticeMessages(sourceUser, m.Params[0]))
+}
+
+// SVSNICK comes only in ENCAP messages. Services are forcing a user to change
+// their nick.
+//
+// We act only if the user is ours. The ENCAP reaches every server, so their
+// server will act if they're not.
+//
+// The user's nick change propagates as a NICK.
+//
+// Parameters: <UID> <new nick> [new nick TS]
+func (s *LocalServer) svsnickCommand(m irc.Message) {
+	if len(m.Params) < 2 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"SVSNICK", "Not enough parameters"})
+		return
+	}
+
+	user, exists := s.Catbox.Users[TS6UID(m.Params[0])]
+	if !exists {
+		s.Catbox.Logger.Warn("SVSNICK for unknown user %s", m.Params[0])
+		return
+	}
+	if !user.isLocal() {
+		return
+	}
+
+	nick := m.Params[1]
+	if !isValidNick(s.Catbox.Config.MaxNickLength, s.Catbox.NickValidator,
+		nick) {
+		s.Catbox.noticeLocalOpers(fmt.Sprintf(
+			"Ignoring SVSNICK for %s to invalid nick %s", user.DisplayNick, nick))
+		return
+	}
+
+	if nick == user.DisplayNick {
+		return
+	}
+
+	nickTS := time.Now().Unix()
+	if len(m.Params) > 2 {
+		ts, err := strconv.ParseInt(m.Params[2], 10, 64)
+		if err != nil || ts <= 0 {
+			s.Catbox.Logger.Warn("SVSNICK with invalid TS: %s", m.Params[2])
+			return
+		}
+		nickTS = ts
+	}
+
+	// If someone else has the nick, we leave both alone. Services can deal with
+	// them.
+	newNickCanon := canonicalizeNick(nick)
+	if uid, exists := s.Catbox.Nicks[newNickCanon]; exists && uid != user.UID {
+		s.Catbox.noticeLocalOpers(fmt.Sprintf(
+			"Ignoring SVSNICK for %s to %s: Nick is in use", user.DisplayNick, nick))
+		return
+	}
+
+	oldNick := user.DisplayNick
+	user.LocalUser.changeNick(nick, nickTS)
+
+	source := s.Catbox.sourceName(m.Prefix)
+	if source == "" {
+		source = m.Prefix
+	}
+	s.Catbox.noticeLocalOpers(fmt.Sprintf("%s forced nick change %s to %s",
+		source, oldNick, nick))
+}
+
+// SVSJOIN comes only in ENCAP messages. Services are joining a user to a
+// channel. They join even if the channel's modes would stop them.
+//
+// Like SVSNICK we act only if the user is ours. Their join propagates as a
+// JOIN (or SJOIN if it creates the channel).
+//
+// We don't need the channel TS. If the join creates the channel, the channel
+// gets a new TS as with any join.
+//
+// Parameters: <UID> <channel> [channel TS]
+func (s *LocalServer) svsjoinCommand(m irc.Message) {
+	if len(m.Params) < 2 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"SVSJOIN", "Not enough parameters"})
+		return
+	}
+
+	user, exists := s.Catbox.Users[TS6UID(m.Params[0])]
+	if !exists {
+		s.Catbox.Logger.Warn("SVSJOIN for unknown user %s", m.Params[0])
+		return
+	}
+	if !user.isLocal() {
+		return
+	}
+
+	channelName := canonicalizeChannel(m.Params[1])
+	if !isValidChannel(channelName) {
+		s.Catbox.Logger.Warn("SVSJOIN to invalid channel %s", m.Params[1])
+		return
+	}
+
+	user.LocalUser.join(channelName, "", true)
+}
+
+// SVSPART comes only in ENCAP messages. Services are removing a user from a
+// channel.
+//
+// Like SVSNICK we act only if the user is ours. Their part propagates as a
+// PART.
+//
+// Parameters: <UID> <channel> [reason]
+func (s *LocalServer) svspartCommand(m irc.Message) {
+	if len(m.Params) < 2 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"SVSPART", "Not enough parameters"})
+		return
+	}
+
+	user, exists := s.Catbox.Users[TS6UID(m.Params[0])]
+	if !exists {
+		s.Catbox.Logger.Warn("SVSPART for unknown user %s", m.Params[0])
+		return
+	}
+	if !user.isLocal() {
+		return
+	}
+
+	channel, exists := s.Catbox.Channels[canonicalizeChannel(m.Params[1])]
+	if !exists || !user.onChannel(channel) {
+		return
+	}
+
+	reason := ""
+	if len(m.Params) > 2 {
+		reason = m.Params[2]
+	}
+
+	user.LocalUser.part(channel.Name, reason)
+}
+
+// SU comes only in ENCAP messages. Services are telling us the account a user
+// is identified to. Without an account, the user is no longer identified.
+//
+// Parameters: <UID> [account]
+func (s *LocalServer) suCommand(m irc.Message) {
+	if len(m.Params) < 1 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"SU", "Not enough parameters"})
+		return
+	}
+
+	user, exists := s.Catbox.Users[TS6UID(m.Params[0])]
+	if !exists {
+		s.Catbox.Logger.Warn("SU for unknown user %s", m.Params[0])
+		return
+	}
+
+	account := ""
+	if len(m.Params) > 1 {
+		account = m.Params[1]
+	}
+
+	user.Account = account
+}
+
 // Upon link to a server, it tells us about the capabilities of all servers
 // it introduces to us. This comes in this form:
 // :3SN ENCAP * GCAP :QS EX CHW IE GLN KNOCK TB ENCAP SAVE SAVETS_100
@@ -2146,7 +2846,7 @@ func (s *LocalServer) whoisCommand(m irc.Message) {
 
 	sourceUser, exists := s.Catbox.Users[TS6UID(m.Prefix)]
 	if !exists {
-		log.Printf("WHOIS from unknown user %s", m.Prefix)
+		s.Catbox.Logger.Warn("WHOIS from unknown user %s", m.Prefix)
 		return
 	}
 
@@ -2162,8 +2862,8 @@ func (s *LocalServer) whoisCommand(m irc.Message) {
 		return
 	}
 
-	// If it's a local user, reply back to the server.
-	if user.isLocal() {
+	// If it's a local user or one of our services, reply back to the server.
+	if user.isLocal() || user.IsService {
 		msgs := s.Catbox.createWHOISResponse(user, sourceUser, true)
 		for _, msg := range msgs {
 			sourceUser.ClosestServer.maybeQueueMessage(msg)
@@ -2175,6 +2875,49 @@ func (s *LocalServer) whoisCommand(m irc.Message) {
 	user.ClosestServer.maybeQueueMessage(m)
 }
 
+// An oper on another server is tracing the route to a server. If it's us,
+// describe our connections. Otherwise say we're passing it on and pass it on.
+// The replies find their way back as numerics.
+//
+// Params: <server name>
+// e.g. :1SNAAAAAB TRACE irc3.example.com
+func (s *LocalServer) traceCommand(m irc.Message) {
+	if len(m.Params) == 0 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"TRACE", "Not enough parameters"})
+		return
+	}
+
+	sourceUser, exists := s.Catbox.Users[TS6UID(m.Prefix)]
+	if !exists {
+		s.Catbox.Logger.Warn("TRACE from unknown user %s", m.Prefix)
+		return
+	}
+
+	if !sourceUser.isOperator() {
+		s.Catbox.noticeOpers(fmt.Sprintf(
+			"Ignoring TRACE from %s who is not an operator", sourceUser.DisplayNick))
+		return
+	}
+
+	if m.Params[0] == s.Catbox.Config.ServerName {
+		s.Catbox.sendNumerics(sourceUser, s.Catbox.traceReplies())
+		return
+	}
+
+	target := s.Catbox.getServerByName(m.Params[0])
+	if target == nil {
+		// 402 ERR_NOSUCHSERVER
+		s.Catbox.sendNumerics(sourceUser, []irc.Message{
+			{Command: "402", Params: []string{m.Params[0], "No such server"}},
+		})
+		return
+	}
+
+	s.Catbox.sendNumerics(sourceUser, []irc.Message{s.Catbox.traceLink(target)})
+	target.nextHop().maybeQueueMessage(m)
+}
+
 // We've got a numeric command.
 // For example, a reply to a remote WHOIS.
 //
@@ -2184,19 +2927,24 @@ func (s *LocalServer) numericCommand(m irc.Message) {
 	// Only servers should be sending numerics.
 	sourceServer, exists := s.Catbox.Servers[TS6SID(m.Prefix)]
 	if !exists {
-		log.Printf("Numeric from unknown server %s", m.Prefix)
+		s.Catbox.Logger.Warn("Numeric from unknown server %s", m.Prefix)
 		return
 	}
 
 	if len(m.Params) == 0 {
-		log.Printf("Numeric with no parameters")
+		s.Catbox.Logger.Warn("Numeric with no parameters")
 		return
 	}
 
 	// Find the target.
 	user, exists := s.Catbox.Users[TS6UID(m.Params[0])]
 	if !exists {
-		log.Printf("Numeric %s for unknown user %s", m.Command, m.Params[0])
+		s.Catbox.Logger.Warn("Numeric %s for unknown user %s", m.Command, m.Params[0])
+		return
+	}
+
+	// Our services have nowhere to send it.
+	if user.IsService {
 		return
 	}
 
@@ -2259,6 +3007,8 @@ func (s *LocalServer) awayCommand(m irc.Message) {
 		user.AwayMessage = ""
 	}
 
+	s.Catbox.notifyWatchersAway(user)
+
 	// Propagate.
 	for _, server := range s.Catbox.LocalServers {
 		if server == s {
@@ -2322,8 +3072,13 @@ func (s *LocalServer) inviteCommand(m irc.Message) {
 		}
 	}
 
-	// TODO(horgh): If we had +i we'd have to record the invited user may join
-	// the channel.
+	// Record the invite so the user may join if the channel is +i.
+	channel.addInvite(targetUser)
+
+	// Our services don't join channels. Don't tell them.
+	if targetUser.IsService {
+		return
+	}
 
 	// If it's a local user, tell the user, and that's it.
 	if targetUser.isLocal() {
@@ -2339,6 +3094,56 @@ func (s *LocalServer) inviteCommand(m irc.Message) {
 	targetUser.ClosestServer.maybeQueueMessage(m)
 }
 
+// encapInviteCommand records an invite to a channel. Servers send it to every
+// server so that all of them know the user may join if the channel is +i.
+//
+// The user hears about the invite through INVITE. This records it and tells
+// local members with invite-notify.
+//
+// Parameters: <target UID> <channel> <channel TS>
+// :8ZZAAAAAB ENCAP * INVITE 000AAAAAB #test 1475187553
+func (s *LocalServer) encapInviteCommand(m irc.Message) {
+	if len(m.Params) < 3 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"INVITE", "Not enough parameters"})
+		return
+	}
+
+	targetUser, exists := s.Catbox.Users[TS6UID(m.Params[0])]
+	if !exists {
+		// They may have quit already.
+		return
+	}
+
+	channel, exists := s.Catbox.Channels[canonicalizeChannel(m.Params[1])]
+	if !exists {
+		return
+	}
+
+	channelTS, err := strconv.ParseInt(m.Params[2], 10, 64)
+	if err != nil {
+		s.quit(fmt.Sprintf("Invalid channel TS: %s: %s", m.Params[2], err))
+		return
+	}
+
+	// If the channel is newer than what we know, the invite is not for our
+	// channel.
+	if channelTS > channel.TS {
+		return
+	}
+
+	if targetUser.onChannel(channel) {
+		return
+	}
+
+	channel.addInvite(targetUser)
+
+	// Every server sees this, unlike INVITE, so we tell members here.
+	if sourceUser, exists := s.Catbox.Users[TS6UID(m.Prefix)]; exists {
+		s.Catbox.notifyInvite(sourceUser, targetUser, channel)
+	}
+}
+
 // TMODE propagates a channel mode change.
 // Source: user or server
 // Parameters: <channel TS> <channel> <mode changes> [parameters]
@@ -2380,7 +3185,7 @@ func (s *LocalServer) tmodeCommand(m irc.Message) {
 
 	// Ignore if the TS is newer
 	if channelTS > channel.TS {
-		log.Printf("TMODE for channel %s has newer TS, ignoring", channel.Name)
+		s.Catbox.Logger.Info("TMODE for channel %s has newer TS, ignoring", channel.Name)
 		return
 	}
 
@@ -2388,72 +3193,20 @@ func (s *LocalServer) tmodeCommand(m irc.Message) {
 	// (i.e., that source user is allowed to make the change). We only do minimal
 	// checks in that regard.
 
-	// Look at the modes and apply each of them that we understand.
-	// At the same time, generate what we need to tell our local clients.
-
-	// Point to where we expect parameters for modes to start.
-	paramIndex := 3
-
-	// Track modes we apply so we can tell our local users.
-	appliedModes := ""
-	appliedModesAction := ' '
-	appliedModesParams := []string{}
-
-	action := '+'
-
-	for _, char := range m.Params[2] {
-		if char == '+' || char == '-' {
-			action = char
-			continue
-		}
-
-		if char != 'o' {
-			continue
-		}
-
-		// +o/-o
-
-		// Must have a parameter.
-
-		if paramIndex >= len(m.Params) {
-			break
-		}
-
-		// Consume the parameter.
-		uidRaw := m.Params[paramIndex]
-		paramIndex++
-
-		// Look the user up.
-		targetUser, exists := s.Catbox.Users[TS6UID(uidRaw)]
-		if !exists {
-			break
-		}
-
-		if !targetUser.onChannel(channel) {
-			break
-		}
-
-		if action == '+' {
-			if channel.userHasOps(targetUser) {
-				continue
-			}
-			channel.grantOps(targetUser)
-		} else {
-			if !channel.userHasOps(targetUser) {
-				continue
-			}
-			channel.removeOps(targetUser)
-		}
-
-		if appliedModesAction != action {
-			appliedModesAction = action
-			appliedModes += string(appliedModesAction)
-		}
+	// Look at the modes and apply each of them that we understand. Parameters
+	// for +o/+v are UIDs.
+	lookupUser := func(uid string) *User {
+		return s.Catbox.Users[TS6UID(uid)]
+	}
 
-		appliedModes += string(char)
-		appliedModesParams = append(appliedModesParams, targetUser.DisplayNick)
+	setter := origin
+	if sourceUser != nil {
+		setter = sourceUser.DisplayNick
 	}
 
+	changes := channel.applyModes(m.Params[2], m.Params[3:], lookupUser, setter,
+		0)
+
 	// It's possible we have more than ChanModesPerCommand to send to the client
 	// now (as TMODE can exceed the limit). We could break it up into separate
 	// MODE commands.
@@ -2462,24 +3215,16 @@ func (s *LocalServer) tmodeCommand(m irc.Message) {
 
 	// But only if there is something to tell.
 
-	if len(appliedModes) > 0 {
-		userModeParams := []string{channel.Name, appliedModes}
-		userModeParams = append(userModeParams, appliedModesParams...)
-		log.Printf("%v %v", appliedModes, appliedModesParams)
-
-		for memberUID := range channel.Members {
-			member := s.Catbox.Users[memberUID]
-
-			if !member.isLocal() {
-				continue
-			}
+	if len(changes) > 0 {
+		userModeParams := []string{channel.Name}
+		userModeParams = append(userModeParams, modeChangesToParams(changes,
+			false)...)
 
-			member.LocalUser.maybeQueueMessage(irc.Message{
-				Prefix:  origin,
-				Command: "MODE",
-				Params:  userModeParams,
-			})
-		}
+		s.Catbox.messageLocalUsersOnChannel(channel, irc.Message{
+			Prefix:  origin,
+			Command: "MODE",
+			Params:  userModeParams,
+		})
 	}
 
 	// Propagate
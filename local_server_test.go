@@ -0,0 +1,1698 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+func TestMakeSJOINMessages(t *testing.T) {
+	tests := []struct {
+		members int
+		// Whether we need more than one message to fit them all.
+		multiple bool
+	}{
+		{1, false},
+		{5, false},
+		{100, true},
+	}
+
+	for _, test := range tests {
+		channel := &Channel{
+			Name:    "#test",
+			Members: map[TS6UID]struct{}{},
+			Ops:     map[TS6UID]*User{},
+			Voices:  map[TS6UID]*User{},
+			Modes:   map[byte]struct{}{'n': {}},
+			TS:      1475187553,
+		}
+
+		for i := 0; i < test.members; i++ {
+			uid := TS6UID(fmt.Sprintf("000AAA%03d", i))
+			channel.Members[uid] = struct{}{}
+			if i%3 == 0 {
+				channel.Ops[uid] = &User{UID: uid}
+			}
+			if i%5 == 0 {
+				channel.Voices[uid] = &User{UID: uid}
+			}
+		}
+
+		msgs, err := makeSJOINMessages(TS6SID("000"), channel)
+		if err != nil {
+			t.Errorf("makeSJOINMessages() with %d members: %s", test.members, err)
+			continue
+		}
+
+		if len(msgs) == 0 || (len(msgs) > 1) != test.multiple {
+			t.Errorf("makeSJOINMessages() with %d members = %d messages",
+				test.members, len(msgs))
+		}
+
+		seen := map[string]int{}
+		for _, msg := range msgs {
+			buf, err := msg.Encode()
+			if err != nil {
+				t.Errorf("makeSJOINMessages() with %d members made a message we can't encode: %s",
+					test.members, err)
+				continue
+			}
+			if len(buf) > irc.MaxLineLength {
+				t.Errorf("makeSJOINMessages() with %d members made a message of length %d",
+					test.members, len(buf))
+			}
+
+			if msg.Params[0] != "1475187553" || msg.Params[1] != "#test" ||
+				msg.Params[2] != "+n" {
+				t.Errorf("makeSJOINMessages() with %d members made message with params %v",
+					test.members, msg.Params)
+			}
+
+			for _, uid := range strings.Fields(msg.Params[3]) {
+				seen[uid]++
+			}
+		}
+
+		for i := 0; i < test.members; i++ {
+			uid := TS6UID(fmt.Sprintf("000AAA%03d", i))
+			want := string(uid)
+			if _, ok := channel.Voices[uid]; ok {
+				want = "+" + want
+			}
+			if _, ok := channel.Ops[uid]; ok {
+				want = "@" + want
+			}
+			if seen[want] != 1 {
+				t.Errorf("makeSJOINMessages() with %d members included %s %d times",
+					test.members, want, seen[want])
+			}
+		}
+	}
+}
+
+// We burst bans to every server, ban exceptions only to servers with EX, and
+// quiets only to servers with QUIET.
+func TestSendBurstMasks(t *testing.T) {
+	tests := []struct {
+		capabs []string
+		wanted []string
+	}{
+		{nil, []string{"TMODE 100 #test +b *!*@ban"}},
+		{[]string{"EX"}, []string{"TMODE 100 #test +be *!*@ban *!*@exception"}},
+		{[]string{"QUIET"}, []string{"TMODE 100 #test +bQ *!*@ban *!*@quiet"}},
+		{[]string{"EX", "QUIET"},
+			[]string{"TMODE 100 #test +beQ *!*@ban *!*@exception *!*@quiet"}},
+	}
+
+	for _, test := range tests {
+		cb := newTraceTestCatbox("irc1.example.com", "000")
+		cb.Channels = map[string]*Channel{}
+		alice := addCallerIDTestUser(cb, 1, "alice")
+		channel := &Channel{
+			Name:          "#test",
+			TS:            100,
+			Members:       map[TS6UID]struct{}{alice.User.UID: {}},
+			Ops:           map[TS6UID]*User{},
+			Modes:         map[byte]struct{}{},
+			Bans:          []BanEntry{{Mask: "*!*@ban"}},
+			BanExceptions: []BanEntry{{Mask: "*!*@exception"}},
+			Quiets:        []BanEntry{{Mask: "*!*@quiet"}},
+		}
+		cb.Channels[channel.Name] = channel
+		alice.User.Channels[channel.Name] = channel
+
+		link := addTraceTestLink(cb, 2, "irc2.example.com", "001")
+		link.WriteChan = make(chan TaggedMessage, 100)
+		link.Server.Capabs = map[string]struct{}{}
+		for _, capab := range test.capabs {
+			link.Server.Capabs[capab] = struct{}{}
+		}
+
+		link.sendBurst()
+
+		var got []string
+		for len(link.WriteChan) > 0 {
+			m := (<-link.WriteChan).Message
+			if m.Command == "TMODE" {
+				got = append(got, m.Command+" "+strings.Join(m.Params, " "))
+			}
+		}
+		if strings.Join(got, "\n") != strings.Join(test.wanted, "\n") {
+			t.Errorf("capabs %v: sent %q, wanted %q", test.capabs, got,
+				test.wanted)
+		}
+	}
+}
+
+func TestEndBurstSendsCHGHOST(t *testing.T) {
+	local := &User{
+		DisplayNick: "local",
+		UID:         TS6UID("000AAAAAA"),
+		Channels:    map[string]*Channel{},
+	}
+	local.LocalUser = &LocalUser{
+		LocalClient: &LocalClient{
+			WriteChan: make(chan TaggedMessage, 10),
+			Caps:      map[string]struct{}{"chghost": {}},
+		},
+		User: local,
+	}
+
+	// noCap is in the channel too but can't hear about it.
+	noCap := &User{
+		DisplayNick: "nocap",
+		UID:         TS6UID("000AAAAAB"),
+		Channels:    map[string]*Channel{},
+	}
+	noCap.LocalUser = &LocalUser{
+		LocalClient: &LocalClient{
+			WriteChan: make(chan TaggedMessage, 10),
+			Caps:      map[string]struct{}{},
+		},
+		User: noCap,
+	}
+
+	// remote1 is in a channel with local. remote2 is not. remote3 quit before
+	// the burst ended.
+	remote1 := &User{
+		DisplayNick: "remote1",
+		Username:    "user1",
+		Hostname:    "host1.example.com",
+		IP:          "192.168.0.1",
+		UID:         TS6UID("001AAAAAA"),
+		Channels:    map[string]*Channel{},
+	}
+	remote2 := &User{
+		DisplayNick: "remote2",
+		Username:    "user2",
+		Hostname:    "host2.example.com",
+		IP:          "192.168.0.2",
+		UID:         TS6UID("001AAAAAB"),
+		Channels:    map[string]*Channel{},
+	}
+
+	channel := &Channel{
+		Name: "#test",
+		Members: map[TS6UID]struct{}{
+			local.UID:   {},
+			noCap.UID:   {},
+			remote1.UID: {},
+		},
+	}
+	local.Channels[channel.Name] = channel
+	noCap.Channels[channel.Name] = channel
+	remote1.Channels[channel.Name] = channel
+
+	cb := &Catbox{
+		Config: &Config{TS6SID: TS6SID("000")},
+		Users: map[TS6UID]*User{
+			local.UID:   local,
+			noCap.UID:   noCap,
+			remote1.UID: remote1,
+			remote2.UID: remote2,
+		},
+		Logger: newTestLogger(),
+	}
+
+	s := &LocalServer{
+		LocalClient:      &LocalClient{Catbox: cb},
+		Server:           &Server{Name: "irc2.example.com"},
+		Bursting:         true,
+		BurstHostChanges: []TS6UID{remote1.UID, remote2.UID, "001AAAAAC"},
+	}
+
+	s.endBurst()
+
+	if s.Bursting || len(s.BurstHostChanges) != 0 {
+		t.Fatalf("endBurst() left bursting %v and %d host changes", s.Bursting,
+			len(s.BurstHostChanges))
+	}
+
+	if len(local.LocalUser.WriteChan) != 1 {
+		t.Fatalf("endBurst() queued %d messages, wanted 1",
+			len(local.LocalUser.WriteChan))
+	}
+
+	m := <-local.LocalUser.WriteChan
+	if m.Prefix != "remote1!user1@192.168.0.1" || m.Command != "CHGHOST" ||
+		strings.Join(m.Params, " ") != "user1 host1.example.com" {
+		t.Errorf("endBurst() sent %s %s %v", m.Prefix, m.Command, m.Params)
+	}
+
+	if len(noCap.LocalUser.WriteChan) != 0 {
+		t.Errorf("endBurst() sent CHGHOST to a user without the capability")
+	}
+}
+
+func TestHandleCollisionStaleNick(t *testing.T) {
+	cb := &Catbox{
+		Config: &Config{TS6SID: TS6SID("000")},
+		Nicks:  map[string]TS6UID{"nick": TS6UID("000AAAAAA")},
+		Users:  map[TS6UID]*User{},
+		Logger: newTestLogger(),
+	}
+
+	if !cb.handleCollision(nil, TS6UID("001AAAAAA"), "Nick", "user",
+		"example.com", 1, "UID") {
+		t.Errorf("handleCollision() rejected a nick held by an unknown user")
+	}
+
+	if _, exists := cb.Nicks["nick"]; exists {
+		t.Errorf("handleCollision() left the stale nick")
+	}
+}
+
+func TestEncapGCAP(t *testing.T) {
+	remote := &Server{SID: TS6SID("002"), Name: "irc3.example.com"}
+
+	cb := &Catbox{
+		Config:  &Config{TS6SID: TS6SID("000"), ServerName: "irc1.example.com"},
+		Servers: map[TS6SID]*Server{remote.SID: remote},
+		Logger:  newTestLogger(),
+	}
+
+	from := &LocalServer{
+		LocalClient: &LocalClient{ID: 1, Catbox: cb,
+			WriteChan: make(chan TaggedMessage, 10)},
+		Server: &Server{SID: TS6SID("001"), Name: "irc2.example.com"},
+	}
+	other := &LocalServer{
+		LocalClient: &LocalClient{ID: 2, Catbox: cb,
+			WriteChan: make(chan TaggedMessage, 10)},
+		Server: &Server{SID: TS6SID("003"), Name: "irc4.example.com"},
+	}
+	cb.LocalServers = map[uint64]*LocalServer{1: from, 2: other}
+	from.Server.LocalServer = from
+	other.Server.LocalServer = other
+	cb.Servers[from.Server.SID] = from.Server
+	cb.Servers[other.Server.SID] = other.Server
+
+	m := irc.Message{
+		Prefix:  string(remote.SID),
+		Command: "ENCAP",
+		Params:  []string{"*", "GCAP", "QS ENCAP TB"},
+	}
+	from.encapCommand(m)
+
+	if remote.capabsString() != "ENCAP QS TB" {
+		t.Errorf("encapCommand() stored capabs %s", remote.capabsString())
+	}
+
+	if !remote.hasCapability("TB") || remote.hasCapability("EX") {
+		t.Errorf("hasCapability() did not match stored capabs %v", remote.Capabs)
+	}
+
+	if len(from.WriteChan) != 0 {
+		t.Errorf("encapCommand() sent GCAP back to its source")
+	}
+
+	if len(other.WriteChan) != 1 {
+		t.Fatalf("encapCommand() sent %d messages to other server, wanted 1",
+			len(other.WriteChan))
+	}
+	forwarded := <-other.WriteChan
+	if forwarded.Prefix != m.Prefix ||
+		strings.Join(forwarded.Params, " ") != "* GCAP QS ENCAP TB" {
+		t.Errorf("encapCommand() forwarded %s %v", forwarded.Prefix,
+			forwarded.Params)
+	}
+}
+
+// Test nick collisions from NICK and UID. We check who gets killed and which
+// servers we tell.
+func TestCollisions(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		// TS of the user changing nick/being introduced. The existing user's TS is
+		// 200.
+		nickTS int64
+		// Whether the new user has the same user@host as the existing one.
+		sameUhost bool
+		// Which users we expect to be killed.
+		killNew      bool
+		killExisting bool
+		// Which servers should get a KILL for the new user.
+		newKillToA bool
+		newKillToB bool
+	}{
+		{"NICK lower TS different uhost", "NICK", 100, false, false, true, false,
+			false},
+		{"NICK lower TS same uhost", "NICK", 100, true, true, false, true, true},
+		{"NICK equal TS", "NICK", 200, false, true, true, true, true},
+		{"NICK higher TS different uhost", "NICK", 300, false, true, false, true,
+			true},
+		{"NICK higher TS same uhost", "NICK", 300, true, false, true, false, false},
+
+		// With UID, the other servers don't know about the new user. We only tell
+		// the server that sent it.
+		{"UID lower TS different uhost", "UID", 100, false, false, true, false,
+			false},
+		{"UID equal TS", "UID", 200, false, true, true, true, false},
+		{"UID higher TS different uhost", "UID", 300, false, true, false, true,
+			false},
+	}
+
+	for _, test := range tests {
+		cb := &Catbox{
+			Config: &Config{TS6SID: TS6SID("000"), ServerName: "irc1.example.com",
+				MaxNickLength: 9},
+			Users:  map[TS6UID]*User{},
+			Nicks:  map[string]TS6UID{},
+			Opers:  map[TS6UID]*User{},
+			Logger: newTestLogger(),
+		}
+
+		// We're linked to A and B. The new user comes from A. The existing user
+		// is on B.
+		serverA := &LocalServer{
+			LocalClient: &LocalClient{ID: 1, Catbox: cb,
+				WriteChan: make(chan TaggedMessage, 100)},
+			Server: &Server{SID: TS6SID("001"), Name: "a.example.com"},
+		}
+		serverA.Server.LocalServer = serverA
+		serverB := &LocalServer{
+			LocalClient: &LocalClient{ID: 2, Catbox: cb,
+				WriteChan: make(chan TaggedMessage, 100)},
+			Server: &Server{SID: TS6SID("002"), Name: "b.example.com"},
+		}
+		serverB.Server.LocalServer = serverB
+		cb.LocalServers = map[uint64]*LocalServer{1: serverA, 2: serverB}
+		cb.Servers = map[TS6SID]*Server{"001": serverA.Server, "002": serverB.Server}
+
+		existing := &User{DisplayNick: "bob", NickTS: 200, Username: "bob",
+			Hostname: "b.example.com", UID: TS6UID("002AAAAAA"),
+			Channels: map[string]*Channel{}, ClosestServer: serverB,
+			Server: serverB.Server}
+		cb.Users[existing.UID] = existing
+		cb.Nicks["bob"] = existing.UID
+
+		username, hostname := "alice", "a.example.com"
+		if test.sameUhost {
+			username, hostname = existing.Username, existing.Hostname
+		}
+
+		newUID := TS6UID("001AAAAAA")
+		if test.command == "NICK" {
+			newUser := &User{DisplayNick: "alice", NickTS: 50, Username: username,
+				Hostname: hostname, UID: newUID, Channels: map[string]*Channel{},
+				ClosestServer: serverA, Server: serverA.Server}
+			cb.Users[newUser.UID] = newUser
+			cb.Nicks["alice"] = newUser.UID
+
+			serverA.nickCommand(irc.Message{
+				Prefix:  string(newUID),
+				Command: "NICK",
+				Params:  []string{"bob", fmt.Sprintf("%d", test.nickTS)},
+			})
+		} else {
+			serverA.uidCommand(irc.Message{
+				Prefix:  "001",
+				Command: "UID",
+				Params: []string{"bob", "1", fmt.Sprintf("%d", test.nickTS), "+i",
+					username, hostname, "127.0.0.1", string(newUID), "Bob"},
+			})
+		}
+
+		killsA := map[string]int{}
+		killsB := map[string]int{}
+		for len(serverA.WriteChan) > 0 {
+			m := <-serverA.WriteChan
+			if m.Command == "KILL" {
+				killsA[m.Params[0]]++
+			}
+		}
+		for len(serverB.WriteChan) > 0 {
+			m := <-serverB.WriteChan
+			if m.Command == "KILL" {
+				killsB[m.Params[0]]++
+			}
+		}
+
+		if (killsA[string(newUID)] == 1) != test.newKillToA ||
+			(killsB[string(newUID)] == 1) != test.newKillToB {
+			t.Errorf("%s: new user KILLs to A %d, to B %d", test.name,
+				killsA[string(newUID)], killsB[string(newUID)])
+		}
+
+		// When we kill the existing user we tell everyone.
+		existingKills := killsA[string(existing.UID)] == 1 &&
+			killsB[string(existing.UID)] == 1
+		if existingKills != test.killExisting {
+			t.Errorf("%s: existing user KILLs to A %d, to B %d", test.name,
+				killsA[string(existing.UID)], killsB[string(existing.UID)])
+		}
+
+		_, existingExists := cb.Users[existing.UID]
+		if existingExists == test.killExisting {
+			t.Errorf("%s: existing user exists: %v", test.name, existingExists)
+		}
+
+		_, newExists := cb.Users[newUID]
+		if newExists == test.killNew {
+			t.Errorf("%s: new user exists: %v", test.name, newExists)
+		}
+
+		// The nick belongs to whoever survived.
+		uid, exists := cb.Nicks["bob"]
+		switch {
+		case !test.killExisting:
+			if uid != existing.UID {
+				t.Errorf("%s: nick is %s, wanted existing user", test.name, uid)
+			}
+		case !test.killNew:
+			if uid != newUID {
+				t.Errorf("%s: nick is %s, wanted new user", test.name, uid)
+			}
+		default:
+			if exists {
+				t.Errorf("%s: nick is %s, wanted nobody", test.name, uid)
+			}
+		}
+
+		// The new user's old nick is gone whether they changed nick or died.
+		if _, exists := cb.Nicks["alice"]; exists {
+			t.Errorf("%s: old nick left behind", test.name)
+		}
+	}
+}
+
+func TestEncapInvite(t *testing.T) {
+	tests := []struct {
+		channelTS int64
+		invited   bool
+	}{
+		{100, true},
+		{50, true},
+		// A newer channel is not ours.
+		{200, false},
+	}
+
+	for _, test := range tests {
+		cb := &Catbox{
+			Config:   &Config{TS6SID: TS6SID("000"), ServerName: "irc1.example.com"},
+			Users:    map[TS6UID]*User{},
+			Nicks:    map[string]TS6UID{},
+			Channels: map[string]*Channel{},
+			Logger:   newTestLogger(),
+		}
+
+		s := &LocalServer{
+			LocalClient: &LocalClient{ID: 1, Catbox: cb,
+				WriteChan: make(chan TaggedMessage, 10)},
+			Server: &Server{SID: TS6SID("001"), Name: "irc2.example.com"},
+		}
+		cb.LocalServers = map[uint64]*LocalServer{1: s}
+
+		user := &User{DisplayNick: "remote", UID: TS6UID("001AAAAAA"),
+			Channels: map[string]*Channel{}, ClosestServer: s, Server: s.Server}
+		cb.Users[user.UID] = user
+		cb.Nicks["remote"] = user.UID
+
+		channel := &Channel{Name: "#test", TS: 100,
+			Members: map[TS6UID]struct{}{},
+			Modes:   map[byte]struct{}{'i': {}}}
+		cb.Channels[channel.Name] = channel
+
+		s.encapCommand(irc.Message{
+			Prefix:  "001AAAAAB",
+			Command: "ENCAP",
+			Params: []string{"*", "INVITE", string(user.UID), "#test",
+				fmt.Sprintf("%d", test.channelTS)},
+		})
+
+		if channel.isInvited(user) != test.invited {
+			t.Errorf("ENCAP INVITE with TS %d: invited %v, wanted %v",
+				test.channelTS, channel.isInvited(user), test.invited)
+		}
+
+		// The invite goes away when the user does.
+		cb.quitRemoteUser(user, "bye")
+		if channel.isInvited(user) {
+			t.Errorf("invite remains after user quit")
+		}
+	}
+}
+
+// newTraceTestCatbox makes a Catbox for TestTraceTwoHops.
+func newTraceTestCatbox(name, sid string) *Catbox {
+	return &Catbox{
+		Config: &Config{TS6SID: TS6SID(sid), ServerName: name,
+			ServerInfo: "Test"},
+		LocalClients: map[uint64]*LocalClient{},
+		LocalUsers:   map[uint64]*LocalUser{},
+		LocalServers: map[uint64]*LocalServer{},
+		Users:        map[TS6UID]*User{},
+		Nicks:        map[string]TS6UID{},
+		Servers:      map[TS6SID]*Server{},
+		Logger:       newTestLogger(),
+	}
+}
+
+// addTraceTestLink makes a server directly linked to cb.
+func addTraceTestLink(cb *Catbox, id uint64, name, sid string) *LocalServer {
+	ls := &LocalServer{
+		LocalClient: &LocalClient{ID: id, Catbox: cb,
+			ConnectionStartTime: time.Now(),
+			WriteChan:           make(chan TaggedMessage, 10)},
+		Server: &Server{SID: TS6SID(sid), Name: name},
+	}
+	ls.Server.LocalServer = ls
+	cb.LocalServers[id] = ls
+	cb.Servers[ls.Server.SID] = ls.Server
+	return ls
+}
+
+// Test an oper on irc1 tracing irc3 in the network irc1 - irc2 - irc3.
+func TestTraceTwoHops(t *testing.T) {
+	cb1 := newTraceTestCatbox("irc1.example.com", "000")
+	link12 := addTraceTestLink(cb1, 1, "irc2.example.com", "001")
+	cb1.Servers["002"] = &Server{SID: "002", Name: "irc3.example.com",
+		ClosestServer: link12, LinkedTo: link12.Server}
+	oper := addCallerIDTestUser(cb1, 0, "oper")
+	oper.User.Modes['o'] = struct{}{}
+
+	cb2 := newTraceTestCatbox("irc2.example.com", "001")
+	link21 := addTraceTestLink(cb2, 1, "irc1.example.com", "000")
+	link23 := addTraceTestLink(cb2, 2, "irc3.example.com", "002")
+	cb2.Users[oper.User.UID] = &User{DisplayNick: "oper", UID: oper.User.UID,
+		Modes: map[byte]struct{}{'o': {}}, ClosestServer: link21}
+
+	cb3 := newTraceTestCatbox("irc3.example.com", "002")
+	link32 := addTraceTestLink(cb3, 1, "irc2.example.com", "001")
+	cb3.Servers["000"] = &Server{SID: "000", Name: "irc1.example.com",
+		ClosestServer: link32, LinkedTo: link32.Server}
+	cb3.Users[oper.User.UID] = &User{DisplayNick: "oper", UID: oper.User.UID,
+		Modes: map[byte]struct{}{'o': {}}, ClosestServer: link32}
+	alice := addCallerIDTestUser(cb3, 1, "alice")
+	alice.User.Class = DefaultConnClass
+
+	// take gets what a local server sent and checks it is what we expect.
+	take := func(ls *LocalServer, wanted []string) []irc.Message {
+		var msgs []irc.Message
+		for len(ls.WriteChan) > 0 {
+			msgs = append(msgs, (<-ls.WriteChan).Message)
+		}
+
+		if len(msgs) != len(wanted) {
+			t.Fatalf("sent %d messages to %s, wanted %d: %v", len(msgs),
+				ls.Server.Name, len(wanted), msgs)
+		}
+
+		for i, m := range msgs {
+			got := m.Prefix + " " + m.Command + " " + strings.Join(m.Params, " ")
+			if got != wanted[i] {
+				t.Errorf("sent %s to %s, wanted %s", got, ls.Server.Name, wanted[i])
+			}
+		}
+		return msgs
+	}
+
+	// expect checks what the oper got.
+	expect := func(when string, want []string) {
+		if got := drainCommands(oper); strings.Join(got, "\n") !=
+			strings.Join(want, "\n") {
+			t.Errorf("%s: oper got %q, wanted %q", when, got, want)
+		}
+	}
+
+	version := cb1.version()
+
+	oper.traceCommand(irc.Message{Command: "TRACE",
+		Params: []string{"irc3.example.com"}})
+
+	expect("after TRACE", []string{
+		"200 oper Link " + version +
+			" irc3.example.com irc2.example.com V6 0",
+	})
+
+	trace := take(link12, []string{"000AAAAAA TRACE irc3.example.com"})
+
+	// irc2 passes it on and says so.
+	link21.traceCommand(trace[0])
+
+	for _, m := range take(link21, []string{
+		"001 200 000AAAAAA Link " + version +
+			" irc3.example.com irc3.example.com V6 0",
+	}) {
+		link12.numericCommand(m)
+	}
+
+	expect("after irc2", []string{
+		"200 oper Link " + version + " irc3.example.com irc3.example.com V6 0",
+	})
+
+	trace = take(link23, []string{"000AAAAAA TRACE irc3.example.com"})
+
+	// irc3 is the target. It describes its connections.
+	link32.traceCommand(trace[0])
+
+	replies := take(link32, []string{
+		"002 205 000AAAAAA User default alice",
+		"002 206 000AAAAAA Serv server 2S 1C irc2.example.com " +
+			"*!*@irc3.example.com V6",
+		"002 262 000AAAAAA irc3.example.com " + version + " End of TRACE",
+	})
+
+	// The replies go back through irc2.
+	for _, m := range replies {
+		link23.numericCommand(m)
+	}
+	for _, m := range take(link21, []string{
+		"002 205 000AAAAAA User default alice",
+		"002 206 000AAAAAA Serv server 2S 1C irc2.example.com " +
+			"*!*@irc3.example.com V6",
+		"002 262 000AAAAAA irc3.example.com " + version + " End of TRACE",
+	}) {
+		link12.numericCommand(m)
+	}
+
+	expect("after irc3", []string{
+		"205 oper User default alice",
+		"206 oper Serv server 2S 1C irc2.example.com *!*@irc3.example.com V6",
+		"262 oper irc3.example.com " + version + " End of TRACE",
+	})
+}
+
+// Test a server mask NOTICE arriving at irc2 in the network irc1 - irc2 -
+// irc3. irc2 delivers it to its users and passes it on to irc3 but not back to
+// irc1.
+func TestServerPrivmsgServerMask(t *testing.T) {
+	cb := newTraceTestCatbox("irc2.example.com", "001")
+	link21 := addTraceTestLink(cb, 1, "irc1.example.com", "000")
+	link23 := addTraceTestLink(cb, 2, "irc3.example.com", "002")
+	cb.Users["000AAAAAA"] = &User{DisplayNick: "oper", Username: "user",
+		Hostname: "host.example.com", UID: "000AAAAAA",
+		Modes: map[byte]struct{}{'o': {}}, ClosestServer: link21}
+	alice := addCallerIDTestUser(cb, 1, "alice")
+
+	m := irc.Message{Prefix: "000AAAAAA", Command: "NOTICE",
+		Params: []string{"$*.example.com", "hi"}}
+	link21.privmsgCommand(m)
+
+	if len(alice.WriteChan) != 1 {
+		t.Fatalf("local user got %d messages, wanted 1", len(alice.WriteChan))
+	}
+	got := (<-alice.WriteChan).Message
+	if got.Prefix != "oper!user@host.example.com" || got.Command != "NOTICE" ||
+		strings.Join(got.Params, " ") != "$*.example.com hi" {
+		t.Errorf("local user got %v", got)
+	}
+
+	if len(link21.WriteChan) != 0 {
+		t.Errorf("sent the message back to where it came from")
+	}
+	if len(link23.WriteChan) != 1 {
+		t.Fatalf("sent %d messages to irc3, wanted 1", len(link23.WriteChan))
+	}
+	if got := (<-link23.WriteChan).Message; got.Prefix != m.Prefix ||
+		strings.Join(got.Params, " ") != "$*.example.com hi" {
+		t.Errorf("propagated %v, wanted %v", got, m)
+	}
+}
+
+// A message from a remote user to a +c channel reaches local members without
+// colors. We pass it on to other servers as it was.
+func TestServerPrivmsgStripColors(t *testing.T) {
+	cb := newTraceTestCatbox("irc2.example.com", "001")
+	cb.Channels = map[string]*Channel{}
+	link21 := addTraceTestLink(cb, 1, "irc1.example.com", "000")
+	link23 := addTraceTestLink(cb, 2, "irc3.example.com", "002")
+	cb.Users["000AAAAAA"] = &User{DisplayNick: "carol", Username: "user",
+		Hostname: "host.example.com", UID: "000AAAAAA",
+		Channels: map[string]*Channel{}, ClosestServer: link21}
+	cb.Users["002AAAAAA"] = &User{DisplayNick: "dave", UID: "002AAAAAA",
+		Channels: map[string]*Channel{}, ClosestServer: link23}
+	alice := addCallerIDTestUser(cb, 1, "alice")
+
+	channel := &Channel{Name: "#test", Members: map[TS6UID]struct{}{},
+		Ops: map[TS6UID]*User{}, Voices: map[TS6UID]*User{},
+		Modes: map[byte]struct{}{'c': {}}}
+	cb.Channels[channel.Name] = channel
+	for _, u := range []*User{alice.User, cb.Users["000AAAAAA"],
+		cb.Users["002AAAAAA"]} {
+		channel.Members[u.UID] = struct{}{}
+		u.Channels[channel.Name] = channel
+	}
+
+	m := irc.Message{Prefix: "000AAAAAA", Command: "PRIVMSG",
+		Params: []string{"#test", "\x0312hi"}}
+	link21.privmsgCommand(m)
+
+	wanted := []string{"PRIVMSG #test hi"}
+	if got := drainCommands(alice); strings.Join(got, "\n") !=
+		strings.Join(wanted, "\n") {
+		t.Errorf("local user got %q, wanted %q", got, wanted)
+	}
+
+	if len(link23.WriteChan) != 1 {
+		t.Fatalf("sent %d messages to irc3, wanted 1", len(link23.WriteChan))
+	}
+	if got := (<-link23.WriteChan).Message; strings.Join(got.Params, " ") !=
+		"#test \x0312hi" {
+		t.Errorf("propagated %v, wanted %v", got, m)
+	}
+}
+
+// A TMODE opping several users where one is unknown ops the rest.
+func TestTmodeCommandMultipleOps(t *testing.T) {
+	cb := newTraceTestCatbox("irc1.example.com", "000")
+	cb.Channels = map[string]*Channel{}
+	link := addTraceTestLink(cb, 1, "irc2.example.com", "001")
+	alice := addCallerIDTestUser(cb, 1, "alice")
+	bob := addCallerIDTestUser(cb, 2, "bob")
+	carol := addCallerIDTestUser(cb, 3, "carol")
+
+	channel := &Channel{
+		Name:    "#test",
+		Members: map[TS6UID]struct{}{},
+		Ops:     map[TS6UID]*User{},
+		Voices:  map[TS6UID]*User{},
+		Modes:   map[byte]struct{}{},
+		TS:      1234,
+	}
+	cb.Channels[channel.Name] = channel
+	for _, lu := range []*LocalUser{alice, bob, carol} {
+		channel.Members[lu.User.UID] = struct{}{}
+		lu.User.Channels[channel.Name] = channel
+	}
+
+	link.tmodeCommand(irc.Message{Prefix: "001", Command: "TMODE",
+		Params: []string{"1234", "#test", "+ooo", string(alice.User.UID),
+			"001AAAAAA", string(carol.User.UID)}})
+
+	if !channel.userHasOps(alice.User) || !channel.userHasOps(carol.User) ||
+		channel.userHasOps(bob.User) {
+		t.Errorf("ops are %v", channel.Ops)
+	}
+
+	wanted := "MODE #test +oo alice carol"
+	if got := drainCommands(bob); len(got) != 1 || got[0] != wanted {
+		t.Errorf("channel got %q, wanted %q", got, wanted)
+	}
+}
+
+// A KILL for a local user tells them who killed them and then closes their
+// connection with ERROR.
+func TestKillCommandLocalUser(t *testing.T) {
+	cb := newTraceTestCatbox("irc1.example.com", "000")
+	cb.Channels = map[string]*Channel{}
+	link := addTraceTestLink(cb, 1, "irc2.example.com", "001")
+	cb.Users["001AAAAAA"] = &User{DisplayNick: "oper", Username: "user",
+		Hostname: "host.example.com", UID: "001AAAAAA",
+		Modes: map[byte]struct{}{'o': {}}, ClosestServer: link}
+	alice := addCallerIDTestUser(cb, 1, "alice")
+
+	link.killCommand(irc.Message{Prefix: "001AAAAAA", Command: "KILL",
+		Params: []string{string(alice.User.UID),
+			"irc2.example.com!host.example.com!user!oper (Go away)"}})
+
+	var got []string
+	for len(alice.WriteChan) > 0 {
+		m := (<-alice.WriteChan).Message
+		got = append(got, m.Prefix+" "+m.Command+" "+strings.Join(m.Params, " "))
+	}
+	wanted := []string{
+		"oper!user@host.example.com KILL alice oper (Go away)",
+		"alice!user@host.example.com QUIT Killed (oper (Go away))",
+		"irc1.example.com ERROR Killed (oper (Go away))",
+	}
+	if strings.Join(got, "\n") != strings.Join(wanted, "\n") {
+		t.Errorf("killed user got %q, wanted %q", got, wanted)
+	}
+
+	if _, exists := cb.Users[alice.User.UID]; exists {
+		t.Errorf("killed user still exists")
+	}
+}
+
+// A GNOTICE from irc1 arriving at irc2 in the network irc1 - irc2 - irc3.
+func TestEncapGnotice(t *testing.T) {
+	cb := newTraceTestCatbox("irc2.example.com", "001")
+	link21 := addTraceTestLink(cb, 1, "irc1.example.com", "000")
+	link23 := addTraceTestLink(cb, 2, "irc3.example.com", "002")
+	cb.Users["000AAAAAA"] = &User{DisplayNick: "oper", UID: "000AAAAAA",
+		Modes: map[byte]struct{}{'o': {}}, ClosestServer: link21}
+	alice := addCallerIDTestUser(cb, 1, "alice")
+
+	m := irc.Message{Prefix: "000AAAAAA", Command: "ENCAP",
+		Params: []string{"*", "GNOTICE", "Hello"}}
+	link21.encapCommand(m)
+
+	wanted := []string{"NOTICE alice *** Global Notice from oper: Hello"}
+	if got := drainCommands(alice); strings.Join(got, "\n") !=
+		strings.Join(wanted, "\n") {
+		t.Errorf("local user got %q, wanted %q", got, wanted)
+	}
+
+	if len(link21.WriteChan) != 0 {
+		t.Errorf("sent the GNOTICE back to where it came from")
+	}
+	if len(link23.WriteChan) != 1 {
+		t.Fatalf("sent %d messages to irc3, wanted 1", len(link23.WriteChan))
+	}
+	if got := (<-link23.WriteChan).Message; got.Prefix != m.Prefix ||
+		strings.Join(got.Params, " ") != "* GNOTICE Hello" {
+		t.Errorf("propagated %v, wanted %v", got, m)
+	}
+}
+
+func TestEncapSVSNICK(t *testing.T) {
+	cb := newTraceTestCatbox("irc2.example.com", "001")
+	cb.Config.MaxNickLength = 9
+	cb.Opers = map[TS6UID]*User{}
+	cb.Channels = map[string]*Channel{}
+	link21 := addTraceTestLink(cb, 1, "irc1.example.com", "000")
+	link23 := addTraceTestLink(cb, 2, "irc3.example.com", "002")
+	cb.Users["002AAAAAA"] = &User{DisplayNick: "carol", UID: "002AAAAAA",
+		ClosestServer: link23}
+	cb.Nicks["carol"] = "002AAAAAA"
+	alice := addCallerIDTestUser(cb, 1, "alice")
+	bob := addCallerIDTestUser(cb, 2, "bob")
+	channel := &Channel{Name: "#test", Members: map[TS6UID]struct{}{
+		alice.User.UID: {}, bob.User.UID: {}}}
+	cb.Channels[channel.Name] = channel
+	alice.User.Channels[channel.Name] = channel
+	bob.User.Channels[channel.Name] = channel
+
+	svsnick := func(params ...string) {
+		link21.encapCommand(irc.Message{Prefix: "000", Command: "ENCAP",
+			Params: append([]string{"*", "SVSNICK"}, params...)})
+	}
+
+	drainLink := func(link *LocalServer) []string {
+		var got []string
+		for len(link.WriteChan) > 0 {
+			m := (<-link.WriteChan).Message
+			got = append(got, m.Prefix+" "+m.Command+" "+strings.Join(m.Params, " "))
+		}
+		return got
+	}
+
+	// A local user.
+	svsnick(string(alice.User.UID), "Guest1", "1234")
+
+	if alice.User.DisplayNick != "Guest1" || alice.User.NickTS != 1234 {
+		t.Errorf("nick is %s at %d, wanted Guest1 at 1234", alice.User.DisplayNick,
+			alice.User.NickTS)
+	}
+	if cb.Nicks["guest1"] != alice.User.UID {
+		t.Errorf("new nick is not recorded")
+	}
+	if _, exists := cb.Nicks["alice"]; exists {
+		t.Errorf("old nick is still recorded")
+	}
+	if got := drainCommands(alice); len(got) != 1 || got[0] != "NICK Guest1" {
+		t.Errorf("user got %q", got)
+	}
+	if got := drainCommands(bob); len(got) != 1 || got[0] != "NICK Guest1" {
+		t.Errorf("channel member got %q", got)
+	}
+
+	// The NICK goes to every server. The ENCAP goes onward too.
+	wanted := []string{
+		string(alice.User.UID) + " NICK Guest1 1234",
+		"000 ENCAP * SVSNICK " + string(alice.User.UID) + " Guest1 1234",
+	}
+	if got := drainLink(link23); strings.Join(got, "\n") !=
+		strings.Join(wanted, "\n") {
+		t.Errorf("sent %q to server, wanted %q", got, wanted)
+	}
+	if got := drainLink(link21); len(got) != 1 || got[0] != wanted[0] {
+		t.Errorf("sent %q to source server, wanted %q", got, wanted[:1])
+	}
+
+	// The nick is in use.
+	svsnick(string(alice.User.UID), "bob")
+	if alice.User.DisplayNick != "Guest1" || cb.Nicks["bob"] != bob.User.UID {
+		t.Errorf("took a nick in use")
+	}
+
+	// An invalid nick.
+	svsnick(string(alice.User.UID), "#bad")
+	if alice.User.DisplayNick != "Guest1" {
+		t.Errorf("changed to an invalid nick")
+	}
+
+	// A remote user is for their server. We pass the ENCAP along.
+	_ = drainLink(link23)
+	svsnick("002AAAAAA", "Guest2")
+	if cb.Users["002AAAAAA"].DisplayNick != "carol" {
+		t.Errorf("changed a remote user's nick")
+	}
+	if got := drainLink(link23); len(got) != 1 ||
+		got[0] != "000 ENCAP * SVSNICK 002AAAAAA Guest2" {
+		t.Errorf("sent %q to server, wanted the ENCAP", got)
+	}
+}
+
+func TestEncapSVSJOIN(t *testing.T) {
+	cb := newTraceTestCatbox("irc2.example.com", "001")
+	cb.Channels = map[string]*Channel{}
+	link21 := addTraceTestLink(cb, 1, "irc1.example.com", "000")
+	link23 := addTraceTestLink(cb, 2, "irc3.example.com", "002")
+	cb.Users["002AAAAAA"] = &User{DisplayNick: "carol", UID: "002AAAAAA",
+		Channels: map[string]*Channel{}, ClosestServer: link23}
+	alice := addCallerIDTestUser(cb, 1, "alice")
+	bob := addCallerIDTestUser(cb, 2, "bob")
+
+	channel := &Channel{Name: "#test", TS: 100,
+		Members: map[TS6UID]struct{}{bob.User.UID: {}},
+		Ops:     map[TS6UID]*User{bob.User.UID: bob.User},
+		Modes:   map[byte]struct{}{'i': {}, 'n': {}}, Key: "secret", Limit: 1}
+	cb.Channels[channel.Name] = channel
+	bob.User.Channels[channel.Name] = channel
+
+	encap := func(params ...string) {
+		link21.encapCommand(irc.Message{Prefix: "000", Command: "ENCAP",
+			Params: append([]string{"*"}, params...)})
+	}
+
+	drainLink := func(link *LocalServer) []string {
+		var got []string
+		for len(link.WriteChan) > 0 {
+			m := (<-link.WriteChan).Message
+			got = append(got, m.Prefix+" "+m.Command+" "+strings.Join(m.Params, " "))
+		}
+		return got
+	}
+
+	// They join despite +i, +k, and +l.
+	encap("SVSJOIN", string(alice.User.UID), "#Test", "100")
+
+	if _, exists := channel.Members[alice.User.UID]; !exists {
+		t.Fatalf("user was not joined")
+	}
+	got := drainCommands(alice)
+	if len(got) < 3 || got[0] != "JOIN #test" ||
+		!strings.HasPrefix(got[len(got)-2], "353 alice = #test ") ||
+		got[len(got)-1] != "366 alice #test End of NAMES list" {
+		t.Errorf("user got %q", got)
+	}
+	if got := drainCommands(bob); len(got) != 1 || got[0] != "JOIN #test" {
+		t.Errorf("channel member got %q", got)
+	}
+	wanted := string(alice.User.UID) + " JOIN 100 #test +"
+	if got := drainLink(link21); len(got) != 1 || got[0] != wanted {
+		t.Errorf("sent %q to source server, wanted %s", got, wanted)
+	}
+	if got := drainLink(link23); len(got) != 2 || got[0] != wanted ||
+		!strings.Contains(got[1], " ENCAP * SVSJOIN ") {
+		t.Errorf("sent %q to server, wanted the JOIN and ENCAP", got)
+	}
+
+	// Joining again does nothing.
+	encap("SVSJOIN", string(alice.User.UID), "#test")
+	if got := drainCommands(alice); len(got) != 0 {
+		t.Errorf("joining again sent %q", got)
+	}
+	if got := drainLink(link21); len(got) != 0 {
+		t.Errorf("joining again sent %q to server", got)
+	}
+
+	// A channel that doesn't exist gets created.
+	encap("SVSJOIN", string(alice.User.UID), "#new")
+	if newChannel, exists := cb.Channels["#new"]; !exists ||
+		!newChannel.userHasOps(alice.User) {
+		t.Errorf("did not create the channel")
+	}
+	_ = drainCommands(alice)
+
+	// A remote user is for their server.
+	_ = drainLink(link23)
+	encap("SVSJOIN", "002AAAAAA", "#test")
+	if _, exists := channel.Members["002AAAAAA"]; exists {
+		t.Errorf("joined a remote user")
+	}
+	if got := drainLink(link23); len(got) != 1 ||
+		got[0] != "000 ENCAP * SVSJOIN 002AAAAAA #test" {
+		t.Errorf("sent %q to server, wanted the ENCAP", got)
+	}
+
+	// SVSPART.
+	_ = drainLink(link21)
+	encap("SVSPART", string(alice.User.UID), "#test", "Bye")
+	if _, exists := channel.Members[alice.User.UID]; exists {
+		t.Errorf("user is still on the channel")
+	}
+	if got := drainCommands(alice); len(got) != 1 || got[0] != "PART #test Bye" {
+		t.Errorf("user got %q", got)
+	}
+	wanted = string(alice.User.UID) + " PART #test Bye"
+	if got := drainLink(link21); len(got) != 1 || got[0] != wanted {
+		t.Errorf("sent %q to source server, wanted %s", got, wanted)
+	}
+
+	// Parting a channel they're not on does nothing.
+	encap("SVSPART", string(alice.User.UID), "#test")
+	if got := drainCommands(alice); len(got) != 0 {
+		t.Errorf("parting again sent %q", got)
+	}
+}
+
+func TestEncapSU(t *testing.T) {
+	cb := newTraceTestCatbox("irc2.example.com", "001")
+	link21 := addTraceTestLink(cb, 1, "irc1.example.com", "000")
+	alice := addCallerIDTestUser(cb, 1, "alice")
+
+	encap := func(params ...string) {
+		link21.encapCommand(irc.Message{Prefix: "000", Command: "ENCAP",
+			Params: append([]string{"*"}, params...)})
+	}
+
+	encap("SU", string(alice.User.UID), "alicesaccount")
+	if alice.User.Account != "alicesaccount" {
+		t.Errorf("account = %s, wanted alicesaccount", alice.User.Account)
+	}
+	if !alice.User.matchesBanMask("$a:alicesaccount") {
+		t.Errorf("user does not match account extended ban")
+	}
+
+	encap("SU", string(alice.User.UID))
+	if alice.User.Account != "" {
+		t.Errorf("account = %s, wanted none", alice.User.Account)
+	}
+
+	// Unknown users are ignored.
+	encap("SU", "000AAAAAZ", "someone")
+}
+
+func TestServerKickCommand(t *testing.T) {
+	cb := newTraceTestCatbox("irc2.example.com", "001")
+	cb.Channels = map[string]*Channel{}
+	link21 := addTraceTestLink(cb, 1, "irc1.example.com", "000")
+	link23 := addTraceTestLink(cb, 2, "irc3.example.com", "002")
+	alice := addCallerIDTestUser(cb, 3, "alice")
+	bob := addCallerIDTestUser(cb, 4, "bob")
+	carol := &User{DisplayNick: "carol", Username: "user",
+		Hostname: "remote.example.com", UID: "000AAAAAA",
+		Channels: map[string]*Channel{}, Server: link21.Server,
+		ClosestServer: link21}
+	cb.Users[carol.UID] = carol
+
+	channel := &Channel{Name: "#test", Members: map[TS6UID]struct{}{},
+		Ops: map[TS6UID]*User{carol.UID: carol}}
+	cb.Channels[channel.Name] = channel
+	for _, user := range []*User{alice.User, bob.User, carol} {
+		channel.Members[user.UID] = struct{}{}
+		user.Channels[channel.Name] = channel
+	}
+
+	m := irc.Message{Prefix: string(carol.UID), Command: "KICK",
+		Params: []string{"#test", string(alice.User.UID), "bye"}}
+	link21.kickCommand(m)
+
+	if alice.User.onChannel(channel) {
+		t.Errorf("alice is still on the channel")
+	}
+	for _, lu := range []*LocalUser{alice, bob} {
+		if got := drainCommands(lu); len(got) != 1 ||
+			got[0] != "KICK #test alice bye" {
+			t.Errorf("%s got %v, wanted KICK", lu.User.DisplayNick, got)
+		}
+	}
+
+	// It goes to the other server but not back.
+	if len(link21.WriteChan) != 0 {
+		t.Errorf("KICK went back to its origin")
+	}
+	if len(link23.WriteChan) != 1 {
+		t.Fatalf("KICK did not propagate")
+	}
+	if got := (<-link23.WriteChan).Message; got.Command != "KICK" ||
+		got.Prefix != string(carol.UID) {
+		t.Errorf("propagated %s", got)
+	}
+
+	// Servers (such as services) may kick too.
+	link21.kickCommand(irc.Message{Prefix: "000", Command: "KICK",
+		Params: []string{"#test", string(bob.User.UID)}})
+	if bob.User.onChannel(channel) {
+		t.Errorf("bob is still on the channel")
+	}
+	m2 := <-bob.WriteChan
+	if m2.Prefix != "irc1.example.com" || m2.Command != "KICK" {
+		t.Errorf("bob got %s, wanted KICK from server", m2.Message)
+	}
+}
+
+func TestServerKickCommandMultipleTargets(t *testing.T) {
+	cb := newTraceTestCatbox("irc2.example.com", "001")
+	cb.Channels = map[string]*Channel{}
+	link21 := addTraceTestLink(cb, 1, "irc1.example.com", "000")
+	link23 := addTraceTestLink(cb, 2, "irc3.example.com", "002")
+	alice := addCallerIDTestUser(cb, 3, "alice")
+	bob := addCallerIDTestUser(cb, 4, "bob")
+	carol := addCallerIDTestUser(cb, 5, "carol")
+
+	channel := &Channel{Name: "#test", Members: map[TS6UID]struct{}{},
+		Ops: map[TS6UID]*User{}}
+	cb.Channels[channel.Name] = channel
+	for _, lu := range []*LocalUser{alice, bob} {
+		channel.Members[lu.User.UID] = struct{}{}
+		lu.User.Channels[channel.Name] = channel
+	}
+
+	// Carol is not on the channel and 000AAAAAZ does not exist.
+	link21.kickCommand(irc.Message{Prefix: "000", Command: "KICK",
+		Params: []string{"#test", string(alice.User.UID) + ",000AAAAAZ," +
+			string(carol.User.UID) + "," + string(bob.User.UID), "bye"}})
+
+	if alice.User.onChannel(channel) || bob.User.onChannel(channel) {
+		t.Errorf("alice or bob is still on the channel")
+	}
+	if got := drainCommands(carol); len(got) != 0 {
+		t.Errorf("carol got %q", got)
+	}
+
+	// We send each on by itself.
+	for _, uid := range []TS6UID{alice.User.UID, bob.User.UID} {
+		if len(link23.WriteChan) == 0 {
+			t.Fatalf("KICK for %s did not propagate", uid)
+		}
+		m := (<-link23.WriteChan).Message
+		if got := m.Prefix + " " + m.Command + " " + strings.Join(m.Params, " "); got !=
+			"000 KICK #test "+string(uid)+" bye" {
+			t.Errorf("propagated %s", got)
+		}
+	}
+	if len(link23.WriteChan) != 0 || len(link21.WriteChan) != 0 {
+		t.Errorf("propagated extra messages")
+	}
+}
+
+func TestEncapConnect(t *testing.T) {
+	cb := newTraceTestCatbox("irc2.example.com", "001")
+	cb.Opers = map[TS6UID]*User{}
+	cb.Config.Servers = map[string]*ServerDefinition{
+		"irc1.example.com": {Name: "irc1.example.com", Port: 6667},
+	}
+	link21 := addTraceTestLink(cb, 1, "irc1.example.com", "000")
+	link23 := addTraceTestLink(cb, 2, "irc3.example.com", "002")
+	localOper := addCallerIDTestUser(cb, 3, "localoper")
+	localOper.User.Modes['o'] = struct{}{}
+	cb.Opers[localOper.User.UID] = localOper.User
+
+	oper := &User{DisplayNick: "oper", UID: "000AAAAAA",
+		Modes: map[byte]struct{}{'o': {}}, ClosestServer: link21}
+	cb.Users[oper.UID] = oper
+	user := &User{DisplayNick: "user", UID: "000AAAAAB",
+		Modes: map[byte]struct{}{}, ClosestServer: link21}
+	cb.Users[user.UID] = user
+
+	tests := []struct {
+		prefix string
+		params []string
+		notice []string
+	}{
+		// For another server. We pass it on without acting.
+		{string(oper.UID), []string{"irc3.example.com", "CONNECT",
+			"irc1.example.com", "0"}, nil},
+		{string(user.UID), []string{"irc2.example.com", "CONNECT",
+			"irc1.example.com", "0"},
+			[]string{"Ignoring CONNECT from user who is not an operator"}},
+		{string(oper.UID), []string{"irc2.example.com", "CONNECT",
+			"irc9.example.com", "7000"},
+			[]string{
+				"Remote CONNECT irc9.example.com 7000 from oper",
+				"Ignoring CONNECT from oper: No such server: irc9.example.com",
+			}},
+		{string(oper.UID), []string{"irc2.example.com", "CONNECT",
+			"irc1.example.com", "0"},
+			[]string{
+				"Remote CONNECT irc1.example.com 0 from oper",
+				"Ignoring CONNECT from oper: Already linked to irc1.example.com",
+			}},
+	}
+
+	for _, test := range tests {
+		link21.encapCommand(irc.Message{Prefix: test.prefix, Command: "ENCAP",
+			Params: test.params})
+
+		var got []string
+		for _, m := range drainCommands(localOper) {
+			got = append(got, strings.TrimPrefix(m,
+				"NOTICE localoper *** Notice --- "))
+		}
+		if strings.Join(got, "\n") != strings.Join(test.notice, "\n") {
+			t.Errorf("ENCAP %v: notices %q, wanted %q", test.params, got,
+				test.notice)
+		}
+
+		// It goes on toward irc3 only if it's for irc3.
+		wantIRC3 := 0
+		if test.params[0] == "irc3.example.com" {
+			wantIRC3 = 1
+		}
+		if len(link23.WriteChan) != wantIRC3 {
+			t.Errorf("ENCAP %v: sent %d messages to irc3, wanted %d", test.params,
+				len(link23.WriteChan), wantIRC3)
+		}
+		for len(link23.WriteChan) > 0 {
+			<-link23.WriteChan
+		}
+		for len(link21.WriteChan) > 0 {
+			<-link21.WriteChan
+		}
+	}
+}
+
+func TestLinkInfoWithPort(t *testing.T) {
+	linkInfo := &ServerDefinition{Name: "irc1.example.com", Port: 6667}
+
+	if got := linkInfoWithPort(linkInfo, 0); got != linkInfo {
+		t.Errorf("port 0 changed the link info")
+	}
+
+	got := linkInfoWithPort(linkInfo, 7000)
+	if got.Port != 7000 || got.Name != linkInfo.Name || linkInfo.Port != 6667 {
+		t.Errorf("linkInfoWithPort(7000) = %+v, config is %+v", got, linkInfo)
+	}
+}
+
+func TestSJOINModes(t *testing.T) {
+	tests := []struct {
+		name string
+
+		// The channel we have, if any.
+		existing *Channel
+
+		params []string
+
+		ts    int64
+		key   string
+		limit int
+		modes string
+
+		// The MODE our local member hears last.
+		mode string
+	}{
+		{
+			name:   "new channel with key",
+			params: []string{"100", "#test", "+nk", "secret", "001AAAAAA"},
+			ts:     100, key: "secret", modes: "+n",
+		},
+		{
+			name:   "new channel with limit",
+			params: []string{"100", "#test", "+l", "50", "001AAAAAA"},
+			ts:     100, limit: 50, modes: "+",
+		},
+		{
+			name: "new channel with key and limit",
+			params: []string{"100", "#test", "+nskl", "secret", "50",
+				"001AAAAAA"},
+			ts: 100, key: "secret", limit: 50, modes: "+ns",
+		},
+		{
+			name: "their TS is newer",
+			existing: &Channel{TS: 100, Key: "ours", Limit: 10,
+				Modes: map[byte]struct{}{'n': {}}},
+			params: []string{"200", "#test", "+skl", "theirs", "50", "001AAAAAA"},
+			ts:     100, key: "ours", limit: 10, modes: "+n",
+			mode: "JOIN #test",
+		},
+		{
+			name: "their TS is older",
+			existing: &Channel{TS: 200, Key: "ours", Limit: 10,
+				Modes: map[byte]struct{}{'n': {}}},
+			params: []string{"100", "#test", "+sl", "50", "001AAAAAA"},
+			ts:     100, limit: 50, modes: "+s",
+			mode: "MODE #test +o carol",
+		},
+		{
+			name: "same TS: greater key and higher limit win",
+			existing: &Channel{TS: 100, Key: "bbb", Limit: 10,
+				Modes: map[byte]struct{}{}},
+			params: []string{"100", "#test", "+kl", "aaa", "20", "001AAAAAA"},
+			ts:     100, key: "bbb", limit: 20, modes: "+",
+			mode: "MODE #test +o carol",
+		},
+		{
+			name: "same TS: their key wins",
+			existing: &Channel{TS: 100, Key: "bbb", Limit: 30,
+				Modes: map[byte]struct{}{}},
+			params: []string{"100", "#test", "+kl", "ccc", "20", "001AAAAAA"},
+			ts:     100, key: "ccc", limit: 30, modes: "+",
+			mode: "MODE #test +o carol",
+		},
+	}
+
+	for _, test := range tests {
+		cb := newTraceTestCatbox("irc1.example.com", "000")
+		cb.Channels = map[string]*Channel{}
+		link := addTraceTestLink(cb, 1, "irc2.example.com", "001")
+		carol := &User{DisplayNick: "carol", UID: "001AAAAAA",
+			Channels: map[string]*Channel{}, ClosestServer: link,
+			Server: link.Server}
+		cb.Users[carol.UID] = carol
+		alice := addCallerIDTestUser(cb, 2, "alice")
+
+		if test.existing != nil {
+			channel := test.existing
+			channel.Name = "#test"
+			channel.Members = map[TS6UID]struct{}{alice.User.UID: {}}
+			channel.Ops = map[TS6UID]*User{}
+			channel.Voices = map[TS6UID]*User{}
+			alice.User.Channels[channel.Name] = channel
+			cb.Channels[channel.Name] = channel
+		}
+
+		// Carol is an op on their side.
+		params := append([]string{}, test.params...)
+		params[len(params)-1] = "@" + params[len(params)-1]
+		link.sjoinCommand(irc.Message{Prefix: "001", Command: "SJOIN",
+			Params: params})
+
+		channel := cb.Channels["#test"]
+		if channel == nil {
+			t.Errorf("%s: no channel", test.name)
+			continue
+		}
+		if channel.TS != test.ts || channel.Key != test.key ||
+			channel.Limit != test.limit {
+			t.Errorf("%s: TS %d key %q limit %d, wanted %d %q %d", test.name,
+				channel.TS, channel.Key, channel.Limit, test.ts, test.key, test.limit)
+		}
+		if got := channel.modesString(); got != test.modes {
+			t.Errorf("%s: modes %s, wanted %s", test.name, got, test.modes)
+		}
+
+		got := drainCommands(alice)
+		if test.mode != "" && (len(got) == 0 || got[len(got)-1] != test.mode) {
+			t.Errorf("%s: alice got %q, wanted last %s", test.name, got, test.mode)
+		}
+	}
+}
+
+func TestApplySJOINModesTellsLocalUsers(t *testing.T) {
+	cb := newTraceTestCatbox("irc1.example.com", "000")
+	cb.Channels = map[string]*Channel{}
+	link := addTraceTestLink(cb, 1, "irc2.example.com", "001")
+	alice := addCallerIDTestUser(cb, 2, "alice")
+	carol := &User{DisplayNick: "carol", UID: "001AAAAAA",
+		Channels: map[string]*Channel{}, ClosestServer: link, Server: link.Server}
+	cb.Users[carol.UID] = carol
+
+	channel := &Channel{Name: "#test", TS: 100,
+		Members: map[TS6UID]struct{}{alice.User.UID: {}},
+		Ops:     map[TS6UID]*User{}, Voices: map[TS6UID]*User{},
+		Modes: map[byte]struct{}{}}
+	alice.User.Channels[channel.Name] = channel
+	cb.Channels[channel.Name] = channel
+
+	link.sjoinCommand(irc.Message{Prefix: "001", Command: "SJOIN",
+		Params: []string{"100", "#test", "+nkl", "secret", "5", "001AAAAAA"}})
+
+	got := drainCommands(alice)
+	if len(got) != 2 || got[0] != "MODE #test +nkl secret 5" ||
+		got[1] != "JOIN #test" {
+		t.Errorf("alice got %q", got)
+	}
+
+	// We send the key and limit in our SJOIN.
+	msgs, err := makeSJOINMessages("000", channel)
+	if err != nil {
+		t.Fatalf("makeSJOINMessages() = error %s", err)
+	}
+	if len(msgs) != 1 || strings.Join(msgs[0].Params[:5], " ") !=
+		"100 #test +nkl secret 5" {
+		t.Errorf("makeSJOINMessages() = %v", msgs)
+	}
+}
+
+func TestEncapInviteNotify(t *testing.T) {
+	cb := newSnapshotCatbox()
+	link := addTraceTestLink(cb, 10, "irc2.example.com", "001")
+	carol := addCallerIDTestUser(cb, 1, "carol")
+	carol.Caps = map[string]struct{}{"invite-notify": {}}
+	dave := addCallerIDTestUser(cb, 2, "dave")
+	dave.Caps = map[string]struct{}{}
+
+	// Alice invites bob. Both are on the other server.
+	alice := &User{DisplayNick: "alice", Username: "user",
+		Hostname: "remote.example.com", UID: "001AAAAAA",
+		Channels: map[string]*Channel{}, Server: link.Server,
+		ClosestServer: link}
+	bob := &User{DisplayNick: "bob", Username: "user",
+		Hostname: "remote.example.com", UID: "001AAAAAB",
+		Channels: map[string]*Channel{}, Server: link.Server,
+		ClosestServer: link}
+	cb.Users[alice.UID] = alice
+	cb.Users[bob.UID] = bob
+
+	channel := &Channel{
+		Name:    "#test",
+		Members: map[TS6UID]struct{}{},
+		Ops:     map[TS6UID]*User{alice.UID: alice},
+		Voices:  map[TS6UID]*User{},
+		Modes:   map[byte]struct{}{},
+		TS:      100,
+	}
+	cb.Channels[channel.Name] = channel
+	for _, user := range []*User{alice, carol.User, dave.User} {
+		channel.Members[user.UID] = struct{}{}
+		user.Channels[channel.Name] = channel
+	}
+
+	link.encapCommand(irc.Message{Prefix: string(alice.UID), Command: "ENCAP",
+		Params: []string{"*", "INVITE", string(bob.UID), "#test", "100"}})
+
+	if got := drainCommands(carol); len(got) != 1 || got[0] != "INVITE bob #test" {
+		t.Errorf("carol got %q", got)
+	}
+	if got := drainCommands(dave); len(got) != 0 {
+		t.Errorf("dave got %q", got)
+	}
+}
+
+func TestNetsplitNotifications(t *testing.T) {
+	cb := newSnapshotCatbox()
+	cb.Config.NetsplitNotifyOpers = true
+	cb.Config.NetsplitNotifyUsers = true
+	link := addTraceTestLink(cb, 10, "irc2.example.com", "001")
+	link.Bursting = true
+	irc3 := &Server{SID: "002", Name: "irc3.example.com", ClosestServer: link,
+		LinkedTo: link.Server}
+	cb.Servers[irc3.SID] = irc3
+
+	oper := addCallerIDTestUser(cb, 1, "oper")
+	oper.User.Modes['o'] = struct{}{}
+	cb.Opers[oper.User.UID] = oper.User
+	alice := addCallerIDTestUser(cb, 2, "alice")
+	carol := addCallerIDTestUser(cb, 3, "carol")
+
+	// bob is behind irc2 on irc3 and shares a channel with alice but not with
+	// carol.
+	bob := &User{DisplayNick: "bob", Username: "bob",
+		Hostname: "bob.example.com", UID: "002AAAAAA", Server: irc3,
+		ClosestServer: link, Channels: map[string]*Channel{},
+		Modes: map[byte]struct{}{}}
+	cb.Users[bob.UID] = bob
+	cb.Nicks["bob"] = bob.UID
+
+	channel := &Channel{Name: "#test", Members: map[TS6UID]struct{}{},
+		Ops: map[TS6UID]*User{}, Voices: map[TS6UID]*User{},
+		Modes: map[byte]struct{}{}}
+	cb.Channels[channel.Name] = channel
+	for _, u := range []*User{alice.User, bob} {
+		channel.Members[u.UID] = struct{}{}
+		u.Channels[channel.Name] = channel
+	}
+
+	link.endBurst()
+
+	wanted := "NOTICE oper *** Notice --- Netjoin irc.example.com irc2.example.com (1 users)"
+	if got := drainCommands(oper); len(got) != 2 || got[1] != wanted {
+		t.Errorf("oper got %q, wanted %s", got, wanted)
+	}
+	wanted = "NOTICE alice *** Notice --- Netjoin irc.example.com irc2.example.com"
+	if got := drainCommands(alice); len(got) != 1 || got[0] != wanted {
+		t.Errorf("alice got %q, wanted %s", got, wanted)
+	}
+	if got := drainCommands(carol); len(got) != 0 {
+		t.Errorf("carol got %q", got)
+	}
+
+	link.serverSplitCleanUp(irc3)
+
+	wanted = "NOTICE oper *** Notice --- Netsplit irc2.example.com irc3.example.com (1 users)"
+	if got := drainCommands(oper); len(got) != 1 || got[0] != wanted {
+		t.Errorf("oper got %q, wanted %s", got, wanted)
+	}
+	wantedAlice := []string{
+		"NOTICE alice *** Notice --- Netsplit irc2.example.com irc3.example.com",
+		"QUIT irc2.example.com irc3.example.com",
+	}
+	if got := drainCommands(alice); strings.Join(got, "\n") !=
+		strings.Join(wantedAlice, "\n") {
+		t.Errorf("alice got %q, wanted %q", got, wantedAlice)
+	}
+	if got := drainCommands(carol); len(got) != 0 {
+		t.Errorf("carol got %q", got)
+	}
+	if _, exists := cb.Users[bob.UID]; exists {
+		t.Errorf("bob is still here")
+	}
+
+	// Without the options, nobody hears about it.
+	cb.Config.NetsplitNotifyOpers = false
+	cb.Config.NetsplitNotifyUsers = false
+	cb.Users[bob.UID] = bob
+	bob.Server = link.Server
+	channel.Members[bob.UID] = struct{}{}
+	bob.Channels[channel.Name] = channel
+	link.serverSplitCleanUp(link.Server)
+	if got := drainCommands(oper); len(got) != 0 {
+		t.Errorf("oper got %q with notifications off", got)
+	}
+	if got := drainCommands(alice); len(got) != 1 || got[0] !=
+		"QUIT irc.example.com irc2.example.com" {
+		t.Errorf("alice got %q with notifications off", got)
+	}
+}
+
+// When a server splits, everyone lost with it quits with the names of the two
+// servers that split, wherever we are. The network is irc1 - irc2 - irc3 -
+// irc4 and irc3 splits from irc2.
+func TestSplitQuitMessage(t *testing.T) {
+	// addRemoteUser puts a remote user on a channel with alice.
+	addRemoteUser := func(cb *Catbox, alice *LocalUser, nick, uid string,
+		server *Server) *User {
+		user := &User{DisplayNick: nick, Username: "user",
+			Hostname: "host.example.com", UID: TS6UID(uid), Server: server,
+			ClosestServer: server.nextHop(), Channels: map[string]*Channel{},
+			Modes: map[byte]struct{}{}}
+		cb.Users[user.UID] = user
+		cb.Nicks[nick] = user.UID
+
+		channel, exists := cb.Channels["#test"]
+		if !exists {
+			channel = &Channel{Name: "#test", Members: map[TS6UID]struct{}{},
+				Ops: map[TS6UID]*User{}, Voices: map[TS6UID]*User{},
+				Modes: map[byte]struct{}{}}
+			cb.Channels[channel.Name] = channel
+			channel.Members[alice.User.UID] = struct{}{}
+			alice.User.Channels[channel.Name] = channel
+		}
+		channel.Members[user.UID] = struct{}{}
+		user.Channels[channel.Name] = channel
+		return user
+	}
+
+	wanted := []string{
+		"QUIT irc2.example.com irc3.example.com",
+		"QUIT irc2.example.com irc3.example.com",
+	}
+
+	// We're irc2 and irc3 is our link.
+	cb2 := newSnapshotCatbox()
+	cb2.Config.ServerName = "irc2.example.com"
+	cb2.Config.TS6SID = "001"
+	link21 := addTraceTestLink(cb2, 10, "irc1.example.com", "000")
+	link23 := addTraceTestLink(cb2, 11, "irc3.example.com", "002")
+	irc4 := &Server{SID: "003", Name: "irc4.example.com",
+		ClosestServer: link23, LinkedTo: link23.Server}
+	cb2.Servers[irc4.SID] = irc4
+	alice := addCallerIDTestUser(cb2, 1, "alice")
+	addRemoteUser(cb2, alice, "arthur", "000AAAAAA", link21.Server)
+	addRemoteUser(cb2, alice, "carol", "002AAAAAA", link23.Server)
+	addRemoteUser(cb2, alice, "dave", "003AAAAAA", irc4)
+
+	link23.serverSplitCleanUp(link23.Server)
+
+	if got := drainCommands(alice); strings.Join(got, "\n") !=
+		strings.Join(wanted, "\n") {
+		t.Errorf("on irc2 alice got %q, wanted %q", got, wanted)
+	}
+	if _, exists := cb2.Users["000AAAAAA"]; !exists {
+		t.Errorf("on irc2 we lost arthur")
+	}
+
+	// We're irc1 and irc3 is further away.
+	cb1 := newSnapshotCatbox()
+	cb1.Config.ServerName = "irc1.example.com"
+	link12 := addTraceTestLink(cb1, 10, "irc2.example.com", "001")
+	irc3 := &Server{SID: "002", Name: "irc3.example.com",
+		ClosestServer: link12, LinkedTo: link12.Server}
+	cb1.Servers[irc3.SID] = irc3
+	irc4 = &Server{SID: "003", Name: "irc4.example.com",
+		ClosestServer: link12, LinkedTo: irc3}
+	cb1.Servers[irc4.SID] = irc4
+	alice = addCallerIDTestUser(cb1, 1, "alice")
+	addRemoteUser(cb1, alice, "bob", "001AAAAAA", link12.Server)
+	addRemoteUser(cb1, alice, "carol", "002AAAAAA", irc3)
+	addRemoteUser(cb1, alice, "dave", "003AAAAAA", irc4)
+
+	link12.serverSplitCleanUp(irc3)
+
+	if got := drainCommands(alice); strings.Join(got, "\n") !=
+		strings.Join(wanted, "\n") {
+		t.Errorf("on irc1 alice got %q, wanted %q", got, wanted)
+	}
+	if _, exists := cb1.Users["001AAAAAA"]; !exists {
+		t.Errorf("on irc1 we lost bob")
+	}
+	if _, exists := cb1.Servers[irc4.SID]; exists {
+		t.Errorf("on irc1 we still know irc4")
+	}
+}
+
+// ENCAP goes only toward servers its destination matches, and we act on it
+// only if it matches us. The network is irc1 - irc2 - irc3 - irc4 with irc5
+// also linked to irc2, and we're irc2. An unknown SID goes nowhere and irc1
+// hears 402.
+func TestEncapRouting(t *testing.T) {
+	tests := []struct {
+		dest  string
+		forUs bool
+		irc1  int
+		irc3  int
+		irc5  int
+	}{
+		{"*", true, 0, 1, 1},
+		{"irc2.example.com", true, 0, 0, 0},
+		{"001", true, 0, 0, 0},
+		{"irc3.example.com", false, 0, 1, 0},
+		{"irc4.example.com", false, 0, 1, 0},
+		{"003", false, 0, 1, 0},
+		{"*.example.org", false, 0, 0, 1},
+		{"irc?.*", true, 0, 1, 1},
+		{"irc1.example.com", false, 0, 0, 0},
+		{"irc9.example.com", false, 0, 0, 0},
+		{"009", false, 1, 0, 0},
+	}
+
+	for _, test := range tests {
+		cb := newTraceTestCatbox("irc2.example.com", "001")
+		link21 := addTraceTestLink(cb, 1, "irc1.example.com", "000")
+		link23 := addTraceTestLink(cb, 2, "irc3.example.com", "002")
+		link25 := addTraceTestLink(cb, 3, "irc5.example.org", "004")
+		cb.Servers["003"] = &Server{SID: "003", Name: "irc4.example.com",
+			ClosestServer: link23, LinkedTo: link23.Server}
+
+		if got := cb.encapForUs(test.dest); got != test.forUs {
+			t.Errorf("encapForUs(%s) = %v, wanted %v", test.dest, got, test.forUs)
+		}
+
+		link21.encapCommand(irc.Message{Prefix: "000", Command: "ENCAP",
+			Params: []string{test.dest, "TESTCMD", "hi"}})
+
+		if len(link21.WriteChan) != test.irc1 || len(link23.WriteChan) != test.irc3 ||
+			len(link25.WriteChan) != test.irc5 {
+			t.Errorf("ENCAP %s: sent to irc1 %d (wanted %d), irc3 %d (wanted %d), irc5 %d (wanted %d)",
+				test.dest, len(link21.WriteChan), test.irc1, len(link23.WriteChan),
+				test.irc3, len(link25.WriteChan), test.irc5)
+			continue
+		}
+		if test.irc1 == 1 {
+			m := (<-link21.WriteChan).Message
+			if m.Prefix != "001" || m.Command != "402" ||
+				strings.Join(m.Params, " ") != "000 "+test.dest+" No such server" {
+				t.Errorf("ENCAP %s: told irc1 %s", test.dest, m)
+			}
+		}
+	}
+}
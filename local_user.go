@@ -2,8 +2,9 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -35,7 +36,30 @@ type LocalUser struct {
 	MessageCounter int
 
 	// MessageQueue holds queued messages from the client.
-	MessageQueue []irc.Message
+	MessageQueue []TaggedMessage
+
+	// The last time we told the client someone tried to message them while they
+	// have +g. We only tell them once per CallerIDNotifyInterval.
+	LastCallerIDNotifyTime time.Time
+
+	// The last time the user sent a GNOTICE. They may send one per
+	// GNOTICEInterval.
+	LastGNOTICETime time.Time
+
+	// We count batches we send the client to make their references.
+	NextBatchID uint64
+
+	// CertFP is the fingerprint of the TLS certificate the client presented. It
+	// is empty if they did not present one.
+	CertFP string
+
+	// The user config they matched when they registered, if any.
+	Config *UserConfig
+
+	// How many WHOIS queries the user made since WhoisWindowStart. We limit
+	// them to MaxWhoisPerMinute.
+	WhoisCount       int
+	WhoisWindowStart time.Time
 }
 
 // NewLocalUser makes a LocalUser from a LocalClient.
@@ -48,7 +72,7 @@ func NewLocalUser(c *LocalClient) *LocalUser {
 		LastPingTime:     now,
 		LastMessageTime:  now,
 		MessageCounter:   UserMessageLimit,
-		MessageQueue:     []irc.Message{},
+		MessageQueue:     []TaggedMessage{},
 	}
 
 	return u
@@ -60,6 +84,12 @@ func (u *LocalUser) String() string {
 
 // Message from this local user to another user, remote or local.
 func (u *LocalUser) messageUser(to *User, command string, params []string) {
+	if to.IsService {
+		u.Catbox.serviceCommand(u.User, irc.Message{Command: command,
+			Params: params})
+		return
+	}
+
 	if to.isLocal() {
 		to.LocalUser.maybeQueueMessage(irc.Message{
 			Prefix:  u.User.nickUhost(),
@@ -115,31 +145,62 @@ func (u *LocalUser) messageFromServer(command string, params []string) {
 // join tries to join the client to a channel.
 //
 // We've validated the name is valid and have canonicalized it.
-func (u *LocalUser) join(channelName string) {
+//
+// key is the key they gave. It may be blank.
+//
+// If force is true, we skip checking whether they may join. Services use this
+// to join users (SVSJOIN).
+//
+// If they already have ops in an existing channel, as with forceJoin, they
+// join with them.
+func (u *LocalUser) join(channelName, key string, force bool) {
 	// Is the client in the channel already? Ignore it if so.
 	if u.User.onChannel(&Channel{Name: channelName}) {
 		return
 	}
 
+	if !force && u.Config != nil && u.Config.MaxChannels > 0 &&
+		len(u.User.Channels) >= u.Config.MaxChannels {
+		// 405 ERR_TOOMANYCHANNELS
+		u.messageFromServer("405", []string{channelName,
+			"You have joined too many channels"})
+		return
+	}
+
 	// Look up the channel. Create it if necessary.
 	channel, channelExists := u.Catbox.Channels[channelName]
+	if channelExists && !force && !u.canJoin(channel, key) {
+		return
+	}
 	if !channelExists {
-		channel = &Channel{
-			Name:    channelName,
-			Members: make(map[TS6UID]struct{}),
-			Ops:     make(map[TS6UID]*User),
-			Modes:   make(map[byte]struct{}),
-			TS:      time.Now().Unix(),
+		// If we saved the channel's state before restarting, bring it back. It
+		// keeps its TS, modes, bans, and topic.
+		persistedChannel, persisted := u.Catbox.PersistedChannels[channelName]
+		if persisted {
+			channel = persistedChannel
+			delete(u.Catbox.PersistedChannels, channelName)
+		} else {
+			channel = &Channel{
+				Name:    channelName,
+				Members: make(map[TS6UID]struct{}),
+				Ops:     make(map[TS6UID]*User),
+				Modes:   make(map[byte]struct{}),
+				TS:      time.Now().Unix(),
+			}
+			channel.Modes['n'] = struct{}{}
+			channel.Modes['s'] = struct{}{}
+			u.Catbox.restoreTopic(channel)
 		}
 		u.Catbox.Channels[channelName] = channel
 		channel.grantOps(u.User)
-		channel.Modes['n'] = struct{}{}
-		channel.Modes['s'] = struct{}{}
 	}
 
-	// Add them to the channel.
+	withOps := channelExists && channel.userHasOps(u.User)
+
+	// Add them to the channel. They no longer need an invite.
 	channel.Members[u.User.UID] = struct{}{}
 	u.User.Channels[channelName] = channel
+	channel.removeInvite(u.User)
 
 	// Tell the client about the join.
 	// This is what RFC says to send: JOIN, RPL_TOPIC, and RPL_NAMREPLY.
@@ -147,9 +208,9 @@ func (u *LocalUser) join(channelName string) {
 	// JOIN comes from the client, to the client.
 	u.messageUser(u.User, "JOIN", []string{channel.Name})
 
-	// If this is a new channel, send them the modes we set by default.
-	if !channelExists {
-		u.messageFromServer("MODE", []string{channel.Name, "+ns"})
+	// If this is a new channel, send them the modes it has.
+	if !channelExists && len(channel.Modes) > 0 {
+		u.messageFromServer("MODE", []string{channel.Name, channel.modesString()})
 	}
 
 	// It appears RPL_TOPIC is optional, at least ircd-ratbox does always send it.
@@ -166,15 +227,88 @@ func (u *LocalUser) join(channelName string) {
 		})
 	}
 
+	u.sendNames(channel)
+
+	// Tell each member in the channel about the client.
+	// Only local clients. Servers will tell their own clients.
+	for memberUID := range channel.Members {
+		member := u.Catbox.Users[memberUID]
+		if !member.isLocal() {
+			continue
+		}
+
+		// Don't tell the client. We already did (above).
+		if member.UID == u.User.UID {
+			continue
+		}
+
+		// From the client to each member.
+		u.messageUser(member, "JOIN", []string{channel.Name})
+	}
+
+	if withOps {
+		u.Catbox.messageLocalUsersOnChannel(channel, irc.Message{
+			Prefix:  u.Catbox.Config.ServerName,
+			Command: "MODE",
+			Params:  []string{channel.Name, "+o", u.User.DisplayNick},
+		})
+	}
+
+	// Tell servers about this.
+	// If it's a new channel, then use SJOIN. If they join with ops, SJOIN too
+	// as JOIN can't say so. Otherwise JOIN.
+	for _, server := range u.Catbox.LocalServers {
+		if withOps {
+			server.maybeQueueMessage(irc.Message{
+				Prefix:  string(u.Catbox.Config.TS6SID),
+				Command: "SJOIN",
+				Params: []string{
+					fmt.Sprintf("%d", channel.TS),
+					channel.Name,
+					"+",
+					"@" + string(u.User.UID),
+				},
+			})
+			continue
+		}
+
+		if !channelExists {
+			server.maybeQueueMessage(irc.Message{
+				Prefix:  string(u.Catbox.Config.TS6SID),
+				Command: "SJOIN",
+				Params: []string{
+					fmt.Sprintf("%d", channel.TS),
+					channel.Name,
+					channel.modesString(),
+					"@" + string(u.User.UID),
+				},
+			})
+			u.Catbox.sendTopicBurst(server, channel)
+		} else {
+			server.maybeQueueMessage(irc.Message{
+				Prefix:  string(u.User.UID),
+				Command: "JOIN",
+				Params: []string{
+					fmt.Sprintf("%d", channel.TS),
+					channel.Name,
+					"+",
+				},
+			})
+		}
+	}
+}
+
+// sendNames sends 353 RPL_NAMREPLY listing the channel's members followed by
+// 366 RPL_ENDOFNAMES.
+func (u *LocalUser) sendNames(channel *Channel) {
 	// 353 RPL_NAMREPLY: This tells the client about who is in the channel
 	// (including itself).
 	// Format: :<server> 353 <targetNick> <channel flag> <#channel> :<nicks>
-	// <nicks> is a list of nicknames in the channel. Each is prefixed with @
-	// or + to indicate opped/voiced). Apparently only one or the other.
+	// <nicks> is a list of nicknames in the channel. Each is prefixed with ~, @,
+	// or + to indicate owner/opped/voiced). Apparently only one of them.
 
 	// Channel flag: = (public), * (private), @ (secret)
-	// When we have more chan modes (-s / +p) this needs to vary
-	channelFlag := "@"
+	channelFlag := channel.namesFlag()
 
 	// We put as many nicks per line as possible.
 
@@ -192,7 +326,7 @@ func (u *LocalUser) join(channelName string) {
 	// point continuing.
 	messageBuf, err := namMessage.Encode()
 	if err != nil {
-		log.Printf("Unable to generate RPL_NAMREPLY: %s", err)
+		u.Catbox.Logger.Error("Unable to generate RPL_NAMREPLY: %s", err)
 		return
 	}
 
@@ -203,10 +337,7 @@ func (u *LocalUser) join(channelName string) {
 		member := u.Catbox.Users[memberUID]
 
 		// We send the nick with its mode prefix.
-		sendNick := member.DisplayNick
-		if channel.userHasOps(member) {
-			sendNick = "@" + sendNick
-		}
+		sendNick := channel.membershipPrefix(member) + member.DisplayNick
 
 		// Assume 1 nick will always be okay to send.
 		if len(nicks) == 0 {
@@ -234,50 +365,52 @@ func (u *LocalUser) join(channelName string) {
 
 	// 366 RPL_ENDOFNAMES: Ends NAMES list.
 	u.messageFromServer("366", []string{channel.Name, "End of NAMES list"})
+}
 
-	// Tell each member in the channel about the client.
-	// Only local clients. Servers will tell their own clients.
-	for memberUID := range channel.Members {
-		member := u.Catbox.Users[memberUID]
-		if !member.isLocal() {
-			continue
-		}
+// forceJoin joins the user to a channel and gives them ops. It skips every
+// check on whether they may join (+i, +k, +l, and +b). Opers use this through
+// OJOIN and OPME.
+func (u *LocalUser) forceJoin(channel *Channel) {
+	if u.User.onChannel(channel) {
+		return
+	}
 
-		// Don't tell the client. We already did (above).
-		if member.UID == u.User.UID {
-			continue
-		}
+	channel.grantOps(u.User)
+	u.join(channel.Name, "", true)
+}
 
-		// From the client to each member.
-		u.messageUser(member, "JOIN", []string{channel.Name})
+// canJoin checks whether the channel's modes let the user join. If not, we
+// tell them why.
+func (u *LocalUser) canJoin(channel *Channel, key string) bool {
+	if channel.isInviteOnly() && !channel.isInvited(u.User) {
+		// 473 ERR_INVITEONLYCHAN
+		u.messageFromServer("473", []string{channel.Name,
+			"Cannot join channel (+i)"})
+		return false
 	}
 
-	// Tell servers about this.
-	// If it's a new channel, then use SJOIN. Otherwise JOIN.
-	for _, server := range u.Catbox.LocalServers {
-		if !channelExists {
-			server.maybeQueueMessage(irc.Message{
-				Prefix:  string(u.Catbox.Config.TS6SID),
-				Command: "SJOIN",
-				Params: []string{
-					fmt.Sprintf("%d", channel.TS),
-					channel.Name,
-					"+ns",
-					"@" + string(u.User.UID),
-				},
-			})
-		} else {
-			server.maybeQueueMessage(irc.Message{
-				Prefix:  string(u.User.UID),
-				Command: "JOIN",
-				Params: []string{
-					fmt.Sprintf("%d", channel.TS),
-					channel.Name,
-					"+",
-				},
-			})
-		}
+	if channel.Key != "" && key != channel.Key {
+		// 475 ERR_BADCHANNELKEY
+		u.messageFromServer("475", []string{channel.Name,
+			"Cannot join channel (+k)"})
+		return false
+	}
+
+	if channel.Limit > 0 && len(channel.Members) >= channel.Limit {
+		// 471 ERR_CHANNELISFULL
+		u.messageFromServer("471", []string{channel.Name,
+			"Cannot join channel (+l)"})
+		return false
 	}
+
+	if channel.isBanned(u.User) {
+		// 474 ERR_BANNEDFROMCHAN
+		u.messageFromServer("474", []string{channel.Name,
+			"Cannot join channel (+b)"})
+		return false
+	}
+
+	return true
 }
 
 // part tries to remove the client from the channel.
@@ -362,7 +495,7 @@ func (u *LocalUser) quit(msg string, propagate bool) {
 	if _, exists := u.Catbox.LocalUsers[u.ID]; !exists {
 		return
 	}
-	log.Printf("Losing user %s", u)
+	u.Catbox.Logger.Info("Losing user %s", u)
 
 	// Tell all clients the client is in the channel with, and remove the client
 	// from each channel it is in.
@@ -419,6 +552,14 @@ func (u *LocalUser) quit(msg string, propagate bool) {
 
 	close(u.WriteChan)
 
+	entry := u.accessLogEntry("disconnect")
+	entry.Reason = msg
+	u.Catbox.logAccess(entry)
+
+	u.Catbox.notifyWatchers(u.User, false)
+	u.Catbox.holdNick(u.User.DisplayNick, time.Now())
+
+	u.Catbox.forgetInvites(u.User)
 	delete(u.Catbox.Nicks, canonicalizeNick(u.User.DisplayNick))
 	delete(u.Catbox.LocalUsers, u.ID)
 	if u.User.isOperator() {
@@ -427,6 +568,23 @@ func (u *LocalUser) quit(msg string, propagate bool) {
 	delete(u.Catbox.Users, u.User.UID)
 }
 
+// killed disconnects the user because they were killed. Before the ERROR that
+// closes their connection we send them the KILL so they see who killed them
+// and why.
+//
+// source is the killer's nick!user@host, or a server name. We don't propagate
+// a QUIT as the KILL goes to every server.
+func (u *LocalUser) killed(source, killerName, message string) {
+	u.maybeQueueMessage(irc.Message{
+		Prefix:  source,
+		Command: "KILL",
+		Params: []string{u.User.DisplayNick,
+			fmt.Sprintf("%s (%s)", killerName, message)},
+	})
+
+	u.quit(fmt.Sprintf("Killed (%s (%s))", killerName, message), false)
+}
+
 // Set the user away. We've been given a non-blank message.
 func (u *LocalUser) setAway(message string) {
 	// Flag him as being away
@@ -449,6 +607,8 @@ func (u *LocalUser) setAway(message string) {
 			Params:  []string{message},
 		})
 	}
+
+	u.Catbox.notifyWatchersAway(u.User)
 }
 
 // Set the user back from away.
@@ -479,10 +639,13 @@ func (u *LocalUser) setUnaway() {
 			Params:  []string{},
 		})
 	}
+
+	u.Catbox.notifyWatchersAway(u.User)
 }
 
-// The user sent us a message. Deal with it.
-func (u *LocalUser) handleMessage(m irc.Message) {
+// The user sent us a message. Deal with it. tags are any IRCv3 message tags
+// they sent with it.
+func (u *LocalUser) handleMessage(m irc.Message, tags map[string]string) {
 	// Record that client said something to us just now.
 	u.LastActivityTime = time.Now()
 
@@ -495,14 +658,16 @@ func (u *LocalUser) handleMessage(m irc.Message) {
 
 	// Flood protection. If we've used all our available message space for now,
 	// queue it.
-	if !u.User.isFloodExempt() {
+	if !u.User.isFloodExempt(u.Catbox.Config.FloodExempt) {
 		if u.MessageCounter == 0 {
-			log.Printf("%s is flooding. Queueing their message.", u.User.DisplayNick)
-			u.MessageQueue = append(u.MessageQueue, m)
+			u.Catbox.Logger.Debug("%s is flooding. Queueing their message.", u.User.DisplayNick)
+			u.MessageQueue = append(u.MessageQueue, TaggedMessage{Message: m,
+				Tags: tags})
 
 			// Check for overwhelming their queue and disconnect them if so.
-			if len(u.MessageQueue) >= ExcessFloodThreshold {
-				u.quit("Excess flood", true)
+			class := u.Catbox.Config.connClass(u.User.Class)
+			if len(u.MessageQueue) >= class.MaxRecvQ {
+				u.Catbox.floodKLine(u)
 				return
 			}
 
@@ -511,9 +676,8 @@ func (u *LocalUser) handleMessage(m irc.Message) {
 		u.MessageCounter--
 	}
 
-	// Non-RFC command that appears to be widely supported. Just ignore it for
-	// now.
 	if m.Command == "CAP" {
+		u.capCommand(m, u.User.DisplayNick, true)
 		return
 	}
 
@@ -532,17 +696,37 @@ func (u *LocalUser) handleMessage(m irc.Message) {
 		return
 	}
 
+	if m.Command == "CHATHISTORY" {
+		u.chathistoryCommand(m)
+		return
+	}
+
+	if m.Command == "METADATA" {
+		u.metadataCommand(m)
+		return
+	}
+
 	if m.Command == "PART" {
 		u.partCommand(m)
 		return
 	}
 
+	if m.Command == "KICK" {
+		u.kickCommand(m)
+		return
+	}
+
 	// Per RFC these commands are near identical.
 	if m.Command == "PRIVMSG" || m.Command == "NOTICE" {
 		u.privmsgCommand(m)
 		return
 	}
 
+	if m.Command == "TAGMSG" {
+		u.tagmsgCommand(m, tags)
+		return
+	}
+
 	if m.Command == "LUSERS" {
 		u.lusersCommand()
 		return
@@ -553,6 +737,31 @@ func (u *LocalUser) handleMessage(m irc.Message) {
 		return
 	}
 
+	if m.Command == "RULES" {
+		u.rulesCommand()
+		return
+	}
+
+	if m.Command == "HELP" || m.Command == "HELPOP" {
+		u.helpCommand(m)
+		return
+	}
+
+	if m.Command == "WATCH" {
+		u.watchCommand(m)
+		return
+	}
+
+	if m.Command == "ACCEPT" {
+		u.acceptCommand(m)
+		return
+	}
+
+	if m.Command == "FINGERPRINT" {
+		u.fingerprintCommand()
+		return
+	}
+
 	if m.Command == "QUIT" {
 		u.quitCommand(m)
 		return
@@ -588,6 +797,11 @@ func (u *LocalUser) handleMessage(m irc.Message) {
 		return
 	}
 
+	if m.Command == "CHALLENGE" {
+		u.challengeCommand(m)
+		return
+	}
+
 	if m.Command == "MODE" {
 		u.modeCommand(m)
 		return
@@ -598,6 +812,16 @@ func (u *LocalUser) handleMessage(m irc.Message) {
 		return
 	}
 
+	if m.Command == "NAMES" {
+		u.namesCommand(m)
+		return
+	}
+
+	if m.Command == "LIST" {
+		u.listCommand(m)
+		return
+	}
+
 	if m.Command == "TOPIC" {
 		u.topicCommand(m)
 		return
@@ -608,6 +832,16 @@ func (u *LocalUser) handleMessage(m irc.Message) {
 		return
 	}
 
+	if m.Command == "OPERS" {
+		u.opersCommand(m)
+		return
+	}
+
+	if m.Command == "TRACE" {
+		u.traceCommand(m)
+		return
+	}
+
 	if m.Command == "LINKS" {
 		u.linksCommand(m)
 		return
@@ -618,6 +852,11 @@ func (u *LocalUser) handleMessage(m irc.Message) {
 		return
 	}
 
+	if m.Command == "GNOTICE" {
+		u.gnoticeCommand(m)
+		return
+	}
+
 	if m.Command == "KILL" {
 		u.killCommand(m)
 		return
@@ -633,6 +872,41 @@ func (u *LocalUser) handleMessage(m irc.Message) {
 		return
 	}
 
+	if m.Command == "XLINE" {
+		u.xlineCommand(m)
+		return
+	}
+
+	if m.Command == "UNXLINE" {
+		u.unxlineCommand(m)
+		return
+	}
+
+	if m.Command == "DLINE" {
+		u.dlineCommand(m)
+		return
+	}
+
+	if m.Command == "UNDLINE" {
+		u.undlineCommand(m)
+		return
+	}
+
+	if m.Command == "GLINE" {
+		u.glineCommand(m)
+		return
+	}
+
+	if m.Command == "UNGLINE" {
+		u.unglineCommand(m)
+		return
+	}
+
+	if m.Command == "CHANREG" {
+		u.chanregCommand(m)
+		return
+	}
+
 	if m.Command == "STATS" {
 		u.statsCommand(m)
 		return
@@ -673,16 +947,51 @@ func (u *LocalUser) handleMessage(m irc.Message) {
 		return
 	}
 
+	if m.Command == "INVITELIST" {
+		u.invitelistCommand(m)
+		return
+	}
+
 	if m.Command == "OPME" {
 		u.opmeCommand(m)
 		return
 	}
 
+	if m.Command == "OJOIN" {
+		u.ojoinCommand(m)
+		return
+	}
+
 	if m.Command == "SQUIT" {
 		u.squitCommand(m)
 		return
 	}
 
+	if m.Command == "SUMMON" {
+		u.summonCommand(m)
+		return
+	}
+
+	if m.Command == "USERS" {
+		u.usersCommand(m)
+		return
+	}
+
+	if m.Command == "SERVICE" {
+		u.serviceCommand(m)
+		return
+	}
+
+	if m.Command == "SQUERY" {
+		u.squeryCommand(m)
+		return
+	}
+
+	if m.Command == "SERVLIST" {
+		u.servlistCommand(m)
+		return
+	}
+
 	// Unknown command. We don't handle it yet anyway.
 	// 421 ERR_UNKNOWNCOMMAND
 	u.messageFromServer("421", []string{m.Command, "Unknown command"})
@@ -705,7 +1014,8 @@ func (u *LocalUser) nickCommand(m irc.Message) {
 		nick = nick[0:u.Catbox.Config.MaxNickLength]
 	}
 
-	if !isValidNick(u.Catbox.Config.MaxNickLength, nick) {
+	if !isValidNick(u.Catbox.Config.MaxNickLength, u.Catbox.NickValidator,
+		nick) {
 		// 432 ERR_ERRONEUSNICKNAME
 		u.messageFromServer("432", []string{nick, "Erroneous nickname"})
 		return
@@ -729,8 +1039,26 @@ func (u *LocalUser) nickCommand(m irc.Message) {
 			u.messageFromServer("433", []string{nick, "Nickname is already in use"})
 			return
 		}
+
+		// Opers may take a held nick.
+		if !u.User.isOperator() && u.Catbox.isNickHeld(newNickCanon, time.Now()) {
+			// 433 ERR_NICKNAMEINUSE
+			u.messageFromServer("433", []string{nick,
+				"Nickname is temporarily unavailable"})
+			return
+		}
 	}
 
+	u.changeNick(nick, time.Now().Unix())
+}
+
+// changeNick changes the user's nick and tells everyone who needs to know.
+//
+// The nick must be valid and not in use by anyone else.
+func (u *LocalUser) changeNick(nick string, nickTS int64) {
+	newNickCanon := canonicalizeNick(nick)
+	oldNickCanon := canonicalizeNick(u.User.DisplayNick)
+
 	// Free the old nick.
 	delete(u.Catbox.Nicks, oldNickCanon)
 
@@ -738,7 +1066,7 @@ func (u *LocalUser) nickCommand(m irc.Message) {
 	u.Catbox.Nicks[newNickCanon] = u.User.UID
 
 	// Nick TS changes when nick is set.
-	u.User.NickTS = time.Now().Unix()
+	u.User.NickTS = nickTS
 
 	// We need to inform other clients about the nick change.
 	// Any that are in the same channel as this client.
@@ -770,10 +1098,18 @@ func (u *LocalUser) nickCommand(m irc.Message) {
 		u.messageUser(u.User, "NICK", []string{nick})
 	}
 
+	if newNickCanon != oldNickCanon {
+		u.Catbox.notifyWatchers(u.User, false)
+	}
+
 	// Finally, make the update. Do this last as we need to ensure we act as the
 	// old nick when crafting messages.
 	u.User.DisplayNick = nick
 
+	if newNickCanon != oldNickCanon {
+		u.Catbox.notifyWatchers(u.User, true)
+	}
+
 	// Propagate to servers.
 	for _, server := range u.Catbox.LocalServers {
 		server.maybeQueueMessage(irc.Message{
@@ -807,19 +1143,39 @@ func (u *LocalUser) joinCommand(m irc.Message) {
 		return
 	}
 
-	// May have multiple channels in a single command.
-	channels := commaChannelsToChannelNames(m.Params[0])
+	// May have multiple channels in a single command. Keys match up with
+	// channels by position, so we can't use commaChannelsToChannelNames() as
+	// it does not keep the order.
+	var keys []string
+	if len(m.Params) > 1 {
+		keys = strings.Split(m.Params[1], ",")
+	}
 
-	// We could support keys.
+	seen := make(map[string]struct{})
 
 	// Try to join the client to the channels.
-	for _, channelName := range channels {
-		u.join(channelName)
-	}
-}
-
-func (u *LocalUser) partCommand(m irc.Message) {
-	// Parameters: <channel> *( "," <channel> ) [ <Part Message> ]
+	for i, rawChannelName := range strings.Split(m.Params[0], ",") {
+		channelName := canonicalizeChannel(strings.TrimSpace(rawChannelName))
+		if !isValidChannel(channelName) {
+			continue
+		}
+
+		if _, ok := seen[channelName]; ok {
+			continue
+		}
+		seen[channelName] = struct{}{}
+
+		key := ""
+		if i < len(keys) {
+			key = keys[i]
+		}
+
+		u.join(channelName, key, false)
+	}
+}
+
+func (u *LocalUser) partCommand(m irc.Message) {
+	// Parameters: <channel> *( "," <channel> ) [ <Part Message> ]
 
 	if len(m.Params) == 0 {
 		// 461 ERR_NEEDMOREPARAMS
@@ -829,7 +1185,8 @@ func (u *LocalUser) partCommand(m irc.Message) {
 
 	partMessage := ""
 	if len(m.Params) >= 2 {
-		partMessage = m.Params[1]
+		partMessage = truncateText(m.Params[1],
+			u.Catbox.Config.MaxPartLength)
 	}
 
 	// May have multiple channels in a single command.
@@ -840,6 +1197,99 @@ func (u *LocalUser) partCommand(m irc.Message) {
 	}
 }
 
+// kickCommand lets a channel operator remove users from the channel.
+func (u *LocalUser) kickCommand(m irc.Message) {
+	// Parameters: <channel> <nick>[,<nick>...] [reason]
+
+	if len(m.Params) < 2 {
+		// 461 ERR_NEEDMOREPARAMS
+		u.messageFromServer("461", []string{"KICK", "Not enough parameters"})
+		return
+	}
+
+	channelName := canonicalizeChannel(m.Params[0])
+	channel, exists := u.Catbox.Channels[channelName]
+	if !exists {
+		// 403 ERR_NOSUCHCHANNEL
+		u.messageFromServer("403", []string{channelName, "No such channel"})
+		return
+	}
+
+	if !u.User.onChannel(channel) {
+		// 442 ERR_NOTONCHANNEL
+		u.messageFromServer("442", []string{channel.Name,
+			"You're not on that channel"})
+		return
+	}
+
+	if !channel.userHasOps(u.User) && !channel.userIsHalfOp(u.User) {
+		// 482 ERR_CHANOPRIVSNEEDED
+		u.messageFromServer("482", []string{channel.Name,
+			"You're not channel operator"})
+		return
+	}
+
+	reason := u.User.DisplayNick
+	if len(m.Params) > 2 && m.Params[2] != "" {
+		reason = m.Params[2]
+	}
+	reason = truncateText(reason, u.Catbox.Config.MaxKickLength)
+
+	// RFC 2812 permits several nicks separated by commas. We kick each in
+	// turn.
+	for _, nick := range strings.Split(m.Params[1], ",") {
+		if nick == "" {
+			continue
+		}
+
+		// They may have kicked themself.
+		if !u.User.onChannel(channel) {
+			return
+		}
+
+		u.kick(channel, nick, reason)
+	}
+}
+
+// kick removes one user from the channel on behalf of a KICK. The caller
+// checked that we may kick from the channel.
+func (u *LocalUser) kick(channel *Channel, nick, reason string) {
+	target := u.Catbox.userByNick(nick)
+	if target == nil {
+		// 401 ERR_NOSUCHNICK
+		u.messageFromServer("401", []string{nick, "No such nick/channel"})
+		return
+	}
+
+	if !target.onChannel(channel) {
+		// 441 ERR_USERNOTINCHANNEL
+		u.messageFromServer("441", []string{target.DisplayNick, channel.Name,
+			"They aren't on that channel"})
+		return
+	}
+
+	// Half-ops may kick only users below them.
+	if !channel.userHasOps(u.User) &&
+		(channel.userHasOps(target) || channel.userIsHalfOp(target)) {
+		// 482 ERR_CHANOPRIVSNEEDED
+		u.messageFromServer("482", []string{channel.Name,
+			"You're not channel operator"})
+		return
+	}
+
+	// Tell all servers. Channel membership is known globally, so every server
+	// removes them, including the target's.
+	for _, server := range u.Catbox.LocalServers {
+		server.maybeQueueMessage(irc.Message{
+			Prefix:  string(u.User.UID),
+			Command: "KICK",
+			Params:  []string{channel.Name, string(target.UID), reason},
+		})
+	}
+
+	u.Catbox.kickUser(u.User.nickUhost(), channel, target, reason)
+}
+
 // Per RFC 2812, PRIVMSG and NOTICE are essentially the same, so both PRIVMSG
 // and NOTICE use this command function.
 func (u *LocalUser) privmsgCommand(m irc.Message) {
@@ -863,6 +1313,28 @@ func (u *LocalUser) privmsgCommand(m irc.Message) {
 
 	msg := m.Params[1]
 
+	// A server mask. Operators may message every user on the servers matching
+	// it.
+	if target[0] == '$' {
+		if !u.User.isOperator() {
+			// 481 ERR_NOPRIVILEGES
+			u.messageFromServer("481", []string{"Permission Denied- You're not an IRC operator"})
+			return
+		}
+
+		u.LastMessageTime = time.Now()
+
+		if !u.Catbox.serverMaskMessage(u.User.nickUhost(), irc.Message{
+			Prefix:  string(u.User.UID),
+			Command: m.Command,
+			Params:  []string{target, msg},
+		}, nil) {
+			// 401 ERR_NOSUCHNICK
+			u.messageFromServer("401", []string{target, "No such nick/channel"})
+		}
+		return
+	}
+
 	// Are we messaging a channel? Note I only support # channels right now.
 	if target[0] == '#' {
 		channelName := canonicalizeChannel(target)
@@ -888,6 +1360,26 @@ func (u *LocalUser) privmsgCommand(m irc.Message) {
 			return
 		}
 
+		// Banned users can't speak.
+		if !channel.canSpeak(u.User) {
+			// 404 ERR_CANNOTSENDTOCHAN
+			u.messageFromServer("404", []string{channelName, "Cannot send to channel"})
+			return
+		}
+
+		if channel.stripsColors() {
+			msg = stripColors(msg)
+			if msg == "" {
+				// 412 ERR_NOTEXTTOSEND
+				u.messageFromServer("412", []string{"No text to send"})
+				return
+			}
+		}
+
+		if !u.checkSpamFilters(channel, msg) {
+			return
+		}
+
 		u.LastMessageTime = time.Now()
 
 		// Send to all members of the channel. Except the client itself it seems.
@@ -907,6 +1399,10 @@ func (u *LocalUser) privmsgCommand(m irc.Message) {
 				continue
 			}
 
+			if member.IsService {
+				continue
+			}
+
 			toServers[member.ClosestServer] = struct{}{}
 		}
 
@@ -919,13 +1415,21 @@ func (u *LocalUser) privmsgCommand(m irc.Message) {
 			})
 		}
 
+		channel.addHistory(&HistoryEntry{
+			Time:    u.LastMessageTime,
+			Prefix:  u.User.nickUhost(),
+			Command: m.Command,
+			Params:  []string{channel.Name, msg},
+		}, u.Catbox.Config.HistorySize)
+
 		return
 	}
 
 	// We're messaging a nick directly.
 
 	nickName := canonicalizeNick(target)
-	if !isValidNick(u.Catbox.Config.MaxNickLength, nickName) {
+	if !isValidNick(u.Catbox.Config.MaxNickLength, u.Catbox.NickValidator,
+		nickName) {
 		// 401 ERR_NOSUCHNICK
 		u.messageFromServer("401", []string{nickName, "No such nick/channel"})
 		return
@@ -941,6 +1445,19 @@ func (u *LocalUser) privmsgCommand(m irc.Message) {
 
 	u.LastMessageTime = time.Now()
 
+	if targetUser.IsService {
+		u.Catbox.serviceCommand(u.User, irc.Message{Command: m.Command,
+			Params: []string{string(targetUser.UID), msg}})
+		return
+	}
+
+	if targetUser.isLocal() && !targetUser.acceptsMessagesFrom(u.User) {
+		if m.Command == "PRIVMSG" {
+			u.Catbox.callerIDReject(u.User, targetUser)
+		}
+		return
+	}
+
 	if targetUser.isLocal() {
 		u.messageUser(targetUser, m.Command, []string{nickName, msg})
 	} else {
@@ -962,17 +1479,91 @@ func (u *LocalUser) privmsgCommand(m irc.Message) {
 	}
 }
 
+// tagmsgCommand handles TAGMSG. This is a message with only tags. We pass on
+// the client-only tags to local users with the message-tags capability.
+//
+// Other servers don't know about tags so we don't send it to them.
+func (u *LocalUser) tagmsgCommand(m irc.Message, tags map[string]string) {
+	// Parameters: <msgtarget>
+	if !u.hasCap("message-tags") {
+		// 421 ERR_UNKNOWNCOMMAND
+		u.messageFromServer("421", []string{m.Command, "Unknown command"})
+		return
+	}
+
+	if len(m.Params) == 0 {
+		// 411 ERR_NORECIPIENT
+		u.messageFromServer("411", []string{"No recipient given (TAGMSG)"})
+		return
+	}
+
+	target := m.Params[0]
+	relayTags := clientTags(tags)
+
+	if target[0] == '#' {
+		channelName := canonicalizeChannel(target)
+		channel, exists := u.Catbox.Channels[channelName]
+		if !exists {
+			// 403 ERR_NOSUCHCHANNEL
+			u.messageFromServer("403", []string{channelName, "No such channel"})
+			return
+		}
+
+		if !u.User.onChannel(channel) || !channel.canSpeak(u.User) {
+			// 404 ERR_CANNOTSENDTOCHAN
+			u.messageFromServer("404", []string{channelName, "Cannot send to channel"})
+			return
+		}
+
+		for memberUID := range channel.Members {
+			member := u.Catbox.Users[memberUID]
+			if member.UID == u.User.UID || !member.isLocal() ||
+				!member.LocalUser.hasCap("message-tags") {
+				continue
+			}
+
+			member.LocalUser.maybeQueueTaggedMessage(irc.Message{
+				Prefix:  u.User.nickUhost(),
+				Command: "TAGMSG",
+				Params:  []string{channel.Name},
+			}, relayTags)
+		}
+		return
+	}
+
+	targetUID, exists := u.Catbox.Nicks[canonicalizeNick(target)]
+	if !exists {
+		// 401 ERR_NOSUCHNICK
+		u.messageFromServer("401", []string{target, "No such nick/channel"})
+		return
+	}
+	targetUser := u.Catbox.Users[targetUID]
+
+	if !targetUser.isLocal() || !targetUser.LocalUser.hasCap("message-tags") ||
+		!targetUser.acceptsMessagesFrom(u.User) {
+		return
+	}
+
+	targetUser.LocalUser.maybeQueueTaggedMessage(irc.Message{
+		Prefix:  u.User.nickUhost(),
+		Command: "TAGMSG",
+		Params:  []string{targetUser.DisplayNick},
+	}, relayTags)
+}
+
 func (u *LocalUser) lusersCommand() {
 	// We always send RPL_LUSERCLIENT and RPL_LUSERME.
 	// The others only need be sent if the counts are non-zero.
 
+	// The maximums should never be below the current counts.
+	u.Catbox.updateCounters()
+
 	// 251 RPL_LUSERCLIENT
 	u.messageFromServer("251", []string{
 		fmt.Sprintf("There are %d users and %d services on %d servers.",
-			len(u.Catbox.Users),
-			0,
-			// +1 to count ourself.
-			len(u.Catbox.Servers)+1),
+			u.Catbox.userCount(),
+			u.Catbox.serviceCount(),
+			u.Catbox.globalServerCount()),
 	})
 
 	// 252 RPL_LUSEROP
@@ -1010,25 +1601,26 @@ func (u *LocalUser) lusersCommand() {
 	}
 
 	// 255 RPL_LUSERME
+	// Only users and servers connected to us.
 	u.messageFromServer("255", []string{
 		fmt.Sprintf("I have %d clients and %d servers",
-			len(u.Catbox.LocalUsers), len(u.Catbox.LocalServers)),
+			u.Catbox.localUserCount(), len(u.Catbox.LocalServers)),
 	})
 
 	// 265 tells current local user count and max. Not standard.
 	u.messageFromServer("265", []string{
-		fmt.Sprintf("%d", len(u.Catbox.LocalUsers)),
+		fmt.Sprintf("%d", u.Catbox.localUserCount()),
 		fmt.Sprintf("%d", u.Catbox.HighestLocalUserCount),
 		fmt.Sprintf("Current local users %d, max %d",
-			len(u.Catbox.LocalUsers), u.Catbox.HighestLocalUserCount),
+			u.Catbox.localUserCount(), u.Catbox.HighestLocalUserCount),
 	})
 
 	// 266 tells global user count and max. Not standard.
 	u.messageFromServer("266", []string{
-		fmt.Sprintf("%d", len(u.Catbox.Users)),
+		fmt.Sprintf("%d", u.Catbox.userCount()),
 		fmt.Sprintf("%d", u.Catbox.HighestGlobalUserCount),
 		fmt.Sprintf("Current global users %d, max %d",
-			len(u.Catbox.Users), u.Catbox.HighestGlobalUserCount),
+			u.Catbox.userCount(), u.Catbox.HighestGlobalUserCount),
 	})
 
 	// 250 tells highest total connections, highest total local users (again, it
@@ -1041,25 +1633,86 @@ func (u *LocalUser) lusersCommand() {
 	})
 }
 
+// rulesCommand shows the server's rules.
+func (u *LocalUser) rulesCommand() {
+	if len(u.Catbox.Rules) == 0 {
+		// 385 ERR_NORULES. Not standard.
+		u.messageFromServer("385", []string{"RULES File is missing"})
+		return
+	}
+
+	// 308 RPL_RULESSTART
+	u.messageFromServer("308", []string{
+		fmt.Sprintf("- %s Server rules - ", u.Catbox.Config.ServerName),
+	})
+
+	// 309 RPL_RULES
+	for _, rule := range u.Catbox.Rules {
+		u.messageFromServer("309", []string{fmt.Sprintf("- %s", rule)})
+	}
+
+	// 310 RPL_ENDOFRULES
+	u.messageFromServer("310", []string{"End of RULES command"})
+}
+
+// sendWelcome sends the welcome NOTICEs we send when a user registers.
+func (u *LocalUser) sendWelcome() {
+	if len(u.Catbox.Welcome) == 0 {
+		return
+	}
+
+	replacer := strings.NewReplacer(
+		"{nick}", u.User.DisplayNick,
+		"{server}", u.Catbox.Config.ServerName,
+		"{users}", strconv.Itoa(len(u.Catbox.Users)),
+		"{channels}", strconv.Itoa(len(u.Catbox.Channels)),
+	)
+
+	for _, line := range u.Catbox.Welcome {
+		u.messageFromServer("NOTICE", []string{u.User.DisplayNick,
+			replacer.Replace(line)})
+	}
+}
+
 func (u *LocalUser) motdCommand() {
 	// 375 RPL_MOTDSTART
 	u.messageFromServer("375", []string{
 		fmt.Sprintf("- %s Message of the day - ", u.Catbox.Config.ServerName),
 	})
 
-	// 372 RPL_MOTD
-	u.messageFromServer("372", []string{
-		fmt.Sprintf("- %s", u.Catbox.Config.MOTD),
-	})
+	if !u.motdThrottled(time.Now()) {
+		// 372 RPL_MOTD
+		u.messageFromServer("372", []string{
+			fmt.Sprintf("- %s", u.Catbox.Config.MOTD),
+		})
+	}
 
 	// 376 RPL_ENDOFMOTD
 	u.messageFromServer("376", []string{"End of MOTD command"})
 }
 
+// motdThrottled decides whether to leave out the MOTD because the user's IP
+// received it recently. If we send it, we remember when.
+//
+// Operators always get it.
+func (u *LocalUser) motdThrottled(now time.Time) bool {
+	if u.Catbox.Config.MOTDThrottle == 0 || u.User.isOperator() {
+		return false
+	}
+
+	sent, exists := u.Catbox.MOTDThrottle[u.User.IP]
+	if exists && now.Sub(sent) < u.Catbox.Config.MOTDThrottle {
+		return true
+	}
+
+	u.Catbox.MOTDThrottle[u.User.IP] = now
+	return false
+}
+
 func (u *LocalUser) quitCommand(m irc.Message) {
 	msg := "Quit:"
 	if len(m.Params) > 0 {
-		msg += " " + m.Params[0]
+		msg += " " + truncateText(m.Params[0], u.Catbox.Config.MaxQuitLength)
 	}
 
 	u.quit(msg, true)
@@ -1121,6 +1774,14 @@ func (u *LocalUser) whoisCommand(m irc.Message) {
 		return
 	}
 
+	// This covers WHOIS we pass on to other servers too.
+	if u.whoisThrottled(time.Now()) {
+		// 263 RPL_TRYAGAIN
+		u.messageFromServer("263", []string{"WHOIS",
+			"This command could not be completed because it has been used recently, and is rate-limited"})
+		return
+	}
+
 	nick := m.Params[0]
 
 	uid, exists := u.Catbox.Nicks[canonicalizeNick(nick)]
@@ -1136,8 +1797,9 @@ func (u *LocalUser) whoisCommand(m irc.Message) {
 	user := u.Catbox.Users[uid]
 
 	// Ask the remote server for the whois if it is a remote user. This gets us
-	// all the interesting details we may not have locally.
-	if user.isRemote() {
+	// all the interesting details we may not have locally. Our services are
+	// not on another server.
+	if user.isRemote() && !user.IsService {
 		user.ClosestServer.maybeQueueMessage(irc.Message{
 			Prefix:  string(u.User.UID),
 			Command: "WHOIS",
@@ -1154,9 +1816,33 @@ func (u *LocalUser) whoisCommand(m irc.Message) {
 	}
 }
 
+// whoisThrottled counts a WHOIS query and decides whether the user made too
+// many this minute. Opers are exempt.
+func (u *LocalUser) whoisThrottled(now time.Time) bool {
+	if u.User.isOperator() || u.Catbox.Config.MaxWhoisPerMinute == 0 {
+		return false
+	}
+
+	if u.WhoisCount == 0 {
+		u.WhoisWindowStart = now
+	}
+	u.WhoisCount++
+	return u.WhoisCount > u.Catbox.Config.MaxWhoisPerMinute
+}
+
+// resetWhoisCount starts a new WHOIS window once a minute has passed.
+func (u *LocalUser) resetWhoisCount(now time.Time) {
+	if u.WhoisCount > 0 && now.Sub(u.WhoisWindowStart) >= time.Minute {
+		u.WhoisCount = 0
+	}
+}
+
 func (u *LocalUser) operCommand(m irc.Message) {
 	// Parameters: <name> <password>
-	if len(m.Params) < 2 {
+	//
+	// The password is optional if the oper has a certificate fingerprint set
+	// and the client presented that certificate.
+	if len(m.Params) < 1 {
 		// 461 ERR_NEEDMOREPARAMS
 		u.messageFromServer("461", []string{"OPER", "Not enough parameters"})
 		return
@@ -1171,14 +1857,27 @@ func (u *LocalUser) operCommand(m irc.Message) {
 	// We could require particular user/hostmask per oper.
 
 	// Check if they gave acceptable permissions.
-	pass, exists := u.Catbox.Config.Opers[m.Params[0]]
-	if !exists || pass != m.Params[1] {
-		// 464 ERR_PASSWDMISMATCH
-		u.messageFromServer("464", []string{"Password incorrect"})
-		return
+	certFP, exists := u.Catbox.Config.OperCerts[m.Params[0]]
+	if !exists || u.CertFP == "" || certFP != u.CertFP {
+		if len(m.Params) < 2 {
+			// 461 ERR_NEEDMOREPARAMS
+			u.messageFromServer("461", []string{"OPER", "Not enough parameters"})
+			return
+		}
+
+		pass, exists := u.Catbox.Config.Opers[m.Params[0]]
+		if !exists || pass != m.Params[1] {
+			// 464 ERR_PASSWDMISMATCH
+			u.messageFromServer("464", []string{"Password incorrect"})
+			return
+		}
 	}
 
-	// Give them oper status.
+	u.becomeOper()
+}
+
+// becomeOper gives the user oper status once they've proven who they are.
+func (u *LocalUser) becomeOper() {
 	u.User.Modes['o'] = struct{}{}
 
 	u.Catbox.Opers[u.User.UID] = u.User
@@ -1198,10 +1897,47 @@ func (u *LocalUser) operCommand(m irc.Message) {
 		})
 	}
 
+	if u.Catbox.Config.ShowOperOnConnect {
+		u.Catbox.noticeLocalOpers(fmt.Sprintf("%s (%s) became an operator.",
+			u.User.nickUhost(), u.Catbox.Config.ServerName))
+		return
+	}
+
 	u.Catbox.noticeLocalOpers(fmt.Sprintf("%s@%s became an operator.",
 		u.User.DisplayNick, u.Catbox.Config.ServerName))
 }
 
+// OPERS lists the operators on the network. Only opers may see it.
+func (u *LocalUser) opersCommand(m irc.Message) {
+	if !u.User.isOperator() {
+		// 481 ERR_NOPRIVILEGES
+		u.messageFromServer("481", []string{"Permission Denied- You're not an IRC operator"})
+		return
+	}
+
+	opers := make([]*User, 0, len(u.Catbox.Opers))
+	for _, oper := range u.Catbox.Opers {
+		opers = append(opers, oper)
+	}
+	sort.Slice(opers, func(i, j int) bool {
+		return opers[i].DisplayNick < opers[j].DisplayNick
+	})
+
+	for _, oper := range opers {
+		where := "local"
+		serverName := u.Catbox.Config.ServerName
+		if oper.isRemote() {
+			where = "remote"
+			serverName = oper.Server.Name
+		}
+
+		u.serverNotice(fmt.Sprintf("OPERS: %s on %s (%s) %s", oper.nickUhost(),
+			serverName, where, oper.modesString()))
+	}
+
+	u.serverNotice(fmt.Sprintf("OPERS: End of list (%d)", len(opers)))
+}
+
 // MODE command applies either to nicknames or to channels.
 func (u *LocalUser) modeCommand(m irc.Message) {
 	// User mode:
@@ -1339,175 +2075,218 @@ func (u *LocalUser) channelModeCommand(channel *Channel, modes string,
 	}
 
 	// No modes? Send back the channel's modes.
-	// Always send back +ns. That's only I support right now.
 	if len(modes) == 0 {
 		// 324 RPL_CHANNELMODEIS
-		u.messageFromServer("324", []string{channel.Name, "+ns"})
+		u.messageFromServer("324", append([]string{channel.Name},
+			channel.modesWithParams()...))
 		// 329 RPL_CREATIONTIME. Not standard but oft used.
 		u.messageFromServer("329", []string{channel.Name,
 			fmt.Sprintf("%d", channel.TS)})
 		return
 	}
 
-	// Listing bans. I don't support bans at this time. Say that there are none.
-	if modes == "b" || modes == "+b" {
+	// Listing bans.
+	if (modes == "b" || modes == "+b") && len(params) == 0 {
+		for _, ban := range channel.Bans {
+			// 367 RPL_BANLIST
+			u.messageFromServer("367", []string{channel.Name, ban.Mask, ban.Setter,
+				fmt.Sprintf("%d", ban.TS)})
+		}
 		// 368 RPL_ENDOFBANLIST
 		u.messageFromServer("368", []string{channel.Name,
 			"End of channel ban list"})
 		return
 	}
 
+	// Listing ban exceptions.
+	if (modes == "e" || modes == "+e") && len(params) == 0 {
+		for _, exception := range channel.BanExceptions {
+			// 348 RPL_EXCEPTLIST
+			u.messageFromServer("348", []string{channel.Name, exception.Mask,
+				exception.Setter, fmt.Sprintf("%d", exception.TS)})
+		}
+		// 349 RPL_ENDOFEXCEPTLIST
+		u.messageFromServer("349", []string{channel.Name,
+			"End of channel exception list"})
+		return
+	}
+
+	// Listing quiets.
+	if (modes == "Q" || modes == "+Q") && len(params) == 0 {
+		for _, quiet := range channel.Quiets {
+			// 728 RPL_QUIETLIST
+			u.messageFromServer("728", []string{channel.Name, "Q", quiet.Mask,
+				quiet.Setter, fmt.Sprintf("%d", quiet.TS)})
+		}
+		// 729 RPL_ENDOFQUIETLIST
+		u.messageFromServer("729", []string{channel.Name, "Q",
+			"End of channel quiet list"})
+		return
+	}
+
 	// This is a channel mode change.
-	// They must be channel operator.
-	if !channel.userHasOps(u.User) {
+	// They must be channel operator. Half-ops may change only bans, quiets,
+	// and voice.
+	if !channel.userHasOps(u.User) &&
+		!(channel.userIsHalfOp(u.User) && onlyModes(modes, "bQv")) {
 		// 482 ERR_CHANOPRIVSNEEDED
 		u.messageFromServer("482", []string{channel.Name,
 			"You're not channel operator"})
 		return
 	}
 
-	// Apply mode changes we support.
-	// Currently I support:
-	// - +o/-o
-	// Also generate the information we need to send to our local users and to
-	// servers.
-
-	// +/-
-	action := '+'
+	// Only owners may take away owner status.
+	if removesMode(modes, 'q') && !channel.userIsOwner(u.User) {
+		// 482 ERR_CHANOPRIVSNEEDED
+		u.messageFromServer("482", []string{channel.Name,
+			"You're not channel owner"})
+		return
+	}
 
-	// Count how many modes we apply.
-	// We support only a limited number per command.
-	modesApplied := 0
+	// Apply mode changes we support. We support only a limited number per
+	// command.
+	lookupUser := func(nick string) *User {
+		uid, exists := u.Catbox.Nicks[canonicalizeNick(nick)]
+		if !exists {
+			return nil
+		}
+		return u.Catbox.Users[uid]
+	}
 
-	// Track the mode string of the modes we actually apply.
-	appliedModes := ""
+	changes := channel.applyModes(modes, params, lookupUser, u.User.DisplayNick,
+		ChanModesPerCommand)
 
-	// Track the current action in our applied modes string.
-	appliedModesAction := ' '
+	// If we didn't apply any changes, then we're done.
+	if len(changes) == 0 {
+		return
+	}
 
-	// Track the parameters of the modes we actually apply.
-	appliedParamsUser := []string{}
-	appliedParamsServer := []string{}
+	// Tell all local users in the channel about the mode changes.
 
-	// Track what parameter we're on (of those presented).
-	// i.e., if we had "+oo u1 u2", then we start out at index 0 pointing
-	// to u1, then index 1 indicating u2.
-	paramIndex := 0
+	userModeParams := []string{channel.Name}
+	userModeParams = append(userModeParams, modeChangesToParams(changes,
+		false)...)
 
-	for _, char := range modes {
-		if modesApplied >= ChanModesPerCommand {
-			break
-		}
+	u.Catbox.messageLocalUsersOnChannel(channel, irc.Message{
+		Prefix:  u.User.nickUhost(),
+		Command: "MODE",
+		Params:  userModeParams,
+	})
 
-		if char == '+' || char == '-' {
-			action = char
-			continue
-		}
+	// Propagate mode changes everywhere.
 
-		if char != 'o' {
-			continue
-		}
+	serverModeParams := []string{
+		fmt.Sprintf("%d", channel.TS),
+		channel.Name,
+	}
+	serverModeParams = append(serverModeParams, modeChangesToParams(changes,
+		true)...)
 
-		// +o/-o
-
-		// Must have a parameter. A nick.
-		if paramIndex >= len(params) {
-			break
-		}
+	for _, ls := range u.Catbox.LocalServers {
+		ls.maybeQueueMessage(irc.Message{
+			Prefix:  string(u.User.UID),
+			Command: "TMODE",
+			Params:  serverModeParams,
+		})
+	}
+}
 
-		// Consume the parameter.
-		targetNick := params[paramIndex]
-		paramIndex++
+// namesCommand lists the members of channels.
+//
+// NAMES <#channel>[,<#channel>...]
+//
+// Without a channel we list none. Users not on a secret channel may not see
+// its members. Private channels only hide from queries for any channel, such
+// as LIST, so here they are like any other. Opers see every channel.
+func (u *LocalUser) namesCommand(m irc.Message) {
+	if len(m.Params) == 0 {
+		// 366 RPL_ENDOFNAMES
+		u.messageFromServer("366", []string{"*", "End of NAMES list"})
+		return
+	}
 
-		// Resolve the nick to a user.
-		targetUID, exists := u.Catbox.Nicks[canonicalizeNick(targetNick)]
-		if !exists {
-			break
-		}
-		targetUser := u.Catbox.Users[targetUID]
+	channelNames := commaChannelsToChannelNames(m.Params[0])
+	sort.Strings(channelNames)
 
-		if !targetUser.onChannel(channel) {
-			break
+	for _, channelName := range channelNames {
+		channel, exists := u.Catbox.Channels[channelName]
+		if !exists || (channel.isSecret() && !u.User.onChannel(channel) &&
+			!u.User.isOperator()) {
+			// 366 RPL_ENDOFNAMES
+			u.messageFromServer("366", []string{channelName, "End of NAMES list"})
+			continue
 		}
 
-		// Looks okay to do this.
+		u.sendNames(channel)
+	}
+}
 
-		if action == '+' {
-			if channel.userHasOps(targetUser) {
-				break
-			}
-			channel.grantOps(targetUser)
-		} else {
-			if !channel.userHasOps(targetUser) {
-				break
+// listCommand lists channels with how many members they have and their
+// topics.
+//
+// LIST [<#channel>[,<#channel>...]]
+//
+// Users not on a channel don't see it if it's secret. If it's private they
+// see * and no topic. +s takes priority. Opers see every channel.
+func (u *LocalUser) listCommand(m irc.Message) {
+	var channels []*Channel
+	if len(m.Params) > 0 {
+		for _, channelName := range commaChannelsToChannelNames(m.Params[0]) {
+			if channel, exists := u.Catbox.Channels[channelName]; exists {
+				channels = append(channels, channel)
 			}
-			channel.removeOps(targetUser)
 		}
-
-		if appliedModesAction != action {
-			appliedModesAction = action
-			appliedModes += string(appliedModesAction)
+	} else {
+		for _, channel := range u.Catbox.Channels {
+			channels = append(channels, channel)
 		}
-
-		appliedModes += string(char)
-		appliedParamsUser = append(appliedParamsUser, targetUser.DisplayNick)
-		appliedParamsServer = append(appliedParamsServer, string(targetUser.UID))
-
-		modesApplied++
-	}
-
-	// If we didn't apply any changes, then we're done.
-	if modesApplied == 0 {
-		return
 	}
 
-	// Tell all local users in the channel about the mode changes.
-
-	userModeParams := []string{channel.Name, appliedModes}
-	userModeParams = append(userModeParams, appliedParamsUser...)
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i].Name < channels[j].Name
+	})
 
-	for memberUID := range channel.Members {
-		member := u.Catbox.Users[memberUID]
+	// 321 RPL_LISTSTART
+	u.messageFromServer("321", []string{"Channel", "Users  Name"})
 
-		if !member.isLocal() {
-			continue
+	for _, channel := range channels {
+		name := channel.Name
+		topic := channel.Topic
+		if !u.User.onChannel(channel) && !u.User.isOperator() {
+			if channel.isSecret() {
+				continue
+			}
+			if channel.isPrivate() {
+				name = "*"
+				topic = ""
+			}
 		}
 
-		member.LocalUser.maybeQueueMessage(irc.Message{
-			Prefix:  u.User.nickUhost(),
-			Command: "MODE",
-			Params:  userModeParams,
-		})
+		// 322 RPL_LIST
+		u.messageFromServer("322", []string{name,
+			strconv.Itoa(len(channel.Members)), topic})
 	}
 
-	// Propagate mode changes everywhere.
-
-	serverModeParams := []string{
-		fmt.Sprintf("%d", channel.TS),
-		channel.Name,
-		appliedModes,
-	}
-	serverModeParams = append(serverModeParams, appliedParamsServer...)
-
-	for _, ls := range u.Catbox.LocalServers {
-		ls.maybeQueueMessage(irc.Message{
-			Prefix:  string(u.User.UID),
-			Command: "TMODE",
-			Params:  serverModeParams,
-		})
-	}
+	// 323 RPL_LISTEND
+	u.messageFromServer("323", []string{"End of /LIST"})
 }
 
 func (u *LocalUser) whoCommand(m irc.Message) {
+	// Parameters: <mask> [flags]
 	if len(m.Params) < 1 {
 		// 461 ERR_NEEDMOREPARAMS
 		u.messageFromServer("461", []string{m.Command, "Not enough parameters"})
 		return
 	}
 
+	flags := whoFlags{}
+	if len(m.Params) > 1 {
+		flags = parseWhoFlags(m.Params[1])
+	}
+
 	// Special case: OPERSPY of a kind. This will let the oper see all users.
 	if m.Params[0] == "!*" {
-		u.operspyWhoCommand(m)
+		u.operspyWhoCommand(flags)
 		return
 	}
 
@@ -1533,6 +2312,15 @@ func (u *LocalUser) whoCommand(m irc.Message) {
 	for memberUID := range channel.Members {
 		member := u.Catbox.Users[memberUID]
 
+		// We don't show services.
+		if member.IsService {
+			continue
+		}
+
+		if !flags.matches(member) {
+			continue
+		}
+
 		// 352 RPL_WHOREPLY
 		// "<channel> <user> <host> <server> <nick>
 		// ( "H" / "G" > ["*"] [ ( "@" / "+" ) ]
@@ -1550,8 +2338,12 @@ func (u *LocalUser) whoCommand(m irc.Message) {
 			mode += "*"
 		}
 
-		if channel.userHasOps(member) {
+		if channel.userIsOwner(member) {
+			mode += "~"
+		} else if channel.userHasOps(member) {
 			mode += "@"
+		} else if channel.userIsHalfOp(member) {
+			mode += "%"
 		}
 
 		serverName := u.Catbox.Config.ServerName
@@ -1578,7 +2370,7 @@ func (u *LocalUser) whoCommand(m irc.Message) {
 // It is to partially support something like ratbox's WHO !<param> command
 // that lets opers see things regular users cannot.
 // In this case, I want to send the WHO result of all users to the oper.
-func (u *LocalUser) operspyWhoCommand(m irc.Message) {
+func (u *LocalUser) operspyWhoCommand(flags whoFlags) {
 	if !u.User.isOperator() {
 		// 481 ERR_NOPRIVILEGES
 		u.messageFromServer("481", []string{
@@ -1588,6 +2380,10 @@ func (u *LocalUser) operspyWhoCommand(m irc.Message) {
 
 	// Tell them every user.
 	for _, user := range u.Catbox.Users {
+		if !flags.matches(user) {
+			continue
+		}
+
 		// 352 RPL_WHOREPLY
 		// "<channel> <user> <host> <server> <nick>
 		// ( "H" / "G" > ["*"] [ ( "@" / "+" ) ]
@@ -1603,9 +2399,10 @@ func (u *LocalUser) operspyWhoCommand(m irc.Message) {
 			mode += "*"
 		}
 
-		serverName := u.Catbox.Config.ServerName
-		if user.isRemote() {
-			serverName = user.Server.Name
+		// Our services have no server.
+		serverName := user.serverName()
+		if serverName == "" {
+			serverName = u.Catbox.Config.ServerName
 		}
 
 		u.messageFromServer("352", []string{
@@ -1627,6 +2424,50 @@ func (u *LocalUser) operspyWhoCommand(m irc.Message) {
 		u.User.DisplayNick))
 }
 
+// whoFlags filter WHO replies. The letters may be combined, such as WHO #chan
+// or. Each narrows the users shown.
+type whoFlags struct {
+	// o: Operators only.
+	opers bool
+
+	// r: Users identified to an account only.
+	registered bool
+
+	// x: Users connected with TLS only. We know this only for local users, so
+	// remote users never match.
+	tls bool
+}
+
+// parseWhoFlags parses WHO's flags parameter. We ignore letters we don't know.
+func parseWhoFlags(s string) whoFlags {
+	flags := whoFlags{}
+	for _, c := range s {
+		switch c {
+		case 'o':
+			flags.opers = true
+		case 'r':
+			flags.registered = true
+		case 'x':
+			flags.tls = true
+		}
+	}
+	return flags
+}
+
+// matches decides whether to show a user.
+func (f whoFlags) matches(user *User) bool {
+	if f.opers && !user.isOperator() {
+		return false
+	}
+	if f.registered && user.Account == "" {
+		return false
+	}
+	if f.tls && !(user.isLocal() && user.LocalUser.isTLS()) {
+		return false
+	}
+	return true
+}
+
 func (u *LocalUser) topicCommand(m irc.Message) {
 	// Params: <channel> [ <topic> ]
 	if len(m.Params) == 0 {
@@ -1669,10 +2510,7 @@ func (u *LocalUser) topicCommand(m irc.Message) {
 		return
 	}
 
-	topic := m.Params[1]
-	if len(topic) > maxTopicLength {
-		topic = topic[:maxTopicLength]
-	}
+	topic := truncateText(m.Params[1], maxTopicLength)
 
 	// TODO: When we support channel mode +t we will need additional logic.
 
@@ -1681,6 +2519,7 @@ func (u *LocalUser) topicCommand(m irc.Message) {
 	channel.Topic = topic
 	channel.TopicTS = time.Now().Unix()
 	channel.TopicSetter = u.User.nickUhost()
+	u.Catbox.rememberTopic(channel)
 
 	// Tell all members of the channel, including the client.
 	// Only local clients. We tell remote users by telling all servers.
@@ -1713,7 +2552,7 @@ func (u *LocalUser) connectCommand(m irc.Message) {
 		return
 	}
 
-	// CONNECT <server name>
+	// CONNECT <server name> [<port> [<remote server>]]
 	if len(m.Params) < 1 {
 		// 461 ERR_NEEDMOREPARAMS
 		u.messageFromServer("461", []string{m.Command, "Not enough parameters"})
@@ -1722,6 +2561,36 @@ func (u *LocalUser) connectCommand(m irc.Message) {
 
 	serverName := m.Params[0]
 
+	port := 0
+	if len(m.Params) > 1 {
+		p, err := strconv.Atoi(m.Params[1])
+		if err != nil || p < 0 || p > 65535 {
+			u.serverNotice(fmt.Sprintf("Invalid port: %s", m.Params[1]))
+			return
+		}
+		port = p
+	}
+
+	// Asking another server to connect. It decides whether it can.
+	if len(m.Params) > 2 && m.Params[2] != u.Catbox.Config.ServerName {
+		remote := u.Catbox.getServerByName(m.Params[2])
+		if remote == nil {
+			// 402 ERR_NOSUCHSERVER
+			u.messageFromServer("402", []string{m.Params[2], "No such server"})
+			return
+		}
+
+		u.serverNotice(fmt.Sprintf("Sending CONNECT %s to %s", serverName,
+			remote.Name))
+		remote.ClosestServer.maybeQueueMessage(irc.Message{
+			Prefix:  string(u.User.UID),
+			Command: "ENCAP",
+			Params: []string{remote.Name, "CONNECT", serverName,
+				strconv.Itoa(port)},
+		})
+		return
+	}
+
 	// Is it a server we know about?
 	linkInfo, exists := u.Catbox.Config.Servers[serverName]
 	if !exists {
@@ -1739,7 +2608,7 @@ func (u *LocalUser) connectCommand(m irc.Message) {
 
 	// We could check if we're already trying to link to it. But the result should
 	// be the same.
-	u.Catbox.connectToServer(linkInfo)
+	u.Catbox.connectToServer(linkInfoWithPort(linkInfo, port))
 }
 
 func (u *LocalUser) linksCommand(m irc.Message) {
@@ -1769,6 +2638,40 @@ func (u *LocalUser) linksCommand(m irc.Message) {
 	u.messageFromServer("365", []string{"*", "End of LINKS list"})
 }
 
+// TRACE shows the route to a server. Each server on the way says it passed the
+// TRACE on, and the server at the end describes its connections. With no
+// server, we describe our own.
+//
+// Only opers may TRACE.
+func (u *LocalUser) traceCommand(m irc.Message) {
+	if !u.User.isOperator() {
+		// 481 ERR_NOPRIVILEGES
+		u.messageFromServer("481", []string{"Permission Denied- You're not an IRC operator"})
+		return
+	}
+
+	// Params: [<server name>]
+	if len(m.Params) == 0 || m.Params[0] == u.Catbox.Config.ServerName {
+		u.Catbox.sendNumerics(u.User, u.Catbox.traceReplies())
+		return
+	}
+
+	target := u.Catbox.getServerByName(m.Params[0])
+	if target == nil {
+		// 402 ERR_NOSUCHSERVER
+		u.messageFromServer("402", []string{m.Params[0], "No such server"})
+		return
+	}
+
+	u.Catbox.sendNumerics(u.User, []irc.Message{u.Catbox.traceLink(target)})
+
+	target.nextHop().maybeQueueMessage(irc.Message{
+		Prefix:  string(u.User.UID),
+		Command: "TRACE",
+		Params:  []string{target.Name},
+	})
+}
+
 // WALLOPS command causes us to send the text to all local operators as a
 // WALLOPS command. We also send it on to each remote server so it can do the
 // same and show its operators.
@@ -1788,22 +2691,49 @@ func (u *LocalUser) wallopsCommand(m irc.Message) {
 
 	text := m.Params[0]
 
-	for _, user := range u.Catbox.Opers {
-		if !user.isLocal() {
-			continue
-		}
-		user.LocalUser.maybeQueueMessage(irc.Message{
-			Prefix:  user.nickUhost(),
+	sendMessages(u.Catbox.wallopsMessages(u.User.nickUhost(), text))
+
+	for _, server := range u.Catbox.LocalServers {
+		server.maybeQueueMessage(irc.Message{
+			Prefix:  string(u.User.UID),
 			Command: "WALLOPS",
 			Params:  []string{text},
 		})
 	}
+}
+
+// GNOTICE lets an operator send a notice to every user on the network.
+func (u *LocalUser) gnoticeCommand(m irc.Message) {
+	// Params: <text>
+	if len(m.Params) == 0 || m.Params[0] == "" {
+		// 461 ERR_NEEDMOREPARAMS
+		u.messageFromServer("461", []string{"GNOTICE", "Not enough parameters"})
+		return
+	}
+
+	if !u.User.isOperator() {
+		// 481 ERR_NOPRIVILEGES
+		u.messageFromServer("481", []string{"Permission Denied- You're not an IRC operator"})
+		return
+	}
+
+	if time.Since(u.LastGNOTICETime) < GNOTICEInterval {
+		// 263 RPL_TRYAGAIN
+		u.messageFromServer("263", []string{"GNOTICE",
+			"This command could not be completed because it has been used recently, and is rate-limited"})
+		return
+	}
+	u.LastGNOTICETime = time.Now()
+
+	text := m.Params[0]
+
+	sendMessages(u.Catbox.globalNoticeMessages(u.User, text))
 
 	for _, server := range u.Catbox.LocalServers {
 		server.maybeQueueMessage(irc.Message{
 			Prefix:  string(u.User.UID),
-			Command: "WALLOPS",
-			Params:  []string{text},
+			Command: "ENCAP",
+			Params:  []string{"*", "GNOTICE", text},
 		})
 	}
 }
@@ -1838,6 +2768,7 @@ func (u *LocalUser) killCommand(m irc.Message) {
 	}
 
 	u.Catbox.issueKill(u.User, targetUser, reason)
+	u.Catbox.operStats(u.User).KillCount++
 }
 
 // Apply a KLine (user ban) locally and cut off any users matching it.
@@ -1865,7 +2796,7 @@ func (u *LocalUser) klineCommand(m irc.Message) {
 
 	match, err := regexp.MatchString("^[0-9]+$", m.Params[0])
 	if err != nil {
-		log.Fatalf("KLine duration regex: %s", err)
+		u.Catbox.fatal("KLine duration regex: %s", err)
 	}
 	if match {
 		duration = m.Params[0]
@@ -1900,6 +2831,12 @@ func (u *LocalUser) klineCommand(m irc.Message) {
 	userMask := pieces[0]
 	hostMask := pieces[1]
 
+	if isKLineTooBroad(userMask, hostMask) {
+		// 415 ERR_BADMASK
+		u.messageFromServer("415", []string{uhost, "K-Line too broad"})
+		return
+	}
+
 	kline := KLine{
 		UserMask: userMask,
 		HostMask: hostMask,
@@ -1926,6 +2863,7 @@ func (u *LocalUser) klineCommand(m irc.Message) {
 	}
 
 	u.Catbox.addAndApplyKLine(kline, u.User.DisplayNick, reason)
+	u.Catbox.operStats(u.User).KLineCount++
 }
 
 func (u *LocalUser) unklineCommand(m irc.Message) {
@@ -1951,7 +2889,9 @@ func (u *LocalUser) unklineCommand(m irc.Message) {
 	userMask := pieces[0]
 	hostMask := pieces[1]
 
-	u.Catbox.removeKLine(userMask, hostMask, u.User.DisplayNick)
+	if u.Catbox.removeKLine(userMask, hostMask, u.User.DisplayNick) {
+		u.Catbox.operStats(u.User).UnKLineCount++
+	}
 
 	// Propagate.
 	for _, server := range u.Catbox.LocalServers {
@@ -1970,6 +2910,14 @@ func (u *LocalUser) unklineCommand(m irc.Message) {
 
 // I support the following queries right now:
 // k/K - Show K-Lines
+// c/C - Show server links and connection classes
+// x/X - Show X-Lines
+// d/D - Show D-Lines
+// g/G - Show G-Lines
+// p - Show the actions opers took
+// R - Show registered channels
+// u - Show how long we've been up. Anyone may see this unless hide-stats is
+//     set.
 // I do not support remote STATS yet.
 func (u *LocalUser) statsCommand(m irc.Message) {
 	if len(m.Params) == 0 {
@@ -1979,17 +2927,60 @@ func (u *LocalUser) statsCommand(m irc.Message) {
 	}
 
 	query := m.Params[0]
-	if query != "k" && query != "K" {
+	if query != "k" && query != "K" && query != "c" && query != "C" &&
+		query != "x" && query != "X" && query != "d" && query != "D" &&
+		query != "g" && query != "G" && query != "p" && query != "R" &&
+		query != "u" && query != "?" {
 		u.messageFromServer("NOTICE", []string{"Unknown stats query"})
 		return
 	}
 
+	if query == "u" && (!u.Catbox.Config.HideStats || u.User.isOperator()) {
+		u.statsUptime(time.Now())
+		return
+	}
+
 	if !u.User.isOperator() {
 		// 481 ERR_NOPRIVILEGES
 		u.messageFromServer("481", []string{"Permission Denied- You're not an IRC operator"})
 		return
 	}
 
+	if query == "c" || query == "C" {
+		u.statsConnect()
+		return
+	}
+
+	if query == "?" {
+		u.statsLinks()
+		return
+	}
+
+	if query == "x" || query == "X" {
+		u.statsXLines()
+		return
+	}
+
+	if query == "d" || query == "D" {
+		u.statsDLines()
+		return
+	}
+
+	if query == "g" || query == "G" {
+		u.statsGLines()
+		return
+	}
+
+	if query == "R" {
+		u.statsChanRegs()
+		return
+	}
+
+	if query == "p" {
+		u.statsOperActions()
+		return
+	}
+
 	// We could sort the KLines.
 
 	for _, kline := range u.Catbox.KLines {
@@ -2013,6 +3004,146 @@ func (u *LocalUser) statsCommand(m irc.Message) {
 	u.messageFromServer("219", []string{"K", "End of /STATS report"})
 }
 
+// statsUptime shows how long we've been up and our connection counts.
+func (u *LocalUser) statsUptime(now time.Time) {
+	// 242 RPL_STATSUPTIME
+	u.messageFromServer("242", []string{
+		formatUptime(now.Sub(u.Catbox.StartTime))})
+
+	// 250 RPL_STATSCONN
+	u.messageFromServer("250", []string{fmt.Sprintf(
+		"Highest connection count: %d (%d clients) (%d connections received)",
+		u.Catbox.HighestConnectionCount, u.Catbox.HighestLocalUserCount,
+		u.Catbox.ConnectionCount)})
+
+	// 219 RPL_ENDOFSTATS
+	u.messageFromServer("219", []string{"u", "End of /STATS report"})
+}
+
+// statsOperActions shows the actions each oper took since we started. Opers
+// who left show with nick *.
+func (u *LocalUser) statsOperActions() {
+	uids := make([]string, 0, len(u.Catbox.OperActions))
+	for uid := range u.Catbox.OperActions {
+		uids = append(uids, string(uid))
+	}
+	sort.Strings(uids)
+
+	for _, uid := range uids {
+		stats := u.Catbox.OperActions[TS6UID(uid)]
+
+		nick := "*"
+		if user, exists := u.Catbox.Users[TS6UID(uid)]; exists {
+			nick = user.DisplayNick
+		}
+
+		// 249 RPL_STATSDEBUG
+		u.messageFromServer("249", []string{"p", fmt.Sprintf(
+			"%s %s Kills: %d K-Lines: %d UnK-Lines: %d Rehashes: %d Squits: %d",
+			uid, nick, stats.KillCount, stats.KLineCount, stats.UnKLineCount,
+			stats.RehashCount, stats.SquitCount)})
+	}
+
+	// 219 RPL_ENDOFSTATS
+	u.messageFromServer("219", []string{"p", "End of /STATS report"})
+}
+
+// statsLinks shows how well we compress each server link.
+func (u *LocalUser) statsLinks() {
+	names := make([]string, 0, len(u.Catbox.LocalServers))
+	servers := make(map[string]*LocalServer)
+	for _, ls := range u.Catbox.LocalServers {
+		names = append(names, ls.Server.Name)
+		servers[ls.Server.Name] = ls
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		ls := servers[name]
+
+		compression := "none"
+		if ratio := ls.compressionRatio(); ratio > 0 {
+			compression = fmt.Sprintf("%.2f", ratio)
+		}
+
+		// 249 RPL_STATSDEBUG
+		u.messageFromServer("249", []string{
+			"?",
+			fmt.Sprintf("%s compression ratio %s", name, compression),
+		})
+	}
+
+	// 219 RPL_ENDOFSTATS
+	u.messageFromServer("219", []string{"?", "End of /STATS report"})
+}
+
+// statsConnect shows the servers we're configured to link with and our
+// connection classes.
+//
+// If a server is linked, we also show the capabilities it advertised with
+// GCAP.
+func (u *LocalUser) statsConnect() {
+	names := make([]string, 0, len(u.Catbox.Config.Servers))
+	for name := range u.Catbox.Config.Servers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		linkInfo := u.Catbox.Config.Servers[name]
+
+		// 213 RPL_STATSCLINE
+		// ircd-ratbox says:
+		// C <host> <flags> <name> <port> <class>
+		// We have no flags or classes. Instead we follow the port with the
+		// server's capabilities if it is linked.
+		params := []string{
+			"C",
+			linkInfo.Hostname,
+			"*",
+			linkInfo.Name,
+			strconv.Itoa(linkInfo.Port),
+		}
+
+		server := u.Catbox.getServerByName(linkInfo.Name)
+		if server != nil {
+			params = append(params, server.capabsString())
+		}
+
+		u.messageFromServer("213", params)
+	}
+
+	// Show the default class too, even if it is not configured.
+	classes := u.Catbox.Config.ConnClasses
+	if _, ok := u.Catbox.Config.findConnClass(DefaultConnClass); !ok {
+		classes = append([]ConnClass{u.Catbox.Config.connClass(DefaultConnClass)},
+			classes...)
+	}
+
+	for _, class := range classes {
+		// 218 RPL_STATSYLINE
+		// ircd-ratbox says:
+		// Y <class> <ping freq> <connect freq> <max users> <max sendq> ...
+		// We show our own fields:
+		// Y <class> <ping time> <dead time> <users>/<max users> <max sendq>
+		//   <max recvq> <flood threshold>
+		u.messageFromServer("218", []string{
+			"Y",
+			class.Name,
+			strconv.Itoa(int(class.PingTime.Seconds())),
+			strconv.Itoa(int(class.DeadTime.Seconds())),
+			fmt.Sprintf("%d/%d", u.Catbox.countClassUsers(class.Name),
+				class.MaxUsers),
+			strconv.Itoa(class.MaxSendQ),
+			strconv.Itoa(class.MaxRecvQ),
+			strconv.Itoa(class.FloodThreshold),
+		})
+	}
+
+	// 219 RPL_ENDOFSTATS
+	u.messageFromServer("219", []string{"C", "End of /STATS report"})
+}
+
 // Reload config.
 // No parameters.
 func (u *LocalUser) rehashCommand(m irc.Message) {
@@ -2022,7 +3153,75 @@ func (u *LocalUser) rehashCommand(m irc.Message) {
 		return
 	}
 
-	u.Catbox.rehash(u.User)
+	// Parameters: [<server name or mask>] [motd | opers | servers | all]
+	params := m.Params
+
+	// If the first parameter is not an option, it's the server to rehash. It
+	// may be a mask matching several servers.
+	var target *Server
+	mask := ""
+	if len(params) > 0 {
+		if _, ok := RehashTargets[strings.ToLower(params[0])]; !ok {
+			if strings.ContainsAny(params[0], "*?") {
+				mask = params[0]
+				if len(u.Catbox.serversMatching(mask)) == 0 {
+					// 402 ERR_NOSUCHSERVER
+					u.messageFromServer("402", []string{params[0], "No such server"})
+					return
+				}
+			} else if params[0] != u.Catbox.Config.ServerName {
+				target = u.Catbox.getServerByName(params[0])
+				if target == nil {
+					// 402 ERR_NOSUCHSERVER
+					u.messageFromServer("402", []string{params[0], "No such server"})
+					return
+				}
+			}
+			params = params[1:]
+		}
+	}
+
+	what := RehashAll
+	if len(params) > 0 {
+		what = strings.ToLower(params[0])
+		if _, ok := RehashTargets[what]; !ok {
+			u.serverNotice(fmt.Sprintf(
+				"Unknown REHASH option: %s. Try motd, opers, servers, or all.",
+				params[0]))
+			return
+		}
+	}
+
+	u.Catbox.operStats(u.User).RehashCount++
+
+	// Rehashing servers matching a mask. Every server hears about it and those
+	// matching act on it.
+	if mask != "" {
+		names := u.Catbox.serversMatching(mask)
+		u.serverNotice(fmt.Sprintf("Sending REHASH to %s",
+			strings.Join(names, ", ")))
+		if globMatch(mask, u.Catbox.Config.ServerName) {
+			u.Catbox.rehash(u.User, what)
+		}
+		sendMessages(u.Catbox.maskRehashMessages(u.User, mask, what))
+		return
+	}
+
+	// Rehashing a remote server. Send it only there.
+	if target != nil {
+		u.serverNotice(fmt.Sprintf("Sending REHASH to %s", target.Name))
+		sendMessages(u.Catbox.remoteRehashMessages(u.User, target, what))
+		return
+	}
+
+	u.Catbox.rehash(u.User, what)
+
+	msgs := u.Catbox.propagateRehashMessages(u.User, what)
+	if len(msgs) > 0 {
+		u.Catbox.noticeOpers(fmt.Sprintf("Propagating REHASH to %d servers",
+			len(u.Catbox.Servers)))
+		sendMessages(msgs)
+	}
 }
 
 // Map is a non standard command. It shows linked servers, and in an ASCII way,
@@ -2043,28 +3242,22 @@ func (u *LocalUser) rehashCommand(m irc.Message) {
 //   server B[SID] --------- | Users: n (n.n%)
 //     server D[SID] ------- | Users: n (n.n%)
 func (u *LocalUser) mapCommand(m irc.Message) {
-	lines := []string{}
-
-	globalUserCount := len(u.Catbox.Users)
+	globalUserCount := u.Catbox.userCount()
 
 	// Ourself.
-	lines = append(lines, serverToMapLine(u.Catbox.Config.ServerName,
-		u.Catbox.Config.TS6SID, len(u.Catbox.LocalUsers), globalUserCount, 0))
-
-	for _, ls := range u.Catbox.LocalServers {
-		// The local server.
-		lines = append(lines, serverToMapLine(ls.Server.Name, ls.Server.SID,
-			ls.Server.getLocalUserCount(u.Catbox.Users), globalUserCount,
-			ls.Server.HopCount))
+	lines := []string{serverToMapLine(u.Catbox.Config.ServerName,
+		u.Catbox.Config.TS6SID, u.Catbox.localUserCount(), globalUserCount, 0)}
 
-		// And all servers it is linked to.
-		linkedServers := ls.Server.getLinkedServers(u.Catbox.Servers)
-		for _, s := range linkedServers {
-			lines = append(lines, serverToMapLine(s.Name, s.SID,
-				s.getLocalUserCount(u.Catbox.Users), globalUserCount, s.HopCount))
-		}
+	// Then each server linked to us and those behind it.
+	visited := map[*Server]struct{}{}
+	for _, s := range u.Catbox.sortedMapServers(nil) {
+		lines = append(lines, u.Catbox.mapLines(s, 1, globalUserCount,
+			visited)...)
 	}
 
+	lines = append(lines, fmt.Sprintf("Total: %d users on %d servers",
+		globalUserCount, u.Catbox.globalServerCount()))
+
 	msgs := []irc.Message{}
 	for _, line := range lines {
 		msgs = append(msgs, irc.Message{
@@ -2085,6 +3278,75 @@ func (u *LocalUser) mapCommand(m irc.Message) {
 	}
 }
 
+// mapLines builds the MAP lines for a server and the servers behind it. depth
+// is how many hops it is from us.
+//
+// We stop descending at MapMaxDepth and say how many servers we left out. We
+// never show a server twice, so a broken topology can't loop forever.
+func (cb *Catbox) mapLines(s *Server, depth, globalUserCount int,
+	visited map[*Server]struct{}) []string {
+	if _, ok := visited[s]; ok {
+		return nil
+	}
+	visited[s] = struct{}{}
+
+	lines := []string{serverToMapLine(s.Name, s.SID,
+		s.getLocalUserCount(cb.Users), globalUserCount, depth)}
+
+	linked := cb.sortedMapServers(s)
+
+	if depth >= cb.Config.MapMaxDepth {
+		hidden := 0
+		for _, linkedServer := range linked {
+			hidden += cb.countMapServers(linkedServer, visited)
+		}
+		if hidden > 0 {
+			lines = append(lines, fmt.Sprintf("%s[... %d more]",
+				strings.Repeat("  ", depth+1), hidden))
+		}
+		return lines
+	}
+
+	for _, linkedServer := range linked {
+		lines = append(lines, cb.mapLines(linkedServer, depth+1, globalUserCount,
+			visited)...)
+	}
+	return lines
+}
+
+// countMapServers counts a server and the servers behind it that we have not
+// visited. It marks them visited.
+func (cb *Catbox) countMapServers(s *Server,
+	visited map[*Server]struct{}) int {
+	if _, ok := visited[s]; ok {
+		return 0
+	}
+	visited[s] = struct{}{}
+
+	count := 1
+	for _, linkedServer := range cb.sortedMapServers(s) {
+		count += cb.countMapServers(linkedServer, visited)
+	}
+	return count
+}
+
+// sortedMapServers finds the servers linked directly to a server, sorted by
+// name. If the server is nil, these are the servers linked to us.
+func (cb *Catbox) sortedMapServers(s *Server) []*Server {
+	servers := []*Server{}
+	for _, server := range cb.Servers {
+		if s == nil && server.LocalServer != nil ||
+			s != nil && server.LinkedTo == s && server != s {
+			servers = append(servers, server)
+		}
+	}
+
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].Name < servers[j].Name
+	})
+	return servers
+}
+
 // Reply with version information.
 // Parameters: None (that I accept, RFC specifies you can query remote server).
 func (u *LocalUser) versionCommand(m irc.Message) {
@@ -2150,6 +3412,35 @@ func (u *LocalUser) whowasCommand(m irc.Message) {
 	})
 }
 
+// SUMMON asks a user logged in to the server's host to join IRC (RFC 2812
+// 4.5). Like most servers we don't support it.
+func (u *LocalUser) summonCommand(m irc.Message) {
+	// 445 ERR_SUMMONDISABLED
+	u.messageFromServer("445", []string{"SUMMON has been disabled"})
+}
+
+// USERS lists the users logged in to the server's host (RFC 2812 4.6). Like
+// SUMMON, we don't support it.
+func (u *LocalUser) usersCommand(m irc.Message) {
+	// 446 ERR_USERSDISABLED
+	u.messageFromServer("446", []string{"USERS has been disabled"})
+}
+
+// SERVICE registers a service (RFC 2812 3.1.6). We only have services we
+// create ourselves.
+func (u *LocalUser) serviceCommand(m irc.Message) {
+	// 421 ERR_UNKNOWNCOMMAND
+	u.messageFromServer("421", []string{m.Command, "SERVICE is not implemented"})
+}
+
+// SQUERY messages a service (RFC 2812 3.5.2). Our services take PRIVMSG
+// instead.
+func (u *LocalUser) squeryCommand(m irc.Message) {
+	// 421 ERR_UNKNOWNCOMMAND
+	u.messageFromServer("421", []string{m.Command,
+		"SQUERY is not implemented. Use PRIVMSG to message services"})
+}
+
 // Set yourself away by including a message.
 // Set yourself not away by not including a message, or having a blank message.
 // Parameters: [message]
@@ -2227,7 +3518,37 @@ func (u *LocalUser) inviteCommand(m irc.Message) {
 		return
 	}
 
-	// Send an invite message.
+	// Don't invite them again while their invite is good.
+	if channel.isInvited(targetUser) {
+		// 443 ERR_USERONCHANNEL
+		u.messageFromServer("443", []string{targetUser.DisplayNick, channel.Name,
+			"is already invited to channel"})
+		return
+	}
+
+	// Record the invite so they may join if the channel is +i. Tell every
+	// server so they all know.
+	channel.addInvite(targetUser)
+	u.Catbox.notifyInvite(u.User, targetUser, channel)
+	for _, server := range u.Catbox.LocalServers {
+		server.maybeQueueMessage(irc.Message{
+			Prefix:  string(u.User.UID),
+			Command: "ENCAP",
+			Params: []string{
+				"*",
+				"INVITE",
+				string(targetUser.UID),
+				channel.Name,
+				fmt.Sprintf("%d", channel.TS),
+			},
+		})
+	}
+
+	// Send an invite message. Services don't get one. They don't join
+	// channels.
+	if targetUser.IsService {
+		return
+	}
 	if targetUser.isLocal() {
 		targetUser.LocalUser.maybeQueueMessage(irc.Message{
 			Prefix:  u.User.nickUhost(),
@@ -2266,6 +3587,49 @@ func (u *LocalUser) inviteCommand(m irc.Message) {
 	}
 }
 
+// INVITELIST is an operator command to show pending channel invites.
+// Params: [channel]
+func (u *LocalUser) invitelistCommand(m irc.Message) {
+	if !u.User.isOperator() {
+		// 481 ERR_NOPRIVILEGES
+		u.messageFromServer("481", []string{"Permission Denied- You're not an IRC operator"})
+		return
+	}
+
+	var channelNames []string
+	if len(m.Params) > 0 {
+		channelNames = append(channelNames, canonicalizeChannel(m.Params[0]))
+	} else {
+		for name := range u.Catbox.Channels {
+			channelNames = append(channelNames, name)
+		}
+		sort.Strings(channelNames)
+	}
+
+	for _, name := range channelNames {
+		channel, exists := u.Catbox.Channels[name]
+		if !exists {
+			continue
+		}
+
+		var nicks []string
+		for uid := range channel.Invites {
+			if user, exists := u.Catbox.Users[uid]; exists {
+				nicks = append(nicks, user.DisplayNick)
+			}
+		}
+		if len(nicks) == 0 {
+			continue
+		}
+		sort.Strings(nicks)
+
+		u.serverNotice(fmt.Sprintf("%s: %s", channel.Name,
+			strings.Join(nicks, " ")))
+	}
+
+	u.serverNotice("End of INVITELIST")
+}
+
 // OPME is an operator command to grant them ops in a channel.
 // Params: <channel>
 func (u *LocalUser) opmeCommand(m irc.Message) {
@@ -2288,6 +3652,17 @@ func (u *LocalUser) opmeCommand(m irc.Message) {
 		return
 	}
 
+	notice := fmt.Sprintf("%s used OPME in %s", u.User.DisplayNick,
+		channel.Name)
+
+	// If they're not on the channel, join them to it with ops.
+	if !u.User.onChannel(channel) {
+		u.forceJoin(channel)
+		u.Catbox.noticeOpers(notice)
+		u.Catbox.noticeMonitoredChannels(notice)
+		return
+	}
+
 	if channel.userHasOps(u.User) {
 		return
 	}
@@ -2323,9 +3698,47 @@ func (u *LocalUser) opmeCommand(m irc.Message) {
 		})
 	}
 
-	// Tell operators.
-	u.Catbox.noticeOpers(fmt.Sprintf("%s used OPME in %s", u.User.DisplayNick,
-		channel.Name))
+	// Tell operators, and anyone watching in a channel.
+	u.Catbox.noticeOpers(notice)
+	u.Catbox.noticeMonitoredChannels(notice)
+}
+
+// OJOIN is an operator command to join a channel whatever its modes. They
+// join with ops.
+// Params: <channel>
+func (u *LocalUser) ojoinCommand(m irc.Message) {
+	if len(m.Params) == 0 {
+		// 461 ERR_NEEDMOREPARAMS
+		u.messageFromServer("461", []string{"OJOIN", "Not enough parameters"})
+		return
+	}
+
+	if !u.User.isOperator() {
+		// 481 ERR_NOPRIVILEGES
+		u.messageFromServer("481", []string{"Permission Denied- You're not an IRC operator"})
+		return
+	}
+
+	channel, exists := u.Catbox.Channels[canonicalizeChannel(m.Params[0])]
+	if !exists {
+		// 403 ERR_NOSUCHCHANNEL.
+		u.messageFromServer("403", []string{m.Params[0], "No such channel"})
+		return
+	}
+
+	if u.User.onChannel(channel) {
+		// 443 ERR_USERONCHANNEL
+		u.messageFromServer("443", []string{u.User.DisplayNick, channel.Name,
+			"is already on channel"})
+		return
+	}
+
+	u.forceJoin(channel)
+
+	notice := fmt.Sprintf("%s used OJOIN in %s", u.User.DisplayNick,
+		channel.Name)
+	u.Catbox.noticeOpers(notice)
+	u.Catbox.noticeMonitoredChannels(notice)
 }
 
 func (u *LocalUser) squitCommand(m irc.Message) {
@@ -2361,6 +3774,8 @@ func (u *LocalUser) squitCommand(m irc.Message) {
 		return
 	}
 
+	u.Catbox.operStats(u.User).SquitCount++
+
 	if server.isLocal() {
 		server.LocalServer.quit(fmt.Sprintf("%s issued SQUIT: %s",
 			u.User.DisplayNick, reason))
@@ -2373,3 +3788,108 @@ func (u *LocalUser) squitCommand(m irc.Message) {
 		Params:  []string{string(server.SID), reason},
 	})
 }
+
+// fingerprintCommand tells the user the fingerprint of the TLS certificate
+// they connected with.
+func (u *LocalUser) fingerprintCommand() {
+	if u.CertFP == "" {
+		u.serverNotice("You did not connect with a client certificate.")
+		return
+	}
+
+	// 276 RPL_WHOISCERTFP
+	u.messageFromServer("276", []string{
+		u.User.DisplayNick,
+		fmt.Sprintf("has client certificate fingerprint %s", u.CertFP),
+	})
+}
+
+// acceptCommand manages the user's accept list. While a user has +g, they
+// only receive private messages from users on it.
+//
+// ACCEPT * lists it. ACCEPT nick[,nick] adds to it, and ACCEPT -nick[,-nick]
+// removes from it. A nick list may mix the two. ACCEPT + nick[,nick] and
+// ACCEPT - nick[,nick] also add and remove.
+func (u *LocalUser) acceptCommand(m irc.Message) {
+	// Parameters: <nick list>
+	if len(m.Params) == 0 {
+		// 461 ERR_NEEDMOREPARAMS
+		u.messageFromServer("461", []string{"ACCEPT", "Not enough parameters"})
+		return
+	}
+
+	// Forget users who are gone.
+	for uid := range u.User.AcceptList {
+		if _, exists := u.Catbox.Users[uid]; !exists {
+			delete(u.User.AcceptList, uid)
+		}
+	}
+
+	if m.Params[0] == "*" {
+		for uid := range u.User.AcceptList {
+			// 281 RPL_ACCEPTLIST
+			u.messageFromServer("281", []string{u.Catbox.Users[uid].DisplayNick})
+		}
+
+		// 282 RPL_ENDOFACCEPT
+		u.messageFromServer("282", []string{"End of /ACCEPT list"})
+		return
+	}
+
+	nicks := strings.Split(m.Params[0], ",")
+	if (m.Params[0] == "+" || m.Params[0] == "-") && len(m.Params) > 1 {
+		nicks = strings.Split(m.Params[1], ",")
+		if m.Params[0] == "-" {
+			for i := range nicks {
+				nicks[i] = "-" + nicks[i]
+			}
+		}
+	}
+
+	for _, nick := range nicks {
+		remove := strings.HasPrefix(nick, "-")
+		nick = strings.TrimPrefix(nick, "-")
+		if nick == "" {
+			continue
+		}
+
+		uid, exists := u.Catbox.Nicks[canonicalizeNick(nick)]
+		if !exists {
+			// 401 ERR_NOSUCHNICK
+			u.messageFromServer("401", []string{nick, "No such nick/channel"})
+			continue
+		}
+		user := u.Catbox.Users[uid]
+
+		_, accepted := u.User.AcceptList[uid]
+
+		if remove {
+			if !accepted {
+				// 458 ERR_ACCEPTNOT
+				u.messageFromServer("458", []string{user.DisplayNick,
+					"is not on your accept list"})
+				continue
+			}
+			delete(u.User.AcceptList, uid)
+			continue
+		}
+
+		if accepted {
+			// 457 ERR_ACCEPTEXIST
+			u.messageFromServer("457", []string{user.DisplayNick,
+				"is already on your accept list"})
+			continue
+		}
+
+		if len(u.User.AcceptList) >= u.Catbox.Config.MaxAcceptList {
+			// 456 ERR_ACCEPTFULL
+			u.messageFromServer("456", []string{"Accept list is full"})
+			return
+		}
+
+		if u.User.AcceptList == nil {
+			u.User.AcceptList = make(map[TS6UID]struct{})
+		}
+		u.User.AcceptList[uid] = struct{}{}
+	}
+}
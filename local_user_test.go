@@ -0,0 +1,2579 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+func TestStatsConnect(t *testing.T) {
+	linked := &Server{
+		SID:    TS6SID("001"),
+		Name:   "irc2.example.com",
+		Capabs: map[string]struct{}{"QS": {}, "ENCAP": {}, "TB": {}},
+	}
+
+	cb := &Catbox{
+		Config: &Config{
+			ServerName: "irc1.example.com",
+			PingTime:   30 * time.Second,
+			DeadTime:   240 * time.Second,
+			ConnClasses: []ConnClass{
+				{Name: "users", MaxUsers: 100, PingTime: time.Minute,
+					DeadTime: 5 * time.Minute, MaxSendQ: 1000, MaxRecvQ: 20,
+					FloodThreshold: 5},
+			},
+			Servers: map[string]*ServerDefinition{
+				"irc3.example.com": {Name: "irc3.example.com",
+					Hostname: "192.168.0.3", Port: 7000},
+				"irc2.example.com": {Name: "irc2.example.com",
+					Hostname: "192.168.0.2", Port: 6667},
+			},
+		},
+		Servers: map[TS6SID]*Server{linked.SID: linked},
+	}
+
+	u := &LocalUser{
+		LocalClient: &LocalClient{Catbox: cb,
+			WriteChan: make(chan TaggedMessage, 10)},
+		User: &User{DisplayNick: "oper",
+			Modes: map[byte]struct{}{'o': {}}},
+	}
+
+	u.statsCommand(irc.Message{Command: "STATS", Params: []string{"c"}})
+
+	wanted := []string{
+		"213 oper C 192.168.0.2 * irc2.example.com 6667 ENCAP QS TB",
+		"213 oper C 192.168.0.3 * irc3.example.com 7000",
+		"218 oper Y default 30 240 0/0 0 50 10",
+		"218 oper Y users 60 300 0/100 1000 20 5",
+		"219 oper C End of /STATS report",
+	}
+
+	if len(u.WriteChan) != len(wanted) {
+		t.Fatalf("statsCommand(c) sent %d messages, wanted %d", len(u.WriteChan),
+			len(wanted))
+	}
+
+	for _, want := range wanted {
+		m := <-u.WriteChan
+		got := m.Command + " " + strings.Join(m.Params, " ")
+		if got != want {
+			t.Errorf("statsCommand(c) sent %s, wanted %s", got, want)
+		}
+	}
+}
+
+func TestStatsLinks(t *testing.T) {
+	cb := &Catbox{
+		Config:       &Config{ServerName: "irc1.example.com"},
+		LocalServers: map[uint64]*LocalServer{},
+	}
+
+	for i, name := range []string{"irc3.example.com", "irc2.example.com"} {
+		ls := &LocalServer{
+			LocalClient: &LocalClient{ID: uint64(i), Catbox: cb,
+				Conn: Conn{zip: &zipState{}}},
+			Server: &Server{Name: name},
+		}
+		cb.LocalServers[ls.ID] = ls
+	}
+	cb.LocalServers[1].Conn.zip.uncompressedBytes = 500
+	cb.LocalServers[1].Conn.zip.compressedBytes = 200
+
+	u := &LocalUser{
+		LocalClient: &LocalClient{Catbox: cb,
+			WriteChan: make(chan TaggedMessage, 10)},
+		User: &User{DisplayNick: "oper",
+			Modes: map[byte]struct{}{'o': {}}},
+	}
+
+	u.statsCommand(irc.Message{Command: "STATS", Params: []string{"?"}})
+
+	wanted := []string{
+		"249 oper ? irc2.example.com compression ratio 2.50",
+		"249 oper ? irc3.example.com compression ratio none",
+		"219 oper ? End of /STATS report",
+	}
+
+	if len(u.WriteChan) != len(wanted) {
+		t.Fatalf("statsCommand(?) sent %d messages, wanted %d", len(u.WriteChan),
+			len(wanted))
+	}
+
+	for _, want := range wanted {
+		m := <-u.WriteChan
+		got := m.Command + " " + strings.Join(m.Params, " ")
+		if got != want {
+			t.Errorf("statsCommand(?) sent %s, wanted %s", got, want)
+		}
+	}
+}
+
+func TestJoinMaxChannels(t *testing.T) {
+	cb := newSnapshotCatbox()
+	alice := addCallerIDTestUser(cb, 0, "alice")
+	alice.Config = &UserConfig{MaxChannels: 2}
+
+	alice.joinCommand(irc.Message{Command: "JOIN",
+		Params: []string{"#one,#two,#three"}})
+
+	if len(alice.User.Channels) != 2 {
+		t.Errorf("alice is in %d channels, wanted 2", len(alice.User.Channels))
+	}
+
+	if _, ok := alice.User.Channels["#three"]; ok {
+		t.Errorf("alice joined a channel past the limit")
+	}
+
+	got := drainCommands(alice)
+	want := "405 alice #three You have joined too many channels"
+	if len(got) == 0 || got[len(got)-1] != want {
+		t.Errorf("JOIN past the limit sent %q, wanted to end with %q", got, want)
+	}
+
+	// Without a config there is no limit.
+	bob := addCallerIDTestUser(cb, 1, "bob")
+	bob.joinCommand(irc.Message{Command: "JOIN",
+		Params: []string{"#one,#two,#three"}})
+	if len(bob.User.Channels) != 3 {
+		t.Errorf("bob is in %d channels, wanted 3", len(bob.User.Channels))
+	}
+}
+
+func TestOpersCommand(t *testing.T) {
+	cb := newSnapshotCatbox()
+	cb.Servers["001"] = &Server{SID: "001", Name: "irc2.example.com"}
+
+	alice := addCallerIDTestUser(cb, 0, "alice")
+	alice.User.Modes['o'] = struct{}{}
+	alice.User.Modes['i'] = struct{}{}
+	cb.Opers[alice.User.UID] = alice.User
+
+	remote := &User{DisplayNick: "carol", Username: "carol",
+		Hostname: "remote.example.com", UID: TS6UID("001AAAAAA"),
+		Modes:  map[byte]struct{}{'o': {}, 'w': {}},
+		Server: cb.Servers["001"]}
+	cb.Users[remote.UID] = remote
+	cb.Opers[remote.UID] = remote
+
+	bob := addCallerIDTestUser(cb, 1, "bob")
+
+	bob.opersCommand(irc.Message{Command: "OPERS"})
+	want := []string{
+		"481 bob Permission Denied- You're not an IRC operator",
+	}
+	if got := drainCommands(bob); strings.Join(got, "\n") !=
+		strings.Join(want, "\n") {
+		t.Errorf("OPERS as a non-oper sent %q, wanted %q", got, want)
+	}
+
+	alice.opersCommand(irc.Message{Command: "OPERS"})
+	want = []string{
+		"NOTICE alice *** Notice --- OPERS: alice!user@host.example.com on " +
+			"irc.example.com (local) +io",
+		"NOTICE alice *** Notice --- OPERS: carol!carol@remote.example.com on " +
+			"irc2.example.com (remote) +ow",
+		"NOTICE alice *** Notice --- OPERS: End of list (2)",
+	}
+	if got := drainCommands(alice); strings.Join(got, "\n") !=
+		strings.Join(want, "\n") {
+		t.Errorf("OPERS sent %q, wanted %q", got, want)
+	}
+}
+
+func TestOperCommandShowOperOnConnect(t *testing.T) {
+	tests := []struct {
+		show   bool
+		notice string
+	}{
+		{false, "NOTICE alice *** Notice --- bob@irc.example.com became an " +
+			"operator."},
+		{true, "NOTICE alice *** Notice --- bob!user@host.example.com " +
+			"(irc.example.com) became an operator."},
+	}
+
+	for _, test := range tests {
+		cb := newSnapshotCatbox()
+		cb.Config.Opers = map[string]string{"bob": "secret"}
+		cb.Config.ShowOperOnConnect = test.show
+
+		alice := addCallerIDTestUser(cb, 0, "alice")
+		alice.User.Modes['o'] = struct{}{}
+		cb.Opers[alice.User.UID] = alice.User
+
+		bob := addCallerIDTestUser(cb, 1, "bob")
+		bob.operCommand(irc.Message{Command: "OPER",
+			Params: []string{"bob", "secret"}})
+
+		got := drainCommands(alice)
+		if len(got) != 1 || got[0] != test.notice {
+			t.Errorf("show-oper-on-connect %v: alice got %q, wanted %q", test.show,
+				got, test.notice)
+		}
+	}
+}
+
+func TestCanJoinInviteOnly(t *testing.T) {
+	cb := &Catbox{Config: &Config{ServerName: "irc.example.com"}}
+
+	u := &LocalUser{
+		LocalClient: &LocalClient{Catbox: cb,
+			WriteChan: make(chan TaggedMessage, 10)},
+		User: &User{DisplayNick: "nick", UID: TS6UID("000AAAAAA")},
+	}
+
+	channel := &Channel{Name: "#test", Members: map[TS6UID]struct{}{},
+		Modes: map[byte]struct{}{'i': {}}}
+
+	if u.canJoin(channel, "") {
+		t.Errorf("canJoin() let an uninvited user join a +i channel")
+	}
+	if m := <-u.WriteChan; m.Command != "473" {
+		t.Errorf("canJoin() sent %s, wanted 473", m.Command)
+	}
+
+	channel.addInvite(u.User)
+	if !u.canJoin(channel, "") {
+		t.Errorf("canJoin() did not let an invited user join a +i channel")
+	}
+}
+
+func TestRulesCommand(t *testing.T) {
+	tests := []struct {
+		rules  []string
+		output []string
+	}{
+		{
+			[]string{"No spam.", "Be nice."},
+			[]string{
+				"308 nick - irc.example.com Server rules - ",
+				"309 nick - No spam.",
+				"309 nick - Be nice.",
+				"310 nick End of RULES command",
+			},
+		},
+		{
+			nil,
+			[]string{"385 nick RULES File is missing"},
+		},
+	}
+
+	for _, test := range tests {
+		cb := &Catbox{Config: &Config{ServerName: "irc.example.com"},
+			Rules: test.rules}
+
+		u := &LocalUser{
+			LocalClient: &LocalClient{Catbox: cb,
+				WriteChan: make(chan TaggedMessage, 10)},
+			User: &User{DisplayNick: "nick"},
+		}
+
+		u.rulesCommand()
+
+		if len(u.WriteChan) != len(test.output) {
+			t.Errorf("rulesCommand() with rules %q sent %d messages, wanted %d",
+				test.rules, len(u.WriteChan), len(test.output))
+			continue
+		}
+
+		for _, want := range test.output {
+			m := <-u.WriteChan
+			got := m.Command + " " + strings.Join(m.Params, " ")
+			if got != want {
+				t.Errorf("rulesCommand() sent %s, wanted %s", got, want)
+			}
+		}
+	}
+}
+
+func TestOperCommandCertFP(t *testing.T) {
+	tests := []struct {
+		certFP string
+		params []string
+		oper   bool
+		output string
+	}{
+		// Matching certificate. No password needed.
+		{"abcd", []string{"alice"}, true, "381"},
+		// Matching certificate with a wrong password still works.
+		{"abcd", []string{"alice", "wrong"}, true, "381"},
+		// Different certificate falls back to the password.
+		{"dcba", []string{"alice"}, false, "461"},
+		{"dcba", []string{"alice", "wrong"}, false, "464"},
+		{"dcba", []string{"alice", "secret"}, true, "381"},
+		// No certificate.
+		{"", []string{"alice", "secret"}, true, "381"},
+		{"", []string{"alice"}, false, "461"},
+		// No fingerprint configured for this oper.
+		{"abcd", []string{"bob"}, false, "461"},
+	}
+
+	for _, test := range tests {
+		cb := &Catbox{
+			Config: &Config{
+				ServerName: "irc.example.com",
+				Opers:      map[string]string{"alice": "secret", "bob": "secret"},
+				OperCerts:  map[string]string{"alice": "abcd"},
+			},
+			Opers:        map[TS6UID]*User{},
+			LocalServers: map[uint64]*LocalServer{},
+			LocalUsers:   map[uint64]*LocalUser{},
+			Logger:       newTestLogger(),
+		}
+
+		u := &LocalUser{
+			LocalClient: &LocalClient{Catbox: cb,
+				WriteChan: make(chan TaggedMessage, 10)},
+			User: &User{DisplayNick: "nick", UID: TS6UID("000AAAAAA"),
+				Modes: map[byte]struct{}{}},
+			CertFP: test.certFP,
+		}
+		u.User.LocalUser = u
+
+		u.operCommand(irc.Message{Command: "OPER", Params: test.params})
+
+		if u.User.isOperator() != test.oper {
+			t.Errorf("operCommand(%q) with fingerprint %q: oper = %v, wanted %v",
+				test.params, test.certFP, u.User.isOperator(), test.oper)
+		}
+
+		found := false
+		for len(u.WriteChan) > 0 {
+			if m := <-u.WriteChan; m.Command == test.output {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("operCommand(%q) with fingerprint %q did not send %s",
+				test.params, test.certFP, test.output)
+		}
+	}
+}
+
+func TestFingerprintCommand(t *testing.T) {
+	tests := []struct {
+		certFP string
+		output string
+	}{
+		{"abcd", "276 nick nick has client certificate fingerprint abcd"},
+		{"", "NOTICE nick *** Notice --- You did not connect with a client certificate."},
+	}
+
+	for _, test := range tests {
+		cb := &Catbox{Config: &Config{ServerName: "irc.example.com"}}
+
+		u := &LocalUser{
+			LocalClient: &LocalClient{Catbox: cb,
+				WriteChan: make(chan TaggedMessage, 10)},
+			User:   &User{DisplayNick: "nick"},
+			CertFP: test.certFP,
+		}
+
+		u.fingerprintCommand()
+
+		if len(u.WriteChan) != 1 {
+			t.Errorf("fingerprintCommand() sent %d messages, wanted 1",
+				len(u.WriteChan))
+			continue
+		}
+
+		m := <-u.WriteChan
+		got := m.Command + " " + strings.Join(m.Params, " ")
+		if got != test.output {
+			t.Errorf("fingerprintCommand() sent %s, wanted %s", got, test.output)
+		}
+	}
+}
+
+// addCallerIDTestUser adds a local user whose messages we can inspect.
+func addCallerIDTestUser(cb *Catbox, id uint64, nick string) *LocalUser {
+	lu := &LocalUser{
+		LocalClient: &LocalClient{
+			Catbox:    cb,
+			ID:        id,
+			WriteChan: make(chan TaggedMessage, 100),
+		},
+	}
+	lu.User = &User{
+		DisplayNick: nick,
+		Username:    "user",
+		Hostname:    "host.example.com",
+		UID:         TS6UID(fmt.Sprintf("000AAAAA%c", 'A'+byte(id))),
+		Modes:       map[byte]struct{}{},
+		Channels:    map[string]*Channel{},
+		LocalUser:   lu,
+	}
+	cb.LocalUsers[lu.ID] = lu
+	cb.Users[lu.User.UID] = lu.User
+	cb.Nicks[canonicalizeNick(nick)] = lu.User.UID
+	return lu
+}
+
+// drainCommands reads the messages sent to a user and returns them as strings
+// with the command and parameters.
+func drainCommands(lu *LocalUser) []string {
+	var got []string
+	for len(lu.WriteChan) > 0 {
+		m := <-lu.WriteChan
+		// We should never send a message too long for the wire.
+		if _, err := m.Message.Encode(); err == irc.ErrTruncated {
+			panic(fmt.Sprintf("message is too long: %s %s", m.Command,
+				strings.Join(m.Params, " ")))
+		}
+		got = append(got, m.Command+" "+strings.Join(m.Params, " "))
+	}
+	return got
+}
+
+func TestAcceptCommand(t *testing.T) {
+	tests := []struct {
+		params []string
+		output []string
+		accept []string
+	}{
+		{
+			[]string{"bob,carol"},
+			nil,
+			[]string{"bob", "carol"},
+		},
+		{
+			[]string{"+", "bob"},
+			nil,
+			[]string{"bob"},
+		},
+		{
+			[]string{"bob,-bob"},
+			nil,
+			nil,
+		},
+		{
+			[]string{"-bob"},
+			[]string{"458 alice bob is not on your accept list"},
+			nil,
+		},
+		{
+			[]string{"bob,bob"},
+			[]string{"457 alice bob is already on your accept list"},
+			[]string{"bob"},
+		},
+		{
+			[]string{"nobody"},
+			[]string{"401 alice nobody No such nick/channel"},
+			nil,
+		},
+		// The limit is 2.
+		{
+			[]string{"bob,carol,dave"},
+			[]string{"456 alice Accept list is full"},
+			[]string{"bob", "carol"},
+		},
+		{
+			[]string{},
+			[]string{"461 alice ACCEPT Not enough parameters"},
+			nil,
+		},
+	}
+
+	for _, test := range tests {
+		cb := newSnapshotCatbox()
+		cb.Config.MaxAcceptList = 2
+		alice := addCallerIDTestUser(cb, 1, "alice")
+		for i, nick := range []string{"bob", "carol", "dave"} {
+			addCallerIDTestUser(cb, uint64(i+2), nick)
+		}
+
+		alice.acceptCommand(irc.Message{Command: "ACCEPT", Params: test.params})
+
+		got := drainCommands(alice)
+		if strings.Join(got, "\n") != strings.Join(test.output, "\n") {
+			t.Errorf("acceptCommand(%q) sent %q, wanted %q", test.params, got,
+				test.output)
+		}
+
+		if len(alice.User.AcceptList) != len(test.accept) {
+			t.Errorf("acceptCommand(%q) accept list = %v, wanted %q", test.params,
+				alice.User.AcceptList, test.accept)
+			continue
+		}
+		for _, nick := range test.accept {
+			if _, ok := alice.User.AcceptList[cb.Nicks[nick]]; !ok {
+				t.Errorf("acceptCommand(%q) did not accept %s", test.params, nick)
+			}
+		}
+	}
+}
+
+func TestAcceptCommandList(t *testing.T) {
+	cb := newSnapshotCatbox()
+	cb.Config.MaxAcceptList = 20
+	alice := addCallerIDTestUser(cb, 1, "alice")
+	bob := addCallerIDTestUser(cb, 2, "bob")
+	carol := addCallerIDTestUser(cb, 3, "carol")
+
+	alice.acceptCommand(irc.Message{Command: "ACCEPT",
+		Params: []string{"bob,carol"}})
+
+	// Users who leave drop off the list.
+	delete(cb.Users, carol.User.UID)
+	delete(cb.Nicks, "carol")
+
+	alice.acceptCommand(irc.Message{Command: "ACCEPT", Params: []string{"*"}})
+
+	want := []string{
+		"281 alice bob",
+		"282 alice End of /ACCEPT list",
+	}
+	got := drainCommands(alice)
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("ACCEPT * sent %q, wanted %q", got, want)
+	}
+
+	if _, ok := alice.User.AcceptList[bob.User.UID]; !ok ||
+		len(alice.User.AcceptList) != 1 {
+		t.Errorf("accept list = %v, wanted only bob", alice.User.AcceptList)
+	}
+}
+
+func TestPrivmsgCallerID(t *testing.T) {
+	cb := newSnapshotCatbox()
+	cb.Config.MaxNickLength = 9
+	alice := addCallerIDTestUser(cb, 1, "alice")
+	bob := addCallerIDTestUser(cb, 2, "bob")
+	carol := addCallerIDTestUser(cb, 3, "carol")
+
+	alice.User.Modes['g'] = struct{}{}
+	alice.User.AcceptList = map[TS6UID]struct{}{carol.User.UID: {}}
+
+	// Bob is not accepted. He hears about it and so does Alice.
+	bob.privmsgCommand(irc.Message{Command: "PRIVMSG",
+		Params: []string{"alice", "hi"}})
+
+	wantBob := []string{
+		"716 bob alice is in +g mode (server-side ignore)",
+		"717 bob alice has been informed that you messaged them.",
+	}
+	if got := drainCommands(bob); strings.Join(got, "\n") !=
+		strings.Join(wantBob, "\n") {
+		t.Errorf("rejected sender got %q, wanted %q", got, wantBob)
+	}
+
+	wantAlice := []string{
+		"718 alice bob user@host.example.com is messaging you, and you have umode +g.",
+	}
+	if got := drainCommands(alice); strings.Join(got, "\n") !=
+		strings.Join(wantAlice, "\n") {
+		t.Errorf("+g user got %q, wanted %q", got, wantAlice)
+	}
+
+	// Again. Alice was told recently so we don't tell her again.
+	bob.privmsgCommand(irc.Message{Command: "PRIVMSG",
+		Params: []string{"alice", "hi"}})
+
+	wantBob = []string{"716 bob alice is in +g mode (server-side ignore)"}
+	if got := drainCommands(bob); strings.Join(got, "\n") !=
+		strings.Join(wantBob, "\n") {
+		t.Errorf("rejected sender got %q, wanted %q", got, wantBob)
+	}
+	if got := drainCommands(alice); len(got) != 0 {
+		t.Errorf("+g user got %q, wanted nothing", got)
+	}
+
+	// NOTICE is dropped without replies.
+	bob.privmsgCommand(irc.Message{Command: "NOTICE",
+		Params: []string{"alice", "hi"}})
+	if got := drainCommands(bob); len(got) != 0 {
+		t.Errorf("NOTICE sender got %q, wanted nothing", got)
+	}
+	if got := drainCommands(alice); len(got) != 0 {
+		t.Errorf("+g user got %q from NOTICE, wanted nothing", got)
+	}
+
+	// Carol is accepted.
+	carol.privmsgCommand(irc.Message{Command: "PRIVMSG",
+		Params: []string{"alice", "hi"}})
+
+	wantAlice = []string{"PRIVMSG alice hi"}
+	if got := drainCommands(alice); strings.Join(got, "\n") !=
+		strings.Join(wantAlice, "\n") {
+		t.Errorf("+g user got %q, wanted %q", got, wantAlice)
+	}
+	if got := drainCommands(carol); len(got) != 0 {
+		t.Errorf("accepted sender got %q, wanted nothing", got)
+	}
+}
+
+func TestCanJoinBanException(t *testing.T) {
+	cb := &Catbox{Config: &Config{ServerName: "irc.example.com"}}
+
+	u := &LocalUser{
+		LocalClient: &LocalClient{Catbox: cb,
+			WriteChan: make(chan TaggedMessage, 10)},
+		User: &User{DisplayNick: "nick", Username: "user",
+			Hostname: "host.example.com", UID: TS6UID("000AAAAAA")},
+	}
+
+	channel := &Channel{Name: "#test", Members: map[TS6UID]struct{}{},
+		Modes: map[byte]struct{}{},
+		Bans:  []BanEntry{{Mask: "*!*@host.example.com"}}}
+
+	if u.canJoin(channel, "") {
+		t.Errorf("canJoin() let a banned user join")
+	}
+	if m := <-u.WriteChan; m.Command != "474" {
+		t.Errorf("canJoin() sent %s, wanted 474", m.Command)
+	}
+
+	channel.BanExceptions = []BanEntry{{Mask: "nick!*@*"}}
+	if !u.canJoin(channel, "") {
+		t.Errorf("canJoin() did not let a user matching a ban exception join")
+	}
+}
+
+func TestChannelModeListExceptions(t *testing.T) {
+	cb := &Catbox{Config: &Config{ServerName: "irc.example.com"}}
+
+	u := &LocalUser{
+		LocalClient: &LocalClient{Catbox: cb,
+			WriteChan: make(chan TaggedMessage, 10)},
+		User: &User{DisplayNick: "nick", UID: TS6UID("000AAAAAA")},
+	}
+
+	channel := &Channel{
+		Name:    "#test",
+		Members: map[TS6UID]struct{}{u.User.UID: {}},
+		Modes:   map[byte]struct{}{},
+		BanExceptions: []BanEntry{
+			{Mask: "friend!*@*", Setter: "op", TS: 100},
+			{Mask: "*!*@good.example.com", Setter: "irc.example.com", TS: 200},
+		},
+	}
+	u.User.Channels = map[string]*Channel{channel.Name: channel}
+
+	u.channelModeCommand(channel, "e", nil)
+
+	wanted := []string{
+		"348 nick #test friend!*@* op 100",
+		"348 nick #test *!*@good.example.com irc.example.com 200",
+		"349 nick #test End of channel exception list",
+	}
+	got := drainCommands(u)
+	if strings.Join(got, "\n") != strings.Join(wanted, "\n") {
+		t.Errorf("MODE #test e sent %q, wanted %q", got, wanted)
+	}
+}
+
+func TestTagmsgCommand(t *testing.T) {
+	cb := newSnapshotCatbox()
+	alice := addCallerIDTestUser(cb, 1, "alice")
+	bob := addCallerIDTestUser(cb, 2, "bob")
+	carol := addCallerIDTestUser(cb, 3, "carol")
+
+	for _, lu := range []*LocalUser{alice, bob, carol} {
+		lu.Caps = map[string]struct{}{"message-tags": {}}
+		lu.MessageCounter = UserMessageLimit
+	}
+	carol.Caps = map[string]struct{}{}
+
+	channel := &Channel{
+		Name: "#test",
+		Members: map[TS6UID]struct{}{alice.User.UID: {}, bob.User.UID: {},
+			carol.User.UID: {}},
+		Ops:    map[TS6UID]*User{},
+		Voices: map[TS6UID]*User{},
+		Modes:  map[byte]struct{}{},
+	}
+	cb.Channels[channel.Name] = channel
+	for _, lu := range []*LocalUser{alice, bob, carol} {
+		lu.User.Channels[channel.Name] = channel
+	}
+
+	tags := map[string]string{"+typing": "active", "label": "123"}
+
+	// To a channel. Only members with the capability get it, and only the
+	// client-only tags.
+	alice.handleMessage(irc.Message{Command: "TAGMSG",
+		Params: []string{"#test"}}, tags)
+
+	if len(bob.WriteChan) != 1 {
+		t.Fatalf("bob got %d messages, wanted 1", len(bob.WriteChan))
+	}
+	m := <-bob.WriteChan
+	if m.Command != "TAGMSG" || m.Prefix != alice.User.nickUhost() ||
+		m.Params[0] != "#test" {
+		t.Errorf("bob got %v", m)
+	}
+	if m.Tags["+typing"] != "active" || m.Tags["time"] == "" ||
+		len(m.Tags) != 2 {
+		t.Errorf("bob got tags %q", m.Tags)
+	}
+
+	if got := drainCommands(carol); len(got) != 0 {
+		t.Errorf("carol without message-tags got %q", got)
+	}
+	if got := drainCommands(alice); len(got) != 0 {
+		t.Errorf("alice got her own TAGMSG: %q", got)
+	}
+
+	// To a user.
+	alice.handleMessage(irc.Message{Command: "TAGMSG",
+		Params: []string{"bob"}}, tags)
+	if got := drainCommands(bob); len(got) != 1 || got[0] != "TAGMSG bob" {
+		t.Errorf("bob got %q, wanted TAGMSG bob", got)
+	}
+
+	alice.handleMessage(irc.Message{Command: "TAGMSG",
+		Params: []string{"carol"}}, tags)
+	if got := drainCommands(carol); len(got) != 0 {
+		t.Errorf("carol without message-tags got %q", got)
+	}
+
+	// Clients without the capability can't send it.
+	carol.handleMessage(irc.Message{Command: "TAGMSG",
+		Params: []string{"bob"}}, tags)
+	if got := drainCommands(carol); len(got) != 1 ||
+		got[0] != "421 carol TAGMSG Unknown command" {
+		t.Errorf("carol got %q, wanted 421", got)
+	}
+	if got := drainCommands(bob); len(got) != 0 {
+		t.Errorf("bob got %q from carol", got)
+	}
+}
+
+func TestPrivmsgServerMask(t *testing.T) {
+	tests := []struct {
+		oper     bool
+		target   string
+		operGot  []string
+		aliceGot []string
+		linkGot  []string
+	}{
+		// Only operators may use a server mask.
+		{
+			false,
+			"$*.example.com",
+			[]string{"481 oper Permission Denied- You're not an IRC operator"},
+			nil,
+			nil,
+		},
+		// We match as do both other servers.
+		{
+			true,
+			"$*.example.com",
+			[]string{"NOTICE $*.example.com hi"},
+			[]string{"NOTICE $*.example.com hi"},
+			[]string{"NOTICE $*.example.com hi"},
+		},
+		// Only a remote server matches.
+		{
+			true,
+			"$irc3.EXAMPLE.com",
+			nil,
+			nil,
+			[]string{"NOTICE $irc3.EXAMPLE.com hi"},
+		},
+		// Only we match.
+		{
+			true,
+			"$irc1.*",
+			[]string{"NOTICE $irc1.* hi"},
+			[]string{"NOTICE $irc1.* hi"},
+			nil,
+		},
+		// Nothing matches.
+		{
+			true,
+			"$*.example.org",
+			[]string{"401 oper $*.example.org No such nick/channel"},
+			nil,
+			nil,
+		},
+	}
+
+	for _, test := range tests {
+		cb := newTraceTestCatbox("irc1.example.com", "000")
+		link12 := addTraceTestLink(cb, 1, "irc2.example.com", "001")
+		cb.Servers["002"] = &Server{SID: "002", Name: "irc3.example.com",
+			ClosestServer: link12, LinkedTo: link12.Server}
+		oper := addCallerIDTestUser(cb, 0, "oper")
+		if test.oper {
+			oper.User.Modes['o'] = struct{}{}
+		}
+		alice := addCallerIDTestUser(cb, 1, "alice")
+
+		oper.privmsgCommand(irc.Message{Command: "NOTICE",
+			Params: []string{test.target, "hi"}})
+
+		if got := drainCommands(oper); strings.Join(got, "\n") !=
+			strings.Join(test.operGot, "\n") {
+			t.Errorf("%s: sender got %q, wanted %q", test.target, got, test.operGot)
+		}
+		if got := drainCommands(alice); strings.Join(got, "\n") !=
+			strings.Join(test.aliceGot, "\n") {
+			t.Errorf("%s: local user got %q, wanted %q", test.target, got,
+				test.aliceGot)
+		}
+
+		var linkGot []string
+		for len(link12.WriteChan) > 0 {
+			m := <-link12.WriteChan
+			if m.Prefix != string(oper.User.UID) {
+				t.Errorf("%s: propagated with prefix %s, wanted %s", test.target,
+					m.Prefix, oper.User.UID)
+			}
+			linkGot = append(linkGot, m.Command+" "+strings.Join(m.Params, " "))
+		}
+		if strings.Join(linkGot, "\n") != strings.Join(test.linkGot, "\n") {
+			t.Errorf("%s: link got %q, wanted %q", test.target, linkGot,
+				test.linkGot)
+		}
+	}
+}
+
+// Messages to a +c channel have their colors stripped for local and remote
+// members alike.
+func TestPrivmsgStripColors(t *testing.T) {
+	tests := []struct {
+		modes    map[byte]struct{}
+		text     string
+		aliceGot []string
+		bobGot   []string
+		linkGot  []string
+	}{
+		{
+			map[byte]struct{}{'c': {}},
+			"\x02hi\x02 \x034,5there",
+			nil,
+			[]string{"PRIVMSG #test hi there"},
+			[]string{"PRIVMSG #test hi there"},
+		},
+		// Nothing left after stripping.
+		{
+			map[byte]struct{}{'c': {}},
+			"\x0304\x02",
+			[]string{"412 alice No text to send"},
+			nil,
+			nil,
+		},
+		// Without +c we leave them.
+		{
+			map[byte]struct{}{},
+			"\x02hi\x02",
+			nil,
+			[]string{"PRIVMSG #test \x02hi\x02"},
+			[]string{"PRIVMSG #test \x02hi\x02"},
+		},
+	}
+
+	for _, test := range tests {
+		cb := newSnapshotCatbox()
+		link := addTraceTestLink(cb, 10, "irc2.example.com", "001")
+		alice := addCallerIDTestUser(cb, 1, "alice")
+		bob := addCallerIDTestUser(cb, 2, "bob")
+		carol := &User{DisplayNick: "carol", UID: "001AAAAAA",
+			Channels: map[string]*Channel{}, ClosestServer: link}
+		cb.Users[carol.UID] = carol
+
+		channel := &Channel{Name: "#test", Members: map[TS6UID]struct{}{},
+			Ops: map[TS6UID]*User{}, Voices: map[TS6UID]*User{},
+			Modes: test.modes}
+		cb.Channels[channel.Name] = channel
+		for _, u := range []*User{alice.User, bob.User, carol} {
+			channel.Members[u.UID] = struct{}{}
+			u.Channels[channel.Name] = channel
+		}
+
+		alice.privmsgCommand(irc.Message{Command: "PRIVMSG",
+			Params: []string{"#test", test.text}})
+
+		if got := drainCommands(alice); strings.Join(got, "\n") !=
+			strings.Join(test.aliceGot, "\n") {
+			t.Errorf("%q: sender got %q, wanted %q", test.text, got, test.aliceGot)
+		}
+		if got := drainCommands(bob); strings.Join(got, "\n") !=
+			strings.Join(test.bobGot, "\n") {
+			t.Errorf("%q: local member got %q, wanted %q", test.text, got,
+				test.bobGot)
+		}
+
+		var linkGot []string
+		for len(link.WriteChan) > 0 {
+			m := <-link.WriteChan
+			linkGot = append(linkGot, m.Command+" "+strings.Join(m.Params, " "))
+		}
+		if strings.Join(linkGot, "\n") != strings.Join(test.linkGot, "\n") {
+			t.Errorf("%q: link got %q, wanted %q", test.text, linkGot,
+				test.linkGot)
+		}
+	}
+}
+
+func TestDisabledCommands(t *testing.T) {
+	tests := []struct {
+		command string
+		output  string
+	}{
+		{"SUMMON", "445 alice SUMMON has been disabled"},
+		{"USERS", "446 alice USERS has been disabled"},
+		{"SERVICE", "421 alice SERVICE SERVICE is not implemented"},
+		{"SQUERY",
+			"421 alice SQUERY SQUERY is not implemented. Use PRIVMSG to message services"},
+	}
+
+	for _, test := range tests {
+		cb := newSnapshotCatbox()
+		alice := addCallerIDTestUser(cb, 1, "alice")
+		alice.MessageCounter = UserMessageLimit
+
+		alice.handleMessage(irc.Message{Command: test.command,
+			Params: []string{"bob"}}, nil)
+
+		got := drainCommands(alice)
+		if len(got) != 1 || got[0] != test.output {
+			t.Errorf("%s: got %q, wanted %q", test.command, got, test.output)
+		}
+	}
+}
+
+func TestMOTDThrottle(t *testing.T) {
+	cb := newSnapshotCatbox()
+	cb.Config.MOTD = "Hi"
+	cb.Config.MOTDThrottle = time.Minute
+	cb.MOTDThrottle = map[string]time.Time{}
+	alice := addCallerIDTestUser(cb, 1, "alice")
+	alice.User.IP = "192.168.0.1"
+	bob := addCallerIDTestUser(cb, 2, "bob")
+	bob.User.IP = "192.168.0.1"
+	carol := addCallerIDTestUser(cb, 3, "carol")
+	carol.User.IP = "192.168.0.2"
+
+	full := []string{
+		"375 alice - irc.example.com Message of the day - ",
+		"372 alice - Hi",
+		"376 alice End of MOTD command",
+	}
+	alice.motdCommand()
+	if got := drainCommands(alice); strings.Join(got, "\n") !=
+		strings.Join(full, "\n") {
+		t.Errorf("first MOTD was %q, wanted %q", got, full)
+	}
+
+	// The same IP again leaves out the MOTD.
+	bob.motdCommand()
+	throttled := []string{
+		"375 bob - irc.example.com Message of the day - ",
+		"376 bob End of MOTD command",
+	}
+	if got := drainCommands(bob); strings.Join(got, "\n") !=
+		strings.Join(throttled, "\n") {
+		t.Errorf("throttled MOTD was %q, wanted %q", got, throttled)
+	}
+
+	// A different IP gets it.
+	now := time.Now()
+	if carol.motdThrottled(now) {
+		t.Errorf("different IP was throttled")
+	}
+
+	// Operators get it.
+	bob.User.Modes['o'] = struct{}{}
+	if bob.motdThrottled(now) {
+		t.Errorf("operator was throttled")
+	}
+	delete(bob.User.Modes, 'o')
+	if !bob.motdThrottled(now) {
+		t.Errorf("IP was not throttled")
+	}
+
+	// Once the throttle expires, the IP gets it again.
+	if bob.motdThrottled(now.Add(2 * time.Minute)) {
+		t.Errorf("IP was throttled after the throttle expired")
+	}
+
+	// We forget IPs once they expire.
+	cb.cleanMOTDThrottle(now.Add(2*time.Minute + time.Second))
+	if _, exists := cb.MOTDThrottle["192.168.0.2"]; exists {
+		t.Errorf("did not forget expired IP")
+	}
+	if _, exists := cb.MOTDThrottle["192.168.0.1"]; !exists {
+		t.Errorf("forgot IP that received the MOTD recently")
+	}
+}
+
+// Opping several users where one of them is not on the channel ops the rest.
+func TestChannelModeCommandMultipleOps(t *testing.T) {
+	cb := newSnapshotCatbox()
+	link := addTraceTestLink(cb, 10, "irc2.example.com", "001")
+	var users []*LocalUser
+	for i, nick := range []string{"alice", "bob", "carol", "dave", "eve"} {
+		lu := addCallerIDTestUser(cb, uint64(i+1), nick)
+		users = append(users, lu)
+	}
+	alice := users[0]
+
+	channel := &Channel{
+		Name:    "#test",
+		Members: map[TS6UID]struct{}{},
+		Ops:     map[TS6UID]*User{alice.User.UID: alice.User},
+		Voices:  map[TS6UID]*User{},
+		Modes:   map[byte]struct{}{},
+		TS:      1234,
+	}
+	cb.Channels[channel.Name] = channel
+	// bob is not on the channel.
+	for _, lu := range users {
+		if lu.User.DisplayNick == "bob" {
+			continue
+		}
+		channel.Members[lu.User.UID] = struct{}{}
+		lu.User.Channels[channel.Name] = channel
+	}
+
+	alice.channelModeCommand(channel, "+oooo",
+		[]string{"bob", "carol", "dave", "eve"})
+
+	for _, lu := range users[2:] {
+		if !channel.userHasOps(lu.User) {
+			t.Errorf("%s does not have ops", lu.User.DisplayNick)
+		}
+	}
+	if channel.userHasOps(users[1].User) {
+		t.Errorf("user not on the channel has ops")
+	}
+
+	wanted := "MODE #test +ooo carol dave eve"
+	if got := drainCommands(alice); len(got) != 1 || got[0] != wanted {
+		t.Errorf("channel got %q, wanted %q", got, wanted)
+	}
+
+	if len(link.WriteChan) != 1 {
+		t.Fatalf("sent %d messages to server, wanted 1", len(link.WriteChan))
+	}
+	m := (<-link.WriteChan).Message
+	wanted = fmt.Sprintf("TMODE 1234 #test +ooo %s %s %s", users[2].User.UID,
+		users[3].User.UID, users[4].User.UID)
+	if got := m.Command + " " + strings.Join(m.Params, " "); got != wanted {
+		t.Errorf("propagated %q, wanted %q", got, wanted)
+	}
+}
+
+// Users who aren't flood exempt have their messages queued once they use up
+// their message counter. Exempt users don't.
+func TestHandleMessageFloodExempt(t *testing.T) {
+	cb := newSnapshotCatbox()
+	cb.Config.FloodExempt = []string{"10.0.0.0/8"}
+	alice := addCallerIDTestUser(cb, 1, "alice")
+	alice.User.IP = "192.168.0.1"
+	bob := addCallerIDTestUser(cb, 2, "bob")
+	bob.User.IP = "10.1.2.3"
+
+	for _, lu := range []*LocalUser{alice, bob} {
+		lu.handleMessage(irc.Message{Command: "PING", Params: []string{"x"}}, nil)
+	}
+
+	if len(alice.MessageQueue) != 1 {
+		t.Errorf("non-exempt user has %d queued messages, wanted 1",
+			len(alice.MessageQueue))
+	}
+	if len(bob.MessageQueue) != 0 {
+		t.Errorf("exempt user has %d queued messages, wanted 0",
+			len(bob.MessageQueue))
+	}
+	if got := drainCommands(bob); len(got) != 1 || got[0] != "PONG irc.example.com x" {
+		t.Errorf("exempt user got %q", got)
+	}
+}
+
+func TestGnoticeCommand(t *testing.T) {
+	cb := newSnapshotCatbox()
+	link := addTraceTestLink(cb, 10, "irc2.example.com", "001")
+	oper := addCallerIDTestUser(cb, 1, "oper")
+	alice := addCallerIDTestUser(cb, 2, "alice")
+
+	// Only operators may use it.
+	oper.gnoticeCommand(irc.Message{Command: "GNOTICE",
+		Params: []string{"Hello"}})
+	wanted := []string{"481 oper Permission Denied- You're not an IRC operator"}
+	if got := drainCommands(oper); strings.Join(got, "\n") !=
+		strings.Join(wanted, "\n") {
+		t.Errorf("non-oper got %q, wanted %q", got, wanted)
+	}
+
+	oper.User.Modes['o'] = struct{}{}
+	oper.gnoticeCommand(irc.Message{Command: "GNOTICE",
+		Params: []string{"Hello"}})
+
+	wanted = []string{"NOTICE alice *** Global Notice from oper: Hello"}
+	if got := drainCommands(alice); strings.Join(got, "\n") !=
+		strings.Join(wanted, "\n") {
+		t.Errorf("local user got %q, wanted %q", got, wanted)
+	}
+	wanted = []string{"NOTICE oper *** Global Notice from oper: Hello"}
+	if got := drainCommands(oper); strings.Join(got, "\n") !=
+		strings.Join(wanted, "\n") {
+		t.Errorf("oper got %q, wanted %q", got, wanted)
+	}
+
+	if len(link.WriteChan) != 1 {
+		t.Fatalf("sent %d messages to server, wanted 1", len(link.WriteChan))
+	}
+	m := (<-link.WriteChan).Message
+	if m.Prefix != string(oper.User.UID) || m.Command != "ENCAP" ||
+		strings.Join(m.Params, " ") != "* GNOTICE Hello" {
+		t.Errorf("propagated %v", m)
+	}
+
+	// Again right away is too soon.
+	oper.gnoticeCommand(irc.Message{Command: "GNOTICE",
+		Params: []string{"Hello"}})
+	wanted = []string{
+		"263 oper GNOTICE This command could not be completed because it has been used recently, and is rate-limited",
+	}
+	if got := drainCommands(oper); strings.Join(got, "\n") !=
+		strings.Join(wanted, "\n") {
+		t.Errorf("oper got %q, wanted %q", got, wanted)
+	}
+	if got := drainCommands(alice); len(got) != 0 {
+		t.Errorf("local user got %q from rate limited GNOTICE", got)
+	}
+	if len(link.WriteChan) != 0 {
+		t.Errorf("propagated rate limited GNOTICE")
+	}
+
+	// Once the interval passes they may send another.
+	oper.LastGNOTICETime = time.Now().Add(-GNOTICEInterval)
+	oper.gnoticeCommand(irc.Message{Command: "GNOTICE",
+		Params: []string{"Hello"}})
+	if got := drainCommands(alice); len(got) != 1 {
+		t.Errorf("local user got %q, wanted the notice", got)
+	}
+}
+
+func TestNickDelay(t *testing.T) {
+	cb := newSnapshotCatbox()
+	cb.Config.MaxNickLength = 9
+	cb.Config.NickDelay = time.Minute
+	alice := addCallerIDTestUser(cb, 1, "alice")
+	bob := addCallerIDTestUser(cb, 2, "bob")
+	oper := addCallerIDTestUser(cb, 3, "oper")
+	oper.User.Modes['o'] = struct{}{}
+
+	alice.quit("Bye", false)
+
+	// Someone else can't take the nick.
+	bob.nickCommand(irc.Message{Command: "NICK", Params: []string{"Alice"}})
+	wanted := "433 bob Alice Nickname is temporarily unavailable"
+	if got := drainCommands(bob); len(got) != 1 || got[0] != wanted {
+		t.Errorf("got %q, wanted %q", got, wanted)
+	}
+	if bob.User.DisplayNick != "bob" {
+		t.Errorf("took held nick")
+	}
+
+	// Once the hold expires, it is free.
+	now := time.Now()
+	if cb.isNickHeld("alice", now.Add(2*time.Minute)) {
+		t.Errorf("nick is held after the hold expired")
+	}
+
+	// We forget holds once they expire.
+	cb.cleanNickHolds(now)
+	if _, exists := cb.NickHolds["alice"]; !exists {
+		t.Errorf("forgot nick held recently")
+	}
+	cb.cleanNickHolds(now.Add(2 * time.Minute))
+	if _, exists := cb.NickHolds["alice"]; exists {
+		t.Errorf("did not forget expired hold")
+	}
+
+	// Operators can take held nicks.
+	bob.quit("Bye", false)
+	oper.nickCommand(irc.Message{Command: "NICK", Params: []string{"bob"}})
+	if oper.User.DisplayNick != "bob" {
+		t.Errorf("operator could not take held nick")
+	}
+
+	// Without a delay we don't hold nicks.
+	cb.Config.NickDelay = 0
+	cb.NickHolds = map[string]time.Time{}
+	oper.quit("Bye", false)
+	if cb.isNickHeld("bob", time.Now()) {
+		t.Errorf("held nick without a delay")
+	}
+}
+
+func TestKickCommand(t *testing.T) {
+	cb := newTraceTestCatbox("irc1.example.com", "000")
+	cb.Config.MaxKickLength = 10
+	cb.Channels = map[string]*Channel{}
+	link := addTraceTestLink(cb, 1, "irc2.example.com", "001")
+
+	alice := addCallerIDTestUser(cb, 2, "alice")
+	bob := addCallerIDTestUser(cb, 3, "bob")
+	carol := &User{DisplayNick: "carol", Username: "user",
+		Hostname: "remote.example.com", UID: "001AAAAAA",
+		Channels: map[string]*Channel{}, Server: link.Server,
+		ClosestServer: link}
+	cb.Users[carol.UID] = carol
+	cb.Nicks["carol"] = carol.UID
+
+	channel := &Channel{Name: "#test", Members: map[TS6UID]struct{}{},
+		Ops: map[TS6UID]*User{alice.User.UID: alice.User}}
+	cb.Channels[channel.Name] = channel
+	for _, user := range []*User{alice.User, bob.User, carol} {
+		channel.Members[user.UID] = struct{}{}
+		user.Channels[channel.Name] = channel
+	}
+
+	// Only ops may kick.
+	bob.kickCommand(irc.Message{Command: "KICK",
+		Params: []string{"#test", "alice"}})
+	if got := drainCommands(bob); len(got) != 1 ||
+		got[0] != "482 bob #test You're not channel operator" {
+		t.Errorf("non-op kick = %v, wanted 482", got)
+	}
+	if !alice.User.onChannel(channel) {
+		t.Errorf("non-op kicked alice")
+	}
+
+	// The target must be on the channel.
+	alice.kickCommand(irc.Message{Command: "KICK",
+		Params: []string{"#test", "nobody"}})
+	if got := drainCommands(alice); len(got) != 1 ||
+		!strings.HasPrefix(got[0], "401 ") {
+		t.Errorf("kicking unknown nick = %v, wanted 401", got)
+	}
+
+	// Kick a local user. The reason is truncated.
+	alice.kickCommand(irc.Message{Command: "KICK",
+		Params: []string{"#TEST", "Bob", "you have been bad"}})
+	for _, lu := range []*LocalUser{alice, bob} {
+		if got := drainCommands(lu); len(got) != 1 ||
+			got[0] != "KICK #test bob you have b" {
+			t.Errorf("%s got %v, wanted KICK", lu.User.DisplayNick, got)
+		}
+	}
+	if bob.User.onChannel(channel) {
+		t.Errorf("bob is still on the channel")
+	}
+	m := <-link.WriteChan
+	if got := m.Prefix + " " + m.Command + " " + strings.Join(m.Params, " "); got !=
+		string(alice.User.UID)+" KICK #test "+string(bob.User.UID)+" you have b" {
+		t.Errorf("propagated %s", got)
+	}
+
+	// Kick a remote user. The default reason is the kicker's nick.
+	alice.kickCommand(irc.Message{Command: "KICK",
+		Params: []string{"#test", "carol"}})
+	if got := drainCommands(alice); len(got) != 1 ||
+		got[0] != "KICK #test carol alice" {
+		t.Errorf("kicking remote user = %v", got)
+	}
+	if carol.onChannel(channel) {
+		t.Errorf("carol is still on the channel")
+	}
+	m = <-link.WriteChan
+	if got := m.Command + " " + strings.Join(m.Params, " "); got !=
+		"KICK #test 001AAAAAA alice" {
+		t.Errorf("propagated %s", got)
+	}
+
+	// Not on the channel any more.
+	alice.kickCommand(irc.Message{Command: "KICK",
+		Params: []string{"#test", "bob"}})
+	if got := drainCommands(alice); len(got) != 1 ||
+		got[0] != "441 alice bob #test They aren't on that channel" {
+		t.Errorf("kicking user not on channel = %v, wanted 441", got)
+	}
+}
+
+func TestLusersCommand(t *testing.T) {
+	lusers := func(lu *LocalUser) map[string]string {
+		got := map[string]string{}
+		lu.lusersCommand()
+		for len(lu.WriteChan) > 0 {
+			m := <-lu.WriteChan
+			got[m.Command] = strings.Join(m.Params[1:], " ")
+		}
+		return got
+	}
+
+	// Only our server.
+	cb := newTraceTestCatbox("irc1.example.com", "000")
+	cb.Channels = map[string]*Channel{}
+	alice := addCallerIDTestUser(cb, 1, "alice")
+	addCallerIDTestUser(cb, 2, "bob")
+
+	want := map[string]string{
+		"251": "There are 2 users and 0 services on 1 servers.",
+		"255": "I have 2 clients and 0 servers",
+		"265": "2 2 Current local users 2, max 2",
+		"266": "2 2 Current global users 2, max 2",
+		"250": "Highest connection count: 2 (2 clients) (0 connections received)",
+	}
+	got := lusers(alice)
+	for command, wanted := range want {
+		if got[command] != wanted {
+			t.Errorf("single server %s = %q, wanted %q", command, got[command],
+				wanted)
+		}
+	}
+
+	// Linked to irc2, which is linked to irc3. They have a user each.
+	link := addTraceTestLink(cb, 10, "irc2.example.com", "001")
+	cb.Servers["002"] = &Server{SID: "002", Name: "irc3.example.com",
+		ClosestServer: link, LinkedTo: link.Server}
+	for _, uid := range []TS6UID{"001AAAAAA", "002AAAAAA"} {
+		cb.Users[uid] = &User{DisplayNick: string(uid), UID: uid,
+			Modes: map[byte]struct{}{}, ClosestServer: link}
+	}
+
+	want = map[string]string{
+		"251": "There are 4 users and 0 services on 3 servers.",
+		"255": "I have 2 clients and 1 servers",
+		"265": "2 2 Current local users 2, max 2",
+		"266": "4 4 Current global users 4, max 4",
+		"250": "Highest connection count: 3 (2 clients) (0 connections received)",
+	}
+	got = lusers(alice)
+	for command, wanted := range want {
+		if got[command] != wanted {
+			t.Errorf("linked %s = %q, wanted %q", command, got[command], wanted)
+		}
+	}
+
+	// The maximums stay when users leave.
+	delete(cb.Users, "002AAAAAA")
+	if got := lusers(alice)["266"]; got != "3 4 Current global users 3, max 4" {
+		t.Errorf("after a user left 266 = %q", got)
+	}
+}
+
+func TestMapCommand(t *testing.T) {
+	// irc1 (us) - irc2 - irc3 - irc4, and irc1 - irc5.
+	cb := newTraceTestCatbox("irc1.example.com", "000")
+	cb.Config.MapMaxDepth = 5
+	alice := addCallerIDTestUser(cb, 1, "alice")
+	link2 := addTraceTestLink(cb, 2, "irc2.example.com", "002")
+	link2.Server.HopCount = 1
+	link5 := addTraceTestLink(cb, 5, "irc5.example.com", "005")
+	link5.Server.HopCount = 1
+	irc3 := &Server{SID: "003", Name: "irc3.example.com", HopCount: 2,
+		ClosestServer: link2, LinkedTo: link2.Server}
+	irc4 := &Server{SID: "004", Name: "irc4.example.com", HopCount: 3,
+		ClosestServer: link2, LinkedTo: irc3}
+	cb.Servers[irc3.SID] = irc3
+	cb.Servers[irc4.SID] = irc4
+	bob := &User{DisplayNick: "bob", UID: "003AAAAAA",
+		Modes: map[byte]struct{}{}, Server: irc3, ClosestServer: link2}
+	cb.Users[bob.UID] = bob
+
+	mapLines := func() []string {
+		alice.mapCommand(irc.Message{Command: "MAP"})
+		var got []string
+		for _, line := range drainCommands(alice) {
+			got = append(got, strings.TrimPrefix(line, "015 alice "))
+		}
+		return got
+	}
+
+	wanted := []string{
+		"irc1.example.com[000] ---------------------------- | Users: 1 ( 50.0%)",
+		"  irc2.example.com[002] -------------------------- | Users: 0 (  0.0%)",
+		"    irc3.example.com[003] ------------------------ | Users: 1 ( 50.0%)",
+		"      irc4.example.com[004] ---------------------- | Users: 0 (  0.0%)",
+		"  irc5.example.com[005] -------------------------- | Users: 0 (  0.0%)",
+		"Total: 2 users on 5 servers",
+		"017 alice End of /MAP",
+	}
+	if got := mapLines(); strings.Join(got, "\n") != strings.Join(wanted, "\n") {
+		t.Errorf("MAP got\n%s\nwanted\n%s", strings.Join(got, "\n"),
+			strings.Join(wanted, "\n"))
+	}
+
+	// Servers beyond the depth are summarized.
+	cb.Config.MapMaxDepth = 1
+	wanted = []string{
+		"irc1.example.com[000] ---------------------------- | Users: 1 ( 50.0%)",
+		"  irc2.example.com[002] -------------------------- | Users: 0 (  0.0%)",
+		"    [... 2 more]",
+		"  irc5.example.com[005] -------------------------- | Users: 0 (  0.0%)",
+		"Total: 2 users on 5 servers",
+		"017 alice End of /MAP",
+	}
+	if got := mapLines(); strings.Join(got, "\n") != strings.Join(wanted, "\n") {
+		t.Errorf("MAP with depth 1 got\n%s\nwanted\n%s", strings.Join(got, "\n"),
+			strings.Join(wanted, "\n"))
+	}
+
+	// A loop in the topology doesn't make us loop.
+	cb.Config.MapMaxDepth = 5
+	irc3.LinkedTo = irc4
+	irc4.LinkedTo = irc3
+	got := mapLines()
+	if len(got) != 5 || got[len(got)-1] != "017 alice End of /MAP" {
+		t.Errorf("MAP with a loop got %q", got)
+	}
+}
+
+func TestMessageLengthLimits(t *testing.T) {
+	cb := newSnapshotCatbox()
+	cb.Config.MaxQuitLength = 10
+	cb.Config.MaxPartLength = 10
+	link := addTraceTestLink(cb, 10, "irc2.example.com", "001")
+	alice := addCallerIDTestUser(cb, 1, "alice")
+	bob := addCallerIDTestUser(cb, 2, "bob")
+
+	channel := &Channel{Name: "#test", Members: map[TS6UID]struct{}{},
+		Ops: map[TS6UID]*User{alice.User.UID: alice.User}}
+	cb.Channels[channel.Name] = channel
+	for _, user := range []*User{alice.User, bob.User} {
+		channel.Members[user.UID] = struct{}{}
+		user.Channels[channel.Name] = channel
+	}
+
+	// A topic at the limit is left alone. One past it is cut.
+	topic := strings.Repeat("a", maxTopicLength)
+	for _, sent := range []string{topic, topic + "b"} {
+		alice.topicCommand(irc.Message{Command: "TOPIC",
+			Params: []string{"#test", sent}})
+		if channel.Topic != topic {
+			t.Errorf("topic is %d bytes, wanted %d", len(channel.Topic),
+				len(topic))
+		}
+		if got := drainCommands(bob); len(got) != 1 ||
+			got[0] != "TOPIC #test "+topic {
+			t.Errorf("bob got %q, wanted the TOPIC", got)
+		}
+		if m := (<-link.WriteChan).Message; m.Params[1] != topic {
+			t.Errorf("propagated topic %q", m.Params[1])
+		}
+	}
+	_ = drainCommands(alice)
+
+	// We don't cut a character in half. é is two bytes.
+	bob.partCommand(irc.Message{Command: "PART",
+		Params: []string{"#test", "goodbye \u00e9\u00e9"}})
+	for _, lu := range []*LocalUser{alice, bob} {
+		if got := drainCommands(lu); len(got) != 1 ||
+			got[0] != "PART #test goodbye \u00e9" {
+			t.Errorf("%s got %q, wanted the PART", lu.User.DisplayNick, got)
+		}
+	}
+	if m := (<-link.WriteChan).Message; m.Params[1] != "goodbye \u00e9" {
+		t.Errorf("propagated part message %q", m.Params[1])
+	}
+
+	alice.quitCommand(irc.Message{Command: "QUIT",
+		Params: []string{"0123456789abc"}})
+	if len(link.WriteChan) != 1 {
+		t.Fatalf("sent %d messages to server, wanted 1", len(link.WriteChan))
+	}
+	if m := (<-link.WriteChan).Message; m.Command != "QUIT" ||
+		m.Params[0] != "Quit: 0123456789" {
+		t.Errorf("propagated %v", m)
+	}
+}
+
+func TestHalfOpPrivileges(t *testing.T) {
+	cb := newSnapshotCatbox()
+	cb.Config.MaxKickLength = 255
+	addTraceTestLink(cb, 10, "irc2.example.com", "001")
+	alice := addCallerIDTestUser(cb, 1, "alice")
+	bob := addCallerIDTestUser(cb, 2, "bob")
+	carol := addCallerIDTestUser(cb, 3, "carol")
+	dave := addCallerIDTestUser(cb, 4, "dave")
+
+	channel := &Channel{
+		Name:    "#test",
+		Members: map[TS6UID]struct{}{},
+		Ops:     map[TS6UID]*User{alice.User.UID: alice.User},
+		Voices:  map[TS6UID]*User{},
+		Modes:   map[byte]struct{}{},
+		TS:      1234,
+	}
+	cb.Channels[channel.Name] = channel
+	for _, lu := range []*LocalUser{alice, bob, carol, dave} {
+		channel.Members[lu.User.UID] = struct{}{}
+		lu.User.Channels[channel.Name] = channel
+	}
+
+	// Ops may grant half-op.
+	alice.channelModeCommand(channel, "+hh", []string{"bob", "dave"})
+	if !channel.userIsHalfOp(bob.User) || !channel.userIsHalfOp(dave.User) {
+		t.Fatalf("bob or dave is not a half-op")
+	}
+	if got := drainCommands(carol); len(got) != 1 ||
+		got[0] != "MODE #test +hh bob dave" {
+		t.Errorf("carol got %q", got)
+	}
+
+	// Half-ops may ban and voice.
+	drainCommands(bob)
+	bob.channelModeCommand(channel, "+bv", []string{"*!*@bad.example.com",
+		"carol"})
+	if len(channel.Bans) != 1 || !channel.userHasVoice(carol.User) {
+		t.Errorf("half-op could not ban or voice")
+	}
+
+	// They may not grant ops or half-op, or change other modes.
+	for _, modes := range []string{"+o", "+h", "+bo", "+m"} {
+		drainCommands(bob)
+		bob.channelModeCommand(channel, modes, []string{"carol", "carol"})
+		if got := drainCommands(bob); len(got) != 1 ||
+			got[0] != "482 bob #test You're not channel operator" {
+			t.Errorf("half-op setting %s got %q, wanted 482", modes, got)
+		}
+	}
+	if channel.userHasOps(carol.User) || channel.userIsHalfOp(carol.User) {
+		t.Errorf("half-op granted carol privileges")
+	}
+
+	// Half-ops may not kick ops or other half-ops.
+	for _, nick := range []string{"alice", "dave"} {
+		bob.kickCommand(irc.Message{Command: "KICK",
+			Params: []string{"#test", nick}})
+		if got := drainCommands(bob); len(got) != 1 ||
+			got[0] != "482 bob #test You're not channel operator" {
+			t.Errorf("half-op kicking %s got %q, wanted 482", nick, got)
+		}
+	}
+
+	// They may kick regular users.
+	bob.kickCommand(irc.Message{Command: "KICK",
+		Params: []string{"#test", "carol"}})
+	if carol.User.onChannel(channel) {
+		t.Errorf("half-op could not kick carol")
+	}
+
+	// Ops may kick half-ops and take half-op away.
+	alice.channelModeCommand(channel, "-h", []string{"dave"})
+	alice.kickCommand(irc.Message{Command: "KICK",
+		Params: []string{"#test", "bob"}})
+	if channel.userIsHalfOp(dave.User) || bob.User.onChannel(channel) {
+		t.Errorf("op could not remove half-op or kick half-op")
+	}
+}
+
+func TestChannelModeCommandOwner(t *testing.T) {
+	cb := newSnapshotCatbox()
+	link := addTraceTestLink(cb, 10, "irc2.example.com", "001")
+	alice := addCallerIDTestUser(cb, 1, "alice")
+	bob := addCallerIDTestUser(cb, 2, "bob")
+
+	channel := &Channel{
+		Name:    "#test",
+		Members: map[TS6UID]struct{}{},
+		Ops:     map[TS6UID]*User{alice.User.UID: alice.User},
+		Voices:  map[TS6UID]*User{},
+		Modes:   map[byte]struct{}{},
+		TS:      1234,
+	}
+	cb.Channels[channel.Name] = channel
+	for _, lu := range []*LocalUser{alice, bob} {
+		channel.Members[lu.User.UID] = struct{}{}
+		lu.User.Channels[channel.Name] = channel
+	}
+
+	// Ops may grant owner status.
+	alice.channelModeCommand(channel, "+qo", []string{"bob", "bob"})
+	if !channel.userIsOwner(bob.User) {
+		t.Fatalf("bob is not an owner")
+	}
+	if got := drainCommands(bob); len(got) != 1 ||
+		got[0] != "MODE #test +qo bob bob" {
+		t.Errorf("bob got %q", got)
+	}
+	if len(link.WriteChan) != 1 {
+		t.Fatalf("sent %d messages to server, wanted 1", len(link.WriteChan))
+	}
+	m := (<-link.WriteChan).Message
+	wanted := fmt.Sprintf("TMODE 1234 #test +qo %s %s", bob.User.UID,
+		bob.User.UID)
+	if got := m.Command + " " + strings.Join(m.Params, " "); got != wanted {
+		t.Errorf("propagated %q, wanted %q", got, wanted)
+	}
+
+	// Only owners may take it away.
+	drainCommands(alice)
+	alice.channelModeCommand(channel, "-q", []string{"bob"})
+	if got := drainCommands(alice); len(got) != 1 ||
+		got[0] != "482 alice #test You're not channel owner" {
+		t.Errorf("alice got %q, wanted 482", got)
+	}
+	if !channel.userIsOwner(bob.User) {
+		t.Errorf("non-owner removed owner")
+	}
+
+	// Owners have ops. Bob may deop alice even after losing +o.
+	bob.channelModeCommand(channel, "-o", []string{"bob"})
+	bob.channelModeCommand(channel, "-o", []string{"alice"})
+	if channel.userHasOps(alice.User) || !channel.userHasOps(bob.User) {
+		t.Errorf("alice ops %v, bob ops %v", channel.userHasOps(alice.User),
+			channel.userHasOps(bob.User))
+	}
+
+	bob.channelModeCommand(channel, "-q", []string{"bob"})
+	if channel.userIsOwner(bob.User) || channel.userHasOps(bob.User) {
+		t.Errorf("bob is still an owner")
+	}
+}
+
+func TestOperActionStats(t *testing.T) {
+	cb := newSnapshotCatbox()
+	link := addTraceTestLink(cb, 10, "irc2.example.com", "001")
+	cb.Servers["002"] = &Server{SID: "002", Name: "irc3.example.com",
+		ClosestServer: link, LinkedTo: link.Server}
+	oper := addCallerIDTestUser(cb, 1, "oper")
+	oper.User.Modes['o'] = struct{}{}
+	alice := addCallerIDTestUser(cb, 2, "alice")
+	carol := &User{DisplayNick: "carol", Username: "user",
+		Hostname: "remote.example.com", UID: "001AAAAAA",
+		Channels: map[string]*Channel{}, Server: link.Server,
+		ClosestServer: link}
+	cb.Users[carol.UID] = carol
+	cb.Nicks["carol"] = carol.UID
+
+	drainLink := func() {
+		for len(link.WriteChan) > 0 {
+			<-link.WriteChan
+		}
+	}
+
+	// Only opers' actions count.
+	alice.killCommand(irc.Message{Command: "KILL", Params: []string{"carol"}})
+	if _, exists := cb.OperActions[alice.User.UID]; exists {
+		t.Errorf("counted a non-oper's KILL")
+	}
+
+	oper.killCommand(irc.Message{Command: "KILL",
+		Params: []string{"carol", "bye"}})
+	drainLink()
+	oper.klineCommand(irc.Message{Command: "KLINE",
+		Params: []string{"*@bad.example.com", "Go away"}})
+	drainLink()
+	oper.unklineCommand(irc.Message{Command: "UNKLINE",
+		Params: []string{"*@bad.example.com"}})
+	drainLink()
+	// Removing a K-Line that doesn't exist doesn't count.
+	oper.unklineCommand(irc.Message{Command: "UNKLINE",
+		Params: []string{"*@bad.example.com"}})
+	drainLink()
+	oper.rehashCommand(irc.Message{Command: "REHASH",
+		Params: []string{"irc3.example.com"}})
+	drainLink()
+	oper.squitCommand(irc.Message{Command: "SQUIT",
+		Params: []string{"irc3.example.com", "bye"}})
+	drainLink()
+
+	stats := cb.OperActions[oper.User.UID]
+	if stats == nil {
+		t.Fatalf("no stats for oper")
+	}
+	wanted := OperStats{KillCount: 1, KLineCount: 1, UnKLineCount: 1,
+		RehashCount: 1, SquitCount: 1}
+	if *stats != wanted {
+		t.Errorf("stats = %+v, wanted %+v", *stats, wanted)
+	}
+
+	// Opers who left show without a nick.
+	cb.OperActions["000AAAAAZ"] = &OperStats{KillCount: 2}
+
+	drainCommands(oper)
+	oper.statsCommand(irc.Message{Command: "STATS", Params: []string{"p"}})
+	wantedLines := []string{
+		"249 oper p 000AAAAAB oper Kills: 1 K-Lines: 1 UnK-Lines: 1 Rehashes: 1 Squits: 1",
+		"249 oper p 000AAAAAZ * Kills: 2 K-Lines: 0 UnK-Lines: 0 Rehashes: 0 Squits: 0",
+		"219 oper p End of /STATS report",
+	}
+	if got := drainCommands(oper); strings.Join(got, "\n") !=
+		strings.Join(wantedLines, "\n") {
+		t.Errorf("STATS p got %q, wanted %q", got, wantedLines)
+	}
+}
+
+func TestStatsUptime(t *testing.T) {
+	cb := newSnapshotCatbox()
+	cb.StartTime = time.Now().Add(-(2*24*time.Hour + 3*time.Hour +
+		4*time.Minute + 5*time.Second + 500*time.Millisecond))
+	cb.HighestConnectionCount = 7
+	cb.HighestLocalUserCount = 3
+	cb.ConnectionCount = 42
+	user := addCallerIDTestUser(cb, 1, "user")
+	oper := addCallerIDTestUser(cb, 2, "oper")
+	oper.User.Modes['o'] = struct{}{}
+
+	wanted := []string{
+		"242 user Server Up 2 days 03:04:05",
+		"250 user Highest connection count: 7 (3 clients) (42 connections received)",
+		"219 user u End of /STATS report",
+	}
+	user.statsCommand(irc.Message{Command: "STATS", Params: []string{"u"}})
+	if got := drainCommands(user); strings.Join(got, "\n") !=
+		strings.Join(wanted, "\n") {
+		t.Errorf("STATS u got %q, wanted %q", got, wanted)
+	}
+
+	// With hide-stats only opers may see it.
+	cb.Config.HideStats = true
+	user.statsCommand(irc.Message{Command: "STATS", Params: []string{"u"}})
+	if got := drainCommands(user); len(got) != 1 ||
+		!strings.HasPrefix(got[0], "481 ") {
+		t.Errorf("STATS u with hide-stats got %q, wanted 481", got)
+	}
+
+	oper.statsCommand(irc.Message{Command: "STATS", Params: []string{"u"}})
+	if got := drainCommands(oper); len(got) != 3 ||
+		got[0] != "242 oper Server Up 2 days 03:04:05" {
+		t.Errorf("STATS u from oper with hide-stats got %q", got)
+	}
+}
+
+// An oper on irc1 uses OPME in a channel they're already on. Local users see
+// MODE, irc2 gets TMODE with the oper's UID, and users on irc2 see MODE.
+func TestOPMEPropagation(t *testing.T) {
+	newChannel := func() *Channel {
+		return &Channel{
+			Name:    "#test",
+			Members: map[TS6UID]struct{}{},
+			Ops:     map[TS6UID]*User{},
+			Voices:  map[TS6UID]*User{},
+			Modes:   map[byte]struct{}{},
+			TS:      100,
+		}
+	}
+
+	cb1 := newSnapshotCatbox()
+	link12 := addTraceTestLink(cb1, 10, "irc2.example.com", "001")
+	alice := addCallerIDTestUser(cb1, 1, "alice")
+	oper := addCallerIDTestUser(cb1, 2, "oper")
+	oper.User.Modes['o'] = struct{}{}
+	cb1.Opers[oper.User.UID] = oper.User
+	channel1 := newChannel()
+	cb1.Channels[channel1.Name] = channel1
+	for _, lu := range []*LocalUser{alice, oper} {
+		channel1.Members[lu.User.UID] = struct{}{}
+		lu.User.Channels[channel1.Name] = channel1
+	}
+
+	cb2 := newSnapshotCatbox()
+	cb2.Config.ServerName = "irc2.example.com"
+	cb2.Config.TS6SID = "001"
+	link21 := addTraceTestLink(cb2, 10, "irc.example.com", "000")
+	bob := addCallerIDTestUser(cb2, 5, "bob")
+	remoteOper := &User{DisplayNick: "oper", Username: "user",
+		Hostname: "host.example.com", UID: oper.User.UID,
+		Modes: map[byte]struct{}{'o': {}}, Channels: map[string]*Channel{},
+		ClosestServer: link21}
+	cb2.Users[remoteOper.UID] = remoteOper
+	channel2 := newChannel()
+	cb2.Channels[channel2.Name] = channel2
+	for _, user := range []*User{bob.User, remoteOper} {
+		channel2.Members[user.UID] = struct{}{}
+		user.Channels[channel2.Name] = channel2
+	}
+
+	oper.opmeCommand(irc.Message{Command: "OPME", Params: []string{"#test"}})
+
+	if !channel1.userHasOps(oper.User) {
+		t.Fatalf("OPME did not give the oper ops")
+	}
+	if got := drainCommands(alice); len(got) != 1 ||
+		got[0] != "MODE #test +o oper" {
+		t.Errorf("alice got %q", got)
+	}
+
+	if len(link12.WriteChan) != 1 {
+		t.Fatalf("sent %d messages to irc2, wanted 1", len(link12.WriteChan))
+	}
+	m := (<-link12.WriteChan).Message
+	if m.Prefix != "000" || m.Command != "TMODE" ||
+		strings.Join(m.Params, " ") != "100 #test +o "+string(oper.User.UID) {
+		t.Fatalf("propagated %s", m)
+	}
+
+	link21.tmodeCommand(m)
+
+	if !channel2.userHasOps(remoteOper) {
+		t.Errorf("TMODE did not give the oper ops on irc2")
+	}
+	if got := drainCommands(bob); len(got) != 1 ||
+		got[0] != "MODE #test +o oper" {
+		t.Errorf("bob got %q", got)
+	}
+}
+
+func TestWhoisThrottle(t *testing.T) {
+	cb := newSnapshotCatbox()
+	cb.Config.MaxWhoisPerMinute = 2
+	link := addTraceTestLink(cb, 10, "irc2.example.com", "001")
+	alice := addCallerIDTestUser(cb, 1, "alice")
+	bob := addCallerIDTestUser(cb, 2, "bob")
+	oper := addCallerIDTestUser(cb, 3, "oper")
+	oper.User.Modes['o'] = struct{}{}
+	carol := &User{DisplayNick: "carol", UID: "001AAAAAA",
+		Modes: map[byte]struct{}{}, Channels: map[string]*Channel{},
+		ClosestServer: link}
+	cb.Users[carol.UID] = carol
+	cb.Nicks["carol"] = carol.UID
+
+	whois := func(lu *LocalUser, nick string) []string {
+		lu.whoisCommand(irc.Message{Command: "WHOIS", Params: []string{nick}})
+		return drainCommands(lu)
+	}
+	throttled := func(got []string) bool {
+		return len(got) == 1 && strings.HasPrefix(got[0], "263 ")
+	}
+
+	// Up to the limit they get replies, whether the user is local or remote.
+	if got := whois(alice, "bob"); len(got) == 0 || throttled(got) {
+		t.Fatalf("first WHOIS got %q", got)
+	}
+	if got := whois(alice, "carol"); len(got) != 0 {
+		t.Fatalf("WHOIS of remote user got %q", got)
+	}
+	if len(link.WriteChan) != 1 {
+		t.Fatalf("sent %d messages to irc2, wanted 1", len(link.WriteChan))
+	}
+	<-link.WriteChan
+
+	// Past the limit they don't, and we don't ask other servers.
+	if got := whois(alice, "bob"); !throttled(got) {
+		t.Errorf("third WHOIS got %q, wanted 263", got)
+	}
+	if got := whois(alice, "carol"); !throttled(got) {
+		t.Errorf("WHOIS of remote user past the limit got %q, wanted 263", got)
+	}
+	if len(link.WriteChan) != 0 {
+		t.Errorf("sent a throttled WHOIS to irc2")
+	}
+
+	// The window lasts a minute.
+	start := alice.WhoisWindowStart
+	alice.resetWhoisCount(start.Add(59 * time.Second))
+	if got := whois(alice, "bob"); !throttled(got) {
+		t.Errorf("WHOIS inside the window got %q, wanted 263", got)
+	}
+	alice.resetWhoisCount(start.Add(time.Minute))
+	if got := whois(alice, "bob"); len(got) == 0 || throttled(got) {
+		t.Errorf("WHOIS in a new window got %q", got)
+	}
+
+	// Others have their own count.
+	if got := whois(bob, "alice"); len(got) == 0 || throttled(got) {
+		t.Errorf("bob's WHOIS got %q", got)
+	}
+
+	// Opers are exempt.
+	for i := 0; i < 5; i++ {
+		if got := whois(oper, "bob"); len(got) == 0 || throttled(got) {
+			t.Fatalf("oper WHOIS %d got %q", i, got)
+		}
+	}
+
+	// 0 means no limit.
+	cb.Config.MaxWhoisPerMinute = 0
+	if got := whois(alice, "bob"); len(got) == 0 || throttled(got) {
+		t.Errorf("WHOIS with no limit got %q", got)
+	}
+}
+
+func TestConnectCommand(t *testing.T) {
+	cb := newSnapshotCatbox()
+	cb.Config.Servers = map[string]*ServerDefinition{
+		"irc2.example.com": {Name: "irc2.example.com", Port: 6667},
+	}
+	link := addTraceTestLink(cb, 10, "irc2.example.com", "001")
+	cb.Servers["002"] = &Server{SID: "002", Name: "irc3.example.com",
+		ClosestServer: link, LinkedTo: link.Server}
+	oper := addCallerIDTestUser(cb, 1, "oper")
+	oper.User.Modes['o'] = struct{}{}
+
+	tests := []struct {
+		params []string
+		reply  string
+	}{
+		{[]string{"irc9.example.com"}, "402 oper irc9.example.com No such server"},
+		{[]string{"irc2.example.com"},
+			"NOTICE oper *** Notice --- I am already linked to irc2.example.com."},
+		{[]string{"irc2.example.com", "port"},
+			"NOTICE oper *** Notice --- Invalid port: port"},
+		// Asking a server we don't know about.
+		{[]string{"irc4.example.com", "0", "irc9.example.com"},
+			"402 oper irc9.example.com No such server"},
+		// Naming ourself as the remote is a local CONNECT.
+		{[]string{"irc2.example.com", "0", "irc.example.com"},
+			"NOTICE oper *** Notice --- I am already linked to irc2.example.com."},
+		{[]string{"irc4.example.com", "7000", "irc3.example.com"},
+			"NOTICE oper *** Notice --- Sending CONNECT irc4.example.com to irc3.example.com"},
+	}
+
+	for _, test := range tests {
+		oper.connectCommand(irc.Message{Command: "CONNECT", Params: test.params})
+		if got := drainCommands(oper); len(got) != 1 || got[0] != test.reply {
+			t.Errorf("CONNECT %v got %q, wanted %s", test.params, got, test.reply)
+		}
+	}
+
+	// We forwarded the last one toward irc3. Only it acts on it.
+	if len(link.WriteChan) != 1 {
+		t.Fatalf("sent %d messages to irc2, wanted 1", len(link.WriteChan))
+	}
+	m := (<-link.WriteChan).Message
+	if got := m.Prefix + " " + m.Command + " " + strings.Join(m.Params, " "); got !=
+		string(oper.User.UID)+" ENCAP irc3.example.com CONNECT irc4.example.com 7000" {
+		t.Errorf("forwarded %s", got)
+	}
+
+	// Only opers may CONNECT.
+	alice := addCallerIDTestUser(cb, 2, "alice")
+	alice.connectCommand(irc.Message{Command: "CONNECT",
+		Params: []string{"irc4.example.com", "0", "irc3.example.com"}})
+	if got := drainCommands(alice); len(got) != 1 ||
+		!strings.HasPrefix(got[0], "481 ") {
+		t.Errorf("non-oper CONNECT got %q, wanted 481", got)
+	}
+}
+
+func TestKickCommandMultipleTargets(t *testing.T) {
+	cb := newSnapshotCatbox()
+	cb.Config.MaxKickLength = 5
+	link := addTraceTestLink(cb, 10, "irc2.example.com", "001")
+	alice := addCallerIDTestUser(cb, 1, "alice")
+	bob := addCallerIDTestUser(cb, 2, "bob")
+	carol := addCallerIDTestUser(cb, 3, "carol")
+	dave := addCallerIDTestUser(cb, 4, "dave")
+
+	channel := &Channel{
+		Name:    "#test",
+		Members: map[TS6UID]struct{}{},
+		Ops:     map[TS6UID]*User{alice.User.UID: alice.User},
+		Voices:  map[TS6UID]*User{},
+		Modes:   map[byte]struct{}{},
+	}
+	cb.Channels[channel.Name] = channel
+	for _, lu := range []*LocalUser{alice, bob, carol} {
+		channel.Members[lu.User.UID] = struct{}{}
+		lu.User.Channels[channel.Name] = channel
+	}
+
+	// Dave is not on the channel and nobody does not exist. We kick the
+	// others and report each failure.
+	alice.kickCommand(irc.Message{Command: "KICK",
+		Params: []string{"#test", "bob,dave,nobody,carol", "go away"}})
+
+	wanted := []string{
+		"KICK #test bob go aw",
+		"441 alice dave #test They aren't on that channel",
+		"401 alice nobody No such nick/channel",
+		"KICK #test carol go aw",
+	}
+	if got := drainCommands(alice); strings.Join(got, "\n") !=
+		strings.Join(wanted, "\n") {
+		t.Errorf("alice got %q, wanted %q", got, wanted)
+	}
+	if bob.User.onChannel(channel) || carol.User.onChannel(channel) {
+		t.Errorf("bob or carol is still on the channel")
+	}
+	if got := drainCommands(dave); len(got) != 0 {
+		t.Errorf("dave got %q", got)
+	}
+
+	// Each kick goes to servers on its own.
+	for _, uid := range []TS6UID{bob.User.UID, carol.User.UID} {
+		m := (<-link.WriteChan).Message
+		if got := m.Command + " " + strings.Join(m.Params, " "); got !=
+			"KICK #test "+string(uid)+" go aw" {
+			t.Errorf("propagated %s", got)
+		}
+	}
+	if len(link.WriteChan) != 0 {
+		t.Errorf("propagated %d extra messages", len(link.WriteChan))
+	}
+}
+
+func TestWhoFlags(t *testing.T) {
+	cb := newSnapshotCatbox()
+	link := addTraceTestLink(cb, 10, "irc2.example.com", "001")
+	alice := addCallerIDTestUser(cb, 1, "alice")
+	bob := addCallerIDTestUser(cb, 2, "bob")
+	bob.User.Modes['o'] = struct{}{}
+	carol := addCallerIDTestUser(cb, 3, "carol")
+	carol.User.Account = "carol"
+	dave := addCallerIDTestUser(cb, 4, "dave")
+	dave.User.Modes['o'] = struct{}{}
+	dave.User.Account = "dave"
+
+	// Dave and erin are on TLS. Erin is remote, so we don't know it.
+	client, server := net.Pipe()
+	defer func() {
+		_ = client.Close()
+		_ = server.Close()
+	}()
+	dave.Conn = Conn{conn: tls.Server(server, &tls.Config{})}
+	erin := &User{DisplayNick: "erin", Username: "user",
+		Hostname: "remote.example.com", UID: "001AAAAAA",
+		Modes: map[byte]struct{}{'o': {}}, Account: "erin",
+		Channels: map[string]*Channel{}, Server: link.Server,
+		ClosestServer: link}
+	cb.Users[erin.UID] = erin
+
+	channel := &Channel{
+		Name:    "#test",
+		Members: map[TS6UID]struct{}{},
+		Ops:     map[TS6UID]*User{},
+		Voices:  map[TS6UID]*User{},
+		Modes:   map[byte]struct{}{},
+	}
+	cb.Channels[channel.Name] = channel
+	for _, user := range []*User{alice.User, bob.User, carol.User, dave.User,
+		erin} {
+		channel.Members[user.UID] = struct{}{}
+		user.Channels[channel.Name] = channel
+	}
+
+	tests := []struct {
+		mask  string
+		flags string
+		nicks []string
+	}{
+		{"#test", "", []string{"alice", "bob", "carol", "dave", "erin"}},
+		{"#test", "o", []string{"bob", "dave", "erin"}},
+		{"#test", "r", []string{"carol", "dave", "erin"}},
+		{"#test", "x", []string{"dave"}},
+		{"#test", "or", []string{"dave", "erin"}},
+		{"#test", "orx", []string{"dave"}},
+		{"#test", "z", []string{"alice", "bob", "carol", "dave", "erin"}},
+		{"!*", "o", []string{"bob", "dave", "erin"}},
+		{"!*", "rx", []string{"dave"}},
+	}
+
+	for _, test := range tests {
+		// Any user may filter. Only opers may use !*.
+		asker := alice
+		if test.mask == "!*" {
+			asker = bob
+		}
+
+		params := []string{test.mask}
+		if test.flags != "" {
+			params = append(params, test.flags)
+		}
+		asker.whoCommand(irc.Message{Command: "WHO", Params: params})
+
+		var nicks []string
+		for _, m := range drainCommands(asker) {
+			fields := strings.Fields(m)
+			if fields[0] == "352" {
+				nicks = append(nicks, fields[6])
+			}
+		}
+		sort.Strings(nicks)
+
+		if strings.Join(nicks, " ") != strings.Join(test.nicks, " ") {
+			t.Errorf("WHO %s %s = %v, wanted %v", test.mask, test.flags, nicks,
+				test.nicks)
+		}
+	}
+
+	_ = drainCommands(bob)
+	alice.whoCommand(irc.Message{Command: "WHO", Params: []string{"!*", "o"}})
+	if got := drainCommands(alice); len(got) != 1 || !strings.HasPrefix(got[0],
+		"481 ") {
+		t.Errorf("non-oper WHO !* = %q, wanted 481", got)
+	}
+}
+
+func TestInviteNotify(t *testing.T) {
+	cb := newSnapshotCatbox()
+	addTraceTestLink(cb, 10, "irc2.example.com", "001")
+	alice := addCallerIDTestUser(cb, 1, "alice")
+	alice.Caps = map[string]struct{}{"invite-notify": {}}
+	bob := addCallerIDTestUser(cb, 2, "bob")
+	bob.Caps = map[string]struct{}{"invite-notify": {}}
+	carol := addCallerIDTestUser(cb, 3, "carol")
+	carol.Caps = map[string]struct{}{"invite-notify": {}}
+	dave := addCallerIDTestUser(cb, 4, "dave")
+	dave.Caps = map[string]struct{}{}
+
+	channel := &Channel{
+		Name:    "#test",
+		Members: map[TS6UID]struct{}{},
+		Ops:     map[TS6UID]*User{alice.User.UID: alice.User},
+		Voices:  map[TS6UID]*User{},
+		Modes:   map[byte]struct{}{},
+		TS:      100,
+	}
+	cb.Channels[channel.Name] = channel
+	for _, lu := range []*LocalUser{alice, carol, dave} {
+		channel.Members[lu.User.UID] = struct{}{}
+		lu.User.Channels[channel.Name] = channel
+	}
+
+	alice.inviteCommand(irc.Message{Command: "INVITE",
+		Params: []string{"bob", "#test"}})
+
+	// Bob gets the INVITE once even with the cap. Alice gets the usual reply.
+	if got := drainCommands(bob); len(got) != 1 || got[0] != "INVITE bob #test" {
+		t.Errorf("bob got %q", got)
+	}
+	if got := drainCommands(alice); len(got) != 1 ||
+		got[0] != "341 alice #test bob" {
+		t.Errorf("alice got %q", got)
+	}
+
+	// Carol has the cap. Dave does not.
+	m := <-carol.WriteChan
+	if m.Prefix != alice.User.nickUhost() || m.Command != "INVITE" ||
+		strings.Join(m.Params, " ") != "bob #test" {
+		t.Errorf("carol got %s", m.Message)
+	}
+	if got := drainCommands(dave); len(got) != 0 {
+		t.Errorf("dave got %q", got)
+	}
+}
+
+func TestInviteCommandDuplicate(t *testing.T) {
+	cb := newSnapshotCatbox()
+	link := addTraceTestLink(cb, 10, "irc2.example.com", "001")
+	alice := addCallerIDTestUser(cb, 1, "alice")
+	bob := addCallerIDTestUser(cb, 2, "bob")
+
+	channel := &Channel{
+		Name:    "#test",
+		Members: map[TS6UID]struct{}{alice.User.UID: {}},
+		Ops:     map[TS6UID]*User{alice.User.UID: alice.User},
+		Modes:   map[byte]struct{}{'i': {}},
+		TS:      100,
+	}
+	cb.Channels[channel.Name] = channel
+	alice.User.Channels[channel.Name] = channel
+
+	invite := irc.Message{Command: "INVITE", Params: []string{"bob", "#test"}}
+
+	alice.inviteCommand(invite)
+	if got := drainCommands(bob); len(got) != 1 || got[0] != "INVITE bob #test" {
+		t.Errorf("bob got %q", got)
+	}
+	_ = drainCommands(alice)
+	for len(link.WriteChan) > 0 {
+		<-link.WriteChan
+	}
+
+	// A second invite while the first is good is refused.
+	alice.inviteCommand(invite)
+	if got := drainCommands(alice); len(got) != 1 ||
+		got[0] != "443 alice bob #test is already invited to channel" {
+		t.Errorf("duplicate invite got %q", got)
+	}
+	if got := drainCommands(bob); len(got) != 0 {
+		t.Errorf("bob got %q for a duplicate invite", got)
+	}
+	if len(link.WriteChan) != 0 {
+		t.Errorf("propagated a duplicate invite")
+	}
+
+	// Once it expires they may be invited again.
+	cb.expireInvites(time.Now().Add(inviteExpiry))
+	if channel.isInvited(bob.User) {
+		t.Fatalf("invite did not expire")
+	}
+	alice.inviteCommand(invite)
+	if got := drainCommands(bob); len(got) != 1 || got[0] != "INVITE bob #test" {
+		t.Errorf("bob got %q after the invite expired", got)
+	}
+	_ = drainCommands(alice)
+
+	// Joining uses the invite up.
+	bob.join("#test", "", false)
+	if channel.isInvited(bob.User) {
+		t.Errorf("bob is still invited after joining")
+	}
+	bob.part("#test", "")
+
+	// Quitting forgets it.
+	alice.inviteCommand(invite)
+	bob.quit("Bye", true)
+	if channel.isInvited(bob.User) {
+		t.Errorf("bob is still invited after quitting")
+	}
+}
+
+func TestQuietCommands(t *testing.T) {
+	cb := newSnapshotCatbox()
+	link := addTraceTestLink(cb, 10, "irc2.example.com", "001")
+	alice := addCallerIDTestUser(cb, 1, "alice")
+	bob := addCallerIDTestUser(cb, 2, "bob")
+	bob.User.Hostname = "bad.example.com"
+
+	channel := &Channel{
+		Name:    "#test",
+		Members: map[TS6UID]struct{}{},
+		Ops:     map[TS6UID]*User{alice.User.UID: alice.User},
+		Voices:  map[TS6UID]*User{},
+		Modes:   map[byte]struct{}{},
+		TS:      100,
+	}
+	cb.Channels[channel.Name] = channel
+	for _, lu := range []*LocalUser{alice, bob} {
+		channel.Members[lu.User.UID] = struct{}{}
+		lu.User.Channels[channel.Name] = channel
+	}
+
+	// Only ops may set quiets.
+	bob.channelModeCommand(channel, "+Q", []string{"*!*@bad.example.com"})
+	if got := drainCommands(bob); len(got) != 1 || !strings.HasPrefix(got[0],
+		"482 ") {
+		t.Errorf("non-op +Q = %q, wanted 482", got)
+	}
+
+	alice.channelModeCommand(channel, "+Q", []string{"*!*@bad.example.com"})
+	if got := drainCommands(bob); len(got) != 1 ||
+		got[0] != "MODE #test +Q *!*@bad.example.com" {
+		t.Errorf("bob got %q", got)
+	}
+	if len(link.WriteChan) != 1 {
+		t.Fatalf("sent %d messages to server, wanted 1", len(link.WriteChan))
+	}
+	m := (<-link.WriteChan).Message
+	if m.Command != "TMODE" ||
+		strings.Join(m.Params, " ") != "100 #test +Q *!*@bad.example.com" {
+		t.Errorf("propagated %s", m)
+	}
+
+	// Any member may list them.
+	bob.channelModeCommand(channel, "Q", nil)
+	got := drainCommands(bob)
+	if len(got) != 2 || !strings.HasPrefix(got[0],
+		"728 bob #test Q *!*@bad.example.com alice ") ||
+		got[1] != "729 bob #test Q End of channel quiet list" {
+		t.Errorf("quiet list = %q", got)
+	}
+
+	// Bob may still be on the channel but not speak in it.
+	_ = drainCommands(alice)
+	bob.privmsgCommand(irc.Message{Command: "PRIVMSG",
+		Params: []string{"#test", "hi"}})
+	if got := drainCommands(bob); len(got) != 1 ||
+		got[0] != "404 bob #test Cannot send to channel" {
+		t.Errorf("quieted PRIVMSG = %q, wanted 404", got)
+	}
+	if got := drainCommands(alice); len(got) != 0 {
+		t.Errorf("alice got %q from a quieted user", got)
+	}
+}
+
+func TestSendWelcome(t *testing.T) {
+	cb := newSnapshotCatbox()
+	alice := addCallerIDTestUser(cb, 1, "alice")
+	_ = addCallerIDTestUser(cb, 2, "bob")
+	cb.Channels["#test"] = &Channel{Name: "#test"}
+
+	alice.sendWelcome()
+	if got := drainCommands(alice); len(got) != 0 {
+		t.Errorf("sent %q with no welcome", got)
+	}
+
+	cb.Welcome = []string{
+		"Welcome to {server}, {nick}!",
+		"There are {users} users in {channels} channels. {nick} {unknown}",
+	}
+	alice.sendWelcome()
+	wanted := []string{
+		"NOTICE alice Welcome to irc.example.com, alice!",
+		"NOTICE alice There are 2 users in 1 channels. alice {unknown}",
+	}
+	if got := drainCommands(alice); strings.Join(got, "\n") !=
+		strings.Join(wanted, "\n") {
+		t.Errorf("sendWelcome() sent %q, wanted %q", got, wanted)
+	}
+}
+
+func TestOJoinCommand(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(*Channel)
+	}{
+		{"invite only", func(c *Channel) { c.Modes['i'] = struct{}{} }},
+		{"key", func(c *Channel) { c.Key = "secret" }},
+		{"limit", func(c *Channel) { c.Limit = 1 }},
+		{"ban", func(c *Channel) {
+			c.Bans = []BanEntry{{Mask: "*!*@host.example.com"}}
+		}},
+	}
+
+	for _, test := range tests {
+		for _, command := range []string{"OJOIN", "OPME"} {
+			cb := newSnapshotCatbox()
+			link := addTraceTestLink(cb, 10, "irc2.example.com", "001")
+			alice := addCallerIDTestUser(cb, 1, "alice")
+			oper := addCallerIDTestUser(cb, 2, "oper")
+			oper.User.Modes['o'] = struct{}{}
+			cb.Opers[oper.User.UID] = oper.User
+
+			channel := &Channel{
+				Name:    "#test",
+				Members: map[TS6UID]struct{}{alice.User.UID: {}},
+				Ops:     map[TS6UID]*User{alice.User.UID: alice.User},
+				Voices:  map[TS6UID]*User{},
+				Modes:   map[byte]struct{}{},
+				TS:      100,
+			}
+			alice.User.Channels[channel.Name] = channel
+			cb.Channels[channel.Name] = channel
+			test.setup(channel)
+
+			// They may not join normally.
+			oper.join(channel.Name, "", false)
+			if oper.User.onChannel(channel) {
+				t.Fatalf("%s: oper joined without forcing", test.name)
+			}
+			_ = drainCommands(oper)
+
+			m := irc.Message{Command: command, Params: []string{"#test"}}
+			if command == "OJOIN" {
+				oper.ojoinCommand(m)
+			} else {
+				oper.opmeCommand(m)
+			}
+
+			if !oper.User.onChannel(channel) || !channel.userHasOps(oper.User) {
+				t.Errorf("%s: %s did not join the oper with ops", test.name, command)
+				continue
+			}
+
+			wanted := []string{"JOIN #test", "MODE #test +o oper"}
+			if got := drainCommands(alice); strings.Join(got, "\n") !=
+				strings.Join(wanted, "\n") {
+				t.Errorf("%s: %s: alice got %q, wanted %q", test.name, command, got,
+					wanted)
+			}
+
+			got := drainCommands(oper)
+			if len(got) == 0 || got[0] != "JOIN #test" ||
+				got[len(got)-1] != fmt.Sprintf(
+					"NOTICE oper *** Notice --- oper used %s in #test", command) {
+				t.Errorf("%s: %s: oper got %q", test.name, command, got)
+			}
+
+			if len(link.WriteChan) != 1 {
+				t.Errorf("%s: %s: sent %d messages to server, wanted 1", test.name,
+					command, len(link.WriteChan))
+				continue
+			}
+			m = (<-link.WriteChan).Message
+			if m.Command != "SJOIN" || strings.Join(m.Params, " ") !=
+				"100 #test + @"+string(oper.User.UID) {
+				t.Errorf("%s: %s: propagated %s", test.name, command, m)
+			}
+		}
+	}
+}
+
+func TestOJoinCommandErrors(t *testing.T) {
+	cb := newSnapshotCatbox()
+	alice := addCallerIDTestUser(cb, 1, "alice")
+	alice.join("#test", "", false)
+	_ = drainCommands(alice)
+
+	alice.ojoinCommand(irc.Message{Command: "OJOIN", Params: []string{"#test"}})
+	if got := drainCommands(alice); len(got) != 1 || !strings.HasPrefix(got[0],
+		"481 ") {
+		t.Errorf("non-oper got %q, wanted 481", got)
+	}
+
+	alice.User.Modes['o'] = struct{}{}
+	alice.ojoinCommand(irc.Message{Command: "OJOIN", Params: []string{"#test"}})
+	if got := drainCommands(alice); len(got) != 1 ||
+		got[0] != "443 alice alice #test is already on channel" {
+		t.Errorf("member got %q, wanted 443", got)
+	}
+
+	alice.ojoinCommand(irc.Message{Command: "OJOIN", Params: []string{"#nope"}})
+	if got := drainCommands(alice); len(got) != 1 ||
+		got[0] != "403 alice #nope No such channel" {
+		t.Errorf("missing channel got %q, wanted 403", got)
+	}
+}
+
+func TestKLineCommandTooBroad(t *testing.T) {
+	cb := newSnapshotCatbox()
+	link := addTraceTestLink(cb, 10, "irc2.example.com", "001")
+	oper := addCallerIDTestUser(cb, 1, "oper")
+	oper.User.Modes['o'] = struct{}{}
+
+	for _, mask := range []string{"*@*", "*?@*", "*@*.*", "*@10.*"} {
+		oper.klineCommand(irc.Message{Command: "KLINE",
+			Params: []string{mask, "Everyone"}})
+		wanted := "415 oper " + mask + " K-Line too broad"
+		if got := drainCommands(oper); len(got) != 1 || got[0] != wanted {
+			t.Errorf("KLINE %s got %q, wanted %s", mask, got, wanted)
+		}
+	}
+	if len(cb.KLines) != 0 || len(link.WriteChan) != 0 {
+		t.Errorf("added or propagated a K-Line that is too broad")
+	}
+
+	for _, mask := range []string{"*@*.example.com", "*@192.168.0.0/16",
+		"user@*"} {
+		oper.klineCommand(irc.Message{Command: "KLINE",
+			Params: []string{mask, "Go away"}})
+	}
+	if len(cb.KLines) != 3 {
+		t.Errorf("have %d K-Lines, wanted 3", len(cb.KLines))
+	}
+}
+
+func TestServerKLineTooBroad(t *testing.T) {
+	cb := newTraceTestCatbox("irc2.example.com", "001")
+	cb.Opers = map[TS6UID]*User{}
+	link := addTraceTestLink(cb, 1, "irc1.example.com", "000")
+	cb.Users["000AAAAAA"] = &User{DisplayNick: "oper", UID: "000AAAAAA",
+		Modes: map[byte]struct{}{'o': {}}, ClosestServer: link}
+	alice := addCallerIDTestUser(cb, 1, "alice")
+
+	link.klineCommand(irc.Message{Prefix: "000AAAAAA", Command: "KLINE",
+		Params: []string{"0", "*", "*", "Everyone"}})
+	if len(cb.KLines) != 0 {
+		t.Errorf("added a K-Line that is too broad")
+	}
+	if _, exists := cb.LocalUsers[alice.ID]; !exists {
+		t.Errorf("disconnected a user for a K-Line that is too broad")
+	}
+
+	link.klineCommand(irc.Message{Prefix: "000AAAAAA", Command: "KLINE",
+		Params: []string{"0", "*", "*.example.com", "Go away"}})
+	if len(cb.KLines) != 1 {
+		t.Errorf("did not add an acceptable K-Line")
+	}
+}
+
+// newVisibilityTestCatbox makes a Catbox where alice is on a public, a
+// private, a secret, and a private and secret channel. bob is on none and
+// oper is an oper.
+func newVisibilityTestCatbox() (*Catbox, *LocalUser, *LocalUser, *LocalUser) {
+	cb := newSnapshotCatbox()
+	alice := addCallerIDTestUser(cb, 1, "alice")
+	bob := addCallerIDTestUser(cb, 2, "bob")
+	oper := addCallerIDTestUser(cb, 3, "oper")
+	oper.User.Modes['o'] = struct{}{}
+
+	for _, c := range []struct {
+		name  string
+		modes string
+	}{
+		{"#public", ""},
+		{"#private", "p"},
+		{"#secret", "s"},
+		{"#both", "ps"},
+	} {
+		channel := &Channel{
+			Name:    c.name,
+			Topic:   "About " + c.name,
+			Members: map[TS6UID]struct{}{alice.User.UID: {}},
+			Ops:     map[TS6UID]*User{alice.User.UID: alice.User},
+			Modes:   map[byte]struct{}{},
+		}
+		for i := range c.modes {
+			channel.Modes[c.modes[i]] = struct{}{}
+		}
+		cb.Channels[channel.Name] = channel
+		alice.User.Channels[channel.Name] = channel
+	}
+
+	return cb, alice, bob, oper
+}
+
+func TestListCommand(t *testing.T) {
+	_, alice, bob, oper := newVisibilityTestCatbox()
+
+	all := []string{
+		"322 %s #both 1 About #both",
+		"322 %s #private 1 About #private",
+		"322 %s #public 1 About #public",
+		"322 %s #secret 1 About #secret",
+	}
+
+	tests := []struct {
+		user   *LocalUser
+		params []string
+		wanted []string
+	}{
+		// Members and opers see everything.
+		{alice, nil, all},
+		{oper, nil, all},
+		// Others don't see secret channels, and see private ones as *.
+		{bob, nil, []string{
+			"322 %s * 1 ",
+			"322 %s #public 1 About #public",
+		}},
+		{bob, []string{"#secret,#PUBLIC,#missing"}, []string{
+			"322 %s #public 1 About #public",
+		}},
+	}
+
+	for _, test := range tests {
+		nick := test.user.User.DisplayNick
+		test.user.listCommand(irc.Message{Command: "LIST", Params: test.params})
+
+		wanted := []string{fmt.Sprintf("321 %s Channel Users  Name", nick)}
+		for _, line := range test.wanted {
+			wanted = append(wanted, fmt.Sprintf(line, nick))
+		}
+		wanted = append(wanted, fmt.Sprintf("323 %s End of /LIST", nick))
+
+		if got := drainCommands(test.user); strings.Join(got, "\n") !=
+			strings.Join(wanted, "\n") {
+			t.Errorf("LIST %v as %s got %q, wanted %q", test.params, nick, got,
+				wanted)
+		}
+	}
+}
+
+func TestNamesCommand(t *testing.T) {
+	_, alice, bob, oper := newVisibilityTestCatbox()
+
+	names := func(user *LocalUser, channel string) []string {
+		user.namesCommand(irc.Message{Command: "NAMES", Params: []string{channel}})
+		return drainCommands(user)
+	}
+
+	tests := []struct {
+		user    *LocalUser
+		channel string
+		flag    string
+	}{
+		{bob, "#public", "="},
+		{bob, "#private", "*"},
+		{bob, "#secret", ""},
+		{bob, "#both", ""},
+		{bob, "#missing", ""},
+		{alice, "#secret", "@"},
+		{alice, "#both", "@"},
+		{oper, "#secret", "@"},
+	}
+
+	for _, test := range tests {
+		nick := test.user.User.DisplayNick
+		wanted := []string{
+			fmt.Sprintf("366 %s %s End of NAMES list", nick, test.channel),
+		}
+		if test.flag != "" {
+			wanted = append([]string{
+				fmt.Sprintf("353 %s %s %s @alice", nick, test.flag, test.channel),
+			}, wanted...)
+		}
+
+		if got := names(test.user, test.channel); strings.Join(got, "\n") !=
+			strings.Join(wanted, "\n") {
+			t.Errorf("NAMES %s as %s got %q, wanted %q", test.channel, nick, got,
+				wanted)
+		}
+	}
+}
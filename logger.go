@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Logger writes log messages at different levels of importance.
+//
+// Each method takes a format string and arguments as fmt.Sprintf does.
+type Logger interface {
+	Debug(format string, args ...interface{})
+	Info(format string, args ...interface{})
+	Warn(format string, args ...interface{})
+	Error(format string, args ...interface{})
+}
+
+// LogLevel is how important a log message is. We drop messages below the
+// configured level.
+type LogLevel int
+
+const (
+	// LogLevelDebug is for messages that are only useful when investigating
+	// behaviour, such as flood control decisions.
+	LogLevelDebug LogLevel = iota
+
+	// LogLevelInfo is for regular events such as clients connecting.
+	LogLevelInfo
+
+	// LogLevelWarn is for unexpected but recoverable situations.
+	LogLevelWarn
+
+	// LogLevelError is for problems, including fatal ones.
+	LogLevelError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogLevelDebug:
+		return "debug"
+	case LogLevelInfo:
+		return "info"
+	case LogLevelWarn:
+		return "warn"
+	default:
+		return "error"
+	}
+}
+
+// parseLogLevel converts a level name from the config to a LogLevel.
+func parseLogLevel(s string) (LogLevel, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LogLevelDebug, nil
+	case "info":
+		return LogLevelInfo, nil
+	case "warn":
+		return LogLevelWarn, nil
+	case "error":
+		return LogLevelError, nil
+	default:
+		return LogLevelInfo, fmt.Errorf("unknown log level: %s", s)
+	}
+}
+
+// StreamLogger is the default Logger. It writes one line per message to a
+// writer, either as plain text or as a JSON object.
+//
+// Text lines look the same as they did before we had levels: The time and the
+// message.
+type StreamLogger struct {
+	level LogLevel
+	json  bool
+
+	// Protects out. Different goroutines log.
+	mutex sync.Mutex
+	out   io.Writer
+
+	// Returns the current time. It is a field so tests can control it.
+	now func() time.Time
+}
+
+// newLogger creates a StreamLogger writing to the given writer.
+//
+// format is either text or json.
+func newLogger(out io.Writer, level LogLevel, format string) (*StreamLogger,
+	error) {
+	if format != "text" && format != "json" {
+		return nil, fmt.Errorf("unknown log format: %s", format)
+	}
+
+	return &StreamLogger{
+		level: level,
+		json:  format == "json",
+		out:   out,
+		now:   time.Now,
+	}, nil
+}
+
+// Debug logs at debug level.
+func (l *StreamLogger) Debug(format string, args ...interface{}) {
+	l.log(LogLevelDebug, format, args...)
+}
+
+// Info logs at info level.
+func (l *StreamLogger) Info(format string, args ...interface{}) {
+	l.log(LogLevelInfo, format, args...)
+}
+
+// Warn logs at warn level.
+func (l *StreamLogger) Warn(format string, args ...interface{}) {
+	l.log(LogLevelWarn, format, args...)
+}
+
+// Error logs at error level.
+func (l *StreamLogger) Error(format string, args ...interface{}) {
+	l.log(LogLevelError, format, args...)
+}
+
+// logEntry is a log message encoded as JSON.
+type logEntry struct {
+	Time    string `json:"time"`
+	Level   string `json:"level"`
+	Message string `json:"msg"`
+}
+
+func (l *StreamLogger) log(level LogLevel, format string,
+	args ...interface{}) {
+	if level < l.level {
+		return
+	}
+
+	msg := fmt.Sprintf(format, args...)
+	now := l.now()
+
+	var line string
+	if l.json {
+		buf, err := json.Marshal(logEntry{
+			Time:    now.Format(time.RFC3339),
+			Level:   level.String(),
+			Message: msg,
+		})
+		if err != nil {
+			// This should not be possible as we only encode strings.
+			line = fmt.Sprintf("unable to encode log message: %s: %s", err, msg)
+		} else {
+			line = string(buf)
+		}
+	} else {
+		line = fmt.Sprintf("%s %s", now.Format("2006/01/02 15:04:05"), msg)
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	_, _ = fmt.Fprintln(l.out, line)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestLogger creates a Logger that discards everything.
+func newTestLogger() Logger {
+	logger, err := newLogger(ioutil.Discard, LogLevelDebug, "text")
+	if err != nil {
+		panic(err)
+	}
+	return logger
+}
+
+func TestLoggerJSON(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger, err := newLogger(buf, LogLevelInfo, "json")
+	if err != nil {
+		t.Fatalf("newLogger() = %s", err)
+	}
+	logger.now = func() time.Time {
+		return time.Date(2019, 7, 8, 10, 30, 0, 0, time.UTC)
+	}
+
+	conn, peer := net.Pipe()
+	defer func() {
+		_ = conn.Close()
+		_ = peer.Close()
+	}()
+
+	client := &LocalClient{ID: 5, Conn: Conn{conn: conn}}
+	logger.Info("New client connection: %s", client)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("logged %d lines, wanted 1: %s", len(lines), buf.String())
+	}
+
+	var fields map[string]string
+	if err := json.Unmarshal([]byte(lines[0]), &fields); err != nil {
+		t.Fatalf("log line is not valid JSON: %s: %s", lines[0], err)
+	}
+
+	want := map[string]string{
+		"time":  "2019-07-08T10:30:00Z",
+		"level": "info",
+		"msg":   "New client connection: " + client.String(),
+	}
+
+	if len(fields) != len(want) {
+		t.Errorf("log line has fields %v, wanted %v", fields, want)
+	}
+	for k, v := range want {
+		if fields[k] != v {
+			t.Errorf("log field %s = %s, wanted %s", k, fields[k], v)
+		}
+	}
+}
+
+func TestLoggerLevels(t *testing.T) {
+	tests := []struct {
+		level LogLevel
+		lines int
+	}{
+		{LogLevelDebug, 4},
+		{LogLevelInfo, 3},
+		{LogLevelWarn, 2},
+		{LogLevelError, 1},
+	}
+
+	for _, test := range tests {
+		buf := &bytes.Buffer{}
+		logger, err := newLogger(buf, test.level, "text")
+		if err != nil {
+			t.Fatalf("newLogger() = %s", err)
+		}
+
+		logger.Debug("debug")
+		logger.Info("info")
+		logger.Warn("warn")
+		logger.Error("error")
+
+		lines := strings.Count(buf.String(), "\n")
+		if lines != test.lines {
+			t.Errorf("logging at %s wrote %d lines, wanted %d", test.level, lines,
+				test.lines)
+		}
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	tests := []struct {
+		input   string
+		output  LogLevel
+		success bool
+	}{
+		{"debug", LogLevelDebug, true},
+		{"info", LogLevelInfo, true},
+		{"WARN", LogLevelWarn, true},
+		{"error", LogLevelError, true},
+		{"verbose", LogLevelInfo, false},
+	}
+
+	for _, test := range tests {
+		level, err := parseLogLevel(test.input)
+		if err != nil {
+			if test.success {
+				t.Errorf("parseLogLevel(%s) = error %s, wanted %s", test.input, err,
+					test.output)
+			}
+			continue
+		}
+
+		if !test.success {
+			t.Errorf("parseLogLevel(%s) = %s, wanted error", test.input, level)
+			continue
+		}
+
+		if level != test.output {
+			t.Errorf("parseLogLevel(%s) = %s, wanted %s", test.input, level,
+				test.output)
+		}
+	}
+}
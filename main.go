@@ -4,12 +4,16 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"syscall"
@@ -27,7 +31,16 @@ type Catbox struct {
 	ConfigFile string
 
 	// Config is the currently loaded config.
-	Config *Config
+	//
+	// We never change a Config once it's here. To rehash we replace it. Only
+	// the main goroutine replaces it, so it may read Config directly. Other
+	// goroutines must use config().
+	Config     *Config
+	ConfigLock sync.RWMutex
+
+	// Logger is where we write log messages. Its level and format come from the
+	// config.
+	Logger Logger
 
 	// Next client ID to issue. This turns into TS6 ID which gets concatenated
 	// with our SID to make the TS6 UID. We wrap it in a mutex as different
@@ -61,9 +74,81 @@ type Catbox struct {
 	// Track channels on the network. Channel name (canonicalized) to Channel.
 	Channels map[string]*Channel
 
+	// Channels we restored from the state file that no one has joined yet.
+	// Channel name (canonicalized) to Channel. These have no members. When
+	// someone joins one we move it into Channels.
+	PersistedChannels map[string]*Channel
+
+	// Lines from the rules file. Shown by RULES.
+	Rules []string
+
+	// NOTICEs we send users when they register. From the welcome file or
+	// WelcomeLines.
+	Welcome []string
+
+	// Help topics from the help directory. Uppercased topic to its lines.
+	// Shown by HELP.
+	HelpCache map[string][]string
+
 	// Active K:Lines (bans).
 	KLines []KLine
 
+	// Active G-Lines (network-wide bans).
+	GLines []GLine
+
+	// Active X-Lines (real name bans) and their compiled regexps. The two are
+	// in the same order.
+	XLines       []XLine
+	XLineRegexps []*regexp.Regexp
+
+	// Active D-Lines (IP bans). We check them in the goroutines accepting
+	// connections, so the lock guards them.
+	DLines    []DLine
+	DLineLock sync.Mutex
+
+	// The country database, if we have one. We look up clients in the
+	// goroutines accepting connections, so the lock guards it.
+	GeoIP     countryDB
+	GeoIPLock sync.Mutex
+
+	// Channel registrations. Canonicalized channel name to registration.
+	ChanRegs map[string]*ChanReg
+
+	// Handlers for messages to our service users. Service UID to handler.
+	ServiceHandlers map[TS6UID]ServiceHandler
+
+	// When users were disconnected for excess flood. IP to Unix times. We use
+	// this to decide whether to K-Line them automatically.
+	FloodHits map[string][]int64
+
+	// When IPs last received the MOTD. We use this to throttle it
+	// (MOTDThrottle).
+	MOTDThrottle map[string]time.Time
+
+	// How many users registered since RegistrationWindowStart. We use this to
+	// limit registrations (MaxRegistrationsPerSecond).
+	RegistrationCount       int
+	RegistrationWindowStart time.Time
+
+	// Nicks of users who quit recently. Canonicalized nick to when we stop
+	// holding it (NickDelay).
+	NickHolds map[string]time.Time
+
+	// The regex we validate nicks with. If nil, we use the built in rules. See
+	// newNickValidator().
+	NickValidator *regexp.Regexp
+
+	// The spam filters from the config with their patterns compiled. See
+	// newSpamFilters().
+	CompiledSpamFilters []CompiledSpamFilter
+
+	// Counts of actions our opers took. Oper UID to their counts. We keep them
+	// until we restart, even after the oper leaves. STATS p shows them.
+	OperActions map[TS6UID]*OperStats
+
+	// CHALLENGEs opers have yet to answer. User UID to the challenge.
+	ChallengeNonces map[TS6UID]*OperChallenge
+
 	// When we close this channel, this indicates that we're shutting down.
 	// Other goroutines can check if this channel is closed.
 	ShutdownChan chan struct{}
@@ -86,6 +171,9 @@ type Catbox struct {
 	// connections (which is what it was in the past).
 	ConnectionCount int
 
+	// When we started. STATS u shows how long we've been up.
+	StartTime time.Time
+
 	// Our TLS configuration.
 	TLSConfig        *tls.Config
 	Certificate      *tls.Certificate
@@ -102,6 +190,14 @@ type Catbox struct {
 	// This will always be false unless someone triggered a restart.
 	Restart bool
 
+	// Snapshot loaded at startup from a hot restart. We restore it when we
+	// start. nil if there is none.
+	Snapshot *Snapshot
+
+	// Connections of users we keep across a hot restart. We hold these until
+	// we exec so their descriptors stay open.
+	SnapshotFiles []*os.File
+
 	// Track the time we last tried to connect to any server.
 	LastConnectAttempt time.Time
 
@@ -109,6 +205,20 @@ type Catbox struct {
 	// one at a time, and we don't want to favour those that happen to be appear
 	// first in the config.
 	LinkQueue []*ServerDefinition
+
+	// HTTP server for health checks. Nil if we're not running one.
+	HealthServer *http.Server
+
+	// Where we log users connecting and disconnecting. Nil if we're not.
+	AccessLog *AccessLog
+
+	// Snapshot of counts for the health checks. The HTTP handlers run in other
+	// goroutines, so they read these rather than our maps. We also track
+	// whether any user registered yet.
+	HealthLock        sync.Mutex
+	HealthUserCount   int
+	HealthServerCount int
+	FirstUser         bool
 }
 
 // KLine holds a kline (a ban).
@@ -118,6 +228,18 @@ type KLine struct {
 	HostMask string
 
 	Reason string
+
+	// When the K-Line expires. Zero if it is permanent.
+	Expires time.Time
+}
+
+// OperStats counts the actions an oper took.
+type OperStats struct {
+	KillCount    int
+	KLineCount   int
+	UnKLineCount int
+	RehashCount  int
+	SquitCount   int
 }
 
 // Message tells us the message and its destination. It primarily exists so that
@@ -145,6 +267,9 @@ type Event struct {
 
 	Message irc.Message
 
+	// IRCv3 message tags the client sent with the message. nil if none.
+	Tags map[string]string
+
 	// If we have an error associated with the event, such as in the case of
 	// some DeadClientEvents, populate it here.
 	Error error
@@ -188,16 +313,67 @@ const ( // nolint: deadcode
 // Each second we raise each user's counter by one (to this maximum).
 //
 // This is similar to ircd-ratbox's flood control. See its packet.c.
+//
+// This is the default. Connection classes may set their own.
 const UserMessageLimit = 10
 
 // ExcessFloodThreshold defines the number of messages a user may have queued
-// before they get disconnected for flooding.
+// before they get disconnected for flooding. Connection classes may set their
+// own.
 const ExcessFloodThreshold = 50
 
+// WriteBatchMessages is the most messages we write to a client in one write.
+//
+// When batching writes, we take as many messages as are waiting to go to a
+// client and write them at once, rather than writing each separately.
+const WriteBatchMessages = 50
+
+// WriteBatchBytes is the most bytes we write to a client in one write when
+// batching writes. With long messages, we hit this before WriteBatchMessages.
+const WriteBatchBytes = 16 * 1024
+
+// CallerIDNotifyInterval is how often we tell a user with +g that someone
+// tried to message them.
+const CallerIDNotifyInterval = time.Minute
+
+// GNOTICEInterval is how often an operator may send a GNOTICE.
+const GNOTICEInterval = 30 * time.Second
+
 // ChanModesPerCommand tells how many channel modes we accept per MODE command
 // from a user.
 const ChanModesPerCommand = 4
 
+// UserModes are the user modes we support.
+const UserModes = "Cgiow"
+
+// ChannelModeTypes are the channel modes we support grouped as in the
+// CHANMODES ISUPPORT token: Lists, modes that always have a parameter, modes
+// that have a parameter only when set, and modes that never have one. +o and
+// +v are not here as they are in PREFIX.
+var ChannelModeTypes = []string{"beQ", "k", "l", "cinps"}
+
+// ISupportTokensPerLine is how many tokens we put in each 005 RPL_ISUPPORT.
+// With the nick and the trailing text this keeps us within the 15 parameters
+// a message may have.
+const ISupportTokensPerLine = 13
+
+// These are the parts of the configuration an oper may ask to reload with
+// REHASH.
+const (
+	RehashAll     = "all"
+	RehashMOTD    = "motd"
+	RehashOpers   = "opers"
+	RehashServers = "servers"
+)
+
+// RehashTargets holds what REHASH accepts as a parameter.
+var RehashTargets = map[string]struct{}{
+	RehashAll:     {},
+	RehashMOTD:    {},
+	RehashOpers:   {},
+	RehashServers: {},
+}
+
 func main() {
 	log.SetFlags(log.Ldate | log.Ltime)
 	log.SetOutput(os.Stdout)
@@ -207,6 +383,13 @@ func main() {
 		os.Exit(1)
 	}
 
+	if args.DumpConfig {
+		if err := dumpConfig(args.ConfigFile, os.Stdout); err != nil {
+			log.Fatalf("configuration problem: %s", err)
+		}
+		return
+	}
+
 	binPath, err := filepath.Abs(os.Args[0])
 	if err != nil {
 		log.Fatalf("Unable to determine absolute path to binary: %s: %s",
@@ -219,11 +402,11 @@ func main() {
 	}
 
 	if err := cb.start(args.ListenFD); err != nil {
-		log.Fatal(err)
+		cb.fatal("%s", err)
 	}
 
 	if cb.Restart {
-		log.Printf("Shutdown completed. Restarting...")
+		cb.Logger.Info("Shutdown completed. Restarting...")
 
 		if err := syscall.Exec( // nolint: gas
 			binPath,
@@ -234,13 +417,13 @@ func main() {
 			},
 			nil,
 		); err != nil {
-			log.Fatalf("Restart failed: %s", err)
+			cb.fatal("Restart failed: %s", err)
 		}
 
-		log.Fatalf("not reached")
+		cb.fatal("not reached")
 	}
 
-	log.Printf("Server shutdown cleanly.")
+	cb.Logger.Info("Server shutdown cleanly.")
 }
 
 func newCatbox(configFile string) (*Catbox, error) {
@@ -255,6 +438,19 @@ func newCatbox(configFile string) (*Catbox, error) {
 		Servers:      make(map[TS6SID]*Server),
 		Channels:     make(map[string]*Channel),
 		KLines:       []KLine{},
+		GLines:       []GLine{},
+		FloodHits:    make(map[string][]int64),
+		MOTDThrottle: make(map[string]time.Time),
+		NickHolds:    make(map[string]time.Time),
+		OperActions:  make(map[TS6UID]*OperStats),
+		ChanRegs:     make(map[string]*ChanReg),
+		StartTime:    time.Now(),
+
+		ChallengeNonces: make(map[TS6UID]*OperChallenge),
+
+		ServiceHandlers: make(map[TS6UID]ServiceHandler),
+
+		PersistedChannels: make(map[string]*Channel),
 
 		// shutdown() closes this channel.
 		ShutdownChan: make(chan struct{}),
@@ -269,6 +465,84 @@ func newCatbox(configFile string) (*Catbox, error) {
 	}
 	cb.Config = cfg
 
+	nickValidator, err := newNickValidator(cb.Config)
+	if err != nil {
+		return nil, err
+	}
+	cb.NickValidator = nickValidator
+
+	spamFilters, err := newSpamFilters(cb.Config)
+	if err != nil {
+		return nil, err
+	}
+	cb.CompiledSpamFilters = spamFilters
+
+	logger, err := newLogger(os.Stdout, cb.Config.LogLevel, cb.Config.LogFormat)
+	if err != nil {
+		return nil, fmt.Errorf("configuration problem: %s", err)
+	}
+	cb.Logger = logger
+
+	rules, err := loadRules(cb.Config.RulesFile)
+	if err != nil {
+		return nil, err
+	}
+	cb.Rules = rules
+
+	welcome, err := loadWelcome(cb.Config)
+	if err != nil {
+		return nil, err
+	}
+	cb.Welcome = welcome
+
+	help, err := loadHelp(cb.Config.HelpDir)
+	if err != nil {
+		return nil, err
+	}
+	cb.HelpCache = help
+
+	if cb.Config.StateFile != "" {
+		channels, err := loadChannelState(cb.Config.StateFile)
+		if err != nil {
+			return nil, err
+		}
+		cb.PersistedChannels = channels
+	}
+
+	xlines, err := loadXLines(cb.Config.XLineFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := cb.setXLines(xlines); err != nil {
+		return nil, err
+	}
+
+	dlines, err := loadDLines(cb.Config.DLineFile)
+	if err != nil {
+		return nil, err
+	}
+	cb.DLines = dlines
+
+	geoIP, err := loadGeoIPDB(cb.Config.GeoIPDB)
+	if err != nil {
+		return nil, err
+	}
+	cb.GeoIP = geoIP
+
+	chanRegs, err := loadChanRegs(cb.Config.ChanRegFile)
+	if err != nil {
+		return nil, err
+	}
+	cb.ChanRegs = chanRegs
+
+	if cb.Config.SnapshotFile != "" {
+		snapshot, err := loadSnapshotFile(cb.Config.SnapshotFile)
+		if err != nil {
+			return nil, err
+		}
+		cb.Snapshot = snapshot
+	}
+
 	if cb.Config.ListenPortTLS != "-1" || cb.Config.CertificateFile != "" ||
 		cb.Config.KeyFile != "" {
 		cb.CertificateMutex = &sync.RWMutex{}
@@ -276,6 +550,9 @@ func newCatbox(configFile string) (*Catbox, error) {
 			GetCertificate:           cb.getCertificate,
 			PreferServerCipherSuites: true,
 			SessionTicketsDisabled:   true,
+			// Ask for a certificate so we can see its fingerprint. We don't verify
+			// it. Clients may present self-signed certificates.
+			ClientAuth: tls.RequestClientCert,
 			// It would be nice to be able to be more restrictive on ciphers, but in
 			// practice many clients do not support the strictest.
 			//CipherSuites: []uint16{
@@ -307,6 +584,21 @@ func (cb *Catbox) getCertificate(
 	return cb.Certificate, nil
 }
 
+// config returns the current config. Goroutines other than the main one must
+// use this rather than reading Config.
+func (cb *Catbox) config() *Config {
+	cb.ConfigLock.RLock()
+	defer cb.ConfigLock.RUnlock()
+	return cb.Config
+}
+
+// setConfig replaces the current config.
+func (cb *Catbox) setConfig(cfg *Config) {
+	cb.ConfigLock.Lock()
+	defer cb.ConfigLock.Unlock()
+	cb.Config = cfg
+}
+
 // Load the certificate and key from files.
 func (cb *Catbox) loadCertificate() error {
 	if cb.Config.CertificateFile == "" || cb.Config.KeyFile == "" {
@@ -331,7 +623,23 @@ func (cb *Catbox) loadCertificate() error {
 func (cb *Catbox) start(listenFD int) error {
 	if listenFD == -1 && cb.Config.ListenPort == "-1" &&
 		cb.Config.ListenPortTLS == "-1" {
-		log.Fatalf("You must set a listen port.")
+		cb.fatal("You must set a listen port.")
+	}
+
+	// Bring back users from a hot restart before anyone new shows up.
+	if cb.Snapshot != nil {
+		cb.restoreSnapshot(cb.Snapshot)
+		cb.Snapshot = nil
+	}
+
+	if cb.Config.NickServStub {
+		if err := cb.createNickServStub(); err != nil {
+			return fmt.Errorf("unable to create NickServ: %s", err)
+		}
+	}
+
+	if err := cb.guardChannels(); err != nil {
+		return fmt.Errorf("unable to guard channels: %s", err)
 	}
 
 	// Plaintext listener.
@@ -345,7 +653,7 @@ func (cb *Catbox) start(listenFD int) error {
 		cb.Listener = ln
 
 		cb.WG.Add(1)
-		go cb.acceptConnections(cb.Listener)
+		go cb.acceptConnections(cb.Listener, nil)
 	}
 
 	if cb.Config.ListenPort != "-1" {
@@ -357,20 +665,34 @@ func (cb *Catbox) start(listenFD int) error {
 		cb.Listener = ln
 
 		cb.WG.Add(1)
-		go cb.acceptConnections(cb.Listener)
+		go cb.acceptConnections(cb.Listener, nil)
 	}
 
-	// TLS listener.
+	// TLS listener. We start TLS on each connection once we accept it. With the
+	// PROXY protocol the header comes before the TLS handshake.
 	if cb.Config.ListenPortTLS != "-1" {
-		tlsLN, err := tls.Listen("tcp", fmt.Sprintf("%s:%s", cb.Config.ListenHost,
-			cb.Config.ListenPortTLS), cb.TLSConfig)
+		tlsLN, err := net.Listen("tcp", fmt.Sprintf("%s:%s", cb.Config.ListenHost,
+			cb.Config.ListenPortTLS))
 		if err != nil {
 			return fmt.Errorf("unable to listen (TLS): %s", err)
 		}
 		cb.TLSListener = tlsLN
 
 		cb.WG.Add(1)
-		go cb.acceptConnections(cb.TLSListener)
+		go cb.acceptConnections(cb.TLSListener, cb.TLSConfig)
+	}
+
+	// HTTP health checks.
+	if cb.Config.HealthAddr != "" {
+		if err := cb.startHealthServer(); err != nil {
+			return err
+		}
+	}
+
+	if cb.Config.AccessLog != "" {
+		if err := cb.startAccessLog(); err != nil {
+			return err
+		}
 	}
 
 	// Alarm is a goroutine to wake up this one periodically so we can do things
@@ -380,7 +702,7 @@ func (cb *Catbox) start(listenFD int) error {
 
 	// Catch SIGHUP and rehash.
 	// Catch SIGUSR1 and restart.
-	signalChan := make(chan os.Signal)
+	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGHUP)
 	signal.Notify(signalChan, syscall.SIGUSR1)
 
@@ -391,16 +713,16 @@ func (cb *Catbox) start(listenFD int) error {
 			select {
 			case sig := <-signalChan:
 				if sig == syscall.SIGHUP {
-					log.Printf("Received SIGHUP signal, rehashing")
+					cb.Logger.Info("Received SIGHUP signal, rehashing")
 					cb.newEvent(Event{Type: RehashEvent})
 					break
 				}
 				if sig == syscall.SIGUSR1 {
-					log.Printf("Received SIGUSR1 signal, restarting")
+					cb.Logger.Info("Received SIGUSR1 signal, restarting")
 					cb.newEvent(Event{Type: RestartEvent})
 					break
 				}
-				log.Printf("Received unknown signal!")
+				cb.Logger.Warn("Received unknown signal!")
 			case <-cb.ShutdownChan:
 				signal.Stop(signalChan)
 				// After Stop() we're guaranteed we will receive no more on the channel,
@@ -408,13 +730,13 @@ func (cb *Catbox) start(listenFD int) error {
 				close(signalChan)
 				for range signalChan {
 				}
-				log.Printf("Signal listener shutting down.")
+				cb.Logger.Debug("Signal listener shutting down.")
 				return
 			}
 		}
 	}()
 
-	log.Printf("catbox started")
+	cb.Logger.Info("catbox started")
 	cb.eventLoop()
 
 	// We don't need to drain any channels. None close that will have any
@@ -435,8 +757,9 @@ func (cb *Catbox) eventLoop() {
 		// promoted to a different client type (LocalUser, LocalServer).
 		case evt := <-cb.ToServerChan:
 			if evt.Type == NewClientEvent {
-				log.Printf("New client connection: %s", evt.Client)
+				cb.Logger.Info("New client connection: %s", evt.Client)
 				cb.LocalClients[evt.Client.ID] = evt.Client
+				cb.updateCounters()
 				continue
 			}
 
@@ -467,7 +790,7 @@ func (cb *Catbox) eventLoop() {
 				}
 				lu, exists := cb.LocalUsers[evt.Client.ID]
 				if exists {
-					lu.handleMessage(evt.Message)
+					lu.handleMessage(evt.Message, evt.Tags)
 					continue
 				}
 				ls, exists := cb.LocalServers[evt.Client.ID]
@@ -479,14 +802,19 @@ func (cb *Catbox) eventLoop() {
 			}
 
 			if evt.Type == WakeUpEvent {
+				cb.expireKLines(time.Now())
+				cb.cleanFloodHits(time.Now())
 				cb.checkAndPingClients()
 				cb.connectToServers()
 				cb.floodControl()
+				cb.updateHealthSnapshot()
 				continue
 			}
 
 			if evt.Type == RehashEvent {
-				cb.rehash(nil)
+				cb.rehash(nil, RehashAll)
+				// Reopen the access log so it can be rotated.
+				cb.reopenAccessLog()
 				continue
 			}
 
@@ -495,7 +823,7 @@ func (cb *Catbox) eventLoop() {
 				continue
 			}
 
-			log.Fatalf("Unexpected event: %d", evt.Type)
+			cb.fatal("Unexpected event: %d", evt.Type)
 		case <-cb.ShutdownChan:
 			return
 		}
@@ -548,7 +876,7 @@ func (cb *Catbox) errorToQuitMessage(err error) string {
 
 // shutdown starts server shutdown.
 func (cb *Catbox) shutdown() {
-	log.Printf("Server shutdown initiated.")
+	cb.Logger.Info("Server shutdown initiated.")
 
 	// Closing ShutdownChan indicates to other goroutines that we're shutting
 	// down.
@@ -556,16 +884,33 @@ func (cb *Catbox) shutdown() {
 
 	if cb.Listener != nil {
 		if err := cb.Listener.Close(); err != nil {
-			log.Printf("Error closing plaintext listener: %s", err)
+			cb.Logger.Error("Error closing plaintext listener: %s", err)
 		}
 	}
 
 	if cb.TLSListener != nil {
 		if err := cb.TLSListener.Close(); err != nil {
-			log.Printf("Error closing TLS listener: %s", err)
+			cb.Logger.Error("Error closing TLS listener: %s", err)
 		}
 	}
 
+	if cb.HealthServer != nil {
+		cb.stopHealthServer()
+	}
+
+	// Save channel state before users quit. Once they quit the channels are
+	// gone.
+	if cb.Config.StateFile != "" {
+		cb.saveState()
+	}
+
+	// If we're restarting with a snapshot, we keep users' connections. We don't
+	// tell those users we're shutting down.
+	kept := map[uint64]struct{}{}
+	if cb.Restart && cb.Config.SnapshotFile != "" {
+		kept = cb.saveSnapshot()
+	}
+
 	// All clients need to be told. This also closes their write channels.
 	for _, client := range cb.LocalClients {
 		client.quit("Server shutting down")
@@ -574,8 +919,22 @@ func (cb *Catbox) shutdown() {
 		client.quit("Server shutting down")
 	}
 	for _, client := range cb.LocalUsers {
+		if _, ok := kept[client.ID]; ok {
+			continue
+		}
 		client.quit("Server shutting down", false)
 	}
+
+	// After users quit so we log their disconnects.
+	if cb.AccessLog != nil {
+		cb.stopAccessLog()
+	}
+}
+
+// fatal logs a message at error level and then exits.
+func (cb *Catbox) fatal(format string, args ...interface{}) {
+	cb.Logger.Error(format, args...)
+	os.Exit(1)
 }
 
 // getClientID generates a new client ID. Each client that connects to us (or
@@ -590,7 +949,7 @@ func (cb *Catbox) getClientID() uint64 {
 	id := cb.NextClientID
 
 	if cb.NextClientID+1 == 0 {
-		log.Fatalf("Client id overflow")
+		cb.fatal("Client id overflow")
 	}
 	cb.NextClientID++
 
@@ -600,7 +959,10 @@ func (cb *Catbox) getClientID() uint64 {
 // acceptConnections accepts TCP connections and tells the main server loop
 // through a channel. It sets up separate goroutines for reading/writing to
 // and from the client.
-func (cb *Catbox) acceptConnections(listener net.Listener) {
+//
+// If tlsConfig is set, we start TLS on each connection.
+func (cb *Catbox) acceptConnections(listener net.Listener,
+	tlsConfig *tls.Config) {
 	defer cb.WG.Done()
 
 	for {
@@ -610,26 +972,57 @@ func (cb *Catbox) acceptConnections(listener net.Listener) {
 
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Printf("Failed to accept connection: %s", err)
+			cb.Logger.Warn("Failed to accept connection: %s", err)
 			continue
 		}
 
-		cb.introduceClient(conn)
+		cb.introduceClient(conn, tlsConfig)
 	}
 
-	log.Printf("Connection accepter shutting down.")
+	cb.Logger.Debug("Connection accepter shutting down.")
 }
 
 // introduceClient sets up a client we just accepted.
 //
+// If we're behind a proxy, we read the PROXY protocol header first to find
+// the client's address. If tlsConfig is set, we then start TLS.
+//
 // It creates a Client struct, and sends initial NOTICEs to the client. It also
 // attempts to look up the client's hostname.
-func (cb *Catbox) introduceClient(conn net.Conn) {
+func (cb *Catbox) introduceClient(conn net.Conn, tlsConfig *tls.Config) {
 	cb.WG.Add(1)
 
 	go func() {
 		defer cb.WG.Done()
 
+		cfg := cb.config()
+
+		if cfg.ProxyProtocol {
+			proxied, err := acceptProxyConn(conn, cfg.DeadTime)
+			if err != nil {
+				cb.Logger.Info("Rejecting connection from %s: %s", conn.RemoteAddr(),
+					err)
+				_ = conn.Close()
+				return
+			}
+			conn = proxied
+		}
+
+		// Check D-Lines before we do anything else with the connection.
+		if tcpAddr, err := net.ResolveTCPAddr("tcp",
+			conn.RemoteAddr().String()); err == nil {
+			if dline, matched := cb.matchDLine(tcpAddr.IP); matched {
+				cb.Logger.Info("Rejecting connection from %s: D-Lined: %s", tcpAddr.IP,
+					dline.Reason)
+				_ = conn.Close()
+				return
+			}
+		}
+
+		if tlsConfig != nil {
+			conn = tls.Server(conn, tlsConfig)
+		}
+
 		id := cb.getClientID()
 
 		client := NewLocalClient(cb, id, conn)
@@ -639,13 +1032,13 @@ func (cb *Catbox) introduceClient(conn net.Conn) {
 
 		sendAuthNotice(
 			client,
-			"*** Processing your connection to "+cb.Config.ServerName,
+			"*** Processing your connection to "+cfg.ServerName,
 		)
 
 		if client.isTLS() {
 			tlsVersion, tlsCipherSuite, err := client.getTLSState()
 			if err != nil {
-				log.Printf("Client %s: %s", client, err)
+				cb.Logger.Info("Client %s: %s", client, err)
 				close(client.WriteChan)
 				return
 			}
@@ -658,7 +1051,7 @@ func (cb *Catbox) introduceClient(conn net.Conn) {
 				client.messageFromServer("ERROR",
 					[]string{fmt.Sprintf(
 						"Your SSL/TLS version is %s. This server requires at least TLS 1.2. Contact %s if this is a problem.",
-						tlsVersion, cb.Config.AdminEmail)})
+						tlsVersion, cfg.AdminEmail)})
 				close(client.WriteChan)
 				return
 			}
@@ -671,14 +1064,24 @@ func (cb *Catbox) introduceClient(conn net.Conn) {
 
 		sendAuthNotice(client, "*** Looking up your hostname...")
 
-		hostname := lookupHostname(context.TODO(), client.Conn.IP)
+		hostname, mismatch := lookupHostname(context.TODO(), client.Conn.IP,
+			cfg.RequireForwardDNS)
 		if len(hostname) > 0 {
+			cb.Logger.Debug("Client %s: Using hostname %s (forward DNS checked: %v)",
+				client.Conn.IP, hostname, cfg.RequireForwardDNS)
 			sendAuthNotice(client, "*** Found your hostname")
 			client.Hostname = hostname
+		} else if mismatch {
+			cb.Logger.Info("Client %s: Discarding hostname that does not resolve back",
+				client.Conn.IP)
+			sendAuthNotice(client,
+				"*** Hostname does not resolve back to your IP, using IP address")
 		} else {
 			sendAuthNotice(client, "*** Couldn't look up your hostname")
 		}
 
+		client.Country = cb.lookupCountry(client.Conn.IP)
+
 		// Inform the main server goroutine about the client.
 		//
 		// Do this after sending any messages to the client's channel as it is
@@ -692,10 +1095,10 @@ func (cb *Catbox) introduceClient(conn net.Conn) {
 }
 
 func sendAuthNotice(c *LocalClient, m string) {
-	c.WriteChan <- irc.Message{
+	c.WriteChan <- TaggedMessage{Message: irc.Message{
 		Command: "NOTICE",
 		Params:  []string{"AUTH", m},
-	}
+	}}
 }
 
 // Return true if the server is shutting down.
@@ -733,7 +1136,7 @@ func (cb *Catbox) alarm() {
 		cb.newEvent(Event{Type: WakeUpEvent})
 	}
 
-	log.Printf("Alarm shutting down.")
+	cb.Logger.Debug("Alarm shutting down.")
 }
 
 // checkAndPingClients looks at each connected client.
@@ -747,6 +1150,14 @@ func (cb *Catbox) alarm() {
 func (cb *Catbox) checkAndPingClients() {
 	now := time.Now()
 
+	cb.cleanMOTDThrottle(now)
+	cb.cleanNickHolds(now)
+	cb.cleanOperChallenges(now)
+	cb.expireDLines(now)
+	cb.expireGLines(now)
+	cb.expireInvites(now)
+	cb.completeDeferredRegistrations(now)
+
 	// Unregistered clients do not receive PINGs, nor do we care about their
 	// idle time. Kill them if they are connected too long and still unregistered.
 	for _, client := range cb.LocalClients {
@@ -772,17 +1183,20 @@ func (cb *Catbox) checkAndPingClients() {
 			continue
 		}
 
+		// Users use the times from their connection class.
+		class := cb.Config.connClass(client.User.Class)
+
 		timeIdle := now.Sub(client.LastActivityTime)
 
 		// Was it active recently enough that we don't need to do anything?
-		if timeIdle < cb.Config.PingTime {
+		if timeIdle < class.PingTime {
 			continue
 		}
 
 		// It's been idle a while.
 
 		// Has it been idle long enough that we consider it dead?
-		if timeIdle > cb.Config.DeadTime {
+		if timeIdle > class.DeadTime {
 			client.quit(fmt.Sprintf("Ping timeout: %d seconds",
 				int(timeIdle.Seconds())), true)
 			continue
@@ -791,7 +1205,7 @@ func (cb *Catbox) checkAndPingClients() {
 		timeSincePing := now.Sub(client.LastPingTime)
 
 		// Should we ping it? We might have pinged it recently.
-		if timeSincePing < cb.Config.PingTime {
+		if timeSincePing < class.PingTime {
 			continue
 		}
 
@@ -934,8 +1348,8 @@ func (cb *Catbox) connectToServers() {
 // floodControl updates the message counters for all users, and potentially
 // processes queued messages for any that hit their limit.
 //
-// Each user will have its message counter increased by 1 to a maximum of
-// UserMessageLimit.
+// Each user will have its message counter increased by 1 to a maximum of its
+// connection class's flood threshold (UserMessageLimit by default).
 //
 // Each user will have its queued messages processed until their message counter
 // hits zero.
@@ -951,8 +1365,10 @@ func (cb *Catbox) connectToServers() {
 // messages they may have before that.
 func (cb *Catbox) floodControl() {
 	for _, user := range cb.LocalUsers {
-		// Bump up their message counter by one if they are not maxed out.
-		if user.MessageCounter < UserMessageLimit {
+		// Bump up their message counter by one if they are not maxed out. Their
+		// connection class sets the maximum.
+		class := cb.Config.connClass(user.User.Class)
+		if user.MessageCounter < class.FloodThreshold {
 			user.MessageCounter++
 		}
 
@@ -964,9 +1380,22 @@ func (cb *Catbox) floodControl() {
 
 			// Process it.
 			// handleMessage decrements our message counter.
-			user.handleMessage(msg)
+			user.handleMessage(msg.Message, msg.Tags)
+		}
+
+		user.resetWhoisCount(time.Now())
+	}
+}
+
+// countClassUsers counts the local users in the given connection class.
+func (cb *Catbox) countClassUsers(name string) int {
+	count := 0
+	for _, user := range cb.LocalUsers {
+		if user.User.Class == name {
+			count++
 		}
 	}
+	return count
 }
 
 // Determine if we are linked to a given server.
@@ -984,6 +1413,18 @@ func (cb *Catbox) isLinkedToServer(name string) bool {
 	return false
 }
 
+// linkInfoWithPort gives the link's config with a different port. A port of 0
+// means to keep the port from the config.
+func linkInfoWithPort(linkInfo *ServerDefinition, port int) *ServerDefinition {
+	if port == 0 {
+		return linkInfo
+	}
+
+	withPort := *linkInfo
+	withPort.Port = port
+	return &withPort
+}
+
 // Initiate a connection to a server.
 //
 // Do this in a goroutine to avoid blocking the main server goroutine.
@@ -993,6 +1434,8 @@ func (cb *Catbox) connectToServer(linkInfo *ServerDefinition) {
 	go func() {
 		defer cb.WG.Done()
 
+		cfg := cb.config()
+
 		var conn net.Conn
 		var err error
 
@@ -1000,7 +1443,7 @@ func (cb *Catbox) connectToServer(linkInfo *ServerDefinition) {
 			cb.noticeOpers(fmt.Sprintf("Connecting to %s with TLS...", linkInfo.Name))
 
 			dialer := &net.Dialer{
-				Timeout: cb.Config.DeadTime,
+				Timeout: cfg.DeadTime,
 			}
 			conn, err = tls.DialWithDialer(dialer, "tcp",
 				fmt.Sprintf("%s:%d", linkInfo.Hostname, linkInfo.Port), cb.TLSConfig)
@@ -1009,7 +1452,7 @@ func (cb *Catbox) connectToServer(linkInfo *ServerDefinition) {
 				linkInfo.Name))
 			conn, err = net.DialTimeout("tcp",
 				fmt.Sprintf("%s:%d", linkInfo.Hostname, linkInfo.Port),
-				cb.Config.DeadTime)
+				cfg.DeadTime)
 		}
 
 		if err != nil {
@@ -1025,7 +1468,7 @@ func (cb *Catbox) connectToServer(linkInfo *ServerDefinition) {
 		if linkInfo.TLS {
 			tlsVersion, tlsCipherSuite, err := client.getTLSState()
 			if err != nil {
-				log.Printf("Disconnecting from server %s: %s", linkInfo.Name, err)
+				cb.Logger.Info("Disconnecting from server %s: %s", linkInfo.Name, err)
 				_ = conn.Close() // nolint: gosec
 				return
 			}
@@ -1038,14 +1481,14 @@ func (cb *Catbox) connectToServer(linkInfo *ServerDefinition) {
 				return
 			}
 
-			log.Printf("Connected to %s with %s (%s)", linkInfo.Name, tlsVersion,
+			cb.Logger.Info("Connected to %s with %s (%s)", linkInfo.Name, tlsVersion,
 				tlsCipherSuite)
 		}
 
 		// Make sure we send to the client's write channel before telling the server
 		// about the client. It is possible otherwise that the server (if shutting
 		// down) could have closed the write channel on us.
-		client.sendServerIntro(linkInfo.Pass)
+		client.sendServerIntro(linkInfo)
 
 		cb.newEvent(Event{Type: NewClientEvent, Client: client})
 
@@ -1078,7 +1521,7 @@ func (cb *Catbox) newEvent(evt Event) {
 
 // Send a message to all operator users.
 func (cb *Catbox) noticeOpers(msg string) {
-	log.Printf("Global oper notice: %s", msg)
+	cb.Logger.Info("Global oper notice: %s", msg)
 
 	for _, user := range cb.Opers {
 		if user.isLocal() {
@@ -1097,107 +1540,522 @@ func (cb *Catbox) noticeOpers(msg string) {
 	}
 }
 
-// Send a message to all local operator users.
-func (cb *Catbox) noticeLocalOpers(msg string) {
-	log.Printf("Local oper notice: %s", msg)
-
-	for _, user := range cb.Opers {
-		if user.isLocal() {
-			user.LocalUser.serverNotice(msg)
+// wallopsMessages builds WALLOPS messages for our local users who should see
+// them. These are operators and users with user mode +w.
+func (cb *Catbox) wallopsMessages(origin, text string) []Message {
+	msgs := []Message{}
+	for _, user := range cb.LocalUsers {
+		_, wallops := user.User.Modes['w']
+		if !wallops && !user.User.isOperator() {
 			continue
 		}
+		msgs = append(msgs, Message{
+			Target: user.LocalClient,
+			Message: irc.Message{
+				Prefix:  origin,
+				Command: "WALLOPS",
+				Params:  []string{text},
+			},
+		})
 	}
+	return msgs
 }
 
-// Store a KLINE locally, and then check if any connected local users match
-// it. If so, cut them off and notify local opers.
-//
-// This function does not propagate to any other servers.
+// globalNoticeMessages builds the notices we send our local users for a
+// GNOTICE.
+func (cb *Catbox) globalNoticeMessages(from *User, text string) []Message {
+	msgs := []Message{}
+	for _, user := range cb.LocalUsers {
+		msgs = append(msgs, Message{
+			Target: user.LocalClient,
+			Message: irc.Message{
+				Prefix:  cb.Config.ServerName,
+				Command: "NOTICE",
+				Params: []string{
+					user.User.DisplayNick,
+					fmt.Sprintf("*** Global Notice from %s: %s", from.DisplayNick, text),
+				},
+			},
+		})
+	}
+	return msgs
+}
+
+// callerIDReject tells a user that the user they tried to message has +g and
+// has not accepted them. The target user may be local or remote.
 //
-// KLines are currently always permanent locally.
-func (cb *Catbox) addAndApplyKLine(kline KLine, source, reason string) {
-	// If it's a duplicate KLINE, ignore it.
-	for _, k := range cb.KLines {
-		if k.UserMask != kline.UserMask {
-			continue
-		}
-		if k.HostMask != kline.HostMask {
-			continue
-		}
-		cb.noticeOpers(fmt.Sprintf("Ignoring duplicate K-Line for [%s@%s] from %s",
-			k.UserMask, k.HostMask, source))
-		return
+// We tell the target user too, though at most once per
+// CallerIDNotifyInterval.
+func (cb *Catbox) callerIDReject(from, to *User) {
+	numerics := []irc.Message{
+		// 716 ERR_TARGUMODEG
+		{Command: "716", Params: []string{to.DisplayNick,
+			"is in +g mode (server-side ignore)"}},
+	}
+
+	lu := to.LocalUser
+	if time.Since(lu.LastCallerIDNotifyTime) >= CallerIDNotifyInterval {
+		lu.LastCallerIDNotifyTime = time.Now()
+
+		// 718 RPL_UMODEGMSG
+		lu.messageFromServer("718", []string{
+			from.DisplayNick,
+			fmt.Sprintf("%s@%s", from.Username, from.Hostname),
+			"is messaging you, and you have umode +g.",
+		})
+
+		// 717 RPL_TARGNOTIFY
+		numerics = append(numerics, irc.Message{Command: "717",
+			Params: []string{to.DisplayNick,
+				"has been informed that you messaged them."}})
 	}
 
-	cb.KLines = append(cb.KLines, kline)
+	cb.sendNumerics(from, numerics)
+}
 
-	cb.noticeOpers(fmt.Sprintf("%s added K-Line for [%s@%s] [%s]",
-		source, kline.UserMask, kline.HostMask, reason))
+// serverMaskMessage delivers a message sent to a server mask such as
+// $*.example.com. Our local users get it if our name matches. We pass it on
+// towards every other server that matches, though never back to the server it
+// came from.
+//
+// source is the prefix to show our local users. m is the message as we
+// propagate it to other servers.
+//
+// It returns false if no server matches the mask.
+func (cb *Catbox) serverMaskMessage(source string, m irc.Message,
+	from *LocalServer) bool {
+	mask := m.Params[0][1:]
+	re, err := maskToRegex(strings.ToLower(mask))
+	if err != nil {
+		return false
+	}
+	re, err = regexp.Compile("^(?:" + re.String() + ")$")
+	if err != nil {
+		return false
+	}
 
-	// Do we have any matching users connected? Cut them off if so.
+	matched := false
 
-	quitReason := fmt.Sprintf("Connection closed: %s", reason)
+	if re.MatchString(strings.ToLower(cb.Config.ServerName)) {
+		matched = true
+		for _, lu := range cb.LocalUsers {
+			lu.maybeQueueMessage(irc.Message{
+				Prefix:  source,
+				Command: m.Command,
+				Params:  m.Params,
+			})
+		}
+	}
 
-	for _, user := range cb.LocalUsers {
-		if !user.User.matchesMask(kline.UserMask, kline.HostMask) {
+	toServers := make(map[*LocalServer]struct{})
+	for _, server := range cb.Servers {
+		if !re.MatchString(strings.ToLower(server.Name)) {
 			continue
 		}
+		matched = true
 
-		user.quit(quitReason, true)
+		if hop := server.nextHop(); hop != from {
+			toServers[hop] = struct{}{}
+		}
+	}
 
-		cb.noticeOpers(fmt.Sprintf("User disconnected due to K-Line: %s",
-			user.User.DisplayNick))
+	for server := range toServers {
+		server.maybeQueueMessage(m)
 	}
+
+	return matched
 }
 
-func (cb *Catbox) removeKLine(userMask, hostMask, source string) bool {
-	idx := -1
-	for i, kline := range cb.KLines {
-		if kline.UserMask != userMask || kline.HostMask != hostMask {
+// sendNumerics sends numeric replies from us to a user. The user may be local
+// or remote. The messages need only the command and the parameters after the
+// target.
+func (cb *Catbox) sendNumerics(to *User, numerics []irc.Message) {
+	for _, m := range numerics {
+		if to.isLocal() {
+			to.LocalUser.messageFromServer(m.Command, m.Params)
 			continue
 		}
-		idx = i
-		break
-	}
 
-	if idx == -1 {
-		cb.noticeOpers(fmt.Sprintf("Not removing K-Line for [%s@%s] (not found)",
-			userMask, hostMask))
-		return false
+		to.ClosestServer.maybeQueueMessage(irc.Message{
+			Prefix:  string(cb.Config.TS6SID),
+			Command: m.Command,
+			Params:  append([]string{string(to.UID)}, m.Params...),
+		})
 	}
+}
 
-	cb.KLines = append(cb.KLines[:idx], cb.KLines[idx+1:]...)
-
-	cb.noticeOpers(fmt.Sprintf("%s removed K-Line for [%s@%s]",
-		source, userMask, hostMask))
+// supportedUserModes returns the user modes we support for 004 RPL_MYINFO.
+func (cb *Catbox) supportedUserModes() string {
+	return UserModes
+}
 
-	return true
+// supportedChannelModes returns the channel modes we support for 004
+// RPL_MYINFO, sorted.
+func (cb *Catbox) supportedChannelModes() string {
+	modes := []byte("hoqv")
+	for _, t := range ChannelModeTypes {
+		modes = append(modes, t...)
+	}
+	sort.Slice(modes, func(i, j int) bool { return modes[i] < modes[j] })
+	return string(modes)
 }
 
-// Issue a KILL from this server.
-//
-// We send a KILL message to each server.
-//
-// We cut the user off if they are local.
-//
-// We tell local users a Quit if the user is remote.
+// isupportTokens makes the tokens we send in 005 RPL_ISUPPORT.
 //
-// We forget the user.
+// maxChannels is how many channels the user may be in. 0 means no limit, and
+// we leave out MAXCHANNELS.
 //
-// If killer is nil, then this is a server KILL.
-func (cb *Catbox) issueKill(killer, killee *User, message string) {
-	sendMessages(cb.issueKillToAllServers(killer, killee, message))
-	cb.cleanupKilledUser(killer, killee, message)
+// We don't limit the size of ban lists, so there is no MAXLIST.
+func (cb *Catbox) isupportTokens(maxChannels int) []string {
+	tokens := []string{
+		"CHANTYPES=#",
+		"PREFIX=(qohv)~@%+",
+		"CHANMODES=" + strings.Join(ChannelModeTypes, ","),
+		fmt.Sprintf("MODES=%d", ChanModesPerCommand),
+		fmt.Sprintf("NICKLEN=%d", cb.Config.MaxNickLength),
+		fmt.Sprintf("CHANNELLEN=%d", maxChannelLength),
+		fmt.Sprintf("TOPICLEN=%d", maxTopicLength),
+		fmt.Sprintf("KICKLEN=%d", cb.Config.MaxKickLength),
+		fmt.Sprintf("KEYLEN=%d", maxKeyLength),
+		"CALLERID=g",
+		"EXCEPTS=e",
+		"EXTBAN=$," + ExtendedBanTypes,
+		fmt.Sprintf("ACCEPT=%d", cb.Config.MaxAcceptList),
+		fmt.Sprintf("WATCH=%d", cb.Config.MaxWatchSize),
+	}
+
+	if maxChannels > 0 {
+		tokens = append(tokens, fmt.Sprintf("MAXCHANNELS=%d", maxChannels))
+	}
+
+	if cb.Config.MOTDThrottle > 0 {
+		tokens = append(tokens, fmt.Sprintf("MOTDTHROTTLE=%d",
+			int(cb.Config.MOTDThrottle.Seconds())))
+	}
+
+	return tokens
 }
 
-// Send a KILL command to all connected servers.
-//
-// We send KILL commands to all servers, but do nothing else.
-//
-// If killer is nil, then the killer is the server.
-func (cb *Catbox) issueKillToAllServers(killer, killee *User,
-	message string) []Message {
-	msgs := []Message{}
+// Send a message to all local operator users.
+func (cb *Catbox) noticeLocalOpers(msg string) {
+	cb.Logger.Info("Local oper notice: %s", msg)
+
+	for _, user := range cb.Opers {
+		if user.isLocal() {
+			user.LocalUser.serverNotice(msg)
+			continue
+		}
+	}
+}
+
+// notifyNetsplit tells about a netsplit or netjoin between two servers if we
+// are configured to. event is Netsplit or Netjoin. users are the users on the
+// far side.
+//
+// We tell local opers, and local users who share a channel with any of the
+// users. ircd-ratbox shows netsplits only through QUIT messages of the form
+// "<near> <far>", so we use the same order of servers.
+func (cb *Catbox) notifyNetsplit(event, near, far string, users []*User) {
+	msg := fmt.Sprintf("%s %s %s", event, near, far)
+
+	if cb.Config.NetsplitNotifyOpers {
+		cb.noticeLocalOpers(fmt.Sprintf("%s (%d users)", msg, len(users)))
+	}
+
+	if !cb.Config.NetsplitNotifyUsers {
+		return
+	}
+
+	informedUsers := make(map[TS6UID]struct{})
+	for _, user := range users {
+		for _, channel := range user.Channels {
+			for memberUID := range channel.Members {
+				member, exists := cb.Users[memberUID]
+				if !exists || !member.isLocal() {
+					continue
+				}
+
+				if _, exists := informedUsers[memberUID]; exists {
+					continue
+				}
+				informedUsers[memberUID] = struct{}{}
+
+				member.LocalUser.serverNotice(msg)
+			}
+		}
+	}
+}
+
+// cleanMOTDThrottle forgets IPs that received the MOTD longer than
+// MOTDThrottle ago.
+func (cb *Catbox) cleanMOTDThrottle(now time.Time) {
+	for ip, sent := range cb.MOTDThrottle {
+		if now.Sub(sent) >= cb.Config.MOTDThrottle {
+			delete(cb.MOTDThrottle, ip)
+		}
+	}
+}
+
+// registrationThrottled decides whether a client must wait to register
+// because too many users registered this second (MaxRegistrationsPerSecond).
+func (cb *Catbox) registrationThrottled(now time.Time) bool {
+	if cb.Config.MaxRegistrationsPerSecond == 0 {
+		return false
+	}
+
+	if now.Sub(cb.RegistrationWindowStart) >= time.Second {
+		cb.RegistrationCount = 0
+		cb.RegistrationWindowStart = now
+	}
+
+	return cb.RegistrationCount >= cb.Config.MaxRegistrationsPerSecond
+}
+
+// completeDeferredRegistrations registers clients we held back because too
+// many registered at once. We take them in the order they connected until we
+// hit the limit again.
+func (cb *Catbox) completeDeferredRegistrations(now time.Time) {
+	var deferred []*LocalClient
+	for _, client := range cb.LocalClients {
+		if client.RegistrationDeferred {
+			deferred = append(deferred, client)
+		}
+	}
+
+	sort.Slice(deferred, func(i, j int) bool {
+		return deferred[i].ID < deferred[j].ID
+	})
+
+	for _, client := range deferred {
+		if cb.registrationThrottled(now) {
+			return
+		}
+		client.registerUser()
+	}
+}
+
+// operStats finds the action counts for the oper, creating them if this is
+// their first action.
+func (cb *Catbox) operStats(u *User) *OperStats {
+	if cb.OperActions == nil {
+		cb.OperActions = make(map[TS6UID]*OperStats)
+	}
+
+	stats, exists := cb.OperActions[u.UID]
+	if !exists {
+		stats = &OperStats{}
+		cb.OperActions[u.UID] = stats
+	}
+	return stats
+}
+
+// holdNick stops anyone but opers from taking the nick for NickDelay.
+func (cb *Catbox) holdNick(nick string, now time.Time) {
+	if cb.Config.NickDelay <= 0 {
+		return
+	}
+
+	if cb.NickHolds == nil {
+		cb.NickHolds = make(map[string]time.Time)
+	}
+	cb.NickHolds[canonicalizeNick(nick)] = now.Add(cb.Config.NickDelay)
+}
+
+// isNickHeld checks whether we're holding the nick. The nick must be
+// canonicalized.
+func (cb *Catbox) isNickHeld(nickCanon string, now time.Time) bool {
+	expires, exists := cb.NickHolds[nickCanon]
+	return exists && now.Before(expires)
+}
+
+// cleanNickHolds forgets nicks we're done holding.
+func (cb *Catbox) cleanNickHolds(now time.Time) {
+	for nick, expires := range cb.NickHolds {
+		if !now.Before(expires) {
+			delete(cb.NickHolds, nick)
+		}
+	}
+}
+
+// Store a KLINE locally, and then check if any connected local users match
+// it. If so, cut them off and notify local opers.
+//
+// This function does not propagate to any other servers.
+//
+// KLines from opers and servers are permanent locally. Automatic K-Lines for
+// flooding expire.
+func (cb *Catbox) addAndApplyKLine(kline KLine, source, reason string) {
+	// If it's a duplicate KLINE, ignore it.
+	for _, k := range cb.KLines {
+		if k.UserMask != kline.UserMask {
+			continue
+		}
+		if k.HostMask != kline.HostMask {
+			continue
+		}
+		cb.noticeOpers(fmt.Sprintf("Ignoring duplicate K-Line for [%s@%s] from %s",
+			k.UserMask, k.HostMask, source))
+		return
+	}
+
+	cb.KLines = append(cb.KLines, kline)
+
+	notice := fmt.Sprintf("%s added K-Line for [%s@%s] [%s]", source,
+		kline.UserMask, kline.HostMask, reason)
+	cb.noticeOpers(notice)
+	cb.noticeMonitoredChannels(notice)
+
+	// Do we have any matching users connected? Cut them off if so.
+
+	quitReason := fmt.Sprintf("Connection closed: %s", reason)
+
+	for _, user := range cb.LocalUsers {
+		matches, err := user.User.matchesMask(kline.UserMask, kline.HostMask)
+		if err != nil {
+			cb.Logger.Warn("K-Line: %s", err)
+		}
+		if !matches {
+			continue
+		}
+
+		user.quit(quitReason, true)
+
+		cb.noticeOpers(fmt.Sprintf("User disconnected due to K-Line: %s",
+			user.User.DisplayNick))
+	}
+}
+
+// expireKLines removes temporary K-Lines that have expired.
+func (cb *Catbox) expireKLines(now time.Time) {
+	klines := []KLine{}
+	for _, kline := range cb.KLines {
+		if kline.Expires.IsZero() || now.Before(kline.Expires) {
+			klines = append(klines, kline)
+			continue
+		}
+
+		cb.noticeOpers(fmt.Sprintf("Temporary K-Line for [%s@%s] expired",
+			kline.UserMask, kline.HostMask))
+	}
+	cb.KLines = klines
+}
+
+// recordFloodHit notes that a user was disconnected for excess flood.
+//
+// It returns true if their IP flooded more than AutoKLineCount times within
+// AutoKLineWindow.
+func (cb *Catbox) recordFloodHit(ip string, now time.Time) bool {
+	cutoff := now.Add(-cb.Config.AutoKLineWindow).Unix()
+
+	hits := []int64{now.Unix()}
+	for _, hit := range cb.FloodHits[ip] {
+		if hit > cutoff {
+			hits = append(hits, hit)
+		}
+	}
+	cb.FloodHits[ip] = hits
+
+	return len(hits) > cb.Config.AutoKLineCount
+}
+
+// cleanFloodHits forgets flood hits older than AutoKLineWindow.
+func (cb *Catbox) cleanFloodHits(now time.Time) {
+	cutoff := now.Add(-cb.Config.AutoKLineWindow).Unix()
+
+	for ip, hits := range cb.FloodHits {
+		recent := []int64{}
+		for _, hit := range hits {
+			if hit > cutoff {
+				recent = append(recent, hit)
+			}
+		}
+
+		if len(recent) == 0 {
+			delete(cb.FloodHits, ip)
+			continue
+		}
+		cb.FloodHits[ip] = recent
+	}
+}
+
+// floodKLine disconnects a user for excess flood. If we automatically K-Line
+// flooders and their IP floods too often, we K-Line it for a while too.
+//
+// We don't propagate these K-Lines. They're for flooding us.
+func (cb *Catbox) floodKLine(u *LocalUser) {
+	now := time.Now()
+	kline := cb.Config.AutoKLineOnFlood && cb.recordFloodHit(u.User.IP, now)
+
+	u.quit("Excess flood", true)
+
+	if !kline {
+		return
+	}
+
+	delete(cb.FloodHits, u.User.IP)
+
+	reason := fmt.Sprintf("Flooding. Temporary K-Line for %d minutes.",
+		cb.Config.AutoKLineDuration)
+
+	cb.noticeLocalOpers(fmt.Sprintf("Automatically K-Lining %s (%s) for flooding",
+		u.User.DisplayNick, u.User.IP))
+
+	cb.addAndApplyKLine(KLine{
+		UserMask: "*",
+		HostMask: u.User.IP,
+		Reason:   reason,
+		Expires:  now.Add(time.Duration(cb.Config.AutoKLineDuration) * time.Minute),
+	}, cb.Config.ServerName, reason)
+}
+
+func (cb *Catbox) removeKLine(userMask, hostMask, source string) bool {
+	idx := -1
+	for i, kline := range cb.KLines {
+		if kline.UserMask != userMask || kline.HostMask != hostMask {
+			continue
+		}
+		idx = i
+		break
+	}
+
+	if idx == -1 {
+		cb.noticeOpers(fmt.Sprintf("Not removing K-Line for [%s@%s] (not found)",
+			userMask, hostMask))
+		return false
+	}
+
+	cb.KLines = append(cb.KLines[:idx], cb.KLines[idx+1:]...)
+
+	cb.noticeOpers(fmt.Sprintf("%s removed K-Line for [%s@%s]",
+		source, userMask, hostMask))
+
+	return true
+}
+
+// Issue a KILL from this server.
+//
+// We send a KILL message to each server.
+//
+// We cut the user off if they are local.
+//
+// We tell local users a Quit if the user is remote.
+//
+// We forget the user.
+//
+// If killer is nil, then this is a server KILL.
+func (cb *Catbox) issueKill(killer, killee *User, message string) {
+	sendMessages(cb.issueKillToAllServers(killer, killee, message))
+	cb.cleanupKilledUser(killer, killee, message)
+}
+
+// Send a KILL command to all connected servers.
+//
+// We send KILL commands to all servers, but do nothing else.
+//
+// If killer is nil, then the killer is the server.
+func (cb *Catbox) issueKillToAllServers(killer, killee *User,
+	message string) []Message {
+	msgs := []Message{}
 	for _, ls := range cb.LocalServers {
 		msgs = append(msgs, cb.issueKillToServer(ls, killer, killee, message)...)
 	}
@@ -1254,26 +2112,91 @@ func (cb *Catbox) issueKillToServer(ls *LocalServer, killer, killee *User,
 // If killer is nil, then this is a server KILL.
 func (cb *Catbox) cleanupKilledUser(killer, killee *User, message string) {
 	killerName := ""
+	source := ""
 	if killer == nil {
 		killerName = cb.Config.ServerName
+		source = cb.Config.ServerName
 	} else {
 		killerName = killer.DisplayNick
+		source = killer.nickUhost()
 	}
 
-	quitReason := fmt.Sprintf("Killed (%s (%s))", killerName, message)
-
 	// If it's a local user, drop it.
 	if killee.isLocal() {
 		// We don't need to propagate a QUIT. We propagated KILL.
-		killee.LocalUser.quit(quitReason, false)
+		killee.LocalUser.killed(source, killerName, message)
 		return
 	}
 
+	quitReason := fmt.Sprintf("Killed (%s (%s))", killerName, message)
+
 	// It's a remote user. Tell local users a quit message.
 	// And forget the remote user.
 	cb.quitRemoteUser(killee, quitReason)
 }
 
+// whoisChannels builds the channel lists for 319 RPL_WHOISCHANNELS. Each
+// channel has the user's membership prefix. We put as many as fit on each
+// line.
+//
+// Unless the user asking is on the channel, is an oper, or is asking about
+// themself, we leave out secret channels and show private channels as *.
+func (cb *Catbox) whoisChannels(user, replyUser *User) []string {
+	var names []string
+	for _, channel := range user.Channels {
+		if user != replyUser && !replyUser.isOperator() &&
+			!replyUser.onChannel(channel) {
+			if channel.isSecret() {
+				continue
+			}
+			if channel.isPrivate() {
+				names = append(names, "*")
+				continue
+			}
+		}
+		names = append(names, channel.membershipPrefix(user)+channel.Name)
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	sort.Strings(names)
+
+	// Size the line as the client will see it. A remote WHOIS uses IDs but the
+	// user's server puts names back.
+	m := irc.Message{
+		Prefix:  cb.Config.ServerName,
+		Command: "319",
+		Params:  []string{replyUser.DisplayNick, user.DisplayNick, ""},
+	}
+	buf, err := m.Encode()
+	if err != nil {
+		cb.Logger.Error("Unable to generate RPL_WHOISCHANNELS: %s", err)
+		return nil
+	}
+	baseSize := len(buf)
+
+	var lines []string
+	line := ""
+	for _, name := range names {
+		// Assume one channel will always fit.
+		if line == "" {
+			line = name
+			continue
+		}
+
+		// +1 for " "
+		if baseSize+len(line)+1+len(name) > irc.MaxLineLength {
+			lines = append(lines, line)
+			line = name
+			continue
+		}
+
+		line += " " + name
+	}
+	return append(lines, line)
+}
+
 // Build irc.Messages that make up a WHOIS response. You can then send them to
 // where they need to go.
 //
@@ -1312,7 +2235,17 @@ func (cb *Catbox) createWHOISResponse(user, replyUser *User,
 	})
 
 	// 319 RPL_WHOISCHANNELS
-	// I choose to not show any.
+	for _, channels := range cb.whoisChannels(user, replyUser) {
+		msgs = append(msgs, irc.Message{
+			Prefix:  from,
+			Command: "319",
+			Params: []string{
+				to,
+				user.DisplayNick,
+				channels,
+			},
+		})
+	}
 
 	// 312 RPL_WHOISSERVER
 	msgs = append(msgs, irc.Message{
@@ -1356,7 +2289,7 @@ func (cb *Catbox) createWHOISResponse(user, replyUser *User,
 	if user.isLocal() && user.LocalUser.isTLS() {
 		tlsVersion, tlsCipherSuite, err := user.LocalUser.getTLSState()
 		if err != nil {
-			log.Printf("Client %s: Unable to determine TLS state: %s", user.LocalUser,
+			cb.Logger.Warn("Client %s: Unable to determine TLS state: %s", user.LocalUser,
 				err)
 		} else {
 			msgs = append(msgs, irc.Message{
@@ -1372,6 +2305,20 @@ func (cb *Catbox) createWHOISResponse(user, replyUser *User,
 		}
 	}
 
+	// 276 RPL_WHOISCERTFP
+	if user.isLocal() && user.LocalUser.CertFP != "" {
+		msgs = append(msgs, irc.Message{
+			Prefix:  from,
+			Command: "276",
+			Params: []string{
+				to,
+				user.DisplayNick,
+				fmt.Sprintf("has client certificate fingerprint %s",
+					user.LocalUser.CertFP),
+			},
+		})
+	}
+
 	// 317 RPL_WHOISIDLE. Only if local.
 	if user.isLocal() {
 		idleDuration := time.Since(user.LocalUser.LastMessageTime)
@@ -1405,6 +2352,17 @@ func (cb *Catbox) createWHOISResponse(user, replyUser *User,
 	return msgs
 }
 
+// localUserCount counts users connected to us. Our services are not
+// connected, so they don't count.
+func (cb *Catbox) localUserCount() int {
+	return len(cb.LocalUsers)
+}
+
+// globalServerCount counts servers on the network, including ourself.
+func (cb *Catbox) globalServerCount() int {
+	return len(cb.Servers) + 1
+}
+
 // Update some of our counters.
 //
 // We track the maximum number of local users we've seen, and the maximum
@@ -1415,12 +2373,12 @@ func (cb *Catbox) createWHOISResponse(user, replyUser *User,
 // You should call this after you have made any changes to
 // clients/users/servers counts.
 func (cb *Catbox) updateCounters() {
-	if len(cb.LocalUsers) > cb.HighestLocalUserCount {
-		cb.HighestLocalUserCount = len(cb.LocalUsers)
+	if cb.localUserCount() > cb.HighestLocalUserCount {
+		cb.HighestLocalUserCount = cb.localUserCount()
 	}
 
-	if len(cb.Users) > cb.HighestGlobalUserCount {
-		cb.HighestGlobalUserCount = len(cb.Users)
+	if cb.userCount() > cb.HighestGlobalUserCount {
+		cb.HighestGlobalUserCount = cb.userCount()
 	}
 
 	currentClientCount := len(cb.LocalClients) + len(cb.LocalUsers) +
@@ -1472,7 +2430,12 @@ func (cb *Catbox) quitRemoteUser(u *User, message string) {
 		}
 	}
 
+	cb.notifyWatchers(u, false)
+	cb.holdNick(u.DisplayNick, time.Now())
+
 	// Forget the user.
+	cb.forgetInvites(u)
+	delete(cb.ServiceHandlers, u.UID)
 	delete(cb.Users, u.UID)
 	if u.isOperator() {
 		delete(cb.Opers, u.UID)
@@ -1480,58 +2443,464 @@ func (cb *Catbox) quitRemoteUser(u *User, message string) {
 	delete(cb.Nicks, canonicalizeNick(u.DisplayNick))
 }
 
+// forgetInvites removes any invites the user has. We do this when they leave
+// the network.
+func (cb *Catbox) forgetInvites(u *User) {
+	for _, channel := range cb.Channels {
+		channel.removeInvite(u)
+	}
+}
+
+// expireInvites forgets invites that users did not use in time.
+func (cb *Catbox) expireInvites(now time.Time) {
+	for _, channel := range cb.Channels {
+		channel.expireInvites(now)
+	}
+}
+
+// notifyInvite tells local members of the channel who negotiated
+// invite-notify that a user invited someone. The inviter and the invited user
+// hear about it otherwise, so we skip them.
+func (cb *Catbox) notifyInvite(inviter, target *User, channel *Channel) {
+	for memberUID := range channel.Members {
+		if memberUID == inviter.UID || memberUID == target.UID {
+			continue
+		}
+
+		member := cb.Users[memberUID]
+		if !member.isLocal() || !member.LocalUser.hasCap("invite-notify") {
+			continue
+		}
+
+		member.LocalUser.maybeQueueMessage(irc.Message{
+			Prefix:  inviter.nickUhost(),
+			Command: "INVITE",
+			Params:  []string{target.DisplayNick, channel.Name},
+		})
+	}
+}
+
 // Rehash reloads our config.
 //
 // Only certain config options can change during rehash.
 //
 // We could close listeners and open new ones. But nah.
-func (cb *Catbox) rehash(byUser *User) {
+//
+// what says which part of the configuration to reload. It is one of the
+// RehashTargets. RehashAll reloads everything we can.
+func (cb *Catbox) rehash(byUser *User, what string) {
 	cfg, err := checkAndParseConfig(cb.ConfigFile)
 	if err != nil {
 		cb.noticeOpers(fmt.Sprintf("Rehash: Configuration problem: %s", err))
 		return
 	}
 
+	description := "configuration"
+
+	// We build the config we'll use from a copy of the current one and then swap
+	// it in. Goroutines besides this one read the config, so we never change it
+	// in place. They'd see it partly updated.
+	next := *cb.Config
+	all := false
+
+	switch what {
+	case RehashMOTD:
+		cb.reloadMOTD(&next, cfg)
+		description = "MOTD"
+	case RehashOpers:
+		reloadOpers(&next, cfg)
+		description = "opers"
+	case RehashServers:
+		reloadServerLinks(&next, cfg)
+		description = "server links"
+	default:
+		cb.reloadAll(&next, cfg)
+		all = true
+	}
+
+	cb.setConfig(&next)
+
+	// New TLS connections get the new certificate. Existing ones keep theirs.
+	// The certificate is only ours, so only our opers hear about it. If we
+	// started without TLS, there's nothing serving a certificate to reload.
+	if all && cb.TLSConfig != nil && cb.Config.CertificateFile != "" &&
+		cb.Config.KeyFile != "" {
+		if err := cb.loadCertificate(); err != nil {
+			cb.noticeLocalOpers(fmt.Sprintf("Error loading certificate/key: %s",
+				err))
+			cb.Logger.Error("%+v", err)
+		} else {
+			cb.noticeLocalOpers("Reloaded certificate/key.")
+		}
+	}
+
+	if byUser != nil {
+		cb.noticeOpers(fmt.Sprintf("%s rehashed %s.", byUser.DisplayNick,
+			description))
+	} else {
+		cb.noticeOpers(fmt.Sprintf("Rehashed %s.", description))
+	}
+}
+
+// propagateRehashMessages builds ENCAP REHASH messages to tell every server
+// on the network to rehash.
+//
+// We only do this if we're configured to. Otherwise there are no messages.
+func (cb *Catbox) propagateRehashMessages(source *User, what string) []Message {
+	if !cb.Config.PropagateRehash {
+		return nil
+	}
+
+	msgs := []Message{}
+	for _, server := range cb.LocalServers {
+		msgs = append(msgs, Message{
+			Target: server.LocalClient,
+			Message: irc.Message{
+				Prefix:  string(source.UID),
+				Command: "ENCAP",
+				Params:  []string{"*", "REHASH", what},
+			},
+		})
+	}
+	return msgs
+}
+
+// remoteRehashMessages builds an ENCAP REHASH message to tell a single remote
+// server to rehash.
+//
+// We send it toward the server. Servers along the way pass it on but do not
+// act on it as it is not for them.
+func (cb *Catbox) remoteRehashMessages(source *User, target *Server,
+	what string) []Message {
+	return []Message{
+		{
+			Target: target.ClosestServer.LocalClient,
+			Message: irc.Message{
+				Prefix:  string(source.UID),
+				Command: "ENCAP",
+				Params:  []string{target.Name, "REHASH", what},
+			},
+		},
+	}
+}
+
+// maskRehashMessages builds ENCAP REHASH messages to tell the servers
+// matching a mask to rehash.
+//
+// We send it to every server we're linked to. Every server passes it on and
+// those matching the mask act on it.
+func (cb *Catbox) maskRehashMessages(source *User, mask,
+	what string) []Message {
+	msgs := []Message{}
+	for _, server := range cb.LocalServers {
+		msgs = append(msgs, Message{
+			Target: server.LocalClient,
+			Message: irc.Message{
+				Prefix:  string(source.UID),
+				Command: "ENCAP",
+				Params:  []string{mask, "REHASH", what},
+			},
+		})
+	}
+	return msgs
+}
+
+// serversMatching returns the names of the servers matching the mask,
+// including us, sorted.
+func (cb *Catbox) serversMatching(mask string) []string {
+	names := []string{}
+	if globMatch(mask, cb.Config.ServerName) {
+		names = append(names, cb.Config.ServerName)
+	}
+	for _, server := range cb.Servers {
+		if globMatch(mask, server.Name) {
+			names = append(names, server.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// encapForUs decides whether an ENCAP destination includes us. The
+// destination is either a server name mask or a SID.
+func (cb *Catbox) encapForUs(dest string) bool {
+	if TS6SID(dest) == cb.Config.TS6SID {
+		return true
+	}
+	return globMatch(dest, cb.Config.ServerName)
+}
+
+// encapRoutes finds the local servers we must pass an ENCAP on to so it
+// reaches every server its destination matches. We skip from, the link it
+// came in on (nil if it came from us).
+//
+// A server gets it only if some server on its side of the tree matches.
+func (cb *Catbox) encapRoutes(dest string, from *LocalServer) []*LocalServer {
+	seen := map[*LocalServer]struct{}{}
+	routes := []*LocalServer{}
+	for _, server := range cb.Servers {
+		if TS6SID(dest) != server.SID && !globMatch(dest, server.Name) {
+			continue
+		}
+
+		route := server.nextHop()
+		if route == nil || route == from {
+			continue
+		}
+		if _, exists := seen[route]; exists {
+			continue
+		}
+		seen[route] = struct{}{}
+		routes = append(routes, route)
+	}
+	sort.Slice(routes, func(i, j int) bool { return routes[i].ID < routes[j].ID })
+	return routes
+}
+
+// issuedChallengeNonce tells whether we sent the nonce in a CHALLENGE to a
+// server that is still linking.
+func (cb *Catbox) issuedChallengeNonce(nonce string) bool {
+	for _, client := range cb.LocalClients {
+		if client.ChallengeNonce != "" && client.ChallengeNonce == nonce {
+			return true
+		}
+	}
+	return false
+}
+
+// reloadAll takes everything from the new config that we can change while
+// running and puts it in next, the config we're building.
+func (cb *Catbox) reloadAll(next, cfg *Config) {
 	// Changing these requires closing/reopening listeners:
 	// ListenHost
 	// ListenPort
 	// ListenPortTLS
 
-	cb.Config.CertificateFile = cfg.CertificateFile
-	cb.Config.KeyFile = cfg.KeyFile
-	if err := cb.loadCertificate(); err != nil {
-		cb.noticeOpers(fmt.Sprintf("Error loading certificate/key: %s", err))
-		log.Printf("%+v", err)
-	}
+	// We load the certificate once we're using the new config.
+	next.CertificateFile = cfg.CertificateFile
+	next.KeyFile = cfg.KeyFile
 
 	// Changing these may require relinking servers as they are part of the
 	// link handshake:
 	// ServerName
 	// ServerInfo
 
-	cb.Config.MOTD = cfg.MOTD
+	cb.reloadMOTD(next, cfg)
+	cb.reloadWelcome(next, cfg)
 
-	// MaxNickLength: I think this is not acceptable to change live. Live clients
-	// might turn out to be invalid, plus there is the issue of remote clients.
+	cb.reloadMaxNickLength(next, cfg)
 
-	cb.Config.PingTime = cfg.PingTime
-	cb.Config.DeadTime = cfg.DeadTime
-	cb.Config.ConnectAttemptTime = cfg.ConnectAttemptTime
+	next.NickDelay = cfg.NickDelay
+	next.PingTime = cfg.PingTime
+	next.DeadTime = cfg.DeadTime
+	next.ConnectAttemptTime = cfg.ConnectAttemptTime
 
 	// TS6SID: Changing this requires relinking. It is part of link handshake.
 
-	cb.Config.AdminEmail = cfg.AdminEmail
-
-	cb.Config.Opers = cfg.Opers
-	cb.Config.Servers = cfg.Servers
-	cb.Config.UserConfigs = cfg.UserConfigs
+	next.AdminEmail = cfg.AdminEmail
+	next.UserPassword = cfg.UserPassword
+
+	next.AutoKLineOnFlood = cfg.AutoKLineOnFlood
+	next.AutoKLineCount = cfg.AutoKLineCount
+	next.AutoKLineWindow = cfg.AutoKLineWindow
+	next.AutoKLineDuration = cfg.AutoKLineDuration
+	next.FloodExempt = cfg.FloodExempt
+
+	next.MaxAcceptList = cfg.MaxAcceptList
+	next.MaxWatchSize = cfg.MaxWatchSize
+	next.MaxMetadataKeys = cfg.MaxMetadataKeys
+	next.MaxKickLength = cfg.MaxKickLength
+	next.MaxQuitLength = cfg.MaxQuitLength
+	next.MaxPartLength = cfg.MaxPartLength
+	next.MaxRegistrationsPerSecond = cfg.MaxRegistrationsPerSecond
+	next.AllowSERVLIST = cfg.AllowSERVLIST
+	next.MapMaxDepth = cfg.MapMaxDepth
+	next.HideStats = cfg.HideStats
+	next.MaxWhoisPerMinute = cfg.MaxWhoisPerMinute
+	next.ShowOperOnConnect = cfg.ShowOperOnConnect
+	next.RequireForwardDNS = cfg.RequireForwardDNS
+	next.NetsplitNotifyOpers = cfg.NetsplitNotifyOpers
+	next.NetsplitNotifyUsers = cfg.NetsplitNotifyUsers
+	next.ChannelNoticePattern = cfg.ChannelNoticePattern
+
+	// The config parsed, so the regex compiles.
+	nickValidator, err := newNickValidator(cfg)
+	if err != nil {
+		cb.noticeOpers(fmt.Sprintf("Rehash: Unable to load nick regex: %s", err))
+	} else {
+		next.NickValidRegex = cfg.NickValidRegex
+		next.NickAllowUnicode = cfg.NickAllowUnicode
+		cb.NickValidator = nickValidator
+	}
 
-	if byUser != nil {
-		cb.noticeOpers(fmt.Sprintf("%s rehashed configuration.",
-			byUser.DisplayNick))
+	// The config parsed, so the patterns compile.
+	spamFilters, err := newSpamFilters(cfg)
+	if err != nil {
+		cb.noticeOpers(fmt.Sprintf("Rehash: Unable to load spam filters: %s", err))
 	} else {
-		cb.noticeOpers("Rehashed configuration.")
+		next.SpamFilters = cfg.SpamFilters
+		cb.CompiledSpamFilters = spamFilters
+	}
+
+	cb.reloadXLines(next, cfg)
+	cb.reloadDLines(next, cfg)
+	cb.reloadGeoIP(next, cfg)
+	cb.reloadHelp(next, cfg)
+	reloadOpers(next, cfg)
+	reloadServerLinks(next, cfg)
+	next.UserConfigs = cfg.UserConfigs
+	next.ConnClasses = cfg.ConnClasses
+}
+
+// reloadMOTD takes the MOTD from the new config and puts it in next. We reload
+// the rules too as they are shown alongside it.
+func (cb *Catbox) reloadMOTD(next, cfg *Config) {
+	next.MOTD = cfg.MOTD
+	next.MOTDThrottle = cfg.MOTDThrottle
+
+	rules, err := loadRules(cfg.RulesFile)
+	if err != nil {
+		cb.noticeOpers(fmt.Sprintf("Rehash: Unable to load rules: %s", err))
+		return
+	}
+	next.RulesFile = cfg.RulesFile
+	next.RulesOnConnect = cfg.RulesOnConnect
+	cb.Rules = rules
+}
+
+// reloadMaxNickLength takes the max nick length from the new config and puts
+// it in next.
+//
+// If it shrinks, we truncate local users' nicks that are now too long. Their
+// nick changes propagate as usual. We leave a user alone if their truncated
+// nick is taken or invalid. Remote users are their servers' business, though
+// servers with longer nicks than we permit will be unable to link.
+func (cb *Catbox) reloadMaxNickLength(next, cfg *Config) {
+	oldLength := next.MaxNickLength
+	next.MaxNickLength = cfg.MaxNickLength
+
+	if cfg.MaxNickLength == oldLength {
+		return
+	}
+
+	cb.noticeOpers(fmt.Sprintf("Rehash: Max nick length changed from %d to %d",
+		oldLength, cfg.MaxNickLength))
+
+	if cfg.MaxNickLength > oldLength {
+		return
+	}
+
+	nickValidator, err := newNickValidator(cfg)
+	if err != nil {
+		nickValidator = cb.NickValidator
+	}
+
+	for _, lu := range cb.LocalUsers {
+		nick := lu.User.DisplayNick
+		if len(nick) <= cfg.MaxNickLength {
+			continue
+		}
+
+		truncated := truncateText(nick, cfg.MaxNickLength)
+
+		if !isValidNick(cfg.MaxNickLength, nickValidator, truncated) {
+			cb.noticeOpers(fmt.Sprintf(
+				"Rehash: Unable to truncate nick %s: %s is invalid", nick, truncated))
+			continue
+		}
+
+		if _, exists := cb.Nicks[canonicalizeNick(truncated)]; exists {
+			cb.noticeOpers(fmt.Sprintf(
+				"Rehash: Unable to truncate nick %s: %s is in use", nick, truncated))
+			continue
+		}
+
+		lu.changeNick(truncated, time.Now().Unix())
+	}
+}
+
+// loadRules reads the rules file. Each line is a rule. We skip blank lines.
+//
+// If there is no file configured or it does not exist, there are no rules.
+func loadRules(file string) ([]string, error) {
+	rules, err := readLines(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read rules file: %s", err)
+	}
+	return rules, nil
+}
+
+// reloadWelcome takes the welcome lines from the new config and puts them in
+// next.
+func (cb *Catbox) reloadWelcome(next, cfg *Config) {
+	welcome, err := loadWelcome(cfg)
+	if err != nil {
+		cb.noticeOpers(fmt.Sprintf("Rehash: Unable to load welcome: %s", err))
+		return
+	}
+	next.WelcomeLines = cfg.WelcomeLines
+	next.WelcomeFile = cfg.WelcomeFile
+	cb.Welcome = welcome
+}
+
+// loadWelcome reads the welcome file if there is one. Otherwise the welcome
+// is WelcomeLines.
+func loadWelcome(cfg *Config) ([]string, error) {
+	if cfg.WelcomeFile == "" {
+		return cfg.WelcomeLines, nil
+	}
+
+	welcome, err := readLines(cfg.WelcomeFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read welcome file: %s", err)
+	}
+	return welcome, nil
+}
+
+// readLines reads the non-blank lines of a file.
+//
+// If there is no file or it does not exist, there are no lines.
+func readLines(file string) ([]string, error) {
+	if file == "" {
+		return nil, nil
+	}
+
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var lines []string
+	for _, line := range strings.Split(string(buf), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		lines = append(lines, line)
 	}
+	return lines, nil
+}
+
+// reloadOpers takes the oper definitions from the new config and puts them in
+// next.
+//
+// Users who are already opers stay opers.
+func reloadOpers(next, cfg *Config) {
+	next.Opers = cfg.Opers
+	next.OperCerts = cfg.OperCerts
+	next.OperRSAKeys = cfg.OperRSAKeys
+}
+
+// reloadServerLinks takes the server link definitions from the new config and
+// puts them in next.
+//
+// This does not affect current links. It changes which servers we will try
+// to connect to and accept.
+func reloadServerLinks(next, cfg *Config) {
+	next.Servers = cfg.Servers
 }
 
 // Restart initiates shutdown and flags us so we restart our process.
@@ -1542,10 +2911,11 @@ func (cb *Catbox) restart(byUser *User) {
 		cb.noticeOpers("Restarting.")
 	}
 
-	// We shutdown everything, then flag to restart. This means when we exit our
-	// main loop we'll start a new process.
-	cb.shutdown()
+	// We flag to restart, then shutdown everything. This means when we exit our
+	// main loop we'll start a new process. Shutdown needs to know we're
+	// restarting as it keeps users connected if we save a snapshot.
 	cb.Restart = true
+	cb.shutdown()
 }
 
 // Look up a server by its name. e.g., irc.example.com
@@ -1571,6 +2941,58 @@ func (cb *Catbox) messageLocalUsersOnChannel(channel *Channel, m irc.Message) {
 	}
 }
 
+// channelNotice sends a NOTICE from the server to the local members of a
+// channel.
+func (cb *Catbox) channelNotice(channel *Channel, text string) {
+	cb.messageLocalUsersOnChannel(channel, irc.Message{
+		Prefix:  cb.Config.ServerName,
+		Command: "NOTICE",
+		Params:  []string{channel.Name, text},
+	})
+}
+
+// noticeMonitoredChannels sends a NOTICE from the server to the local members
+// of each channel matching ChannelNoticePattern.
+//
+// This lets a channel such as #opers follow what opers do.
+func (cb *Catbox) noticeMonitoredChannels(text string) {
+	if cb.Config.ChannelNoticePattern == "" {
+		return
+	}
+
+	for _, channel := range cb.Channels {
+		if !globMatch(cb.Config.ChannelNoticePattern, channel.Name) {
+			continue
+		}
+		cb.channelNotice(channel, text)
+	}
+}
+
+// kickUser removes a user from a channel because someone kicked them. source is
+// who kicked them, as it appears to users (nick!user@host or a server name).
+//
+// We tell local users on the channel, including the user. We don't tell any
+// servers.
+func (cb *Catbox) kickUser(source string, channel *Channel, user *User,
+	reason string) {
+	params := []string{channel.Name, user.DisplayNick}
+	if reason != "" {
+		params = append(params, reason)
+	}
+
+	cb.messageLocalUsersOnChannel(channel, irc.Message{
+		Prefix:  source,
+		Command: "KICK",
+		Params:  params,
+	})
+
+	channel.removeUser(user)
+
+	if len(channel.Members) == 0 {
+		delete(cb.Channels, channel.Name)
+	}
+}
+
 // Determine if there is a collision for the given nick.
 //
 // If there is, issue the appropriate kills.
@@ -1620,9 +3042,12 @@ func (cb *Catbox) handleCollision(fromServer *LocalServer, newUID TS6UID,
 
 	existingUser, exists := cb.Users[existingUID]
 	if !exists {
-		log.Printf("User not found with UID %s. But UID has a nick! (%s)",
+		// The nick is stale. This should not happen, but if it does then drop the
+		// nick. There is no one to collide with.
+		cb.Logger.Warn("User not found with UID %s. But UID has a nick! (%s)",
 			existingUID, canonicalizeNick(newNick))
-		// TODO(horgh): Should we abort?
+		delete(cb.Nicks, canonicalizeNick(newNick))
+		return true
 	}
 
 	// If this is a UID command then we do not yet have a User record yet for the
@@ -1701,6 +3126,48 @@ func (cb *Catbox) handleCollision(fromServer *LocalServer, newUID TS6UID,
 	return false
 }
 
+// chghostMessages builds CHGHOST messages telling local users about a user's
+// new username and/or hostname.
+//
+// The messages come from the user's old nick!user@host. We tell each local
+// user in a channel with the user once, if they have the chghost capability.
+// Others don't hear about it.
+func (cb *Catbox) chghostMessages(user *User, oldUsername,
+	oldHostname string) []Message {
+	prefix := fmt.Sprintf("%s!%s@%s", user.DisplayNick, oldUsername, oldHostname)
+
+	msgs := []Message{}
+	toldUsers := make(map[TS6UID]struct{})
+	for _, channel := range user.Channels {
+		for memberUID := range channel.Members {
+			if memberUID == user.UID {
+				continue
+			}
+
+			member, exists := cb.Users[memberUID]
+			if !exists || !member.isLocal() ||
+				!member.LocalUser.hasCap("chghost") {
+				continue
+			}
+
+			if _, exists := toldUsers[member.UID]; exists {
+				continue
+			}
+			toldUsers[member.UID] = struct{}{}
+
+			msgs = append(msgs, Message{
+				Target: member.LocalUser.LocalClient,
+				Message: irc.Message{
+					Prefix:  prefix,
+					Command: "CHGHOST",
+					Params:  []string{user.Username, user.Hostname},
+				},
+			})
+		}
+	}
+	return msgs
+}
+
 func sendMessages(messages []Message) {
 	for _, m := range messages {
 		m.Target.maybeQueueMessage(m.Message)
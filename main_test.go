@@ -2,8 +2,16 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/horgh/irc"
 )
 
 func TestErrorToQuitMessage(t *testing.T) {
@@ -70,3 +78,620 @@ func TestErrorToQuitMessage(t *testing.T) {
 		}
 	}
 }
+
+func TestWallopsMessages(t *testing.T) {
+	cb := &Catbox{LocalUsers: map[uint64]*LocalUser{}}
+
+	// One user of each kind: +w, oper, and neither.
+	modes := []map[byte]struct{}{
+		{'w': {}},
+		{'o': {}},
+		{'i': {}},
+	}
+	for i, m := range modes {
+		user := &User{DisplayNick: fmt.Sprintf("user%d", i), Modes: m}
+		lu := &LocalUser{LocalClient: &LocalClient{ID: uint64(i)}, User: user}
+		user.LocalUser = lu
+		cb.LocalUsers[lu.ID] = lu
+	}
+
+	msgs := cb.wallopsMessages("oper!user@host", "hi there")
+
+	targets := map[uint64]struct{}{}
+	for _, m := range msgs {
+		targets[m.Target.ID] = struct{}{}
+		if m.Message.Prefix != "oper!user@host" || m.Message.Command != "WALLOPS" ||
+			len(m.Message.Params) != 1 || m.Message.Params[0] != "hi there" {
+			t.Errorf("wallopsMessages() built %v", m.Message)
+		}
+	}
+
+	if len(msgs) != 2 || len(targets) != 2 {
+		t.Fatalf("wallopsMessages() built %d messages, wanted 2", len(msgs))
+	}
+
+	if _, ok := targets[0]; !ok {
+		t.Errorf("wallopsMessages() did not include the +w user")
+	}
+	if _, ok := targets[1]; !ok {
+		t.Errorf("wallopsMessages() did not include the oper")
+	}
+}
+
+func TestLoadRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catbox-rules-")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %s", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	rulesFile := filepath.Join(dir, "rules.txt")
+	if err := ioutil.WriteFile(rulesFile,
+		[]byte("No spam.\r\n\nBe nice.\n"), 0600); err != nil {
+		t.Fatalf("unable to write rules: %s", err)
+	}
+
+	emptyFile := filepath.Join(dir, "empty.txt")
+	if err := ioutil.WriteFile(emptyFile, []byte(""), 0600); err != nil {
+		t.Fatalf("unable to write rules: %s", err)
+	}
+
+	tests := []struct {
+		file   string
+		output []string
+	}{
+		{rulesFile, []string{"No spam.", "Be nice."}},
+		{emptyFile, nil},
+		{filepath.Join(dir, "missing.txt"), nil},
+		{"", nil},
+	}
+
+	for _, test := range tests {
+		rules, err := loadRules(test.file)
+		if err != nil {
+			t.Errorf("loadRules(%s) = error %s", test.file, err)
+			continue
+		}
+
+		if strings.Join(rules, "|") != strings.Join(test.output, "|") {
+			t.Errorf("loadRules(%s) = %q, wanted %q", test.file, rules, test.output)
+		}
+	}
+}
+
+func TestLoadWelcome(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catbox-welcome-")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %s", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	welcomeFile := filepath.Join(dir, "welcome.txt")
+	if err := ioutil.WriteFile(welcomeFile,
+		[]byte("Hi {nick}.\r\n\nWelcome to {server}.\n"), 0600); err != nil {
+		t.Fatalf("unable to write welcome: %s", err)
+	}
+
+	lines := []string{"From the config."}
+
+	tests := []struct {
+		lines  []string
+		file   string
+		output []string
+	}{
+		{lines, "", lines},
+		{nil, welcomeFile, []string{"Hi {nick}.", "Welcome to {server}."}},
+		// The file wins if we have both.
+		{lines, welcomeFile, []string{"Hi {nick}.", "Welcome to {server}."}},
+		{lines, filepath.Join(dir, "missing.txt"), nil},
+		{nil, "", nil},
+	}
+
+	for _, test := range tests {
+		welcome, err := loadWelcome(&Config{WelcomeLines: test.lines,
+			WelcomeFile: test.file})
+		if err != nil {
+			t.Errorf("loadWelcome(%q, %s) = error %s", test.lines, test.file, err)
+			continue
+		}
+
+		if strings.Join(welcome, "|") != strings.Join(test.output, "|") {
+			t.Errorf("loadWelcome(%q, %s) = %q, wanted %q", test.lines, test.file,
+				welcome, test.output)
+		}
+	}
+}
+
+func TestRecordFloodHit(t *testing.T) {
+	cb := &Catbox{
+		Config:    &Config{AutoKLineCount: 2, AutoKLineWindow: time.Minute},
+		FloodHits: map[string][]int64{},
+	}
+
+	now := time.Unix(10000, 0)
+
+	tests := []struct {
+		ip     string
+		time   time.Time
+		output bool
+	}{
+		{"192.168.0.1", now, false},
+		{"192.168.0.1", now.Add(10 * time.Second), false},
+		// A different IP has its own count.
+		{"192.168.0.2", now.Add(10 * time.Second), false},
+		// Third hit in the window. That's more than 2.
+		{"192.168.0.1", now.Add(20 * time.Second), true},
+		// The first two hits are outside the window now.
+		{"192.168.0.2", now.Add(90 * time.Second), false},
+		{"192.168.0.1", now.Add(75 * time.Second), false},
+	}
+
+	for i, test := range tests {
+		if got := cb.recordFloodHit(test.ip, test.time); got != test.output {
+			t.Errorf("recordFloodHit(#%d %s) = %v, wanted %v", i, test.ip, got,
+				test.output)
+		}
+	}
+}
+
+func TestCleanFloodHits(t *testing.T) {
+	now := time.Unix(10000, 0)
+
+	cb := &Catbox{
+		Config: &Config{AutoKLineWindow: time.Minute},
+		FloodHits: map[string][]int64{
+			"192.168.0.1": {now.Add(-2 * time.Minute).Unix()},
+			"192.168.0.2": {now.Add(-2 * time.Minute).Unix(),
+				now.Add(-10 * time.Second).Unix()},
+		},
+	}
+
+	cb.cleanFloodHits(now)
+
+	if _, ok := cb.FloodHits["192.168.0.1"]; ok {
+		t.Errorf("stale flood hits were not removed")
+	}
+	if len(cb.FloodHits["192.168.0.2"]) != 1 {
+		t.Errorf("flood hits = %v, wanted one recent hit",
+			cb.FloodHits["192.168.0.2"])
+	}
+}
+
+func TestExpireKLines(t *testing.T) {
+	now := time.Now()
+
+	cb := &Catbox{
+		Config: &Config{},
+		Logger: newTestLogger(),
+		KLines: []KLine{
+			{UserMask: "*", HostMask: "permanent"},
+			{UserMask: "*", HostMask: "expired", Expires: now.Add(-time.Second)},
+			{UserMask: "*", HostMask: "active", Expires: now.Add(time.Minute)},
+		},
+	}
+
+	cb.expireKLines(now)
+
+	if len(cb.KLines) != 2 || cb.KLines[0].HostMask != "permanent" ||
+		cb.KLines[1].HostMask != "active" {
+		t.Errorf("KLines = %+v, wanted permanent and active", cb.KLines)
+	}
+}
+
+func TestFloodKLine(t *testing.T) {
+	tests := []struct {
+		enabled bool
+		hits    int
+		kline   bool
+	}{
+		{false, 5, false},
+		{true, 1, false},
+		{true, 3, true},
+	}
+
+	for _, test := range tests {
+		cb := newSnapshotCatbox()
+		cb.Config.AutoKLineOnFlood = test.enabled
+		cb.Config.AutoKLineCount = 2
+		cb.Config.AutoKLineWindow = time.Minute
+		cb.Config.AutoKLineDuration = 10
+		cb.FloodHits = map[string][]int64{}
+
+		for i := 0; i < test.hits; i++ {
+			server, client := tcpPair(t)
+			defer func() {
+				_ = server.Close()
+				_ = client.Close()
+			}()
+
+			lu := NewLocalUser(NewLocalClient(cb, uint64(i), server))
+			lu.User = &User{
+				DisplayNick: fmt.Sprintf("flooder%d", i),
+				Username:    "user",
+				Hostname:    "192.168.0.1",
+				IP:          "192.168.0.1",
+				UID:         TS6UID(fmt.Sprintf("000AAAAA%d", i)),
+				Modes:       map[byte]struct{}{},
+				Channels:    map[string]*Channel{},
+				LocalUser:   lu,
+			}
+			cb.LocalUsers[lu.ID] = lu
+			cb.Users[lu.User.UID] = lu.User
+			cb.Nicks[canonicalizeNick(lu.User.DisplayNick)] = lu.User.UID
+
+			cb.floodKLine(lu)
+
+			if _, ok := cb.LocalUsers[lu.ID]; ok {
+				t.Errorf("floodKLine() did not disconnect the user")
+			}
+		}
+
+		if !test.kline {
+			if len(cb.KLines) != 0 {
+				t.Errorf("floodKLine() added K-Lines %+v", cb.KLines)
+			}
+			continue
+		}
+
+		if len(cb.KLines) != 1 {
+			t.Fatalf("floodKLine() added %d K-Lines, wanted 1", len(cb.KLines))
+		}
+
+		kline := cb.KLines[0]
+		if kline.UserMask != "*" || kline.HostMask != "192.168.0.1" {
+			t.Errorf("K-Line is for %s@%s, wanted *@192.168.0.1", kline.UserMask,
+				kline.HostMask)
+		}
+
+		duration := time.Until(kline.Expires)
+		if duration <= 9*time.Minute || duration > 10*time.Minute {
+			t.Errorf("K-Line expires in %s, wanted 10 minutes", duration)
+		}
+
+		if _, ok := cb.FloodHits["192.168.0.1"]; ok {
+			t.Errorf("flood hits were not reset after the K-Line")
+		}
+	}
+}
+
+func TestCreateWHOISResponseCertFP(t *testing.T) {
+	tests := []struct {
+		certFP string
+		output bool
+	}{
+		{"abcd", true},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		cb := &Catbox{Config: &Config{ServerName: "irc.example.com"},
+			Logger: newTestLogger()}
+
+		lu := &LocalUser{LocalClient: &LocalClient{}, CertFP: test.certFP}
+		user := &User{DisplayNick: "alice", Modes: map[byte]struct{}{},
+			LocalUser: lu}
+		lu.User = user
+
+		replyUser := &User{DisplayNick: "bob"}
+
+		found := false
+		for _, m := range cb.createWHOISResponse(user, replyUser, false) {
+			if m.Command != "276" {
+				continue
+			}
+			found = true
+			want := "bob alice has client certificate fingerprint abcd"
+			if got := strings.Join(m.Params, " "); got != want {
+				t.Errorf("createWHOISResponse() sent 276 %s, wanted %s", got, want)
+			}
+		}
+
+		if found != test.output {
+			t.Errorf("createWHOISResponse() with fingerprint %q sent 276: %v, wanted %v",
+				test.certFP, found, test.output)
+		}
+	}
+}
+
+func TestCreateWHOISResponseChannels(t *testing.T) {
+	cb := &Catbox{Config: &Config{ServerName: "irc.example.com"},
+		Logger: newTestLogger()}
+
+	alice := &User{DisplayNick: "alice", UID: "000AAAAAA",
+		Modes: map[byte]struct{}{}, Channels: map[string]*Channel{}}
+	bob := &User{DisplayNick: "bob", UID: "001AAAAAA",
+		Modes: map[byte]struct{}{}, Channels: map[string]*Channel{}}
+	oper := &User{DisplayNick: "oper", UID: "001AAAAAB",
+		Modes: map[byte]struct{}{'o': {}}, Channels: map[string]*Channel{}}
+
+	addChannel := func(name string, secret bool, members ...*User) *Channel {
+		channel := &Channel{Name: name, Members: map[TS6UID]struct{}{},
+			Ops: map[TS6UID]*User{}, Voices: map[TS6UID]*User{},
+			Modes: map[byte]struct{}{}}
+		if secret {
+			channel.Modes['s'] = struct{}{}
+		}
+		for _, member := range members {
+			channel.Members[member.UID] = struct{}{}
+			member.Channels[channel.Name] = channel
+		}
+		return channel
+	}
+
+	whoisChannels := func(replyUser *User) []string {
+		var got []string
+		for _, m := range cb.createWHOISResponse(alice, replyUser, false) {
+			if m.Command == "319" {
+				got = append(got, strings.Join(m.Params, " "))
+			}
+		}
+		return got
+	}
+
+	if got := whoisChannels(bob); len(got) != 0 {
+		t.Errorf("without channels got %q", got)
+	}
+
+	public := addChannel("#public", false, alice)
+	public.grantOps(alice)
+	if got := whoisChannels(bob); len(got) != 1 ||
+		got[0] != "bob alice @#public" {
+		t.Errorf("one channel got %q", got)
+	}
+
+	voiced := addChannel("#voiced", false, alice)
+	voiced.Voices[alice.UID] = alice
+	addChannel("#shared", true, alice, bob)
+	addChannel("#secret", true, alice)
+	addChannel("#private", false, alice).Modes['p'] = struct{}{}
+	addChannel("#both", true, alice).Modes['p'] = struct{}{}
+
+	// Bob sees the secret channel they share but not the other. The private
+	// channel shows as *. +s takes priority over +p.
+	if got := whoisChannels(bob); len(got) != 1 ||
+		got[0] != "bob alice #shared * +#voiced @#public" {
+		t.Errorf("bob got %q", got)
+	}
+
+	// Opers and alice see them all.
+	for _, replyUser := range []*User{oper, alice} {
+		want := replyUser.DisplayNick +
+			" alice #both #private #secret #shared +#voiced @#public"
+		if got := whoisChannels(replyUser); len(got) != 1 || got[0] != want {
+			t.Errorf("%s got %q, wanted %s", replyUser.DisplayNick, got, want)
+		}
+	}
+
+	// Lots of channels take several lines.
+	for i := 0; i < 50; i++ {
+		addChannel(fmt.Sprintf("#channel%02d", i), false, alice)
+	}
+	got := whoisChannels(bob)
+	if len(got) < 2 {
+		t.Fatalf("many channels got %d lines, wanted several", len(got))
+	}
+	count := 0
+	for _, line := range got {
+		m := irc.Message{Prefix: "irc.example.com", Command: "319",
+			Params: strings.SplitN(line, " ", 3)}
+		if _, err := m.Encode(); err != nil {
+			t.Errorf("319 does not encode: %s", err)
+		}
+		count += len(strings.Fields(m.Params[2]))
+	}
+	if count != 54 {
+		t.Errorf("listed %d channels, wanted 54", count)
+	}
+}
+
+// A local oper killing a local user. The user sees the KILL before ERROR.
+func TestIssueKillLocalUser(t *testing.T) {
+	cb := newSnapshotCatbox()
+	oper := addCallerIDTestUser(cb, 1, "oper")
+	oper.User.Modes['o'] = struct{}{}
+	cb.Opers[oper.User.UID] = oper.User
+	alice := addCallerIDTestUser(cb, 2, "alice")
+
+	cb.issueKill(oper.User, alice.User, "Go away")
+
+	wanted := []string{
+		"KILL alice oper (Go away)",
+		"QUIT Killed (oper (Go away))",
+		"ERROR Killed (oper (Go away))",
+	}
+	if got := drainCommands(alice); strings.Join(got, "\n") !=
+		strings.Join(wanted, "\n") {
+		t.Errorf("killed user got %q, wanted %q", got, wanted)
+	}
+}
+
+// An invalid nick regex stops us from starting. main() exits with the error.
+func TestNewCatboxInvalidNickRegex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catbox-nick-regex-")
+	if err != nil {
+		t.Fatalf("error making temporary directory: %s", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	file := filepath.Join(dir, "catbox.conf")
+	if err := ioutil.WriteFile(file, []byte("nick-valid-regex = ^[a-z+$\n"),
+		0600); err != nil {
+		t.Fatalf("error writing config: %s", err)
+	}
+
+	_, err = newCatbox(file)
+	if err == nil ||
+		!strings.Contains(err.Error(), "nick valid regex is not valid") {
+		t.Errorf("newCatbox() = %v, wanted nick regex error", err)
+	}
+}
+
+func TestSupportedModes(t *testing.T) {
+	cb := newSnapshotCatbox()
+
+	if got := cb.supportedUserModes(); got != "Cgiow" {
+		t.Errorf("supportedUserModes() = %s, wanted Cgiow", got)
+	}
+	if got := cb.supportedChannelModes(); got != "Qbcehiklnopqsv" {
+		t.Errorf("supportedChannelModes() = %s, wanted Qbcehiklnopqsv", got)
+	}
+}
+
+func TestISupportTokens(t *testing.T) {
+	tests := []struct {
+		maxChannels  int
+		motdThrottle time.Duration
+		present      []string
+		absent       []string
+	}{
+		{0, 0, nil, []string{"MAXCHANNELS", "MOTDTHROTTLE", "MAXLIST"}},
+		{5, time.Minute, []string{"MAXCHANNELS=5", "MOTDTHROTTLE=60"},
+			[]string{"MAXLIST"}},
+	}
+
+	tokenRE := regexp.MustCompile(`^[A-Z0-9]+(=[\x21-\x7e]*)?$`)
+	numeric := map[string]struct{}{"MODES": {}, "NICKLEN": {}, "CHANNELLEN": {},
+		"TOPICLEN": {}, "KEYLEN": {}, "ACCEPT": {}, "WATCH": {}, "MAXCHANNELS": {},
+		"MOTDTHROTTLE": {}}
+
+	for _, test := range tests {
+		cb := newSnapshotCatbox()
+		cb.Config.MaxNickLength = 9
+		cb.Config.MaxAcceptList = 20
+		cb.Config.MaxWatchSize = 128
+		cb.Config.MOTDThrottle = test.motdThrottle
+
+		tokens := cb.isupportTokens(test.maxChannels)
+
+		values := map[string]string{}
+		for _, token := range tokens {
+			if !tokenRE.MatchString(token) {
+				t.Errorf("invalid token %q", token)
+				continue
+			}
+
+			pieces := strings.SplitN(token, "=", 2)
+			if _, exists := values[pieces[0]]; exists {
+				t.Errorf("duplicate token %s", pieces[0])
+			}
+			value := ""
+			if len(pieces) == 2 {
+				value = pieces[1]
+			}
+			values[pieces[0]] = value
+
+			if _, ok := numeric[pieces[0]]; ok {
+				if n, err := strconv.Atoi(value); err != nil || n <= 0 {
+					t.Errorf("token %s wants a positive number", token)
+				}
+			}
+		}
+
+		for _, token := range test.present {
+			pieces := strings.SplitN(token, "=", 2)
+			if values[pieces[0]] != pieces[1] {
+				t.Errorf("%s = %q, wanted %q", pieces[0], values[pieces[0]],
+					pieces[1])
+			}
+		}
+		for _, name := range test.absent {
+			if _, exists := values[name]; exists {
+				t.Errorf("sent %s, wanted it absent", name)
+			}
+		}
+
+		if values["NICKLEN"] != "9" || values["MODES"] != "4" ||
+			values["CHANTYPES"] != "#" || values["PREFIX"] != "(qohv)~@%+" {
+			t.Errorf("tokens are %q", tokens)
+		}
+
+		// Each channel mode we support is in exactly one of CHANMODES and
+		// PREFIX.
+		chanModes := strings.Split(values["CHANMODES"], ",")
+		if len(chanModes) != 4 {
+			t.Fatalf("CHANMODES %s has %d types, wanted 4", values["CHANMODES"],
+				len(chanModes))
+		}
+		seen := map[rune]int{'q': 1, 'o': 1, 'h': 1, 'v': 1}
+		for _, modes := range chanModes {
+			for _, mode := range modes {
+				seen[mode]++
+			}
+		}
+		for _, mode := range cb.supportedChannelModes() {
+			if seen[mode] != 1 {
+				t.Errorf("mode %c is in CHANMODES/PREFIX %d times", mode, seen[mode])
+			}
+			delete(seen, mode)
+		}
+		if len(seen) != 0 {
+			t.Errorf("CHANMODES/PREFIX have unsupported modes %v", seen)
+		}
+	}
+}
+
+func TestNoticeMonitoredChannels(t *testing.T) {
+	cb := newSnapshotCatbox()
+	oper := addCallerIDTestUser(cb, 1, "oper")
+	oper.User.Modes['o'] = struct{}{}
+	alice := addCallerIDTestUser(cb, 2, "alice")
+	carol := addCallerIDTestUser(cb, 3, "carol")
+	bob := &User{DisplayNick: "bob", UID: "001AAAAAA",
+		Channels: map[string]*Channel{}}
+	cb.Users[bob.UID] = bob
+
+	addChannel := func(name string, users ...*User) *Channel {
+		channel := &Channel{Name: name, Members: map[TS6UID]struct{}{},
+			Ops: map[TS6UID]*User{}, Voices: map[TS6UID]*User{},
+			Modes: map[byte]struct{}{}}
+		for _, u := range users {
+			channel.Members[u.UID] = struct{}{}
+			u.Channels[name] = channel
+		}
+		cb.Channels[name] = channel
+		return channel
+	}
+	addChannel("#opers", alice.User, bob)
+	addChannel("#opers-chat", carol.User)
+	addChannel("#other", oper.User, carol.User)
+
+	// Without a pattern, no channel hears about it.
+	cb.addAndApplyKLine(KLine{UserMask: "*", HostMask: "bad.example.com"},
+		"oper", "Bad")
+	if got := drainCommands(alice); len(got) != 0 {
+		t.Errorf("alice got %q without a pattern", got)
+	}
+
+	cb.Config.ChannelNoticePattern = "#OPERS"
+	cb.addAndApplyKLine(KLine{UserMask: "*", HostMask: "worse.example.com"},
+		"oper", "Worse")
+	wanted := "NOTICE #opers oper added K-Line for [*@worse.example.com] [Worse]"
+	if got := drainCommands(alice); len(got) != 1 || got[0] != wanted {
+		t.Errorf("alice got %q, wanted %s", got, wanted)
+	}
+	if got := drainCommands(carol); len(got) != 0 {
+		t.Errorf("carol got %q", got)
+	}
+
+	cb.Config.ChannelNoticePattern = "#opers*"
+	_ = drainCommands(oper)
+	oper.opmeCommand(irc.Message{Command: "OPME", Params: []string{"#other"}})
+	wanted = "NOTICE #opers oper used OPME in #other"
+	if got := drainCommands(alice); len(got) != 1 || got[0] != wanted {
+		t.Errorf("alice got %q, wanted %s", got, wanted)
+	}
+	wantedCarol := []string{
+		"MODE #other +o oper",
+		"NOTICE #opers-chat oper used OPME in #other",
+	}
+	if got := drainCommands(carol); strings.Join(got, "\n") !=
+		strings.Join(wantedCarol, "\n") {
+		t.Errorf("carol got %q, wanted %q", got, wantedCarol)
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/horgh/irc"
+)
+
+// MetadataKeyMaxLength is the longest a metadata key may be.
+const MetadataKeyMaxLength = 64
+
+// metadataCommand lets clients view and change metadata on users and channels.
+// The client must have negotiated the metadata capability.
+//
+// Parameters: <target> <subcommand> [params]
+//
+// The target is a nick, a channel, or * for the client itself. Subcommands:
+//
+// GET <key> [key...]: Show the values of the keys.
+//
+// LIST (or KEYS): Show every key and value.
+//
+// SET <key> [value]: Set the key. Without a value, remove it. Users may change
+// their own metadata. Channel operators may change their channel's.
+//
+// CLEAR: Remove every key.
+func (u *LocalUser) metadataCommand(m irc.Message) {
+	if !u.hasCap("metadata") {
+		// 421 ERR_UNKNOWNCOMMAND
+		u.messageFromServer("421", []string{m.Command, "Unknown command"})
+		return
+	}
+
+	if len(m.Params) < 2 {
+		// 461 ERR_NEEDMOREPARAMS
+		u.messageFromServer("461", []string{m.Command, "Not enough parameters"})
+		return
+	}
+
+	user, channel := u.metadataTarget(m.Params[0])
+	if user == nil && channel == nil {
+		// 765 ERR_TARGETINVALID
+		u.messageFromServer("765", []string{m.Params[0],
+			"invalid metadata target"})
+		return
+	}
+
+	target, metadata := metadataOf(user, channel)
+
+	subCommand := strings.ToUpper(m.Params[1])
+
+	switch subCommand {
+	case "GET":
+		if len(m.Params) < 3 {
+			// 461 ERR_NEEDMOREPARAMS
+			u.messageFromServer("461", []string{m.Command, "Not enough parameters"})
+			return
+		}
+
+		for _, key := range m.Params[2:] {
+			key = strings.ToLower(key)
+			if !isValidMetadataKey(key) {
+				// 767 ERR_KEYINVALID
+				u.messageFromServer("767", []string{key, "invalid metadata key"})
+				continue
+			}
+
+			value, exists := metadata[key]
+			if !exists {
+				// 766 ERR_NOMATCHINGKEY
+				u.messageFromServer("766", []string{target, key, "no matching key"})
+				continue
+			}
+
+			// 761 RPL_KEYVALUE
+			u.messageFromServer("761", []string{target, key, "*", value})
+		}
+
+		// 762 RPL_METADATAEND
+		u.messageFromServer("762", []string{"end of metadata"})
+	case "LIST", "KEYS":
+		for _, key := range sortedMetadataKeys(metadata) {
+			// 761 RPL_KEYVALUE
+			u.messageFromServer("761", []string{target, key, "*", metadata[key]})
+		}
+
+		// 762 RPL_METADATAEND
+		u.messageFromServer("762", []string{"end of metadata"})
+	case "SET":
+		if len(m.Params) < 3 {
+			// 461 ERR_NEEDMOREPARAMS
+			u.messageFromServer("461", []string{m.Command, "Not enough parameters"})
+			return
+		}
+
+		key := strings.ToLower(m.Params[2])
+		if !isValidMetadataKey(key) {
+			// 767 ERR_KEYINVALID
+			u.messageFromServer("767", []string{key, "invalid metadata key"})
+			return
+		}
+
+		if !u.mayChangeMetadata(user, channel) {
+			// 769 ERR_KEYNOPERMISSION
+			u.messageFromServer("769", []string{target, key, "permission denied"})
+			return
+		}
+
+		value := ""
+		if len(m.Params) > 3 {
+			value = m.Params[3]
+		}
+
+		if _, exists := metadata[key]; !exists && value != "" &&
+			len(metadata) >= u.Catbox.Config.MaxMetadataKeys {
+			// 764 ERR_METADATALIMIT
+			u.messageFromServer("764", []string{target, "metadata limit reached"})
+			return
+		}
+
+		u.changeMetadata(user, channel, key, value)
+
+		// 761 RPL_KEYVALUE
+		params := []string{target, key, "*"}
+		if value != "" {
+			params = append(params, value)
+		}
+		u.messageFromServer("761", params)
+
+		// 762 RPL_METADATAEND
+		u.messageFromServer("762", []string{"end of metadata"})
+	case "CLEAR":
+		if !u.mayChangeMetadata(user, channel) {
+			// 769 ERR_KEYNOPERMISSION
+			u.messageFromServer("769", []string{target, "*", "permission denied"})
+			return
+		}
+
+		for _, key := range sortedMetadataKeys(metadata) {
+			u.changeMetadata(user, channel, key, "")
+
+			// 761 RPL_KEYVALUE
+			u.messageFromServer("761", []string{target, key, "*"})
+		}
+
+		// 762 RPL_METADATAEND
+		u.messageFromServer("762", []string{"end of metadata"})
+	default:
+		u.messageFromServer("FAIL", []string{"METADATA", "INVALID_PARAMS",
+			m.Params[1], "Unknown subcommand"})
+	}
+}
+
+// metadataTarget finds the user or channel a METADATA command is for. * is
+// the user themself. Both are nil if there is no such target.
+func (u *LocalUser) metadataTarget(target string) (*User, *Channel) {
+	if target == "*" {
+		return u.User, nil
+	}
+
+	channelName := canonicalizeChannel(target)
+	if isValidChannel(channelName) {
+		channel, exists := u.Catbox.Channels[channelName]
+		if !exists {
+			return nil, nil
+		}
+		return nil, channel
+	}
+
+	user := u.Catbox.userByNick(target)
+	if user == nil {
+		return nil, nil
+	}
+	return user, nil
+}
+
+// mayChangeMetadata checks whether the user may change the metadata of the
+// user or channel. Users may change their own. Channel operators may change
+// their channel's. Opers may change anyone's.
+func (u *LocalUser) mayChangeMetadata(user *User, channel *Channel) bool {
+	if u.User.isOperator() {
+		return true
+	}
+
+	if user != nil {
+		return user == u.User
+	}
+
+	return channel.userHasOps(u.User)
+}
+
+// changeMetadata changes the metadata of a user or channel and tells other
+// servers. A blank value removes the key.
+func (u *LocalUser) changeMetadata(user *User, channel *Channel, key,
+	value string) {
+	u.Catbox.setMetadata(user, channel, key, value, u.User)
+
+	params := []string{"*", "METADATA"}
+	if user != nil {
+		params = append(params, string(user.UID))
+	} else {
+		params = append(params, channel.Name)
+	}
+	params = append(params, key)
+	if value != "" {
+		params = append(params, value)
+	}
+
+	for _, server := range u.Catbox.LocalServers {
+		server.maybeQueueMessage(irc.Message{
+			Prefix:  string(u.User.UID),
+			Command: "ENCAP",
+			Params:  params,
+		})
+	}
+}
+
+// METADATA comes only in ENCAP messages. Someone changed the metadata of a
+// user or channel.
+//
+// Parameters: <UID or channel> <key> [value]
+//
+// Without a value, the key is removed.
+func (s *LocalServer) metadataCommand(m irc.Message) {
+	if len(m.Params) < 2 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"METADATA", "Not enough parameters"})
+		return
+	}
+
+	key := strings.ToLower(m.Params[1])
+	if !isValidMetadataKey(key) {
+		s.Catbox.Logger.Warn("METADATA with invalid key %s", m.Params[1])
+		return
+	}
+
+	value := ""
+	if len(m.Params) > 2 {
+		value = m.Params[2]
+	}
+
+	if user, exists := s.Catbox.Users[TS6UID(m.Params[0])]; exists {
+		s.Catbox.setMetadata(user, nil, key, value, nil)
+		return
+	}
+
+	if channel, exists := s.Catbox.Channels[canonicalizeChannel(m.Params[0])]; exists {
+		s.Catbox.setMetadata(nil, channel, key, value, nil)
+		return
+	}
+
+	s.Catbox.Logger.Warn("METADATA for unknown target %s", m.Params[0])
+}
+
+// setMetadata changes the metadata of a user or channel. A blank value removes
+// the key.
+//
+// We tell local users who negotiated the metadata capability. For a user, we
+// tell the user and those sharing a channel with them. For a channel, we tell
+// its members. We don't tell the user who made the change, if any. They get a
+// reply instead.
+func (cb *Catbox) setMetadata(user *User, channel *Channel, key, value string,
+	changedBy *User) {
+	target := ""
+	if user != nil {
+		if user.Metadata == nil {
+			user.Metadata = make(map[string]string)
+		}
+		if value == "" {
+			delete(user.Metadata, key)
+		} else {
+			user.Metadata[key] = value
+		}
+		target = user.DisplayNick
+	} else {
+		if channel.Metadata == nil {
+			channel.Metadata = make(map[string]string)
+		}
+		if value == "" {
+			delete(channel.Metadata, key)
+		} else {
+			channel.Metadata[key] = value
+		}
+		target = channel.Name
+	}
+
+	tell := map[TS6UID]*User{}
+	if user != nil {
+		tell[user.UID] = user
+		for _, userChannel := range user.Channels {
+			for memberUID := range userChannel.Members {
+				tell[memberUID] = cb.Users[memberUID]
+			}
+		}
+	} else {
+		for memberUID := range channel.Members {
+			tell[memberUID] = cb.Users[memberUID]
+		}
+	}
+
+	params := []string{target, key, "*"}
+	if value != "" {
+		params = append(params, value)
+	}
+
+	for _, member := range tell {
+		if !member.isLocal() || member == changedBy ||
+			!member.LocalUser.hasCap("metadata") {
+			continue
+		}
+
+		member.LocalUser.maybeQueueMessage(irc.Message{
+			Prefix:  cb.Config.ServerName,
+			Command: "METADATA",
+			Params:  params,
+		})
+	}
+}
+
+// sendMetadataBurst tells a server the metadata of a user (by UID) or channel
+// during a burst. prefix is the server the change should come from.
+func (s *LocalServer) sendMetadataBurst(prefix, target string,
+	metadata map[string]string) {
+	for _, key := range sortedMetadataKeys(metadata) {
+		s.maybeQueueMessage(irc.Message{
+			Prefix:  prefix,
+			Command: "ENCAP",
+			Params:  []string{"*", "METADATA", target, key, metadata[key]},
+		})
+	}
+}
+
+// metadataOf returns the name and metadata of a user or channel.
+func metadataOf(user *User, channel *Channel) (string, map[string]string) {
+	if user != nil {
+		return user.DisplayNick, user.Metadata
+	}
+	return channel.Name, channel.Metadata
+}
+
+// sortedMetadataKeys returns the keys in the metadata in order.
+func sortedMetadataKeys(metadata map[string]string) []string {
+	keys := make([]string, 0, len(metadata))
+	for key := range metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// isValidMetadataKey checks a key is made up of lowercase letters, digits, and
+// any of _.:/- and is not too long.
+func isValidMetadataKey(key string) bool {
+	if key == "" || len(key) > MetadataKeyMaxLength {
+		return false
+	}
+
+	for _, c := range key {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			strings.ContainsRune("_.:/-", c) {
+			continue
+		}
+		return false
+	}
+
+	return true
+}
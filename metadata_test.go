@@ -0,0 +1,229 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/horgh/irc"
+)
+
+func TestMetadataCommand(t *testing.T) {
+	cb := newSnapshotCatbox()
+	cb.Config.MaxMetadataKeys = 2
+	link := addTraceTestLink(cb, 10, "irc2.example.com", "001")
+	alice := addCallerIDTestUser(cb, 1, "alice")
+	alice.Caps = map[string]struct{}{"metadata": {}}
+	bob := addCallerIDTestUser(cb, 2, "bob")
+	bob.Caps = map[string]struct{}{"metadata": {}}
+	carol := addCallerIDTestUser(cb, 3, "carol")
+	carol.Caps = map[string]struct{}{}
+
+	channel := &Channel{Name: "#test", Members: map[TS6UID]struct{}{
+		alice.User.UID: {}, bob.User.UID: {}, carol.User.UID: {}},
+		Ops: map[TS6UID]*User{alice.User.UID: alice.User}}
+	cb.Channels[channel.Name] = channel
+	for _, lu := range []*LocalUser{alice, bob, carol} {
+		lu.User.Channels[channel.Name] = channel
+	}
+
+	tests := []struct {
+		name   string
+		user   *LocalUser
+		params []string
+		output []string
+	}{
+		{
+			"without the capability",
+			carol,
+			[]string{"*", "LIST"},
+			[]string{"421 carol METADATA Unknown command"},
+		},
+		{
+			"set on self",
+			alice,
+			[]string{"*", "SET", "URL", "https://example.com"},
+			[]string{
+				"761 alice alice url * https://example.com",
+				"762 alice end of metadata",
+			},
+		},
+		{
+			"get",
+			bob,
+			[]string{"alice", "GET", "url", "missing", "bad key"},
+			[]string{
+				"761 bob alice url * https://example.com",
+				"766 bob alice missing no matching key",
+				"767 bob bad key invalid metadata key",
+				"762 bob end of metadata",
+			},
+		},
+		{
+			"set on someone else",
+			bob,
+			[]string{"alice", "SET", "url", "https://example.org"},
+			[]string{"769 bob alice url permission denied"},
+		},
+		{
+			"set on a channel as an operator",
+			alice,
+			[]string{"#Test", "SET", "homepage", "https://example.com"},
+			[]string{
+				"761 alice #test homepage * https://example.com",
+				"762 alice end of metadata",
+			},
+		},
+		{
+			"set on a channel without ops",
+			bob,
+			[]string{"#test", "SET", "homepage", "https://example.org"},
+			[]string{"769 bob #test homepage permission denied"},
+		},
+		{
+			"limit",
+			alice,
+			[]string{"*", "SET", "a", "1"},
+			[]string{
+				"761 alice alice a * 1",
+				"762 alice end of metadata",
+			},
+		},
+		{
+			"over the limit",
+			alice,
+			[]string{"*", "SET", "b", "2"},
+			[]string{"764 alice alice metadata limit reached"},
+		},
+		{
+			"keys",
+			alice,
+			[]string{"*", "KEYS"},
+			[]string{
+				"761 alice alice a * 1",
+				"761 alice alice url * https://example.com",
+				"762 alice end of metadata",
+			},
+		},
+		{
+			"remove",
+			alice,
+			[]string{"*", "SET", "a"},
+			[]string{
+				"761 alice alice a *",
+				"762 alice end of metadata",
+			},
+		},
+		{
+			"clear",
+			alice,
+			[]string{"*", "CLEAR"},
+			[]string{
+				"761 alice alice url *",
+				"762 alice end of metadata",
+			},
+		},
+		{
+			"list after clearing",
+			alice,
+			[]string{"*", "LIST"},
+			[]string{"762 alice end of metadata"},
+		},
+		{
+			"unknown target",
+			alice,
+			[]string{"nosuchnick", "LIST"},
+			[]string{"765 alice nosuchnick invalid metadata target"},
+		},
+		{
+			"unknown subcommand",
+			alice,
+			[]string{"*", "FOO"},
+			[]string{"FAIL METADATA INVALID_PARAMS FOO Unknown subcommand"},
+		},
+	}
+
+	for _, test := range tests {
+		for len(link.WriteChan) > 0 {
+			<-link.WriteChan
+		}
+		_ = drainCommands(bob)
+
+		test.user.metadataCommand(irc.Message{Command: "METADATA",
+			Params: test.params})
+		if got := drainCommands(test.user); strings.Join(got, "\n") !=
+			strings.Join(test.output, "\n") {
+			t.Errorf("%s: got %q, wanted %q", test.name, got, test.output)
+		}
+	}
+}
+
+func TestMetadataPropagation(t *testing.T) {
+	cb := newSnapshotCatbox()
+	cb.Config.MaxMetadataKeys = 20
+	link := addTraceTestLink(cb, 10, "irc2.example.com", "001")
+	alice := addCallerIDTestUser(cb, 1, "alice")
+	alice.Caps = map[string]struct{}{"metadata": {}}
+	bob := addCallerIDTestUser(cb, 2, "bob")
+	bob.Caps = map[string]struct{}{"metadata": {}}
+	carol := addCallerIDTestUser(cb, 3, "carol")
+	carol.Caps = map[string]struct{}{}
+	dave := addCallerIDTestUser(cb, 4, "dave")
+	dave.Caps = map[string]struct{}{"metadata": {}}
+
+	channel := &Channel{Name: "#test", Members: map[TS6UID]struct{}{
+		alice.User.UID: {}, bob.User.UID: {}, carol.User.UID: {}},
+		Ops: map[TS6UID]*User{}}
+	cb.Channels[channel.Name] = channel
+	for _, lu := range []*LocalUser{alice, bob, carol} {
+		lu.User.Channels[channel.Name] = channel
+	}
+
+	alice.metadataCommand(irc.Message{Command: "METADATA",
+		Params: []string{"*", "SET", "url", "https://example.com"}})
+	_ = drainCommands(alice)
+
+	if len(link.WriteChan) != 1 {
+		t.Fatalf("sent %d messages to server, wanted 1", len(link.WriteChan))
+	}
+	m := (<-link.WriteChan).Message
+	if m.Prefix != string(alice.User.UID) || m.Command != "ENCAP" ||
+		strings.Join(m.Params, " ") != "* METADATA "+string(alice.User.UID)+
+			" url https://example.com" {
+		t.Errorf("propagated %v", m)
+	}
+
+	// Those sharing a channel with the capability hear about it.
+	if got := drainCommands(bob); len(got) != 1 ||
+		got[0] != "METADATA alice url * https://example.com" {
+		t.Errorf("channel member got %q", got)
+	}
+	if got := drainCommands(carol); len(got) != 0 {
+		t.Errorf("channel member without the capability got %q", got)
+	}
+	if got := drainCommands(dave); len(got) != 0 {
+		t.Errorf("user not sharing a channel got %q", got)
+	}
+
+	// From another server.
+	link.encapCommand(irc.Message{Prefix: "001AAAAAA", Command: "ENCAP",
+		Params: []string{"*", "METADATA", "#test", "topic-url",
+			"https://example.org"}})
+	if channel.Metadata["topic-url"] != "https://example.org" {
+		t.Errorf("channel metadata is %q", channel.Metadata)
+	}
+	for _, lu := range []*LocalUser{alice, bob} {
+		if got := drainCommands(lu); len(got) != 1 ||
+			got[0] != "METADATA #test topic-url * https://example.org" {
+			t.Errorf("%s got %q", lu.User.DisplayNick, got)
+		}
+	}
+
+	link.encapCommand(irc.Message{Prefix: "001AAAAAA", Command: "ENCAP",
+		Params: []string{"*", "METADATA", string(alice.User.UID), "url"}})
+	if _, exists := alice.User.Metadata["url"]; exists {
+		t.Errorf("remote removal did not remove the key")
+	}
+	if got := drainCommands(alice); len(got) != 1 || got[0] != "METADATA alice url *" {
+		t.Errorf("user got %q", got)
+	}
+}
@@ -2,9 +2,12 @@ package main
 
 import (
 	"bufio"
+	"compress/flate"
 	"fmt"
-	"log"
+	"io"
 	"net"
+	"os"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
@@ -16,14 +19,50 @@ type Conn struct {
 	rw     *bufio.ReadWriter
 	ioWait time.Duration
 	IP     net.IP
+	logger Logger
+
+	// Link compression (ZIP). This is shared by copies of the Conn.
+	zip *zipState
+}
+
+// zipState holds the state of compressing a server link.
+//
+// Reading and writing happen in different goroutines. Only the reader touches
+// reader, and only the writer touches writer.
+type zipState struct {
+	// Set (atomically) if we offered ZIP. If so we accept ZIPSTART.
+	offered int32
+
+	// Once we see ZIPSTART we read through this.
+	reader *bufio.Reader
+
+	// Once we send ZIPSTART we write through this.
+	writer *flate.Writer
+
+	// Bytes we wrote before and after compressing them. Use atomics.
+	uncompressedBytes int64
+	compressedBytes   int64
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w     io.Writer
+	count *int64
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	atomic.AddInt64(c.count, int64(n))
+	return n, err
 }
 
 // NewConn initializes a Conn struct
-func NewConn(conn net.Conn, ioWait time.Duration) Conn {
+func NewConn(conn net.Conn, ioWait time.Duration, logger Logger) Conn {
 	tcpAddr, err := net.ResolveTCPAddr("tcp", conn.RemoteAddr().String())
 	// This shouldn't happen.
 	if err != nil {
-		log.Fatalf("Unable to resolve TCP address: %s", err)
+		logger.Error("Unable to resolve TCP address: %s", err)
+		os.Exit(1)
 	}
 
 	return Conn{
@@ -31,6 +70,8 @@ func NewConn(conn net.Conn, ioWait time.Duration) Conn {
 		rw:     bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)),
 		ioWait: ioWait,
 		IP:     tcpAddr.IP,
+		logger: logger,
+		zip:    &zipState{},
 	}
 }
 
@@ -49,10 +90,15 @@ func (c Conn) Read() (string, error) {
 	if err := c.conn.SetReadDeadline(time.Now().Add(c.ioWait)); err != nil {
 		// Do not treat this as fatal. There can be something available to read in
 		// the buffer which we want to see.
-		log.Printf("Error setting read deadline: %s", err)
+		c.logger.Warn("Error setting read deadline: %s", err)
+	}
+
+	reader := c.rw.Reader
+	if c.zip != nil && c.zip.reader != nil {
+		reader = c.zip.reader
 	}
 
-	line, err := c.rw.ReadString('\n')
+	line, err := reader.ReadString('\n')
 	if err != nil {
 		// There may be something read even with error.
 		return line, errors.Wrap(err, "error reading")
@@ -67,13 +113,31 @@ func (c Conn) Write(s string) error {
 		return fmt.Errorf("error setting write deadline: %s", err)
 	}
 
-	sz, err := c.rw.WriteString(s)
-	if err != nil {
-		return err
-	}
+	if c.zip != nil && c.zip.writer != nil {
+		sz, err := c.zip.writer.Write([]byte(s))
+		if err != nil {
+			return err
+		}
 
-	if sz != len(s) {
-		return fmt.Errorf("short write")
+		if sz != len(s) {
+			return fmt.Errorf("short write")
+		}
+
+		atomic.AddInt64(&c.zip.uncompressedBytes, int64(sz))
+
+		// Push out what we have so the other side can decompress it now.
+		if err := c.zip.writer.Flush(); err != nil {
+			return fmt.Errorf("compression flush error: %s", err)
+		}
+	} else {
+		sz, err := c.rw.WriteString(s)
+		if err != nil {
+			return err
+		}
+
+		if sz != len(s) {
+			return fmt.Errorf("short write")
+		}
 	}
 
 	if err := c.rw.Flush(); err != nil {
@@ -82,3 +146,57 @@ func (c Conn) Write(s string) error {
 
 	return nil
 }
+
+// offerZIP records that we offered to compress the link. After this we accept
+// ZIPSTART from the other side.
+func (c Conn) offerZIP() {
+	if c.zip == nil {
+		return
+	}
+	atomic.StoreInt32(&c.zip.offered, 1)
+}
+
+// zipOffered tells whether we offered to compress the link.
+func (c Conn) zipOffered() bool {
+	return c.zip != nil && atomic.LoadInt32(&c.zip.offered) == 1
+}
+
+// startDecompressing makes us decompress everything we read from now on. The
+// reader calls this after it reads ZIPSTART.
+//
+// We may have read compressed data into our buffer already. We decompress
+// what is in the buffer first.
+func (c Conn) startDecompressing() {
+	c.zip.reader = bufio.NewReader(flate.NewReader(c.rw.Reader))
+}
+
+// startCompressing makes us compress everything we write from now on. The
+// writer calls this after it writes ZIPSTART.
+func (c Conn) startCompressing() error {
+	// We flush after each write. At lower levels, flate compresses small
+	// writes poorly across flushes.
+	w, err := flate.NewWriter(countingWriter{w: c.rw.Writer,
+		count: &c.zip.compressedBytes}, flate.BestCompression)
+	if err != nil {
+		return fmt.Errorf("unable to create compressor: %s", err)
+	}
+	c.zip.writer = w
+	return nil
+}
+
+// compressionRatio tells how much we compressed what we wrote: The bytes
+// before compressing divided by the bytes after. It is 0 if we're not
+// compressing.
+func (c Conn) compressionRatio() float64 {
+	if c.zip == nil {
+		return 0
+	}
+
+	compressed := atomic.LoadInt64(&c.zip.compressedBytes)
+	if compressed == 0 {
+		return 0
+	}
+
+	return float64(atomic.LoadInt64(&c.zip.uncompressedBytes)) /
+		float64(compressed)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestConnZIP(t *testing.T) {
+	server, client := tcpPair(t)
+	defer func() {
+		_ = server.Close()
+		_ = client.Close()
+	}()
+
+	writer := NewConn(server, 5*time.Second, newTestLogger())
+	reader := NewConn(client, 5*time.Second, newTestLogger())
+
+	reader.offerZIP()
+	if !reader.zipOffered() {
+		t.Fatalf("offered ZIP but zipOffered() is false")
+	}
+
+	var lines []string
+	for i := 0; i < 50; i++ {
+		lines = append(lines, fmt.Sprintf(
+			":000AAAAAA PRIVMSG #test :this is a fairly repetitive line %d\r\n", i))
+	}
+
+	if err := writer.Write("SVINFO 6 6 0 1\r\nZIPSTART\r\n"); err != nil {
+		t.Fatalf("unable to write: %s", err)
+	}
+	if err := writer.startCompressing(); err != nil {
+		t.Fatalf("unable to start compressing: %s", err)
+	}
+	for _, line := range lines {
+		if err := writer.Write(line); err != nil {
+			t.Fatalf("unable to write: %s", err)
+		}
+	}
+
+	for _, want := range []string{"SVINFO 6 6 0 1\r\n", "ZIPSTART\r\n"} {
+		line, err := reader.Read()
+		if err != nil {
+			t.Fatalf("unable to read: %s", err)
+		}
+		if line != want {
+			t.Fatalf("read %q, wanted %q", line, want)
+		}
+	}
+
+	reader.startDecompressing()
+
+	for _, want := range lines {
+		line, err := reader.Read()
+		if err != nil {
+			t.Fatalf("unable to read: %s", err)
+		}
+		if line != want {
+			t.Fatalf("read %q, wanted %q", line, want)
+		}
+	}
+
+	if ratio := writer.compressionRatio(); ratio <= 1 {
+		t.Errorf("compression ratio is %.2f, wanted more than 1", ratio)
+	}
+
+	if ratio := reader.compressionRatio(); ratio != 0 {
+		t.Errorf("compression ratio of reader is %.2f, wanted 0", ratio)
+	}
+}
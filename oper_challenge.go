@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// OperChallenge is a CHALLENGE an oper has yet to answer.
+type OperChallenge struct {
+	// The oper name they're trying to become.
+	Name string
+
+	// The answer we expect. The SHA-256 hash of the nonce.
+	Answer []byte
+
+	// When we stop accepting an answer.
+	Expires time.Time
+}
+
+// OperChallengeTimeout is how long an oper has to answer a CHALLENGE.
+const OperChallengeTimeout = time.Minute
+
+// operChallengeLineLength is how many characters of the encrypted nonce we
+// send per 740 RPL_RSACHALLENGE2.
+const operChallengeLineLength = 60
+
+// challengeCommand lets opers authenticate with an RSA key instead of a
+// password.
+//
+// CHALLENGE <name> starts. We encrypt a random nonce with the oper's public
+// key and send it.
+//
+// CHALLENGE +<answer> finishes. The answer is the base64 encoded SHA-256 hash
+// of the nonce. Only someone with the private key can decrypt the nonce.
+func (u *LocalUser) challengeCommand(m irc.Message) {
+	if len(m.Params) < 1 || m.Params[0] == "" {
+		// 461 ERR_NEEDMOREPARAMS
+		u.messageFromServer("461", []string{"CHALLENGE", "Not enough parameters"})
+		return
+	}
+
+	if u.User.isOperator() {
+		// 381 RPL_YOUREOPER
+		u.messageFromServer("381", []string{"You are already an IRC operator"})
+		return
+	}
+
+	if strings.HasPrefix(m.Params[0], "+") {
+		u.answerOperChallenge(m.Params[0][1:])
+		return
+	}
+
+	name := m.Params[0]
+
+	keyFile, exists := u.Catbox.Config.OperRSAKeys[name]
+	if !exists {
+		// 491 ERR_NOOPERHOST
+		u.messageFromServer("491", []string{
+			"No appropriate operator blocks were found for your host"})
+		return
+	}
+
+	key, err := loadRSAPublicKey(keyFile)
+	if err != nil {
+		u.Catbox.Logger.Error("Unable to load RSA key for oper %s: %s", name, err)
+		u.serverNotice("Unable to issue a CHALLENGE")
+		return
+	}
+
+	nonce := make([]byte, ChallengeNonceLength)
+	if _, err := rand.Read(nonce); err != nil {
+		u.Catbox.Logger.Error("Unable to make CHALLENGE nonce: %s", err)
+		u.serverNotice("Unable to issue a CHALLENGE")
+		return
+	}
+
+	encrypted, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, key, nonce, nil)
+	if err != nil {
+		u.Catbox.Logger.Error("Unable to encrypt CHALLENGE nonce for oper %s: %s",
+			name, err)
+		u.serverNotice("Unable to issue a CHALLENGE")
+		return
+	}
+
+	answer := sha256.Sum256(nonce)
+
+	if u.Catbox.ChallengeNonces == nil {
+		u.Catbox.ChallengeNonces = make(map[TS6UID]*OperChallenge)
+	}
+	u.Catbox.ChallengeNonces[u.User.UID] = &OperChallenge{
+		Name:    name,
+		Answer:  answer[:],
+		Expires: time.Now().Add(OperChallengeTimeout),
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(encrypted)
+	for i := 0; i < len(encoded); i += operChallengeLineLength {
+		end := i + operChallengeLineLength
+		if end > len(encoded) {
+			end = len(encoded)
+		}
+
+		// 740 RPL_RSACHALLENGE2
+		u.messageFromServer("740", []string{encoded[i:end]})
+	}
+
+	// 741 RPL_ENDOFRSACHALLENGE2
+	u.messageFromServer("741", []string{"End of CHALLENGE"})
+}
+
+// answerOperChallenge checks the answer to the user's CHALLENGE. If it's right
+// they become an oper.
+//
+// They get one try.
+func (u *LocalUser) answerOperChallenge(answer string) {
+	challenge, exists := u.Catbox.ChallengeNonces[u.User.UID]
+	if !exists {
+		// 464 ERR_PASSWDMISMATCH
+		u.messageFromServer("464", []string{"No CHALLENGE in progress"})
+		return
+	}
+	delete(u.Catbox.ChallengeNonces, u.User.UID)
+
+	decoded, err := base64.StdEncoding.DecodeString(answer)
+	if err != nil || !time.Now().Before(challenge.Expires) ||
+		subtle.ConstantTimeCompare(decoded, challenge.Answer) != 1 {
+		// 464 ERR_PASSWDMISMATCH
+		u.messageFromServer("464", []string{"Password incorrect"})
+		u.Catbox.noticeLocalOpers(fmt.Sprintf(
+			"Failed CHALLENGE attempt as %s by %s", challenge.Name,
+			u.User.nickUhost()))
+		return
+	}
+
+	u.becomeOper()
+}
+
+// cleanOperChallenges forgets CHALLENGEs no one answered in time.
+func (cb *Catbox) cleanOperChallenges(now time.Time) {
+	for uid, challenge := range cb.ChallengeNonces {
+		if !now.Before(challenge.Expires) {
+			delete(cb.ChallengeNonces, uid)
+		}
+	}
+}
+
+// loadRSAPublicKey reads a PEM encoded RSA public key. It may be PKIX
+// ("PUBLIC KEY") or PKCS #1 ("RSA PUBLIC KEY").
+func loadRSAPublicKey(file string) (*rsa.PublicKey, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading key file: %s", err)
+	}
+
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", file)
+	}
+
+	if block.Type == "RSA PUBLIC KEY" {
+		key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing key: %s", err)
+		}
+		return key, nil
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing key: %s", err)
+	}
+
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("key in %s is not an RSA key", file)
+	}
+	return rsaKey, nil
+}
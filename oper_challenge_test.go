@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+func TestChallengeCommandOper(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catbox-challenge-")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("error generating key: %s", err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("error encoding key: %s", err)
+	}
+	keyFile := filepath.Join(dir, "oper.pem")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{
+		Type: "PUBLIC KEY", Bytes: pub}), 0600); err != nil {
+		t.Fatalf("error writing key: %s", err)
+	}
+
+	cb := newSnapshotCatbox()
+	cb.Config.OperRSAKeys = map[string]string{"oper": keyFile}
+	alice := addCallerIDTestUser(cb, 1, "alice")
+
+	// challenge starts a CHALLENGE and returns the nonce decrypted with the
+	// private key.
+	challenge := func(name string) []byte {
+		alice.challengeCommand(irc.Message{Command: "CHALLENGE",
+			Params: []string{name}})
+
+		encoded := ""
+		got := drainCommands(alice)
+		for i, line := range got {
+			if i == len(got)-1 {
+				if line != "741 alice End of CHALLENGE" {
+					t.Fatalf("CHALLENGE ended with %s", line)
+				}
+				break
+			}
+			fields := strings.Fields(line)
+			if len(fields) != 3 || fields[0] != "740" {
+				t.Fatalf("CHALLENGE got %s, wanted 740", line)
+			}
+			encoded += fields[2]
+		}
+
+		encrypted, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			t.Fatalf("error decoding CHALLENGE: %s", err)
+		}
+		nonce, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, key, encrypted,
+			nil)
+		if err != nil {
+			t.Fatalf("error decrypting CHALLENGE: %s", err)
+		}
+		return nonce
+	}
+
+	answer := func(nonce []byte) string {
+		hash := sha256.Sum256(nonce)
+		return "+" + base64.StdEncoding.EncodeToString(hash[:])
+	}
+
+	// An oper without a key.
+	alice.challengeCommand(irc.Message{Command: "CHALLENGE",
+		Params: []string{"nosuchoper"}})
+	if got := drainCommands(alice); len(got) != 1 ||
+		!strings.HasPrefix(got[0], "491 ") {
+		t.Errorf("unknown oper got %q", got)
+	}
+
+	// Answering without a CHALLENGE.
+	alice.challengeCommand(irc.Message{Command: "CHALLENGE",
+		Params: []string{"+abcd"}})
+	if got := drainCommands(alice); len(got) != 1 ||
+		got[0] != "464 alice No CHALLENGE in progress" {
+		t.Errorf("answer without CHALLENGE got %q", got)
+	}
+
+	// A wrong answer.
+	nonce := challenge("oper")
+	alice.challengeCommand(irc.Message{Command: "CHALLENGE",
+		Params: []string{answer(append(nonce, 'x'))}})
+	if got := drainCommands(alice); len(got) != 1 ||
+		got[0] != "464 alice Password incorrect" {
+		t.Errorf("wrong answer got %q", got)
+	}
+	if alice.User.isOperator() {
+		t.Fatalf("wrong answer made them an oper")
+	}
+
+	// The right answer after the CHALLENGE expires.
+	nonce = challenge("oper")
+	cb.ChallengeNonces[alice.User.UID].Expires = time.Now().Add(-time.Second)
+	alice.challengeCommand(irc.Message{Command: "CHALLENGE",
+		Params: []string{answer(nonce)}})
+	if got := drainCommands(alice); len(got) != 1 ||
+		got[0] != "464 alice Password incorrect" {
+		t.Errorf("expired answer got %q", got)
+	}
+
+	// A CHALLENGE is good for one answer.
+	nonce = challenge("oper")
+	alice.challengeCommand(irc.Message{Command: "CHALLENGE",
+		Params: []string{answer(append(nonce, 'x'))}})
+	alice.challengeCommand(irc.Message{Command: "CHALLENGE",
+		Params: []string{answer(nonce)}})
+	if alice.User.isOperator() {
+		t.Fatalf("answered a CHALLENGE twice")
+	}
+	_ = drainCommands(alice)
+
+	// The right answer.
+	nonce = challenge("oper")
+	alice.challengeCommand(irc.Message{Command: "CHALLENGE",
+		Params: []string{answer(nonce)}})
+	if !alice.User.isOperator() {
+		t.Errorf("right answer did not make them an oper")
+	}
+	if _, exists := cb.Opers[alice.User.UID]; !exists {
+		t.Errorf("oper was not recorded")
+	}
+	if len(cb.ChallengeNonces) != 0 {
+		t.Errorf("CHALLENGE was not forgotten")
+	}
+}
+
+func TestCleanOperChallenges(t *testing.T) {
+	cb := newSnapshotCatbox()
+	now := time.Now()
+	cb.ChallengeNonces = map[TS6UID]*OperChallenge{
+		"000AAAAAB": {Name: "oper", Expires: now.Add(time.Minute)},
+		"000AAAAAC": {Name: "oper", Expires: now},
+	}
+
+	cb.cleanOperChallenges(now)
+	if _, exists := cb.ChallengeNonces["000AAAAAB"]; !exists {
+		t.Errorf("forgot a CHALLENGE that has not expired")
+	}
+	if _, exists := cb.ChallengeNonces["000AAAAAC"]; exists {
+		t.Errorf("did not forget an expired CHALLENGE")
+	}
+}
+
+func TestLoadRSAPublicKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catbox-challenge-")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("error generating key: %s", err)
+	}
+	pkix, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("error encoding key: %s", err)
+	}
+
+	tests := []struct {
+		name    string
+		content []byte
+		ok      bool
+	}{
+		{"pkix", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY",
+			Bytes: pkix}), true},
+		{"pkcs1", pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY",
+			Bytes: x509.MarshalPKCS1PublicKey(&key.PublicKey)}), true},
+		{"not pem", []byte("hi"), false},
+		{"bad key", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY",
+			Bytes: []byte("hi")}), false},
+	}
+
+	for _, test := range tests {
+		file := filepath.Join(dir, test.name+".pem")
+		if err := ioutil.WriteFile(file, test.content, 0600); err != nil {
+			t.Fatalf("error writing key: %s", err)
+		}
+
+		got, err := loadRSAPublicKey(file)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("%s: loaded key", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if got.N.Cmp(key.PublicKey.N) != 0 {
+			t.Errorf("%s: loaded a different key", test.name)
+		}
+	}
+
+	if _, err := loadRSAPublicKey(filepath.Join(dir, "missing.pem")); err == nil {
+		t.Errorf("loaded a missing key")
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyV2Signature starts a PROXY protocol version 2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyV1MaxLength is the longest a PROXY protocol version 1 header may be,
+// including CRLF.
+const proxyV1MaxLength = 107
+
+// proxyConn is a connection that came through a proxy speaking the PROXY
+// protocol. Its remote address is that of the client rather than the proxy.
+type proxyConn struct {
+	net.Conn
+
+	// We read the header through this. It may hold data past the header so we
+	// must keep reading through it.
+	reader *bufio.Reader
+
+	remoteAddr net.Addr
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// RemoteAddr returns the client's address.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// acceptProxyConn reads the PROXY protocol header from a connection we just
+// accepted. We return a connection with the client's address as its remote
+// address.
+//
+// If the header is for a connection the proxy made itself (UNKNOWN or LOCAL),
+// we use the proxy's address.
+//
+// It is an error for the header to be missing, malformed, or to take longer
+// than timeout to arrive.
+func acceptProxyConn(conn net.Conn, timeout time.Duration) (net.Conn, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, fmt.Errorf("error setting read deadline: %s", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	addr, err := readProxyHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, fmt.Errorf("error clearing read deadline: %s", err)
+	}
+
+	remoteAddr := conn.RemoteAddr()
+	if addr != nil {
+		remoteAddr = addr
+	}
+
+	return &proxyConn{Conn: conn, reader: reader, remoteAddr: remoteAddr}, nil
+}
+
+// readProxyHeader reads a version 1 or 2 PROXY protocol header. It returns the
+// source address, or nil if the header does not give one.
+func readProxyHeader(r *bufio.Reader) (*net.TCPAddr, error) {
+	start, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, fmt.Errorf("error reading PROXY header: %s", err)
+	}
+
+	if bytes.Equal(start, proxyV2Signature) {
+		return readProxyV2Header(r)
+	}
+
+	if bytes.HasPrefix(start, []byte("PROXY ")) {
+		return readProxyV1Header(r)
+	}
+
+	return nil, fmt.Errorf("missing PROXY header")
+}
+
+// readProxyV1Header reads a human readable header. e.g.,
+//
+// PROXY TCP4 192.0.2.1 192.0.2.2 56324 6667\r\n
+func readProxyV1Header(r *bufio.Reader) (*net.TCPAddr, error) {
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("error reading PROXY header: %s", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= proxyV1MaxLength {
+			return nil, fmt.Errorf("PROXY header is too long")
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("PROXY header does not end with CRLF")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+
+	// The rest of an UNKNOWN header does not matter.
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("malformed PROXY header: %q", line)
+	}
+
+	if fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, fmt.Errorf("unknown PROXY protocol: %s", fields[1])
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil || net.ParseIP(fields[3]) == nil {
+		return nil, fmt.Errorf("invalid PROXY address: %q", line)
+	}
+	if (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("PROXY address does not match protocol: %q", line)
+	}
+
+	port, err := parseProxyPort(fields[4])
+	if err != nil {
+		return nil, err
+	}
+	if _, err := parseProxyPort(fields[5]); err != nil {
+		return nil, err
+	}
+
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// parseProxyPort parses a port from a version 1 header.
+func parseProxyPort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 0 || port > 65535 ||
+		(len(s) > 1 && s[0] == '0') {
+		return 0, fmt.Errorf("invalid PROXY port: %s", s)
+	}
+	return port, nil
+}
+
+// readProxyV2Header reads a binary header.
+func readProxyV2Header(r *bufio.Reader) (*net.TCPAddr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("error reading PROXY header: %s", err)
+	}
+
+	version := header[12] >> 4
+	command := header[12] & 0xf
+	family := header[13]
+	length := binary.BigEndian.Uint16(header[14:16])
+
+	if version != 2 {
+		return nil, fmt.Errorf("unknown PROXY version: %d", version)
+	}
+	if command > 1 {
+		return nil, fmt.Errorf("unknown PROXY command: %d", command)
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("error reading PROXY header: %s", err)
+	}
+
+	// LOCAL. The proxy connected on its own behalf.
+	if command == 0 {
+		return nil, nil
+	}
+
+	// We care only about TCP over IPv4 or IPv6. For anything else we use the
+	// proxy's address. Any TLVs after the addresses we ignore.
+	switch family {
+	case 0x11:
+		if len(body) < 12 {
+			return nil, fmt.Errorf("PROXY header is too short for TCP4")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(body[0:4]),
+			Port: int(binary.BigEndian.Uint16(body[8:10])),
+		}, nil
+	case 0x21:
+		if len(body) < 36 {
+			return nil, fmt.Errorf("PROXY header is too short for TCP6")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(body[0:16]),
+			Port: int(binary.BigEndian.Uint16(body[32:34])),
+		}, nil
+	default:
+		return nil, nil
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := func(command, family byte, body ...byte) string {
+		header := append([]byte{}, proxyV2Signature...)
+		header = append(header, 0x20|command, family, 0, byte(len(body)))
+		return string(append(header, body...))
+	}
+
+	tcp4Body := []byte{
+		192, 0, 2, 1, // Source.
+		192, 0, 2, 2, // Destination.
+		0xdc, 0x04, // Source port 56324.
+		0x1a, 0x0b, // Destination port 6667.
+	}
+
+	tcp6Body := make([]byte, 36)
+	copy(tcp6Body, net.ParseIP("2001:db8::1"))
+	copy(tcp6Body[16:], net.ParseIP("2001:db8::2"))
+	tcp6Body[32], tcp6Body[33] = 0x00, 0x50
+
+	tests := []struct {
+		name   string
+		header string
+		addr   string
+		ok     bool
+	}{
+		{"v1 TCP4", "PROXY TCP4 192.0.2.1 192.0.2.2 56324 6667\r\n",
+			"192.0.2.1:56324", true},
+		{"v1 TCP6", "PROXY TCP6 2001:db8::1 2001:db8::2 80 6667\r\n",
+			"[2001:db8::1]:80", true},
+		{"v1 UNKNOWN", "PROXY UNKNOWN\r\n", "", true},
+		{"v1 UNKNOWN with addresses",
+			"PROXY UNKNOWN 2001:db8::1 2001:db8::2 80 6667\r\n", "", true},
+		{"v2 TCP4", v2(1, 0x11, tcp4Body...), "192.0.2.1:56324", true},
+		{"v2 TCP6", v2(1, 0x21, tcp6Body...), "[2001:db8::1]:80", true},
+		{"v2 TCP4 with TLVs", v2(1, 0x11, append(tcp4Body, 0x04, 0, 1, 'x')...),
+			"192.0.2.1:56324", true},
+		{"v2 LOCAL", v2(0, 0x00), "", true},
+		{"v2 UNIX", v2(1, 0x31, make([]byte, 216)...), "", true},
+
+		{"missing", "NICK alice\r\nUSER a b c d\r\n", "", false},
+		{"v1 without CRLF", "PROXY TCP4 192.0.2.1 192.0.2.2 56324 6667\n", "",
+			false},
+		{"v1 too few fields", "PROXY TCP4 192.0.2.1 192.0.2.2 56324\r\n", "",
+			false},
+		{"v1 bad protocol", "PROXY UDP4 192.0.2.1 192.0.2.2 56324 6667\r\n", "",
+			false},
+		{"v1 bad address", "PROXY TCP4 192.0.2 192.0.2.2 56324 6667\r\n", "",
+			false},
+		{"v1 wrong family", "PROXY TCP4 2001:db8::1 192.0.2.2 56324 6667\r\n", "",
+			false},
+		{"v1 bad port", "PROXY TCP4 192.0.2.1 192.0.2.2 65536 6667\r\n", "",
+			false},
+		{"v1 too long", "PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n", "",
+			false},
+		{"v2 bad version", strings.Replace(v2(1, 0x11, tcp4Body...), "\x21",
+			"\x11", 1), "", false},
+		{"v2 bad command", v2(2, 0x11, tcp4Body...), "", false},
+		{"v2 short TCP4", v2(1, 0x11, tcp4Body[:8]...), "", false},
+		{"v2 truncated", v2(1, 0x11, make([]byte, 200)...)[:40], "", false},
+	}
+
+	for _, test := range tests {
+		r := bufio.NewReader(strings.NewReader(test.header + "NICK alice\r\n"))
+		addr, err := readProxyHeader(r)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("%s: accepted header", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+
+		got := ""
+		if addr != nil {
+			got = addr.String()
+		}
+		if got != test.addr {
+			t.Errorf("%s: address is %q, wanted %q", test.name, got, test.addr)
+		}
+
+		// What follows the header is still there.
+		rest, _ := ioutil.ReadAll(r)
+		if string(rest) != "NICK alice\r\n" {
+			t.Errorf("%s: left %q after the header", test.name, rest)
+		}
+	}
+}
+
+func TestAcceptProxyConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer func() {
+		_ = client.Close()
+		_ = server.Close()
+	}()
+
+	go func() {
+		_, _ = client.Write([]byte(
+			"PROXY TCP4 192.0.2.1 192.0.2.2 56324 6667\r\nNICK alice\r\n"))
+	}()
+
+	conn, err := acceptProxyConn(server, time.Second)
+	if err != nil {
+		t.Fatalf("acceptProxyConn: %s", err)
+	}
+
+	if got := conn.RemoteAddr().String(); got != "192.0.2.1:56324" {
+		t.Errorf("remote address is %s, wanted 192.0.2.1:56324", got)
+	}
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "NICK alice\r\n" {
+		t.Errorf("read %q, %v, wanted NICK alice", line, err)
+	}
+
+	// If the proxy says nothing, we give up.
+	client2, server2 := net.Pipe()
+	defer func() {
+		_ = client2.Close()
+		_ = server2.Close()
+	}()
+
+	if _, err := acceptProxyConn(server2, 10*time.Millisecond); err == nil {
+		t.Errorf("accepted a connection without a header")
+	}
+}
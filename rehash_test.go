@@ -0,0 +1,635 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+func TestRehashTargets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catbox-rehash-")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %s", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	opersFile := filepath.Join(dir, "opers.conf")
+	if err := ioutil.WriteFile(opersFile, []byte("newoper = pass\n"),
+		0600); err != nil {
+		t.Fatalf("unable to write opers config: %s", err)
+	}
+
+	serversFile := filepath.Join(dir, "servers.conf")
+	if err := ioutil.WriteFile(serversFile,
+		[]byte("irc2.example.com = 127.0.0.1,6698,pass,0\n"), 0600); err != nil {
+		t.Fatalf("unable to write servers config: %s", err)
+	}
+
+	rulesFile := filepath.Join(dir, "rules.txt")
+	if err := ioutil.WriteFile(rulesFile, []byte("Be nice.\n"),
+		0600); err != nil {
+		t.Fatalf("unable to write rules: %s", err)
+	}
+
+	configFile := filepath.Join(dir, "catbox.conf")
+	if err := ioutil.WriteFile(configFile, []byte(fmt.Sprintf(`
+motd = new motd
+ping-time = 10s
+opers-config = %s
+servers-config = %s
+rules-file = %s
+`, opersFile, serversFile, rulesFile)), 0600); err != nil {
+		t.Fatalf("unable to write config: %s", err)
+	}
+
+	tests := []struct {
+		what    string
+		motd    bool
+		opers   bool
+		servers bool
+		other   bool
+	}{
+		{RehashMOTD, true, false, false, false},
+		{RehashOpers, false, true, false, false},
+		{RehashServers, false, false, true, false},
+		{RehashAll, true, true, true, true},
+	}
+
+	for _, test := range tests {
+		cb := &Catbox{
+			ConfigFile: configFile,
+			Config: &Config{
+				MOTD:     "old motd",
+				PingTime: 30 * time.Second,
+				Opers:    map[string]string{"oldoper": "pass"},
+				Servers:  map[string]*ServerDefinition{},
+			},
+			Logger: newTestLogger(),
+		}
+
+		cb.rehash(nil, test.what)
+
+		if (cb.Config.MOTD == "new motd") != test.motd {
+			t.Errorf("rehash(%s): MOTD is %s", test.what, cb.Config.MOTD)
+		}
+
+		// Rules reload along with the MOTD.
+		if (len(cb.Rules) == 1) != test.motd {
+			t.Errorf("rehash(%s): rules are %v", test.what, cb.Rules)
+		}
+
+		_, newOper := cb.Config.Opers["newoper"]
+		if newOper != test.opers {
+			t.Errorf("rehash(%s): opers are %v", test.what, cb.Config.Opers)
+		}
+
+		_, newServer := cb.Config.Servers["irc2.example.com"]
+		if newServer != test.servers {
+			t.Errorf("rehash(%s): servers are %v", test.what, cb.Config.Servers)
+		}
+
+		if (cb.Config.PingTime == 10*time.Second) != test.other {
+			t.Errorf("rehash(%s): ping time is %s", test.what, cb.Config.PingTime)
+		}
+	}
+}
+
+// Other goroutines read the config while we rehash. They must see either the
+// old config or the new one, never a mix.
+func TestRehashSwapsConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catbox-rehash-")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %s", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	var files []string
+	for i := 1; i <= 2; i++ {
+		file := filepath.Join(dir, fmt.Sprintf("catbox%d.conf", i))
+		if err := ioutil.WriteFile(file, []byte(fmt.Sprintf(`
+motd = motd %d
+ping-time = %ds
+dead-time = %ds
+admin-email = admin%d@example.com
+`, i, i*10, i*100, i)), 0600); err != nil {
+			t.Fatalf("unable to write config: %s", err)
+		}
+		files = append(files, file)
+	}
+
+	cb := &Catbox{
+		ConfigFile: files[0],
+		Config: &Config{
+			MOTD:       "motd 1",
+			PingTime:   10 * time.Second,
+			DeadTime:   100 * time.Second,
+			AdminEmail: "admin1@example.com",
+		},
+		Logger: newTestLogger(),
+	}
+
+	// Each config's fields all come from the same file.
+	consistent := func(cfg *Config) bool {
+		for i := 1; i <= 2; i++ {
+			if cfg.MOTD == fmt.Sprintf("motd %d", i) &&
+				cfg.PingTime == time.Duration(i*10)*time.Second &&
+				cfg.DeadTime == time.Duration(i*100)*time.Second &&
+				cfg.AdminEmail == fmt.Sprintf("admin%d@example.com", i) {
+				return true
+			}
+		}
+		return false
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var bad []*Config
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				cfg := cb.config()
+				if !consistent(cfg) {
+					mu.Lock()
+					bad = append(bad, cfg)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 200; i++ {
+		old := cb.Config
+		oldCopy := *old
+
+		cb.ConfigFile = files[(i+1)%2]
+		cb.rehash(nil, RehashAll)
+
+		if cb.Config == old {
+			t.Errorf("rehash changed the config in place")
+		}
+		if old.MOTD != oldCopy.MOTD || old.PingTime != oldCopy.PingTime ||
+			old.DeadTime != oldCopy.DeadTime ||
+			old.AdminEmail != oldCopy.AdminEmail {
+			t.Errorf("rehash modified the old config")
+		}
+	}
+
+	close(done)
+	wg.Wait()
+
+	for _, cfg := range bad {
+		t.Errorf("read an inconsistent config: %+v", cfg)
+	}
+
+	if cb.Config.MOTD != "motd 1" {
+		t.Errorf("MOTD is %s, wanted motd 1", cb.Config.MOTD)
+	}
+}
+
+func TestPropagateRehashMessages(t *testing.T) {
+	oper := &User{DisplayNick: "oper", UID: TS6UID("000AAAAAA")}
+
+	servers := map[uint64]*LocalServer{
+		1: {LocalClient: &LocalClient{ID: 1}, Server: &Server{Name: "a"}},
+		2: {LocalClient: &LocalClient{ID: 2}, Server: &Server{Name: "b"}},
+	}
+
+	tests := []struct {
+		propagate bool
+		messages  int
+	}{
+		{true, 2},
+		{false, 0},
+	}
+
+	for _, test := range tests {
+		cb := &Catbox{
+			Config:       &Config{PropagateRehash: test.propagate},
+			LocalServers: servers,
+		}
+
+		msgs := cb.propagateRehashMessages(oper, RehashMOTD)
+		if len(msgs) != test.messages {
+			t.Errorf("propagateRehashMessages() with propagate %v = %d messages, wanted %d",
+				test.propagate, len(msgs), test.messages)
+			continue
+		}
+
+		targets := map[uint64]struct{}{}
+		for _, msg := range msgs {
+			targets[msg.Target.ID] = struct{}{}
+
+			want := "ENCAP * REHASH motd"
+			got := msg.Message.Command + " " + strings.Join(msg.Message.Params, " ")
+			if got != want || msg.Message.Prefix != string(oper.UID) {
+				t.Errorf("propagateRehashMessages() sent %s, wanted %s", got, want)
+			}
+		}
+
+		if len(targets) != test.messages {
+			t.Errorf("propagateRehashMessages() sent to %d servers, wanted %d",
+				len(targets), test.messages)
+		}
+	}
+}
+
+func TestRemoteRehashMessages(t *testing.T) {
+	oper := &User{DisplayNick: "oper", UID: TS6UID("000AAAAAA")}
+
+	// We're linked to irc2. irc3 is behind it.
+	irc2 := &LocalServer{LocalClient: &LocalClient{ID: 1}}
+	other := &LocalServer{LocalClient: &LocalClient{ID: 2}}
+	irc3 := &Server{Name: "irc3.example.com", ClosestServer: irc2}
+
+	cb := &Catbox{
+		Config: &Config{PropagateRehash: true},
+		LocalServers: map[uint64]*LocalServer{
+			1: irc2,
+			2: other,
+		},
+	}
+
+	msgs := cb.remoteRehashMessages(oper, irc3, RehashAll)
+	if len(msgs) != 1 {
+		t.Fatalf("remoteRehashMessages() = %d messages, wanted 1", len(msgs))
+	}
+
+	if msgs[0].Target != irc2.LocalClient {
+		t.Errorf("remoteRehashMessages() sent to %d, wanted %d", msgs[0].Target.ID,
+			irc2.ID)
+	}
+
+	want := "ENCAP irc3.example.com REHASH all"
+	got := msgs[0].Message.Command + " " + strings.Join(msgs[0].Message.Params, " ")
+	if got != want {
+		t.Errorf("remoteRehashMessages() sent %s, wanted %s", got, want)
+	}
+}
+
+func TestMaskRehashMessages(t *testing.T) {
+	oper := &User{DisplayNick: "oper", UID: TS6UID("000AAAAAA")}
+
+	cb := &Catbox{
+		Config: &Config{},
+		LocalServers: map[uint64]*LocalServer{
+			1: {LocalClient: &LocalClient{ID: 1}},
+			2: {LocalClient: &LocalClient{ID: 2}},
+		},
+	}
+
+	// Every server hears about it, whether we propagate rehashes or not.
+	msgs := cb.maskRehashMessages(oper, "*.example.com", RehashOpers)
+	if len(msgs) != 2 {
+		t.Fatalf("maskRehashMessages() = %d messages, wanted 2", len(msgs))
+	}
+
+	for _, msg := range msgs {
+		want := "ENCAP *.example.com REHASH opers"
+		got := msg.Message.Command + " " + strings.Join(msg.Message.Params, " ")
+		if got != want || msg.Message.Prefix != string(oper.UID) {
+			t.Errorf("maskRehashMessages() sent %s, wanted %s", got, want)
+		}
+	}
+}
+
+func TestServersMatching(t *testing.T) {
+	cb := &Catbox{
+		Config: &Config{ServerName: "irc1.example.com"},
+		Servers: map[TS6SID]*Server{
+			"001": {Name: "irc2.example.com"},
+			"002": {Name: "irc3.example.org"},
+		},
+	}
+
+	tests := []struct {
+		mask string
+		want string
+	}{
+		{"*", "irc1.example.com irc2.example.com irc3.example.org"},
+		{"*.example.com", "irc1.example.com irc2.example.com"},
+		{"irc?.example.org", "irc3.example.org"},
+		{"*.example.net", ""},
+	}
+
+	for _, test := range tests {
+		got := strings.Join(cb.serversMatching(test.mask), " ")
+		if got != test.want {
+			t.Errorf("serversMatching(%s) = %s, wanted %s", test.mask, got,
+				test.want)
+		}
+	}
+}
+
+// Servers act on ENCAP REHASH only if the mask matches them. They pass it on
+// only toward servers it matches.
+func TestEncapRehashMask(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catbox-rehash-")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %s", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	configFile := filepath.Join(dir, "catbox.conf")
+	if err := ioutil.WriteFile(configFile, []byte("motd = new motd\n"),
+		0600); err != nil {
+		t.Fatalf("unable to write config: %s", err)
+	}
+
+	tests := []struct {
+		mask      string
+		rehash    bool
+		propagate bool
+	}{
+		{"*", true, true},
+		{"irc2.example.com", true, false},
+		{"irc2.*", true, false},
+		{"*.example.org", false, false},
+		{"irc3.example.com", false, true},
+	}
+
+	for _, test := range tests {
+		cb := newTraceTestCatbox("irc2.example.com", "001")
+		cb.ConfigFile = configFile
+		cb.Config.MOTD = "old motd"
+		link21 := addTraceTestLink(cb, 1, "irc1.example.com", "000")
+		link23 := addTraceTestLink(cb, 2, "irc3.example.com", "002")
+
+		oper := &User{DisplayNick: "oper", UID: "000AAAAAA",
+			Modes: map[byte]struct{}{'o': {}}, ClosestServer: link21}
+		cb.Users[oper.UID] = oper
+
+		link21.encapCommand(irc.Message{Prefix: string(oper.UID),
+			Command: "ENCAP", Params: []string{test.mask, "REHASH", RehashMOTD}})
+
+		if (cb.Config.MOTD == "new motd") != test.rehash {
+			t.Errorf("ENCAP %s REHASH: MOTD is %s", test.mask, cb.Config.MOTD)
+		}
+
+		// It goes on toward irc3 if it matches but never back to irc1.
+		wantIRC3 := 0
+		if test.propagate {
+			wantIRC3 = 1
+		}
+		if len(link21.WriteChan) != 0 || len(link23.WriteChan) != wantIRC3 {
+			t.Errorf("ENCAP %s REHASH: propagated to irc1 %d, irc3 %d", test.mask,
+				len(link21.WriteChan), len(link23.WriteChan))
+		}
+	}
+}
+
+func TestRehashReloadsCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catbox-rehash-")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %s", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	certFile := filepath.Join(dir, "certificate.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writeCert := func(cert tls.Certificate) {
+		keyDER, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+		if err != nil {
+			t.Fatalf("unable to marshal key: %s", err)
+		}
+		if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{
+			Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600); err != nil {
+			t.Fatalf("unable to write certificate: %s", err)
+		}
+		if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{
+			Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+			t.Fatalf("unable to write key: %s", err)
+		}
+	}
+
+	configFile := filepath.Join(dir, "catbox.conf")
+	if err := ioutil.WriteFile(configFile, []byte(fmt.Sprintf(`
+certificate-file = %s
+key-file = %s
+`, certFile, keyFile)), 0600); err != nil {
+		t.Fatalf("unable to write config: %s", err)
+	}
+
+	cb := newSnapshotCatbox()
+	cb.ConfigFile = configFile
+	cb.Config.CertificateFile = certFile
+	cb.Config.KeyFile = keyFile
+	cb.Config.MaxNickLength = 9
+	cb.CertificateMutex = &sync.RWMutex{}
+	cb.TLSConfig = &tls.Config{GetCertificate: cb.getCertificate}
+	oper := addCallerIDTestUser(cb, 1, "oper")
+	oper.User.Modes['o'] = struct{}{}
+	cb.Opers[oper.User.UID] = oper.User
+
+	// servedCert connects and returns the certificate the server presents.
+	servedCert := func() []byte {
+		server, client := tcpPair(t)
+		defer func() {
+			_ = server.Close()
+			_ = client.Close()
+		}()
+
+		tlsServer := tls.Server(server, cb.TLSConfig)
+		go func() {
+			_ = tlsServer.Handshake()
+		}()
+
+		tlsClient := tls.Client(client, &tls.Config{InsecureSkipVerify: true})
+		if err := tlsClient.Handshake(); err != nil {
+			t.Fatalf("handshake failed: %s", err)
+		}
+		return tlsClient.ConnectionState().PeerCertificates[0].Raw
+	}
+
+	cert1 := makeTestCertificate(t)
+	writeCert(cert1)
+	if err := cb.loadCertificate(); err != nil {
+		t.Fatalf("unable to load certificate: %s", err)
+	}
+	if !bytes.Equal(servedCert(), cert1.Certificate[0]) {
+		t.Fatalf("served the wrong certificate")
+	}
+
+	cert2 := makeTestCertificate(t)
+	writeCert(cert2)
+	cb.rehash(nil, RehashAll)
+	if !bytes.Equal(servedCert(), cert2.Certificate[0]) {
+		t.Errorf("served the old certificate after rehashing")
+	}
+	if got := drainCommands(oper); len(got) != 2 || got[0] !=
+		"NOTICE oper *** Notice --- Reloaded certificate/key." {
+		t.Errorf("oper got %q", got)
+	}
+
+	// If the new files are bad, we keep serving the certificate we have.
+	if err := ioutil.WriteFile(keyFile, []byte("junk"), 0600); err != nil {
+		t.Fatalf("unable to write key: %s", err)
+	}
+	cb.rehash(nil, RehashAll)
+	if !bytes.Equal(servedCert(), cert2.Certificate[0]) {
+		t.Errorf("did not keep the certificate after a bad rehash")
+	}
+	if got := drainCommands(oper); len(got) != 2 || !strings.HasPrefix(got[0],
+		"NOTICE oper *** Notice --- Error loading certificate/key: ") {
+		t.Errorf("oper got %q", got)
+	}
+}
+
+func TestRehashWelcome(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catbox-rehash-")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %s", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	welcomeFile := filepath.Join(dir, "welcome.txt")
+	if err := ioutil.WriteFile(welcomeFile, []byte("From the file.\n"),
+		0600); err != nil {
+		t.Fatalf("unable to write welcome: %s", err)
+	}
+
+	configFile := filepath.Join(dir, "catbox.conf")
+	writeConfig := func(config string) {
+		if err := ioutil.WriteFile(configFile, []byte(config), 0600); err != nil {
+			t.Fatalf("unable to write config: %s", err)
+		}
+	}
+
+	cb := &Catbox{
+		ConfigFile: configFile,
+		Config:     &Config{},
+		Welcome:    []string{"Old welcome."},
+		Logger:     newTestLogger(),
+	}
+
+	writeConfig("welcome-lines = Hi {nick}. | | Welcome to {server}.\n")
+	cb.rehash(nil, RehashAll)
+	if got := strings.Join(cb.Welcome, "|"); got !=
+		"Hi {nick}.|Welcome to {server}." {
+		t.Errorf("welcome after rehash = %s", got)
+	}
+
+	writeConfig(fmt.Sprintf("welcome-lines = Hi.\nwelcome-file = %s\n",
+		welcomeFile))
+	cb.rehash(nil, RehashAll)
+	if got := strings.Join(cb.Welcome, "|"); got != "From the file." {
+		t.Errorf("welcome after rehash = %s, wanted the file", got)
+	}
+	if cb.Config.WelcomeFile != welcomeFile {
+		t.Errorf("welcome file = %s", cb.Config.WelcomeFile)
+	}
+
+	writeConfig("")
+	cb.rehash(nil, RehashAll)
+	if len(cb.Welcome) != 0 {
+		t.Errorf("welcome after rehash = %q, wanted none", cb.Welcome)
+	}
+}
+
+func TestRehashMaxNickLength(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catbox-rehash-")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %s", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	configFile := filepath.Join(dir, "catbox.conf")
+	setMaxNickLength := func(n int) {
+		if err := ioutil.WriteFile(configFile,
+			[]byte(fmt.Sprintf("max-nick-length = %d\n", n)), 0600); err != nil {
+			t.Fatalf("unable to write config: %s", err)
+		}
+	}
+
+	cb := newSnapshotCatbox()
+	cb.ConfigFile = configFile
+	cb.Config.MaxNickLength = 12
+	link := addTraceTestLink(cb, 10, "irc2.example.com", "001")
+	oper := addCallerIDTestUser(cb, 1, "oper")
+	oper.User.Modes['o'] = struct{}{}
+	cb.Opers[oper.User.UID] = oper.User
+	alice := addCallerIDTestUser(cb, 2, "alexandria1")
+	bob := addCallerIDTestUser(cb, 3, "christophe1")
+	_ = addCallerIDTestUser(cb, 4, "christoph")
+
+	// Growing changes no nicks.
+	setMaxNickLength(15)
+	cb.rehash(nil, RehashAll)
+	if got := drainCommands(oper); len(got) != 2 || got[0] !=
+		"NOTICE oper *** Notice --- Rehash: Max nick length changed from 12 to 15" {
+		t.Errorf("oper got %q", got)
+	}
+	if len(drainCommands(alice)) != 0 || len(link.WriteChan) != 0 {
+		t.Errorf("changed nicks when the max nick length grew")
+	}
+
+	setMaxNickLength(9)
+	cb.rehash(nil, RehashAll)
+
+	if alice.User.DisplayNick != "alexandri" {
+		t.Errorf("nick is %s, wanted alexandri", alice.User.DisplayNick)
+	}
+	if got := drainCommands(alice); len(got) != 1 || got[0] != "NICK alexandri" {
+		t.Errorf("user got %q, wanted their NICK", got)
+	}
+	if len(link.WriteChan) != 1 {
+		t.Fatalf("sent %d messages to server, wanted 1", len(link.WriteChan))
+	}
+	if m := (<-link.WriteChan).Message; m.Prefix != string(alice.User.UID) ||
+		m.Command != "NICK" || m.Params[0] != "alexandri" {
+		t.Errorf("propagated %s", m)
+	}
+
+	// Their truncated nick is taken, so we leave them be.
+	if bob.User.DisplayNick != "christophe1" {
+		t.Errorf("nick is %s, wanted christophe1", bob.User.DisplayNick)
+	}
+	got := drainCommands(oper)
+	if len(got) != 3 ||
+		got[0] != "NOTICE oper *** Notice --- Rehash: Max nick length changed from 15 to 9" ||
+		got[1] != "NOTICE oper *** Notice --- Rehash: Unable to truncate nick christophe1: christoph is in use" {
+		t.Errorf("oper got %q", got)
+	}
+
+	found := false
+	for _, token := range cb.isupportTokens(0) {
+		if token == "NICKLEN=9" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("ISUPPORT tokens %q lack NICKLEN=9", cb.isupportTokens(0))
+	}
+}
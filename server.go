@@ -1,6 +1,10 @@
 package main
 
-import "fmt"
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
 
 // Server holds information about a linked server. Local and remote.
 type Server struct {
@@ -45,17 +49,23 @@ func (s *Server) isLocal() bool {
 	return s.LocalServer != nil
 }
 
-// Turn our capabilities into a single space separated string.
+// nextHop is the local server we send messages through to reach the server.
+func (s *Server) nextHop() *LocalServer {
+	if s.isLocal() {
+		return s.LocalServer
+	}
+	return s.ClosestServer
+}
+
+// Turn our capabilities into a single space separated string. We sort them so
+// the string is the same each time.
 func (s *Server) capabsString() string {
-	str := ""
+	capabs := make([]string, 0, len(s.Capabs))
 	for capab := range s.Capabs {
-		if len(str) > 0 {
-			str += " " + capab
-		} else {
-			str += capab
-		}
+		capabs = append(capabs, capab)
 	}
-	return str
+	sort.Strings(capabs)
+	return strings.Join(capabs, " ")
 }
 
 // Check if the server supports a given capability.
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// ServiceHandler handles a PRIVMSG sent to a service. text is the message.
+type ServiceHandler func(from *User, text string)
+
+// NewServiceUser creates a service user. This is a user on our server with no
+// connection. We handle messages to it ourself with the handler given to
+// RegisterService.
+//
+// We tell linked servers about it like any other user.
+func NewServiceUser(cb *Catbox, nick, user, host, realname string) (*User,
+	error) {
+	if !isValidNick(cb.Config.MaxNickLength, cb.NickValidator, nick) {
+		return nil, fmt.Errorf("invalid nick: %s", nick)
+	}
+	if !isValidUser(user) {
+		return nil, fmt.Errorf("invalid user: %s", user)
+	}
+	if !isValidHostname(host) {
+		return nil, fmt.Errorf("invalid hostname: %s", host)
+	}
+	if !isValidRealName(realname) {
+		return nil, fmt.Errorf("invalid real name: %s", realname)
+	}
+
+	if _, exists := cb.Nicks[canonicalizeNick(nick)]; exists {
+		return nil, fmt.Errorf("nick is in use: %s", nick)
+	}
+
+	ts6id, err := makeTS6ID(cb.getClientID())
+	if err != nil {
+		return nil, err
+	}
+
+	u := &User{
+		DisplayNick: nick,
+		NickTS:      time.Now().Unix(),
+		Modes:       make(map[byte]struct{}),
+		Username:    user,
+		Hostname:    host,
+		// Like spoofed users in TS6, we have no IP.
+		IP:        "0",
+		UID:       TS6UID(string(cb.Config.TS6SID) + string(ts6id)),
+		RealName:  realname,
+		Channels:  make(map[string]*Channel),
+		IsService: true,
+	}
+
+	cb.Users[u.UID] = u
+	cb.Nicks[canonicalizeNick(u.DisplayNick)] = u.UID
+
+	for _, server := range cb.LocalServers {
+		server.maybeQueueMessage(irc.Message{
+			Prefix:  string(cb.Config.TS6SID),
+			Command: "UID",
+			Params: []string{
+				u.DisplayNick,
+				"1",
+				fmt.Sprintf("%d", u.NickTS),
+				u.modesString(),
+				u.Username,
+				u.Hostname,
+				u.IP,
+				string(u.UID),
+				u.RealName,
+			},
+		})
+	}
+
+	return u, nil
+}
+
+// RegisterService sets the function that handles messages to the service
+// with the given nick.
+func (cb *Catbox) RegisterService(nick string, handler ServiceHandler) error {
+	uid, exists := cb.Nicks[canonicalizeNick(nick)]
+	if !exists || !cb.Users[uid].IsService {
+		return fmt.Errorf("no such service: %s", nick)
+	}
+
+	cb.ServiceHandlers[uid] = handler
+	return nil
+}
+
+// serviceCommand passes a PRIVMSG for a service to its handler. The target
+// may be the service's nick or UID.
+//
+// We ignore anything else, such as NOTICE. Services must not reply to those.
+func (cb *Catbox) serviceCommand(from *User, m irc.Message) {
+	if m.Command != "PRIVMSG" || len(m.Params) < 2 {
+		return
+	}
+
+	target := m.Params[0]
+	if !isValidUID(target) {
+		uid, exists := cb.Nicks[canonicalizeNick(target)]
+		if !exists {
+			return
+		}
+		target = string(uid)
+	}
+
+	handler, exists := cb.ServiceHandlers[TS6UID(target)]
+	if !exists {
+		return
+	}
+
+	handler(from, m.Params[1])
+}
+
+// serviceNotice sends a NOTICE from a service to a user, local or remote.
+func (cb *Catbox) serviceNotice(service, to *User, text string) {
+	if to.isLocal() {
+		to.LocalUser.maybeQueueMessage(irc.Message{
+			Prefix:  service.nickUhost(),
+			Command: "NOTICE",
+			Params:  []string{to.DisplayNick, text},
+		})
+		return
+	}
+
+	if to.IsService {
+		return
+	}
+
+	to.ClosestServer.maybeQueueMessage(irc.Message{
+		Prefix:  string(service.UID),
+		Command: "NOTICE",
+		Params:  []string{string(to.UID), text},
+	})
+}
+
+// SERVLIST lists services (RFC 2812 3.5.1).
+//
+// Parameters: [ <mask> [ <type> ] ]
+//
+// The mask matches service nicks. Our services have no type, so we say 0.
+func (u *LocalUser) servlistCommand(m irc.Message) {
+	mask := "*"
+	if len(m.Params) > 0 && m.Params[0] != "" {
+		mask = m.Params[0]
+	}
+	serviceType := "*"
+	if len(m.Params) > 1 && m.Params[1] != "" {
+		serviceType = m.Params[1]
+	}
+
+	if u.Catbox.Config.AllowSERVLIST && globMatch(serviceType, "0") {
+		var services []*User
+		for _, user := range u.Catbox.Users {
+			if user.IsService && globMatch(mask, user.DisplayNick) {
+				services = append(services, user)
+			}
+		}
+
+		sort.Slice(services, func(i, j int) bool {
+			return services[i].DisplayNick < services[j].DisplayNick
+		})
+
+		for _, service := range services {
+			// 234 RPL_SERVLIST
+			u.messageFromServer("234", []string{
+				service.DisplayNick,
+				u.Catbox.Config.ServerName,
+				"*",
+				"0",
+				fmt.Sprintf("%d", service.HopCount),
+				service.RealName,
+			})
+		}
+	}
+
+	// 235 RPL_SERVLISTEND
+	u.messageFromServer("235", []string{mask, serviceType,
+		"End of service listing"})
+}
+
+// serviceCount counts our service users.
+func (cb *Catbox) serviceCount() int {
+	count := 0
+	for _, user := range cb.Users {
+		if user.IsService {
+			count++
+		}
+	}
+	return count
+}
+
+// userCount counts users on the network, not including services.
+func (cb *Catbox) userCount() int {
+	return len(cb.Users) - cb.serviceCount()
+}
+
+// createNickServStub creates NickServ. It is an example of a service. It
+// can't do anything but tell you so.
+func (cb *Catbox) createNickServStub() error {
+	nickServ, err := NewServiceUser(cb, "NickServ", "NickServ",
+		cb.Config.ServerName, "Nickname Services")
+	if err != nil {
+		return err
+	}
+
+	return cb.RegisterService(nickServ.DisplayNick, func(from *User,
+		text string) {
+		fields := strings.Fields(text)
+		if len(fields) > 0 && strings.ToUpper(fields[0]) == "HELP" {
+			cb.serviceNotice(nickServ, from,
+				"NickServ is an example service. It does not register nicks.")
+			cb.serviceNotice(nickServ, from, "Commands: HELP")
+			return
+		}
+
+		cb.serviceNotice(nickServ, from, "Unknown command. Try HELP.")
+	})
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/horgh/irc"
+)
+
+func newServiceCatbox() *Catbox {
+	cb := newSnapshotCatbox()
+	cb.Config.MaxNickLength = 9
+	cb.ServiceHandlers = map[TS6UID]ServiceHandler{}
+	return cb
+}
+
+// addServiceTestUser adds a local user whose messages we can inspect.
+func addServiceTestUser(cb *Catbox, nick string) *LocalUser {
+	lu := &LocalUser{
+		LocalClient: &LocalClient{
+			Catbox:    cb,
+			ID:        100,
+			WriteChan: make(chan TaggedMessage, 100),
+		},
+	}
+	lu.User = &User{
+		DisplayNick: nick,
+		Username:    "user",
+		Hostname:    "host.example.com",
+		UID:         TS6UID("000AAAAZZ"),
+		Modes:       map[byte]struct{}{},
+		Channels:    map[string]*Channel{},
+		LocalUser:   lu,
+	}
+	cb.LocalUsers[lu.ID] = lu
+	cb.Users[lu.User.UID] = lu.User
+	cb.Nicks[canonicalizeNick(nick)] = lu.User.UID
+	return lu
+}
+
+func TestNewServiceUser(t *testing.T) {
+	cb := newServiceCatbox()
+
+	server := &LocalServer{LocalClient: &LocalClient{
+		WriteChan: make(chan TaggedMessage, 10)}}
+	cb.LocalServers[1] = server
+
+	u, err := NewServiceUser(cb, "ChanServ", "services", "services.example.com",
+		"Channel Services")
+	if err != nil {
+		t.Fatalf("NewServiceUser() = %s", err)
+	}
+
+	if !u.IsService || u.isLocal() {
+		t.Errorf("service user is not a service: %+v", u)
+	}
+	if !strings.HasPrefix(string(u.UID), "000") || !isValidUID(string(u.UID)) {
+		t.Errorf("service UID = %s, wanted a valid UID on our server", u.UID)
+	}
+	if cb.Users[u.UID] != u || cb.Nicks["chanserv"] != u.UID {
+		t.Errorf("service user is not in the user and nick maps")
+	}
+
+	// Linked servers hear about it.
+	if len(server.WriteChan) != 1 {
+		t.Fatalf("sent %d messages to linked server, wanted 1",
+			len(server.WriteChan))
+	}
+	if m := <-server.WriteChan; m.Command != "UID" || m.Params[0] != "ChanServ" ||
+		m.Params[7] != string(u.UID) {
+		t.Errorf("sent %s to linked server, wanted UID", m)
+	}
+
+	badTests := []struct {
+		nick, user, host string
+	}{
+		{"ChanServ", "services", "services.example.com"},
+		{"1bad", "services", "services.example.com"},
+		{"OperServ", "bad user", "services.example.com"},
+		{"OperServ", "services", "bad host!"},
+	}
+	for _, test := range badTests {
+		if _, err := NewServiceUser(cb, test.nick, test.user, test.host,
+			"Services"); err == nil {
+			t.Errorf("NewServiceUser(%s, %s, %s) succeeded, wanted error",
+				test.nick, test.user, test.host)
+		}
+	}
+}
+
+func TestServicePrivmsg(t *testing.T) {
+	cb := newServiceCatbox()
+
+	service, err := NewServiceUser(cb, "EchoServ", "services",
+		"services.example.com", "Echo")
+	if err != nil {
+		t.Fatalf("NewServiceUser() = %s", err)
+	}
+
+	var gotFrom *User
+	gotText := ""
+	if err := cb.RegisterService("echoserv", func(from *User, text string) {
+		gotFrom = from
+		gotText = text
+		cb.serviceNotice(service, from, "echo: "+text)
+	}); err != nil {
+		t.Fatalf("RegisterService() = %s", err)
+	}
+
+	if err := cb.RegisterService("NoSuchServ", nil); err == nil {
+		t.Errorf("RegisterService() for a missing service succeeded")
+	}
+
+	lu := addServiceTestUser(cb, "alice")
+	if err := cb.RegisterService("alice", nil); err == nil {
+		t.Errorf("RegisterService() for a regular user succeeded")
+	}
+
+	lu.privmsgCommand(irc.Message{Command: "PRIVMSG",
+		Params: []string{"EchoServ", "hello there"}})
+
+	if gotFrom != lu.User || gotText != "hello there" {
+		t.Errorf("handler got %v %q, wanted alice and hello there", gotFrom,
+			gotText)
+	}
+
+	m := <-lu.WriteChan
+	if m.Prefix != "EchoServ!services@services.example.com" ||
+		m.Command != "NOTICE" || m.Params[0] != "alice" ||
+		m.Params[1] != "echo: hello there" {
+		t.Errorf("service replied %s", m)
+	}
+
+	// Services ignore NOTICE.
+	gotText = ""
+	lu.privmsgCommand(irc.Message{Command: "NOTICE",
+		Params: []string{"EchoServ", "hi"}})
+	if gotText != "" {
+		t.Errorf("handler got NOTICE %q", gotText)
+	}
+}
+
+// Services have no server. Things that show or route by a user's server must
+// not trip over them.
+func TestServicesHaveNoServer(t *testing.T) {
+	cb := newServiceCatbox()
+	link := addTraceTestLink(cb, 10, "irc2.example.com", "001")
+	oper := addServiceTestUser(cb, "oper")
+	oper.User.Modes['o'] = struct{}{}
+
+	service, err := NewServiceUser(cb, "ChanServ", "services",
+		"services.example.com", "Channel Services")
+	if err != nil {
+		t.Fatalf("NewServiceUser() = %s", err)
+	}
+	for len(link.WriteChan) > 0 {
+		<-link.WriteChan
+	}
+
+	oper.whoCommand(irc.Message{Command: "WHO", Params: []string{"!*"}})
+	found := false
+	for _, got := range drainCommands(oper) {
+		if strings.HasPrefix(got, "352 oper * services services.example.com "+
+			"irc.example.com ChanServ ") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("WHO !* did not show ChanServ on our server")
+	}
+
+	// A numeric for a service goes nowhere.
+	link.numericCommand(irc.Message{Prefix: "001", Command: "401",
+		Params: []string{string(service.UID), "nobody", "No such nick/channel"}})
+	if len(link.WriteChan) != 0 {
+		t.Errorf("sent a numeric for a service to a server")
+	}
+}
+
+func TestLusersExcludesServices(t *testing.T) {
+	cb := newServiceCatbox()
+
+	if err := cb.createNickServStub(); err != nil {
+		t.Fatalf("createNickServStub() = %s", err)
+	}
+
+	lu := addServiceTestUser(cb, "alice")
+
+	lu.lusersCommand()
+
+	want := map[string]string{
+		"251": "There are 1 users and 1 services on 1 servers.",
+		"266": "Current global users 1, max 1",
+	}
+
+	for len(lu.WriteChan) > 0 {
+		m := <-lu.WriteChan
+		wanted, ok := want[m.Command]
+		if !ok {
+			continue
+		}
+		if got := m.Params[len(m.Params)-1]; got != wanted {
+			t.Errorf("lusers %s = %q, wanted %q", m.Command, got, wanted)
+		}
+		delete(want, m.Command)
+	}
+
+	if len(want) != 0 {
+		t.Errorf("lusers did not send %v", want)
+	}
+}
+
+func TestNickServStub(t *testing.T) {
+	cb := newServiceCatbox()
+
+	if err := cb.createNickServStub(); err != nil {
+		t.Fatalf("createNickServStub() = %s", err)
+	}
+
+	lu := addServiceTestUser(cb, "alice")
+
+	tests := []struct {
+		input  string
+		output []string
+	}{
+		{"help", []string{
+			"NickServ is an example service. It does not register nicks.",
+			"Commands: HELP",
+		}},
+		{"REGISTER pass", []string{"Unknown command. Try HELP."}},
+	}
+
+	for _, test := range tests {
+		lu.privmsgCommand(irc.Message{Command: "PRIVMSG",
+			Params: []string{"NickServ", test.input}})
+
+		if len(lu.WriteChan) != len(test.output) {
+			t.Errorf("NickServ %s: sent %d messages, wanted %d", test.input,
+				len(lu.WriteChan), len(test.output))
+			continue
+		}
+
+		for _, want := range test.output {
+			if m := <-lu.WriteChan; m.Params[1] != want {
+				t.Errorf("NickServ %s: sent %q, wanted %q", test.input, m.Params[1],
+					want)
+			}
+		}
+	}
+}
+
+func TestServlistCommand(t *testing.T) {
+	cb := newServiceCatbox()
+	cb.Config.AllowSERVLIST = true
+	alice := addServiceTestUser(cb, "alice")
+
+	// No services.
+	alice.servlistCommand(irc.Message{Command: "SERVLIST"})
+	if got := drainCommands(alice); len(got) != 1 ||
+		got[0] != "235 alice * * End of service listing" {
+		t.Errorf("without services got %q", got)
+	}
+
+	for _, nick := range []string{"NickServ", "ChanServ"} {
+		if _, err := NewServiceUser(cb, nick, "services", "services.example.com",
+			nick+" Services"); err != nil {
+			t.Fatalf("NewServiceUser() = %s", err)
+		}
+	}
+
+	tests := []struct {
+		params []string
+		output []string
+	}{
+		{
+			nil,
+			[]string{
+				"234 alice ChanServ irc.example.com * 0 0 ChanServ Services",
+				"234 alice NickServ irc.example.com * 0 0 NickServ Services",
+				"235 alice * * End of service listing",
+			},
+		},
+		{
+			[]string{"nick*"},
+			[]string{
+				"234 alice NickServ irc.example.com * 0 0 NickServ Services",
+				"235 alice nick* * End of service listing",
+			},
+		},
+		{
+			[]string{"*", "0"},
+			[]string{
+				"234 alice ChanServ irc.example.com * 0 0 ChanServ Services",
+				"234 alice NickServ irc.example.com * 0 0 NickServ Services",
+				"235 alice * 0 End of service listing",
+			},
+		},
+		{
+			[]string{"*", "1"},
+			[]string{"235 alice * 1 End of service listing"},
+		},
+		// Users are not services.
+		{
+			[]string{"alice"},
+			[]string{"235 alice alice * End of service listing"},
+		},
+	}
+
+	for _, test := range tests {
+		alice.servlistCommand(irc.Message{Command: "SERVLIST",
+			Params: test.params})
+		if got := drainCommands(alice); strings.Join(got, "\n") !=
+			strings.Join(test.output, "\n") {
+			t.Errorf("SERVLIST %v got %q, wanted %q", test.params, got,
+				test.output)
+		}
+	}
+
+	// We can hide them.
+	cb.Config.AllowSERVLIST = false
+	alice.servlistCommand(irc.Message{Command: "SERVLIST"})
+	if got := drainCommands(alice); len(got) != 1 ||
+		got[0] != "235 alice * * End of service listing" {
+		t.Errorf("with SERVLIST disabled got %q", got)
+	}
+}
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Snapshot is what we carry across a hot restart.
+//
+// When we restart with a snapshot file configured, we keep the connections of
+// local users open and hand them to the new process. Their state comes along
+// in the snapshot so they stay registered and on their channels.
+//
+// We can't keep TLS connections as their TLS state lives in this process. We
+// don't keep server links either. The other side would not know we restarted.
+// Both disconnect as usual. Remote users come back when the links return and
+// burst.
+type Snapshot struct {
+	// Our process ID. exec keeps it. If it differs when we load the snapshot,
+	// the file descriptors in it are not ours.
+	PID int
+
+	NextClientID uint64
+
+	Users    []SnapshotUser
+	Channels []SnapshotChannel
+	KLines   []KLine
+
+	HighestLocalUserCount  int
+	HighestGlobalUserCount int
+	HighestConnectionCount int
+	ConnectionCount        int
+}
+
+// SnapshotUser is a local user we keep across a hot restart.
+type SnapshotUser struct {
+	// File descriptor of their connection. It stays open across exec.
+	FD uintptr
+
+	ID                  uint64
+	ConnectionStartTime time.Time
+	Caps                []string
+	Country             string
+
+	// The user config they matched when they registered, if any.
+	Config *UserConfig
+
+	DisplayNick string
+	NickTS      int64
+	Modes       string
+	Username    string
+	Hostname    string
+	IP          string
+	UID         TS6UID
+	RealName    string
+	AwayMessage string
+	FloodExempt bool
+	Class       string
+	AcceptList  []TS6UID
+	WatchList   []string
+	Account     string
+	Metadata    map[string]string
+}
+
+// SnapshotChannel is a channel we keep across a hot restart. We only keep
+// members that are local users we keep.
+type SnapshotChannel struct {
+	Name        string
+	TS          int64
+	Modes       string
+	Key         string
+	Limit       int
+	Topic       string
+	TopicSetter string
+	TopicTS     int64
+	Bans        []BanEntry
+	Exceptions  []BanEntry
+	Quiets      []BanEntry
+	Members     []TS6UID
+	Ops         []TS6UID
+	Voices      []TS6UID
+	HalfOps     []TS6UID
+	Owners      []TS6UID
+	Invites     []TS6UID
+	History     []HistoryEntry
+	Metadata    map[string]string
+}
+
+// saveSnapshot writes the snapshot file and readies the connections of the
+// users in it to survive exec.
+//
+// It returns the IDs of the users we keep. We must not tell them we're
+// shutting down. If we can't write the snapshot, we keep no one.
+func (cb *Catbox) saveSnapshot() map[uint64]struct{} {
+	fds := map[uint64]uintptr{}
+	for id, user := range cb.LocalUsers {
+		if user.isTLS() {
+			continue
+		}
+
+		f, err := inheritableFile(user.Conn.conn)
+		if err != nil {
+			cb.Logger.Warn("Unable to keep connection of %s: %s", user, err)
+			continue
+		}
+
+		cb.SnapshotFiles = append(cb.SnapshotFiles, f)
+		fds[id] = f.Fd()
+	}
+
+	if err := saveSnapshotFile(cb.Config.SnapshotFile,
+		cb.makeSnapshot(fds)); err != nil {
+		cb.Logger.Error("Unable to save snapshot: %s", err)
+		for _, f := range cb.SnapshotFiles {
+			_ = f.Close()
+		}
+		cb.SnapshotFiles = nil
+		return map[uint64]struct{}{}
+	}
+
+	cb.Logger.Info("Saved snapshot with %d users.", len(fds))
+
+	kept := map[uint64]struct{}{}
+	for id := range fds {
+		kept[id] = struct{}{}
+	}
+	return kept
+}
+
+// inheritableFile duplicates the connection's file descriptor and lets it
+// survive exec.
+//
+// The caller must hold on to the returned file until we exec. If it gets
+// garbage collected, the descriptor closes.
+func inheritableFile(conn net.Conn) (*os.File, error) {
+	if proxied, ok := conn.(*proxyConn); ok {
+		conn = proxied.Conn
+	}
+
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, fmt.Errorf("not a TCP connection")
+	}
+
+	f, err := tcpConn.File()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get file: %s", err)
+	}
+
+	// Go sets close-on-exec on every descriptor. Clear it.
+	if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, f.Fd(),
+		syscall.F_SETFD, 0); errno != 0 {
+		_ = f.Close()
+		return nil, fmt.Errorf("unable to clear close-on-exec: %s", errno)
+	}
+
+	return f, nil
+}
+
+// makeSnapshot builds a snapshot including the local users with the given
+// file descriptors. Client ID to descriptor.
+func (cb *Catbox) makeSnapshot(fds map[uint64]uintptr) *Snapshot {
+	s := &Snapshot{
+		PID:                    os.Getpid(),
+		NextClientID:           cb.NextClientID,
+		KLines:                 cb.KLines,
+		HighestLocalUserCount:  cb.HighestLocalUserCount,
+		HighestGlobalUserCount: cb.HighestGlobalUserCount,
+		HighestConnectionCount: cb.HighestConnectionCount,
+		ConnectionCount:        cb.ConnectionCount,
+	}
+
+	kept := map[TS6UID]struct{}{}
+
+	for id, fd := range fds {
+		lu := cb.LocalUsers[id]
+		u := lu.User
+
+		modes := ""
+		for mode := range u.Modes {
+			modes += string(mode)
+		}
+
+		caps := []string{}
+		for cap := range lu.Caps {
+			caps = append(caps, cap)
+		}
+
+		acceptList := []TS6UID{}
+		for uid := range u.AcceptList {
+			acceptList = append(acceptList, uid)
+		}
+
+		watchList := []string{}
+		for nick := range u.WatchList {
+			watchList = append(watchList, nick)
+		}
+
+		s.Users = append(s.Users, SnapshotUser{
+			FD:                  fd,
+			ID:                  id,
+			ConnectionStartTime: lu.ConnectionStartTime,
+			Caps:                caps,
+			Country:             lu.Country,
+			Config:              lu.Config,
+			DisplayNick:         u.DisplayNick,
+			NickTS:              u.NickTS,
+			Modes:               modes,
+			Username:            u.Username,
+			Hostname:            u.Hostname,
+			IP:                  u.IP,
+			UID:                 u.UID,
+			RealName:            u.RealName,
+			AwayMessage:         u.AwayMessage,
+			FloodExempt:         u.FloodExempt,
+			Class:               u.Class,
+			AcceptList:          acceptList,
+			WatchList:           watchList,
+			Account:             u.Account,
+			Metadata:            u.Metadata,
+		})
+
+		kept[u.UID] = struct{}{}
+	}
+
+	for _, channel := range cb.Channels {
+		sc := SnapshotChannel{
+			Name:        channel.Name,
+			TS:          channel.TS,
+			Key:         channel.Key,
+			Limit:       channel.Limit,
+			Topic:       channel.Topic,
+			TopicSetter: channel.TopicSetter,
+			TopicTS:     channel.TopicTS,
+			Bans:        channel.Bans,
+			Exceptions:  channel.BanExceptions,
+			Quiets:      channel.Quiets,
+			Metadata:    channel.Metadata,
+		}
+
+		for mode := range channel.Modes {
+			sc.Modes += string(mode)
+		}
+
+		for uid := range channel.Members {
+			if _, ok := kept[uid]; !ok {
+				continue
+			}
+			sc.Members = append(sc.Members, uid)
+			if _, ok := channel.Ops[uid]; ok {
+				sc.Ops = append(sc.Ops, uid)
+			}
+			if _, ok := channel.Voices[uid]; ok {
+				sc.Voices = append(sc.Voices, uid)
+			}
+			if _, ok := channel.HalfOps[uid]; ok {
+				sc.HalfOps = append(sc.HalfOps, uid)
+			}
+			if _, ok := channel.Owners[uid]; ok {
+				sc.Owners = append(sc.Owners, uid)
+			}
+		}
+
+		// No one we keep is on it. It goes away.
+		if len(sc.Members) == 0 {
+			continue
+		}
+
+		for uid := range channel.Invites {
+			if _, ok := kept[uid]; ok {
+				sc.Invites = append(sc.Invites, uid)
+			}
+		}
+
+		for _, entry := range channel.History {
+			sc.History = append(sc.History, *entry)
+		}
+
+		s.Channels = append(s.Channels, sc)
+	}
+
+	return s
+}
+
+// saveSnapshotFile writes the snapshot to the given file using gob.
+//
+// Like the channel state file, we write to a temporary file and then rename.
+func saveSnapshotFile(file string, s *Snapshot) error {
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(s); err != nil {
+		return fmt.Errorf("error encoding snapshot: %s", err)
+	}
+
+	tmpFile := file + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, buf.Bytes(), 0600); err != nil {
+		return fmt.Errorf("error writing snapshot file: %s", err)
+	}
+
+	if err := os.Rename(tmpFile, file); err != nil {
+		return fmt.Errorf("error renaming snapshot file: %s", err)
+	}
+
+	return nil
+}
+
+// loadSnapshotFile reads a snapshot and removes the file. A snapshot is only
+// good for the restart that wrote it.
+//
+// It is not an error for the file to not exist. Then we return nil.
+func loadSnapshotFile(file string) (*Snapshot, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error reading snapshot file: %s", err)
+	}
+
+	if err := os.Remove(file); err != nil {
+		return nil, fmt.Errorf("error removing snapshot file: %s", err)
+	}
+
+	s := &Snapshot{}
+	if err := gob.NewDecoder(bytes.NewReader(buf)).Decode(s); err != nil {
+		return nil, fmt.Errorf("error decoding snapshot: %s", err)
+	}
+
+	return s, nil
+}
+
+// restoreSnapshot brings back the users and channels from a hot restart. We
+// call it at startup before we accept connections.
+func (cb *Catbox) restoreSnapshot(s *Snapshot) {
+	// If we didn't get here by exec, the descriptors are not the connections we
+	// think they are.
+	if s.PID != os.Getpid() {
+		cb.Logger.Warn("Ignoring snapshot from another process.")
+		return
+	}
+
+	conns := map[TS6UID]net.Conn{}
+	for _, su := range s.Users {
+		f := os.NewFile(su.FD, fmt.Sprintf("<fd %d>", su.FD))
+		conn, err := net.FileConn(f)
+		// FileConn duplicates the descriptor. We don't need this one.
+		_ = f.Close()
+		if err != nil {
+			cb.Logger.Warn("Unable to restore connection of %s: %s",
+				su.DisplayNick, err)
+			continue
+		}
+		conns[su.UID] = conn
+	}
+
+	cb.applySnapshot(s, conns)
+
+	for _, lu := range cb.LocalUsers {
+		cb.WG.Add(2)
+		go lu.writeLoop()
+		go lu.readLoop()
+
+		lu.serverNotice("Server restarted. Your connection was kept.")
+	}
+
+	cb.Logger.Info("Restored %d users and %d channels from snapshot.",
+		len(cb.LocalUsers), len(cb.Channels))
+}
+
+// applySnapshot restores our state from the snapshot. Users get the given
+// connections. We skip users without one.
+func (cb *Catbox) applySnapshot(s *Snapshot, conns map[TS6UID]net.Conn) {
+	cb.NextClientID = s.NextClientID
+	cb.KLines = append(cb.KLines, s.KLines...)
+	cb.HighestLocalUserCount = s.HighestLocalUserCount
+	cb.HighestGlobalUserCount = s.HighestGlobalUserCount
+	cb.HighestConnectionCount = s.HighestConnectionCount
+	cb.ConnectionCount = s.ConnectionCount
+
+	for _, su := range s.Users {
+		conn, ok := conns[su.UID]
+		if !ok {
+			continue
+		}
+
+		c := NewLocalClient(cb, su.ID, conn)
+		c.ConnectionStartTime = su.ConnectionStartTime
+		c.Country = su.Country
+		for _, cap := range su.Caps {
+			c.Caps[cap] = struct{}{}
+		}
+
+		lu := NewLocalUser(c)
+		lu.Config = su.Config
+
+		u := &User{
+			DisplayNick: su.DisplayNick,
+			NickTS:      su.NickTS,
+			Modes:       make(map[byte]struct{}),
+			Username:    su.Username,
+			Hostname:    su.Hostname,
+			IP:          su.IP,
+			UID:         su.UID,
+			RealName:    su.RealName,
+			AwayMessage: su.AwayMessage,
+			Channels:    make(map[string]*Channel),
+			FloodExempt: su.FloodExempt,
+			Class:       su.Class,
+			Account:     su.Account,
+			Metadata:    su.Metadata,
+			LocalUser:   lu,
+		}
+		for _, mode := range []byte(su.Modes) {
+			u.Modes[mode] = struct{}{}
+		}
+		if len(su.AcceptList) > 0 {
+			u.AcceptList = make(map[TS6UID]struct{})
+			for _, uid := range su.AcceptList {
+				u.AcceptList[uid] = struct{}{}
+			}
+		}
+		if len(su.WatchList) > 0 {
+			u.WatchList = make(map[string]struct{})
+			for _, nick := range su.WatchList {
+				u.WatchList[nick] = struct{}{}
+			}
+		}
+
+		lu.User = u
+
+		class := cb.Config.connClass(u.Class)
+		lu.MaxSendQ = class.MaxSendQ
+		lu.MessageCounter = class.FloodThreshold
+
+		cb.LocalUsers[lu.ID] = lu
+		cb.Users[u.UID] = u
+		cb.Nicks[canonicalizeNick(u.DisplayNick)] = u.UID
+		if u.isOperator() {
+			cb.Opers[u.UID] = u
+		}
+	}
+
+	for _, sc := range s.Channels {
+		channel := &Channel{
+			Name:          sc.Name,
+			Members:       make(map[TS6UID]struct{}),
+			Ops:           make(map[TS6UID]*User),
+			Voices:        make(map[TS6UID]*User),
+			HalfOps:       make(map[TS6UID]*User),
+			Owners:        make(map[TS6UID]*User),
+			Invites:       make(map[TS6UID]time.Time),
+			Modes:         make(map[byte]struct{}),
+			Bans:          sc.Bans,
+			BanExceptions: sc.Exceptions,
+			Quiets:        sc.Quiets,
+			Key:           sc.Key,
+			Limit:         sc.Limit,
+			Topic:         sc.Topic,
+			TopicSetter:   sc.TopicSetter,
+			TopicTS:       sc.TopicTS,
+			TS:            sc.TS,
+			Metadata:      sc.Metadata,
+		}
+
+		for _, mode := range []byte(sc.Modes) {
+			channel.Modes[mode] = struct{}{}
+		}
+
+		for _, uid := range sc.Members {
+			u, ok := cb.Users[uid]
+			if !ok {
+				continue
+			}
+			channel.Members[uid] = struct{}{}
+			u.Channels[channel.Name] = channel
+		}
+
+		if len(channel.Members) == 0 {
+			continue
+		}
+
+		for _, uid := range sc.Ops {
+			if u, ok := cb.Users[uid]; ok {
+				channel.Ops[uid] = u
+			}
+		}
+		for _, uid := range sc.Voices {
+			if u, ok := cb.Users[uid]; ok {
+				channel.Voices[uid] = u
+			}
+		}
+		for _, uid := range sc.HalfOps {
+			if u, ok := cb.Users[uid]; ok {
+				channel.HalfOps[uid] = u
+			}
+		}
+		for _, uid := range sc.Owners {
+			if u, ok := cb.Users[uid]; ok {
+				channel.Owners[uid] = u
+			}
+		}
+		for _, uid := range sc.Invites {
+			if _, ok := cb.Users[uid]; ok {
+				channel.Invites[uid] = time.Now()
+			}
+		}
+
+		for i := range sc.History {
+			channel.History = append(channel.History, &sc.History[i])
+		}
+
+		cb.Channels[channel.Name] = channel
+
+		// It's no longer waiting for someone to join.
+		delete(cb.PersistedChannels, channel.Name)
+	}
+
+	cb.updateCounters()
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// tcpPair makes a connected pair of TCP connections.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err)
+	}
+	defer func() {
+		_ = ln.Close()
+	}()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("unable to dial: %s", err)
+	}
+
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("unable to accept: %s", err)
+	}
+
+	return server, client
+}
+
+func newSnapshotCatbox() *Catbox {
+	return &Catbox{
+		Config: &Config{
+			ServerName: "irc.example.com",
+			TS6SID:     TS6SID("000"),
+			PingTime:   30 * time.Second,
+			DeadTime:   240 * time.Second,
+		},
+		LocalClients:      map[uint64]*LocalClient{},
+		LocalUsers:        map[uint64]*LocalUser{},
+		LocalServers:      map[uint64]*LocalServer{},
+		Opers:             map[TS6UID]*User{},
+		Users:             map[TS6UID]*User{},
+		Nicks:             map[string]TS6UID{},
+		Servers:           map[TS6SID]*Server{},
+		Channels:          map[string]*Channel{},
+		PersistedChannels: map[string]*Channel{},
+		ChanRegs:          map[string]*ChanReg{},
+		Logger:            newTestLogger(),
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	cb := newSnapshotCatbox()
+	cb.NextClientID = 5
+	cb.KLines = []KLine{{UserMask: "*", HostMask: "bad.example.com",
+		Reason: "Bad"}}
+	cb.HighestLocalUserCount = 10
+	cb.ConnectionCount = 20
+
+	var users []*User
+	for i, nick := range []string{"Alice", "Bob"} {
+		server, client := tcpPair(t)
+		defer func() {
+			_ = server.Close()
+			_ = client.Close()
+		}()
+
+		c := NewLocalClient(cb, uint64(i+1), server)
+		c.Caps["draft/chathistory"] = struct{}{}
+		lu := NewLocalUser(c)
+		u := &User{
+			DisplayNick: nick,
+			NickTS:      1000,
+			Modes:       map[byte]struct{}{'i': {}},
+			Username:    "user",
+			Hostname:    "host.example.com",
+			IP:          "192.168.0.1",
+			UID:         TS6UID("000AAAAA" + string('A'+byte(i))),
+			RealName:    "Real Name",
+			Channels:    map[string]*Channel{},
+			LocalUser:   lu,
+		}
+		lu.User = u
+
+		cb.LocalUsers[lu.ID] = lu
+		cb.Users[u.UID] = u
+		cb.Nicks[canonicalizeNick(nick)] = u.UID
+		users = append(users, u)
+	}
+
+	alice, bob := users[0], users[1]
+	alice.Modes['o'] = struct{}{}
+	alice.AwayMessage = "Away"
+	alice.Account = "alice"
+	alice.Metadata = map[string]string{"url": "https://example.com"}
+	alice.LocalUser.Country = "CA"
+	alice.LocalUser.Config = &UserConfig{UserMask: "*", HostMask: "*",
+		MaxChannels: 3}
+	cb.Opers[alice.UID] = alice
+
+	channel := &Channel{
+		Name:    "#test",
+		Members: map[TS6UID]struct{}{alice.UID: {}, bob.UID: {}},
+		Ops:     map[TS6UID]*User{alice.UID: alice},
+		Voices:  map[TS6UID]*User{bob.UID: bob},
+		Invites: map[TS6UID]time.Time{alice.UID: time.Now()},
+		Modes:   map[byte]struct{}{'n': {}, 'k': {}},
+		Key:     "secret",
+		Bans:    []BanEntry{{Mask: "*!*@bad.example.com", Setter: "Alice", TS: 5}},
+		Topic:   "Hello",
+		TS:      100,
+		History: []*HistoryEntry{{Prefix: "Alice!user@host.example.com",
+			Command: "PRIVMSG", Params: []string{"#test", "hi"}}},
+		Metadata: map[string]string{"url": "https://example.com/test"},
+	}
+	cb.Channels[channel.Name] = channel
+	alice.Channels[channel.Name] = channel
+	bob.Channels[channel.Name] = channel
+
+	// Only Bob is on a channel alone.
+	cb.Channels["#bob"] = &Channel{
+		Name:    "#bob",
+		Members: map[TS6UID]struct{}{bob.UID: {}},
+		Ops:     map[TS6UID]*User{},
+		Voices:  map[TS6UID]*User{},
+		Modes:   map[byte]struct{}{},
+	}
+
+	// We keep Alice but not Bob.
+	s := cb.makeSnapshot(map[uint64]uintptr{alice.LocalUser.ID: 42})
+
+	dir, err := ioutil.TempDir("", "catbox-snapshot-")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %s", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	file := filepath.Join(dir, "snapshot")
+	if err := saveSnapshotFile(file, s); err != nil {
+		t.Fatalf("saveSnapshotFile() = %s", err)
+	}
+
+	loaded, err := loadSnapshotFile(file)
+	if err != nil {
+		t.Fatalf("loadSnapshotFile() = %s", err)
+	}
+
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("loadSnapshotFile() did not remove the file")
+	}
+
+	if len(loaded.Users) != 1 || loaded.Users[0].FD != 42 {
+		t.Fatalf("loaded users = %+v, wanted Alice with FD 42", loaded.Users)
+	}
+
+	server, client := tcpPair(t)
+	defer func() {
+		_ = server.Close()
+		_ = client.Close()
+	}()
+
+	cb2 := newSnapshotCatbox()
+	cb2.applySnapshot(loaded, map[TS6UID]net.Conn{alice.UID: server})
+
+	if cb2.NextClientID != 5 {
+		t.Errorf("NextClientID = %d, wanted 5", cb2.NextClientID)
+	}
+	if len(cb2.KLines) != 1 || cb2.KLines[0] != cb.KLines[0] {
+		t.Errorf("KLines = %+v, wanted %+v", cb2.KLines, cb.KLines)
+	}
+	if cb2.HighestLocalUserCount != 10 || cb2.ConnectionCount != 20 {
+		t.Errorf("counters = %d, %d, wanted 10, 20", cb2.HighestLocalUserCount,
+			cb2.ConnectionCount)
+	}
+
+	lu, ok := cb2.LocalUsers[alice.LocalUser.ID]
+	if !ok {
+		t.Fatalf("Alice is not a local user")
+	}
+	u := lu.User
+	if u.DisplayNick != "Alice" || u.UID != alice.UID ||
+		u.Hostname != alice.Hostname || u.IP != alice.IP ||
+		u.AwayMessage != "Away" || !u.isOperator() {
+		t.Errorf("restored user = %+v", u)
+	}
+	if !lu.hasCap("draft/chathistory") {
+		t.Errorf("restored user lost their capabilities")
+	}
+	if u.Account != "alice" || u.Metadata["url"] != "https://example.com" ||
+		lu.Country != "CA" || lu.Config == nil || lu.Config.MaxChannels != 3 {
+		t.Errorf("restored user has account %q, metadata %v, country %q, config %+v",
+			u.Account, u.Metadata, lu.Country, lu.Config)
+	}
+	if cb2.Nicks["alice"] != alice.UID || cb2.Users[alice.UID] != u ||
+		cb2.Opers[alice.UID] != u {
+		t.Errorf("restored user is not in the nick, user, and oper maps")
+	}
+	if _, ok := cb2.Users[bob.UID]; ok {
+		t.Errorf("Bob was restored")
+	}
+
+	if _, ok := cb2.Channels["#bob"]; ok {
+		t.Errorf("channel with no kept members was restored")
+	}
+
+	c, ok := cb2.Channels["#test"]
+	if !ok {
+		t.Fatalf("#test was not restored")
+	}
+	if len(c.Members) != 1 || !u.onChannel(c) {
+		t.Errorf("#test members = %v, wanted only Alice", c.Members)
+	}
+	if c.Ops[alice.UID] != u || len(c.Voices) != 0 {
+		t.Errorf("#test ops = %v, voices = %v", c.Ops, c.Voices)
+	}
+	if !c.isInvited(u) {
+		t.Errorf("#test lost Alice's invite")
+	}
+	if c.modesString() != channel.modesString() || c.Key != "secret" ||
+		c.Topic != "Hello" || c.TS != 100 || len(c.Bans) != 1 {
+		t.Errorf("#test = %+v", c)
+	}
+	if len(c.History) != 1 || c.History[0].Params[1] != "hi" {
+		t.Errorf("#test history = %v", c.History)
+	}
+	if c.Metadata["url"] != "https://example.com/test" {
+		t.Errorf("#test metadata = %v", c.Metadata)
+	}
+}
+
+func TestInheritableFile(t *testing.T) {
+	server, client := tcpPair(t)
+	defer func() {
+		_ = server.Close()
+		_ = client.Close()
+	}()
+
+	f, err := inheritableFile(server)
+	if err != nil {
+		t.Fatalf("inheritableFile() = %s", err)
+	}
+
+	flags, _, errno := syscall.Syscall(syscall.SYS_FCNTL, f.Fd(),
+		syscall.F_GETFD, 0)
+	if errno != 0 {
+		t.Fatalf("unable to get descriptor flags: %s", errno)
+	}
+	if flags&syscall.FD_CLOEXEC != 0 {
+		t.Errorf("close-on-exec is still set")
+	}
+
+	// The descriptor is the same connection.
+	conn, err := net.FileConn(f)
+	if err != nil {
+		t.Fatalf("FileConn() = %s", err)
+	}
+	_ = f.Close()
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	if _, err := conn.Write([]byte("PING :hi\r\n")); err != nil {
+		t.Fatalf("unable to write: %s", err)
+	}
+
+	line, err := bufio.NewReader(client).ReadString('\n')
+	if err != nil {
+		t.Fatalf("unable to read: %s", err)
+	}
+	if line != "PING :hi\r\n" {
+		t.Errorf("read %q, wanted PING", line)
+	}
+}
+
+func TestLoadSnapshotFileMissing(t *testing.T) {
+	s, err := loadSnapshotFile(filepath.Join(os.TempDir(),
+		"catbox-no-such-snapshot"))
+	if err != nil {
+		t.Fatalf("loadSnapshotFile() = %s", err)
+	}
+	if s != nil {
+		t.Errorf("loadSnapshotFile() = %+v, wanted nil", s)
+	}
+}
+
+func TestRestoreSnapshotOtherProcess(t *testing.T) {
+	cb := newSnapshotCatbox()
+
+	cb.restoreSnapshot(&Snapshot{
+		PID:   os.Getpid() + 1,
+		Users: []SnapshotUser{{FD: 42, UID: TS6UID("000AAAAAA")}},
+	})
+
+	if len(cb.LocalUsers) != 0 {
+		t.Errorf("restored %d users from another process's snapshot",
+			len(cb.LocalUsers))
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/horgh/irc"
+)
+
+// CompiledSpamFilter is a spam filter with its pattern compiled.
+type CompiledSpamFilter struct {
+	SpamFilter
+	Regexp *regexp.Regexp
+}
+
+// newSpamFilters compiles the patterns of the configured spam filters.
+func newSpamFilters(c *Config) ([]CompiledSpamFilter, error) {
+	var filters []CompiledSpamFilter
+	for _, filter := range c.SpamFilters {
+		re, err := regexp.Compile(filter.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("spam filter %s pattern is not valid: %s",
+				filter.Name, err)
+		}
+		filters = append(filters, CompiledSpamFilter{SpamFilter: filter,
+			Regexp: re})
+	}
+	return filters, nil
+}
+
+// checkSpamFilters acts on the first spam filter matching a message the user
+// sent to the channel.
+//
+// It returns whether we should still deliver the message. Opers are exempt.
+func (u *LocalUser) checkSpamFilters(channel *Channel, msg string) bool {
+	if len(u.Catbox.CompiledSpamFilters) == 0 || u.User.isOperator() {
+		return true
+	}
+
+	for _, filter := range u.Catbox.CompiledSpamFilters {
+		if !filter.Regexp.MatchString(msg) {
+			continue
+		}
+
+		switch filter.Action {
+		case "warn":
+			u.Catbox.noticeLocalOpers(fmt.Sprintf(
+				"Spam filter %s matched %s in %s: %s", filter.Name,
+				u.User.nickUhost(), channel.Name, filter.Reason))
+			return true
+		case "kick":
+			u.Catbox.spamFilterKick(channel, u.User, filter.Reason)
+		case "kline":
+			u.Catbox.spamFilterKLine(u, filter.Reason)
+		}
+
+		// drop and the others don't deliver it.
+		return false
+	}
+
+	return true
+}
+
+// spamFilterKick kicks a user from a channel on behalf of our server.
+func (cb *Catbox) spamFilterKick(channel *Channel, user *User, reason string) {
+	for _, server := range cb.LocalServers {
+		server.maybeQueueMessage(irc.Message{
+			Prefix:  string(cb.Config.TS6SID),
+			Command: "KICK",
+			Params:  []string{channel.Name, string(user.UID), reason},
+		})
+	}
+
+	cb.kickUser(cb.Config.ServerName, channel, user, reason)
+}
+
+// spamFilterKLine K-Lines the user's IP. Like an oper's K-Line it is
+// permanent and we tell every server.
+func (cb *Catbox) spamFilterKLine(u *LocalUser, reason string) {
+	for _, server := range cb.LocalServers {
+		server.maybeQueueMessage(irc.Message{
+			Prefix:  string(cb.Config.TS6SID),
+			Command: "ENCAP",
+			Params:  []string{"*", "KLINE", "0", "*", u.User.IP, reason},
+		})
+	}
+
+	cb.addAndApplyKLine(KLine{
+		UserMask: "*",
+		HostMask: u.User.IP,
+		Reason:   reason,
+	}, cb.Config.ServerName, reason)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/horgh/irc"
+)
+
+func TestSpamFilters(t *testing.T) {
+	cb := newSnapshotCatbox()
+	cb.Config.SpamFilters = []SpamFilter{
+		{Name: "a", Pattern: "(?i)warnme", Action: "warn", Reason: "Warned"},
+		{Name: "b", Pattern: "dropme", Action: "drop", Reason: "Dropped"},
+		{Name: "c", Pattern: "kickme", Action: "kick", Reason: "Kicked"},
+		{Name: "d", Pattern: "klineme", Action: "kline", Reason: "K-Lined"},
+	}
+	filters, err := newSpamFilters(cb.Config)
+	if err != nil {
+		t.Fatalf("newSpamFilters() = %s", err)
+	}
+	cb.CompiledSpamFilters = filters
+
+	link := addTraceTestLink(cb, 10, "irc2.example.com", "001")
+	oper := addCallerIDTestUser(cb, 1, "oper")
+	oper.User.Modes['o'] = struct{}{}
+	cb.Opers[oper.User.UID] = oper.User
+	alice := addCallerIDTestUser(cb, 2, "alice")
+	alice.User.IP = "192.0.2.5"
+	bob := addCallerIDTestUser(cb, 3, "bob")
+
+	channel := &Channel{Name: "#test", Members: map[TS6UID]struct{}{},
+		Ops: map[TS6UID]*User{}}
+	cb.Channels[channel.Name] = channel
+	for _, lu := range []*LocalUser{oper, alice, bob} {
+		channel.Members[lu.User.UID] = struct{}{}
+		lu.User.Channels[channel.Name] = channel
+	}
+
+	say := func(lu *LocalUser, text string) {
+		lu.privmsgCommand(irc.Message{Command: "PRIVMSG",
+			Params: []string{"#test", text}})
+	}
+	drainLink := func() []string {
+		var got []string
+		for len(link.WriteChan) > 0 {
+			m := (<-link.WriteChan).Message
+			got = append(got, m.Prefix+" "+m.Command+" "+strings.Join(m.Params, " "))
+		}
+		return got
+	}
+
+	// Nothing matches.
+	say(alice, "hello")
+	if got := drainCommands(bob); len(got) != 1 ||
+		got[0] != "PRIVMSG #test hello" {
+		t.Errorf("bob got %q, wanted the message", got)
+	}
+	_ = drainCommands(oper)
+
+	// warn tells opers and delivers it.
+	say(alice, "WARNME")
+	if got := drainCommands(bob); len(got) != 1 ||
+		got[0] != "PRIVMSG #test WARNME" {
+		t.Errorf("bob got %q, wanted the warned message", got)
+	}
+	wanted := []string{
+		"NOTICE oper *** Notice --- Spam filter a matched alice!user@host.example.com in #test: Warned",
+		"PRIVMSG #test WARNME",
+	}
+	if got := drainCommands(oper); strings.Join(got, "\n") !=
+		strings.Join(wanted, "\n") {
+		t.Errorf("oper got %q, wanted %q", got, wanted)
+	}
+
+	// drop is silent.
+	say(alice, "please dropme")
+	for _, lu := range []*LocalUser{oper, alice, bob} {
+		if got := drainCommands(lu); len(got) != 0 {
+			t.Errorf("%s got %q for a dropped message", lu.User.DisplayNick, got)
+		}
+	}
+	if got := drainLink(); len(got) != 0 {
+		t.Errorf("propagated %q for a dropped message", got)
+	}
+
+	// Opers are exempt.
+	say(oper, "dropme")
+	if got := drainCommands(bob); len(got) != 1 {
+		t.Errorf("bob got %q, wanted the oper's message", got)
+	}
+	_ = drainCommands(alice)
+
+	// kick removes them from the channel.
+	say(bob, "kickme")
+	if got := drainCommands(alice); len(got) != 1 ||
+		got[0] != "KICK #test bob Kicked" {
+		t.Errorf("alice got %q, wanted the KICK", got)
+	}
+	if bob.User.onChannel(channel) {
+		t.Errorf("bob is still on the channel")
+	}
+	if got := drainLink(); len(got) != 1 ||
+		got[0] != "000 KICK #test "+string(bob.User.UID)+" Kicked" {
+		t.Errorf("propagated %q, wanted the KICK", got)
+	}
+	_ = drainCommands(oper)
+
+	// kline K-Lines their IP.
+	say(alice, "klineme")
+	if len(cb.KLines) != 1 || cb.KLines[0].UserMask != "*" ||
+		cb.KLines[0].HostMask != "192.0.2.5" || cb.KLines[0].Reason != "K-Lined" {
+		t.Errorf("K-Lines = %+v", cb.KLines)
+	}
+	if _, exists := cb.LocalUsers[alice.ID]; exists {
+		t.Errorf("alice is still connected")
+	}
+	got := drainLink()
+	if len(got) != 2 || got[0] != "000 ENCAP * KLINE 0 * 192.0.2.5 K-Lined" ||
+		!strings.HasPrefix(got[1], string(alice.User.UID)+" QUIT ") {
+		t.Errorf("propagated %q, wanted the K-Line and QUIT", got)
+	}
+	if got := drainCommands(oper); len(got) == 0 || strings.Contains(
+		strings.Join(got, "\n"), "PRIVMSG") {
+		t.Errorf("oper got %q", got)
+	}
+}
+
+func TestRehashSpamFilters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catbox-spam-")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %s", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	filtersFile := filepath.Join(dir, "spam-filters.conf")
+	configFile := filepath.Join(dir, "catbox.conf")
+	if err := ioutil.WriteFile(configFile, []byte(fmt.Sprintf(
+		"spam-filters-config = %s\n", filtersFile)), 0600); err != nil {
+		t.Fatalf("unable to write config: %s", err)
+	}
+
+	cb := &Catbox{
+		ConfigFile: configFile,
+		Config:     &Config{},
+		Logger:     newTestLogger(),
+	}
+
+	if err := ioutil.WriteFile(filtersFile,
+		[]byte("links = drop,Links,https?://\n"), 0600); err != nil {
+		t.Fatalf("unable to write spam filters: %s", err)
+	}
+	cb.rehash(nil, RehashAll)
+	if len(cb.CompiledSpamFilters) != 1 ||
+		!cb.CompiledSpamFilters[0].Regexp.MatchString("see http://example.com") ||
+		cb.CompiledSpamFilters[0].Action != "drop" {
+		t.Fatalf("spam filters after rehash = %+v", cb.CompiledSpamFilters)
+	}
+
+	// A bad filter means we keep what we have.
+	if err := ioutil.WriteFile(filtersFile,
+		[]byte("links = drop,Links,(\n"), 0600); err != nil {
+		t.Fatalf("unable to write spam filters: %s", err)
+	}
+	cb.rehash(nil, RehashAll)
+	if len(cb.CompiledSpamFilters) != 1 {
+		t.Errorf("spam filters after a bad rehash = %+v", cb.CompiledSpamFilters)
+	}
+
+	if err := ioutil.WriteFile(filtersFile, []byte("\n"), 0600); err != nil {
+		t.Fatalf("unable to write spam filters: %s", err)
+	}
+	cb.rehash(nil, RehashAll)
+	if len(cb.CompiledSpamFilters) != 0 {
+		t.Errorf("spam filters after removing them = %+v", cb.CompiledSpamFilters)
+	}
+}
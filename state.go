@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// ChannelState is what we persist about a channel across restarts.
+//
+// We do not save members. Everyone disconnects when we restart so they would
+// be meaningless.
+type ChannelState struct {
+	Name        string     `json:"name"`
+	TS          int64      `json:"ts"`
+	Modes       string     `json:"modes"`
+	Key         string     `json:"key,omitempty"`
+	Limit       int        `json:"limit,omitempty"`
+	Topic       string     `json:"topic"`
+	TopicSetter string     `json:"topic_setter"`
+	TopicTS     int64      `json:"topic_ts"`
+	Bans        []BanState `json:"bans,omitempty"`
+}
+
+// BanState is a ban (+b) we persist on a channel.
+type BanState struct {
+	Mask   string `json:"mask"`
+	Setter string `json:"setter"`
+	TS     int64  `json:"ts"`
+}
+
+// saveState writes our channels to the state file.
+//
+// Channels we restored but that no one rejoined get saved too. Otherwise we'd
+// lose them if we restart again before anyone joins.
+func (cb *Catbox) saveState() {
+	channels := make(map[string]*Channel)
+	for name, channel := range cb.PersistedChannels {
+		channels[name] = channel
+	}
+	for name, channel := range cb.Channels {
+		channels[name] = channel
+	}
+
+	if err := saveChannelState(cb.Config.StateFile, channels); err != nil {
+		cb.Logger.Error("Unable to save state: %s", err)
+		return
+	}
+
+	cb.Logger.Info("Saved state for %d channels.", len(channels))
+}
+
+// saveChannelState writes channel metadata to the given file as JSON.
+//
+// We write to a temporary file and then rename so that we never leave behind
+// a partially written file.
+func saveChannelState(file string, channels map[string]*Channel) error {
+	buf, err := encodeChannelState(channels)
+	if err != nil {
+		return err
+	}
+
+	tmpFile := file + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, buf, 0600); err != nil {
+		return fmt.Errorf("error writing state file: %s", err)
+	}
+
+	if err := os.Rename(tmpFile, file); err != nil {
+		return fmt.Errorf("error renaming state file: %s", err)
+	}
+
+	return nil
+}
+
+// loadChannelState reads channel metadata from the given file.
+//
+// It is not an error for the file to not exist. In that case there are no
+// channels to restore.
+func loadChannelState(file string) (map[string]*Channel, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string]*Channel{}, nil
+		}
+		return nil, fmt.Errorf("error reading state file: %s", err)
+	}
+
+	return decodeChannelState(buf)
+}
+
+func encodeChannelState(channels map[string]*Channel) ([]byte, error) {
+	states := []ChannelState{}
+
+	for _, channel := range channels {
+		modes := ""
+		for mode := range channel.Modes {
+			modes += string(mode)
+		}
+
+		var bans []BanState
+		for _, ban := range channel.Bans {
+			bans = append(bans, BanState{
+				Mask:   ban.Mask,
+				Setter: ban.Setter,
+				TS:     ban.TS,
+			})
+		}
+
+		states = append(states, ChannelState{
+			Name:        channel.Name,
+			TS:          channel.TS,
+			Modes:       modes,
+			Key:         channel.Key,
+			Limit:       channel.Limit,
+			Topic:       channel.Topic,
+			TopicSetter: channel.TopicSetter,
+			TopicTS:     channel.TopicTS,
+			Bans:        bans,
+		})
+	}
+
+	// Sort so the file is stable between saves.
+	sort.Slice(states, func(i, j int) bool { return states[i].Name < states[j].Name })
+
+	buf, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("error encoding channel state: %s", err)
+	}
+
+	return buf, nil
+}
+
+func decodeChannelState(buf []byte) (map[string]*Channel, error) {
+	var states []ChannelState
+	if err := json.Unmarshal(buf, &states); err != nil {
+		return nil, fmt.Errorf("error decoding channel state: %s", err)
+	}
+
+	channels := make(map[string]*Channel)
+
+	for _, state := range states {
+		name := canonicalizeChannel(state.Name)
+		if !isValidChannel(name) {
+			return nil, fmt.Errorf("invalid channel name in state: %s", state.Name)
+		}
+
+		channel := &Channel{
+			Name:        name,
+			Members:     make(map[TS6UID]struct{}),
+			Ops:         make(map[TS6UID]*User),
+			Modes:       make(map[byte]struct{}),
+			TS:          state.TS,
+			Key:         state.Key,
+			Limit:       state.Limit,
+			Topic:       state.Topic,
+			TopicSetter: state.TopicSetter,
+			TopicTS:     state.TopicTS,
+		}
+
+		for _, mode := range []byte(state.Modes) {
+			channel.Modes[mode] = struct{}{}
+		}
+
+		for _, ban := range state.Bans {
+			channel.Bans = append(channel.Bans, BanEntry{
+				Mask:   ban.Mask,
+				Setter: ban.Setter,
+				TS:     ban.TS,
+			})
+		}
+
+		channels[name] = channel
+	}
+
+	return channels, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestChannelStateRoundTrip(t *testing.T) {
+	channels := map[string]*Channel{
+		"#test": {
+			Name:        "#test",
+			Members:     map[TS6UID]struct{}{"000AAAAAA": {}},
+			Ops:         map[TS6UID]*User{},
+			Modes:       map[byte]struct{}{'n': {}, 's': {}},
+			TS:          1475187553,
+			Topic:       "hi there",
+			TopicSetter: "nick!user@host",
+			TopicTS:     1475187600,
+		},
+		"#locked": {
+			Name:    "#locked",
+			Members: map[TS6UID]struct{}{},
+			Ops:     map[TS6UID]*User{},
+			Modes:   map[byte]struct{}{'n': {}, 't': {}},
+			Key:     "secret",
+			Limit:   10,
+			Bans: []BanEntry{
+				{Mask: "*!*@bad.example.com", Setter: "alice", TS: 1475187700},
+			},
+			TS: 1475187500,
+		},
+		"#empty": {
+			Name:    "#empty",
+			Members: map[TS6UID]struct{}{},
+			Ops:     map[TS6UID]*User{},
+			Modes:   map[byte]struct{}{},
+			TS:      100,
+		},
+	}
+
+	dir, err := ioutil.TempDir("", "catbox-state-")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %s", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	file := filepath.Join(dir, "state.json")
+
+	if err := saveChannelState(file, channels); err != nil {
+		t.Fatalf("saveChannelState() = %s", err)
+	}
+
+	restored, err := loadChannelState(file)
+	if err != nil {
+		t.Fatalf("loadChannelState() = %s", err)
+	}
+
+	if len(restored) != len(channels) {
+		t.Fatalf("restored %d channels, wanted %d", len(restored), len(channels))
+	}
+
+	for name, want := range channels {
+		got, exists := restored[name]
+		if !exists {
+			t.Errorf("channel %s not restored", name)
+			continue
+		}
+
+		if got.Name != want.Name || got.TS != want.TS || got.Topic != want.Topic ||
+			got.TopicSetter != want.TopicSetter || got.TopicTS != want.TopicTS ||
+			got.Key != want.Key || got.Limit != want.Limit {
+			t.Errorf("channel %s restored as %+v, wanted %+v", name, got, want)
+		}
+
+		if len(got.Modes) != len(want.Modes) {
+			t.Errorf("channel %s restored with modes %s, wanted %s", name,
+				got.modesString(), want.modesString())
+		}
+		for mode := range want.Modes {
+			if _, exists := got.Modes[mode]; !exists {
+				t.Errorf("channel %s missing mode %c", name, mode)
+			}
+		}
+
+		if !reflect.DeepEqual(got.Bans, want.Bans) {
+			t.Errorf("channel %s restored with bans %+v, wanted %+v", name,
+				got.Bans, want.Bans)
+		}
+
+		// Members are not restored.
+		if len(got.Members) != 0 || len(got.Ops) != 0 {
+			t.Errorf("channel %s restored with members", name)
+		}
+	}
+}
+
+func TestLoadChannelStateMissingFile(t *testing.T) {
+	channels, err := loadChannelState(filepath.Join(os.TempDir(),
+		"catbox-state-does-not-exist.json"))
+	if err != nil {
+		t.Fatalf("loadChannelState() = %s, wanted no error", err)
+	}
+	if len(channels) != 0 {
+		t.Errorf("loadChannelState() = %d channels, wanted 0", len(channels))
+	}
+}
+
+func TestDecodeChannelState(t *testing.T) {
+	tests := []struct {
+		input   string
+		success bool
+	}{
+		{`[]`, true},
+		{`[{"name":"#Test","ts":5,"modes":"ns"}]`, true},
+		{`[{"name":"test","ts":5}]`, false},
+		{`{`, false},
+	}
+
+	for _, test := range tests {
+		_, err := decodeChannelState([]byte(test.input))
+		if err != nil {
+			if test.success {
+				t.Errorf("decodeChannelState(%s) = error %s, wanted success",
+					test.input, err)
+			}
+			continue
+		}
+
+		if !test.success {
+			t.Errorf("decodeChannelState(%s) = success, wanted error", test.input)
+		}
+	}
+}
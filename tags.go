@@ -0,0 +1,161 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// MaxTagsLength is the most bytes of tags we accept on a message from a
+// client, including the leading @ and trailing space. This is in addition to
+// irc.MaxLineLength. See the IRCv3 message-tags specification.
+const MaxTagsLength = 4096
+
+// ServerTimeFormat is how we format the time tag.
+const ServerTimeFormat = "2006-01-02T15:04:05.000Z"
+
+// TaggedMessage is a protocol message along with its IRCv3 message tags. The
+// irc package's Message does not know about tags, so we carry them alongside
+// it.
+type TaggedMessage struct {
+	irc.Message
+
+	// Tag name to value. The value may be blank.
+	Tags map[string]string
+}
+
+// Encode encodes the message including its tags.
+func (m TaggedMessage) Encode() (string, error) {
+	s, err := m.Message.Encode()
+	if len(m.Tags) == 0 {
+		return s, err
+	}
+	return encodeTags(m.Tags) + " " + s, err
+}
+
+// parseTags splits the tags from the start of a protocol line. It returns the
+// tags and the rest of the line. If the line has no tags, it returns nil and
+// the line as it was.
+//
+// We drop tags we can't make sense of, such as those with empty names.
+func parseTags(line string) (map[string]string, string) {
+	if !strings.HasPrefix(line, "@") {
+		return nil, line
+	}
+
+	idx := strings.Index(line, " ")
+	if idx == -1 {
+		return nil, ""
+	}
+
+	rawTags := line[1:idx]
+	rest := strings.TrimLeft(line[idx:], " ")
+
+	if len(rawTags)+2 > MaxTagsLength {
+		return nil, rest
+	}
+
+	tags := make(map[string]string)
+	for _, rawTag := range strings.Split(rawTags, ";") {
+		pieces := strings.SplitN(rawTag, "=", 2)
+		if pieces[0] == "" {
+			continue
+		}
+
+		value := ""
+		if len(pieces) == 2 {
+			value = unescapeTagValue(pieces[1])
+		}
+
+		tags[pieces[0]] = value
+	}
+
+	return tags, rest
+}
+
+// encodeTags turns tags into the tag section of a protocol line. e.g.,
+// @a=1;b. We sort them so the string is the same each time.
+func encodeTags(tags map[string]string) string {
+	names := make([]string, 0, len(tags))
+	for name := range tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString("@")
+	for i, name := range names {
+		if i > 0 {
+			b.WriteString(";")
+		}
+		b.WriteString(name)
+		if tags[name] != "" {
+			b.WriteString("=")
+			b.WriteString(escapeTagValue(tags[name]))
+		}
+	}
+	return b.String()
+}
+
+var tagValueEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	";", `\:`,
+	" ", `\s`,
+	"\r", `\r`,
+	"\n", `\n`,
+)
+
+// escapeTagValue escapes characters that can't appear in a tag value.
+func escapeTagValue(s string) string {
+	return tagValueEscaper.Replace(s)
+}
+
+// unescapeTagValue reverses escapeTagValue. An invalid escape becomes the
+// character after the \, and a trailing \ is dropped.
+func unescapeTagValue(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+
+		i++
+		if i == len(s) {
+			break
+		}
+
+		switch s[i] {
+		case ':':
+			b.WriteByte(';')
+		case 's':
+			b.WriteByte(' ')
+		case 'r':
+			b.WriteByte('\r')
+		case 'n':
+			b.WriteByte('\n')
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// clientTags picks out the client-only tags. Their names start with +. We
+// pass these on from one client to another.
+func clientTags(tags map[string]string) map[string]string {
+	picked := make(map[string]string)
+	for name, value := range tags {
+		if strings.HasPrefix(name, "+") {
+			picked[name] = value
+		}
+	}
+	return picked
+}
+
+// serverTime formats a time for the time tag.
+func serverTime(t time.Time) string {
+	return t.UTC().Format(ServerTimeFormat)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+func TestParseTags(t *testing.T) {
+	tests := []struct {
+		input string
+		tags  map[string]string
+		rest  string
+	}{
+		{"PRIVMSG #test :hi\r\n", nil, "PRIVMSG #test :hi\r\n"},
+		{
+			"@+typing=active TAGMSG #test\r\n",
+			map[string]string{"+typing": "active"},
+			"TAGMSG #test\r\n",
+		},
+		{
+			"@a=1;b;c= :nick PRIVMSG #test :hi\r\n",
+			map[string]string{"a": "1", "b": "", "c": ""},
+			":nick PRIVMSG #test :hi\r\n",
+		},
+		{
+			`@a=one\stwo\:three\\four\r\n;=bad;b=x\y\ TAGMSG #test` + "\r\n",
+			map[string]string{"a": "one two;three\\four\r\n", "b": "xy"},
+			"TAGMSG #test\r\n",
+		},
+		{"@a=1\r\n", nil, ""},
+	}
+
+	for _, test := range tests {
+		tags, rest := parseTags(test.input)
+		if !reflect.DeepEqual(tags, test.tags) || rest != test.rest {
+			t.Errorf("parseTags(%q) = %q, %q, wanted %q, %q", test.input, tags,
+				rest, test.tags, test.rest)
+		}
+	}
+}
+
+func TestTaggedMessageRoundTrip(t *testing.T) {
+	tests := []TaggedMessage{
+		{Message: irc.Message{Command: "TAGMSG", Params: []string{"#test"}},
+			Tags: map[string]string{"+typing": "active"}},
+		{Message: irc.Message{Prefix: "nick!user@host", Command: "PRIVMSG",
+			Params: []string{"#test", "hi there"}},
+			Tags: map[string]string{
+				"time":    "2019-01-02T03:04:05.000Z",
+				"+flag":   "",
+				"+reply":  "a; b\\c",
+				"+domain": "x",
+			}},
+		{Message: irc.Message{Command: "PING", Params: []string{"hi"}}},
+	}
+
+	for _, test := range tests {
+		line, err := test.Encode()
+		if err != nil {
+			t.Errorf("Encode(%v) = %s", test, err)
+			continue
+		}
+
+		tags, rest := parseTags(line)
+		m, err := irc.ParseMessage(rest)
+		if err != nil {
+			t.Errorf("ParseMessage(%q) = %s", rest, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(m, test.Message) {
+			t.Errorf("round trip of %v gave message %v", test, m)
+		}
+
+		if len(test.Tags) == 0 && tags == nil {
+			continue
+		}
+		if !reflect.DeepEqual(tags, test.Tags) {
+			t.Errorf("round trip of %v gave tags %q", test, tags)
+		}
+	}
+}
+
+func TestEncodeTags(t *testing.T) {
+	tags := map[string]string{"b": "x y", "a": "", "c": "1;2"}
+	want := `@a;b=x\sy;c=1\:2`
+	if got := encodeTags(tags); got != want {
+		t.Errorf("encodeTags(%q) = %s, wanted %s", tags, got, want)
+	}
+}
+
+func TestMaybeQueueTaggedMessage(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		caps []string
+		tags map[string]string
+		// Tags we expect other than time.
+		output map[string]string
+		time   bool
+	}{
+		{nil, map[string]string{"+typing": "active"}, nil, false},
+		{[]string{"message-tags"}, map[string]string{"+typing": "active"},
+			map[string]string{"+typing": "active"}, true},
+		{[]string{"server-time"}, map[string]string{"+typing": "active"},
+			map[string]string{}, true},
+		{[]string{"message-tags"}, nil, map[string]string{}, true},
+	}
+
+	for _, test := range tests {
+		c := &LocalClient{WriteChan: make(chan TaggedMessage, 1),
+			Caps: map[string]struct{}{}}
+		for _, cap := range test.caps {
+			c.Caps[cap] = struct{}{}
+		}
+
+		c.maybeQueueTaggedMessage(irc.Message{Command: "PING"}, test.tags)
+
+		m := <-c.WriteChan
+
+		if !test.time {
+			if m.Tags != nil {
+				t.Errorf("caps %q: got tags %q, wanted none", test.caps, m.Tags)
+			}
+			continue
+		}
+
+		sent, err := time.Parse(ServerTimeFormat, m.Tags["time"])
+		if err != nil || sent.Before(now.Add(-time.Second)) ||
+			sent.After(time.Now().Add(time.Second)) {
+			t.Errorf("caps %q: time tag is %q", test.caps, m.Tags["time"])
+		}
+
+		delete(m.Tags, "time")
+		if !reflect.DeepEqual(m.Tags, test.output) {
+			t.Errorf("caps %q: got tags %q, wanted %q", test.caps, m.Tags,
+				test.output)
+		}
+	}
+}
@@ -266,17 +266,52 @@ func (c *Catbox) stop() {
 	}
 }
 
+// linkOptions are optional settings for a link.
+type linkOptions struct {
+	zip       bool
+	challenge bool
+
+	// Opers to configure, name to password.
+	opers map[string]string
+}
+
 func (c *Catbox) linkServer(other *Catbox) error {
+	return c.linkServerWith(other, linkOptions{})
+}
+
+// linkServerWith is like linkServer but lets us set the link's options.
+func (c *Catbox) linkServerWith(other *Catbox, options linkOptions) error {
 	conf := filepath.Join(c.ConfigDir, "catbox.conf")
 	serversConf := filepath.Join(c.ConfigDir, "servers.conf")
 	extra := fmt.Sprintf("servers-config = %s", serversConf)
 
+	if len(options.opers) > 0 {
+		opersConf := filepath.Join(c.ConfigDir, "opers.conf")
+		opersConfContent := ""
+		for name, password := range options.opers {
+			opersConfContent += fmt.Sprintf("%s = %s\n", name, password)
+		}
+		if err := ioutil.WriteFile(opersConf, []byte(opersConfContent),
+			0644); err != nil {
+			return fmt.Errorf("error writing opers conf: %s: %s", opersConf, err)
+		}
+		extra += fmt.Sprintf("\nopers-config = %s", opersConf)
+	}
+
 	if err := writeConf(conf, c.Name, c.SID, extra); err != nil {
 		return err
 	}
 
-	serversConfContent := fmt.Sprintf(`%s = %s,%d,%s,0`,
-		other.Name, "127.0.0.1", other.Port, "testing")
+	flag := func(b bool) int {
+		if b {
+			return 1
+		}
+		return 0
+	}
+
+	serversConfContent := fmt.Sprintf(`%s = %s,%d,%s,0,%d,%d`,
+		other.Name, "127.0.0.1", other.Port, "testing", flag(options.zip),
+		flag(options.challenge))
 
 	if err := ioutil.WriteFile(serversConf, []byte(serversConfContent),
 		0644); err != nil {
@@ -286,6 +321,40 @@ func (c *Catbox) linkServer(other *Catbox) error {
 	return c.rehash()
 }
 
+// waitForLink waits until c and other link. We wait for each to log that the
+// other's burst is over. Until then, users and channels on one side may not
+// be known on the other.
+//
+// Retry rehashing as I observed a failing build where the second server did
+// not receive the SIGHUP, yet didn't exit. I'm not sure how that can happen
+// other than perhaps a race in signal.Notify() such that the signal handler
+// is registered so the HUP gets received but not delivered to the channel.
+func (c *Catbox) waitForLink(other *Catbox) error {
+	burstRE := regexp.MustCompile(
+		fmt.Sprintf(`Burst with %s over\.`, regexp.QuoteMeta(other.Name)))
+	var attempts int
+	for !waitForLog(c.LogChan, burstRE) {
+		attempts++
+		if attempts >= 5 {
+			return fmt.Errorf("%s failed to link to %s", c.Name, other.Name)
+		}
+		if err := c.rehash(); err != nil {
+			return err
+		}
+		if err := other.rehash(); err != nil {
+			return err
+		}
+	}
+
+	otherBurstRE := regexp.MustCompile(
+		fmt.Sprintf(`Burst with %s over\.`, regexp.QuoteMeta(c.Name)))
+	if !waitForLog(other.LogChan, otherBurstRE) {
+		return fmt.Errorf("%s did not finish burst from %s", other.Name, c.Name)
+	}
+
+	return nil
+}
+
 func (c *Catbox) rehash() error {
 	return errors.Wrap(
 		c.Command.Process.Signal(syscall.SIGHUP),
@@ -19,7 +19,6 @@ type Client struct {
 	serverPort uint16
 
 	writeTimeout time.Duration
-	readTimeout  time.Duration
 
 	conn net.Conn
 	rw   *bufio.ReadWriter
@@ -42,7 +41,6 @@ func NewClient(nick, serverHost string, serverPort uint16) *Client {
 		serverPort: serverPort,
 
 		writeTimeout: 30 * time.Second,
-		readTimeout:  100 * time.Millisecond,
 
 		channels: map[string]struct{}{},
 		mutex:    &sync.Mutex{},
@@ -110,8 +108,8 @@ func (c *Client) connect() error {
 		KeepAlive: 30 * time.Second,
 	}
 
-	conn, err := dialer.Dial("tcp", fmt.Sprintf("%s:%d", c.serverHost,
-		c.serverPort))
+	conn, err := dialer.Dial("tcp", net.JoinHostPort(c.serverHost,
+		fmt.Sprintf("%d", c.serverPort)))
 	if err != nil {
 		return fmt.Errorf("error dialing: %s", err)
 	}
@@ -123,28 +121,18 @@ func (c *Client) connect() error {
 
 func (c Client) reader(recvChan chan<- irc.Message) {
 	defer c.wg.Done()
+	defer close(recvChan)
 
 	for {
-		select {
-		case <-c.doneChan:
-			close(recvChan)
-			return
-		default:
-		}
-
+		// We block until a message arrives. Stop() closes the connection to end
+		// us.
 		m, err := c.readMessage()
 		if err != nil {
-			// If we time out waiting for a read to succeed, just ignore it and try
-			// again. We want a short timeout on that so we frequently check whether
-			// we should end.
-			//
-			// There's no accessible error variable to compare with
-			if strings.Contains(err.Error(), "i/o timeout") {
-				continue
+			select {
+			case <-c.doneChan:
+			default:
+				c.errChan <- fmt.Errorf("error reading message: %s", err)
 			}
-
-			c.errChan <- fmt.Errorf("error reading message: %s", err)
-			close(recvChan)
 			return
 		}
 
@@ -154,7 +142,6 @@ func (c Client) reader(recvChan chan<- irc.Message) {
 				Params:  []string{m.Params[0]},
 			}); err != nil {
 				c.errChan <- fmt.Errorf("error sending pong: %s", err)
-				close(recvChan)
 				return
 			}
 		}
@@ -167,7 +154,11 @@ func (c Client) reader(recvChan chan<- irc.Message) {
 			}
 		}
 
-		recvChan <- m
+		select {
+		case recvChan <- m:
+		case <-c.doneChan:
+			return
+		}
 	}
 }
 
@@ -225,10 +216,6 @@ func (c Client) writeMessage(m irc.Message) error {
 
 // readMessage reads a line from the connection and parses it as an IRC message.
 func (c Client) readMessage() (irc.Message, error) {
-	if err := c.conn.SetReadDeadline(time.Now().Add(c.readTimeout)); err != nil {
-		return irc.Message{}, fmt.Errorf("unable to set deadline: %s", err)
-	}
-
 	line, err := c.rw.ReadString('\n')
 	if err != nil {
 		return irc.Message{}, err
@@ -256,6 +243,9 @@ func (c *Client) Stop() {
 	// We won't be sending anything further to writer. Let it clean up.
 	close(c.sendChan)
 
+	// The reader may be blocked reading. Closing the connection wakes it.
+	_ = c.conn.Close()
+
 	// Wait for reader and writer to end.
 	c.wg.Wait()
 
@@ -263,8 +253,6 @@ func (c *Client) Stop() {
 	// more.
 	close(c.errChan)
 
-	_ = c.conn.Close()
-
 	for range c.recvChan {
 	}
 	for range c.errChan {
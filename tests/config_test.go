@@ -0,0 +1,73 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// Test converting a config to JSON with -dump-config, then dumping the JSON
+// config.
+func TestDumpConfig(t *testing.T) {
+	if err := buildCatbox(); err != nil {
+		t.Fatalf("error building catbox: %s", err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "boxcat-")
+	if err != nil {
+		t.Fatalf("error retrieving a temporary directory: %s", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+
+	conf := filepath.Join(tmpDir, "catbox.conf")
+	if err := writeConf(conf, "irc.example.com", "000", ""); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	dump := func(file string) []byte {
+		cmd := exec.Command("./catbox", "-conf", file, "-dump-config")
+		cmd.Dir = catboxDir
+		output, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("error dumping config %s: %s", file, err)
+		}
+		return output
+	}
+
+	output := dump(conf)
+
+	var m map[string]string
+	if err := json.Unmarshal(output, &m); err != nil {
+		t.Fatalf("dumped config is not JSON: %s: %s", err, output)
+	}
+	if m["server-name"] != "irc.example.com" || m["ts6-sid"] != "000" {
+		t.Errorf("dumped config is %v", m)
+	}
+
+	jsonConf := filepath.Join(tmpDir, "catbox.json")
+	if err := ioutil.WriteFile(jsonConf, output, 0600); err != nil {
+		t.Fatalf("error writing JSON config: %s", err)
+	}
+
+	if output2 := dump(jsonConf); !bytes.Equal(output, output2) {
+		t.Errorf("dumping the JSON config gave %s, wanted %s", output2, output)
+	}
+
+	// An invalid config fails.
+	badConf := filepath.Join(tmpDir, "bad.json")
+	if err := ioutil.WriteFile(badConf, []byte(`{"ts6-sid": "bad"}`),
+		0600); err != nil {
+		t.Fatalf("error writing JSON config: %s", err)
+	}
+	cmd := exec.Command("./catbox", "-conf", badConf, "-dump-config")
+	cmd.Dir = catboxDir
+	if err := cmd.Run(); err == nil {
+		t.Errorf("dumping an invalid config succeeded")
+	}
+}
@@ -0,0 +1,130 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/horgh/irc"
+	"github.com/stretchr/testify/require"
+)
+
+// Test that servers that both offer ZIP compress their link, and that
+// messages still make it across.
+func TestLinkZIP(t *testing.T) {
+	testLink(t, linkOptions{zip: true})
+}
+
+// Test that servers link when they prove they know the password with
+// CHALLENGE.
+func TestLinkChallenge(t *testing.T) {
+	testLink(t, linkOptions{challenge: true})
+}
+
+// testLink links two servers with the options. It checks that they link and
+// that a message from a user on one reaches a user on the other.
+func testLink(t *testing.T, options linkOptions) {
+	catbox1, err := harnessCatbox("irc1.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox1.stop()
+
+	catbox2, err := harnessCatbox("irc2.example.org", "002")
+	require.NoError(t, err, "harness catbox")
+	defer catbox2.stop()
+
+	err = catbox1.linkServerWith(catbox2, options)
+	require.NoError(t, err, "link catbox1 to catbox2")
+	err = catbox2.linkServerWith(catbox1, options)
+	require.NoError(t, err, "link catbox2 to catbox1")
+
+	require.NoError(t, catbox1.waitForLink(catbox2), "link")
+
+	client1 := NewClient("client1", "127.0.0.1", catbox1.Port)
+	recvChan1, sendChan1, _, err := client1.Start()
+	require.NoError(t, err, "start client 1")
+	defer client1.Stop()
+
+	client2 := NewClient("client2", "127.0.0.1", catbox2.Port)
+	recvChan2, sendChan2, _, err := client2.Start()
+	require.NoError(t, err, "start client 2")
+	defer client2.Stop()
+
+	require.NotNil(
+		t,
+		waitForMessage(
+			t,
+			recvChan1,
+			irc.Message{Command: irc.ReplyWelcome},
+			"welcome from %s",
+			client1.GetNick(),
+		),
+		"client 1 gets welcome",
+	)
+	require.NotNil(
+		t,
+		waitForMessage(
+			t,
+			recvChan2,
+			irc.Message{Command: irc.ReplyWelcome},
+			"welcome from %s",
+			client2.GetNick(),
+		),
+		"client 2 gets welcome",
+	)
+
+	sendChan2 <- irc.Message{
+		Command: "JOIN",
+		Params:  []string{"#test"},
+	}
+	require.NotNil(
+		t,
+		waitForMessage(
+			t,
+			recvChan2,
+			irc.Message{
+				Command: "JOIN",
+				Params:  []string{"#test"},
+			},
+			"%s received JOIN #test",
+			client2.GetNick(),
+		),
+		"client 2 gets JOIN message",
+	)
+
+	sendChan1 <- irc.Message{
+		Command: "JOIN",
+		Params:  []string{"#test"},
+	}
+	require.NotNil(
+		t,
+		waitForMessage(
+			t,
+			recvChan2,
+			irc.Message{
+				Command: "JOIN",
+				Params:  []string{"#test"},
+			},
+			"%s sees %s JOIN #test",
+			client2.GetNick(),
+			client1.GetNick(),
+		),
+		"client 2 sees client 1 JOIN",
+	)
+
+	sendChan1 <- irc.Message{
+		Command: "PRIVMSG",
+		Params:  []string{"#test", "hello from the other server"},
+	}
+	require.NotNil(
+		t,
+		waitForMessage(
+			t,
+			recvChan2,
+			irc.Message{
+				Command: "PRIVMSG",
+				Params:  []string{"#test", "hello from the other server"},
+			},
+			"%s received PRIVMSG",
+			client2.GetNick(),
+		),
+		"client 2 gets PRIVMSG",
+	)
+}
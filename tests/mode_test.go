@@ -1,7 +1,6 @@
 package tests
 
 import (
-	"regexp"
 	"strconv"
 	"testing"
 	"time"
@@ -28,25 +27,7 @@ func TestMODETS(t *testing.T) {
 	err = catbox2.linkServer(catbox1)
 	require.NoError(t, err, "link catbox2 to catbox1")
 
-	// Wait until we link.
-	//
-	// Retry rehashing as I observed a failing build where the second server did
-	// not receive the SIGHUP, yet didn't exit. I'm not sure how that can happen
-	// other than perhaps a race in signal.Notify() such that the signal handler
-	// is registered so the HUP gets received but not delivered to the channel.
-	linkRE := regexp.MustCompile(`Established link to irc2\.`)
-	var attempts int
-	for {
-		if waitForLog(catbox1.LogChan, linkRE) {
-			break
-		}
-		attempts++
-		if attempts >= 5 {
-			require.Fail(t, "failed to link")
-		}
-		require.NoError(t, err, catbox1.rehash(), "rehash catbox1")
-		require.NoError(t, err, catbox2.rehash(), "rehash catbox2")
-	}
+	require.NoError(t, catbox1.waitForLink(catbox2), "link")
 
 	client1 := NewClient("client1", "127.0.0.1", catbox1.Port)
 	recvChan1, sendChan1, _, err := client1.Start()
@@ -184,3 +165,188 @@ func TestMODETS(t *testing.T) {
 		},
 	)
 }
+
+// Test that channel mode changes get propagated between servers and applied
+// on the other side.
+func TestMODEPropagation(t *testing.T) {
+	catbox1, err := harnessCatbox("irc1.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox1.stop()
+
+	catbox2, err := harnessCatbox("irc2.example.org", "002")
+	require.NoError(t, err, "harness catbox")
+	defer catbox2.stop()
+
+	err = catbox1.linkServer(catbox2)
+	require.NoError(t, err, "link catbox1 to catbox2")
+	err = catbox2.linkServer(catbox1)
+	require.NoError(t, err, "link catbox2 to catbox1")
+
+	require.NoError(t, catbox1.waitForLink(catbox2), "link")
+
+	client1 := NewClient("client1", "127.0.0.1", catbox1.Port)
+	recvChan1, sendChan1, _, err := client1.Start()
+	require.NoError(t, err, "start client")
+	defer client1.Stop()
+
+	client2 := NewClient("client2", "127.0.0.1", catbox2.Port)
+	recvChan2, sendChan2, _, err := client2.Start()
+	require.NoError(t, err, "start client 2")
+	defer client2.Stop()
+
+	require.NotNil(t, waitForMessage(t, recvChan1,
+		irc.Message{Command: irc.ReplyWelcome}, "welcome from %s",
+		client1.GetNick()), "client gets welcome")
+	require.NotNil(t, waitForMessage(t, recvChan2,
+		irc.Message{Command: irc.ReplyWelcome}, "welcome from %s",
+		client2.GetNick()), "client 2 gets welcome")
+
+	sendChan1 <- irc.Message{Command: "JOIN", Params: []string{"#test"}}
+	require.NotNil(t, waitForMessage(t, recvChan1, irc.Message{Command: "JOIN"},
+		"%s received JOIN #test", client1.GetNick()), "client gets JOIN message")
+
+	sendChan2 <- irc.Message{Command: "JOIN", Params: []string{"#test"}}
+	require.NotNil(t, waitForMessage(t, recvChan2, irc.Message{Command: "JOIN"},
+		"%s received JOIN #test", client2.GetNick()),
+		"client 2 gets JOIN message")
+
+	// Wait for client 1 to see client 2 join so we know it's on the channel on
+	// both sides.
+	require.NotNil(t, waitForMessage(t, recvChan1, irc.Message{Command: "JOIN"},
+		"%s saw %s JOIN #test", client1.GetNick(), client2.GetNick()),
+		"client gets JOIN message for client 2")
+
+	sendChan1 <- irc.Message{
+		Command: "MODE",
+		Params: []string{"#test", "+bvl", "*!*@evil.example.com", client2.GetNick(),
+			"5"},
+	}
+
+	// Client 2 may see other MODE messages first depending on which server
+	// created the channel, such as +ns and +o.
+	var modeMessage *irc.Message
+	for i := 0; i < 10; i++ {
+		modeMessage = waitForMessage(t, recvChan2, irc.Message{Command: "MODE"},
+			"%s received MODE", client2.GetNick())
+		require.NotNil(t, modeMessage, "client 2 receives MODE")
+		if len(modeMessage.Params) > 1 && modeMessage.Params[1] == "+bvl" {
+			break
+		}
+	}
+
+	require.Equal(
+		t,
+		[]string{"#test", "+bvl", "*!*@evil.example.com", client2.GetNick(), "5"},
+		modeMessage.Params,
+		"client 2 sees the mode change",
+	)
+
+	// The other side applied the changes too.
+	sendChan2 <- irc.Message{Command: "MODE", Params: []string{"#test"}}
+	modeIsMessage := waitForMessage(t, recvChan2, irc.Message{Command: "324"},
+		"%s received 324", client2.GetNick())
+	require.NotNil(t, modeIsMessage, "client 2 receives 324")
+	require.Equal(t, "5", modeIsMessage.Params[len(modeIsMessage.Params)-1],
+		"limit applied on other server")
+
+	sendChan2 <- irc.Message{Command: "MODE", Params: []string{"#test", "b"}}
+	banMessage := waitForMessage(t, recvChan2, irc.Message{Command: "367"},
+		"%s received 367", client2.GetNick())
+	require.NotNil(t, banMessage, "client 2 receives 367")
+	require.Equal(t, "*!*@evil.example.com", banMessage.Params[2],
+		"ban applied on other server")
+}
+
+// Test that when an oper uses OPME the users on the other server see them get
+// ops.
+func TestOPMEPropagation(t *testing.T) {
+	catbox1, err := harnessCatbox("irc1.example.org", "001")
+	require.NoError(t, err, "harness catbox")
+	defer catbox1.stop()
+
+	catbox2, err := harnessCatbox("irc2.example.org", "002")
+	require.NoError(t, err, "harness catbox")
+	defer catbox2.stop()
+
+	err = catbox1.linkServerWith(catbox2,
+		linkOptions{opers: map[string]string{"oper": "secret"}})
+	require.NoError(t, err, "link catbox1 to catbox2")
+	err = catbox2.linkServer(catbox1)
+	require.NoError(t, err, "link catbox2 to catbox1")
+
+	require.NoError(t, catbox1.waitForLink(catbox2), "link")
+
+	client1 := NewClient("client1", "127.0.0.1", catbox1.Port)
+	recvChan1, sendChan1, _, err := client1.Start()
+	require.NoError(t, err, "start client")
+	defer client1.Stop()
+
+	client2 := NewClient("client2", "127.0.0.1", catbox2.Port)
+	recvChan2, sendChan2, _, err := client2.Start()
+	require.NoError(t, err, "start client 2")
+	defer client2.Stop()
+
+	require.NotNil(t, waitForMessage(t, recvChan1,
+		irc.Message{Command: irc.ReplyWelcome}, "welcome from %s",
+		client1.GetNick()), "client gets welcome")
+	require.NotNil(t, waitForMessage(t, recvChan2,
+		irc.Message{Command: irc.ReplyWelcome}, "welcome from %s",
+		client2.GetNick()), "client 2 gets welcome")
+
+	sendChan1 <- irc.Message{Command: "JOIN", Params: []string{"#test"}}
+	require.NotNil(t, waitForMessage(t, recvChan1, irc.Message{Command: "JOIN"},
+		"%s received JOIN #test", client1.GetNick()), "client gets JOIN message")
+
+	// Client 1 created the channel. Drop its ops so OPME has work to do.
+	sendChan1 <- irc.Message{Command: "MODE",
+		Params: []string{"#test", "-o", client1.GetNick()}}
+	for i := 0; i < 10; i++ {
+		modeMessage := waitForMessage(t, recvChan1, irc.Message{Command: "MODE"},
+			"%s received MODE", client1.GetNick())
+		require.NotNil(t, modeMessage, "client receives MODE")
+		if len(modeMessage.Params) > 1 && modeMessage.Params[1] == "-o" {
+			break
+		}
+	}
+
+	sendChan2 <- irc.Message{Command: "JOIN", Params: []string{"#test"}}
+	require.NotNil(t, waitForMessage(t, recvChan2, irc.Message{Command: "JOIN"},
+		"%s received JOIN #test", client2.GetNick()),
+		"client 2 gets JOIN message")
+
+	// Wait for client 1 to see client 2 join so we know it's on the channel on
+	// both sides.
+	require.NotNil(t, waitForMessage(t, recvChan1, irc.Message{Command: "JOIN"},
+		"%s saw %s JOIN #test", client1.GetNick(), client2.GetNick()),
+		"client gets JOIN message for client 2")
+
+	sendChan1 <- irc.Message{Command: "OPER", Params: []string{"oper", "secret"}}
+	require.NotNil(t, waitForMessage(t, recvChan1, irc.Message{Command: "381"},
+		"%s received 381", client1.GetNick()), "client becomes oper")
+
+	sendChan1 <- irc.Message{Command: "OPME", Params: []string{"#test"}}
+
+	// Client 1 sees it locally.
+	modeMessage := waitForMessage(t, recvChan1, irc.Message{Command: "MODE"},
+		"%s received MODE", client1.GetNick())
+	require.NotNil(t, modeMessage, "client receives MODE")
+	require.Equal(t, []string{"#test", "+o", client1.GetNick()},
+		modeMessage.Params, "client sees itself get ops")
+
+	// Client 2 may see other MODE messages first, such as the channel's
+	// modes.
+	for i := 0; i < 10; i++ {
+		modeMessage = waitForMessage(t, recvChan2, irc.Message{Command: "MODE"},
+			"%s received MODE", client2.GetNick())
+		require.NotNil(t, modeMessage, "client 2 receives MODE")
+		if len(modeMessage.Params) > 2 && modeMessage.Params[1] == "+o" &&
+			modeMessage.Params[2] == client1.GetNick() {
+			break
+		}
+	}
+
+	require.Equal(t, []string{"#test", "+o", client1.GetNick()},
+		modeMessage.Params, "client 2 sees client 1 get ops")
+	require.Equal(t, "irc1.example.org", modeMessage.Prefix,
+		"mode change comes from client 1's server")
+}
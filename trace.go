@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// traceLink makes the 200 RPL_TRACELINK reply we send when we pass a TRACE on
+// toward the target server.
+func (cb *Catbox) traceLink(target *Server) irc.Message {
+	next := target.nextHop()
+
+	// 200 RPL_TRACELINK
+	// RFC 2812 says:
+	// Link <version & debug level> <destination> <next server> V<protocol
+	//   version> <link uptime in seconds> <backstream sendq> <upstream sendq>
+	// We don't track the send queues in bytes so we leave them out.
+	return irc.Message{
+		Command: "200",
+		Params: []string{
+			"Link",
+			cb.version(),
+			target.Name,
+			next.Server.Name,
+			"V6",
+			strconv.Itoa(int(time.Since(next.ConnectionStartTime).Seconds())),
+		},
+	}
+}
+
+// traceReplies makes the replies a TRACE gets when it reaches us. We describe
+// each of our local users and servers.
+func (cb *Catbox) traceReplies() []irc.Message {
+	msgs := []irc.Message{}
+
+	users := make([]*LocalUser, 0, len(cb.LocalUsers))
+	for _, lu := range cb.LocalUsers {
+		users = append(users, lu)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].User.DisplayNick < users[j].User.DisplayNick
+	})
+
+	for _, lu := range users {
+		if lu.User.isOperator() {
+			// 204 RPL_TRACEOPERATOR
+			// Oper <class> <nick>
+			msgs = append(msgs, irc.Message{
+				Command: "204",
+				Params:  []string{"Oper", lu.User.Class, lu.User.DisplayNick},
+			})
+			continue
+		}
+
+		// 205 RPL_TRACEUSER
+		// User <class> <nick>
+		msgs = append(msgs, irc.Message{
+			Command: "205",
+			Params:  []string{"User", lu.User.Class, lu.User.DisplayNick},
+		})
+	}
+
+	servers := make([]*LocalServer, 0, len(cb.LocalServers))
+	for _, ls := range cb.LocalServers {
+		servers = append(servers, ls)
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].Server.Name < servers[j].Server.Name
+	})
+
+	for _, ls := range servers {
+		// Count the servers and users we reach through it.
+		serverCount := len(ls.Server.getLinkedServers(cb.Servers)) + 1
+		userCount := 0
+		for _, user := range cb.Users {
+			if user.ClosestServer == ls {
+				userCount++
+			}
+		}
+
+		// 206 RPL_TRACESERVER
+		// Serv <class> <int>S <int>C <server> <nick!user|*!*>@<host|server>
+		//   V<protocol version>
+		// We have no classes for servers.
+		msgs = append(msgs, irc.Message{
+			Command: "206",
+			Params: []string{
+				"Serv",
+				"server",
+				fmt.Sprintf("%dS", serverCount),
+				fmt.Sprintf("%dC", userCount),
+				ls.Server.Name,
+				"*!*@" + cb.Config.ServerName,
+				"V6",
+			},
+		})
+	}
+
+	// 262 RPL_TRACEEND
+	// <server name> <version & debug level> :End of TRACE
+	msgs = append(msgs, irc.Message{
+		Command: "262",
+		Params:  []string{cb.Config.ServerName, cb.version(), "End of TRACE"},
+	})
+
+	return msgs
+}
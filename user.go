@@ -2,7 +2,10 @@ package main
 
 import (
 	"fmt"
-	"log"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
 )
 
 // User holds information about a user. It may be remote or local.
@@ -16,7 +19,7 @@ type User struct {
 	// The user's nick's TS. This changes on registration and NICK.
 	NickTS int64
 
-	// The user's modes. Currently +i, +o, +C supported.
+	// The user's modes. Currently +i, +o, +w, +C, +g supported.
 	Modes map[byte]struct{}
 
 	// The user's username.
@@ -47,6 +50,28 @@ type User struct {
 	// a user is flood exempt, use the isFloodExempt() function.
 	FloodExempt bool
 
+	// Whether this is one of our service users. Services have no connection.
+	// We handle messages to them ourself.
+	IsService bool
+
+	// Users a local user accepts messages from while they have +g (caller ID).
+	AcceptList map[TS6UID]struct{}
+
+	// Canonicalized nicks a local user watches (WATCH). We tell them when these
+	// nicks come online and go offline.
+	WatchList map[string]struct{}
+
+	// Metadata set on the user (METADATA). Key to value.
+	Metadata map[string]string
+
+	// The account the user is identified to. Services tell us with ENCAP SU.
+	// Blank if none.
+	Account string
+
+	// The connection class of a local user. It decides their limits. Blank
+	// means the default class.
+	Class string
+
 	// LocalUser set if this is a local user.
 	LocalUser *LocalUser
 
@@ -78,13 +103,15 @@ func (u *User) onChannel(channel *Channel) bool {
 	return exists
 }
 
-// Make a string of their user modes. + if no modes.
+// Make a string of their user modes. + if no modes. We sort them so the
+// string is the same each time.
 func (u *User) modesString() string {
-	s := "+"
+	modes := make([]string, 0, len(u.Modes))
 	for m := range u.Modes {
-		s += string(m)
+		modes = append(modes, string(m))
 	}
-	return s
+	sort.Strings(modes)
+	return "+" + strings.Join(modes, "")
 }
 
 func (u *User) isLocal() bool {
@@ -99,30 +126,184 @@ func (u *User) isRemote() bool {
 //
 // If they are an oper, they are.
 //
-// If they are flagged so, they are.
-func (u *User) isFloodExempt() bool {
-	return u.isOperator() || u.FloodExempt
+// If they are flagged so, they are. Services are too.
+//
+// If they match one of the given host masks, they are.
+func (u *User) isFloodExempt(hostMasks []string) bool {
+	if u.isOperator() || u.FloodExempt || u.IsService {
+		return true
+	}
+
+	for _, mask := range hostMasks {
+		if matches, _ := u.matchesMask("*", mask); matches {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Determine if the user matches a ban mask of the form nick!user@host, or an
+// extended ban (see extendedBanMatch).
+//
+// Comparison is case insensitive. The mask must match the whole of
+// nick!user@host.
+func (u *User) matchesBanMask(mask string) bool {
+	if strings.HasPrefix(mask, "$") {
+		return extendedBanMatch(u, mask)
+	}
+
+	return globMatch(mask, u.nickUhost())
+}
+
+// ExtendedBanTypes are the extended ban types we support.
+//
+// a: Account. With no value, any user identified to an account.
+// r: Real name glob.
+// s: Server name glob.
+// x: Glob of nick!user@host#real name.
+const ExtendedBanTypes = "arsx"
+
+// extendedBanMatch checks whether the user matches an extended ban. These look
+// like $<type>[:<value>]. A ~ before the type negates it, e.g. $~a matches
+// users not identified to an account.
+//
+// An invalid extended ban matches no one.
+func extendedBanMatch(u *User, mask string) bool {
+	if !isValidExtendedBan(mask) {
+		return false
+	}
+
+	mask = mask[1:]
+
+	negate := false
+	if mask[0] == '~' {
+		negate = true
+		mask = mask[1:]
+	}
+
+	banType := mask[0]
+	value := ""
+	if len(mask) > 2 {
+		value = mask[2:]
+	}
+
+	matched := false
+	switch banType {
+	case 'a':
+		if value == "" {
+			matched = u.Account != ""
+		} else {
+			matched = u.Account != "" && globMatch(value, u.Account)
+		}
+	case 'r':
+		matched = globMatch(value, u.RealName)
+	case 's':
+		matched = globMatch(value, u.serverName())
+	case 'x':
+		matched = globMatch(value, u.nickUhost()+"#"+u.RealName)
+	}
+
+	if negate {
+		return !matched
+	}
+	return matched
+}
+
+// isValidExtendedBan checks an extended ban is well formed. Every type but a
+// requires a value.
+func isValidExtendedBan(mask string) bool {
+	if !strings.HasPrefix(mask, "$") {
+		return false
+	}
+	mask = strings.TrimPrefix(mask[1:], "~")
+
+	if mask == "" || !strings.ContainsRune(ExtendedBanTypes, rune(mask[0])) {
+		return false
+	}
+
+	if len(mask) == 1 {
+		return mask[0] == 'a'
+	}
+
+	return mask[1] == ':' && len(mask) > 2
+}
+
+// globMatch checks whether s matches the glob pattern (* and ?). The pattern
+// must match the whole of s. Comparison is case insensitive.
+func globMatch(pattern, s string) bool {
+	re, err := maskToRegex(strings.ToLower(pattern))
+	if err != nil {
+		return false
+	}
+
+	re, err = regexp.Compile("^(?:" + re.String() + ")$")
+	if err != nil {
+		return false
+	}
+
+	return re.MatchString(strings.ToLower(s))
+}
+
+// serverName is the name of the server the user is on. It is blank for our
+// services since they have no server or connection.
+func (u *User) serverName() string {
+	if u.isLocal() {
+		return u.LocalUser.Catbox.Config.ServerName
+	}
+	if u.Server != nil {
+		return u.Server.Name
+	}
+	return ""
 }
 
 // Determine if our user mask (Username@Hostname) matches the given mask.
 //
 // If there are no wildcards in the mask, then it must match our user@host.
+// The host mask may match either our hostname or our IP.
 //
 // We support glob style (*) wildcards and ? to match any single char.
-func (u *User) matchesMask(userMask, hostMask string) bool {
+//
+// If a mask is invalid we return an error. The user does not match.
+func (u *User) matchesMask(userMask, hostMask string) (bool, error) {
 	userRE, err := maskToRegex(userMask)
 	if err != nil {
-		log.Printf("matchesMask: %s", err)
-		return false
+		return false, fmt.Errorf("invalid user mask: %s: %s", userMask, err)
 	}
 	if !userRE.MatchString(u.Username) {
-		return false
+		return false, nil
+	}
+
+	// A CIDR host mask matches their IP only.
+	if _, ipNet, err := net.ParseCIDR(hostMask); err == nil {
+		ip := net.ParseIP(u.IP)
+		return ip != nil && ipNet.Contains(ip), nil
 	}
 
 	hostRE, err := maskToRegex(hostMask)
 	if err != nil {
-		log.Printf("matchesMask: %s", err)
-		return false
+		return false, fmt.Errorf("invalid host mask: %s: %s", hostMask, err)
 	}
-	return hostRE.MatchString(u.Hostname)
+
+	// The hostname may be cloaked, so check the IP as well.
+	return hostRE.MatchString(u.Hostname) || hostRE.MatchString(u.IP), nil
+}
+
+// acceptsMessagesFrom decides whether a user accepts a private message from
+// another user. Users with +g only accept messages from users on their accept
+// list.
+//
+// We only know the accept lists of local users. The user's server decides for
+// remote users.
+func (u *User) acceptsMessagesFrom(from *User) bool {
+	if _, exists := u.Modes['g']; !exists {
+		return true
+	}
+
+	if from.UID == u.UID {
+		return true
+	}
+
+	_, exists := u.AcceptList[from.UID]
+	return exists
 }
@@ -9,6 +9,7 @@ import (
 	"sort"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 // 50 from RFC
@@ -26,6 +27,13 @@ const maxUsernameLength = 10
 // This matches ratbox's.
 const maxRealNameLength = 50
 
+// This matches ratbox's.
+const maxKeyLength = 23
+
+// How long an invite lasts. We forget it after this if the user has not
+// joined.
+const inviteExpiry = 5 * time.Minute
+
 // ByHopCount is a sort type for sorting *Servers by their hop count
 type ByHopCount []*Server
 
@@ -79,11 +87,28 @@ func canonicalizeChannel(c string) string {
 // 1459 has a more restricted set. In particular, RFC 1459 does not allow
 // "special" characters to be in the first position in the nick, whereas RFC
 // 2812 does.
-func isValidNick(maxLen int, n string) bool {
+//
+// If validator is set (nick-valid-regex or nick-allow-unicode), we use it
+// instead of checking characters ourself. The nick must still not start with
+// - or a digit, and must not contain characters that would break messages or
+// masks.
+func isValidNick(maxLen int, validator *regexp.Regexp, n string) bool {
 	if len(n) == 0 || len(n) > maxLen {
 		return false
 	}
 
+	if validator != nil {
+		if n[0] == '-' || (n[0] >= '0' && n[0] <= '9') {
+			return false
+		}
+		for _, char := range n {
+			if char <= ' ' || strings.ContainsRune(NickForbiddenChars, char) {
+				return false
+			}
+		}
+		return validator.MatchString(n)
+	}
+
 	// First character may not be - or 0-9.
 
 	// Afterwards we permit these characters:
@@ -131,6 +156,33 @@ func isValidNick(maxLen int, n string) bool {
 	return true
 }
 
+// NickForbiddenChars are characters a nick may never have, even with
+// nick-valid-regex.
+const NickForbiddenChars = ",*?!@.:#$"
+
+// UnicodeNickRegex is the nick-allow-unicode pattern. It permits letters in
+// any script where we usually permit only A-Z and a-z.
+const UnicodeNickRegex = "^[\\p{L}\\[\\]\\\\^_`{|}][-0-9\\p{L}\\[\\]\\\\^_`{|}]*$"
+
+// newNickValidator compiles the regex to validate nicks with. It is nil if
+// we use the built in checks. nick-valid-regex takes precedence over
+// nick-allow-unicode.
+func newNickValidator(c *Config) (*regexp.Regexp, error) {
+	if c.NickValidRegex != "" {
+		re, err := regexp.Compile(c.NickValidRegex)
+		if err != nil {
+			return nil, fmt.Errorf("nick valid regex is not valid: %s", err)
+		}
+		return re, nil
+	}
+
+	if c.NickAllowUnicode {
+		return regexp.MustCompile(UnicodeNickRegex), nil
+	}
+
+	return nil, nil
+}
+
 // isValidUser checks if a user (USER command) is valid
 //
 // See valid_username() in ratbox's match.c to see what ratbox accepts. This
@@ -253,6 +305,27 @@ func isValidChannel(c string) bool {
 	return true
 }
 
+// isValidChannelKey checks a channel key (+k) looks okay.
+//
+// It must not contain characters that would confuse JOIN or mode parsing.
+func isValidChannelKey(k string) bool {
+	if len(k) == 0 || len(k) > maxKeyLength {
+		return false
+	}
+
+	if k[0] == ':' {
+		return false
+	}
+
+	for _, char := range k {
+		if char <= ' ' || char == ',' || char == 0x7f {
+			return false
+		}
+	}
+
+	return true
+}
+
 // isValidHostname is a basic check to determine if a host looks valid.
 // Very basic.
 func isValidHostname(s string) bool {
@@ -275,11 +348,16 @@ func isValidUserMask(s string) bool {
 }
 
 // Check if a string is a valid host mask.
-// This is a pattern with * or ? glob style characters.
+// This is a pattern with * or ? glob style characters, or a CIDR such as
+// 192.168.0.0/16.
 // It matches the host portion of a user@host
 //
 // TODO: Improve the host regex
 func isValidHostMask(s string) bool {
+	if _, _, err := net.ParseCIDR(s); err == nil {
+		return true
+	}
+
 	matched, err := regexp.MatchString("^[a-zA-Z0-9-.*?]+$", s)
 	if err != nil {
 		return false
@@ -287,6 +365,41 @@ func isValidHostMask(s string) bool {
 	return matched
 }
 
+// isKLineTooBroad decides whether a K-Line would match so many users that it
+// is most likely a mistake.
+//
+// If the user mask is only wildcards, host masks of *, *.*, IP masks with
+// fewer than two whole octets (e.g. 10.*), and CIDRs shorter than /16 are too
+// broad. *.example.com and 192.168.0.0/16 are fine. A user mask such as
+// ~victim makes any host mask fine.
+func isKLineTooBroad(userMask, hostMask string) bool {
+	if strings.Trim(userMask, "*?") != "" {
+		return false
+	}
+
+	if hostMask == "*" || hostMask == "*.*" {
+		return true
+	}
+
+	if _, ipNet, err := net.ParseCIDR(hostMask); err == nil {
+		ones, _ := ipNet.Mask.Size()
+		return ones < 16
+	}
+
+	// Masks made of only digits, dots, and wildcards are for IPv4 addresses.
+	// Their whole octets say how much of the address they pin down.
+	if strings.Trim(hostMask, "0123456789.*?") != "" {
+		return false
+	}
+	octets := 0
+	for _, octet := range strings.Split(hostMask, ".") {
+		if octet != "" && !strings.ContainsAny(octet, "*?") {
+			octets++
+		}
+	}
+	return octets < 2
+}
+
 func isNumericCommand(command string) bool {
 	for _, c := range command {
 		if c < 48 || c > 57 {
@@ -372,6 +485,42 @@ func makeTS6ID(id uint64) (TS6ID, error) {
 	return TS6ID(ts6id), nil
 }
 
+// stripColors removes mIRC color and formatting codes from text: Bold (2),
+// color (3), reset (15), reverse (22), and underline (31).
+//
+// A color code may be followed by a foreground color of one or two digits, and
+// then a comma and a background color of one or two digits. We remove these
+// too. We leave a comma if there is no foreground color or if no digit follows
+// it.
+func stripColors(text string) string {
+	var b strings.Builder
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case 2, 15, 22, 31:
+		case 3:
+			n := colorDigits(text[i+1:])
+			i += n
+			if n > 0 && i+2 < len(text) && text[i+1] == ',' {
+				if n := colorDigits(text[i+2:]); n > 0 {
+					i += 1 + n
+				}
+			}
+		default:
+			b.WriteByte(text[i])
+		}
+	}
+	return b.String()
+}
+
+// colorDigits counts the digits (at most two) at the start of s.
+func colorDigits(s string) int {
+	n := 0
+	for n < len(s) && n < 2 && s[n] >= '0' && s[n] <= '9' {
+		n++
+	}
+	return n
+}
+
 // Convert a mask to a regexp.
 // This quotes all regexp metachars, and then turns "*" into ".*", and "?"
 // into ".".
@@ -388,28 +537,43 @@ func maskToRegex(mask string) (*regexp.Regexp, error) {
 	return re, nil
 }
 
-var resolver = net.Resolver{
+// hostResolver is the part of net.Resolver we use to look up hostnames. Tests
+// replace the resolver.
+type hostResolver interface {
+	LookupAddr(context.Context, string) ([]string, error)
+	LookupIPAddr(context.Context, string) ([]net.IPAddr, error)
+}
+
+var resolver hostResolver = &net.Resolver{
 	PreferGo:     true,
 	StrictErrors: true,
 }
 
 // Attempt to resolve a client's IP to a hostname.
 //
-// This is a forward confirmed DNS lookup.
+// If requireForward is true, this is a forward confirmed DNS lookup.
 //
 // First we look up IP reverse DNS and find name(s).
 //
 // We then look up each of these name(s) and if one of them matches the IP,
 // then we say the client has that host.
 //
-// If none match, we return blank indicating no hostname found.
-func lookupHostname(ctx context.Context, ip net.IP) string {
+// If none match, we return blank indicating no hostname found. We also return
+// true if there were names but none resolved back to the IP.
+//
+// If requireForward is false, we take the first name without checking it.
+func lookupHostname(ctx context.Context, ip net.IP,
+	requireForward bool) (string, bool) {
 	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
 
 	names, err := resolver.LookupAddr(ctx, ip.String())
-	if err != nil {
-		return ""
+	if err != nil || len(names) == 0 {
+		return "", false
+	}
+
+	if !requireForward {
+		return strings.TrimSuffix(names[0], "."), false
 	}
 
 	for _, name := range names {
@@ -421,12 +585,12 @@ func lookupHostname(ctx context.Context, ip net.IP) string {
 		for _, foundIP := range ips {
 			if foundIP.IP.Equal(ip) {
 				// Drop trailing "."
-				return strings.TrimSuffix(name, ".")
+				return strings.TrimSuffix(name, "."), false
 			}
 		}
 	}
 
-	return ""
+	return "", true
 }
 
 func tlsVersionToString(version uint16) string {
@@ -550,13 +714,15 @@ func parseAndResolveUmodeChanges(modes string,
 	unknownModes := make(map[byte]struct{})
 
 	for mode := range requestSetModes {
-		if mode != 'i' && mode != 'o' && mode != 'C' {
+		if mode != 'i' && mode != 'o' && mode != 'w' && mode != 'C' &&
+			mode != 'g' {
 			delete(requestSetModes, mode)
 			unknownModes[mode] = struct{}{}
 		}
 	}
 	for mode := range requestUnsetModes {
-		if mode != 'i' && mode != 'o' && mode != 'C' {
+		if mode != 'i' && mode != 'o' && mode != 'w' && mode != 'C' &&
+			mode != 'g' {
 			delete(requestUnsetModes, mode)
 			unknownModes[mode] = struct{}{}
 		}
@@ -624,7 +790,7 @@ func parseAndResolveUmodeChanges(modes string,
 			}
 		}
 
-		if mode == 'i' {
+		if mode == 'i' || mode == 'w' || mode == 'g' {
 			currentModes[mode] = struct{}{}
 			setModes[mode] = struct{}{}
 			continue
@@ -701,18 +867,16 @@ func sortServersByHopCount(serverMap map[TS6SID]*Server) []*Server {
 	return servers
 }
 
+// mapServerColumn is the column we pad server names to with dashes in MAP
+// output so the user counts line up.
+const mapServerColumn = 50
+
 // Create a line for a response in the map command output.
 // Refer to mapCommand() for details.
 func serverToMapLine(name string, sid TS6SID, localUsers, globalUsers,
 	hopCount int) string {
-	// Each line is the same length.
-	lineLen := 74
-
 	// For each hop, add two spaces to indicate it's subordinate.
-	serverName := ""
-	for i := 0; i < hopCount; i++ {
-		serverName += "  "
-	}
+	serverName := strings.Repeat("  ", hopCount)
 
 	// irc.example.com[000]
 	serverName += fmt.Sprintf("%s[%s] ", name, string(sid))
@@ -723,20 +887,79 @@ func serverToMapLine(name string, sid TS6SID, localUsers, globalUsers,
 	globalCountString := fmt.Sprintf("%d", globalUsers)
 	userCountLenString := fmt.Sprintf("%d", len(globalCountString))
 
-	// Determine percentage of global users are on this server.
-	percent := float64(localUsers) / float64(globalUsers) * 100.0
+	// Determine percentage of global users are on this server. There may be
+	// none, such as when only services are around.
+	percent := 0.0
+	if globalUsers > 0 {
+		percent = float64(localUsers) / float64(globalUsers) * 100.0
+	}
 
 	// | Users: n (100.0%)
 	users := fmt.Sprintf(" | Users: %"+userCountLenString+"d (%5.1f%%)",
 		localUsers, percent)
 
-	// Pad dashes in between server name and user count.
-	numDashes := lineLen - len(serverName) - len(users)
-	dashes := ""
-	for i := 0; i < numDashes; i++ {
-		dashes += "-"
+	// Pad dashes in between server name and user count. Always have at least
+	// one even if the name is long.
+	numDashes := mapServerColumn - len(serverName)
+	if numDashes < 1 {
+		numDashes = 1
 	}
 
 	// irc.example.com[000] ---------- | Users: n (100.0%)
-	return serverName + dashes + users
+	return serverName + strings.Repeat("-", numDashes) + users
+}
+
+// cloakIP hides the part of an IP that identifies a particular host.
+//
+// For IPv4 we replace the last octet with x. For IPv6 we replace the last 64
+// bits with xxxx:xxxx:xxxx:xxxx.
+//
+// We return false if we are not configured to cloak this type of IP.
+func cloakIP(ip net.IP, cloakIPv4, cloakIPv6 bool) (string, bool) {
+	if ip4 := ip.To4(); ip4 != nil {
+		if !cloakIPv4 {
+			return "", false
+		}
+		return fmt.Sprintf("%d.%d.%d.x", ip4[0], ip4[1], ip4[2]), true
+	}
+
+	ip6 := ip.To16()
+	if ip6 == nil || !cloakIPv6 {
+		return "", false
+	}
+
+	return fmt.Sprintf("%x:%x:%x:%x:xxxx:xxxx:xxxx:xxxx",
+		uint16(ip6[0])<<8|uint16(ip6[1]),
+		uint16(ip6[2])<<8|uint16(ip6[3]),
+		uint16(ip6[4])<<8|uint16(ip6[5]),
+		uint16(ip6[6])<<8|uint16(ip6[7]),
+	), true
+}
+
+// truncateText cuts text to at most maxLen bytes. We don't cut a character in
+// half, so the result may be shorter.
+func truncateText(text string, maxLen int) string {
+	if len(text) <= maxLen {
+		return text
+	}
+
+	truncated := text[:maxLen]
+	for !utf8.ValidString(truncated) {
+		truncated = truncated[:len(truncated)-1]
+	}
+	return truncated
+}
+
+// formatUptime describes how long we've been up as STATS u shows it, e.g.
+// Server Up 3 days 04:05:06.
+func formatUptime(d time.Duration) string {
+	seconds := int64(d / time.Second)
+	if seconds < 0 {
+		seconds = 0
+	}
+	days := seconds / 86400
+	hours := seconds % 86400 / 3600
+	minutes := seconds % 3600 / 60
+	return fmt.Sprintf("Server Up %d days %02d:%02d:%02d", days, hours, minutes,
+		seconds%60)
 }
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// WatchListLineLength is about how many bytes of nicks we put in each 606
+// RPL_WATCHLIST.
+const WatchListLineLength = 400
+
+// watchCommand handles WATCH. Users watch nicks to hear when they come online
+// and go offline.
+//
+// Each parameter holds items separated by commas or spaces:
+//
+// +nick: Watch nick. We tell them whether it is online now.
+// -nick: Stop watching nick.
+// C: Clear the watch list.
+// L: List the watch list.
+// S: Show the status of each nick on the watch list.
+//
+// With no parameters, this is the same as L.
+func (u *LocalUser) watchCommand(m irc.Message) {
+	var items []string
+	for _, param := range m.Params {
+		items = append(items, strings.FieldsFunc(param, func(r rune) bool {
+			return r == ',' || r == ' '
+		})...)
+	}
+
+	if len(items) == 0 {
+		items = []string{"L"}
+	}
+
+	for _, item := range items {
+		switch {
+		case item[0] == '+':
+			if !u.addWatch(item[1:]) {
+				return
+			}
+		case item[0] == '-':
+			u.removeWatch(item[1:])
+		case strings.EqualFold(item, "C"):
+			u.User.WatchList = nil
+		case strings.EqualFold(item, "L"):
+			u.watchList()
+		case strings.EqualFold(item, "S"):
+			u.watchStatus()
+		}
+	}
+}
+
+// addWatch adds a nick to the user's watch list and tells them whether it is
+// online. It returns false if their list is full.
+func (u *LocalUser) addWatch(nick string) bool {
+	if !isValidNick(u.Catbox.Config.MaxNickLength, u.Catbox.NickValidator,
+		nick) {
+		// 432 ERR_ERRONEUSNICKNAME
+		u.messageFromServer("432", []string{nick, "Erroneous nickname"})
+		return true
+	}
+
+	canonicalNick := canonicalizeNick(nick)
+
+	if _, exists := u.User.WatchList[canonicalNick]; !exists {
+		if len(u.User.WatchList) >= u.Catbox.Config.MaxWatchSize {
+			// 512 ERR_TOOMANYWATCH
+			u.messageFromServer("512", []string{nick, fmt.Sprintf(
+				"Maximum size for WATCH-list is %d entries",
+				u.Catbox.Config.MaxWatchSize)})
+			return false
+		}
+
+		if u.User.WatchList == nil {
+			u.User.WatchList = make(map[string]struct{})
+		}
+		u.User.WatchList[canonicalNick] = struct{}{}
+	}
+
+	u.watchNickStatus(nick)
+	return true
+}
+
+// removeWatch takes a nick off the user's watch list.
+func (u *LocalUser) removeWatch(nick string) {
+	canonicalNick := canonicalizeNick(nick)
+	if _, exists := u.User.WatchList[canonicalNick]; !exists {
+		return
+	}
+	delete(u.User.WatchList, canonicalNick)
+
+	// 602 RPL_WATCHOFF
+	if user := u.Catbox.userByNick(nick); user != nil {
+		u.messageFromServer("602", []string{user.DisplayNick, user.Username,
+			user.Hostname, fmt.Sprintf("%d", user.NickTS), "stopped watching"})
+		return
+	}
+	u.messageFromServer("602", []string{nick, "*", "*", "0", "stopped watching"})
+}
+
+// watchList sends the user the nicks on their watch list.
+func (u *LocalUser) watchList() {
+	line := ""
+	for _, nick := range u.watchedNicks() {
+		if line != "" && len(line)+len(nick) >= WatchListLineLength {
+			// 606 RPL_WATCHLIST
+			u.messageFromServer("606", []string{line})
+			line = ""
+		}
+		if line != "" {
+			line += " "
+		}
+		line += nick
+	}
+	if line != "" {
+		// 606 RPL_WATCHLIST
+		u.messageFromServer("606", []string{line})
+	}
+
+	// 607 RPL_ENDOFWATCHLIST
+	u.messageFromServer("607", []string{"End of WATCH L"})
+}
+
+// watchStatus tells the user whether each nick on their watch list is
+// online.
+func (u *LocalUser) watchStatus() {
+	// How many users watch this user.
+	watchers := 0
+	canonicalNick := canonicalizeNick(u.User.DisplayNick)
+	for _, lu := range u.Catbox.LocalUsers {
+		if _, exists := lu.User.WatchList[canonicalNick]; exists {
+			watchers++
+		}
+	}
+
+	// 603 RPL_WATCHSTAT
+	u.messageFromServer("603", []string{fmt.Sprintf(
+		"You have %d and are on %d WATCH entries", len(u.User.WatchList),
+		watchers)})
+
+	for _, nick := range u.watchedNicks() {
+		u.watchNickStatus(nick)
+	}
+
+	// 607 RPL_ENDOFWATCHLIST
+	u.messageFromServer("607", []string{"End of WATCH S"})
+}
+
+// watchNickStatus tells the user whether a nick is online.
+func (u *LocalUser) watchNickStatus(nick string) {
+	if user := u.Catbox.userByNick(nick); user != nil {
+		// 604 RPL_NOWON
+		u.messageFromServer("604", []string{user.DisplayNick, user.Username,
+			user.Hostname, fmt.Sprintf("%d", user.NickTS), "is online"})
+		return
+	}
+
+	// 605 RPL_NOWOFF
+	u.messageFromServer("605", []string{nick, "*", "*", "0", "is offline"})
+}
+
+// watchedNicks returns the nicks on the user's watch list, sorted.
+func (u *LocalUser) watchedNicks() []string {
+	nicks := make([]string, 0, len(u.User.WatchList))
+	for nick := range u.User.WatchList {
+		nicks = append(nicks, nick)
+	}
+	sort.Strings(nicks)
+	return nicks
+}
+
+// userByNick finds the user with the nick, if there is one.
+func (cb *Catbox) userByNick(nick string) *User {
+	uid, exists := cb.Nicks[canonicalizeNick(nick)]
+	if !exists {
+		return nil
+	}
+	return cb.Users[uid]
+}
+
+// notifyWatchers tells local users watching the user's nick that the user came
+// online or went offline.
+func (cb *Catbox) notifyWatchers(user *User, online bool) {
+	canonicalNick := canonicalizeNick(user.DisplayNick)
+
+	for _, lu := range cb.LocalUsers {
+		if _, exists := lu.User.WatchList[canonicalNick]; !exists {
+			continue
+		}
+
+		if online {
+			// 600 RPL_LOGON
+			lu.messageFromServer("600", []string{user.DisplayNick, user.Username,
+				user.Hostname, fmt.Sprintf("%d", user.NickTS), "logged online"})
+			continue
+		}
+
+		// 601 RPL_LOGOFF
+		lu.messageFromServer("601", []string{user.DisplayNick, user.Username,
+			user.Hostname, fmt.Sprintf("%d", time.Now().Unix()), "logged offline"})
+	}
+}
+
+// notifyWatchersAway tells local users watching the user's nick that the user
+// went away or came back.
+//
+// These are UnrealIRCd's numerics. 604 and 605 say whether a nick is online,
+// so they don't suit this.
+func (cb *Catbox) notifyWatchersAway(user *User) {
+	canonicalNick := canonicalizeNick(user.DisplayNick)
+
+	for _, lu := range cb.LocalUsers {
+		if _, exists := lu.User.WatchList[canonicalNick]; !exists {
+			continue
+		}
+
+		if user.AwayMessage != "" {
+			// 598 RPL_GONEAWAY
+			lu.messageFromServer("598", []string{user.DisplayNick, user.Username,
+				user.Hostname, fmt.Sprintf("%d", time.Now().Unix()),
+				user.AwayMessage})
+			continue
+		}
+
+		// 599 RPL_NOTAWAY
+		lu.messageFromServer("599", []string{user.DisplayNick, user.Username,
+			user.Hostname, fmt.Sprintf("%d", time.Now().Unix()),
+			"is no longer away"})
+	}
+}
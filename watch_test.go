@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/horgh/irc"
+)
+
+func TestWatchCommand(t *testing.T) {
+	tests := []struct {
+		name   string
+		params []string
+		output []string
+		watch  []string
+	}{
+		{
+			"add online and offline nicks",
+			[]string{"-dave,+bob,+Carol"},
+			[]string{
+				"602 alice dave * * 0 stopped watching",
+				"604 alice bob user host.example.com 100 is online",
+				"605 alice Carol * * 0 is offline",
+			},
+			[]string{"bob", "carol"},
+		},
+		{
+			"add an invalid nick",
+			[]string{"+#bob"},
+			[]string{"432 alice #bob Erroneous nickname"},
+			[]string{"dave"},
+		},
+		{
+			"remove nicks",
+			[]string{"-dave", "-bob"},
+			[]string{"602 alice dave * * 0 stopped watching"},
+			nil,
+		},
+		{
+			"list",
+			[]string{"l"},
+			[]string{
+				"606 alice dave",
+				"607 alice End of WATCH L",
+			},
+			[]string{"dave"},
+		},
+		{
+			"no parameters lists",
+			nil,
+			[]string{
+				"606 alice dave",
+				"607 alice End of WATCH L",
+			},
+			[]string{"dave"},
+		},
+		{
+			"clear",
+			[]string{"C"},
+			nil,
+			nil,
+		},
+		{
+			"clear then add",
+			[]string{"C +bob"},
+			[]string{"604 alice bob user host.example.com 100 is online"},
+			[]string{"bob"},
+		},
+		{
+			"status",
+			[]string{"+bob", "s"},
+			[]string{
+				"604 alice bob user host.example.com 100 is online",
+				"603 alice You have 2 and are on 1 WATCH entries",
+				"604 alice bob user host.example.com 100 is online",
+				"605 alice dave * * 0 is offline",
+				"607 alice End of WATCH S",
+			},
+			[]string{"bob", "dave"},
+		},
+		{
+			"full",
+			[]string{"+bob,+carol,+erin"},
+			[]string{
+				"604 alice bob user host.example.com 100 is online",
+				"512 alice carol Maximum size for WATCH-list is 2 entries",
+			},
+			[]string{"bob", "dave"},
+		},
+	}
+
+	for _, test := range tests {
+		cb := newSnapshotCatbox()
+		cb.Config.MaxNickLength = 9
+		cb.Config.MaxWatchSize = 2
+		alice := addCallerIDTestUser(cb, 1, "alice")
+		alice.User.WatchList = map[string]struct{}{"dave": {}}
+		bob := addCallerIDTestUser(cb, 2, "bob")
+		bob.User.NickTS = 100
+		bob.User.WatchList = map[string]struct{}{"alice": {}}
+
+		alice.watchCommand(irc.Message{Command: "WATCH", Params: test.params})
+
+		if got := drainCommands(alice); strings.Join(got, "\n") !=
+			strings.Join(test.output, "\n") {
+			t.Errorf("%s: got %q, wanted %q", test.name, got, test.output)
+		}
+
+		watch := alice.watchedNicks()
+		if strings.Join(watch, " ") != strings.Join(test.watch, " ") {
+			t.Errorf("%s: watching %q, wanted %q", test.name, watch, test.watch)
+		}
+	}
+}
+
+// Long watch lists take more than one 606 RPL_WATCHLIST.
+func TestWatchListLines(t *testing.T) {
+	cb := newSnapshotCatbox()
+	alice := addCallerIDTestUser(cb, 1, "alice")
+	alice.User.WatchList = map[string]struct{}{}
+	for i := 0; i < 100; i++ {
+		alice.User.WatchList[fmt.Sprintf("nick%05d", i)] = struct{}{}
+	}
+
+	alice.watchList()
+
+	var nicks []string
+	lines := drainCommands(alice)
+	for _, line := range lines[:len(lines)-1] {
+		if len(line) > 512 {
+			t.Errorf("line is too long: %s", line)
+		}
+		fields := strings.Fields(line)
+		if fields[0] != "606" {
+			t.Fatalf("got %s, wanted 606", line)
+		}
+		nicks = append(nicks, fields[2:]...)
+	}
+	if len(lines) < 3 {
+		t.Errorf("got %d lines, wanted the list split up", len(lines))
+	}
+	if len(nicks) != 100 {
+		t.Errorf("listed %d nicks, wanted 100", len(nicks))
+	}
+}
+
+func TestNotifyWatchers(t *testing.T) {
+	cb := newSnapshotCatbox()
+	cb.Config.MaxNickLength = 9
+	alice := addCallerIDTestUser(cb, 1, "alice")
+	alice.User.WatchList = map[string]struct{}{"bob": {}, "robert": {}}
+	bob := addCallerIDTestUser(cb, 2, "bob")
+	carol := addCallerIDTestUser(cb, 3, "carol")
+
+	// A nick change is going offline as one nick and online as the other.
+	bob.nickCommand(irc.Message{Command: "NICK", Params: []string{"Robert"}})
+
+	got := drainCommands(alice)
+	if len(got) != 2 ||
+		!strings.HasPrefix(got[0], "601 alice bob user host.example.com ") ||
+		!strings.HasSuffix(got[0], " logged offline") ||
+		!strings.HasPrefix(got[1], "600 alice Robert user host.example.com ") ||
+		!strings.HasSuffix(got[1], " logged online") {
+		t.Errorf("watcher got %q on nick change", got)
+	}
+	if got := drainCommands(carol); len(got) != 0 {
+		t.Errorf("non-watcher got %q", got)
+	}
+
+	// Quitting.
+	bob.quit("Bye", false)
+
+	got = drainCommands(alice)
+	if len(got) != 1 ||
+		!strings.HasPrefix(got[0], "601 alice Robert user host.example.com ") {
+		t.Errorf("watcher got %q on quit", got)
+	}
+}
+
+func TestNotifyWatchersAway(t *testing.T) {
+	cb := newSnapshotCatbox()
+	link := addTraceTestLink(cb, 10, "irc2.example.com", "001")
+	alice := addCallerIDTestUser(cb, 1, "alice")
+	alice.User.WatchList = map[string]struct{}{"bob": {}, "carol": {}}
+	bob := addCallerIDTestUser(cb, 2, "bob")
+	carol := &User{DisplayNick: "carol", Username: "carol",
+		Hostname: "carol.example.com", UID: "001AAAAAA", ClosestServer: link,
+		Server: link.Server, Channels: map[string]*Channel{}}
+	cb.Users[carol.UID] = carol
+	cb.Nicks["carol"] = carol.UID
+
+	bob.awayCommand(irc.Message{Command: "AWAY", Params: []string{"Lunch"}})
+	got := drainCommands(alice)
+	if len(got) != 1 ||
+		!strings.HasPrefix(got[0], "598 alice bob user host.example.com ") ||
+		!strings.HasSuffix(got[0], " Lunch") {
+		t.Errorf("watcher got %q when bob went away", got)
+	}
+
+	bob.awayCommand(irc.Message{Command: "AWAY"})
+	got = drainCommands(alice)
+	if len(got) != 1 ||
+		!strings.HasPrefix(got[0], "599 alice bob user host.example.com ") ||
+		!strings.HasSuffix(got[0], " is no longer away") {
+		t.Errorf("watcher got %q when bob came back", got)
+	}
+
+	link.awayCommand(irc.Message{Prefix: string(carol.UID), Command: "AWAY",
+		Params: []string{"Gone"}})
+	got = drainCommands(alice)
+	if len(got) != 1 ||
+		!strings.HasPrefix(got[0], "598 alice carol carol carol.example.com ") {
+		t.Errorf("watcher got %q when remote carol went away", got)
+	}
+
+	// Bob is not watching anyone.
+	if got := drainCommands(bob); len(got) != 2 {
+		t.Errorf("bob got %q, wanted only 306 and 305", got)
+	}
+}
+
+// Users on the far side of a netsplit go offline, and come back online when
+// the server links again.
+func TestWatchNetsplit(t *testing.T) {
+	cb := newSnapshotCatbox()
+	cb.Config.MaxNickLength = 9
+	alice := addCallerIDTestUser(cb, 1, "alice")
+	alice.User.WatchList = map[string]struct{}{"bob": {}}
+
+	link := addTraceTestLink(cb, 10, "irc2.example.com", "001")
+	uid := irc.Message{Prefix: "001", Command: "UID", Params: []string{"bob",
+		"1", "100", "+i", "bob", "bob.example.com", "192.0.2.1", "001AAAAAA",
+		"Bob"}}
+	link.uidCommand(uid)
+	if got := drainCommands(alice); len(got) != 1 ||
+		got[0] != "600 alice bob bob bob.example.com 100 logged online" {
+		t.Errorf("watcher got %q when bob was introduced", got)
+	}
+
+	link.serverSplitCleanUp(link.Server)
+	if got := drainCommands(alice); len(got) != 1 ||
+		!strings.HasPrefix(got[0], "601 alice bob bob bob.example.com ") {
+		t.Errorf("watcher got %q on netsplit", got)
+	}
+
+	link = addTraceTestLink(cb, 11, "irc2.example.com", "001")
+	link.Bursting = true
+	link.uidCommand(uid)
+	if got := drainCommands(alice); len(got) != 1 ||
+		got[0] != "600 alice bob bob bob.example.com 100 logged online" {
+		t.Errorf("watcher got %q when bob came back in the burst", got)
+	}
+}
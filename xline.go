@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+
+	"github.com/horgh/irc"
+)
+
+// XLine holds an X-Line. This bans users by their real name (GECOS).
+type XLine struct {
+	// Regular expression matched against the real name.
+	Regex string `json:"regex"`
+
+	Reason string `json:"reason"`
+}
+
+// xlineCommand adds an X-Line.
+//
+// Parameters: <regex> <reason>
+func (u *LocalUser) xlineCommand(m irc.Message) {
+	if len(m.Params) < 2 {
+		// 461 ERR_NEEDMOREPARAMS
+		u.messageFromServer("461", []string{"XLINE", "Not enough parameters"})
+		return
+	}
+
+	if !u.User.isOperator() {
+		// 481 ERR_NOPRIVILEGES
+		u.messageFromServer("481", []string{"Permission Denied- You're not an IRC operator"})
+		return
+	}
+
+	xline := XLine{
+		Regex:  m.Params[0],
+		Reason: m.Params[1],
+	}
+
+	if _, err := regexp.Compile(xline.Regex); err != nil {
+		u.serverNotice(fmt.Sprintf("Invalid X-Line regex: %s", err))
+		return
+	}
+
+	// Propagate. Like KLINE this must be in ENCAP.
+	for _, server := range u.Catbox.LocalServers {
+		server.maybeQueueMessage(irc.Message{
+			Prefix:  string(u.User.UID),
+			Command: "ENCAP",
+			Params:  []string{"*", "XLINE", xline.Regex, xline.Reason},
+		})
+	}
+
+	u.Catbox.addAndApplyXLine(xline, u.User.DisplayNick)
+}
+
+// unxlineCommand removes an X-Line.
+//
+// Parameters: <regex>
+func (u *LocalUser) unxlineCommand(m irc.Message) {
+	if len(m.Params) < 1 {
+		// 461 ERR_NEEDMOREPARAMS
+		u.messageFromServer("461", []string{"UNXLINE", "Not enough parameters"})
+		return
+	}
+
+	if !u.User.isOperator() {
+		// 481 ERR_NOPRIVILEGES
+		u.messageFromServer("481", []string{"Permission Denied- You're not an IRC operator"})
+		return
+	}
+
+	u.Catbox.removeXLine(m.Params[0], u.User.DisplayNick)
+
+	// Propagate.
+	for _, server := range u.Catbox.LocalServers {
+		server.maybeQueueMessage(irc.Message{
+			Prefix:  string(u.User.UID),
+			Command: "ENCAP",
+			Params:  []string{"*", "UNXLINE", m.Params[0]},
+		})
+	}
+}
+
+// statsXLines lists the X-Lines for STATS x.
+func (u *LocalUser) statsXLines() {
+	for _, xline := range u.Catbox.XLines {
+		// 247 RPL_STATSXLINE
+		u.messageFromServer("247", []string{"X", xline.Regex, xline.Reason})
+	}
+
+	// 219 RPL_ENDOFSTATS
+	u.messageFromServer("219", []string{"X", "End of /STATS report"})
+}
+
+// XLINE <regex> <reason>
+//
+// This comes only inside ENCAP, so we don't need to propagate it.
+func (s *LocalServer) xlineCommand(m irc.Message) {
+	if len(m.Params) < 1 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"XLINE", "Not enough parameters"})
+		return
+	}
+
+	source := s.Catbox.sourceName(m.Prefix)
+	if source == "" {
+		s.Catbox.Logger.Warn("Unknown source for XLINE command")
+		return
+	}
+
+	reason := "<No reason given>"
+	if len(m.Params) > 1 {
+		reason = m.Params[1]
+	}
+
+	s.Catbox.addAndApplyXLine(XLine{Regex: m.Params[0], Reason: reason}, source)
+}
+
+// UNXLINE <regex>
+//
+// This comes only inside ENCAP, so we don't need to propagate it.
+func (s *LocalServer) unxlineCommand(m irc.Message) {
+	if len(m.Params) < 1 {
+		// 461 ERR_NEEDMOREPARAMS
+		s.messageFromServer("461", []string{"UNXLINE", "Not enough parameters"})
+		return
+	}
+
+	source := s.Catbox.sourceName(m.Prefix)
+	if source == "" {
+		s.Catbox.Logger.Warn("Unknown source for UNXLINE command")
+		return
+	}
+
+	s.Catbox.removeXLine(m.Params[0], source)
+}
+
+// sourceName finds the nick or server name for a UID or SID prefix. It is
+// blank if we don't know the source.
+func (cb *Catbox) sourceName(prefix string) string {
+	if user, exists := cb.Users[TS6UID(prefix)]; exists {
+		return user.DisplayNick
+	}
+	if server, exists := cb.Servers[TS6SID(prefix)]; exists {
+		return server.Name
+	}
+	return ""
+}
+
+// addAndApplyXLine adds an X-Line, saves it, and cuts off matching local
+// users.
+func (cb *Catbox) addAndApplyXLine(xline XLine, source string) {
+	for _, x := range cb.XLines {
+		if x.Regex == xline.Regex {
+			cb.noticeOpers(fmt.Sprintf("Ignoring duplicate X-Line for [%s] from %s",
+				xline.Regex, source))
+			return
+		}
+	}
+
+	re, err := regexp.Compile(xline.Regex)
+	if err != nil {
+		cb.noticeOpers(fmt.Sprintf("Ignoring invalid X-Line for [%s] from %s: %s",
+			xline.Regex, source, err))
+		return
+	}
+
+	cb.XLines = append(cb.XLines, xline)
+	cb.XLineRegexps = append(cb.XLineRegexps, re)
+	cb.saveXLines()
+
+	cb.noticeOpers(fmt.Sprintf("%s added X-Line for [%s] [%s]", source,
+		xline.Regex, xline.Reason))
+
+	quitReason := fmt.Sprintf("Connection closed: %s", xline.Reason)
+
+	for _, user := range cb.LocalUsers {
+		if !re.MatchString(user.User.RealName) {
+			continue
+		}
+
+		user.quit(quitReason, true)
+
+		cb.noticeOpers(fmt.Sprintf("User disconnected due to X-Line: %s",
+			user.User.DisplayNick))
+	}
+}
+
+// removeXLine removes the X-Line with the regex. It returns false if there was
+// no such X-Line.
+func (cb *Catbox) removeXLine(regex, source string) bool {
+	idx := -1
+	for i, xline := range cb.XLines {
+		if xline.Regex == regex {
+			idx = i
+			break
+		}
+	}
+
+	if idx == -1 {
+		cb.noticeOpers(fmt.Sprintf("Not removing X-Line for [%s] (not found)",
+			regex))
+		return false
+	}
+
+	cb.XLines = append(cb.XLines[:idx], cb.XLines[idx+1:]...)
+	cb.XLineRegexps = append(cb.XLineRegexps[:idx], cb.XLineRegexps[idx+1:]...)
+	cb.saveXLines()
+
+	cb.noticeOpers(fmt.Sprintf("%s removed X-Line for [%s]", source, regex))
+
+	return true
+}
+
+// matchXLine finds an X-Line matching the real name.
+func (cb *Catbox) matchXLine(realName string) (XLine, bool) {
+	for i, re := range cb.XLineRegexps {
+		if re.MatchString(realName) {
+			return cb.XLines[i], true
+		}
+	}
+	return XLine{}, false
+}
+
+// setXLines replaces our X-Lines. It compiles each one first and changes
+// nothing if any is invalid.
+func (cb *Catbox) setXLines(xlines []XLine) error {
+	regexps := make([]*regexp.Regexp, 0, len(xlines))
+	for _, xline := range xlines {
+		re, err := regexp.Compile(xline.Regex)
+		if err != nil {
+			return fmt.Errorf("invalid X-Line regex: %s: %s", xline.Regex, err)
+		}
+		regexps = append(regexps, re)
+	}
+
+	cb.XLines = xlines
+	cb.XLineRegexps = regexps
+	return nil
+}
+
+// reloadXLines takes the X-Line file from the new config, puts it in next, and
+// loads the X-Lines from it. This lets admins edit the file by hand.
+func (cb *Catbox) reloadXLines(next, cfg *Config) {
+	// Without a file there is nothing to load. Keep the X-Lines we have.
+	if cfg.XLineFile == "" {
+		next.XLineFile = ""
+		return
+	}
+
+	xlines, err := loadXLines(cfg.XLineFile)
+	if err != nil {
+		cb.noticeOpers(fmt.Sprintf("Rehash: Unable to load X-Lines: %s", err))
+		return
+	}
+
+	if err := cb.setXLines(xlines); err != nil {
+		cb.noticeOpers(fmt.Sprintf("Rehash: Unable to load X-Lines: %s", err))
+		return
+	}
+
+	next.XLineFile = cfg.XLineFile
+}
+
+// saveXLines writes our X-Lines to the X-Line file, if we have one.
+func (cb *Catbox) saveXLines() {
+	if cb.Config.XLineFile == "" {
+		return
+	}
+
+	if err := saveXLineFile(cb.Config.XLineFile, cb.XLines); err != nil {
+		cb.Logger.Error("Unable to save X-Lines: %s", err)
+		cb.noticeOpers(fmt.Sprintf("Unable to save X-Lines: %s", err))
+	}
+}
+
+// saveXLineFile writes X-Lines to the file as JSON.
+//
+// Like the state file, we write to a temporary file and then rename.
+func saveXLineFile(file string, xlines []XLine) error {
+	buf, err := json.MarshalIndent(xlines, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding X-Lines: %s", err)
+	}
+
+	tmpFile := file + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, buf, 0600); err != nil {
+		return fmt.Errorf("error writing X-Line file: %s", err)
+	}
+
+	if err := os.Rename(tmpFile, file); err != nil {
+		return fmt.Errorf("error renaming X-Line file: %s", err)
+	}
+
+	return nil
+}
+
+// loadXLines reads X-Lines from the file.
+//
+// It is not an error for the file to be blank or to not exist. In that case
+// there are no X-Lines.
+func loadXLines(file string) ([]XLine, error) {
+	if file == "" {
+		return []XLine{}, nil
+	}
+
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []XLine{}, nil
+		}
+		return nil, fmt.Errorf("error reading X-Line file: %s", err)
+	}
+
+	xlines := []XLine{}
+	if err := json.Unmarshal(buf, &xlines); err != nil {
+		return nil, fmt.Errorf("error decoding X-Line file: %s", err)
+	}
+
+	return xlines, nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/horgh/irc"
+)
+
+func TestMatchXLine(t *testing.T) {
+	cb := newSnapshotCatbox()
+	if err := cb.setXLines([]XLine{
+		{Regex: "^spam.*bot$", Reason: "No bots"},
+		{Regex: "(?i)free money", Reason: "No spam"},
+	}); err != nil {
+		t.Fatalf("error setting X-Lines: %s", err)
+	}
+
+	tests := []struct {
+		realName string
+		reason   string
+		matched  bool
+	}{
+		{"spambot", "No bots", true},
+		{"spam spam bot", "No bots", true},
+		{"a spambot", "", false},
+		{"Get FREE MONEY now", "No spam", true},
+		{"Alice", "", false},
+		{"", "", false},
+	}
+
+	for _, test := range tests {
+		xline, matched := cb.matchXLine(test.realName)
+		if matched != test.matched || xline.Reason != test.reason {
+			t.Errorf("matchXLine(%q) = %v, %v, wanted %s, %v", test.realName,
+				xline, matched, test.reason, test.matched)
+		}
+	}
+
+	if err := cb.setXLines([]XLine{{Regex: "(", Reason: "Bad"}}); err == nil {
+		t.Errorf("set an invalid X-Line")
+	}
+	if len(cb.XLines) != 2 || len(cb.XLineRegexps) != 2 {
+		t.Errorf("invalid X-Line changed the X-Lines")
+	}
+}
+
+func TestXLineCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catbox-xline-")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	cb := newSnapshotCatbox()
+	cb.Config.XLineFile = filepath.Join(dir, "xlines.json")
+	link := addTraceTestLink(cb, 10, "irc2.example.com", "001")
+	oper := addCallerIDTestUser(cb, 1, "oper")
+	oper.User.Modes['o'] = struct{}{}
+	alice := addCallerIDTestUser(cb, 2, "alice")
+	alice.User.RealName = "spambot"
+	bob := addCallerIDTestUser(cb, 3, "bob")
+	bob.User.RealName = "Bob"
+
+	oper.xlineCommand(irc.Message{Command: "XLINE",
+		Params: []string{"(", "Bad"}})
+	if got := drainCommands(oper); len(got) != 1 ||
+		!strings.HasPrefix(got[0], "NOTICE oper *** Notice --- Invalid X-Line regex: ") {
+		t.Errorf("invalid regex got %q", got)
+	}
+
+	oper.xlineCommand(irc.Message{Command: "XLINE",
+		Params: []string{"^spam.*bot$", "No bots"}})
+
+	// The X-Line goes out first and then the matching user's QUIT.
+	if len(link.WriteChan) != 2 {
+		t.Fatalf("sent %d messages to server, wanted 2", len(link.WriteChan))
+	}
+	m := (<-link.WriteChan).Message
+	if m.Prefix != string(oper.User.UID) || m.Command != "ENCAP" ||
+		strings.Join(m.Params, " ") != "* XLINE ^spam.*bot$ No bots" {
+		t.Errorf("propagated %v", m)
+	}
+	if m := (<-link.WriteChan).Message; m.Prefix != string(alice.User.UID) ||
+		m.Command != "QUIT" {
+		t.Errorf("sent %v, wanted the QUIT", m)
+	}
+
+	if _, exists := cb.LocalUsers[alice.ID]; exists {
+		t.Errorf("matching user is still connected")
+	}
+	if _, exists := cb.LocalUsers[bob.ID]; !exists {
+		t.Errorf("user who did not match was disconnected")
+	}
+
+	xlines, err := loadXLines(cb.Config.XLineFile)
+	if err != nil {
+		t.Fatalf("error loading X-Lines: %s", err)
+	}
+	if len(xlines) != 1 || xlines[0].Regex != "^spam.*bot$" ||
+		xlines[0].Reason != "No bots" {
+		t.Errorf("saved %v", xlines)
+	}
+
+	_ = drainCommands(oper)
+	oper.statsCommand(irc.Message{Command: "STATS", Params: []string{"x"}})
+	wanted := []string{
+		"247 oper X ^spam.*bot$ No bots",
+		"219 oper X End of /STATS report",
+	}
+	if got := drainCommands(oper); strings.Join(got, "\n") !=
+		strings.Join(wanted, "\n") {
+		t.Errorf("STATS x got %q, wanted %q", got, wanted)
+	}
+
+	oper.unxlineCommand(irc.Message{Command: "UNXLINE",
+		Params: []string{"^spam.*bot$"}})
+
+	if len(link.WriteChan) != 1 {
+		t.Fatalf("sent %d messages to server, wanted 1", len(link.WriteChan))
+	}
+	m = (<-link.WriteChan).Message
+	if strings.Join(m.Params, " ") != "* UNXLINE ^spam.*bot$" {
+		t.Errorf("propagated %v", m)
+	}
+	if len(cb.XLines) != 0 || len(cb.XLineRegexps) != 0 {
+		t.Errorf("X-Line was not removed")
+	}
+	xlines, err = loadXLines(cb.Config.XLineFile)
+	if err != nil {
+		t.Fatalf("error loading X-Lines: %s", err)
+	}
+	if len(xlines) != 0 {
+		t.Errorf("saved %v after removing", xlines)
+	}
+}
+
+func TestEncapXLine(t *testing.T) {
+	cb := newTraceTestCatbox("irc2.example.com", "001")
+	cb.Opers = map[TS6UID]*User{}
+	link21 := addTraceTestLink(cb, 1, "irc1.example.com", "000")
+	link23 := addTraceTestLink(cb, 2, "irc3.example.com", "002")
+	cb.Users["000AAAAAA"] = &User{DisplayNick: "oper", UID: "000AAAAAA",
+		Modes: map[byte]struct{}{'o': {}}, ClosestServer: link21}
+	alice := addCallerIDTestUser(cb, 1, "alice")
+	alice.User.RealName = "spambot"
+
+	m := irc.Message{Prefix: "000AAAAAA", Command: "ENCAP",
+		Params: []string{"*", "XLINE", "bot$", "No bots"}}
+	link21.encapCommand(m)
+
+	if _, matched := cb.matchXLine("spambot"); !matched {
+		t.Errorf("X-Line was not added")
+	}
+	if _, exists := cb.LocalUsers[alice.ID]; exists {
+		t.Errorf("matching user is still connected")
+	}
+	if len(link23.WriteChan) == 0 {
+		t.Errorf("did not propagate the X-Line")
+	}
+
+	link21.encapCommand(irc.Message{Prefix: "000AAAAAA", Command: "ENCAP",
+		Params: []string{"*", "UNXLINE", "bot$"}})
+	if _, matched := cb.matchXLine("spambot"); matched {
+		t.Errorf("X-Line was not removed")
+	}
+}
+
+func TestReloadXLines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catbox-xline-")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	file := filepath.Join(dir, "xlines.json")
+	if err := saveXLineFile(file, []XLine{
+		{Regex: "bot$", Reason: "No bots"},
+	}); err != nil {
+		t.Fatalf("error saving X-Lines: %s", err)
+	}
+
+	cb := newSnapshotCatbox()
+	cb.reloadXLines(cb.Config, &Config{XLineFile: file})
+	if _, matched := cb.matchXLine("spambot"); !matched {
+		t.Errorf("did not load the X-Line")
+	}
+
+	// A file with a bad regex leaves what we have.
+	if err := ioutil.WriteFile(file, []byte(`[{"regex":"(","reason":"Bad"}]`),
+		0600); err != nil {
+		t.Fatalf("error writing X-Line file: %s", err)
+	}
+	cb.reloadXLines(cb.Config, &Config{XLineFile: file})
+	if _, matched := cb.matchXLine("spambot"); !matched {
+		t.Errorf("lost the X-Line reloading a bad file")
+	}
+
+	// A file that does not exist has no X-Lines.
+	cb.reloadXLines(cb.Config, &Config{XLineFile: filepath.Join(dir, "missing.json")})
+	if len(cb.XLines) != 0 {
+		t.Errorf("have %d X-Lines after loading a missing file", len(cb.XLines))
+	}
+}